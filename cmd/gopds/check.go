@@ -0,0 +1,114 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/ab0oo/gopds/internal/database"
+	"github.com/ab0oo/gopds/internal/epubcheck"
+	"github.com/ab0oo/gopds/internal/organize"
+)
+
+// runCheck validates the structure of the given EPUBs, or of every EPUB in
+// the library, and exits 1 if any has errors.
+func runCheck(args []string) {
+	var asJSON, quiet bool
+	rest, closeLog := setup("gopds check", args, func(fs *flag.FlagSet) {
+		fs.BoolVar(&asJSON, "json", false, "print every report as a JSON array instead of text")
+		fs.BoolVar(&quiet, "quiet", false, "in text output, leave out warnings and list only books with errors")
+	})
+	defer closeLog()
+
+	var files []string
+	if len(rest) == 0 {
+		bookPath, _ := bookPathFromEnv()
+		library, err := realDir(bookPath)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "gopds check: library:", err)
+			os.Exit(2)
+		}
+		if files, err = organize.FindEPUBs(library); err != nil {
+			fmt.Fprintln(os.Stderr, "gopds check:", err)
+			os.Exit(1)
+		}
+	} else {
+		db := openDBIfExists()
+		for _, arg := range rest {
+			path, err := checkTarget(db, arg)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "gopds check:", err)
+				if db != nil {
+					db.Close()
+				}
+				os.Exit(2)
+			}
+			files = append(files, path)
+		}
+		if db != nil {
+			db.Close()
+		}
+	}
+
+	reports := make([]*epubcheck.Report, 0, len(files))
+	invalid, warned := 0, 0
+	for _, file := range files {
+		report := epubcheck.Check(file)
+		reports = append(reports, report)
+		if !report.Valid {
+			invalid++
+		} else if report.Warnings > 0 {
+			warned++
+		}
+		if asJSON || (report.Errors == 0 && (quiet || report.Warnings == 0)) {
+			continue
+		}
+		fmt.Printf("%s: %d errors, %d warnings\n", file, report.Errors, report.Warnings)
+		for _, issue := range report.Issues {
+			if quiet && issue.Severity != epubcheck.SeverityError {
+				continue
+			}
+			where := ""
+			if issue.Path != "" {
+				where = issue.Path + ": "
+			}
+			fmt.Printf("  %s [%s] %s%s\n", issue.Severity, issue.Code, where, issue.Message)
+		}
+	}
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(reports)
+	} else {
+		fmt.Printf("%d files, %d with errors, %d with warnings only\n", len(files), invalid, warned)
+	}
+	if invalid > 0 {
+		os.Exit(1)
+	}
+}
+
+// checkTarget finds the EPUB an argument names: a file path, or a book ID
+// in the database.
+func checkTarget(db *database.DB, arg string) (string, error) {
+	if info, err := os.Stat(arg); err == nil && !info.IsDir() {
+		return arg, nil
+	}
+	if _, err := strconv.Atoi(arg); err != nil {
+		return "", fmt.Errorf("%s: no such file", arg)
+	}
+	if db == nil {
+		return "", fmt.Errorf("no database at %s to look up book %s in", dbPathFromEnv(), arg)
+	}
+	book, err := db.GetBookByID(arg)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", fmt.Errorf("no book with ID %s", arg)
+	}
+	if err != nil {
+		return "", err
+	}
+	return book.Path, nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/ab0oo/gopds/internal/database"
+	"github.com/ab0oo/gopds/internal/scanner"
+	"github.com/ab0oo/gopds/internal/storage"
+	"github.com/ab0oo/gopds/internal/web"
+)
+
+// runCovers manages the cover cache.
+func runCovers(args []string) {
+	if len(args) == 0 || args[0] != "rebuild" {
+		fmt.Fprintln(os.Stderr, "Usage: gopds covers rebuild [-only-missing] [book ID...]")
+		os.Exit(2)
+	}
+	runCoversRebuild(args[1:])
+}
+
+// runCoversRebuild extracts covers again, as a scan does, for every book
+// or the ones named, and encodes them for the configured image formats.
+func runCoversRebuild(args []string) {
+	var onlyMissing bool
+	rest, closeLog := setup("gopds covers rebuild", args, func(fs *flag.FlagSet) {
+		fs.BoolVar(&onlyMissing, "only-missing", false, "only books with no cached cover, and formats not yet encoded")
+	})
+	defer closeLog()
+	dbPath := dbPathFromEnv()
+	if _, err := os.Stat(dbPath); err != nil {
+		slog.Error("no database to rebuild covers for", "path", dbPath, "err", err)
+		os.Exit(1)
+	}
+	db, err := database.New(dbPath)
+	if err != nil {
+		slog.Error("failed to open database", "path", dbPath, "err", err)
+		os.Exit(1)
+	}
+	defer db.Close()
+
+	var books []database.Book
+	if len(rest) > 0 {
+		for _, id := range rest {
+			book, err := db.GetBookByID(id)
+			if errors.Is(err, sql.ErrNoRows) {
+				fmt.Fprintf(os.Stderr, "gopds covers: no book with ID %s\n", id)
+				db.Close()
+				os.Exit(1)
+			}
+			if err != nil {
+				slog.Error("failed to look up book", "id", id, "err", err)
+				db.Close()
+				os.Exit(1)
+			}
+			books = append(books, *book)
+		}
+	} else if books, err = db.GetAllBooks(); err != nil {
+		slog.Error("failed to list books", "err", err)
+		db.Close()
+		os.Exit(1)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	extracted, kept, missing, failed := 0, 0, 0, 0
+	for _, book := range books {
+		if ctx.Err() != nil {
+			break
+		}
+		_, statErr := storage.Covers().Stat(ctx, scanner.CoverName(book.ID))
+		hasCover := statErr == nil
+		if !onlyMissing || !hasCover {
+			if err := scanner.SaveCover(book.Path, book.ID); err != nil {
+				if hasCover {
+					// Keep what is cached, which may be a cover chosen
+					// online that the EPUB can't be given.
+					fmt.Printf("kept book %d: %v\n", book.ID, err)
+					kept++
+				} else {
+					fmt.Printf("no cover for book %d: %v\n", book.ID, err)
+					missing++
+					continue
+				}
+			} else {
+				extracted++
+			}
+		}
+		if err := web.EncodeCover(ctx, book.ID); err != nil {
+			fmt.Printf("failed to encode book %d: %v\n", book.ID, err)
+			failed++
+		}
+	}
+	if extracted > 0 {
+		// Feeds link covers by content version, so a running server must
+		// render them again.
+		if err := db.BumpLibraryVersion(); err != nil {
+			slog.Warn("failed to bump library version", "err", err)
+		}
+	}
+	fmt.Printf("%d books, %d covers extracted, %d kept, %d without a cover, %d failed to encode\n", len(books), extracted, kept, missing, failed)
+	if ctx.Err() != nil {
+		db.Close()
+		os.Exit(1)
+	}
+}
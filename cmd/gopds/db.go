@@ -0,0 +1,144 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/ab0oo/gopds/internal/database"
+)
+
+const dbUsage = "Usage: gopds db backup [-o file] | vacuum | check [-quick] | migrate"
+
+// runDB wraps the database maintenance operations for scripts. Each can
+// run while the server is up.
+func runDB(args []string) {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, dbUsage)
+		os.Exit(2)
+	}
+	switch args[0] {
+	case "backup":
+		runDBBackup(args[1:])
+	case "vacuum":
+		runDBVacuum(args[1:])
+	case "check":
+		runDBCheck(args[1:])
+	case "migrate":
+		runDBMigrate(args[1:])
+	default:
+		fmt.Fprintln(os.Stderr, dbUsage)
+		os.Exit(2)
+	}
+}
+
+// openExistingDB opens the configured database for a maintenance command,
+// which should never create an empty one.
+func openExistingDB(name string, args []string, define func(*flag.FlagSet)) (*database.DB, string, func()) {
+	rest, closeLog := setup(name, args, define)
+	if len(rest) > 0 {
+		fmt.Fprintf(os.Stderr, "%s: unexpected argument %q\n", name, rest[0])
+		os.Exit(2)
+	}
+	dbPath := dbPathFromEnv()
+	if _, err := os.Stat(dbPath); err != nil {
+		slog.Error("no database", "path", dbPath, "err", err)
+		os.Exit(1)
+	}
+	db, err := database.New(dbPath)
+	if err != nil {
+		slog.Error("failed to open database", "path", dbPath, "err", err)
+		os.Exit(1)
+	}
+	return db, dbPath, func() {
+		db.Close()
+		closeLog()
+	}
+}
+
+func runDBBackup(args []string) {
+	var output string
+	db, dbPath, done := openExistingDB("gopds db backup", args, func(fs *flag.FlagSet) {
+		fs.StringVar(&output, "o", "", "file to write (default data/backups/gopds-<time>.db beside the database)")
+	})
+	defer done()
+	if output == "" {
+		dir := filepath.Join(filepath.Dir(dbPath), "backups")
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			slog.Error("failed to prepare backups directory", "err", err)
+			done()
+			os.Exit(1)
+		}
+		output = filepath.Join(dir, fmt.Sprintf("gopds-%s.db", time.Now().UTC().Format("20060102-150405")))
+	}
+	if _, err := os.Stat(output); err == nil {
+		fmt.Fprintf(os.Stderr, "gopds db backup: %s already exists\n", output)
+		done()
+		os.Exit(1)
+	}
+	if err := db.BackupTo(output); err != nil {
+		slog.Error("database backup failed", "err", err)
+		done()
+		os.Exit(1)
+	}
+	fmt.Println(output)
+}
+
+func runDBVacuum(args []string) {
+	db, dbPath, done := openExistingDB("gopds db vacuum", args, nil)
+	defer done()
+	before := fileSize(dbPath)
+	if err := db.Vacuum(); err != nil {
+		slog.Error("vacuum failed", "err", err)
+		done()
+		os.Exit(1)
+	}
+	fmt.Printf("%s: %s -> %s\n", dbPath, formatSize(before), formatSize(fileSize(dbPath)))
+}
+
+func runDBCheck(args []string) {
+	var quick bool
+	db, dbPath, done := openExistingDB("gopds db check", args, func(fs *flag.FlagSet) {
+		fs.BoolVar(&quick, "quick", false, "skip checking indexes against their tables, which is much faster")
+	})
+	defer done()
+	problems, err := db.Check(quick)
+	if err != nil {
+		slog.Error("integrity check failed to run", "err", err)
+		done()
+		os.Exit(1)
+	}
+	if len(problems) == 0 {
+		fmt.Printf("%s: ok\n", dbPath)
+		return
+	}
+	for _, p := range problems {
+		fmt.Println(p)
+	}
+	fmt.Printf("%s: %d problems; restore a backup, or use a full rebuild from the admin page\n", dbPath, len(problems))
+	done()
+	os.Exit(1)
+}
+
+// runDBMigrate brings the schema up to date. Opening the database applies
+// any pending changes, so this only needs to open it; it is for upgrades
+// scripted before the new server starts.
+func runDBMigrate(args []string) {
+	_, dbPath, done := openExistingDB("gopds db migrate", args, nil)
+	defer done()
+	fmt.Printf("%s: schema up to date\n", dbPath)
+}
+
+func fileSize(path string) int64 {
+	var total int64
+	// The write-ahead log holds changes not yet folded into the file.
+	for _, p := range []string{path, path + "-wal"} {
+		if info, err := os.Stat(p); err == nil {
+			total += info.Size()
+		}
+	}
+	return total
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ab0oo/gopds/internal/database"
+	"github.com/ab0oo/gopds/internal/organize"
+	"github.com/ab0oo/gopds/internal/scanner"
+)
+
+// dupeFile is one copy in a duplicate group.
+type dupeFile struct {
+	path    string
+	size    int64
+	modTime time.Time
+	book    *database.Book
+}
+
+// runDedupe finds byte-identical EPUBs in the library and can move the
+// redundant copies out of it.
+func runDedupe(args []string) {
+	var quarantine string
+	var dryRun bool
+	rest, closeLog := setup("gopds dedupe", args, func(fs *flag.FlagSet) {
+		fs.StringVar(&quarantine, "quarantine", "", "move redundant copies into this folder, outside the library")
+		fs.BoolVar(&dryRun, "dry-run", false, "with -quarantine, print what would be moved without moving anything")
+	})
+	defer closeLog()
+	if len(rest) > 0 {
+		fmt.Fprintf(os.Stderr, "gopds dedupe: unexpected argument %q\n", rest[0])
+		os.Exit(2)
+	}
+	bookPath, _ := bookPathFromEnv()
+	library, err := realDir(bookPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "gopds dedupe: library:", err)
+		os.Exit(2)
+	}
+	if quarantine != "" {
+		if quarantine, err = filepath.Abs(quarantine); err != nil {
+			fmt.Fprintln(os.Stderr, "gopds dedupe:", err)
+			os.Exit(2)
+		}
+		if real, err := filepath.EvalSymlinks(quarantine); err == nil {
+			quarantine = real
+		}
+		if within(library, quarantine) {
+			fmt.Fprintln(os.Stderr, "gopds dedupe: the quarantine folder must be outside the library, or the next scan indexes the copies again")
+			os.Exit(2)
+		}
+	}
+
+	db := openDBIfExists()
+	if db != nil {
+		defer db.Close()
+	}
+	groups, err := findDuplicates(db, library)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "gopds dedupe:", err)
+		os.Exit(1)
+	}
+
+	var redundant []dupeFile
+	var reclaimable int64
+	for _, g := range groups {
+		fmt.Printf("%d copies, %s:\n", len(g), formatSize(g[0].size))
+		for i, f := range g {
+			label := "keep"
+			if i > 0 {
+				label = "copy"
+				redundant = append(redundant, f)
+				reclaimable += f.size
+			}
+			if f.book != nil {
+				fmt.Printf("  %s %s (book %d)\n", label, relTo(library, f.path), f.book.ID)
+			} else {
+				fmt.Printf("  %s %s\n", label, relTo(library, f.path))
+			}
+		}
+	}
+	fmt.Printf("%d duplicate groups, %d redundant copies, %s reclaimable\n", len(groups), len(redundant), formatSize(reclaimable))
+	if quarantine == "" || len(redundant) == 0 {
+		return
+	}
+
+	if dryRun {
+		for _, f := range redundant {
+			fmt.Printf("would move %s -> %s\n", relTo(library, f.path), filepath.Join(quarantine, relTo(library, f.path)))
+		}
+		return
+	}
+	if err := os.MkdirAll(quarantine, 0o755); err != nil {
+		fmt.Fprintln(os.Stderr, "gopds dedupe:", err)
+		os.Exit(1)
+	}
+	journalPath := organize.JournalName(quarantine, time.Now())
+	journal, err := organize.CreateJournal(journalPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "gopds dedupe: journal:", err)
+		os.Exit(1)
+	}
+	failed := 0
+	for _, f := range redundant {
+		m := organize.Move{From: f.path, To: freePath(filepath.Join(quarantine, relTo(library, f.path)))}
+		createdDirs, err := organize.Apply(m)
+		if err != nil {
+			fmt.Printf("failed %s: %v\n", relTo(library, f.path), err)
+			failed++
+			continue
+		}
+		if err := journal.Record(m, createdDirs); err != nil {
+			fmt.Fprintln(os.Stderr, "gopds dedupe: journal:", err)
+			if err := organize.Undo(m, createdDirs); err != nil {
+				fmt.Printf("failed %s: moved to %s but not journaled: %v\n", relTo(library, f.path), m.To, err)
+			}
+			failed++
+			break
+		}
+		organize.RemoveEmptyDirs(library, f.path)
+		if f.book != nil {
+			if err := db.DeleteBook(f.book.ID); err != nil {
+				slog.Error("failed to remove quarantined book from the catalog", "book_id", f.book.ID, "err", err)
+			}
+		}
+		fmt.Printf("moved %s -> %s\n", relTo(library, f.path), m.To)
+	}
+	if err := journal.Close(); err != nil {
+		fmt.Fprintln(os.Stderr, "gopds dedupe: journal:", err)
+	}
+	fmt.Printf("To put them back: gopds organize -undo %q, then gopds scan\n", journalPath)
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// findDuplicates groups the library's EPUBs by content. Only files of the
+// same size are hashed, and a stored hash is reused while the file's
+// modification time matches the catalog. In each group, the copy to keep
+// comes first: the one in the catalog with the lowest ID, then the
+// oldest file.
+func findDuplicates(db *database.DB, library string) ([][]dupeFile, error) {
+	catalog := map[string]*database.Book{}
+	if db != nil {
+		err := db.ForEachBook(func(b database.Book) error {
+			catalog[b.Path] = &b
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	paths, err := organize.FindEPUBs(library)
+	if err != nil {
+		return nil, err
+	}
+	bySize := map[int64][]dupeFile{}
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		bySize[info.Size()] = append(bySize[info.Size()], dupeFile{path: path, size: info.Size(), modTime: info.ModTime(), book: catalog[path]})
+	}
+
+	byHash := map[string][]dupeFile{}
+	for _, files := range bySize {
+		if len(files) < 2 {
+			continue
+		}
+		for _, f := range files {
+			hash := ""
+			if f.book != nil && f.book.FileHash != "" && f.book.ModTime.Equal(f.modTime) {
+				hash = f.book.FileHash
+			} else if hash, err = scanner.HashFile(f.path); err != nil {
+				slog.Warn("dedupe: could not hash file", "path", f.path, "err", err)
+				continue
+			}
+			byHash[hash] = append(byHash[hash], f)
+		}
+	}
+
+	var groups [][]dupeFile
+	for _, g := range byHash {
+		if len(g) < 2 {
+			continue
+		}
+		sort.Slice(g, func(i, j int) bool {
+			a, b := g[i], g[j]
+			if (a.book != nil) != (b.book != nil) {
+				return a.book != nil
+			}
+			if a.book != nil && a.book.ID != b.book.ID {
+				return a.book.ID < b.book.ID
+			}
+			if !a.modTime.Equal(b.modTime) {
+				return a.modTime.Before(b.modTime)
+			}
+			return a.path < b.path
+		})
+		groups = append(groups, g)
+	}
+	sort.Slice(groups, func(i, j int) bool { return strings.ToLower(groups[i][0].path) < strings.ToLower(groups[j][0].path) })
+	return groups, nil
+}
+
+// freePath returns path, or path with " (2)", " (3)", ... before its
+// extension if that is taken.
+func freePath(path string) string {
+	ext := filepath.Ext(path)
+	stem := strings.TrimSuffix(path, ext)
+	candidate := path
+	for n := 2; ; n++ {
+		if _, err := os.Stat(candidate); os.IsNotExist(err) {
+			return candidate
+		}
+		candidate = fmt.Sprintf("%s (%d)%s", stem, n, ext)
+	}
+}
+
+func formatSize(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1f GB", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1f KB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%d bytes", n)
+}
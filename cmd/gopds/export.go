@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+
+	"github.com/ab0oo/gopds/internal/database"
+	"github.com/ab0oo/gopds/internal/web"
+)
+
+// runExport writes the catalog, as GET /api/export does, to stdout or a file.
+func runExport(args []string) {
+	var format, output string
+	rest, closeLog := setup("gopds export", args, func(fs *flag.FlagSet) {
+		fs.StringVar(&format, "format", "json", "csv, json, or ndjson")
+		fs.StringVar(&output, "o", "", "file to write (default stdout)")
+	})
+	defer closeLog()
+	if len(rest) > 0 {
+		fmt.Fprintf(os.Stderr, "gopds export: unexpected argument %q\n", rest[0])
+		os.Exit(2)
+	}
+	dbPath := dbPathFromEnv()
+	if _, err := os.Stat(dbPath); err != nil {
+		slog.Error("no database to export", "path", dbPath, "err", err)
+		os.Exit(1)
+	}
+	db, err := database.New(dbPath)
+	if err != nil {
+		slog.Error("failed to open database", "path", dbPath, "err", err)
+		os.Exit(1)
+	}
+	defer db.Close()
+
+	var w io.Writer = os.Stdout
+	var file *os.File
+	if output != "" && output != "-" {
+		if file, err = os.Create(output); err != nil {
+			slog.Error("failed to create export file", "path", output, "err", err)
+			os.Exit(1)
+		}
+		w = file
+	}
+	buf := bufio.NewWriter(w)
+	n, err := web.ExportBooks(db, buf, format)
+	if err == nil {
+		err = buf.Flush()
+	}
+	if file != nil {
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		slog.Error("export failed", "err", err)
+		db.Close()
+		os.Exit(1)
+	}
+	slog.Info("export complete", "books", n, "format", format)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/ab0oo/gopds/internal/config"
+	"github.com/ab0oo/gopds/internal/listen"
+)
+
+// runHealthcheck probes /healthz on the server this configuration would
+// start, over the same LISTEN_ADDR and TLS setup, and exits non-zero if it
+// doesn't answer. It is the Docker image's HEALTHCHECK, so the check
+// follows a changed port, a Unix socket, or HTTPS without editing it.
+func runHealthcheck(args []string) {
+	// Docker runs this every 30 seconds, so unlike setup it doesn't log the
+	// configuration or touch LOG_FILE, which belongs to the server; only
+	// warnings and errors go to stderr.
+	_, rest, err := config.Parse("gopds healthcheck", args, os.Stderr, nil)
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "gopds healthcheck:", err)
+		os.Exit(2)
+	}
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelWarn})))
+	if len(rest) > 0 {
+		fmt.Fprintf(os.Stderr, "gopds healthcheck: unexpected argument %q\n", rest[0])
+		os.Exit(2)
+	}
+	listenAddr := os.Getenv("LISTEN_ADDR")
+	if listenAddr == "" {
+		listenAddr = ":8880"
+	}
+	tlsConfig, err := listen.TLSFromEnv(filepath.Dir(dbPathFromEnv()))
+	if err != nil {
+		slog.Error("invalid tls configuration", "err", err)
+		os.Exit(1)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := listen.ProbeAddr(ctx, listenAddr, tlsConfig); err != nil {
+		slog.Error("health check failed", "addr", listenAddr, "err", err)
+		os.Exit(1)
+	}
+}
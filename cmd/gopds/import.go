@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/ab0oo/gopds/internal/database"
+	"github.com/ab0oo/gopds/internal/organize"
+	"github.com/ab0oo/gopds/internal/scanner"
+	"github.com/ab0oo/gopds/internal/settings"
+)
+
+// runImport checks, optionally organizes, and indexes a folder of new
+// EPUBs, printing a line per file, for cron jobs and download hooks.
+// ORGANIZE_ON_IMPORT makes organizing the default.
+func runImport(args []string) {
+	var dryRun, organizeBooks bool
+	var onConflict string
+	var flags *flag.FlagSet
+	rest, closeLog := setup("gopds import", args, func(fs *flag.FlagSet) {
+		flags = fs
+		fs.BoolVar(&dryRun, "dry-run", false, "report what would happen without moving or indexing anything")
+		fs.BoolVar(&organizeBooks, "organize", false, "move the books into the library, laid out by ORGANIZE_TEMPLATE (default ORGANIZE_ON_IMPORT)")
+		fs.StringVar(&onConflict, "on-conflict", string(organize.SkipConflicts), `with -organize, when a destination is taken: "skip" the book, or "suffix" it as "Title (2)"`)
+	})
+	defer closeLog()
+	// The config file is only read once the flags are parsed, so the
+	// setting can't be the flag's default.
+	organizeSet := false
+	flags.Visit(func(f *flag.Flag) { organizeSet = organizeSet || f.Name == "organize" })
+	if !organizeSet {
+		organizeBooks = os.Getenv("ORGANIZE_ON_IMPORT") == "true"
+	}
+	if len(rest) != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: gopds import [-organize] [-dry-run] <directory>")
+		os.Exit(2)
+	}
+	conflict, err := organize.ParseConflict(onConflict)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "gopds import:", err)
+		os.Exit(2)
+	}
+	tmpl, err := organize.ParseTemplate(os.Getenv("ORGANIZE_TEMPLATE"))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "gopds import:", err)
+		os.Exit(2)
+	}
+	dir, err := realDir(rest[0])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "gopds import:", err)
+		os.Exit(2)
+	}
+	bookPath, _ := bookPathFromEnv()
+	library, err := realDir(bookPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "gopds import: library:", err)
+		os.Exit(2)
+	}
+	if !organizeBooks && !within(library, dir) {
+		fmt.Fprintf(os.Stderr, "gopds import: %s is not inside the library (%s); use -organize to move the books there\n", dir, library)
+		os.Exit(2)
+	}
+
+	genreMap := genreMapFromEnv()
+	dbPath := dbPathFromEnv()
+	db, err := database.New(dbPath)
+	if err != nil {
+		slog.Error("failed to open database", "path", dbPath, "err", err)
+		os.Exit(1)
+	}
+	defer db.Close()
+
+	files, err := organize.FindEPUBs(dir)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "gopds import:", err)
+		db.Close()
+		os.Exit(1)
+	}
+
+	// Check each file: it must be a readable EPUB, and not a copy of a
+	// book already in the library.
+	failed, duplicates := 0, 0
+	var accepted []string
+	for _, path := range files {
+		if _, err := scanner.ExtractLiveMetadata(path); err != nil {
+			fmt.Printf("invalid %s: %v\n", relTo(dir, path), err)
+			failed++
+			continue
+		}
+		hash, err := scanner.HashFile(path)
+		if err != nil {
+			fmt.Printf("failed %s: %v\n", relTo(dir, path), err)
+			failed++
+			continue
+		}
+		if existing, err := db.GetBookByFileHash(hash); err == nil && existing.Path != path {
+			fmt.Printf("duplicate %s: same file as book %d (%s)\n", relTo(dir, path), existing.ID, existing.Path)
+			duplicates++
+			continue
+		} else if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			slog.Error("failed to look up file hash", "path", path, "err", err)
+		}
+		accepted = append(accepted, path)
+	}
+
+	if organizeBooks {
+		moves, skips, err := organize.PlanFiles(accepted, organize.Options{Dest: library, Template: tmpl, OnConflict: conflict})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "gopds import:", err)
+			db.Close()
+			os.Exit(1)
+		}
+		for _, s := range skips {
+			fmt.Printf("skipped %s: %s\n", relTo(dir, s.Path), s.Reason)
+		}
+		// Books the template already puts where they are stay in place
+		// and are indexed; skipped ones are not.
+		handled := map[string]bool{}
+		for _, s := range skips {
+			handled[s.Path] = true
+		}
+		for _, m := range moves {
+			handled[m.From] = true
+		}
+		var kept []string
+		for _, path := range accepted {
+			if !handled[path] && within(library, path) {
+				kept = append(kept, path)
+			}
+		}
+		accepted = kept
+		if dryRun {
+			for _, m := range moves {
+				fmt.Printf("would move %s -> %s%s\n", relTo(dir, m.From), relTo(library, m.To), renamedNote(m))
+				accepted = append(accepted, m.To)
+			}
+		} else if len(moves) > 0 {
+			journalPath := organize.JournalName(dir, time.Now())
+			journal, err := organize.CreateJournal(journalPath)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "gopds import: journal:", err)
+				db.Close()
+				os.Exit(1)
+			}
+			for i, m := range moves {
+				createdDirs, err := organize.Apply(m)
+				if err != nil {
+					fmt.Printf("failed %s: %v\n", relTo(dir, m.From), err)
+					failed++
+					continue
+				}
+				if err := journal.Record(m, createdDirs); err != nil {
+					fmt.Fprintln(os.Stderr, "gopds import: journal:", err)
+					if err := organize.Undo(m, createdDirs); err != nil {
+						fmt.Printf("failed %s: moved to %s but not journaled: %v\n", relTo(dir, m.From), m.To, err)
+					}
+					failed += len(moves) - i
+					break
+				}
+				organize.RemoveEmptyDirs(dir, m.From)
+				fmt.Printf("moved %s -> %s%s\n", relTo(dir, m.From), relTo(library, m.To), renamedNote(m))
+				accepted = append(accepted, m.To)
+			}
+			if err := journal.Close(); err != nil {
+				fmt.Fprintln(os.Stderr, "gopds import: journal:", err)
+			}
+			fmt.Printf("To undo the moves: gopds organize -undo %q\n", journalPath)
+		}
+	}
+
+	if dryRun {
+		for _, path := range accepted {
+			fmt.Printf("would index %s\n", relTo(library, path))
+		}
+		fmt.Println("dry run, nothing changed")
+		return
+	}
+
+	indexed := 0
+	if len(accepted) > 0 {
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		sc := scanner.New(db)
+		store := settings.New(db)
+		sc.CategorySource = store.Get(settings.CategorySource)
+		sc.BatchSize = store.Int(settings.ScanBatchSize)
+		sc.Throttle = store.ScanThrottle()
+		sc.Adult = genreMap.Adult
+		added, err := sc.IndexFiles(ctx, library, accepted)
+		if err != nil {
+			slog.Error("indexing failed", "err", err)
+			db.Close()
+			os.Exit(1)
+		}
+		isNew := map[string]bool{}
+		for _, b := range added {
+			isNew[b.Path] = true
+		}
+		for _, path := range accepted {
+			if real, err := filepath.EvalSymlinks(path); err == nil {
+				path = real
+			}
+			book, err := db.GetBookByPath(path)
+			switch {
+			case err != nil:
+				fmt.Printf("failed %s: not indexed\n", relTo(library, path))
+				failed++
+			case isNew[path]:
+				fmt.Printf("added %s (book %d)\n", relTo(library, path), book.ID)
+				indexed++
+			default:
+				fmt.Printf("indexed %s (book %d, already in the library)\n", relTo(library, path), book.ID)
+				indexed++
+			}
+		}
+	}
+	fmt.Printf("%d files, %d indexed, %d duplicates, %d failed\n", len(files), indexed, duplicates, failed)
+	if failed > 0 {
+		db.Close()
+		os.Exit(1)
+	}
+}
+
+// realDir returns path made absolute with symlinks resolved, if it is a
+// directory.
+func realDir(path string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	real, err := filepath.EvalSymlinks(abs)
+	if err != nil {
+		return "", err
+	}
+	if info, err := os.Stat(real); err != nil || !info.IsDir() {
+		return "", fmt.Errorf("%s is not a directory", path)
+	}
+	return real, nil
+}
+
+// within reports whether path is dir or inside it.
+func within(dir, path string) bool {
+	return path == dir || strings.HasPrefix(path, dir+string(filepath.Separator))
+}
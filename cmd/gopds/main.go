@@ -1,76 +1,180 @@
 package main
 
 import (
-	"context"
 	"embed"
-	"log"
-	"net/http"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
 	"os"
-	"os/signal"
-	"syscall"
-	"time"
+	"strings"
 
+	"github.com/ab0oo/gopds/internal/config"
 	"github.com/ab0oo/gopds/internal/database"
-	"github.com/ab0oo/gopds/internal/scanner"
-	"github.com/ab0oo/gopds/internal/web"
+	"github.com/ab0oo/gopds/internal/genres"
+	"github.com/ab0oo/gopds/internal/i18n"
+	"github.com/ab0oo/gopds/internal/logging"
+	"github.com/ab0oo/gopds/internal/organize"
+	"github.com/ab0oo/gopds/internal/storage"
 )
 
 //go:embed web/ui/*
 var uiFS embed.FS
 
+type command struct {
+	name    string
+	summary string
+	run     func(args []string)
+}
+
+// commands are gopds's subcommands. With no command, or only flags, gopds
+// serves, so existing service files and containers keep working.
+var commands []command
+
+func init() {
+	// Assigned here rather than in the declaration because serve's usage
+	// message lists the commands.
+	commands = []command{
+		{"serve", "run the OPDS server (the default)", runServe},
+		{"scan", "index the library once and exit", runScan},
+		{"watch", "index the library, then index new books as they arrive", runWatch},
+		{"import", "check, optionally organize, and index a folder of new books", runImport},
+		{"organize", "move loose EPUBs in a folder into a folder per book", runOrganize},
+		{"covers", "extract cached covers again (covers rebuild)", runCovers},
+		{"db", "back up, vacuum, check, or migrate the database", runDB},
+		{"check", "validate the structure of EPUBs in the library", runCheck},
+		{"dedupe", "find identical copies of books and quarantine the extras", runDedupe},
+		{"meta", "show or set a book's EPUB metadata", runMeta},
+		{"export", "write the catalog as JSON, NDJSON, or CSV", runExport},
+		{"healthcheck", "exit 0 if the configured server answers /healthz", runHealthcheck},
+	}
+}
+
 func main() {
-	// 1. Configuration from Environment Variables (Docker Friendly)
-	bookPath := os.Getenv("BOOK_PATH")
-	if bookPath == "" {
-		bookPath = "./books"
+	args := os.Args[1:]
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		runServe(args)
+		return
+	}
+	if args[0] == "help" {
+		printCommands(os.Stdout)
+		return
+	}
+	for _, c := range commands {
+		if c.name == args[0] {
+			c.run(args[1:])
+			return
+		}
 	}
-	dbPath := "./data/gopds.db"
+	fmt.Fprintf(os.Stderr, "gopds: unknown command %q\n\n", args[0])
+	printCommands(os.Stderr)
+	os.Exit(2)
+}
 
-	// 2. Initialize Database
-	db, err := database.New(dbPath)
-	if err != nil {
-		log.Fatalf("Failed to open database: %v", err)
+func printCommands(w io.Writer) {
+	fmt.Fprintln(w, "Usage: gopds [command] [flags]")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Commands:")
+	for _, c := range commands {
+		fmt.Fprintf(w, "  %-12s %s\n", c.name, c.summary)
 	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, `Run "gopds <command> -h" for a command's flags.`)
+}
 
-	// 3. Start Scanner in the background
-	s := scanner.New(db)
-	go func() {
-		if err := s.Start(bookPath); err != nil {
-			log.Printf("Scanner error: %v", err)
-		}
-	}()
+// usage prints the command list before the flags.
+func usage(fs *flag.FlagSet) func() {
+	return func() {
+		printCommands(fs.Output())
+		fmt.Fprintln(fs.Output())
+		fmt.Fprintln(fs.Output(), "Flags:")
+		fs.PrintDefaults()
+	}
+}
 
-	// 4. Setup Web Server
-	srv := web.NewServer(db, uiFS)
-	httpServer := &http.Server{
-		Addr:    ":8880",
-		Handler: srv.Router(),
+// setup loads a command's configuration: an optional YAML file, overridden
+// by environment variables, overridden by flags. The winners are exported
+// to the environment, which is where everything else reads them from. It
+// then starts logging and returns the arguments left after the flags, and
+// a function that closes the log file. It exits on -h or a bad
+// configuration.
+func setup(name string, args []string, define func(*flag.FlagSet)) ([]string, func()) {
+	cfg, rest, err := config.Parse(name, args, os.Stderr, define)
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "gopds:", err)
+		os.Exit(2)
 	}
 
-	// 5. Graceful Shutdown Logic
-	// Create a channel to listen for OS signals (SIGTERM, SIGINT)
-	stop := make(chan os.Signal, 1)
-	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	// Structured logs go to stderr (LOG_LEVEL, LOG_FORMAT), to LOG_FILE if
+	// set, and are also kept in memory for /api/admin/logs.
+	logFile, err := logging.FileFromEnv()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "gopds: log file:", err)
+		os.Exit(2)
+	}
+	closeLog := func() {}
+	if logFile != nil {
+		closeLog = func() { logFile.Close() }
+		logging.Setup(io.MultiWriter(os.Stderr, logFile))
+	} else {
+		logging.Setup(os.Stderr)
+	}
+	cfg.Log()
+	// Feed titles and error messages follow LANG.
+	i18n.SetupFromEnv()
+	if err := storage.ConfigureFromEnv(); err != nil {
+		fmt.Fprintln(os.Stderr, "gopds: remote libraries:", err)
+		os.Exit(2)
+	}
+	return rest, closeLog
+}
 
-	// Run the server in a goroutine so it doesn't block
-	go func() {
-		log.Printf("GoPDS is running on http://localhost:8880")
-		if err := httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatalf("Server failed: %v", err)
-		}
-	}()
+// bookPathFromEnv returns BOOK_PATH, or ./books and true if it is unset.
+func bookPathFromEnv() (string, bool) {
+	if bookPath := os.Getenv("BOOK_PATH"); bookPath != "" {
+		return bookPath, false
+	}
+	return "./books", true
+}
 
-	// Wait here until we receive a signal
-	<-stop
-	log.Println("Shutting down GoPDS...")
+func dbPathFromEnv() string {
+	if dbPath := os.Getenv("DB_PATH"); dbPath != "" {
+		return dbPath
+	}
+	return "./data/gopds.db"
+}
 
-	// Create a 5-second timeout for the shutdown process
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
+func genreMapFromEnv() *genres.Mapper {
+	genreMap, err := genres.FromEnv()
+	if err != nil {
+		slog.Error("invalid genre map", "err", err)
+		os.Exit(1)
+	}
+	return genreMap
+}
 
-	if err := httpServer.Shutdown(ctx); err != nil {
-		log.Printf("Server forced to shutdown: %v", err)
+// newBookPlacer returns the Placer that organizes books as they are added
+// when ORGANIZE_ON_IMPORT is set, or nil. It exits on a bad
+// ORGANIZE_TEMPLATE.
+func newBookPlacer(bookPath string) *organize.Placer {
+	placer, err := organize.PlacerFromEnv(bookPath)
+	if err != nil {
+		slog.Error("invalid organize template", "err", err)
+		os.Exit(1)
 	}
+	return placer
+}
 
-	log.Println("Exited cleanly.")
+// refreshAdultFlags re-derives adult-content flags from the stored
+// subjects, in case the keyword list changed since the last run.
+func refreshAdultFlags(db *database.DB, genreMap *genres.Mapper) {
+	if n, err := db.RefreshAdultFlags(genreMap.Adult); err != nil {
+		slog.Warn("failed to refresh adult-content flags", "err", err)
+	} else if n > 0 {
+		slog.Info("adult-content flags updated", "books", n)
+	}
 }
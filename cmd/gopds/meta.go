@@ -0,0 +1,258 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/ab0oo/gopds/internal/database"
+	"github.com/ab0oo/gopds/internal/scanner"
+	"github.com/ab0oo/gopds/internal/web"
+)
+
+// runMeta shows or edits a book's EPUB metadata, for scripted fixes.
+func runMeta(args []string) {
+	if len(args) == 0 || (args[0] != "show" && args[0] != "set") {
+		fmt.Fprintln(os.Stderr, "Usage: gopds meta show [-json] <file|id>")
+		fmt.Fprintln(os.Stderr, "       gopds meta set [-title=...] [-author=...] ... <file|id>")
+		os.Exit(2)
+	}
+	if args[0] == "show" {
+		runMetaShow(args[1:])
+		return
+	}
+	runMetaSet(args[1:])
+}
+
+func runMetaShow(args []string) {
+	var asJSON bool
+	rest, closeLog := setup("gopds meta show", args, func(fs *flag.FlagSet) {
+		fs.BoolVar(&asJSON, "json", false, "print JSON instead of one field per line")
+	})
+	defer closeLog()
+	if len(rest) != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: gopds meta show [-json] <file|id>")
+		os.Exit(2)
+	}
+	db := openDBIfExists()
+	if db != nil {
+		defer db.Close()
+	}
+	_, bookPath := resolveMetaTarget(db, rest[0])
+	meta, err := scanner.ExtractLiveMetadata(bookPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "gopds meta: %s: %v\n", bookPath, err)
+		os.Exit(1)
+	}
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(meta)
+		return
+	}
+	fmt.Printf("path: %s\n", bookPath)
+	for _, f := range []struct{ name, value string }{
+		{"title", meta.Title},
+		{"author", meta.Author},
+		{"author_sort", meta.AuthorSort},
+		{"language", meta.Language},
+		{"identifier", meta.Identifier},
+		{"publisher", meta.Publisher},
+		{"date", meta.Date},
+		{"series", meta.Series},
+		{"series_index", meta.SeriesIndex},
+		{"subjects", strings.Join(meta.Subjects, "; ")},
+		{"description", meta.Description},
+	} {
+		fmt.Printf("%s: %s\n", f.name, f.value)
+	}
+}
+
+// metaFields are the fields meta set can change, as flag name and help.
+var metaFields = []struct{ name, help string }{
+	{"title", "new title"},
+	{"author", "new author"},
+	{"language", "new language code, such as en"},
+	{"identifier", "new identifier, such as an ISBN"},
+	{"publisher", "new publisher"},
+	{"date", "new publication date"},
+	{"description", "new description"},
+	{"series", "new series; empty removes it"},
+	{"series-index", "new position in the series"},
+}
+
+func runMetaSet(args []string) {
+	// changes holds only the flags given, so an empty value clears a field
+	// while an absent one keeps it.
+	changes := map[string]string{}
+	var subjects []string
+	setSubjects := false
+	rest, closeLog := setup("gopds meta set", args, func(fs *flag.FlagSet) {
+		for _, f := range metaFields {
+			fs.Func(f.name, f.help, func(v string) error {
+				changes[f.name] = strings.TrimSpace(v)
+				return nil
+			})
+		}
+		fs.Func("subject", "a subject; repeat for several, which replace the current ones (-subject= clears them)", func(v string) error {
+			setSubjects = true
+			if v = strings.TrimSpace(v); v != "" {
+				subjects = append(subjects, v)
+			}
+			return nil
+		})
+	})
+	defer closeLog()
+	if len(rest) != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: gopds meta set [-title=...] [-author=...] ... <file|id>")
+		os.Exit(2)
+	}
+	if len(changes) == 0 && !setSubjects {
+		fmt.Fprintln(os.Stderr, "gopds meta set: nothing to change; see gopds meta set -h")
+		os.Exit(2)
+	}
+	if title, ok := changes["title"]; ok && title == "" {
+		fmt.Fprintln(os.Stderr, "gopds meta set: title cannot be empty")
+		os.Exit(2)
+	}
+
+	db := openDBIfExists()
+	if db != nil {
+		defer db.Close()
+	}
+	book, bookPath := resolveMetaTarget(db, rest[0])
+	before, err := scanner.ExtractLiveMetadata(bookPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "gopds meta: %s: %v\n", bookPath, err)
+		os.Exit(1)
+	}
+
+	update := scanner.MetadataUpdate{
+		Title:       before.Title,
+		Creator:     before.Author,
+		Language:    before.Language,
+		Identifier:  before.Identifier,
+		Publisher:   before.Publisher,
+		Date:        before.Date,
+		Description: before.Description,
+		Subjects:    before.Subjects,
+		Series:      before.Series,
+		SeriesIndex: before.SeriesIndex,
+	}
+	for name, field := range map[string]*string{
+		"title":        &update.Title,
+		"author":       &update.Creator,
+		"language":     &update.Language,
+		"identifier":   &update.Identifier,
+		"publisher":    &update.Publisher,
+		"date":         &update.Date,
+		"description":  &update.Description,
+		"series":       &update.Series,
+		"series-index": &update.SeriesIndex,
+	} {
+		if v, ok := changes[name]; ok {
+			*field = v
+		}
+	}
+	if setSubjects {
+		update.Subjects = subjects
+	}
+	if update.Creator == "" {
+		update.Creator = "Unknown Author"
+	}
+
+	var after *scanner.EPUBMetadata
+	if book != nil {
+		after, err = web.ApplyMetadataUpdate(db, genreMapFromEnv(), book, bookPath, update)
+	} else {
+		after, err = scanner.UpdateEPUBMetadata(bookPath, update)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "gopds meta: %s: %v\n", bookPath, err)
+		os.Exit(1)
+	}
+	if book == nil {
+		fmt.Printf("updated %s (not in the library database; the next scan picks it up)\n", bookPath)
+		return
+	}
+	// Recorded like a web edit, so it shows in the book's history and can
+	// be reverted there.
+	beforeJSON, _ := json.Marshal(before)
+	afterJSON, _ := json.Marshal(after)
+	if _, err := db.AddAuditEntry(database.AuditEntry{
+		BookID: book.ID,
+		Actor:  "cli",
+		Action: database.AuditActionMetadata,
+		Before: beforeJSON,
+		After:  afterJSON,
+	}); err != nil {
+		slog.Error("audit: failed to record metadata change", "book_id", book.ID, "err", err)
+	}
+	fmt.Printf("updated book %d: %s\n", book.ID, bookPath)
+}
+
+// openDBIfExists opens the library database, or returns nil if there is
+// none yet, so the meta commands also work on loose files.
+func openDBIfExists() *database.DB {
+	dbPath := dbPathFromEnv()
+	if _, err := os.Stat(dbPath); err != nil {
+		return nil
+	}
+	db, err := database.New(dbPath)
+	if err != nil {
+		slog.Error("failed to open database", "path", dbPath, "err", err)
+		os.Exit(1)
+	}
+	return db
+}
+
+// resolveMetaTarget finds the EPUB an argument names: a file path, or a
+// book ID in the database. The book is nil if the file isn't in the
+// database.
+func resolveMetaTarget(db *database.DB, arg string) (*database.Book, string) {
+	if info, err := os.Stat(arg); err == nil && !info.IsDir() {
+		if db == nil {
+			return nil, arg
+		}
+		for _, candidate := range []string{arg, filepath.Clean(arg)} {
+			if book, err := db.GetBookByPath(candidate); err == nil {
+				return book, arg
+			}
+		}
+		if abs, err := filepath.Abs(arg); err == nil {
+			if book, err := db.GetBookByPath(abs); err == nil {
+				return book, arg
+			}
+		}
+		return nil, arg
+	}
+	if _, err := strconv.Atoi(arg); err != nil {
+		fmt.Fprintf(os.Stderr, "gopds meta: %s: no such file\n", arg)
+		os.Exit(1)
+	}
+	if db == nil {
+		fmt.Fprintf(os.Stderr, "gopds meta: no database at %s to look up book %s in\n", dbPathFromEnv(), arg)
+		os.Exit(1)
+	}
+	book, err := db.GetBookByID(arg)
+	if errors.Is(err, sql.ErrNoRows) {
+		fmt.Fprintf(os.Stderr, "gopds meta: no book with ID %s\n", arg)
+		os.Exit(1)
+	}
+	if err != nil {
+		slog.Error("failed to look up book", "id", arg, "err", err)
+		os.Exit(1)
+	}
+	if _, err := os.Stat(book.Path); err != nil {
+		fmt.Fprintf(os.Stderr, "gopds meta: book %s: %v\n", arg, err)
+		os.Exit(1)
+	}
+	return book, book.Path
+}
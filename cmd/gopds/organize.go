@@ -0,0 +1,175 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/ab0oo/gopds/internal/organize"
+)
+
+// runOrganize moves the loose EPUBs in one folder, typically an author's,
+// into a folder per book named after its title or into the layout
+// ORGANIZE_TEMPLATE describes, or with -undo puts a previous run's books
+// back.
+func runOrganize(args []string) {
+	var dryRun, recursive bool
+	var onConflict, journalPath, undo string
+	rest, closeLog := setup("gopds organize", args, func(fs *flag.FlagSet) {
+		fs.BoolVar(&dryRun, "dry-run", false, "print what would be moved without moving anything")
+		fs.BoolVar(&recursive, "recursive", false, "also move books in subfolders, to lay out a whole library anew")
+		fs.StringVar(&onConflict, "on-conflict", string(organize.SkipConflicts), `when a destination is taken: "skip" the book, or "suffix" it as "Title (2)"`)
+		fs.StringVar(&journalPath, "journal", "", "file to record the moves in, for -undo (default <directory>/.gopds-organize-<time>.jsonl)")
+		fs.StringVar(&undo, "undo", "", "undo the run recorded in this journal file")
+	})
+	defer closeLog()
+	if undo != "" {
+		if len(rest) > 0 {
+			fmt.Fprintf(os.Stderr, "gopds organize: unexpected argument %q with -undo\n", rest[0])
+			os.Exit(2)
+		}
+		undoOrganize(undo, dryRun)
+		return
+	}
+	if len(rest) != 1 {
+		fmt.Fprintln(os.Stderr, `Usage: gopds organize [flags] <directory>`)
+		fmt.Fprintln(os.Stderr, `       gopds organize -undo <journal>`)
+		fmt.Fprintln(os.Stderr, `Example: gopds organize -dry-run "/share/Multimedia/Books/Anne McCaffrey"`)
+		os.Exit(2)
+	}
+	conflict, err := organize.ParseConflict(onConflict)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "gopds organize:", err)
+		os.Exit(2)
+	}
+	tmpl, err := organize.ParseTemplate(os.Getenv("ORGANIZE_TEMPLATE"))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "gopds organize:", err)
+		os.Exit(2)
+	}
+	dir, err := filepath.Abs(rest[0])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "gopds organize:", err)
+		os.Exit(2)
+	}
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		fmt.Fprintf(os.Stderr, "gopds organize: %s is not a directory\n", dir)
+		os.Exit(2)
+	}
+
+	moves, skips, err := organize.Plan(dir, organize.Options{Template: tmpl, OnConflict: conflict, Recursive: recursive})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "gopds organize:", err)
+		os.Exit(1)
+	}
+	for _, s := range skips {
+		fmt.Printf("skipped %s: %s\n", relTo(dir, s.Path), s.Reason)
+	}
+	if dryRun {
+		for _, m := range moves {
+			fmt.Printf("would move %s -> %s%s\n", relTo(dir, m.From), relTo(dir, m.To), renamedNote(m))
+		}
+		fmt.Printf("%d to move, %d skipped (dry run, nothing changed)\n", len(moves), len(skips))
+		return
+	}
+	if len(moves) == 0 {
+		fmt.Printf("0 moved, %d skipped\n", len(skips))
+		return
+	}
+
+	if journalPath == "" {
+		journalPath = organize.JournalName(dir, time.Now())
+	}
+	journal, err := organize.CreateJournal(journalPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "gopds organize: journal:", err)
+		os.Exit(1)
+	}
+	failed := 0
+	for i, m := range moves {
+		createdDirs, err := organize.Apply(m)
+		if err != nil {
+			fmt.Printf("failed %s: %v\n", relTo(dir, m.From), err)
+			failed++
+			continue
+		}
+		if err := journal.Record(m, createdDirs); err != nil {
+			// Put this book back and stop, so the journal covers every
+			// move made.
+			fmt.Fprintln(os.Stderr, "gopds organize: journal:", err)
+			if err := organize.Undo(m, createdDirs); err != nil {
+				fmt.Printf("moved %s -> %s, but it is not in the journal: %v\n", filepath.Base(m.From), relTo(dir, m.To), err)
+				failed--
+			}
+			failed += len(moves) - i
+			break
+		}
+		organize.RemoveEmptyDirs(dir, m.From)
+		fmt.Printf("moved %s -> %s%s\n", relTo(dir, m.From), relTo(dir, m.To), renamedNote(m))
+	}
+	if err := journal.Close(); err != nil {
+		fmt.Fprintln(os.Stderr, "gopds organize: journal:", err)
+	}
+	moved := len(moves) - failed
+	fmt.Printf("%d moved, %d skipped, %d failed\n", moved, len(skips), failed)
+	if moved > 0 {
+		fmt.Printf("To undo: gopds organize -undo %q\n", journalPath)
+		fmt.Println("Delete any cover.jpg the books used to share before rescanning, or they will all get that cover.")
+	}
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// undoOrganize moves the books recorded in a journal back, newest first,
+// and deletes the journal once every one is back.
+func undoOrganize(path string, dryRun bool) {
+	entries, err := organize.ReadJournal(path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "gopds organize:", err)
+		os.Exit(1)
+	}
+	failed := 0
+	for i := len(entries) - 1; i >= 0; i-- {
+		e := entries[i]
+		if dryRun {
+			fmt.Printf("would restore %s -> %s\n", e.To, e.From)
+			continue
+		}
+		if err := organize.Undo(e.Move, e.CreatedDirs); err != nil {
+			fmt.Printf("failed %s: %v\n", e.To, err)
+			failed++
+			continue
+		}
+		fmt.Printf("restored %s -> %s\n", e.To, e.From)
+	}
+	if dryRun {
+		fmt.Printf("%d to restore (dry run, nothing changed)\n", len(entries))
+		return
+	}
+	fmt.Printf("%d restored, %d failed\n", len(entries)-failed, failed)
+	if failed > 0 {
+		// Keep the journal; undoing again retries the failures, and
+		// reports the restored books as missing.
+		os.Exit(1)
+	}
+	if err := os.Remove(path); err != nil {
+		fmt.Fprintln(os.Stderr, "gopds organize: journal:", err)
+	}
+}
+
+func relTo(dir, path string) string {
+	if rel, err := filepath.Rel(dir, path); err == nil {
+		return rel
+	}
+	return path
+}
+
+func renamedNote(m organize.Move) string {
+	if m.Renamed {
+		return " (renamed, destination taken)"
+	}
+	return ""
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/ab0oo/gopds/internal/database"
+	"github.com/ab0oo/gopds/internal/scanner"
+	"github.com/ab0oo/gopds/internal/settings"
+)
+
+// runScan indexes the library once, as the server's startup scan does, for
+// cron jobs and first imports. It can run beside a server on the same
+// database; the server sees the new books at once.
+func runScan(args []string) {
+	rest, closeLog := setup("gopds scan", args, nil)
+	defer closeLog()
+	if len(rest) > 0 {
+		fmt.Fprintf(os.Stderr, "gopds scan: unexpected argument %q\n", rest[0])
+		os.Exit(2)
+	}
+	bookPath, _ := bookPathFromEnv()
+	dbPath := dbPathFromEnv()
+	genreMap := genreMapFromEnv()
+
+	db, err := database.New(dbPath)
+	if err != nil {
+		slog.Error("failed to open database", "path", dbPath, "err", err)
+		os.Exit(1)
+	}
+	defer db.Close()
+	refreshAdultFlags(db, genreMap)
+
+	// Ctrl-C stops the walk; the books indexed so far are kept.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	sc := scanner.New(db)
+	store := settings.New(db)
+	sc.CategorySource = store.Get(settings.CategorySource)
+	sc.BatchSize = store.Int(settings.ScanBatchSize)
+	sc.Throttle = store.ScanThrottle()
+	sc.Adult = genreMap.Adult
+	// The first scan of an empty library indexes books that were already
+	// there, so it leaves them where they are.
+	if placer := newBookPlacer(bookPath); placer != nil {
+		defer placer.Close()
+		if n, _ := db.CountBooks(); n > 0 {
+			sc.Place = placer.Place
+		}
+	}
+	if err := sc.StartAll(ctx, bookPath); err != nil {
+		slog.Error("scan failed", "path", bookPath, "err", err)
+		db.Close()
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/ab0oo/gopds/internal/database"
+	"github.com/ab0oo/gopds/internal/diagnostics"
+	"github.com/ab0oo/gopds/internal/jobs"
+	"github.com/ab0oo/gopds/internal/listen"
+	"github.com/ab0oo/gopds/internal/settings"
+	"github.com/ab0oo/gopds/internal/storage"
+	"github.com/ab0oo/gopds/internal/systemd"
+	"github.com/ab0oo/gopds/internal/upstream"
+	"github.com/ab0oo/gopds/internal/web"
+	"github.com/ab0oo/gopds/internal/webhooks"
+)
+
+// runServe runs the OPDS server until SIGINT or SIGTERM.
+func runServe(args []string) {
+	// 1. Configuration: an optional YAML file, overridden by environment
+	// variables, overridden by flags.
+	rest, closeLog := setup("gopds", args, func(fs *flag.FlagSet) { fs.Usage = usage(fs) })
+	defer closeLog()
+	if len(rest) > 0 {
+		fmt.Fprintf(os.Stderr, "gopds: unexpected argument %q\n", rest[0])
+		os.Exit(2)
+	}
+	bookPath, bookPathDefaulted := bookPathFromEnv()
+	dbPath := dbPathFromEnv()
+	listenAddr := os.Getenv("LISTEN_ADDR")
+	if listenAddr == "" {
+		listenAddr = ":8880"
+	}
+
+	// HTTPS is optional; most installs terminate TLS at a reverse proxy.
+	tlsConfig, err := listen.TLSFromEnv(filepath.Dir(dbPath))
+	if err != nil {
+		slog.Error("invalid tls configuration", "err", err)
+		os.Exit(1)
+	}
+
+	// External metadata and cover lookups share one client.
+	lookups, err := upstream.FromEnv()
+	if err != nil {
+		slog.Error("invalid upstream configuration", "err", err)
+		os.Exit(1)
+	}
+
+	genreMap := genreMapFromEnv()
+
+	// Refuse to start against a missing library or an unwritable data
+	// folder rather than scan nothing or fail on the first write.
+	checker := &diagnostics.Checker{
+		BookPath:          bookPath,
+		BookPathDefaulted: bookPathDefaulted,
+		DataDir:           filepath.Dir(dbPath),
+		WriteDirs:         web.WriteDirs(),
+	}
+	if dir, ok := storage.LocalDir(storage.Covers()); ok {
+		checker.WriteDirs = append(checker.WriteDirs, dir)
+	}
+	if report := checker.Run(context.Background()); !report.OK {
+		report.Log()
+		os.Exit(1)
+	}
+
+	// 2. Initialize Database
+	db, err := database.New(dbPath)
+	if err != nil {
+		slog.Error("failed to open database", "path", dbPath, "err", err)
+		os.Exit(1)
+	}
+	runtimeSettings := settings.New(db)
+	checker.DB = db
+	checker.Online = func() bool { return !runtimeSettings.Bool(settings.OfflineMode) }
+	report := checker.Run(context.Background())
+	report.Log()
+	if !report.OK {
+		os.Exit(1)
+	}
+	refreshAdultFlags(db, genreMap)
+
+	// 3. Start the background job workers and queue the startup scan. The
+	// root context is cancelled on SIGINT/SIGTERM, which stops scans and
+	// other jobs as well as the schedules that queue them.
+	rootCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	jobManager := jobs.New(db, 2)
+	hooks := webhooks.New(db)
+
+	// 4. Setup Web Server
+	srv := web.NewServer(db, uiFS, jobManager, hooks, lookups, checker, genreMap)
+	jobManager.Start(rootCtx)
+	hooks.Start(rootCtx)
+	go srv.RunScanSchedule(rootCtx)
+	go srv.RunIntegritySchedule(rootCtx)
+	go srv.RunPurgeSchedule(rootCtx)
+	go srv.RunLibraryMonitor(rootCtx)
+	go srv.RunMaintenance(rootCtx)
+	go srv.RunDigestSchedule(rootCtx)
+	slog.Info("library root", "path", bookPath)
+	if _, err := srv.QueueScan(rootCtx, "rescan"); err != nil {
+		slog.Error("failed to queue startup scan", "err", err)
+	}
+	httpServer := listen.NewServer(listenAddr, srv.Router(), runtimeSettings.HTTPLimits())
+	var redirectServer *http.Server
+	if tlsConfig != nil {
+		httpServer.TLSConfig = tlsConfig.Config()
+		if tlsConfig.RedirectAddr != "" {
+			redirectServer = tlsConfig.RedirectServer(listenAddr)
+		}
+	}
+
+	// LISTEN_ADDR is a TCP address or unix:/path/to.sock.
+	ln, err := listen.Listen(listenAddr)
+	if err != nil {
+		slog.Error("failed to listen", "addr", listenAddr, "err", err)
+		os.Exit(1)
+	}
+
+	// Run the server in a goroutine so it doesn't block
+	go func() {
+		slog.Info("GoPDS is running", "addr", listenAddr, "tls", tlsConfig != nil)
+		var err error
+		if tlsConfig != nil {
+			// The certificate comes from TLSConfig.GetCertificate.
+			err = httpServer.ServeTLS(ln, "", "")
+		} else {
+			err = httpServer.Serve(ln)
+		}
+		if err != nil && err != http.ErrServerClosed {
+			slog.Error("server failed", "err", err)
+			os.Exit(1)
+		}
+	}()
+	if redirectServer != nil {
+		go func() {
+			slog.Info("redirecting http to https", "addr", redirectServer.Addr)
+			if err := redirectServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				slog.Error("redirect server failed", "err", err)
+				os.Exit(1)
+			}
+		}()
+	}
+
+	// Under a Type=notify systemd unit, report readiness and keep the
+	// watchdog fed for as long as the server answers and the database does.
+	if _, err := systemd.Notify("READY=1"); err != nil {
+		slog.Warn("failed to notify systemd", "err", err)
+	}
+	go systemd.RunWatchdog(rootCtx, func(ctx context.Context) error {
+		if err := db.Ping(ctx); err != nil {
+			return fmt.Errorf("database: %w", err)
+		}
+		if err := listen.Probe(ctx, ln, tlsConfig); err != nil {
+			return fmt.Errorf("http: %w", err)
+		}
+		return nil
+	})
+
+	// 5. Graceful shutdown. Wait here until we receive a signal; by then
+	// rootCtx is cancelled and jobs are already winding down.
+	<-rootCtx.Done()
+	stop()
+	slog.Info("shutting down GoPDS")
+	systemd.Notify("STOPPING=1")
+
+	// Create a 5-second timeout for the shutdown process
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := httpServer.Shutdown(ctx); err != nil {
+		slog.Warn("server forced to shutdown", "err", err)
+	}
+	if redirectServer != nil {
+		redirectServer.Shutdown(ctx)
+	}
+
+	// A cancelled scan commits what it has indexed before returning, so
+	// give it a little longer than in-flight requests before giving up.
+	jobsCtx, cancelJobs := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancelJobs()
+	if err := jobManager.Wait(jobsCtx); err != nil {
+		slog.Warn("background jobs did not stop in time", "err", err)
+	} else {
+		hooks.Wait()
+		if err := db.Close(); err != nil {
+			slog.Warn("failed to close database", "err", err)
+		}
+	}
+
+	slog.Info("exited cleanly")
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/ab0oo/gopds/internal/database"
+	"github.com/ab0oo/gopds/internal/scanner"
+	"github.com/ab0oo/gopds/internal/settings"
+)
+
+// runWatch scans the library, then indexes books as they arrive, without
+// serving, for setups where the machine that holds the books isn't the one
+// that serves them.
+func runWatch(args []string) {
+	var settle time.Duration
+	rest, closeLog := setup("gopds watch", args, func(fs *flag.FlagSet) {
+		fs.DurationVar(&settle, "settle", 5*time.Second, "index a file once it has been unchanged this long")
+	})
+	defer closeLog()
+	if len(rest) > 1 || settle <= 0 {
+		fmt.Fprintln(os.Stderr, "Usage: gopds watch [-settle=5s] [directory]")
+		os.Exit(2)
+	}
+	bookPath, _ := bookPathFromEnv()
+	if len(rest) == 1 {
+		bookPath = rest[0]
+	}
+	dbPath := dbPathFromEnv()
+	genreMap := genreMapFromEnv()
+
+	db, err := database.New(dbPath)
+	if err != nil {
+		slog.Error("failed to open database", "path", dbPath, "err", err)
+		os.Exit(1)
+	}
+	defer db.Close()
+	refreshAdultFlags(db, genreMap)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	sc := scanner.New(db)
+	store := settings.New(db)
+	sc.CategorySource = store.Get(settings.CategorySource)
+	sc.BatchSize = store.Int(settings.ScanBatchSize)
+	sc.Throttle = store.ScanThrottle()
+	sc.Adult = genreMap.Adult
+	// Books that arrive are organized. The first scan of an empty library
+	// indexes books that were already there, so it leaves them alone.
+	placer := newBookPlacer(bookPath)
+	if placer != nil {
+		defer placer.Close()
+		if n, _ := db.CountBooks(); n > 0 {
+			sc.Place = placer.Place
+		}
+	}
+	// Catch up on what changed while nothing was watching.
+	if err := sc.Start(ctx, bookPath); err != nil {
+		if ctx.Err() != nil {
+			return
+		}
+		slog.Error("scan failed", "path", bookPath, "err", err)
+		db.Close()
+		os.Exit(1)
+	}
+	if placer != nil {
+		sc.Place = placer.Place
+	}
+	if err := sc.Watch(ctx, bookPath, settle); err != nil && !errors.Is(err, context.Canceled) {
+		slog.Error("watch failed", "path", bookPath, "err", err)
+		db.Close()
+		os.Exit(1)
+	}
+}
@@ -26,13 +26,17 @@ const App = {
     coverCandidatesByKey: {},
     rebuildPollTimer: null,
     lastRebuildCompletedAt: '',
+    activityNext: '',
     coverVersion: {},
     filterAuthor: '__all',
     filterCategory: '__all',
     filterSubcategory: '__all',
+    filterGenre: '__all',
+    genreBookIds: null,
     auth: {
         authenticated: false,
-        username: ''
+        username: '',
+        scopes: []
     },
 
     ui: {
@@ -41,9 +45,14 @@ const App = {
         authorFilter: document.getElementById('author-filter'),
         categoryFilter: document.getElementById('category-filter'),
         subcategoryFilter: document.getElementById('subcategory-filter'),
+        genreFilter: document.getElementById('genre-filter'),
         rescanBtn: document.getElementById('rescan-btn'),
         rebuildBtn: document.getElementById('rebuild-btn'),
         rebuildStatus: document.getElementById('rebuild-status'),
+        activityBtn: document.getElementById('activity-btn'),
+        activityPanel: document.getElementById('activity-panel'),
+        activityList: document.getElementById('activity-list'),
+        activityMore: document.getElementById('activity-more'),
         authBtn: document.getElementById('auth-btn'),
         authStatus: document.getElementById('auth-status')
     },
@@ -51,7 +60,10 @@ const App = {
     async init() {
         this.createModal();
         this.createCoverModal();
+        this.createPreviewModal();
         this.bindEvents();
+        await this.handlePasswordReset();
+        await this.handleInvite();
         await this.syncAuthStatus();
         await this.fetchLibrary();
         await this.syncRebuildStatus();
@@ -131,9 +143,12 @@ const App = {
         this.ui.authorFilter.addEventListener('change', (e) => this.handleAuthorFilterChange(e));
         this.ui.categoryFilter.addEventListener('change', (e) => this.handleCategoryFilterChange(e));
         this.ui.subcategoryFilter.addEventListener('change', (e) => this.handleSubcategoryFilterChange(e));
+        this.ui.genreFilter.addEventListener('change', (e) => this.handleGenreFilterChange(e));
         window.addEventListener('scroll', () => this.handleScroll());
         this.ui.rescanBtn.addEventListener('click', () => this.handleRescanClick());
         this.ui.rebuildBtn.addEventListener('click', () => this.handleRebuildClick());
+        this.ui.activityBtn.addEventListener('click', () => this.handleActivityClick());
+        this.ui.activityMore.addEventListener('click', () => this.loadActivity(this.activityNext));
         this.ui.authBtn.addEventListener('click', () => this.handleAuthClick());
 
         this.ui.library.addEventListener('click', (e) => this.handleLibraryClick(e));
@@ -167,6 +182,12 @@ const App = {
             }
         });
         this.ui.coverModalApply.addEventListener('click', () => this.applyCoverSelection());
+        this.ui.previewModalClose.addEventListener('click', () => this.closePreviewModal());
+        this.ui.previewModal.addEventListener('click', (e) => {
+            if (e.target.dataset.closePreviewModal === '1') {
+                this.closePreviewModal();
+            }
+        });
         this.ui.coverFetchOnline.addEventListener('click', () => this.fetchOnlineCoverCandidates());
 
         document.addEventListener('keydown', (e) => {
@@ -176,6 +197,9 @@ const App = {
             if (e.key === 'Escape' && !this.ui.coverModal.classList.contains('hidden')) {
                 this.closeCoverModal();
             }
+            if (e.key === 'Escape' && !this.ui.previewModal.classList.contains('hidden')) {
+                this.closePreviewModal();
+            }
         });
     },
 
@@ -217,9 +241,112 @@ const App = {
         this.ui.coverModalApply = modal.querySelector('#cover-apply');
     },
 
+    createPreviewModal() {
+        const modal = document.createElement('div');
+        modal.id = 'preview-modal';
+        modal.className = 'modal hidden';
+        modal.innerHTML = `
+            <div class="modal-backdrop" data-close-preview-modal="1"></div>
+            <div class="modal-dialog preview-modal-dialog" role="dialog" aria-modal="true" aria-label="Book preview">
+                <div class="modal-header">
+                    <h2 id="preview-modal-title">Preview</h2>
+                    <button type="button" id="preview-modal-close" class="modal-close" aria-label="Close">&times;</button>
+                </div>
+                <div class="modal-book" id="preview-modal-book"></div>
+                <div class="preview-status" id="preview-modal-status"></div>
+                <article class="preview-body" id="preview-body"></article>
+                <div class="preview-related hidden" id="preview-related">
+                    <h3>Related Books</h3>
+                    <ul id="preview-related-list"></ul>
+                </div>
+                <div class="modal-actions">
+                    <a class="book-download" id="preview-download" href="#">Download</a>
+                </div>
+            </div>
+        `;
+
+        document.body.appendChild(modal);
+        this.ui.previewModal = modal;
+        this.ui.previewModalClose = modal.querySelector('#preview-modal-close');
+        this.ui.previewModalTitle = modal.querySelector('#preview-modal-title');
+        this.ui.previewModalBook = modal.querySelector('#preview-modal-book');
+        this.ui.previewModalStatus = modal.querySelector('#preview-modal-status');
+        this.ui.previewBody = modal.querySelector('#preview-body');
+        this.ui.previewDownload = modal.querySelector('#preview-download');
+        this.ui.previewRelated = modal.querySelector('#preview-related');
+        this.ui.previewRelatedList = modal.querySelector('#preview-related-list');
+    },
+
+    async openPreviewModal(book) {
+        this.ui.previewModalTitle.textContent = book.title || 'Preview';
+        this.ui.previewModalBook.textContent = book.author || '';
+        this.ui.previewModalStatus.textContent = 'Loading preview...';
+        this.ui.previewBody.innerHTML = '';
+        this.ui.previewDownload.href = `/download/${book.id}`;
+        this.previewBookId = book.id;
+        this.ui.previewRelated.classList.add('hidden');
+        this.ui.previewRelatedList.innerHTML = '';
+        this.ui.previewModal.classList.remove('hidden');
+        this.loadRelatedBooks(book.id);
+
+        try {
+            const response = await fetch(`/api/books/${book.id}/preview`);
+            if (!response.ok) {
+                const msg = await response.text();
+                throw new Error(msg || `Preview failed (${response.status})`);
+            }
+            const payload = await response.json();
+            // The server sanitizes the fragment before it leaves the EPUB.
+            this.ui.previewBody.innerHTML = payload.html || '';
+            this.ui.previewModalStatus.textContent = payload.truncated ? 'Preview shortened.' : '';
+        } catch (err) {
+            this.ui.previewModalStatus.textContent = `Error: ${err.message}`;
+            console.error(err);
+        }
+    },
+
+    async loadRelatedBooks(bookId) {
+        try {
+            const response = await fetch(`/api/books/${bookId}`);
+            if (!response.ok) {
+                return;
+            }
+            const payload = await response.json();
+            const related = payload.related || [];
+            if (related.length === 0 || this.previewBookId !== bookId) {
+                return;
+            }
+            for (const rel of related) {
+                const item = document.createElement('li');
+                const link = document.createElement('button');
+                link.type = 'button';
+                link.className = 'link-button';
+                link.textContent = rel.title || 'Untitled';
+                link.addEventListener('click', () => this.openPreviewModal(rel));
+                item.appendChild(link);
+                item.appendChild(document.createTextNode(` — ${rel.author || 'Unknown Author'}`));
+                this.ui.previewRelatedList.appendChild(item);
+            }
+            this.ui.previewRelated.classList.remove('hidden');
+        } catch (err) {
+            console.error(err);
+        }
+    },
+
+    closePreviewModal() {
+        this.ui.previewModal.classList.add('hidden');
+        this.ui.previewBody.innerHTML = '';
+    },
+
     async fetchLibrary() {
         try {
             const response = await fetch('/api/books');
+            if (response.status === 401) {
+                this.allBooks = [];
+                this.ui.search.placeholder = 'Search books...';
+                this.ui.library.innerText = 'This library is private. Log in to browse it.';
+                return;
+            }
             if (!response.ok) {
                 throw new Error(`Failed to load books (${response.status})`);
             }
@@ -227,6 +354,7 @@ const App = {
             this.allBooks = await response.json();
             this.ui.search.placeholder = `Search ${this.allBooks.length} books...`;
             this.refreshBrowseFilters();
+            await this.refreshGenreFilter();
             this.applyFiltersAndRender();
         } catch (err) {
             this.ui.library.innerText = 'Error loading library. Check console.';
@@ -235,7 +363,7 @@ const App = {
     },
 
     async handleRebuildClick() {
-        if (!this.auth.authenticated) {
+        if (!this.isAdmin()) {
             this.ui.rebuildStatus.textContent = 'Admin login required.';
             return;
         }
@@ -259,7 +387,7 @@ const App = {
     },
 
     async handleRescanClick() {
-        if (!this.auth.authenticated) {
+        if (!this.isAdmin()) {
             this.ui.rebuildStatus.textContent = 'Admin login required.';
             return;
         }
@@ -286,7 +414,7 @@ const App = {
     },
 
     async syncRebuildStatus() {
-        if (!this.auth.authenticated) {
+        if (!this.isAdmin()) {
             this.stopRebuildPolling();
             this.ui.rebuildStatus.textContent = '';
             this.ui.rescanBtn.classList.add('hidden');
@@ -316,38 +444,124 @@ const App = {
         try {
             const response = await fetch('/api/auth/status');
             if (!response.ok) {
-                this.auth = { authenticated: false, username: '' };
+                this.auth = { authenticated: false, username: '', scopes: [] };
             } else {
                 const payload = await response.json();
                 this.auth = {
                     authenticated: Boolean(payload.authenticated),
-                    username: payload.username || ''
+                    username: payload.username || '',
+                    role: payload.role || '',
+                    scopes: payload.scopes || [],
+                    oidcEnabled: Boolean(payload.oidc_enabled)
                 };
             }
         } catch (err) {
             console.error(err);
-            this.auth = { authenticated: false, username: '' };
+            this.auth = { authenticated: false, username: '', scopes: [] };
         }
 
         this.renderAuthState();
         this.render(true);
     },
 
+    hasScope(scope) {
+        return this.auth.authenticated && (this.auth.scopes.includes('admin') || this.auth.scopes.includes(scope));
+    },
+
+    canEdit() {
+        return this.hasScope('metadata');
+    },
+
+    isAdmin() {
+        return this.hasScope('admin');
+    },
+
     renderAuthState() {
         if (this.auth.authenticated) {
             this.ui.authBtn.textContent = 'Logout';
-            this.ui.authStatus.textContent = `Logged in as ${this.auth.username || 'admin'}.`;
-            this.ui.rescanBtn.classList.remove('hidden');
-            this.ui.rebuildBtn.classList.remove('hidden');
+            const role = this.auth.role ? ` (${this.auth.role})` : '';
+            this.ui.authStatus.textContent = `Logged in as ${this.auth.username || 'admin'}${role}.`;
+            this.ui.rescanBtn.classList.toggle('hidden', !this.isAdmin());
+            this.ui.rebuildBtn.classList.toggle('hidden', !this.isAdmin());
+            this.ui.activityBtn.classList.toggle('hidden', !this.isAdmin());
+            if (!this.isAdmin()) {
+                this.ui.activityPanel.classList.add('hidden');
+            }
             return;
         }
-        this.ui.authBtn.textContent = 'Admin Login';
+        this.ui.authBtn.textContent = 'Login';
         this.ui.authStatus.textContent = 'Read-only mode.';
         this.ui.rescanBtn.classList.add('hidden');
         this.ui.rebuildBtn.classList.add('hidden');
+        this.ui.activityBtn.classList.add('hidden');
+        this.ui.activityPanel.classList.add('hidden');
         this.ui.rebuildStatus.textContent = '';
     },
 
+    async handleActivityClick() {
+        const panel = this.ui.activityPanel;
+        panel.classList.toggle('hidden');
+        if (!panel.classList.contains('hidden')) {
+            this.ui.activityList.innerHTML = '';
+            await this.loadActivity('/api/activity?limit=20');
+        }
+    },
+
+    async loadActivity(url) {
+        if (!url) {
+            return;
+        }
+        try {
+            const response = await fetch(url);
+            if (!response.ok) {
+                if (response.status === 401) {
+                    await this.syncAuthStatus();
+                }
+                return;
+            }
+            const link = response.headers.get('Link') || '';
+            const next = link.match(/<([^>]+)>;\s*rel="next"/);
+            this.activityNext = next ? next[1] : '';
+            this.ui.activityMore.classList.toggle('hidden', !this.activityNext);
+
+            const payload = await response.json();
+            const fragment = document.createDocumentFragment();
+            (payload.activity || []).forEach((entry) => {
+                const item = document.createElement('li');
+                const when = new Date(entry.created_at).toLocaleString();
+                item.innerHTML = `
+                    <time>${this.escapeHTML(when)}</time>
+                    <span>${this.escapeHTML(this.describeActivity(entry))}</span>
+                `;
+                fragment.appendChild(item);
+            });
+            this.ui.activityList.appendChild(fragment);
+        } catch (err) {
+            console.error(err);
+        }
+    },
+
+    describeActivity(entry) {
+        const data = entry.data || {};
+        const book = data.book ? `${data.book.title || 'Untitled'} by ${data.book.author || 'Unknown'}` : '';
+        switch (entry.event) {
+        case 'book.added':
+            return `Added ${book}`;
+        case 'book.removed':
+            return `File missing for ${book}`;
+        case 'metadata.changed': {
+            const what = data.action === 'cover' ? 'Cover' : 'Metadata';
+            return `${what} changed by ${data.actor || 'someone'}: ${book}`;
+        }
+        case 'scan.completed':
+            return data.status === 'failed'
+                ? `Scan failed: ${data.error || ''}`
+                : `Scan completed: ${data.books || 0} books`;
+        default:
+            return entry.event;
+        }
+    },
+
     async handleAuthClick() {
         if (this.auth.authenticated) {
             try {
@@ -356,6 +570,12 @@ const App = {
                 console.error(err);
             }
             await this.syncAuthStatus();
+            await this.fetchLibrary();
+            return;
+        }
+
+        if (this.auth.oidcEnabled && window.confirm('Sign in with single sign-on? Cancel to use a GoPDS password.')) {
+            window.location.href = '/api/auth/oidc/login';
             return;
         }
 
@@ -370,25 +590,107 @@ const App = {
 
         this.ui.authStatus.textContent = 'Signing in...';
         try {
-            const response = await fetch('/api/auth/login', {
-                method: 'POST',
-                headers: { 'Content-Type': 'application/json' },
-                body: JSON.stringify({
-                    username: usernameInput.trim() || 'admin',
-                    password: passwordInput
-                })
-            });
+            const credentials = {
+                username: usernameInput.trim() || 'admin',
+                password: passwordInput
+            };
+            let response = await this.postLogin(credentials);
+            if (response.status === 401 && (response.headers.get('Content-Type') || '').includes('application/json')) {
+                const payload = await response.json();
+                if (payload.totp_required) {
+                    const code = window.prompt('Two-factor code (or a recovery code)');
+                    if (code === null) {
+                        this.ui.authStatus.textContent = 'Read-only mode.';
+                        return;
+                    }
+                    response = await this.postLogin({ ...credentials, code: code.trim() });
+                }
+            }
             if (!response.ok) {
                 const msg = await response.text();
                 throw new Error(msg || `Login failed (${response.status})`);
             }
             await this.syncAuthStatus();
+            await this.fetchLibrary();
         } catch (err) {
             this.ui.authStatus.textContent = `Login failed: ${err.message}`;
             console.error(err);
         }
     },
 
+    async handlePasswordReset() {
+        const match = window.location.hash.match(/^#reset=([0-9a-f]+)$/);
+        if (!match) {
+            return;
+        }
+        // Drop the token from the address bar and history before anything else.
+        window.history.replaceState(null, '', window.location.pathname + window.location.search);
+        const password = window.prompt('Choose a new password (at least 8 characters)');
+        if (password === null) {
+            return;
+        }
+        try {
+            const response = await fetch('/api/auth/password/reset', {
+                method: 'POST',
+                headers: { 'Content-Type': 'application/json' },
+                body: JSON.stringify({ token: match[1], password })
+            });
+            if (!response.ok) {
+                const msg = await response.text();
+                throw new Error(msg || `Reset failed (${response.status})`);
+            }
+            window.alert('Password changed. Log in with the new password.');
+        } catch (err) {
+            window.alert(`Password reset failed: ${err.message}`);
+            console.error(err);
+        }
+    },
+
+    async handleInvite() {
+        const match = window.location.hash.match(/^#invite=([0-9a-f]+)$/);
+        if (!match) {
+            return;
+        }
+        window.history.replaceState(null, '', window.location.pathname + window.location.search);
+        const token = match[1];
+        try {
+            const info = await fetch(`/api/auth/invite?token=${token}`);
+            if (!info.ok) {
+                const msg = await info.text();
+                throw new Error(msg || `Invite check failed (${info.status})`);
+            }
+            const invite = await info.json();
+            const username = window.prompt(`You're invited as ${invite.role}. Choose a username`);
+            if (username === null) {
+                return;
+            }
+            const password = window.prompt('Choose a password (at least 8 characters)');
+            if (password === null) {
+                return;
+            }
+            const response = await fetch('/api/auth/invite', {
+                method: 'POST',
+                headers: { 'Content-Type': 'application/json' },
+                body: JSON.stringify({ token, username: username.trim(), password })
+            });
+            if (!response.ok) {
+                const msg = await response.text();
+                throw new Error(msg || `Signup failed (${response.status})`);
+            }
+        } catch (err) {
+            window.alert(`Invite failed: ${err.message}`);
+            console.error(err);
+        }
+    },
+
+    postLogin(body) {
+        return fetch('/api/auth/login', {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify(body)
+        });
+    },
+
     startRebuildPolling() {
         if (this.rebuildPollTimer) {
             return;
@@ -465,6 +767,56 @@ const App = {
         this.applyFiltersAndRender();
     },
 
+    async handleGenreFilterChange(e) {
+        this.filterGenre = e.target.value || '__all';
+        await this.loadGenreBooks();
+        this.applyFiltersAndRender();
+    },
+
+    // Genres come from each book's subjects on the server, so the filter
+    // asks for the IDs of the selected genre's books.
+    async loadGenreBooks() {
+        this.genreBookIds = null;
+        if (this.filterGenre === '__all') {
+            return;
+        }
+        try {
+            const response = await fetch(`/api/books?genre=${encodeURIComponent(this.filterGenre)}`);
+            if (!response.ok) {
+                throw new Error(`Failed to load genre (${response.status})`);
+            }
+            const books = await response.json();
+            this.genreBookIds = new Set(books.map((b) => b.id));
+        } catch (err) {
+            this.filterGenre = '__all';
+            this.ui.genreFilter.value = '__all';
+            console.error(err);
+        }
+    },
+
+    async refreshGenreFilter() {
+        let genres = [];
+        try {
+            const response = await fetch('/api/genres');
+            if (response.ok) {
+                genres = (await response.json()).genres || [];
+            }
+        } catch (err) {
+            console.error(err);
+        }
+        const options = ['<option value="__all">All genres</option>'];
+        genres.forEach((g) => {
+            options.push(`<option value="${this.escapeHTML(g.name)}">${this.escapeHTML(g.name)} (${g.count})</option>`);
+        });
+        this.ui.genreFilter.innerHTML = options.join('');
+        this.ui.genreFilter.disabled = genres.length === 0;
+        if (!genres.some((g) => g.name === this.filterGenre)) {
+            this.filterGenre = '__all';
+        }
+        this.ui.genreFilter.value = this.filterGenre;
+        await this.loadGenreBooks();
+    },
+
     refreshBrowseFilters() {
         this.refreshAuthorFilter();
         this.refreshCategoryFilter();
@@ -597,6 +949,10 @@ const App = {
                 return false;
             }
 
+            if (this.genreBookIds && !this.genreBookIds.has(b.id)) {
+                return false;
+            }
+
             if (!term) {
                 return true;
             }
@@ -616,9 +972,19 @@ const App = {
     },
 
     handleLibraryClick(e) {
+        const previewButton = e.target.closest('.book-preview');
+        if (previewButton) {
+            const id = Number(previewButton.dataset.bookId);
+            const book = this.allBooks.find((b) => b.id === id);
+            if (book) {
+                this.openPreviewModal(book);
+            }
+            return;
+        }
+
         const editButton = e.target.closest('.edit-toggle');
         if (editButton) {
-            if (!this.auth.authenticated) {
+            if (!this.canEdit()) {
                 return;
             }
             const id = Number(editButton.dataset.bookId);
@@ -634,7 +1000,7 @@ const App = {
         if (!coverButton) {
             return;
         }
-        if (!this.auth.authenticated) {
+        if (!this.canEdit()) {
             return;
         }
 
@@ -647,8 +1013,8 @@ const App = {
     },
 
     async openCoverModal(book) {
-        if (!this.auth.authenticated) {
-            this.ui.authStatus.textContent = 'Admin login required.';
+        if (!this.canEdit()) {
+            this.ui.authStatus.textContent = 'Editor login required.';
             return;
         }
         this.coverModalBookId = book.id;
@@ -706,7 +1072,7 @@ const App = {
                 <input type="radio" name="cover-candidate" value="${this.escapeHTML(c.key)}" ${c.is_current || idx === 0 ? 'checked' : ''}>
                 <img src="${this.escapeHTML(c.preview_url)}" alt="${this.escapeHTML(c.name)}">
                 <span>${this.escapeHTML(c.name)}</span>
-                <small>${c.width > 0 && c.height > 0 ? `${c.width}x${c.height} ` : ''}${this.escapeHTML(c.media_type || '')}${c.source ? ` | ${this.escapeHTML(c.source)}` : ''}${c.is_current ? ' | current' : ''}</small>
+                <small>${c.width > 0 && c.height > 0 ? `${c.width}x${c.height} ` : ''}${this.escapeHTML(c.media_type || '')}${c.source ? ` | ${this.escapeHTML(c.source)}` : ''}${c.is_current ? ' | current' : ''}${c.same_as_current ? ' | same as current' : ''}</small>
             </label>
         `).join('');
     },
@@ -721,51 +1087,75 @@ const App = {
         this.ui.coverFetchOnline.disabled = true;
         this.ui.coverModalStatus.textContent = 'Searching online covers (Wikipedia/Open Library)...';
         try {
-            const response = await fetch(`/api/books/${this.coverModalBookId}/covers/online`);
+            const bookId = this.coverModalBookId;
+            const response = await fetch(`/api/books/${bookId}/covers/online`, {
+                headers: { Accept: 'application/x-ndjson' }
+            });
             console.info('[covers] online lookup response', {
-                bookId: this.coverModalBookId,
+                bookId,
                 status: response.status,
                 ok: response.ok
             });
             if (!response.ok) {
                 const msg = await response.text();
                 console.warn('[covers] online lookup failed', {
-                    bookId: this.coverModalBookId,
+                    bookId,
                     status: response.status,
                     message: msg
                 });
                 throw new Error(msg || `Online cover lookup failed (${response.status})`);
             }
-            const payload = await response.json();
-            const incoming = payload.candidates || [];
-            console.info('[covers] online lookup payload', {
-                bookId: this.coverModalBookId,
-                candidateCount: incoming.length,
-                candidates: incoming.map((c) => ({
+
+            // Candidates arrive one per line as each source answers; show
+            // them as they come rather than after the slowest source.
+            let added = 0;
+            const addCandidate = (line) => {
+                if (!line.trim() || this.coverModalBookId !== bookId) {
+                    return;
+                }
+                const c = JSON.parse(line);
+                if (!c || !c.key || this.coverCandidatesByKey[c.key]) {
+                    return;
+                }
+                added++;
+                console.info('[covers] online candidate', {
+                    bookId,
                     key: c.key,
                     source: c.source,
                     name: c.name,
                     image_url: c.image_url
-                }))
+                });
+                this.renderCoverCandidates([...Object.values(this.coverCandidatesByKey), c]);
+                this.ui.coverModalStatus.textContent = `Searching online covers... ${added} found so far.`;
+                this.ui.coverModalApply.disabled = false;
+            };
+            const reader = response.body.getReader();
+            const decoder = new TextDecoder();
+            let buffered = '';
+            for (;;) {
+                const { value, done } = await reader.read();
+                if (done) {
+                    break;
+                }
+                buffered += decoder.decode(value, { stream: true });
+                const lines = buffered.split('\n');
+                buffered = lines.pop();
+                lines.forEach(addCandidate);
+            }
+            addCandidate(buffered + decoder.decode());
+            console.info('[covers] online lookup merged', {
+                bookId,
+                added,
+                totalVisibleCandidates: Object.keys(this.coverCandidatesByKey).length
             });
-            if (incoming.length === 0) {
+            if (this.coverModalBookId !== bookId) {
+                return;
+            }
+            if (added === 0) {
                 this.ui.coverModalStatus.textContent = 'No online covers found for this title.';
                 return;
             }
-
-            const mergedMap = { ...this.coverCandidatesByKey };
-            incoming.forEach((c) => {
-                if (c && c.key && !mergedMap[c.key]) {
-                    mergedMap[c.key] = c;
-                }
-            });
-            const merged = Object.values(mergedMap);
-            this.renderCoverCandidates(merged);
-            console.info('[covers] online lookup merged', {
-                bookId: this.coverModalBookId,
-                totalVisibleCandidates: merged.length
-            });
-            this.ui.coverModalStatus.textContent = `Added ${incoming.length} online candidates.`;
+            this.ui.coverModalStatus.textContent = `Added ${added} online candidates.`;
             this.ui.coverModalApply.disabled = false;
         } catch (err) {
             console.error('[covers] online lookup exception', {
@@ -783,8 +1173,8 @@ const App = {
     },
 
     async applyCoverSelection() {
-        if (!this.auth.authenticated) {
-            this.ui.coverModalStatus.textContent = 'Admin login required.';
+        if (!this.canEdit()) {
+            this.ui.coverModalStatus.textContent = 'Editor login required.';
             return;
         }
         if (!this.coverModalBookId) {
@@ -821,9 +1211,9 @@ const App = {
             const payload = await response.json();
             this.coverVersion[this.coverModalBookId] = Date.now();
             this.render(true);
-            this.ui.coverModalStatus.textContent = payload.wrote_to_epub
+            this.ui.coverModalStatus.textContent = (payload.wrote_to_epub
                 ? 'Cover updated in cache and EPUB.'
-                : 'Cover cache updated.';
+                : 'Cover cache updated.') + (payload.same_as_previous ? ' The new cover looks the same as the old one.' : '');
         } catch (err) {
             this.ui.coverModalStatus.textContent = `Error: ${err.message}`;
             console.error(err);
@@ -833,8 +1223,8 @@ const App = {
     },
 
     async openModal(book) {
-        if (!this.auth.authenticated) {
-            this.ui.authStatus.textContent = 'Admin login required.';
+        if (!this.canEdit()) {
+            this.ui.authStatus.textContent = 'Editor login required.';
             return;
         }
         this.modalBookId = book.id;
@@ -905,8 +1295,8 @@ const App = {
 
     async handleMetadataSubmit(e) {
         e.preventDefault();
-        if (!this.auth.authenticated) {
-            this.ui.modalStatus.textContent = 'Admin login required.';
+        if (!this.canEdit()) {
+            this.ui.modalStatus.textContent = 'Editor login required.';
             return;
         }
         if (!this.modalBookId) {
@@ -967,6 +1357,9 @@ const App = {
             if (isbn) {
                 params.set('isbn', isbn);
             }
+            if (this.modalBookId) {
+                params.set('book_id', this.modalBookId);
+            }
             const response = await fetch(`/api/openlibrary/search?${params.toString()}`);
             if (!response.ok) {
                 const msg = await response.text();
@@ -999,7 +1392,7 @@ const App = {
     renderOpenLibraryResults() {
         this.ui.olResults.innerHTML = this.openLibraryResults.map((r, idx) => `
             <button type="button" class="ol-result-select" data-result-index="${idx}">
-                ${this.escapeHTML(r.title || 'Untitled')} | ${this.escapeHTML(r.author || 'Unknown')} | ${this.escapeHTML(r.source || 'unknown')}
+                ${this.escapeHTML(r.title || 'Untitled')} | ${this.escapeHTML(r.author || 'Unknown')} | ${this.escapeHTML(r.source || 'unknown')}${r.rating ? ` | ${r.rating.toFixed(1)}/5 (${r.ratings_count || 0})` : ''}${r.confidence ? ` | ${Math.round(r.confidence * 100)}% match` : ''}
             </button>
         `).join('');
     },
@@ -1096,7 +1489,10 @@ const App = {
 
         nextBatch.forEach((book) => {
             const el = document.createElement('div');
-            el.className = 'book';
+            el.className = book.available === false ? 'book unavailable' : 'book';
+            if (book.available === false) {
+                el.title = 'This book\'s file is currently unavailable';
+            }
             const coverV = this.coverVersion[book.id] || 0;
             el.innerHTML = `
                 <a href="/download/${book.id}">
@@ -1109,8 +1505,9 @@ const App = {
                 <small>${this.escapeHTML(book.author || '')}</small>
                 <div class="book-actions">
                     <a class="book-download" href="/download/${book.id}">Download</a>
-                    ${this.auth.authenticated ? `<button type="button" class="edit-toggle" data-book-id="${book.id}">Edit Metadata</button>` : ''}
-                    ${this.auth.authenticated ? `<button type="button" class="change-cover" data-book-id="${book.id}">Change Cover</button>` : ''}
+                    <button type="button" class="book-preview" data-book-id="${book.id}">Preview</button>
+                    ${this.canEdit() ? `<button type="button" class="edit-toggle" data-book-id="${book.id}">Edit Metadata</button>` : ''}
+                    ${this.canEdit() ? `<button type="button" class="change-cover" data-book-id="${book.id}">Change Cover</button>` : ''}
                 </div>
             `;
             fragment.appendChild(el);
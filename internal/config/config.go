@@ -0,0 +1,441 @@
+// Package config merges GoPDS's settings from three places: an optional YAML
+// file, environment variables, and command-line flags, in increasing order
+// of precedence. Every file key and flag maps onto one of the environment
+// variables the rest of the program already reads, so Load resolves the
+// winner for each and exports it to the environment; nothing downstream has
+// to know where a value came from.
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultPath is where Load looks for a config file when neither -config nor
+// GOPDS_CONFIG names one. In the container it is inside the data volume.
+const DefaultPath = "./data/gopds.yaml"
+
+// Value types.
+const (
+	TypeString = "string"
+	TypeInt    = "int"
+	TypeBool   = "bool"
+	// TypeList accepts a YAML sequence or a comma-separated string.
+	TypeList = "list"
+)
+
+// Sources of an effective value, from weakest to strongest.
+const (
+	SourceFile = "file"
+	SourceEnv  = "env"
+	SourceFlag = "flag"
+)
+
+// Option is one setting. Key is its dotted path in the file and its flag
+// name.
+type Option struct {
+	Key     string
+	Env     string
+	Type    string
+	Options []string // allowed values, for enumerations
+	Secret  bool     // redacted when logged
+	Help    string
+}
+
+func opt(key, env, typ, help string) Option {
+	return Option{Key: key, Env: env, Type: typ, Help: help}
+}
+
+func enum(key, env, help string, options ...string) Option {
+	return Option{Key: key, Env: env, Type: TypeString, Options: options, Help: help}
+}
+
+func secret(key, env, help string) Option {
+	return Option{Key: key, Env: env, Type: TypeString, Secret: true, Help: help}
+}
+
+// roleMapping lists the group-to-role options shared by external logins.
+func roleMapping(section, prefix string) []Option {
+	return []Option{
+		opt(section+".admin_groups", prefix+"_ADMIN_GROUPS", TypeList, "groups whose members become admins"),
+		opt(section+".editor_groups", prefix+"_EDITOR_GROUPS", TypeList, "groups whose members become editors"),
+		enum(section+".default_role", prefix+"_DEFAULT_ROLE", "role for users in neither group list", "admin", "editor", "reader"),
+	}
+}
+
+// Options lists every setting the file and flags accept.
+var Options = slices.Concat([]Option{
+	opt("listen", "LISTEN_ADDR", TypeString, "address to listen on, or unix:/path for a socket (default :8880)"),
+	opt("socket_mode", "LISTEN_SOCKET_MODE", TypeString, "octal permissions of a unix socket (default 0660)"),
+	opt("socket_group", "LISTEN_SOCKET_GROUP", TypeString, "group that owns a unix socket"),
+	opt("http.read_header_timeout_seconds", "HTTP_READ_HEADER_TIMEOUT_SECONDS", TypeInt, "time to read request headers; 0 is unlimited (default 10)"),
+	opt("http.read_timeout_seconds", "HTTP_READ_TIMEOUT_SECONDS", TypeInt, "time to read a request; 0 is unlimited (default 60)"),
+	opt("http.write_timeout_seconds", "HTTP_WRITE_TIMEOUT_SECONDS", TypeInt, "time to write a response, except downloads, exports, and uploads; 0 is unlimited (default 60)"),
+	opt("http.idle_timeout_seconds", "HTTP_IDLE_TIMEOUT_SECONDS", TypeInt, "idle keep-alive connection lifetime; 0 is unlimited (default 120)"),
+	opt("http.max_header_kb", "HTTP_MAX_HEADER_KB", TypeInt, "largest request headers (default 64)"),
+	opt("http.max_body_kb", "MAX_BODY_KB", TypeInt, "largest request body except uploads (default 1024)"),
+	opt("http.max_upload_mb", "MAX_UPLOAD_MB", TypeInt, "largest file upload (default 20)"),
+	opt("tls.cert_file", "TLS_CERT_FILE", TypeString, "PEM certificate for HTTPS"),
+	opt("tls.key_file", "TLS_KEY_FILE", TypeString, "PEM private key for HTTPS"),
+	opt("tls.autocert_hosts", "TLS_AUTOCERT_HOSTS", TypeList, "hostnames to get Let's Encrypt certificates for"),
+	opt("tls.autocert_email", "TLS_AUTOCERT_EMAIL", TypeString, "contact address for Let's Encrypt"),
+	opt("tls.autocert_cache", "TLS_AUTOCERT_CACHE", TypeString, "directory for Let's Encrypt certificates (default data/autocert)"),
+	opt("tls.redirect_addr", "TLS_REDIRECT_ADDR", TypeString, "plain HTTP address that redirects to HTTPS, such as :80"),
+	opt("paths.books", "BOOK_PATH", TypeString, "library root (default ./books)"),
+	opt("paths.database", "DB_PATH", TypeString, "SQLite database file (default ./data/gopds.db)"),
+	opt("paths.ui", "UI_DIR", TypeString, "directory whose files override the built-in web UI"),
+	opt("paths.remote", "REMOTE_LIBRARIES", TypeList, "read-only s3:// or webdav(s):// libraries scanned beside BOOK_PATH"),
+	opt("storage.s3.endpoint", "S3_ENDPOINT", TypeString, "S3-compatible service URL (default Amazon S3)"),
+	opt("storage.s3.region", "S3_REGION", TypeString, "S3 region (default us-east-1)"),
+	opt("storage.s3.access_key_id", "S3_ACCESS_KEY_ID", TypeString, "S3 access key; unset reads public buckets"),
+	secret("storage.s3.secret_access_key", "S3_SECRET_ACCESS_KEY", "S3 secret key"),
+	opt("storage.webdav.username", "WEBDAV_USERNAME", TypeString, "WebDAV login"),
+	secret("storage.webdav.password", "WEBDAV_PASSWORD", "WebDAV password"),
+	enum("log.level", "LOG_LEVEL", "minimum log level", "debug", "info", "warn", "warning", "error"),
+	enum("log.format", "LOG_FORMAT", "log output format", "text", "json"),
+	opt("log.file", "LOG_FILE", TypeString, "also write logs to this file"),
+	opt("log.file_max_mb", "LOG_FILE_MAX_MB", TypeInt, "size at which the log file is rotated (default 10)"),
+	opt("log.file_max_backups", "LOG_FILE_MAX_BACKUPS", TypeInt, "rotated log files to keep; 0 keeps all (default 5)"),
+	opt("log.file_max_age_days", "LOG_FILE_MAX_AGE_DAYS", TypeInt, "days to keep rotated log files; 0 keeps all (default 30)"),
+	opt("lang", "LANG", TypeString, "language of feed titles and error messages, such as de or fr (default en)"),
+
+	opt("auth.admin_username", "ADMIN_USERNAME", TypeString, "first account, created while there are no users"),
+	secret("auth.admin_password", "ADMIN_PASSWORD", "password for the first account"),
+	opt("auth.kosync_username", "KOSYNC_USERNAME", TypeString, "legacy KOReader sync account"),
+	secret("auth.kosync_password", "KOSYNC_PASSWORD", "legacy KOReader sync password"),
+	opt("auth.trusted_proxies", "TRUSTED_PROXIES", TypeList, "reverse proxies whose X-Forwarded-* headers are believed"),
+	opt("auth.login_lockout_threshold", "LOGIN_LOCKOUT_THRESHOLD", TypeInt, "failed logins before a lockout; 0 disables"),
+	opt("auth.login_lockout_minutes", "LOGIN_LOCKOUT_MINUTES", TypeInt, "lockout length"),
+
+	opt("auth.ldap.url", "LDAP_URL", TypeString, "LDAP server URL"),
+	opt("auth.ldap.base_dn", "LDAP_BASE_DN", TypeString, "search base for users"),
+	opt("auth.ldap.bind_dn", "LDAP_BIND_DN", TypeString, "service account DN"),
+	secret("auth.ldap.bind_password", "LDAP_BIND_PASSWORD", "service account password"),
+	opt("auth.ldap.user_filter", "LDAP_USER_FILTER", TypeString, "user search filter with {username}"),
+	opt("auth.ldap.group_attribute", "LDAP_GROUP_ATTRIBUTE", TypeString, "attribute listing the user's groups"),
+	opt("auth.ldap.start_tls", "LDAP_START_TLS", TypeBool, "upgrade ldap:// connections with StartTLS"),
+	opt("auth.ldap.insecure_skip_verify", "LDAP_INSECURE_SKIP_VERIFY", TypeBool, "skip LDAP certificate checks"),
+	opt("auth.ldap.auto_create", "LDAP_AUTO_CREATE", TypeBool, "create accounts on first LDAP login"),
+}, roleMapping("auth.ldap", "LDAP"), []Option{
+	opt("auth.proxy.trusted_proxies", "PROXY_AUTH_TRUSTED_PROXIES", TypeList, "proxies allowed to name the user in a header"),
+	opt("auth.proxy.user_header", "PROXY_AUTH_USER_HEADER", TypeString, "header naming the user"),
+	opt("auth.proxy.groups_header", "PROXY_AUTH_GROUPS_HEADER", TypeString, "header listing the user's groups"),
+	opt("auth.proxy.auto_create", "PROXY_AUTH_AUTO_CREATE", TypeBool, "create accounts for new proxy users"),
+}, roleMapping("auth.proxy", "PROXY_AUTH"), []Option{
+	opt("auth.oidc.issuer_url", "OIDC_ISSUER_URL", TypeString, "OpenID Connect issuer"),
+	opt("auth.oidc.client_id", "OIDC_CLIENT_ID", TypeString, "OpenID Connect client ID"),
+	secret("auth.oidc.client_secret", "OIDC_CLIENT_SECRET", "OpenID Connect client secret"),
+	opt("auth.oidc.redirect_url", "OIDC_REDIRECT_URL", TypeString, "callback URL registered with the issuer"),
+	opt("auth.oidc.scopes", "OIDC_SCOPES", TypeList, "scopes to request"),
+	opt("auth.oidc.username_claim", "OIDC_USERNAME_CLAIM", TypeString, "claim holding the username"),
+	opt("auth.oidc.groups_claim", "OIDC_GROUPS_CLAIM", TypeString, "claim holding the groups"),
+	opt("auth.oidc.auto_create", "OIDC_AUTO_CREATE", TypeBool, "create accounts on first SSO login"),
+}, roleMapping("auth.oidc", "OIDC"), []Option{
+	opt("smtp.host", "SMTP_HOST", TypeString, "mail relay for reset and invite links and digests"),
+	opt("smtp.port", "SMTP_PORT", TypeInt, "mail relay port"),
+	opt("smtp.username", "SMTP_USERNAME", TypeString, "mail relay login"),
+	secret("smtp.password", "SMTP_PASSWORD", "mail relay password"),
+	opt("smtp.from", "SMTP_FROM", TypeString, "sender address"),
+	enum("smtp.tls", "SMTP_TLS", "mail relay encryption", "starttls", "tls", "none"),
+
+	opt("rate_limits.login", "RATE_LIMIT_LOGIN", TypeInt, "login attempts per minute per IP"),
+	opt("rate_limits.search", "RATE_LIMIT_SEARCH", TypeInt, "metadata searches per minute per IP"),
+	opt("rate_limits.download", "RATE_LIMIT_DOWNLOAD", TypeInt, "downloads per minute per IP"),
+
+	enum("scanner.category_source", "CATEGORY_SOURCE", "where scans take categories from", "path", "subject", "auto", "none"),
+	opt("scanner.interval_minutes", "SCAN_INTERVAL_MINUTES", TypeInt, "scheduled rescan interval; 0 disables"),
+	opt("scanner.stall_seconds", "SCAN_STALL_SECONDS", TypeInt, "seconds without progress before a scan counts as wedged"),
+	opt("scanner.batch_size", "SCAN_BATCH_SIZE", TypeInt, "files a scan indexes per transaction"),
+	opt("scanner.files_per_second", "SCAN_FILES_PER_SECOND", TypeInt, "new or changed EPUBs a scan reads per second; 0 is unlimited"),
+	opt("scanner.max_open_files", "SCAN_MAX_OPEN_FILES", TypeInt, "EPUBs a scan has open at once; 0 is unlimited"),
+	opt("scanner.idle_hours", "SCAN_IDLE_HOURS", TypeString, "local hours, such as 1-6, when scans ignore the limits above"),
+	opt("scanner.integrity_interval_hours", "INTEGRITY_INTERVAL_HOURS", TypeInt, "scheduled file integrity check interval; 0 disables"),
+	opt("scanner.missing_retention_days", "MISSING_RETENTION_DAYS", TypeInt, "days before books with missing files are purged; 0 keeps them"),
+
+	opt("providers.openlibrary", "PROVIDER_OPENLIBRARY", TypeBool, "use Open Library"),
+	opt("providers.googlebooks", "PROVIDER_GOOGLEBOOKS", TypeBool, "use Google Books"),
+	opt("providers.wikipedia", "PROVIDER_WIKIPEDIA", TypeBool, "use Wikipedia for covers"),
+	opt("providers.hardcover", "PROVIDER_HARDCOVER", TypeBool, "use Hardcover when a token is set"),
+	opt("providers.wikidata", "PROVIDER_WIKIDATA", TypeBool, "add series and author details from Wikidata"),
+	opt("providers.douban", "PROVIDER_DOUBAN", TypeBool, "use Douban Books (default off)"),
+	opt("providers.douban_url", "DOUBAN_API_URL", TypeString, "Douban v2-compatible book API (default https://api.douban.com/v2/book)"),
+	secret("providers.douban_key", "DOUBAN_API_KEY", "Douban API key"),
+	secret("providers.googlebooks_key", "GOOGLE_BOOKS_API_KEY", "Google Books API key"),
+	opt("providers.quota_openlibrary", "QUOTA_OPENLIBRARY", TypeInt, "Open Library requests per UTC day; 0 is unlimited"),
+	opt("providers.quota_googlebooks", "QUOTA_GOOGLEBOOKS", TypeInt, "Google Books requests per UTC day (default 1000)"),
+	opt("providers.quota_hardcover", "QUOTA_HARDCOVER", TypeInt, "Hardcover requests per UTC day; 0 is unlimited"),
+	opt("providers.quota_douban", "QUOTA_DOUBAN", TypeInt, "Douban requests per UTC day; 0 is unlimited"),
+	opt("providers.quota_wikipedia", "QUOTA_WIKIPEDIA", TypeInt, "Wikipedia requests per UTC day; 0 is unlimited"),
+	opt("providers.quota_wikidata", "QUOTA_WIKIDATA", TypeInt, "Wikidata queries per UTC day; 0 is unlimited"),
+	opt("providers.cache_hours", "LOOKUP_CACHE_HOURS", TypeInt, "how long provider lookups are cached; 0 disables (default 168)"),
+	opt("providers.auto_apply_confidence", "METADATA_AUTO_APPLY_CONFIDENCE", TypeInt, "match confidence percent at which a candidate is safe to auto-apply; 0 disables (default 90)"),
+	secret("providers.hardcover_token", "HARDCOVER_API_TOKEN", "Hardcover API token"),
+	opt("providers.offline", "OFFLINE_MODE", TypeBool, "disable all external metadata and cover lookups"),
+	opt("providers.timeout_seconds", "UPSTREAM_TIMEOUT_SECONDS", TypeInt, "limit on each provider request (default 20)"),
+	secret("providers.proxy", "UPSTREAM_PROXY", "http, https, or socks5 proxy for provider requests"),
+	opt("providers.retries", "UPSTREAM_RETRIES", TypeInt, "retries after 429, 5xx, or connection errors (default 2)"),
+	opt("providers.host_rate", "UPSTREAM_HOST_RATE", TypeInt, "requests per second to any one provider host; 0 is unlimited (default 5)"),
+	opt("covers.online_min_width", "ONLINE_COVER_MIN_WIDTH", TypeInt, "narrowest online cover kept"),
+	opt("covers.online_min_height", "ONLINE_COVER_MIN_HEIGHT", TypeInt, "shortest online cover kept"),
+	opt("covers.webp_encoder", "COVER_WEBP_ENCODER", TypeString, "path to cwebp, to serve WebP covers to clients that accept them"),
+	opt("covers.avif_encoder", "COVER_AVIF_ENCODER", TypeString, "path to avifenc, to serve AVIF covers to clients that accept them"),
+	opt("covers.cache", "COVER_CACHE", TypeString, "directory or s3://bucket/prefix holding cached covers (default ./data/covers)"),
+	opt("images.max_pixels", "IMAGE_MAX_PIXELS", TypeInt, "largest image, in pixels, decoded for covers (default 40000000)"),
+	opt("images.decoders", "IMAGE_DECODERS", TypeInt, "images decoded at once (default 2)"),
+	opt("feeds.cache_mb", "FEED_CACHE_MB", TypeInt, "memory for rendered OPDS feeds; 0 disables (default 16)"),
+	opt("genres.map_file", "GENRE_MAP_FILE", TypeString, "YAML file extending or replacing the built-in genre mapping"),
+	opt("organize.template", "ORGANIZE_TEMPLATE", TypeString, "layout gopds organize moves books into (default {title}/{title}.epub)"),
+	opt("organize.on_import", "ORGANIZE_ON_IMPORT", TypeBool, "move books into the ORGANIZE_TEMPLATE layout as scans, watch, and import add them"),
+	opt("downloads.filename", "DOWNLOAD_FILENAME", TypeString, "name of downloaded books (default {author} - {title})"),
+
+	opt("public.browse", "PUBLIC_BROWSE", TypeBool, "anonymous OPDS browsing"),
+	opt("public.covers", "PUBLIC_COVERS", TypeBool, "anonymous cover images"),
+	opt("public.downloads", "PUBLIC_DOWNLOADS", TypeBool, "anonymous downloads and previews"),
+	opt("public.api", "PUBLIC_API", TypeBool, "anonymous JSON API"),
+	opt("public.hide_adult", "HIDE_ADULT", TypeBool, "hide adult content from anonymous visitors and non-admin accounts"),
+	opt("downloads.daily_limit", "DOWNLOAD_DAILY_LIMIT", TypeInt, "books per user per day; 0 is unlimited"),
+	opt("downloads.monthly_limit", "DOWNLOAD_MONTHLY_LIMIT", TypeInt, "books per user per month; 0 is unlimited"),
+	opt("downloads.daily_mb", "DOWNLOAD_DAILY_MB", TypeInt, "megabytes per user per day; 0 is unlimited"),
+	opt("downloads.monthly_mb", "DOWNLOAD_MONTHLY_MB", TypeInt, "megabytes per user per month; 0 is unlimited"),
+
+	opt("conversion.ebook_convert", "EBOOK_CONVERT", TypeString, "path to Calibre's ebook-convert"),
+	opt("webhooks.max_attempts", "WEBHOOK_MAX_ATTEMPTS", TypeInt, "delivery attempts per webhook event"),
+	opt("debug.pprof", "ENABLE_PPROF", TypeBool, "serve /debug/pprof to admins"),
+})
+
+// Effective is an option's winning value and where it came from.
+type Effective struct {
+	Option
+	Value  string
+	Source string
+}
+
+// Config is the result of Load.
+type Config struct {
+	// Path is the config file that was read, or "" if there was none.
+	Path   string
+	Values []Effective
+}
+
+// Load parses args (without the program name), reads the config file, and
+// exports each option's winning value to its environment variable. It
+// returns flag.ErrHelp if args asked for usage, which has been printed.
+func Load(args []string, usage io.Writer) (*Config, error) {
+	cfg, rest, err := Parse("gopds", args, usage, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) > 0 {
+		return nil, fmt.Errorf("unexpected argument %q", rest[0])
+	}
+	return cfg, nil
+}
+
+// Parse is Load for a subcommand: define, if set, adds the command's own
+// flags alongside the config options, and the arguments left after the
+// flags are returned rather than rejected.
+func Parse(name string, args []string, usage io.Writer, define func(*flag.FlagSet)) (*Config, []string, error) {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(usage)
+	if define != nil {
+		define(fs)
+	}
+	configPath := fs.String("config", "", "YAML config file (default $GOPDS_CONFIG, then "+DefaultPath+" if it exists)")
+	flagValues := map[string]*optionFlag{}
+	for _, o := range Options {
+		f := &optionFlag{bool: o.Type == TypeBool}
+		flagValues[o.Key] = f
+		fs.Var(f, o.Key, o.Help+" ($"+o.Env+")")
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, nil, err
+	}
+	cfg, err := resolve(*configPath, flagValues)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cfg, fs.Args(), nil
+}
+
+// resolve reads the config file and exports the winning value of each
+// option.
+func resolve(configPath string, flagValues map[string]*optionFlag) (*Config, error) {
+
+	cfg := &Config{}
+	path, required := configPath, true
+	if path == "" {
+		path = strings.TrimSpace(os.Getenv("GOPDS_CONFIG"))
+	}
+	if path == "" {
+		path, required = DefaultPath, false
+	}
+	fileValues, err := readFile(path)
+	switch {
+	case err == nil:
+		cfg.Path = path
+	case errors.Is(err, os.ErrNotExist) && !required:
+	default:
+		return nil, err
+	}
+
+	var problems []string
+	for _, o := range Options {
+		var e Effective
+		if f := flagValues[o.Key]; f.set {
+			e = Effective{Option: o, Value: f.value, Source: SourceFlag}
+		} else if v := strings.TrimSpace(os.Getenv(o.Env)); v != "" {
+			e = Effective{Option: o, Value: v, Source: SourceEnv}
+		} else if v, ok := fileValues[o.Key]; ok {
+			e = Effective{Option: o, Value: v, Source: SourceFile}
+		} else {
+			continue
+		}
+		v, err := o.normalize(e.Value)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s (%s from %s): %v", o.Key, o.Env, e.Source, err))
+			continue
+		}
+		e.Value = v
+		if err := os.Setenv(o.Env, v); err != nil {
+			return nil, err
+		}
+		cfg.Values = append(cfg.Values, e)
+	}
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("invalid configuration:\n  %s", strings.Join(problems, "\n  "))
+	}
+	return cfg, nil
+}
+
+// Log writes the effective configuration, one line per option that is set,
+// with secrets redacted.
+func (c *Config) Log() {
+	file := c.Path
+	if file == "" {
+		file = "(none)"
+	}
+	slog.Info("configuration loaded", "file", file, "options_set", len(c.Values))
+	for _, e := range c.Values {
+		value := e.Value
+		if e.Secret {
+			value = "[redacted]"
+		}
+		slog.Info("config", "key", e.Key, "env", e.Env, "value", value, "source", e.Source)
+	}
+}
+
+func (o Option) normalize(raw string) (string, error) {
+	raw = strings.TrimSpace(raw)
+	switch o.Type {
+	case TypeInt:
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 0 {
+			return "", errors.New("must be a whole number")
+		}
+		return strconv.Itoa(n), nil
+	case TypeBool:
+		switch strings.ToLower(raw) {
+		case "1", "true", "yes", "on":
+			return "true", nil
+		case "0", "false", "no", "off":
+			return "false", nil
+		}
+		return "", errors.New("must be true or false")
+	case TypeList:
+		var items []string
+		for _, item := range strings.Split(raw, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		return strings.Join(items, ","), nil
+	}
+	if len(o.Options) > 0 && !slices.Contains(o.Options, strings.ToLower(raw)) {
+		return "", fmt.Errorf("must be one of %s", strings.Join(o.Options, ", "))
+	}
+	return raw, nil
+}
+
+// readFile flattens a YAML file into dotted keys. Unknown keys are errors,
+// so a typo doesn't silently leave a setting at its default.
+func readFile(path string) (map[string]string, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var doc map[string]any
+	if err := yaml.Unmarshal(raw, &doc); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	out := map[string]string{}
+	if err := flatten("", doc, out); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	var unknown []string
+	for key := range out {
+		if !slices.ContainsFunc(Options, func(o Option) bool { return o.Key == key }) {
+			unknown = append(unknown, key)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return nil, fmt.Errorf("%s: unknown setting %s", path, strings.Join(unknown, ", "))
+	}
+	return out, nil
+}
+
+func flatten(prefix string, node map[string]any, out map[string]string) error {
+	for k, v := range node {
+		key := k
+		if prefix != "" {
+			key = prefix + "." + k
+		}
+		switch v := v.(type) {
+		case map[string]any:
+			if err := flatten(key, v, out); err != nil {
+				return err
+			}
+		case []any:
+			items := make([]string, 0, len(v))
+			for _, item := range v {
+				if _, nested := item.(map[string]any); nested {
+					return fmt.Errorf("%s: list items must be plain values", key)
+				}
+				items = append(items, fmt.Sprint(item))
+			}
+			out[key] = strings.Join(items, ",")
+		case nil:
+			// An empty key leaves the option unset.
+		default:
+			out[key] = fmt.Sprint(v)
+		}
+	}
+	return nil
+}
+
+// optionFlag records whether it was given, so an explicit empty value still
+// overrides the environment.
+type optionFlag struct {
+	value string
+	set   bool
+	bool  bool
+}
+
+func (f *optionFlag) String() string { return f.value }
+
+func (f *optionFlag) Set(v string) error {
+	f.value, f.set = v, true
+	return nil
+}
+
+func (f *optionFlag) IsBoolFlag() bool { return f.bool }
@@ -0,0 +1,102 @@
+package database
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Activity is one library event in the activity feed: a book added,
+// removed, or changed, or a scan finished. Data is the event's payload,
+// the same one webhooks subscribed to Event receive.
+type Activity struct {
+	ID        int64           `json:"id"`
+	Event     string          `json:"event"`
+	BookID    int             `json:"book_id,omitempty"`
+	Data      json.RawMessage `json:"data"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+const activityTableDDL = `
+CREATE TABLE IF NOT EXISTS library_activity (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	event TEXT NOT NULL,
+	book_id INTEGER,
+	data_json TEXT,
+	created_at DATETIME NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_library_activity_event ON library_activity(event, id);
+CREATE INDEX IF NOT EXISTS idx_library_activity_book ON library_activity(book_id, id);`
+
+// ActivityFilter selects activity for ListActivity. Zero fields select
+// everything.
+type ActivityFilter struct {
+	Event  string
+	BookID int
+	// Before lists only events older than the one with this ID, for
+	// paging back through the feed.
+	Before int64
+	Limit  int
+}
+
+func (db *DB) AddActivity(a Activity) (int64, error) {
+	if a.CreatedAt.IsZero() {
+		a.CreatedAt = time.Now().UTC()
+	}
+	var bookID any
+	if a.BookID > 0 {
+		bookID = a.BookID
+	}
+	result, err := db.conn.Exec(`INSERT INTO library_activity (event, book_id, data_json, created_at) VALUES (?, ?, ?, ?)`,
+		a.Event, bookID, string(a.Data), a.CreatedAt)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+// ListActivity returns the events f selects, newest first.
+func (db *DB) ListActivity(f ActivityFilter) ([]Activity, error) {
+	query := `SELECT id, event, coalesce(book_id, 0), data_json, created_at FROM library_activity WHERE 1=1`
+	var args []any
+	if f.Event != "" {
+		query += ` AND event = ?`
+		args = append(args, f.Event)
+	}
+	if f.BookID > 0 {
+		query += ` AND book_id = ?`
+		args = append(args, f.BookID)
+	}
+	if f.Before > 0 {
+		query += ` AND id < ?`
+		args = append(args, f.Before)
+	}
+	query += ` ORDER BY id DESC LIMIT ?`
+	args = append(args, f.Limit)
+
+	rows, err := db.conn.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := make([]Activity, 0)
+	for rows.Next() {
+		var a Activity
+		var data string
+		if err := rows.Scan(&a.ID, &a.Event, &a.BookID, &data, &a.CreatedAt); err != nil {
+			return nil, err
+		}
+		a.Data = rawJSONOrNull(data)
+		entries = append(entries, a)
+	}
+	return entries, rows.Err()
+}
+
+// PruneActivity deletes events older than keep.
+func (db *DB) PruneActivity(keep time.Duration) (int64, error) {
+	res, err := db.conn.Exec(`DELETE FROM library_activity WHERE created_at < ?`, time.Now().UTC().Add(-keep))
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
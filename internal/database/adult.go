@@ -0,0 +1,79 @@
+package database
+
+import "database/sql"
+
+// Books are flagged as adult content in books.adult, derived from their
+// subjects whenever those are recorded. books.adult_override holds an
+// admin's decision, which wins while it is set; NULL defers to the flag.
+
+// RefreshAdultFlags re-derives the adult flag of every book from its stored
+// subjects, so a changed keyword list applies without a rescan. It returns
+// how many books changed.
+func (db *DB) RefreshAdultFlags(match func([]string) bool) (int, error) {
+	rows, err := db.conn.Query(`SELECT id, subjects, adult FROM books WHERE subjects IS NOT NULL`)
+	if err != nil {
+		return 0, err
+	}
+	changed := map[int]bool{}
+	for rows.Next() {
+		var id int
+		var raw sql.NullString
+		var adult bool
+		if err := rows.Scan(&id, &raw, &adult); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if want := match(splitSubjects(raw.String)); want != adult {
+			changed[id] = want
+		}
+	}
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		return 0, err
+	}
+	rows.Close()
+	if len(changed) == 0 {
+		return 0, nil
+	}
+
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	for id, adult := range changed {
+		if _, err := tx.Exec(`UPDATE books SET adult = ? WHERE id = ?`, adult, id); err != nil {
+			return 0, err
+		}
+	}
+	return len(changed), tx.Commit()
+}
+
+// SetBookAdultOverride records an admin's adult-content decision for a
+// book; nil clears it so the subjects decide again. It reports false if
+// there is no such book.
+func (db *DB) SetBookAdultOverride(id int, adult *bool) (bool, error) {
+	var v any
+	if adult != nil {
+		v = *adult
+	}
+	result, err := db.conn.Exec(`UPDATE books SET adult_override = ? WHERE id = ?`, v, id)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// BookAdultOverride returns the admin's decision for a book, or nil if the
+// subjects decide.
+func (db *DB) BookAdultOverride(id int) (*bool, error) {
+	var v sql.NullBool
+	if err := db.conn.QueryRow(`SELECT adult_override FROM books WHERE id = ?`, id).Scan(&v); err != nil {
+		return nil, err
+	}
+	if !v.Valid {
+		return nil, nil
+	}
+	return &v.Bool, nil
+}
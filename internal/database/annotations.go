@@ -0,0 +1,192 @@
+package database
+
+import (
+	"database/sql"
+	"time"
+)
+
+// Annotation is a user's highlight or note in a book. Locator says where it
+// is: an EPUB CFI from the web reader, or a KOReader position or page.
+type Annotation struct {
+	ID         int64     `json:"id"`
+	Username   string    `json:"username"`
+	BookID     int       `json:"book_id"`
+	BookTitle  string    `json:"book_title,omitempty"`
+	BookAuthor string    `json:"book_author,omitempty"`
+	Locator    string    `json:"locator"`
+	Chapter    string    `json:"chapter,omitempty"`
+	Text       string    `json:"text,omitempty"`
+	Note       string    `json:"note,omitempty"`
+	Color      string    `json:"color"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// annotations keep the book's path alongside its ID so they survive a
+// rebuild, which renumbers every book; see RelinkAnnotations.
+const annotationsTableDDL = `
+CREATE TABLE IF NOT EXISTS annotations (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	username TEXT NOT NULL,
+	book_id INTEGER NOT NULL,
+	book_path TEXT,
+	locator TEXT NOT NULL,
+	chapter TEXT,
+	text TEXT,
+	note TEXT,
+	color TEXT NOT NULL,
+	created_at DATETIME,
+	updated_at DATETIME
+);
+CREATE INDEX IF NOT EXISTS idx_annotations_user_book ON annotations(username, book_id);`
+
+const annotationColumns = `a.id, a.username, a.book_id, coalesce(b.title, ''), coalesce(b.author, ''),
+	a.locator, a.chapter, a.text, a.note, a.color, a.created_at, a.updated_at`
+
+func scanAnnotation(row interface{ Scan(...any) error }) (*Annotation, error) {
+	var a Annotation
+	var chapter, text, note sql.NullString
+	var created, updated sql.NullTime
+	if err := row.Scan(&a.ID, &a.Username, &a.BookID, &a.BookTitle, &a.BookAuthor,
+		&a.Locator, &chapter, &text, &note, &a.Color, &created, &updated); err != nil {
+		return nil, err
+	}
+	a.Chapter = chapter.String
+	a.Text = text.String
+	a.Note = note.String
+	a.CreatedAt = created.Time
+	a.UpdatedAt = updated.Time
+	return &a, nil
+}
+
+// CreateAnnotation stores a new annotation on book for a.Username. A zero
+// CreatedAt is set to now.
+func (db *DB) CreateAnnotation(book Book, a Annotation) (*Annotation, error) {
+	if a.CreatedAt.IsZero() {
+		a.CreatedAt = time.Now().UTC()
+	}
+	result, err := db.conn.Exec(`
+		INSERT INTO annotations (username, book_id, book_path, locator, chapter, text, note, color, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		a.Username, book.ID, book.Path, a.Locator, a.Chapter, a.Text, a.Note, a.Color, a.CreatedAt, time.Now().UTC(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	return db.GetAnnotation(a.Username, id)
+}
+
+// ImportAnnotations stores annotations on book for username, skipping any
+// with the same locator and text as one the user already has there, so the
+// same export can be imported again. It returns how many were added.
+func (db *DB) ImportAnnotations(username string, book Book, annotations []Annotation) (int, error) {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+	added := 0
+	for _, a := range annotations {
+		if a.CreatedAt.IsZero() {
+			a.CreatedAt = now
+		}
+		result, err := tx.Exec(`
+			INSERT INTO annotations (username, book_id, book_path, locator, chapter, text, note, color, created_at, updated_at)
+			SELECT ?, ?, ?, ?, ?, ?, ?, ?, ?, ?
+			WHERE NOT EXISTS (
+				SELECT 1 FROM annotations
+				WHERE username = ? AND book_id = ? AND locator = ? AND coalesce(text, '') = ?
+			)`,
+			username, book.ID, book.Path, a.Locator, a.Chapter, a.Text, a.Note, a.Color, a.CreatedAt, now,
+			username, book.ID, a.Locator, a.Text,
+		)
+		if err != nil {
+			return 0, err
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return 0, err
+		}
+		added += int(n)
+	}
+	return added, tx.Commit()
+}
+
+// GetAnnotation returns sql.ErrNoRows if the annotation doesn't exist or
+// belongs to someone else.
+func (db *DB) GetAnnotation(username string, id int64) (*Annotation, error) {
+	return scanAnnotation(db.conn.QueryRow(
+		"SELECT "+annotationColumns+" FROM annotations a LEFT JOIN books b ON b.id = a.book_id WHERE a.id = ? AND a.username = ?",
+		id, username,
+	))
+}
+
+// ListAnnotations returns username's annotations for one book or, with
+// bookID 0, every book. Within a book they are ordered by locator, shorter
+// first, which keeps page numbers and CFIs roughly in reading order.
+func (db *DB) ListAnnotations(username string, bookID int) ([]Annotation, error) {
+	query := "SELECT " + annotationColumns + " FROM annotations a LEFT JOIN books b ON b.id = a.book_id WHERE a.username = ?"
+	args := []any{username}
+	if bookID != 0 {
+		query += " AND a.book_id = ?"
+		args = append(args, bookID)
+	}
+	query += " ORDER BY b.author COLLATE NOCASE, b.title COLLATE NOCASE, a.book_id, length(a.locator), a.locator, a.id"
+	rows, err := db.conn.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	annotations := []Annotation{}
+	for rows.Next() {
+		a, err := scanAnnotation(rows)
+		if err != nil {
+			return nil, err
+		}
+		annotations = append(annotations, *a)
+	}
+	return annotations, rows.Err()
+}
+
+// UpdateAnnotation replaces an annotation's locator, chapter, text, note,
+// and color.
+func (db *DB) UpdateAnnotation(a Annotation) (bool, error) {
+	result, err := db.conn.Exec(`
+		UPDATE annotations SET locator = ?, chapter = ?, text = ?, note = ?, color = ?, updated_at = ?
+		WHERE id = ? AND username = ?`,
+		a.Locator, a.Chapter, a.Text, a.Note, a.Color, time.Now().UTC(), a.ID, a.Username,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+func (db *DB) DeleteAnnotation(username string, id int64) (bool, error) {
+	result, err := db.conn.Exec(`DELETE FROM annotations WHERE id = ? AND username = ?`, id, username)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// RelinkAnnotations points annotations at the book that now has their
+// path, e.g. after a rebuild has renumbered the books.
+func (db *DB) RelinkAnnotations() error {
+	_, err := db.conn.Exec(`
+		UPDATE annotations
+		SET book_id = (SELECT id FROM books WHERE path = annotations.book_path)
+		WHERE book_path IS NOT NULL
+			AND EXISTS (SELECT 1 FROM books WHERE path = annotations.book_path)
+			AND book_id <> (SELECT id FROM books WHERE path = annotations.book_path)`)
+	return err
+}
@@ -0,0 +1,105 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+)
+
+const (
+	AuditActionMetadata = "metadata"
+	AuditActionCover    = "cover"
+	// AuditActionCatalog is a change to the cached row only; the EPUB was
+	// not rewritten.
+	AuditActionCatalog = "catalog"
+)
+
+// AuditEntry records one metadata or cover change to a book. Before and After
+// hold JSON snapshots whose shape depends on Action.
+type AuditEntry struct {
+	ID        int64           `json:"id"`
+	BookID    int             `json:"book_id"`
+	Actor     string          `json:"actor"`
+	Action    string          `json:"action"`
+	Before    json.RawMessage `json:"before"`
+	After     json.RawMessage `json:"after"`
+	RevertOf  int64           `json:"revert_of,omitempty"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+const auditTableDDL = `
+CREATE TABLE IF NOT EXISTS metadata_audit (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	book_id INTEGER NOT NULL,
+	actor TEXT,
+	action TEXT NOT NULL,
+	before_json TEXT,
+	after_json TEXT,
+	revert_of INTEGER,
+	created_at DATETIME
+);
+CREATE INDEX IF NOT EXISTS idx_metadata_audit_book ON metadata_audit(book_id, id);`
+
+const auditColumns = "id, book_id, actor, action, before_json, after_json, revert_of, created_at"
+
+func scanAuditEntry(row interface{ Scan(...any) error }) (*AuditEntry, error) {
+	var e AuditEntry
+	var actor, before, after sql.NullString
+	var revertOf sql.NullInt64
+	if err := row.Scan(&e.ID, &e.BookID, &actor, &e.Action, &before, &after, &revertOf, &e.CreatedAt); err != nil {
+		return nil, err
+	}
+	e.Actor = actor.String
+	e.Before = rawJSONOrNull(before.String)
+	e.After = rawJSONOrNull(after.String)
+	e.RevertOf = revertOf.Int64
+	return &e, nil
+}
+
+func rawJSONOrNull(s string) json.RawMessage {
+	if s == "" {
+		return json.RawMessage("null")
+	}
+	return json.RawMessage(s)
+}
+
+func (db *DB) AddAuditEntry(e AuditEntry) (int64, error) {
+	if e.CreatedAt.IsZero() {
+		e.CreatedAt = time.Now().UTC()
+	}
+	var revertOf any
+	if e.RevertOf > 0 {
+		revertOf = e.RevertOf
+	}
+	result, err := db.conn.Exec(
+		`INSERT INTO metadata_audit (book_id, actor, action, before_json, after_json, revert_of, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		e.BookID, e.Actor, e.Action, string(e.Before), string(e.After), revertOf, e.CreatedAt,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+func (db *DB) GetAuditEntry(id int64) (*AuditEntry, error) {
+	return scanAuditEntry(db.conn.QueryRow("SELECT "+auditColumns+" FROM metadata_audit WHERE id = ?", id))
+}
+
+// GetBookAuditHistory returns a book's changes, newest first.
+func (db *DB) GetBookAuditHistory(bookID int, limit int) ([]AuditEntry, error) {
+	rows, err := db.conn.Query("SELECT "+auditColumns+" FROM metadata_audit WHERE book_id = ? ORDER BY id DESC LIMIT ?", bookID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := make([]AuditEntry, 0)
+	for rows.Next() {
+		e, err := scanAuditEntry(rows)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, *e)
+	}
+	return entries, rows.Err()
+}
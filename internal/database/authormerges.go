@@ -0,0 +1,217 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// AuthorCount is one spelling of an author as it appears in the catalog,
+// with how many books carry it.
+type AuthorCount struct {
+	Name  string `json:"name"`
+	Books int    `json:"books"`
+}
+
+// AuthorMerge records spellings of an author that were replaced with one
+// canonical name, so the merge can be undone.
+type AuthorMerge struct {
+	ID        int64      `json:"id"`
+	Canonical string     `json:"canonical"`
+	Variants  []string   `json:"variants"`
+	Books     int        `json:"books"`
+	Actor     string     `json:"actor"`
+	CreatedAt time.Time  `json:"created_at"`
+	UndoneAt  *time.Time `json:"undone_at,omitempty"`
+}
+
+// AuthorMergeBook is a book a merge renamed and the author it had before.
+type AuthorMergeBook struct {
+	BookID         int    `json:"book_id"`
+	Path           string `json:"path"`
+	PreviousAuthor string `json:"previous_author"`
+}
+
+// author_merge_books is keyed by path rather than book ID, so a merge can
+// still be undone after a rebuild renumbers the books.
+const authorMergesTableDDL = `
+CREATE TABLE IF NOT EXISTS author_merges (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	canonical TEXT NOT NULL,
+	variants TEXT NOT NULL,
+	books INTEGER NOT NULL,
+	actor TEXT,
+	created_at DATETIME,
+	undone_at DATETIME
+);
+CREATE TABLE IF NOT EXISTS author_merge_books (
+	merge_id INTEGER NOT NULL,
+	book_path TEXT NOT NULL,
+	previous_author TEXT NOT NULL,
+	PRIMARY KEY (merge_id, book_path)
+);`
+
+// AuthorCounts lists every author spelling in the catalog with its number
+// of books.
+func (db *DB) AuthorCounts() ([]AuthorCount, error) {
+	rows, err := db.conn.Query(`SELECT author, COUNT(*) FROM books WHERE author <> '' GROUP BY author ORDER BY author`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := []AuthorCount{}
+	for rows.Next() {
+		var c AuthorCount
+		if err := rows.Scan(&c.Name, &c.Books); err != nil {
+			return nil, err
+		}
+		counts = append(counts, c)
+	}
+	return counts, rows.Err()
+}
+
+// GetBooksByAuthors returns the books whose author is exactly one of names.
+func (db *DB) GetBooksByAuthors(names []string) ([]Book, error) {
+	if len(names) == 0 {
+		return []Book{}, nil
+	}
+	args := make([]any, len(names))
+	for i, n := range names {
+		args[i] = n
+	}
+	rows, err := db.conn.Query(`
+		SELECT `+bookColumns+`
+		FROM books WHERE author IN (?`+strings.Repeat(", ?", len(names)-1)+`)
+		ORDER BY id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	books := []Book{}
+	for rows.Next() {
+		b, err := scanBook(rows)
+		if err != nil {
+			return nil, err
+		}
+		books = append(books, b)
+	}
+	return books, rows.Err()
+}
+
+// RecordAuthorMerge stores a merge and the books it renamed, returning the
+// merge with its ID.
+func (db *DB) RecordAuthorMerge(m AuthorMerge, books []AuthorMergeBook) (*AuthorMerge, error) {
+	variants, err := json.Marshal(m.Variants)
+	if err != nil {
+		return nil, err
+	}
+	m.Books = len(books)
+	m.CreatedAt = time.Now().UTC()
+
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(
+		`INSERT INTO author_merges (canonical, variants, books, actor, created_at) VALUES (?, ?, ?, ?, ?)`,
+		m.Canonical, string(variants), m.Books, m.Actor, m.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if m.ID, err = result.LastInsertId(); err != nil {
+		return nil, err
+	}
+	for _, b := range books {
+		if _, err := tx.Exec(
+			`INSERT OR REPLACE INTO author_merge_books (merge_id, book_path, previous_author) VALUES (?, ?, ?)`,
+			m.ID, b.Path, b.PreviousAuthor,
+		); err != nil {
+			return nil, err
+		}
+	}
+	return &m, tx.Commit()
+}
+
+const authorMergeColumns = "id, canonical, variants, books, actor, created_at, undone_at"
+
+func scanAuthorMerge(row interface{ Scan(...any) error }) (*AuthorMerge, error) {
+	var m AuthorMerge
+	var variants string
+	var actor sql.NullString
+	var undone sql.NullTime
+	if err := row.Scan(&m.ID, &m.Canonical, &variants, &m.Books, &actor, &m.CreatedAt, &undone); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(variants), &m.Variants); err != nil {
+		return nil, err
+	}
+	m.Actor = actor.String
+	if undone.Valid {
+		m.UndoneAt = &undone.Time
+	}
+	return &m, nil
+}
+
+func (db *DB) GetAuthorMerge(id int64) (*AuthorMerge, error) {
+	return scanAuthorMerge(db.conn.QueryRow("SELECT "+authorMergeColumns+" FROM author_merges WHERE id = ?", id))
+}
+
+// AuthorMerges returns the most recent merges, newest first.
+func (db *DB) AuthorMerges(limit int) ([]AuthorMerge, error) {
+	rows, err := db.conn.Query("SELECT "+authorMergeColumns+" FROM author_merges ORDER BY id DESC LIMIT ?", limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	merges := []AuthorMerge{}
+	for rows.Next() {
+		m, err := scanAuthorMerge(rows)
+		if err != nil {
+			return nil, err
+		}
+		merges = append(merges, *m)
+	}
+	return merges, rows.Err()
+}
+
+// AuthorMergeBooks returns the books a merge renamed that are still in the
+// library, under their current IDs.
+func (db *DB) AuthorMergeBooks(mergeID int64) ([]AuthorMergeBook, error) {
+	rows, err := db.conn.Query(`
+		SELECT b.id, b.path, m.previous_author
+		FROM author_merge_books m JOIN books b ON b.path = m.book_path
+		WHERE m.merge_id = ?
+		ORDER BY b.id`, mergeID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	books := []AuthorMergeBook{}
+	for rows.Next() {
+		var b AuthorMergeBook
+		if err := rows.Scan(&b.BookID, &b.Path, &b.PreviousAuthor); err != nil {
+			return nil, err
+		}
+		books = append(books, b)
+	}
+	return books, rows.Err()
+}
+
+// MarkAuthorMergeUndone flags a merge as undone. It reports false if the
+// merge doesn't exist or was already undone, so two undos can't both run.
+func (db *DB) MarkAuthorMergeUndone(id int64) (bool, error) {
+	result, err := db.conn.Exec(`UPDATE author_merges SET undone_at = ? WHERE id = ? AND undone_at IS NULL`, time.Now().UTC(), id)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
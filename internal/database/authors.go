@@ -0,0 +1,85 @@
+package database
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+)
+
+// authors and series hold what GoPDS has learned about the people and
+// series named in book metadata, keyed by the name as books spell it
+// (lower-cased). Rows are filled in by metadata lookups such as Wikidata;
+// a missing row just means nothing is known yet.
+const authorsTableDDL = `
+CREATE TABLE IF NOT EXISTS authors (
+	name_key TEXT PRIMARY KEY,
+	canonical_name TEXT NOT NULL,
+	birth_year INTEGER,
+	wikidata_id TEXT,
+	updated_at DATETIME
+);`
+
+const seriesTableDDL = `
+CREATE TABLE IF NOT EXISTS series (
+	name_key TEXT PRIMARY KEY,
+	name TEXT NOT NULL,
+	wikidata_id TEXT,
+	updated_at DATETIME
+);`
+
+// AuthorInfo is what is known about an author.
+type AuthorInfo struct {
+	Name          string `json:"name"`
+	CanonicalName string `json:"canonical_name"`
+	BirthYear     int    `json:"birth_year,omitempty"`
+	WikidataID    string `json:"wikidata_id,omitempty"`
+}
+
+// SeriesInfo is what is known about a series.
+type SeriesInfo struct {
+	Name       string `json:"name"`
+	WikidataID string `json:"wikidata_id,omitempty"`
+}
+
+func nameKey(name string) string {
+	return strings.ToLower(strings.TrimSpace(name))
+}
+
+// SaveAuthorInfo records a, replacing anything known about a.Name.
+func (db *DB) SaveAuthorInfo(a AuthorInfo) error {
+	_, err := db.conn.Exec(`
+		INSERT INTO authors (name_key, canonical_name, birth_year, wikidata_id, updated_at) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(name_key) DO UPDATE SET canonical_name=excluded.canonical_name, birth_year=excluded.birth_year,
+			wikidata_id=excluded.wikidata_id, updated_at=excluded.updated_at`,
+		nameKey(a.Name), a.CanonicalName, sql.NullInt64{Int64: int64(a.BirthYear), Valid: a.BirthYear != 0},
+		a.WikidataID, time.Now().UTC(),
+	)
+	return err
+}
+
+// GetAuthorInfo returns what is known about the author spelled name.
+func (db *DB) GetAuthorInfo(name string) (AuthorInfo, bool, error) {
+	a := AuthorInfo{Name: strings.TrimSpace(name)}
+	var birth sql.NullInt64
+	var wikidataID sql.NullString
+	err := db.conn.QueryRow(`SELECT canonical_name, birth_year, wikidata_id FROM authors WHERE name_key = ?`, nameKey(name)).
+		Scan(&a.CanonicalName, &birth, &wikidataID)
+	if err == sql.ErrNoRows {
+		return AuthorInfo{}, false, nil
+	}
+	if err != nil {
+		return AuthorInfo{}, false, err
+	}
+	a.BirthYear, a.WikidataID = int(birth.Int64), wikidataID.String
+	return a, true, nil
+}
+
+// SaveSeriesInfo records s, replacing anything known about s.Name.
+func (db *DB) SaveSeriesInfo(s SeriesInfo) error {
+	_, err := db.conn.Exec(`
+		INSERT INTO series (name_key, name, wikidata_id, updated_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT(name_key) DO UPDATE SET name=excluded.name, wikidata_id=excluded.wikidata_id, updated_at=excluded.updated_at`,
+		nameKey(s.Name), strings.TrimSpace(s.Name), s.WikidataID, time.Now().UTC(),
+	)
+	return err
+}
@@ -0,0 +1,93 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+)
+
+// catalogOrder is the order catalog listings use: author, then title,
+// ignoring case, with id breaking ties so every book has one place.
+const catalogOrder = "author COLLATE NOCASE, title COLLATE NOCASE, id"
+
+// BookCursor marks a book's place in catalog order, so a page can start
+// just after it instead of counting past every earlier book with OFFSET,
+// which gets slower the deeper the page.
+type BookCursor struct {
+	Author string
+	Title  string
+	ID     int
+}
+
+// CursorAfter returns the cursor that continues a listing after b.
+func CursorAfter(b Book) *BookCursor {
+	return &BookCursor{Author: b.Author, Title: b.Title, ID: b.ID}
+}
+
+// ErrInvalidCursor is returned by ParseBookCursor for a malformed token.
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// String encodes the cursor as an opaque token for use in URLs.
+func (c *BookCursor) String() string {
+	raw, _ := json.Marshal([]any{c.Author, c.Title, c.ID})
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+// ParseBookCursor decodes a token made by BookCursor.String.
+func ParseBookCursor(token string) (*BookCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	var fields []json.RawMessage
+	if err := json.Unmarshal(raw, &fields); err != nil || len(fields) != 3 {
+		return nil, ErrInvalidCursor
+	}
+	var c BookCursor
+	for i, dest := range []any{&c.Author, &c.Title, &c.ID} {
+		if err := json.Unmarshal(fields[i], dest); err != nil {
+			return nil, ErrInvalidCursor
+		}
+	}
+	if c.ID <= 0 {
+		return nil, ErrInvalidCursor
+	}
+	return &c, nil
+}
+
+// clause returns a SQL condition admitting the books after c in catalog
+// order, or "1=1" for a nil cursor.
+func (c *BookCursor) clause() (string, []any) {
+	if c == nil {
+		return "1=1", nil
+	}
+	return "(" + catalogOrder + ") > (?, ?, ?)", []any{c.Author, c.Title, c.ID}
+}
+
+// ForEachBookAfter streams the books f allows, and their subjects, to fn
+// in catalog order, starting after the cursor (or from the first book for
+// nil). Iteration stops at the first error fn returns.
+func (db *DB) ForEachBookAfter(f BookFilter, after *BookCursor, fn func(Book, []string) error) error {
+	cond, args := f.clause("")
+	afterCond, afterArgs := after.clause()
+	rows, err := db.conn.Query("SELECT "+bookColumns+", subjects FROM books WHERE "+cond+" AND "+afterCond+" ORDER BY "+catalogOrder, append(args, afterArgs...)...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var raw sql.NullString
+		b, err := scanBook(scanFunc(func(dest ...any) error {
+			return rows.Scan(append(dest, &raw)...)
+		}))
+		if err != nil {
+			return err
+		}
+		if err := fn(b, splitSubjects(raw.String)); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
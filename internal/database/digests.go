@@ -0,0 +1,111 @@
+package database
+
+import (
+	"database/sql"
+	"time"
+)
+
+// Digest frequencies.
+const (
+	DigestDaily  = "daily"
+	DigestWeekly = "weekly"
+)
+
+// DigestSubscription is a user's request for a periodic email of the books
+// added since the last one. BaseURL is the address the user subscribed
+// from, which the email's links use.
+type DigestSubscription struct {
+	Username   string    `json:"username"`
+	Frequency  string    `json:"frequency"`
+	BaseURL    string    `json:"base_url"`
+	LastSentAt time.Time `json:"last_sent_at"`
+	CreatedAt  time.Time `json:"created_at"`
+	// UnsubscribeToken lets the link in each email cancel the
+	// subscription without signing in.
+	UnsubscribeToken string `json:"-"`
+}
+
+const digestSubscriptionsTableDDL = `
+CREATE TABLE IF NOT EXISTS digest_subscriptions (
+	username TEXT PRIMARY KEY COLLATE NOCASE,
+	frequency TEXT NOT NULL,
+	base_url TEXT NOT NULL,
+	unsubscribe_token TEXT NOT NULL UNIQUE,
+	last_sent_at DATETIME NOT NULL,
+	created_at DATETIME NOT NULL
+);`
+
+const digestColumns = "username, frequency, base_url, unsubscribe_token, last_sent_at, created_at"
+
+func scanDigestSubscription(row interface{ Scan(...any) error }) (*DigestSubscription, error) {
+	var d DigestSubscription
+	if err := row.Scan(&d.Username, &d.Frequency, &d.BaseURL, &d.UnsubscribeToken, &d.LastSentAt, &d.CreatedAt); err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+// SubscribeDigest starts a subscription, or changes the frequency and
+// address of an existing one. A new subscription counts as sent now, so
+// the first email only has books added after it.
+func (db *DB) SubscribeDigest(username, frequency, baseURL, token string) (*DigestSubscription, error) {
+	now := time.Now().UTC()
+	_, err := db.conn.Exec(`
+		INSERT INTO digest_subscriptions (username, frequency, base_url, unsubscribe_token, last_sent_at, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT(username) DO UPDATE SET frequency = excluded.frequency, base_url = excluded.base_url`,
+		username, frequency, baseURL, token, now, now,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return db.GetDigestSubscription(username)
+}
+
+func (db *DB) GetDigestSubscription(username string) (*DigestSubscription, error) {
+	return scanDigestSubscription(db.conn.QueryRow("SELECT "+digestColumns+" FROM digest_subscriptions WHERE username = ?", username))
+}
+
+// DigestSubscriptions lists every subscription.
+func (db *DB) DigestSubscriptions() ([]DigestSubscription, error) {
+	rows, err := db.conn.Query("SELECT " + digestColumns + " FROM digest_subscriptions ORDER BY username")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	subs := []DigestSubscription{}
+	for rows.Next() {
+		d, err := scanDigestSubscription(rows)
+		if err != nil {
+			return nil, err
+		}
+		subs = append(subs, *d)
+	}
+	return subs, rows.Err()
+}
+
+func (db *DB) UnsubscribeDigest(username string) (bool, error) {
+	return deleteDigest(db.conn.Exec(`DELETE FROM digest_subscriptions WHERE username = ?`, username))
+}
+
+// UnsubscribeDigestByToken cancels the subscription an email's
+// unsubscribe link names.
+func (db *DB) UnsubscribeDigestByToken(token string) (bool, error) {
+	return deleteDigest(db.conn.Exec(`DELETE FROM digest_subscriptions WHERE unsubscribe_token = ?`, token))
+}
+
+func deleteDigest(result sql.Result, err error) (bool, error) {
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// MarkDigestSent records that username's digest covers books added up to
+// at.
+func (db *DB) MarkDigestSent(username string, at time.Time) error {
+	_, err := db.conn.Exec(`UPDATE digest_subscriptions SET last_sent_at = ? WHERE username = ?`, at.UTC(), username)
+	return err
+}
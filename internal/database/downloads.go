@@ -0,0 +1,104 @@
+package database
+
+import (
+	"strings"
+	"time"
+)
+
+// DownloadUsage totals a user's downloads over a period.
+type DownloadUsage struct {
+	Downloads int   `json:"downloads"`
+	Bytes     int64 `json:"bytes"`
+}
+
+// DownloadQuota holds a user's own download limits. A nil field falls back
+// to the server-wide default setting; zero means unlimited.
+type DownloadQuota struct {
+	DailyDownloads   *int `json:"daily_downloads,omitempty"`
+	MonthlyDownloads *int `json:"monthly_downloads,omitempty"`
+	DailyMB          *int `json:"daily_mb,omitempty"`
+	MonthlyMB        *int `json:"monthly_mb,omitempty"`
+}
+
+// downloadsTableDDL logs every served book file. Anonymous downloads are
+// recorded with an empty username.
+const downloadsTableDDL = `
+CREATE TABLE IF NOT EXISTS downloads (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	username TEXT NOT NULL DEFAULT '' COLLATE NOCASE,
+	book_id INTEGER NOT NULL,
+	format TEXT NOT NULL,
+	bytes INTEGER NOT NULL DEFAULT 0,
+	created_at DATETIME NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_downloads_user_time ON downloads(username, created_at);
+CREATE INDEX IF NOT EXISTS idx_downloads_time ON downloads(created_at);`
+
+// userQuotaColumns are the per-user quota overrides on the users table.
+var userQuotaColumns = []string{"quota_daily_downloads INTEGER", "quota_monthly_downloads INTEGER", "quota_daily_mb INTEGER", "quota_monthly_mb INTEGER"}
+
+func (db *DB) RecordDownload(username string, bookID int, format string, bytes int64, at time.Time) error {
+	_, err := db.conn.Exec(
+		`INSERT INTO downloads (username, book_id, format, bytes, created_at) VALUES (?, ?, ?, ?, ?)`,
+		username, bookID, format, bytes, at.UTC(),
+	)
+	return err
+}
+
+// DownloadUsageSince totals username's downloads at or after since.
+func (db *DB) DownloadUsageSince(username string, since time.Time) (DownloadUsage, error) {
+	var u DownloadUsage
+	err := db.conn.QueryRow(
+		`SELECT COUNT(*), coalesce(SUM(bytes), 0) FROM downloads WHERE username = ? AND created_at >= ?`,
+		username, since.UTC(),
+	).Scan(&u.Downloads, &u.Bytes)
+	return u, err
+}
+
+// DownloadedSince reports whether username has a download of bookID recorded
+// at or after since.
+func (db *DB) DownloadedSince(username string, bookID int, since time.Time) (bool, error) {
+	var n int
+	err := db.conn.QueryRow(
+		`SELECT COUNT(*) FROM downloads WHERE username = ? AND book_id = ? AND created_at >= ?`,
+		username, bookID, since.UTC(),
+	).Scan(&n)
+	return n > 0, err
+}
+
+// DownloadUsageByUser totals downloads at or after since for every username,
+// keyed by lower-cased name; anonymous downloads are under "".
+func (db *DB) DownloadUsageByUser(since time.Time) (map[string]DownloadUsage, error) {
+	rows, err := db.conn.Query(
+		`SELECT lower(username), COUNT(*), coalesce(SUM(bytes), 0) FROM downloads WHERE created_at >= ? GROUP BY lower(username)`,
+		since.UTC(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := map[string]DownloadUsage{}
+	for rows.Next() {
+		var name string
+		var u DownloadUsage
+		if err := rows.Scan(&name, &u.Downloads, &u.Bytes); err != nil {
+			return nil, err
+		}
+		out[strings.ToLower(name)] = u
+	}
+	return out, rows.Err()
+}
+
+// SetUserDownloadQuota replaces the user's quota overrides.
+func (db *DB) SetUserDownloadQuota(id int64, q DownloadQuota) (bool, error) {
+	result, err := db.conn.Exec(
+		`UPDATE users SET quota_daily_downloads = ?, quota_monthly_downloads = ?, quota_daily_mb = ?, quota_monthly_mb = ?, updated_at = ? WHERE id = ?`,
+		q.DailyDownloads, q.MonthlyDownloads, q.DailyMB, q.MonthlyMB, time.Now().UTC(), id,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
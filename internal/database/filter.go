@@ -0,0 +1,58 @@
+package database
+
+import "strings"
+
+// BookFilter narrows the books a query can return, for users who may only
+// see part of the library. The zero value allows every book.
+type BookFilter struct {
+	// Categories, if set, admits only books filed under one of them,
+	// compared case-insensitively. Uncategorized books are hidden.
+	Categories []string
+	// HideAdult hides books flagged as adult content.
+	HideAdult bool
+}
+
+// Restricted reports whether the filter hides anything.
+func (f BookFilter) Restricted() bool {
+	return len(f.Categories) > 0 || f.HideAdult
+}
+
+// AllowsCategory reports whether books in category are visible.
+func (f BookFilter) AllowsCategory(category string) bool {
+	if len(f.Categories) == 0 {
+		return true
+	}
+	category = strings.TrimSpace(category)
+	for _, c := range f.Categories {
+		if strings.EqualFold(c, category) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f BookFilter) Allows(b Book) bool {
+	return f.AllowsCategory(b.Category) && !(f.HideAdult && b.Adult)
+}
+
+// clause returns a SQL condition on the books table (aliased by prefix, e.g.
+// "b.") and its arguments, or "1=1" when the filter is unrestricted.
+func (f BookFilter) clause(prefix string) (string, []any) {
+	if !f.Restricted() {
+		return "1=1", nil
+	}
+	var conds []string
+	var args []any
+	if len(f.Categories) > 0 {
+		marks := make([]string, len(f.Categories))
+		for i, c := range f.Categories {
+			marks[i] = "?"
+			args = append(args, strings.ToLower(strings.TrimSpace(c)))
+		}
+		conds = append(conds, "lower(trim(coalesce("+prefix+"category,''))) IN ("+strings.Join(marks, ", ")+")")
+	}
+	if f.HideAdult {
+		conds = append(conds, "coalesce("+prefix+"adult_override, "+prefix+"adult, 0) = 0")
+	}
+	return strings.Join(conds, " AND "), args
+}
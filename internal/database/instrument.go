@@ -0,0 +1,132 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ab0oo/gopds/internal/metrics"
+)
+
+// timedConn wraps the connection pool so every statement issued through it
+// is recorded in metrics.DBQueryDuration. Query timings cover execution up
+// to the first row, not iteration of the result set.
+type timedConn struct {
+	*sql.DB
+	stmts *stmtCache
+}
+
+func (c timedConn) Exec(query string, args ...any) (sql.Result, error) {
+	return c.ExecContext(context.Background(), query, args...)
+}
+
+func (c timedConn) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	defer observeQuery(query, time.Now())
+	return c.DB.ExecContext(ctx, query, args...)
+}
+
+func (c timedConn) Query(query string, args ...any) (*sql.Rows, error) {
+	return c.QueryContext(context.Background(), query, args...)
+}
+
+func (c timedConn) QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	defer observeQuery(query, time.Now())
+	return c.DB.QueryContext(ctx, query, args...)
+}
+
+func (c timedConn) QueryRow(query string, args ...any) *sql.Row {
+	return c.QueryRowContext(context.Background(), query, args...)
+}
+
+func (c timedConn) QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row {
+	defer observeQuery(query, time.Now())
+	return c.DB.QueryRowContext(ctx, query, args...)
+}
+
+// QueryPrepared is Query through a statement prepared once and reused, for
+// queries run often enough that parsing and planning them each time shows.
+func (c timedConn) QueryPrepared(query string, args ...any) (*sql.Rows, error) {
+	stmt, err := c.stmts.get(c.DB, query)
+	if err != nil {
+		return nil, err
+	}
+	defer observeQuery(query, time.Now())
+	return stmt.Query(args...)
+}
+
+// QueryRowPrepared is QueryRow through a prepared statement.
+func (c timedConn) QueryRowPrepared(query string, args ...any) *sql.Row {
+	stmt, err := c.stmts.get(c.DB, query)
+	if err != nil {
+		// Let the row report the error when scanned.
+		return c.QueryRow(query, args...)
+	}
+	defer observeQuery(query, time.Now())
+	return stmt.QueryRow(args...)
+}
+
+// ExecPrepared is Exec through a prepared statement.
+func (c timedConn) ExecPrepared(query string, args ...any) (sql.Result, error) {
+	stmt, err := c.stmts.get(c.DB, query)
+	if err != nil {
+		return nil, err
+	}
+	defer observeQuery(query, time.Now())
+	return stmt.Exec(args...)
+}
+
+// stmtCache holds statements prepared by the timedConn methods, keyed by
+// their SQL. Queries that vary with a BookFilter produce one entry per
+// shape of filter in use, which stays small.
+type stmtCache struct {
+	mu    sync.Mutex
+	stmts map[string]*sql.Stmt
+}
+
+func newStmtCache() *stmtCache {
+	return &stmtCache{stmts: make(map[string]*sql.Stmt)}
+}
+
+func (c *stmtCache) get(db *sql.DB, query string) (*sql.Stmt, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if stmt, ok := c.stmts[query]; ok {
+		return stmt, nil
+	}
+	stmt, err := db.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	c.stmts[query] = stmt
+	return stmt, nil
+}
+
+func (c *stmtCache) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for query, stmt := range c.stmts {
+		stmt.Close()
+		delete(c.stmts, query)
+	}
+}
+
+func observeQuery(query string, start time.Time) {
+	metrics.DBQueryDuration.Observe(time.Since(start).Seconds(), statementKind(query))
+}
+
+// statementKind is the lowercased leading keyword of a statement, which keeps
+// the metric's label set small.
+func statementKind(query string) string {
+	fields := strings.Fields(query)
+	if len(fields) == 0 {
+		return "other"
+	}
+	switch kind := strings.ToLower(fields[0]); kind {
+	case "select", "insert", "update", "delete", "create", "alter", "drop", "pragma", "vacuum", "with":
+		return kind
+	default:
+		return "other"
+	}
+}
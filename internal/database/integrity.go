@@ -0,0 +1,88 @@
+package database
+
+import (
+	"database/sql"
+	"time"
+)
+
+// Problems an integrity check can find with a book's file.
+const (
+	IntegrityMissing    = "missing"    // the file is gone or can't be opened
+	IntegrityMismatch   = "mismatch"   // its contents changed without its modification time
+	IntegrityUnreadable = "unreadable" // it is no longer a readable EPUB, e.g. truncated
+)
+
+// IntegrityIssue is a problem the last integrity check found with a book's
+// file.
+type IntegrityIssue struct {
+	BookID       int       `json:"book_id"`
+	Path         string    `json:"path"`
+	Title        string    `json:"title"`
+	Author       string    `json:"author"`
+	Problem      string    `json:"problem"`
+	Detail       string    `json:"detail,omitempty"`
+	ExpectedHash string    `json:"expected_hash,omitempty"`
+	ActualHash   string    `json:"actual_hash,omitempty"`
+	DetectedAt   time.Time `json:"detected_at"`
+}
+
+const integrityIssuesTableDDL = `
+CREATE TABLE IF NOT EXISTS integrity_issues (
+	book_id INTEGER NOT NULL,
+	path TEXT NOT NULL,
+	title TEXT,
+	author TEXT,
+	problem TEXT NOT NULL,
+	detail TEXT,
+	expected_hash TEXT,
+	actual_hash TEXT,
+	detected_at DATETIME NOT NULL
+);`
+
+// ReplaceIntegrityIssues stores the findings of a completed check in place
+// of the previous one's.
+func (db *DB) ReplaceIntegrityIssues(issues []IntegrityIssue) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM integrity_issues`); err != nil {
+		return err
+	}
+	for _, i := range issues {
+		if _, err := tx.Exec(`
+			INSERT INTO integrity_issues (book_id, path, title, author, problem, detail, expected_hash, actual_hash, detected_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			i.BookID, i.Path, i.Title, i.Author, i.Problem, i.Detail, i.ExpectedHash, i.ActualHash, i.DetectedAt,
+		); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// IntegrityIssues lists what the last completed check found, by path.
+func (db *DB) IntegrityIssues() ([]IntegrityIssue, error) {
+	rows, err := db.conn.Query(`
+		SELECT book_id, path, title, author, problem, detail, expected_hash, actual_hash, detected_at
+		FROM integrity_issues ORDER BY path`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	issues := []IntegrityIssue{}
+	for rows.Next() {
+		var i IntegrityIssue
+		var title, author, detail, expected, actual sql.NullString
+		if err := rows.Scan(&i.BookID, &i.Path, &title, &author, &i.Problem, &detail, &expected, &actual, &i.DetectedAt); err != nil {
+			return nil, err
+		}
+		i.Title, i.Author, i.Detail = title.String, author.String, detail.String
+		i.ExpectedHash, i.ActualHash = expected.String, actual.String
+		issues = append(issues, i)
+	}
+	return issues, rows.Err()
+}
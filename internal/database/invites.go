@@ -0,0 +1,152 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+)
+
+// ErrInviteUnavailable is returned when an invite has been used, revoked,
+// or has expired.
+var ErrInviteUnavailable = errors.New("invite is no longer valid")
+
+// Invite lets one new user create their own account. The account gets Role
+// and Categories; only a SHA-256 hash of the link's token is stored.
+type Invite struct {
+	ID         int64     `json:"id"`
+	Role       string    `json:"role"`
+	Email      string    `json:"email,omitempty"`
+	Categories []string  `json:"categories"`
+	CreatedBy  string    `json:"created_by"`
+	CreatedAt  time.Time `json:"created_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	UsedAt     time.Time `json:"used_at,omitzero"`
+	UsedBy     string    `json:"used_by,omitempty"`
+}
+
+const invitesTableDDL = `
+CREATE TABLE IF NOT EXISTS invites (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	token_hash TEXT NOT NULL UNIQUE,
+	role TEXT NOT NULL,
+	email TEXT,
+	categories TEXT,
+	created_by TEXT,
+	created_at DATETIME,
+	expires_at DATETIME NOT NULL,
+	used_at DATETIME,
+	used_by TEXT
+);`
+
+const inviteColumns = "id, role, email, categories, created_by, created_at, expires_at, used_at, used_by"
+
+func scanInvite(row interface{ Scan(...any) error }) (*Invite, error) {
+	var inv Invite
+	var email, categories, createdBy, usedBy sql.NullString
+	var created, used sql.NullTime
+	if err := row.Scan(&inv.ID, &inv.Role, &email, &categories, &createdBy, &created, &inv.ExpiresAt, &used, &usedBy); err != nil {
+		return nil, err
+	}
+	inv.Email = email.String
+	inv.Categories = splitLines(categories.String)
+	inv.CreatedBy = createdBy.String
+	inv.CreatedAt = created.Time
+	inv.UsedAt = used.Time
+	inv.UsedBy = usedBy.String
+	return &inv, nil
+}
+
+func (db *DB) CreateInvite(tokenHash, role, email string, categories []string, createdBy string, expiresAt time.Time) (*Invite, error) {
+	result, err := db.conn.Exec(
+		`INSERT INTO invites (token_hash, role, email, categories, created_by, created_at, expires_at) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		tokenHash, role, email, strings.Join(categories, "\n"), createdBy, time.Now().UTC(), expiresAt.UTC(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	return scanInvite(db.conn.QueryRow("SELECT "+inviteColumns+" FROM invites WHERE id = ?", id))
+}
+
+// ListInvites returns every invite, newest first, used and expired ones
+// included.
+func (db *DB) ListInvites() ([]Invite, error) {
+	rows, err := db.conn.Query("SELECT " + inviteColumns + " FROM invites ORDER BY id DESC")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	invites := make([]Invite, 0)
+	for rows.Next() {
+		inv, err := scanInvite(rows)
+		if err != nil {
+			return nil, err
+		}
+		invites = append(invites, *inv)
+	}
+	return invites, rows.Err()
+}
+
+// GetOpenInvite returns the unused, unexpired invite with the given token
+// hash, or sql.ErrNoRows.
+func (db *DB) GetOpenInvite(tokenHash string, now time.Time) (*Invite, error) {
+	return scanInvite(db.conn.QueryRow(
+		"SELECT "+inviteColumns+" FROM invites WHERE token_hash = ? AND used_at IS NULL AND expires_at > ?",
+		tokenHash, now.UTC(),
+	))
+}
+
+// AcceptInvite creates the invited account and marks the invite used, in one
+// transaction so a link can't create two accounts. It returns
+// ErrInviteUnavailable if the invite was used or expired in the meantime,
+// and ErrUserExists if the username is taken.
+func (db *DB) AcceptInvite(id int64, username, email, passwordHash, kosyncHash string, now time.Time) (*User, error) {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	now = now.UTC()
+	result, err := tx.Exec(`UPDATE invites SET used_at = ?, used_by = ? WHERE id = ? AND used_at IS NULL AND expires_at > ?`, now, username, id, now)
+	if err != nil {
+		return nil, err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return nil, err
+	} else if n == 0 {
+		return nil, ErrInviteUnavailable
+	}
+
+	result, err = tx.Exec(
+		`INSERT INTO users (username, role, email, categories, password_hash, kosync_hash, created_at, updated_at)
+		SELECT ?, role, ?, categories, ?, ?, ?, ? FROM invites WHERE id = ?`,
+		username, email, passwordHash, kosyncHash, now, now, id,
+	)
+	if err != nil {
+		return nil, userWriteErr(err)
+	}
+	userID, err := result.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return db.GetUser(userID)
+}
+
+// DeleteInvite revokes an invite, used or not.
+func (db *DB) DeleteInvite(id int64) (bool, error) {
+	result, err := db.conn.Exec(`DELETE FROM invites WHERE id = ?`, id)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
@@ -0,0 +1,62 @@
+package database
+
+import "database/sql"
+
+// ISBNs are stored in books.isbn as the EPUB gives them, without
+// separators. NULL means the book was indexed before ISBNs were recorded;
+// an empty string means it has none.
+
+// SetBookISBNTx records a book's ISBN inside a scan transaction.
+func (db *DB) SetBookISBNTx(tx *sql.Tx, path, isbn string) error {
+	_, err := tx.Exec(`UPDATE books SET isbn = ? WHERE path = ?`, isbn, path)
+	return err
+}
+
+func (db *DB) SetBookISBN(id int, isbn string) error {
+	_, err := db.conn.Exec(`UPDATE books SET isbn = ? WHERE id = ?`, isbn, id)
+	return err
+}
+
+// BooksMissingISBN lists books indexed before ISBNs were recorded.
+func (db *DB) BooksMissingISBN() ([]Book, error) {
+	rows, err := db.conn.Query("SELECT " + bookColumns + " FROM books WHERE isbn IS NULL ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var books []Book
+	for rows.Next() {
+		b, err := scanBook(rows)
+		if err != nil {
+			return nil, err
+		}
+		books = append(books, b)
+	}
+	return books, rows.Err()
+}
+
+// ForEachBookWithISBN streams every book f allows, and its ISBN, to fn in
+// id order. Iteration stops at the first error fn returns.
+func (db *DB) ForEachBookWithISBN(f BookFilter, fn func(Book, string) error) error {
+	cond, args := f.clause("")
+	rows, err := db.conn.Query("SELECT "+bookColumns+", isbn FROM books WHERE "+cond+" ORDER BY id", args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var isbn sql.NullString
+		b, err := scanBook(scanFunc(func(dest ...any) error {
+			return rows.Scan(append(dest, &isbn)...)
+		}))
+		if err != nil {
+			return err
+		}
+		if err := fn(b, isbn.String); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
@@ -0,0 +1,213 @@
+package database
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+)
+
+const (
+	JobStatusQueued    = "queued"
+	JobStatusRunning   = "running"
+	JobStatusCompleted = "completed"
+	JobStatusFailed    = "failed"
+	JobStatusCancelled = "cancelled"
+)
+
+type Job struct {
+	ID          int64     `json:"id"`
+	Type        string    `json:"type"`
+	Status      string    `json:"status"`
+	Payload     string    `json:"payload,omitempty"`
+	Phase       string    `json:"phase"`
+	Message     string    `json:"message"`
+	Count       int       `json:"count"`
+	Error       string    `json:"error,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	StartedAt   time.Time `json:"started_at,omitempty"`
+	UpdatedAt   time.Time `json:"updated_at"`
+	CompletedAt time.Time `json:"completed_at,omitempty"`
+	// RequestID is the ID of the HTTP request that queued the job, if any.
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// Active reports whether the job is waiting for or occupying a worker.
+func (j Job) Active() bool {
+	return j.Status == JobStatusQueued || j.Status == JobStatusRunning
+}
+
+const jobsTableDDL = `
+CREATE TABLE IF NOT EXISTS jobs (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	type TEXT NOT NULL,
+	status TEXT NOT NULL,
+	payload TEXT,
+	phase TEXT,
+	message TEXT,
+	count INTEGER DEFAULT 0,
+	error TEXT,
+	created_at DATETIME,
+	started_at DATETIME,
+	updated_at DATETIME,
+	completed_at DATETIME,
+	request_id TEXT
+);
+CREATE INDEX IF NOT EXISTS idx_jobs_status ON jobs(status, id);`
+
+const jobColumns = "id, type, status, payload, phase, message, count, error, created_at, started_at, updated_at, completed_at, request_id"
+
+func scanJob(row interface{ Scan(...any) error }) (*Job, error) {
+	var j Job
+	var payload, phase, message, errMsg, requestID sql.NullString
+	var created, started, updated, completed sql.NullTime
+	if err := row.Scan(&j.ID, &j.Type, &j.Status, &payload, &phase, &message, &j.Count, &errMsg, &created, &started, &updated, &completed, &requestID); err != nil {
+		return nil, err
+	}
+	j.Payload = payload.String
+	j.Phase = phase.String
+	j.Message = message.String
+	j.Error = errMsg.String
+	j.CreatedAt = created.Time
+	j.StartedAt = started.Time
+	j.UpdatedAt = updated.Time
+	j.CompletedAt = completed.Time
+	j.RequestID = requestID.String
+	return &j, nil
+}
+
+func (db *DB) CreateJob(jobType, payload, message, requestID string) (*Job, error) {
+	now := time.Now().UTC()
+	result, err := db.conn.Exec(
+		`INSERT INTO jobs (type, status, payload, phase, message, count, created_at, updated_at, request_id) VALUES (?, ?, ?, ?, ?, 0, ?, ?, ?)`,
+		jobType, JobStatusQueued, payload, "queued", message, now, now, requestID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	return db.GetJob(id)
+}
+
+// ClaimNextJob atomically moves the oldest queued job to running and returns
+// it. It returns sql.ErrNoRows when the queue is empty.
+func (db *DB) ClaimNextJob() (*Job, error) {
+	now := time.Now().UTC()
+	row := db.conn.QueryRow(
+		`UPDATE jobs SET status = ?, phase = 'starting', started_at = ?, updated_at = ?
+		WHERE id = (SELECT id FROM jobs WHERE status = ? ORDER BY id LIMIT 1)
+		RETURNING `+jobColumns,
+		JobStatusRunning, now, now, JobStatusQueued,
+	)
+	return scanJob(row)
+}
+
+func (db *DB) UpdateJobProgress(id int64, phase, message string, count int) error {
+	_, err := db.conn.Exec(
+		`UPDATE jobs SET phase = ?, message = ?, count = ?, updated_at = ? WHERE id = ? AND status = ?`,
+		phase, message, count, time.Now().UTC(), id, JobStatusRunning,
+	)
+	return err
+}
+
+// FinishJob records the terminal state of a job. An empty phase or message
+// keeps whatever the handler last reported.
+func (db *DB) FinishJob(id int64, status, phase, message, errMsg string) error {
+	now := time.Now().UTC()
+	_, err := db.conn.Exec(
+		`UPDATE jobs SET status = ?,
+			phase = CASE WHEN ? = '' THEN phase ELSE ? END,
+			message = CASE WHEN ? = '' THEN message ELSE ? END,
+			error = ?, updated_at = ?, completed_at = ?
+		WHERE id = ?`,
+		status, phase, phase, message, message, errMsg, now, now, id,
+	)
+	return err
+}
+
+// CancelQueuedJob cancels a job that has not been picked up by a worker yet.
+// It reports whether a row was changed.
+func (db *DB) CancelQueuedJob(id int64) (bool, error) {
+	now := time.Now().UTC()
+	result, err := db.conn.Exec(
+		`UPDATE jobs SET status = ?, phase = 'cancelled', message = 'Cancelled before start.', updated_at = ?, completed_at = ? WHERE id = ? AND status = ?`,
+		JobStatusCancelled, now, now, id, JobStatusQueued,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// FailInterruptedJobs marks jobs left running by a previous process as failed.
+func (db *DB) FailInterruptedJobs() (int64, error) {
+	now := time.Now().UTC()
+	result, err := db.conn.Exec(
+		`UPDATE jobs SET status = ?, phase = 'failed', error = 'interrupted by server restart', updated_at = ?, completed_at = ? WHERE status = ?`,
+		JobStatusFailed, now, now, JobStatusRunning,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func (db *DB) GetJob(id int64) (*Job, error) {
+	return scanJob(db.conn.QueryRow("SELECT "+jobColumns+" FROM jobs WHERE id = ?", id))
+}
+
+// GetLatestJob returns the most recently created job of the given type.
+func (db *DB) GetLatestJob(jobType string) (*Job, error) {
+	return scanJob(db.conn.QueryRow("SELECT "+jobColumns+" FROM jobs WHERE type = ? ORDER BY id DESC LIMIT 1", jobType))
+}
+
+// GetActiveJob returns a queued or running job of the given type, if any.
+func (db *DB) GetActiveJob(jobType string) (*Job, error) {
+	return scanJob(db.conn.QueryRow(
+		"SELECT "+jobColumns+" FROM jobs WHERE type = ? AND status IN (?, ?) ORDER BY id LIMIT 1",
+		jobType, JobStatusQueued, JobStatusRunning,
+	))
+}
+
+func (db *DB) ListJobs(jobType, status string, limit int) ([]Job, error) {
+	query := "SELECT " + jobColumns + " FROM jobs WHERE 1=1"
+	args := []any{}
+	if jobType = strings.TrimSpace(jobType); jobType != "" {
+		query += " AND type = ?"
+		args = append(args, jobType)
+	}
+	if status = strings.TrimSpace(status); status != "" {
+		query += " AND status = ?"
+		args = append(args, status)
+	}
+	query += " ORDER BY id DESC LIMIT ?"
+	args = append(args, limit)
+
+	rows, err := db.conn.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	jobs := make([]Job, 0, limit)
+	for rows.Next() {
+		j, err := scanJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, *j)
+	}
+	return jobs, rows.Err()
+}
+
+// PruneJobs deletes finished jobs older than the cutoff.
+func (db *DB) PruneJobs(olderThan time.Time) error {
+	_, err := db.conn.Exec(
+		`DELETE FROM jobs WHERE status IN (?, ?, ?) AND completed_at < ?`,
+		JobStatusCompleted, JobStatusFailed, JobStatusCancelled, olderThan,
+	)
+	return err
+}
@@ -0,0 +1,65 @@
+package database
+
+import (
+	"database/sql"
+	"time"
+)
+
+// lookup_cache keeps responses from external metadata providers, keyed by
+// request, so repeated lookups for the same book don't go back out.
+const lookupCacheTableDDL = `
+CREATE TABLE IF NOT EXISTS lookup_cache (
+	key TEXT PRIMARY KEY,
+	content_type TEXT NOT NULL DEFAULT '',
+	body BLOB NOT NULL,
+	expires_at DATETIME NOT NULL
+);`
+
+// GetLookupCache returns an unexpired entry.
+func (db *DB) GetLookupCache(key string) (body []byte, contentType string, ok bool, err error) {
+	err = db.conn.QueryRow(`SELECT body, content_type FROM lookup_cache WHERE key = ? AND expires_at > ?`, key, time.Now().UTC()).
+		Scan(&body, &contentType)
+	if err == sql.ErrNoRows {
+		return nil, "", false, nil
+	}
+	if err != nil {
+		return nil, "", false, err
+	}
+	return body, contentType, true, nil
+}
+
+// PutLookupCache stores an entry for ttl, replacing any existing one.
+func (db *DB) PutLookupCache(key, contentType string, body []byte, ttl time.Duration) error {
+	_, err := db.conn.Exec(`
+		INSERT INTO lookup_cache (key, content_type, body, expires_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT(key) DO UPDATE SET content_type=excluded.content_type, body=excluded.body, expires_at=excluded.expires_at`,
+		key, contentType, body, time.Now().UTC().Add(ttl),
+	)
+	return err
+}
+
+// PruneLookupCache deletes expired entries and returns how many it removed.
+func (db *DB) PruneLookupCache() (int64, error) {
+	res, err := db.conn.Exec(`DELETE FROM lookup_cache WHERE expires_at <= ?`, time.Now().UTC())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// ClearLookupCache deletes every entry and returns how many there were.
+func (db *DB) ClearLookupCache() (int64, error) {
+	res, err := db.conn.Exec(`DELETE FROM lookup_cache`)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// LookupCacheStats returns the number of unexpired entries and their total
+// size in bytes.
+func (db *DB) LookupCacheStats() (entries int, size int64, err error) {
+	err = db.conn.QueryRow(`SELECT COUNT(*), COALESCE(SUM(length(body)), 0) FROM lookup_cache WHERE expires_at > ?`, time.Now().UTC()).
+		Scan(&entries, &size)
+	return entries, size, err
+}
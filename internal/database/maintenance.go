@@ -0,0 +1,40 @@
+package database
+
+// Vacuum rebuilds the database file, returning the space freed by deleted
+// rows to the filesystem, and refreshes the query planner's statistics.
+// The rebuilt pages go through the write-ahead log, which is then folded
+// back into the file and truncated.
+func (db *DB) Vacuum() error {
+	for _, stmt := range []string{`VACUUM`, `PRAGMA optimize`, `PRAGMA wal_checkpoint(TRUNCATE)`} {
+		if _, err := db.conn.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Check runs SQLite's integrity check, or with quick the faster check that
+// skips verifying indexes against their tables. It returns the problems
+// found, or none if the database is sound.
+func (db *DB) Check(quick bool) ([]string, error) {
+	pragma := `PRAGMA integrity_check`
+	if quick {
+		pragma = `PRAGMA quick_check`
+	}
+	rows, err := db.conn.Query(pragma)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var problems []string
+	for rows.Next() {
+		var line string
+		if err := rows.Scan(&line); err != nil {
+			return nil, err
+		}
+		if line != "ok" {
+			problems = append(problems, line)
+		}
+	}
+	return problems, rows.Err()
+}
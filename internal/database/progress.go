@@ -0,0 +1,179 @@
+package database
+
+import (
+	"database/sql"
+	"time"
+)
+
+// ReadingProgress is a reader's position in one document, as reported by a
+// KOReader device. Document is KOReader's document ID, normally the partial
+// MD5 of the file; BookID is the catalog book with that partial MD5, or zero
+// if none matched.
+type ReadingProgress struct {
+	Username   string    `json:"username"`
+	Document   string    `json:"document"`
+	BookID     int       `json:"book_id,omitempty"`
+	Progress   string    `json:"progress"`
+	Percentage float64   `json:"percentage"`
+	Device     string    `json:"device"`
+	DeviceID   string    `json:"device_id"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+const readingProgressTableDDL = `
+CREATE TABLE IF NOT EXISTS reading_progress (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	username TEXT NOT NULL,
+	document TEXT NOT NULL,
+	book_id INTEGER,
+	progress TEXT,
+	percentage REAL,
+	device TEXT,
+	device_id TEXT,
+	updated_at DATETIME,
+	UNIQUE(username, document)
+);
+CREATE INDEX IF NOT EXISTS idx_reading_progress_book ON reading_progress(book_id);`
+
+const readingProgressColumns = "username, document, book_id, progress, percentage, device, device_id, updated_at"
+
+func scanReadingProgress(row interface{ Scan(...any) error }) (*ReadingProgress, error) {
+	var p ReadingProgress
+	var bookID sql.NullInt64
+	var progress, device, deviceID sql.NullString
+	var percentage sql.NullFloat64
+	var updated sql.NullTime
+	if err := row.Scan(&p.Username, &p.Document, &bookID, &progress, &percentage, &device, &deviceID, &updated); err != nil {
+		return nil, err
+	}
+	p.BookID = int(bookID.Int64)
+	p.Progress = progress.String
+	p.Percentage = percentage.Float64
+	p.Device = device.String
+	p.DeviceID = deviceID.String
+	p.UpdatedAt = updated.Time
+	return &p, nil
+}
+
+// SaveReadingProgress upserts the position for (username, document) and
+// links it to the book whose partial MD5 matches the document ID.
+func (db *DB) SaveReadingProgress(p ReadingProgress) (*ReadingProgress, error) {
+	if p.UpdatedAt.IsZero() {
+		p.UpdatedAt = time.Now().UTC()
+	}
+	_, err := db.conn.Exec(`
+		INSERT INTO reading_progress (username, document, book_id, progress, percentage, device, device_id, updated_at)
+		VALUES (?, ?, (SELECT id FROM books WHERE partial_md5 = ? LIMIT 1), ?, ?, ?, ?, ?)
+		ON CONFLICT(username, document) DO UPDATE SET
+			book_id=COALESCE(excluded.book_id, reading_progress.book_id),
+			progress=excluded.progress,
+			percentage=excluded.percentage,
+			device=excluded.device,
+			device_id=excluded.device_id,
+			updated_at=excluded.updated_at`,
+		p.Username, p.Document, p.Document, p.Progress, p.Percentage, p.Device, p.DeviceID, p.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return db.GetReadingProgress(p.Username, p.Document)
+}
+
+// GetReadingProgress returns sql.ErrNoRows if the user has no position for
+// the document.
+func (db *DB) GetReadingProgress(username, document string) (*ReadingProgress, error) {
+	return scanReadingProgress(db.conn.QueryRow(
+		"SELECT "+readingProgressColumns+" FROM reading_progress WHERE username = ? AND document = ?",
+		username, document,
+	))
+}
+
+// SetBookPartialMD5Tx records a book's KOReader document ID inside a scan
+// transaction.
+func (db *DB) SetBookPartialMD5Tx(tx *sql.Tx, path, hash string) error {
+	_, err := tx.Exec(`UPDATE books SET partial_md5 = ? WHERE path = ?`, hash, path)
+	return err
+}
+
+func (db *DB) SetBookPartialMD5(id int, hash string) error {
+	_, err := db.conn.Exec(`UPDATE books SET partial_md5 = ? WHERE id = ?`, hash, id)
+	return err
+}
+
+// BooksMissingPartialMD5 lists books indexed before partial MD5s were
+// recorded.
+func (db *DB) BooksMissingPartialMD5() ([]Book, error) {
+	rows, err := db.conn.Query("SELECT " + bookColumns + " FROM books WHERE partial_md5 IS NULL OR partial_md5 = '' ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var books []Book
+	for rows.Next() {
+		b, err := scanBook(rows)
+		if err != nil {
+			return nil, err
+		}
+		books = append(books, b)
+	}
+	return books, rows.Err()
+}
+
+// RelinkReadingProgress points progress rows at the book that currently has
+// their document ID, e.g. after a rebuild has renumbered the books. Rows with
+// no match keep their link (the file may have been rewritten since the
+// device downloaded it) unless that book no longer exists.
+func (db *DB) RelinkReadingProgress() error {
+	if _, err := db.conn.Exec(`
+		UPDATE reading_progress
+		SET book_id = (SELECT id FROM books WHERE partial_md5 = reading_progress.document LIMIT 1)
+		WHERE EXISTS (SELECT 1 FROM books WHERE partial_md5 = reading_progress.document)`); err != nil {
+		return err
+	}
+	_, err := db.conn.Exec(`UPDATE reading_progress SET book_id = NULL WHERE book_id IS NOT NULL AND book_id NOT IN (SELECT id FROM books)`)
+	return err
+}
+
+// inProgressQuery selects the catalog books username has a synced position
+// in between 0 and below, with when each was last read.
+const inProgressQuery = `
+	FROM books b JOIN (
+		SELECT book_id, MAX(updated_at) AS last_read
+		FROM reading_progress
+		WHERE username = ? COLLATE NOCASE AND book_id IS NOT NULL AND percentage > 0 AND percentage < ?
+		GROUP BY book_id
+	) p ON p.book_id = b.id
+	WHERE `
+
+// InProgressBooks returns the books username has started but not read
+// past below (a fraction), most recently read first.
+func (db *DB) InProgressBooks(username string, below float64, f BookFilter, limit, offset int) ([]Book, error) {
+	cond, args := f.clause("b.")
+	rows, err := db.conn.Query(`
+		SELECT `+prefixedBookColumns("b.")+
+		inProgressQuery+cond+`
+		ORDER BY p.last_read DESC, b.id
+		LIMIT ? OFFSET ?`, append(append([]any{username, below}, args...), limit, offset)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	books := []Book{}
+	for rows.Next() {
+		b, err := scanBook(rows)
+		if err != nil {
+			return nil, err
+		}
+		books = append(books, b)
+	}
+	return books, rows.Err()
+}
+
+func (db *DB) CountInProgressBooks(username string, below float64, f BookFilter) (int, error) {
+	cond, args := f.clause("b.")
+	var n int
+	err := db.conn.QueryRow(`SELECT COUNT(*)`+inProgressQuery+cond, append([]any{username, below}, args...)...).Scan(&n)
+	return n, err
+}
@@ -0,0 +1,58 @@
+package database
+
+import "time"
+
+// provider_usage counts requests to each external metadata provider per UTC
+// day, so daily quotas survive restarts.
+const providerUsageTableDDL = `
+CREATE TABLE IF NOT EXISTS provider_usage (
+	provider TEXT NOT NULL,
+	day TEXT NOT NULL,
+	requests INTEGER NOT NULL DEFAULT 0,
+	PRIMARY KEY (provider, day)
+);`
+
+// usageDay is the provider_usage day for t.
+func usageDay(t time.Time) string {
+	return t.UTC().Format("2006-01-02")
+}
+
+// AddProviderUsage counts one request to provider today and returns today's
+// total.
+func (db *DB) AddProviderUsage(provider string) (int, error) {
+	var n int
+	err := db.conn.QueryRow(`
+		INSERT INTO provider_usage (provider, day, requests) VALUES (?, ?, 1)
+		ON CONFLICT(provider, day) DO UPDATE SET requests = requests + 1
+		RETURNING requests`,
+		provider, usageDay(time.Now()),
+	).Scan(&n)
+	return n, err
+}
+
+// ProviderUsageToday returns today's request count for each provider that
+// has made any.
+func (db *DB) ProviderUsageToday() (map[string]int, error) {
+	rows, err := db.conn.Query(`SELECT provider, requests FROM provider_usage WHERE day = ?`, usageDay(time.Now()))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := map[string]int{}
+	for rows.Next() {
+		var provider string
+		var n int
+		if err := rows.Scan(&provider, &n); err != nil {
+			return nil, err
+		}
+		out[provider] = n
+	}
+	return out, rows.Err()
+}
+
+// PruneProviderUsage deletes counts older than keep.
+func (db *DB) PruneProviderUsage(keep time.Duration) error {
+	_, err := db.conn.Exec(`DELETE FROM provider_usage WHERE day < ?`, usageDay(time.Now().Add(-keep)))
+	return err
+}
@@ -0,0 +1,143 @@
+package database
+
+import "time"
+
+// BookRating is a book's average star rating from the people who rated it,
+// and the caller's own rating, 0 if they haven't rated it.
+type BookRating struct {
+	BookID  int     `json:"book_id"`
+	Average float64 `json:"average"`
+	Count   int     `json:"count"`
+	Mine    int     `json:"mine,omitempty"`
+}
+
+// book_ratings keeps the book's path alongside its ID so ratings survive a
+// rebuild, which renumbers every book; see RelinkRatings.
+const bookRatingsTableDDL = `
+CREATE TABLE IF NOT EXISTS book_ratings (
+	username TEXT NOT NULL,
+	book_id INTEGER NOT NULL,
+	book_path TEXT,
+	rating INTEGER NOT NULL,
+	updated_at DATETIME,
+	PRIMARY KEY (username, book_id)
+);
+CREATE INDEX IF NOT EXISTS idx_book_ratings_book ON book_ratings(book_id);`
+
+// RateBook sets username's rating of book, from 1 to 5 stars.
+func (db *DB) RateBook(username string, book Book, rating int) error {
+	_, err := db.conn.Exec(`
+		INSERT INTO book_ratings (username, book_id, book_path, rating, updated_at)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(username, book_id) DO UPDATE SET
+			book_path = excluded.book_path,
+			rating = excluded.rating,
+			updated_at = excluded.updated_at`,
+		username, book.ID, book.Path, rating, time.Now().UTC(),
+	)
+	return err
+}
+
+func (db *DB) DeleteBookRating(username string, bookID int) (bool, error) {
+	result, err := db.conn.Exec(`DELETE FROM book_ratings WHERE username = ? AND book_id = ?`, username, bookID)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// GetBookRating returns a book's average rating and username's own.
+func (db *DB) GetBookRating(username string, bookID int) (BookRating, error) {
+	r := BookRating{BookID: bookID}
+	err := db.conn.QueryRow(`
+		SELECT coalesce(AVG(rating), 0), COUNT(*), coalesce(MAX(CASE WHEN username = ? THEN rating END), 0)
+		FROM book_ratings WHERE book_id = ?`, username, bookID,
+	).Scan(&r.Average, &r.Count, &r.Mine)
+	return r, err
+}
+
+// RelinkRatings points ratings at the book that now has their path, e.g.
+// after a rebuild has renumbered the books.
+func (db *DB) RelinkRatings() error {
+	_, err := db.conn.Exec(`
+		UPDATE OR IGNORE book_ratings
+		SET book_id = (SELECT id FROM books WHERE path = book_ratings.book_path)
+		WHERE book_path IS NOT NULL
+			AND EXISTS (SELECT 1 FROM books WHERE path = book_ratings.book_path)
+			AND book_id <> (SELECT id FROM books WHERE path = book_ratings.book_path)`)
+	return err
+}
+
+// popularQuery ranks the books downloaded at or after a time by how many
+// people downloaded them. A signed-in user counts once however often they
+// download a book; each anonymous download counts on its own.
+const popularQuery = `
+	FROM books b JOIN (
+		SELECT book_id,
+			COUNT(DISTINCT CASE WHEN username <> '' THEN lower(username) END) + SUM(username = '') AS readers
+		FROM downloads WHERE created_at >= ?
+		GROUP BY book_id
+	) d ON d.book_id = b.id
+	WHERE `
+
+// PopularBooks returns the books filter admits that were downloaded at or
+// after since, most widely downloaded first.
+func (db *DB) PopularBooks(f BookFilter, since time.Time, limit, offset int) ([]Book, error) {
+	cond, args := f.clause("b.")
+	return db.rankedBooks(`
+		SELECT `+prefixedBookColumns("b.")+
+		popularQuery+cond+`
+		ORDER BY d.readers DESC, b.title COLLATE NOCASE, b.id
+		LIMIT ? OFFSET ?`, append(append([]any{since.UTC()}, args...), limit, offset)...)
+}
+
+func (db *DB) CountPopularBooks(f BookFilter, since time.Time) (int, error) {
+	cond, args := f.clause("b.")
+	var n int
+	err := db.conn.QueryRow(`SELECT COUNT(*)`+popularQuery+cond, append([]any{since.UTC()}, args...)...).Scan(&n)
+	return n, err
+}
+
+const topRatedQuery = `
+	FROM books b JOIN (
+		SELECT book_id, AVG(rating) AS average, COUNT(*) AS ratings
+		FROM book_ratings GROUP BY book_id
+	) r ON r.book_id = b.id
+	WHERE `
+
+// TopRatedBooks returns the rated books filter admits, best average first;
+// ties go to the book more people rated.
+func (db *DB) TopRatedBooks(f BookFilter, limit, offset int) ([]Book, error) {
+	cond, args := f.clause("b.")
+	return db.rankedBooks(`
+		SELECT `+prefixedBookColumns("b.")+
+		topRatedQuery+cond+`
+		ORDER BY r.average DESC, r.ratings DESC, b.title COLLATE NOCASE, b.id
+		LIMIT ? OFFSET ?`, append(args, limit, offset)...)
+}
+
+func (db *DB) CountRatedBooks(f BookFilter) (int, error) {
+	cond, args := f.clause("b.")
+	var n int
+	err := db.conn.QueryRow(`SELECT COUNT(*)`+topRatedQuery+cond, args...).Scan(&n)
+	return n, err
+}
+
+func (db *DB) rankedBooks(query string, args ...any) ([]Book, error) {
+	rows, err := db.conn.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	books := []Book{}
+	for rows.Next() {
+		b, err := scanBook(rows)
+		if err != nil {
+			return nil, err
+		}
+		books = append(books, b)
+	}
+	return books, rows.Err()
+}
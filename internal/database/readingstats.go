@@ -0,0 +1,84 @@
+package database
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+)
+
+// ReadingActivity is one reader's progress through one document, with the
+// book it matched, if any.
+type ReadingActivity struct {
+	Username   string
+	BookID     int
+	Author     string
+	Path       string
+	ModTime    time.Time
+	Percentage float64
+	UpdatedAt  time.Time
+}
+
+// ReadingActivity lists username's reading progress, or everyone's for "".
+func (db *DB) ReadingActivity(username string) ([]ReadingActivity, error) {
+	query := `
+		SELECT p.username, coalesce(b.id, 0), coalesce(b.author, ''), coalesce(b.path, ''), b.mod_time, coalesce(p.percentage, 0), p.updated_at
+		FROM reading_progress p LEFT JOIN books b ON b.id = p.book_id`
+	var args []any
+	if username != "" {
+		query += ` WHERE p.username = ? COLLATE NOCASE`
+		args = append(args, username)
+	}
+	rows, err := db.conn.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []ReadingActivity
+	for rows.Next() {
+		var a ReadingActivity
+		var modTime, updated sql.NullTime
+		if err := rows.Scan(&a.Username, &a.BookID, &a.Author, &a.Path, &modTime, &a.Percentage, &updated); err != nil {
+			return nil, err
+		}
+		a.ModTime, a.UpdatedAt = modTime.Time, updated.Time
+		out = append(out, a)
+	}
+	return out, rows.Err()
+}
+
+// MonthlyDownloads totals one user's downloads in one calendar month (UTC),
+// formatted "2006-01".
+type MonthlyDownloads struct {
+	Username string
+	Month    string
+	DownloadUsage
+}
+
+// DownloadsByMonth totals downloads at or after since per user and month.
+// Usernames are lower-cased; anonymous downloads are under "".
+func (db *DB) DownloadsByMonth(since time.Time) ([]MonthlyDownloads, error) {
+	// created_at is stored as UTC text, so its first seven characters are
+	// the month.
+	rows, err := db.conn.Query(`
+		SELECT lower(username), substr(created_at, 1, 7) AS month, COUNT(*), coalesce(SUM(bytes), 0)
+		FROM downloads WHERE created_at >= ?
+		GROUP BY lower(username), month ORDER BY month`,
+		since.UTC(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []MonthlyDownloads
+	for rows.Next() {
+		var m MonthlyDownloads
+		if err := rows.Scan(&m.Username, &m.Month, &m.Downloads, &m.Bytes); err != nil {
+			return nil, err
+		}
+		m.Username = strings.ToLower(m.Username)
+		out = append(out, m)
+	}
+	return out, rows.Err()
+}
@@ -0,0 +1,89 @@
+package database
+
+import (
+	"database/sql"
+	"time"
+)
+
+// scan_resume remembers, per library root, the last file a scan committed,
+// so a scan that was interrupted can carry on from there. pending_covers
+// lists the committed books whose covers haven't been extracted yet, so a
+// crash before the cover workers got to them doesn't lose the covers.
+const scanResumeTableDDL = `
+CREATE TABLE IF NOT EXISTS scan_resume (
+	root TEXT PRIMARY KEY,
+	last_path TEXT NOT NULL,
+	updated_at DATETIME NOT NULL
+);
+CREATE TABLE IF NOT EXISTS pending_covers (
+	book_id INTEGER PRIMARY KEY
+);`
+
+// ScanResumePoint returns the last file an unfinished scan of root
+// committed, or "" when the last scan finished.
+func (db *DB) ScanResumePoint(root string) (string, error) {
+	var path string
+	err := db.conn.QueryRow(`SELECT last_path FROM scan_resume WHERE root = ?`, root).Scan(&path)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return path, err
+}
+
+// SetScanResumePointTx records path as the last file committed by the
+// scan of root, in the transaction that commits it.
+func SetScanResumePointTx(tx *sql.Tx, root, path string) error {
+	_, err := tx.Exec(`
+		INSERT INTO scan_resume (root, last_path, updated_at) VALUES (?, ?, ?)
+		ON CONFLICT(root) DO UPDATE SET last_path=excluded.last_path, updated_at=excluded.updated_at`,
+		root, path, time.Now().UTC(),
+	)
+	return err
+}
+
+// ClearScanResumePoint forgets root's resume point once a scan finishes.
+func (db *DB) ClearScanResumePoint(root string) error {
+	_, err := db.conn.Exec(`DELETE FROM scan_resume WHERE root = ?`, root)
+	return err
+}
+
+// PendingCover is a committed book still waiting for its cover.
+type PendingCover struct {
+	BookID int
+	Path   string
+}
+
+// QueueCoverTx records that bookID's cover is still to be extracted, in
+// the transaction that saves the book.
+func QueueCoverTx(tx *sql.Tx, bookID int) error {
+	_, err := tx.Exec(`INSERT OR IGNORE INTO pending_covers (book_id) VALUES (?)`, bookID)
+	return err
+}
+
+// CoverDone forgets bookID's pending cover once extraction was tried.
+func (db *DB) CoverDone(bookID int) error {
+	_, err := db.conn.Exec(`DELETE FROM pending_covers WHERE book_id = ?`, bookID)
+	return err
+}
+
+// PendingCovers lists the books still waiting for their covers, dropping
+// entries for books that have since been removed.
+func (db *DB) PendingCovers() ([]PendingCover, error) {
+	if _, err := db.conn.Exec(`DELETE FROM pending_covers WHERE book_id NOT IN (SELECT id FROM books)`); err != nil {
+		return nil, err
+	}
+	rows, err := db.conn.Query(`SELECT b.id, b.path FROM pending_covers p JOIN books b ON b.id = p.book_id ORDER BY b.id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var pending []PendingCover
+	for rows.Next() {
+		var c PendingCover
+		if err := rows.Scan(&c.BookID, &c.Path); err != nil {
+			return nil, err
+		}
+		pending = append(pending, c)
+	}
+	return pending, rows.Err()
+}
@@ -0,0 +1,156 @@
+package database
+
+import (
+	"database/sql"
+	"time"
+)
+
+// Session is a browser login. Only a SHA-256 hash of the cookie value is
+// stored, so a copy of the database can't be used to sign in.
+type Session struct {
+	ID        int64  `json:"id"`
+	Username  string `json:"username"`
+	IP        string `json:"ip"`
+	UserAgent string `json:"user_agent"`
+	// Device is a short description of UserAgent, such as "Firefox on
+	// Linux"; the web layer fills it in.
+	Device     string    `json:"device"`
+	Current    bool      `json:"current"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+const sessionsTableDDL = `
+CREATE TABLE IF NOT EXISTS sessions (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	token_hash TEXT NOT NULL UNIQUE,
+	username TEXT NOT NULL COLLATE NOCASE,
+	ip TEXT,
+	user_agent TEXT,
+	created_at DATETIME,
+	last_seen_at DATETIME,
+	expires_at DATETIME NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_sessions_username ON sessions(username);
+CREATE INDEX IF NOT EXISTS idx_sessions_expires ON sessions(expires_at);`
+
+// sessionExtraColumns are added to tables created before sessions were
+// listed.
+var sessionExtraColumns = []string{"ip TEXT", "user_agent TEXT", "last_seen_at DATETIME"}
+
+const sessionColumns = "id, username, ip, user_agent, created_at, last_seen_at, expires_at"
+
+func scanSession(row interface{ Scan(...any) error }) (*Session, error) {
+	var sess Session
+	var ip, userAgent sql.NullString
+	var created, lastSeen sql.NullTime
+	if err := row.Scan(&sess.ID, &sess.Username, &ip, &userAgent, &created, &lastSeen, &sess.ExpiresAt); err != nil {
+		return nil, err
+	}
+	sess.IP = ip.String
+	sess.UserAgent = userAgent.String
+	sess.CreatedAt = created.Time
+	sess.LastSeenAt = lastSeen.Time
+	if sess.LastSeenAt.IsZero() {
+		sess.LastSeenAt = sess.CreatedAt
+	}
+	return &sess, nil
+}
+
+func (db *DB) CreateSession(tokenHash, username, ip, userAgent string, expiresAt time.Time) error {
+	now := time.Now().UTC()
+	_, err := db.conn.Exec(
+		`INSERT INTO sessions (token_hash, username, ip, user_agent, created_at, last_seen_at, expires_at) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		tokenHash, username, ip, userAgent, now, now, expiresAt.UTC(),
+	)
+	return err
+}
+
+// TouchSession records that the session was just used from ip.
+func (db *DB) TouchSession(id int64, ip string, at time.Time) error {
+	_, err := db.conn.Exec(`UPDATE sessions SET last_seen_at = ?, ip = ? WHERE id = ?`, at.UTC(), ip, id)
+	return err
+}
+
+// ListUserSessions returns username's unexpired sessions, most recently used
+// first.
+func (db *DB) ListUserSessions(username string, now time.Time) ([]Session, error) {
+	rows, err := db.conn.Query(
+		"SELECT "+sessionColumns+" FROM sessions WHERE username = ? AND expires_at > ? ORDER BY coalesce(last_seen_at, created_at) DESC",
+		username, now.UTC(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := make([]Session, 0)
+	for rows.Next() {
+		sess, err := scanSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, *sess)
+	}
+	return sessions, rows.Err()
+}
+
+// DeleteUserSession ends one of username's sessions. It reports false if
+// there is no such session or it belongs to someone else.
+func (db *DB) DeleteUserSession(id int64, username string) (bool, error) {
+	result, err := db.conn.Exec(`DELETE FROM sessions WHERE id = ? AND username = ?`, id, username)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// DeleteOtherUserSessions ends every session of username except keepID and
+// returns how many ended.
+func (db *DB) DeleteOtherUserSessions(username string, keepID int64) (int64, error) {
+	result, err := db.conn.Exec(`DELETE FROM sessions WHERE username = ? AND id != ?`, username, keepID)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// GetSessionByHash returns the unexpired session with the given cookie hash,
+// or sql.ErrNoRows.
+func (db *DB) GetSessionByHash(tokenHash string, now time.Time) (*Session, error) {
+	return scanSession(db.conn.QueryRow(
+		"SELECT "+sessionColumns+" FROM sessions WHERE token_hash = ? AND expires_at > ?",
+		tokenHash, now.UTC(),
+	))
+}
+
+// DeleteSessionByHash reports false if there was no such session.
+func (db *DB) DeleteSessionByHash(tokenHash string) (bool, error) {
+	result, err := db.conn.Exec(`DELETE FROM sessions WHERE token_hash = ?`, tokenHash)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// DeleteUserSessions signs username out everywhere and returns how many
+// sessions ended.
+func (db *DB) DeleteUserSessions(username string) (int64, error) {
+	result, err := db.conn.Exec(`DELETE FROM sessions WHERE username = ?`, username)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// PruneSessions removes sessions that expired before now.
+func (db *DB) PruneSessions(now time.Time) (int64, error) {
+	result, err := db.conn.Exec(`DELETE FROM sessions WHERE expires_at <= ?`, now.UTC())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,74 @@
+package database
+
+import (
+	"database/sql"
+	"time"
+)
+
+// settings holds runtime overrides for tunables that otherwise come from the
+// environment. A missing row means "use the environment or the default".
+const settingsTableDDL = `
+CREATE TABLE IF NOT EXISTS settings (
+	key TEXT PRIMARY KEY,
+	value TEXT NOT NULL,
+	updated_at DATETIME,
+	updated_by TEXT
+);`
+
+// GetSetting returns a stored override and whether one exists.
+func (db *DB) GetSetting(key string) (string, bool, error) {
+	var value string
+	err := db.conn.QueryRow(`SELECT value FROM settings WHERE key = ?`, key).Scan(&value)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return value, true, nil
+}
+
+// ListSettings returns every stored override by key.
+func (db *DB) ListSettings() (map[string]string, error) {
+	rows, err := db.conn.Query(`SELECT key, value FROM settings`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := map[string]string{}
+	for rows.Next() {
+		var key, value string
+		if err := rows.Scan(&key, &value); err != nil {
+			return nil, err
+		}
+		out[key] = value
+	}
+	return out, rows.Err()
+}
+
+// UpdateSettings stores overrides and removes resets in one transaction.
+func (db *DB) UpdateSettings(set map[string]string, reset []string, by string) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+	for key, value := range set {
+		if _, err := tx.Exec(`
+			INSERT INTO settings (key, value, updated_at, updated_by) VALUES (?, ?, ?, ?)
+			ON CONFLICT(key) DO UPDATE SET value=excluded.value, updated_at=excluded.updated_at, updated_by=excluded.updated_by`,
+			key, value, now, by,
+		); err != nil {
+			return err
+		}
+	}
+	for _, key := range reset {
+		if _, err := tx.Exec(`DELETE FROM settings WHERE key = ?`, key); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
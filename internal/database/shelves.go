@@ -0,0 +1,270 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+)
+
+// ErrShelfExists is returned when a user already has a shelf with the name.
+var ErrShelfExists = errors.New("shelf name already in use")
+
+func shelfWriteErr(err error) error {
+	if err != nil && strings.Contains(err.Error(), "UNIQUE constraint failed") {
+		return ErrShelfExists
+	}
+	return err
+}
+
+// Shelf is a user's own named, ordered list of books.
+type Shelf struct {
+	ID          int64     `json:"id"`
+	Username    string    `json:"username"`
+	Name        string    `json:"name"`
+	Description string    `json:"description,omitempty"`
+	BookCount   int       `json:"book_count"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// shelf_books keeps the book's path alongside its ID so memberships survive
+// a rebuild, which renumbers every book; see RelinkShelfBooks.
+const shelvesTableDDL = `
+CREATE TABLE IF NOT EXISTS shelves (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	username TEXT NOT NULL,
+	name TEXT NOT NULL,
+	description TEXT,
+	created_at DATETIME,
+	updated_at DATETIME,
+	UNIQUE(username, name)
+);
+CREATE TABLE IF NOT EXISTS shelf_books (
+	shelf_id INTEGER NOT NULL,
+	book_id INTEGER NOT NULL,
+	book_path TEXT,
+	position INTEGER NOT NULL,
+	added_at DATETIME,
+	PRIMARY KEY (shelf_id, book_id)
+);
+CREATE INDEX IF NOT EXISTS idx_shelf_books_book ON shelf_books(book_id);`
+
+const shelfColumns = `s.id, s.username, s.name, s.description, s.created_at, s.updated_at,
+	(SELECT COUNT(*) FROM shelf_books sb JOIN books b ON b.id = sb.book_id WHERE sb.shelf_id = s.id)`
+
+func scanShelf(row interface{ Scan(...any) error }) (*Shelf, error) {
+	var sh Shelf
+	var description sql.NullString
+	var created, updated sql.NullTime
+	if err := row.Scan(&sh.ID, &sh.Username, &sh.Name, &description, &created, &updated, &sh.BookCount); err != nil {
+		return nil, err
+	}
+	sh.Description = description.String
+	sh.CreatedAt = created.Time
+	sh.UpdatedAt = updated.Time
+	return &sh, nil
+}
+
+// CreateShelf adds a shelf for username. Names are unique per user; a
+// duplicate fails with ErrShelfExists.
+func (db *DB) CreateShelf(username, name, description string) (*Shelf, error) {
+	now := time.Now().UTC()
+	result, err := db.conn.Exec(
+		`INSERT INTO shelves (username, name, description, created_at, updated_at) VALUES (?, ?, ?, ?, ?)`,
+		username, name, description, now, now,
+	)
+	if err != nil {
+		return nil, shelfWriteErr(err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	return db.GetShelf(username, id)
+}
+
+// GetShelf returns sql.ErrNoRows if the shelf doesn't exist or belongs to
+// someone else.
+func (db *DB) GetShelf(username string, id int64) (*Shelf, error) {
+	return scanShelf(db.conn.QueryRow("SELECT "+shelfColumns+" FROM shelves s WHERE s.id = ? AND s.username = ?", id, username))
+}
+
+func (db *DB) ListShelves(username string) ([]Shelf, error) {
+	rows, err := db.conn.Query("SELECT "+shelfColumns+" FROM shelves s WHERE s.username = ? ORDER BY s.name COLLATE NOCASE", username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	shelves := []Shelf{}
+	for rows.Next() {
+		sh, err := scanShelf(rows)
+		if err != nil {
+			return nil, err
+		}
+		shelves = append(shelves, *sh)
+	}
+	return shelves, rows.Err()
+}
+
+func (db *DB) UpdateShelf(username string, id int64, name, description string) (bool, error) {
+	result, err := db.conn.Exec(
+		`UPDATE shelves SET name = ?, description = ?, updated_at = ? WHERE id = ? AND username = ?`,
+		name, description, time.Now().UTC(), id, username,
+	)
+	if err != nil {
+		return false, shelfWriteErr(err)
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+func (db *DB) DeleteShelf(username string, id int64) (bool, error) {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`DELETE FROM shelves WHERE id = ? AND username = ?`, id, username)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil || n == 0 {
+		return false, err
+	}
+	if _, err := tx.Exec(`DELETE FROM shelf_books WHERE shelf_id = ?`, id); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// ShelfBooks returns the shelf's books that f allows, in shelf order.
+// Entries whose book is no longer in the catalog are skipped.
+func (db *DB) ShelfBooks(shelfID int64, f BookFilter, limit, offset int) ([]Book, error) {
+	cond, args := f.clause("b.")
+	rows, err := db.conn.Query(`
+		SELECT `+prefixedBookColumns("b.")+`
+		FROM shelf_books sb JOIN books b ON b.id = sb.book_id
+		WHERE sb.shelf_id = ? AND `+cond+`
+		ORDER BY sb.position, sb.added_at, b.id
+		LIMIT ? OFFSET ?`, append(append([]any{shelfID}, args...), limit, offset)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	books := []Book{}
+	for rows.Next() {
+		b, err := scanBook(rows)
+		if err != nil {
+			return nil, err
+		}
+		books = append(books, b)
+	}
+	return books, rows.Err()
+}
+
+// AddShelfBook appends a book to the end of a shelf. Adding a book that is
+// already there leaves its position alone.
+func (db *DB) AddShelfBook(shelfID int64, book Book) error {
+	now := time.Now().UTC()
+	_, err := db.conn.Exec(`
+		INSERT INTO shelf_books (shelf_id, book_id, book_path, position, added_at)
+		VALUES (?, ?, ?, (SELECT COALESCE(MAX(position), 0) + 1 FROM shelf_books WHERE shelf_id = ?), ?)
+		ON CONFLICT(shelf_id, book_id) DO UPDATE SET book_path = excluded.book_path`,
+		shelfID, book.ID, book.Path, shelfID, now,
+	)
+	if err != nil {
+		return err
+	}
+	return db.touchShelf(shelfID, now)
+}
+
+func (db *DB) RemoveShelfBook(shelfID int64, bookID int) (bool, error) {
+	result, err := db.conn.Exec(`DELETE FROM shelf_books WHERE shelf_id = ? AND book_id = ?`, shelfID, bookID)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil || n == 0 {
+		return false, err
+	}
+	return true, db.touchShelf(shelfID, time.Now().UTC())
+}
+
+// ReorderShelf moves the given books to the front of the shelf in the order
+// listed; books not listed keep their relative order after them. IDs that
+// aren't on the shelf are ignored.
+func (db *DB) ReorderShelf(shelfID int64, bookIDs []int) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`SELECT book_id FROM shelf_books WHERE shelf_id = ? ORDER BY position, added_at`, shelfID)
+	if err != nil {
+		return err
+	}
+	var current []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		current = append(current, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	onShelf := make(map[int]bool, len(current))
+	for _, id := range current {
+		onShelf[id] = true
+	}
+	placed := make(map[int]bool, len(current))
+	order := make([]int, 0, len(current))
+	for _, id := range bookIDs {
+		if onShelf[id] && !placed[id] {
+			order = append(order, id)
+			placed[id] = true
+		}
+	}
+	for _, id := range current {
+		if !placed[id] {
+			order = append(order, id)
+		}
+	}
+
+	for i, id := range order {
+		if _, err := tx.Exec(`UPDATE shelf_books SET position = ? WHERE shelf_id = ? AND book_id = ?`, i+1, shelfID, id); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec(`UPDATE shelves SET updated_at = ? WHERE id = ?`, time.Now().UTC(), shelfID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (db *DB) touchShelf(shelfID int64, at time.Time) error {
+	_, err := db.conn.Exec(`UPDATE shelves SET updated_at = ? WHERE id = ?`, at, shelfID)
+	return err
+}
+
+// RelinkShelfBooks points shelf entries at the book that now has their
+// path, e.g. after a rebuild has renumbered the books.
+func (db *DB) RelinkShelfBooks() error {
+	_, err := db.conn.Exec(`
+		UPDATE OR IGNORE shelf_books
+		SET book_id = (SELECT id FROM books WHERE path = shelf_books.book_path)
+		WHERE book_path IS NOT NULL
+			AND EXISTS (SELECT 1 FROM books WHERE path = shelf_books.book_path)
+			AND book_id <> (SELECT id FROM books WHERE path = shelf_books.book_path)`)
+	return err
+}
@@ -1,8 +1,12 @@
 package database
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
+	"net/url"
+	"path/filepath"
+	"runtime"
 	"strings"
 	"time"
 
@@ -17,11 +21,22 @@ type Book struct {
 	Description string    `json:"description"`
 	Category    string    `json:"category"`
 	Subcategory string    `json:"subcategory"`
+	Series      string    `json:"series"`
+	SeriesIndex string    `json:"series_index"`
+	FileHash    string    `json:"file_hash"`
 	ModTime     time.Time `json:"mod_time"`
+	// Adult is set for books flagged as adult content, by their subjects
+	// or by an admin.
+	Adult bool `json:"adult"`
+	// Available is cleared while the book's file can't be reached: the
+	// last full scan didn't find it, or the library it lives in, such as
+	// a network share, has gone away. The book is kept and listed, but its
+	// file can't be served until it is back.
+	Available bool `json:"available"`
 }
 
 type DB struct {
-	conn *sql.DB
+	conn timedConn
 }
 
 const booksTableDDL = `
@@ -33,54 +48,253 @@ CREATE TABLE IF NOT EXISTS books (
 	description TEXT,
 	category TEXT,
 	subcategory TEXT,
-	mod_time DATETIME
+	series TEXT,
+	series_index TEXT,
+	file_hash TEXT,
+	mod_time DATETIME,
+	partial_md5 TEXT,
+	subjects TEXT,
+	adult INTEGER NOT NULL DEFAULT 0,
+	adult_override INTEGER,
+	isbn TEXT,
+	unavailable INTEGER NOT NULL DEFAULT 0,
+	missing_since DATETIME
 );`
 
+// booksIndexDDL is applied after booksTableDDL and any column migrations.
+const booksIndexDDL = `
+CREATE INDEX IF NOT EXISTS idx_books_partial_md5 ON books(partial_md5);
+CREATE INDEX IF NOT EXISTS idx_books_file_hash ON books(file_hash);
+CREATE INDEX IF NOT EXISTS idx_books_catalog_order ON books(author COLLATE NOCASE, title COLLATE NOCASE, id);`
+
 const saveBookSQL = `
-	INSERT INTO books (path, title, author, description, category, subcategory, mod_time)
-	VALUES (?, ?, ?, ?, ?, ?, ?)
+	INSERT INTO books (path, title, author, description, category, subcategory, series, series_index, file_hash, mod_time)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 	ON CONFLICT(path) DO UPDATE SET
 		title=excluded.title,
 		author=excluded.author,
 		description=excluded.description,
 		category=excluded.category,
 		subcategory=excluded.subcategory,
-		mod_time=excluded.mod_time`
+		series=excluded.series,
+		series_index=excluded.series_index,
+		file_hash=excluded.file_hash,
+		mod_time=excluded.mod_time,
+		unavailable=0,
+		missing_since=NULL`
+
+// bookColumns is the column list scanBook expects, in order. An admin's
+// adult_override, when set, wins over the flag derived from subjects.
+var bookColumns = prefixedBookColumns("")
+
+// prefixedBookColumns is bookColumns with every column qualified by prefix
+// (e.g. "b."), for queries that join books to another table.
+func prefixedBookColumns(prefix string) string {
+	return strings.ReplaceAll("{}id, {}path, {}title, {}author, {}description, {}category, {}subcategory, {}series, {}series_index, {}file_hash, {}mod_time, coalesce({}adult_override, {}adult, 0), {}unavailable = 0", "{}", prefix)
+}
+
+func scanBook(row interface{ Scan(...any) error }) (Book, error) {
+	var b Book
+	var category, subcategory, series, seriesIndex, fileHash sql.NullString
+	err := row.Scan(&b.ID, &b.Path, &b.Title, &b.Author, &b.Description, &category, &subcategory, &series, &seriesIndex, &fileHash, &b.ModTime, &b.Adult, &b.Available)
+	b.Category = category.String
+	b.Subcategory = subcategory.String
+	b.Series = series.String
+	b.SeriesIndex = seriesIndex.String
+	b.FileHash = fileHash.String
+	return b, err
+}
+
+// connPragmas are applied to every pooled connection as it opens; a PRAGMA
+// run through the pool would reach only whichever connection ran it.
+// busy_timeout makes a connection wait for another's write to finish rather
+// than fail with "database is locked". cache_size is in KiB when negative.
+var connPragmas = []string{
+	"busy_timeout(5000)",
+	"journal_mode(WAL)",
+	"synchronous(NORMAL)",
+	"temp_store(MEMORY)",
+	"cache_size(-16384)",
+	"mmap_size(268435456)",
+}
+
+// maxOpenConns bounds the pool. WAL lets readers run alongside the one
+// writer, so feeds stay responsive during a scan, but each connection
+// holds its own page cache.
+func maxOpenConns() int {
+	return max(4, runtime.NumCPU())
+}
+
+// dsn adds the connection settings to a database path. Transactions begin
+// IMMEDIATE, taking the write lock up front: a deferred transaction that
+// reads and then writes can't wait out another writer and fails at once.
+func dsn(dbPath string) string {
+	q := url.Values{"_txlock": {"immediate"}}
+	for _, p := range connPragmas {
+		q.Add("_pragma", p)
+	}
+	sep := "?"
+	if strings.Contains(dbPath, "?") {
+		sep = "&"
+	}
+	return dbPath + sep + q.Encode()
+}
 
 func New(dbPath string) (*DB, error) {
-	db, err := sql.Open("sqlite", dbPath)
+	db, err := sql.Open("sqlite", dsn(dbPath))
 	if err != nil {
 		return nil, err
 	}
+	db.SetMaxOpenConns(maxOpenConns())
+	db.SetMaxIdleConns(maxOpenConns())
 
-	// Pragmas tuned for scan-heavy workloads.
-	if _, err := db.Exec(`PRAGMA journal_mode=WAL`); err != nil {
+	if _, err := db.Exec(booksTableDDL); err != nil {
 		return nil, err
 	}
-	if _, err := db.Exec(`PRAGMA synchronous=NORMAL`); err != nil {
+	if err := ensureBooksColumns(db); err != nil {
 		return nil, err
 	}
-	if _, err := db.Exec(`PRAGMA temp_store=MEMORY`); err != nil {
+	if err := ensureColumns(db, "books", "partial_md5 TEXT", "subjects TEXT", "adult INTEGER NOT NULL DEFAULT 0", "adult_override INTEGER", "isbn TEXT", "unavailable INTEGER NOT NULL DEFAULT 0", "missing_since DATETIME"); err != nil {
 		return nil, err
 	}
-	if _, err := db.Exec(`PRAGMA busy_timeout=5000`); err != nil {
+	// Books found missing before missing_since existed start their
+	// retention period now.
+	if _, err := db.Exec(`UPDATE books SET missing_since = ? WHERE unavailable = ? AND missing_since IS NULL`, time.Now().UTC(), unavailableMissing); err != nil {
 		return nil, err
 	}
-
-	if _, err := db.Exec(booksTableDDL); err != nil {
+	if _, err := db.Exec(booksIndexDDL); err != nil {
 		return nil, err
 	}
-	if err := ensureBooksColumns(db); err != nil {
+	if _, err := db.Exec(libraryVersionDDL); err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(jobsTableDDL); err != nil {
+		return nil, err
+	}
+	if err := ensureColumns(db, "jobs", "request_id TEXT"); err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(auditTableDDL); err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(activityTableDDL); err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(apiTokensTableDDL); err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(webhooksTableDDL); err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(readingProgressTableDDL); err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(shelvesTableDDL); err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(annotationsTableDDL); err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(bookRatingsTableDDL); err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(authorMergesTableDDL); err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(digestSubscriptionsTableDDL); err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(settingsTableDDL); err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(sessionsTableDDL); err != nil {
+		return nil, err
+	}
+	if err := ensureColumns(db, "sessions", sessionExtraColumns...); err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(usersTableDDL); err != nil {
+		return nil, err
+	}
+	if err := ensureColumns(db, "users", usersRoleColumn, "categories TEXT", "source TEXT NOT NULL DEFAULT 'local'", "totp_secret TEXT", "totp_enabled INTEGER NOT NULL DEFAULT 0", "totp_last_step INTEGER NOT NULL DEFAULT 0", "recovery_codes TEXT", "email TEXT", "reset_token_hash TEXT", "reset_expires_at DATETIME", "hide_adult INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return nil, err
+	}
+	if err := ensureColumns(db, "users", userQuotaColumns...); err != nil {
 		return nil, err
 	}
+	if _, err := db.Exec(downloadsTableDDL); err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(invitesTableDDL); err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(authorsTableDDL); err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(seriesTableDDL); err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(providerUsageTableDDL); err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(lookupCacheTableDDL); err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(scanResumeTableDDL); err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(bookAdditionsTableDDL); err != nil {
+		return nil, err
+	}
+	if err := backfillBookAdditions(db); err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(integrityIssuesTableDDL); err != nil {
+		return nil, err
+	}
+
+	return &DB{conn: timedConn{DB: db, stmts: newStmtCache()}}, nil
+}
+
+// Close closes the prepared statements and the connection pool. Call it
+// once background writers have stopped.
+func (db *DB) Close() error {
+	db.conn.stmts.close()
+	return db.conn.Close()
+}
+
+// Ping verifies the database file can be read.
+func (db *DB) Ping(ctx context.Context) error {
+	var one int
+	err := db.conn.QueryRowContext(ctx, "SELECT 1 FROM books LIMIT 1").Scan(&one)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	return err
+}
+
+// CountBooks returns the number of indexed books.
+func (db *DB) CountBooks() (int, error) {
+	var n int
+	err := db.conn.QueryRow("SELECT COUNT(*) FROM books").Scan(&n)
+	return n, err
+}
 
-	return &DB{conn: db}, nil
+// LibraryCounts returns how many books, distinct authors, and distinct series
+// the filter admits.
+func (db *DB) LibraryCounts(f BookFilter) (books, authors, series int, err error) {
+	where, args := f.clause("")
+	err = db.conn.QueryRow(
+		"SELECT COUNT(*), COUNT(DISTINCT nullif(lower(trim(author)), '')), COUNT(DISTINCT nullif(lower(trim(series)), '')) FROM books WHERE "+where,
+		args...,
+	).Scan(&books, &authors, &series)
+	return books, authors, series, err
 }
 
 // NeedsReScan checks if the file at 'path' has been modified since last scan
 func (db *DB) NeedsReScan(path string, currentModTime time.Time) bool {
 	var lastMod time.Time
-	err := db.conn.QueryRow("SELECT mod_time FROM books WHERE path = ?", path).Scan(&lastMod)
+	err := db.conn.QueryRowPrepared("SELECT mod_time FROM books WHERE path = ?", path).Scan(&lastMod)
 	if err == sql.ErrNoRows {
 		return true // New book
 	}
@@ -88,7 +302,7 @@ func (db *DB) NeedsReScan(path string, currentModTime time.Time) bool {
 }
 
 func (db *DB) SaveBook(b Book) (int64, error) {
-	result, err := db.conn.Exec(saveBookSQL, b.Path, b.Title, b.Author, b.Description, b.Category, b.Subcategory, b.ModTime)
+	result, err := db.conn.ExecPrepared(saveBookSQL, b.Path, b.Title, b.Author, b.Description, b.Category, b.Subcategory, b.Series, b.SeriesIndex, b.FileHash, b.ModTime)
 	if err != nil {
 		return 0, err
 	}
@@ -101,7 +315,12 @@ func (db *DB) Begin() (*sql.Tx, error) {
 }
 
 func (db *DB) SaveBookTx(tx *sql.Tx, b Book) (int64, error) {
-	result, err := tx.Exec(saveBookSQL, b.Path, b.Title, b.Author, b.Description, b.Category, b.Subcategory, b.ModTime)
+	stmt, err := db.conn.stmts.get(db.conn.DB, saveBookSQL)
+	if err != nil {
+		return 0, err
+	}
+	defer observeQuery(saveBookSQL, time.Now())
+	result, err := tx.Stmt(stmt).Exec(b.Path, b.Title, b.Author, b.Description, b.Category, b.Subcategory, b.Series, b.SeriesIndex, b.FileHash, b.ModTime)
 	if err != nil {
 		return 0, err
 	}
@@ -117,15 +336,145 @@ func (db *DB) UpdateBookMetadata(id int, title, author, description string, modT
 	return err
 }
 
+func (db *DB) UpdateBookSeries(id int, series, seriesIndex string) error {
+	_, err := db.conn.Exec("UPDATE books SET series = ?, series_index = ? WHERE id = ?", series, seriesIndex, id)
+	return err
+}
+
+// UpdateBookFileHash stores the content hash of a book file after it has
+// been rewritten in place.
+func (db *DB) UpdateBookFileHash(id int, hash string) error {
+	_, err := db.conn.Exec("UPDATE books SET file_hash = ? WHERE id = ?", hash, id)
+	return err
+}
+
 func (db *DB) UpdateBookPath(id int, path string) error {
 	query := `
 	UPDATE books
-	SET path = ?
+	SET path = ?, unavailable = 0, missing_since = NULL
 	WHERE id = ?`
 	_, err := db.conn.Exec(query, path, id)
 	return err
 }
 
+// DeleteBook removes a book's row, for files that have been taken out of
+// the library. Progress and shelf entries that refer to it are relinked if
+// the file comes back.
+func (db *DB) DeleteBook(id int) error {
+	_, err := db.conn.Exec(`DELETE FROM books WHERE id = ?`, id)
+	return err
+}
+
+// CountBooksUnder returns how many books have files under the directory
+// root.
+func (db *DB) CountBooksUnder(root string) (int, error) {
+	prefix := strings.TrimSuffix(root, string(filepath.Separator)) + string(filepath.Separator)
+	var n int
+	err := db.conn.QueryRow(`SELECT COUNT(*) FROM books WHERE substr(path, 1, length(?)) = ?`, prefix, prefix).Scan(&n)
+	return n, err
+}
+
+// Why a book is unavailable, in the books table's unavailable column; 0
+// means it is available.
+const (
+	unavailableMissing = 1 // a full scan didn't find its file
+	unavailableOffline = 2 // its library can't be reached
+)
+
+// SetBooksUnavailable flags every available book with a file under the
+// directory root as offline, or makes the books it flagged available
+// again, returning how many changed. Books whose files a scan found
+// missing stay that way.
+func (db *DB) SetBooksUnavailable(root string, unavailable bool) (int64, error) {
+	prefix := strings.TrimSuffix(root, string(filepath.Separator)) + string(filepath.Separator)
+	from, to := 0, unavailableOffline
+	if !unavailable {
+		from, to = unavailableOffline, 0
+	}
+	res, err := db.conn.Exec(`UPDATE books SET unavailable = ? WHERE substr(path, 1, length(?)) = ? AND unavailable = ?`,
+		to, prefix, prefix, from)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// SweepAvailability brings the availability of every book with a file
+// under the directory root in line with a full walk of it that found the
+// files in seen, returning the IDs of the books that went missing and how
+// many came back.
+func (db *DB) SweepAvailability(root string, seen map[string]bool) (gone []int, back int, err error) {
+	prefix := strings.TrimSuffix(root, string(filepath.Separator)) + string(filepath.Separator)
+	rows, err := db.conn.Query(`SELECT id, path, unavailable FROM books WHERE substr(path, 1, length(?)) = ?`, prefix, prefix)
+	if err != nil {
+		return nil, 0, err
+	}
+	var missing, found []int
+	for rows.Next() {
+		var id int
+		var path string
+		var unavailable int
+		if err := rows.Scan(&id, &path, &unavailable); err != nil {
+			rows.Close()
+			return nil, 0, err
+		}
+		switch {
+		case !seen[path] && unavailable != unavailableMissing:
+			missing = append(missing, id)
+		case seen[path] && unavailable != 0:
+			found = append(found, id)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+	if len(missing) == 0 && len(found) == 0 {
+		return nil, 0, nil
+	}
+
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return nil, 0, err
+	}
+	defer tx.Rollback()
+	now := time.Now().UTC()
+	for _, id := range missing {
+		if _, err := tx.Exec(`UPDATE books SET unavailable = ?, missing_since = ? WHERE id = ?`, unavailableMissing, now, id); err != nil {
+			return nil, 0, err
+		}
+	}
+	for _, id := range found {
+		if _, err := tx.Exec(`UPDATE books SET unavailable = 0, missing_since = NULL WHERE id = ?`, id); err != nil {
+			return nil, 0, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, 0, err
+	}
+	return missing, len(found), nil
+}
+
+// MissingBooks returns the books whose files a full scan found missing
+// before cutoff and that haven't turned up since. Books that are only
+// offline aren't included.
+func (db *DB) MissingBooks(cutoff time.Time) ([]Book, error) {
+	rows, err := db.conn.Query(`SELECT `+bookColumns+` FROM books WHERE unavailable = ? AND missing_since < ? ORDER BY id`, unavailableMissing, cutoff.UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	books := []Book{}
+	for rows.Next() {
+		b, err := scanBook(rows)
+		if err != nil {
+			return nil, err
+		}
+		books = append(books, b)
+	}
+	return books, rows.Err()
+}
+
 func (db *DB) RebuildBooksTable() error {
 	if _, err := db.conn.Exec("DROP TABLE IF EXISTS books"); err != nil {
 		return err
@@ -133,40 +482,130 @@ func (db *DB) RebuildBooksTable() error {
 	if _, err := db.conn.Exec(booksTableDDL); err != nil {
 		return err
 	}
+	if _, err := db.conn.Exec(booksIndexDDL); err != nil {
+		return err
+	}
+	// The books an interrupted scan committed are gone, so it has nothing
+	// to resume from.
+	if _, err := db.conn.Exec("DELETE FROM scan_resume"); err != nil {
+		return err
+	}
 	return nil
 }
 
+// BackupTo writes a consistent snapshot of the database to dest.
+func (db *DB) BackupTo(dest string) error {
+	_, err := db.conn.Exec("VACUUM INTO ?", dest)
+	return err
+}
+
 // GetAllBooks retrieves every book stored in the database.
 func (db *DB) GetAllBooks() ([]Book, error) {
-	query := "SELECT id, path, title, author, description, category, subcategory, mod_time FROM books"
-	rows, err := db.conn.Query(query)
+	var books []Book
+	err := db.ForEachBook(func(b Book) error {
+		books = append(books, b)
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
+	return books, nil
+}
+
+// ForEachBook streams every book to fn in id order without loading the
+// whole table into memory. Iteration stops at the first error fn returns.
+func (db *DB) ForEachBook(fn func(Book) error) error {
+	return db.ForEachVisibleBook(BookFilter{}, fn)
+}
+
+// ForEachVisibleBook is ForEachBook limited to the books f allows.
+func (db *DB) ForEachVisibleBook(f BookFilter, fn func(Book) error) error {
+	cond, args := f.clause("")
+	rows, err := db.conn.Query("SELECT "+bookColumns+" FROM books WHERE "+cond+" ORDER BY id", args...)
+	if err != nil {
+		return err
+	}
 	defer rows.Close()
 
-	var books []Book
 	for rows.Next() {
-		var b Book
-		err := rows.Scan(&b.ID, &b.Path, &b.Title, &b.Author, &b.Description, &b.Category, &b.Subcategory, &b.ModTime)
+		b, err := scanBook(rows)
 		if err != nil {
-			return nil, err
+			return err
+		}
+		if err := fn(b); err != nil {
+			return err
 		}
-		books = append(books, b)
 	}
-	return books, nil
+	return rows.Err()
 }
 
 func (db *DB) GetBookByID(id string) (*Book, error) {
-	var b Book
-	query := "SELECT id, path, title, author, description, category, subcategory, mod_time FROM books WHERE id = ?"
-	err := db.conn.QueryRow(query, id).Scan(&b.ID, &b.Path, &b.Title, &b.Author, &b.Description, &b.Category, &b.Subcategory, &b.ModTime)
+	b, err := scanBook(db.conn.QueryRowPrepared("SELECT "+bookColumns+" FROM books WHERE id = ?", id))
 	if err != nil {
 		return nil, err
 	}
 	return &b, nil
 }
 
+func (db *DB) GetBookByPath(path string) (*Book, error) {
+	b, err := scanBook(db.conn.QueryRowPrepared("SELECT "+bookColumns+" FROM books WHERE path = ?", path))
+	if err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+// GetBookByFileHash returns a book whose file has the given SHA-256.
+func (db *DB) GetBookByFileHash(hash string) (*Book, error) {
+	b, err := scanBook(db.conn.QueryRow("SELECT "+bookColumns+" FROM books WHERE file_hash = ? ORDER BY id LIMIT 1", hash))
+	if err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+// ensureColumns adds any of the given column definitions ("name TYPE") that
+// table lacks.
+func ensureColumns(db *sql.DB, table string, defs ...string) error {
+	existing, err := tableColumns(db, table)
+	if err != nil {
+		return err
+	}
+	for _, def := range defs {
+		name := strings.ToLower(strings.Fields(def)[0])
+		if _, ok := existing[name]; ok {
+			continue
+		}
+		if _, err := db.Exec("ALTER TABLE " + table + " ADD COLUMN " + def); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func tableColumns(db *sql.DB, table string) (map[string]struct{}, error) {
+	rows, err := db.Query("PRAGMA table_info(" + table + ")")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	existing := map[string]struct{}{}
+	for rows.Next() {
+		var cid int
+		var name string
+		var ctype string
+		var notnull int
+		var dflt sql.NullString
+		var pk int
+		if err := rows.Scan(&cid, &name, &ctype, &notnull, &dflt, &pk); err != nil {
+			return nil, err
+		}
+		existing[strings.ToLower(strings.TrimSpace(name))] = struct{}{}
+	}
+	return existing, rows.Err()
+}
+
 func ensureBooksColumns(db *sql.DB) error {
 	rows, err := db.Query("PRAGMA table_info(books)")
 	if err != nil {
@@ -198,6 +637,18 @@ func ensureBooksColumns(db *sql.DB) error {
 			return err
 		}
 	}
+	for _, col := range []string{"series", "series_index"} {
+		if _, ok := existing[col]; !ok {
+			if _, err := db.Exec("ALTER TABLE books ADD COLUMN " + col + " TEXT"); err != nil {
+				return err
+			}
+		}
+	}
+	if _, ok := existing["file_hash"]; !ok {
+		if _, err := db.Exec("ALTER TABLE books ADD COLUMN file_hash TEXT"); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -207,37 +658,52 @@ const authorInitialExpr = `CASE
 	ELSE '#'
 END`
 
-func (db *DB) CountBooksByAuthorRange(start, end string, includeOther bool) (int, error) {
+func (db *DB) CountBooksByAuthorRange(f BookFilter, start, end string, includeOther bool) (int, error) {
 	where := fmt.Sprintf("%s BETWEEN ? AND ?", authorInitialExpr)
 	args := []any{start, end}
 	if includeOther {
 		where = fmt.Sprintf("(%s BETWEEN ? AND ? OR %s = ?)", authorInitialExpr, authorInitialExpr)
 		args = append(args, "#")
 	}
+	cond, condArgs := f.clause("")
+	where += " AND " + cond
+	args = append(args, condArgs...)
 
 	query := fmt.Sprintf("SELECT COUNT(*) FROM books WHERE %s", where)
 	var count int
-	if err := db.conn.QueryRow(query, args...).Scan(&count); err != nil {
+	if err := db.conn.QueryRowPrepared(query, args...).Scan(&count); err != nil {
 		return 0, err
 	}
 	return count, nil
 }
 
-func (db *DB) GetBooksByAuthorRange(start, end string, includeOther bool, limit, offset int) ([]Book, error) {
+// GetBooksByAuthorRange returns a page of books whose authors fall in the
+// initials start to end, in catalog order. A non-nil after starts the page
+// just past that book and offset is ignored.
+func (db *DB) GetBooksByAuthorRange(f BookFilter, start, end string, includeOther bool, limit, offset int, after *BookCursor) ([]Book, error) {
 	where := fmt.Sprintf("%s BETWEEN ? AND ?", authorInitialExpr)
 	args := []any{start, end}
 	if includeOther {
 		where = fmt.Sprintf("(%s BETWEEN ? AND ? OR %s = ?)", authorInitialExpr, authorInitialExpr)
 		args = append(args, "#")
 	}
+	cond, condArgs := f.clause("")
+	where += " AND " + cond
+	args = append(args, condArgs...)
+	if after != nil {
+		afterCond, afterArgs := after.clause()
+		where += " AND " + afterCond
+		args = append(args, afterArgs...)
+		offset = 0
+	}
 
 	query := fmt.Sprintf(
-		"SELECT id, path, title, author, description, category, subcategory, mod_time FROM books WHERE %s ORDER BY author COLLATE NOCASE, title COLLATE NOCASE, id LIMIT ? OFFSET ?",
+		"SELECT "+bookColumns+" FROM books WHERE %s ORDER BY "+catalogOrder+" LIMIT ? OFFSET ?",
 		where,
 	)
 	args = append(args, limit, offset)
 
-	rows, err := db.conn.Query(query, args...)
+	rows, err := db.conn.QueryPrepared(query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -245,8 +711,8 @@ func (db *DB) GetBooksByAuthorRange(start, end string, includeOther bool, limit,
 
 	books := make([]Book, 0, limit)
 	for rows.Next() {
-		var b Book
-		if err := rows.Scan(&b.ID, &b.Path, &b.Title, &b.Author, &b.Description, &b.Category, &b.Subcategory, &b.ModTime); err != nil {
+		b, err := scanBook(rows)
+		if err != nil {
 			return nil, err
 		}
 		books = append(books, b)
@@ -254,8 +720,9 @@ func (db *DB) GetBooksByAuthorRange(start, end string, includeOther bool, limit,
 	return books, nil
 }
 
-func (db *DB) GetCategoryCounts() (map[string]int, error) {
-	rows, err := db.conn.Query(`SELECT trim(coalesce(category,'')) AS c, COUNT(*) FROM books WHERE trim(coalesce(category,'')) != '' GROUP BY c ORDER BY c COLLATE NOCASE`)
+func (db *DB) GetCategoryCounts(f BookFilter) (map[string]int, error) {
+	cond, args := f.clause("")
+	rows, err := db.conn.Query(`SELECT trim(coalesce(category,'')) AS c, COUNT(*) FROM books WHERE trim(coalesce(category,'')) != '' AND `+cond+` GROUP BY c ORDER BY c COLLATE NOCASE`, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -273,8 +740,12 @@ func (db *DB) GetCategoryCounts() (map[string]int, error) {
 	return out, nil
 }
 
-func (db *DB) GetSubcategoryCounts(category string) (map[string]int, error) {
-	rows, err := db.conn.Query(`SELECT trim(coalesce(subcategory,'')) AS s, COUNT(*) FROM books WHERE trim(coalesce(category,'')) = ? AND trim(coalesce(subcategory,'')) != '' GROUP BY s ORDER BY s COLLATE NOCASE`, strings.TrimSpace(category))
+func (db *DB) GetSubcategoryCounts(f BookFilter, category string) (map[string]int, error) {
+	if !f.AllowsCategory(category) {
+		return map[string]int{}, nil
+	}
+	cond, args := f.clause("")
+	rows, err := db.conn.Query(`SELECT trim(coalesce(subcategory,'')) AS s, COUNT(*) FROM books WHERE trim(coalesce(category,'')) = ? AND trim(coalesce(subcategory,'')) != '' AND `+cond+` GROUP BY s ORDER BY s COLLATE NOCASE`, append([]any{strings.TrimSpace(category)}, args...)...)
 	if err != nil {
 		return nil, err
 	}
@@ -292,9 +763,12 @@ func (db *DB) GetSubcategoryCounts(category string) (map[string]int, error) {
 	return out, nil
 }
 
-func (db *DB) CountBooksByCategory(category, subcategory string) (int, error) {
+func (db *DB) CountBooksByCategory(f BookFilter, category, subcategory string) (int, error) {
 	category = strings.TrimSpace(category)
 	subcategory = strings.TrimSpace(subcategory)
+	if !f.AllowsCategory(category) {
+		return 0, nil
+	}
 	var query string
 	var args []any
 	if subcategory == "" {
@@ -304,28 +778,46 @@ func (db *DB) CountBooksByCategory(category, subcategory string) (int, error) {
 		query = `SELECT COUNT(*) FROM books WHERE trim(coalesce(category,'')) = ? AND trim(coalesce(subcategory,'')) = ?`
 		args = []any{category, subcategory}
 	}
+	cond, condArgs := f.clause("")
+	query += " AND " + cond
+	args = append(args, condArgs...)
 
 	var count int
-	if err := db.conn.QueryRow(query, args...).Scan(&count); err != nil {
+	if err := db.conn.QueryRowPrepared(query, args...).Scan(&count); err != nil {
 		return 0, err
 	}
 	return count, nil
 }
 
-func (db *DB) GetBooksByCategory(category, subcategory string, limit, offset int) ([]Book, error) {
+// GetBooksByCategory returns a page of a category's books, or a
+// subcategory's, in catalog order. A non-nil after starts the page just
+// past that book and offset is ignored.
+func (db *DB) GetBooksByCategory(f BookFilter, category, subcategory string, limit, offset int, after *BookCursor) ([]Book, error) {
 	category = strings.TrimSpace(category)
 	subcategory = strings.TrimSpace(subcategory)
+	if !f.AllowsCategory(category) {
+		return []Book{}, nil
+	}
 
-	query := "SELECT id, path, title, author, description, category, subcategory, mod_time FROM books WHERE trim(coalesce(category,'')) = ?"
+	query := "SELECT " + bookColumns + " FROM books WHERE trim(coalesce(category,'')) = ?"
 	args := []any{category}
 	if subcategory != "" {
 		query += " AND trim(coalesce(subcategory,'')) = ?"
 		args = append(args, subcategory)
 	}
-	query += " ORDER BY author COLLATE NOCASE, title COLLATE NOCASE, id LIMIT ? OFFSET ?"
+	cond, condArgs := f.clause("")
+	query += " AND " + cond
+	args = append(args, condArgs...)
+	if after != nil {
+		afterCond, afterArgs := after.clause()
+		query += " AND " + afterCond
+		args = append(args, afterArgs...)
+		offset = 0
+	}
+	query += " ORDER BY " + catalogOrder + " LIMIT ? OFFSET ?"
 	args = append(args, limit, offset)
 
-	rows, err := db.conn.Query(query, args...)
+	rows, err := db.conn.QueryPrepared(query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -333,8 +825,8 @@ func (db *DB) GetBooksByCategory(category, subcategory string, limit, offset int
 
 	books := make([]Book, 0, limit)
 	for rows.Next() {
-		var b Book
-		if err := rows.Scan(&b.ID, &b.Path, &b.Title, &b.Author, &b.Description, &b.Category, &b.Subcategory, &b.ModTime); err != nil {
+		b, err := scanBook(rows)
+		if err != nil {
 			return nil, err
 		}
 		books = append(books, b)
@@ -0,0 +1,101 @@
+package database
+
+import (
+	"database/sql"
+	"strings"
+)
+
+// Subjects are stored newline-separated in books.subjects. NULL means the
+// book was indexed before subjects were recorded; an empty string means it
+// has none.
+
+func joinSubjects(subjects []string) string {
+	clean := make([]string, 0, len(subjects))
+	for _, s := range subjects {
+		if s = strings.TrimSpace(strings.ReplaceAll(s, "\n", " ")); s != "" {
+			clean = append(clean, s)
+		}
+	}
+	return strings.Join(clean, "\n")
+}
+
+func splitSubjects(raw string) []string {
+	var out []string
+	for _, s := range strings.Split(raw, "\n") {
+		if s = strings.TrimSpace(s); s != "" {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// SetBookSubjectsTx records a book's EPUB subjects, and whether they mark
+// it as adult content, inside a scan transaction.
+func (db *DB) SetBookSubjectsTx(tx *sql.Tx, path string, subjects []string, adult bool) error {
+	_, err := tx.Exec(`UPDATE books SET subjects = ?, adult = ? WHERE path = ?`, joinSubjects(subjects), adult, path)
+	return err
+}
+
+func (db *DB) SetBookSubjects(id int, subjects []string, adult bool) error {
+	_, err := db.conn.Exec(`UPDATE books SET subjects = ?, adult = ? WHERE id = ?`, joinSubjects(subjects), adult, id)
+	return err
+}
+
+// BooksMissingSubjects lists books indexed before subjects were recorded.
+func (db *DB) BooksMissingSubjects() ([]Book, error) {
+	rows, err := db.conn.Query("SELECT " + bookColumns + " FROM books WHERE subjects IS NULL ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var books []Book
+	for rows.Next() {
+		b, err := scanBook(rows)
+		if err != nil {
+			return nil, err
+		}
+		books = append(books, b)
+	}
+	return books, rows.Err()
+}
+
+// GetBookSubjects returns the stored subjects for one book.
+func (db *DB) GetBookSubjects(id int) ([]string, error) {
+	var raw sql.NullString
+	if err := db.conn.QueryRow(`SELECT subjects FROM books WHERE id = ?`, id).Scan(&raw); err != nil {
+		return nil, err
+	}
+	return splitSubjects(raw.String), nil
+}
+
+// ForEachBookWithSubjects streams every book f allows, and its subjects,
+// to fn in id order. Iteration stops at the first error fn returns.
+func (db *DB) ForEachBookWithSubjects(f BookFilter, fn func(Book, []string) error) error {
+	cond, args := f.clause("")
+	rows, err := db.conn.Query("SELECT "+bookColumns+", subjects FROM books WHERE "+cond+" ORDER BY id", args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var raw sql.NullString
+		b, err := scanBook(scanFunc(func(dest ...any) error {
+			return rows.Scan(append(dest, &raw)...)
+		}))
+		if err != nil {
+			return err
+		}
+		if err := fn(b, splitSubjects(raw.String)); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// scanFunc adapts a function to the Scan interface the scan helpers take,
+// so extra trailing columns can be read alongside a shared column list.
+type scanFunc func(dest ...any) error
+
+func (f scanFunc) Scan(dest ...any) error { return f(dest...) }
@@ -0,0 +1,208 @@
+package database
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+)
+
+// How a book first came into the library, as recorded in book_additions.
+const (
+	BookSourceScan   = "scan"   // found by a library scan
+	BookSourceWatch  = "watch"  // picked up by the folder watcher
+	BookSourceImport = "import" // added with gopds import
+)
+
+// book_additions records when each path was first indexed and how. It is
+// kept apart from books so a rebuild, which drops and refills books, doesn't
+// make the whole library look newly added.
+const bookAdditionsTableDDL = `
+CREATE TABLE IF NOT EXISTS book_additions (
+	path TEXT PRIMARY KEY,
+	added_at DATETIME NOT NULL,
+	source TEXT NOT NULL
+);`
+
+// backfillBookAdditions records books indexed before additions were, using
+// their file modification time as the best guess at when they arrived.
+func backfillBookAdditions(db *sql.DB) error {
+	rows, err := db.Query(`SELECT path, mod_time FROM books WHERE path NOT IN (SELECT path FROM book_additions)`)
+	if err != nil {
+		return err
+	}
+	type missing struct {
+		path    string
+		modTime sql.NullTime
+	}
+	var books []missing
+	for rows.Next() {
+		var m missing
+		if err := rows.Scan(&m.path, &m.modTime); err != nil {
+			rows.Close()
+			return err
+		}
+		books = append(books, m)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil || len(books) == 0 {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	now := time.Now().UTC()
+	for _, m := range books {
+		at := now
+		if m.modTime.Valid && m.modTime.Time.Before(now) {
+			at = m.modTime.Time.UTC()
+		}
+		if _, err := tx.Exec(`INSERT OR IGNORE INTO book_additions (path, added_at, source) VALUES (?, ?, ?)`, m.path, at, BookSourceScan); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// RecordBookAddedTx notes that the book at path was added to the library
+// now, by source. A path seen before keeps its original record.
+func RecordBookAddedTx(tx *sql.Tx, path, source string) error {
+	_, err := tx.Exec(`INSERT OR IGNORE INTO book_additions (path, added_at, source) VALUES (?, ?, ?)`, path, time.Now().UTC(), source)
+	return err
+}
+
+// BookAdditions is how many books one source added in one period.
+type BookAdditions struct {
+	Period string
+	Source string
+	Books  int
+}
+
+// BookAdditionsSince counts the books in the library that filter admits by
+// the period they were added in, at or after since, and by source. Periods
+// are UTC days ("2006-01-02") or, with byMonth, months ("2006-01").
+func (db *DB) BookAdditionsSince(f BookFilter, since time.Time, byMonth bool) ([]BookAdditions, error) {
+	width := 10
+	if byMonth {
+		width = 7
+	}
+	cond, args := f.clause("b.")
+	rows, err := db.conn.Query(`
+		SELECT substr(a.added_at, 1, ?) AS period, a.source, COUNT(*)
+		FROM book_additions a JOIN books b ON b.path = a.path
+		WHERE a.added_at >= ? AND `+cond+`
+		GROUP BY period, a.source ORDER BY period`,
+		append([]any{width, since.UTC()}, args...)...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []BookAdditions
+	for rows.Next() {
+		var a BookAdditions
+		if err := rows.Scan(&a.Period, &a.Source, &a.Books); err != nil {
+			return nil, err
+		}
+		out = append(out, a)
+	}
+	return out, rows.Err()
+}
+
+// CountBooksAddedBefore counts the books in the library that filter admits
+// and that were added before t.
+func (db *DB) CountBooksAddedBefore(f BookFilter, t time.Time) (int, error) {
+	cond, args := f.clause("b.")
+	var n int
+	err := db.conn.QueryRow(`
+		SELECT COUNT(*) FROM book_additions a JOIN books b ON b.path = a.path
+		WHERE a.added_at < ? AND `+cond, append([]any{t.UTC()}, args...)...).Scan(&n)
+	return n, err
+}
+
+// FirstBookAdded returns when the earliest book in the library that filter
+// admits was added, or the zero time if there are none.
+func (db *DB) FirstBookAdded(f BookFilter) (time.Time, error) {
+	cond, args := f.clause("b.")
+	var first sql.NullString
+	err := db.conn.QueryRow(`
+		SELECT MIN(a.added_at) FROM book_additions a JOIN books b ON b.path = a.path
+		WHERE `+cond, args...).Scan(&first)
+	if err != nil || !first.Valid {
+		return time.Time{}, err
+	}
+	// Stored as time.Time's String form; the date is all callers need.
+	t, err := time.Parse("2006-01-02", first.String[:min(len(first.String), 10)])
+	if err != nil {
+		return time.Time{}, err
+	}
+	return t, nil
+}
+
+// AdditionFilter narrows RecentlyAddedBooks to one category, subcategory,
+// or author, compared case-insensitively, and to books added after Since.
+// Zero fields match every book.
+type AdditionFilter struct {
+	Category    string
+	Subcategory string
+	Author      string
+	Since       time.Time
+}
+
+// AddedBook is a book with when it was added to the library and its EPUB
+// subjects.
+type AddedBook struct {
+	Book
+	AddedAt  time.Time
+	Subjects []string
+}
+
+// RecentlyAddedBooks returns up to limit books that filter and only admit,
+// most recently added first. keep, if set, is asked about each candidate's
+// subjects, so callers can narrow by genre.
+func (db *DB) RecentlyAddedBooks(f BookFilter, only AdditionFilter, limit int, keep func(subjects []string) bool) ([]AddedBook, error) {
+	cond, args := f.clause("b.")
+	for _, c := range []struct{ column, value string }{
+		{"b.category", only.Category},
+		{"b.subcategory", only.Subcategory},
+		{"b.author", only.Author},
+	} {
+		if v := strings.TrimSpace(c.value); v != "" {
+			cond += " AND lower(trim(coalesce(" + c.column + ", ''))) = lower(?)"
+			args = append(args, v)
+		}
+	}
+	if !only.Since.IsZero() {
+		cond += " AND a.added_at > ?"
+		args = append(args, only.Since.UTC())
+	}
+	rows, err := db.conn.Query(`
+		SELECT `+prefixedBookColumns("b.")+`, b.subjects, a.added_at
+		FROM books b JOIN book_additions a ON a.path = b.path
+		WHERE `+cond+`
+		ORDER BY a.added_at DESC, b.id DESC`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	books := []AddedBook{}
+	for rows.Next() && len(books) < limit {
+		var a AddedBook
+		var subjects sql.NullString
+		a.Book, err = scanBook(scanFunc(func(dest ...any) error {
+			return rows.Scan(append(dest, &subjects, &a.AddedAt)...)
+		}))
+		if err != nil {
+			return nil, err
+		}
+		a.Subjects = splitSubjects(subjects.String)
+		if keep == nil || keep(a.Subjects) {
+			books = append(books, a)
+		}
+	}
+	return books, rows.Err()
+}
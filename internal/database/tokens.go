@@ -0,0 +1,114 @@
+package database
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+)
+
+// APIToken is a named bearer credential. Only a SHA-256 hash of the secret
+// is stored; Prefix is its first few characters so tokens can be told apart
+// in listings.
+type APIToken struct {
+	ID         int64     `json:"id"`
+	Name       string    `json:"name"`
+	Prefix     string    `json:"prefix"`
+	Scopes     []string  `json:"scopes"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at,omitempty"`
+	RevokedAt  time.Time `json:"revoked_at,omitempty"`
+}
+
+// Revoked reports whether the token has been revoked.
+func (t APIToken) Revoked() bool {
+	return !t.RevokedAt.IsZero()
+}
+
+const apiTokensTableDDL = `
+CREATE TABLE IF NOT EXISTS api_tokens (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	name TEXT NOT NULL,
+	token_hash TEXT NOT NULL UNIQUE,
+	prefix TEXT,
+	scopes TEXT,
+	created_at DATETIME,
+	last_used_at DATETIME,
+	revoked_at DATETIME
+);`
+
+const apiTokenColumns = "id, name, prefix, scopes, created_at, last_used_at, revoked_at"
+
+func scanAPIToken(row interface{ Scan(...any) error }) (*APIToken, error) {
+	var t APIToken
+	var prefix, scopes sql.NullString
+	var created, lastUsed, revoked sql.NullTime
+	if err := row.Scan(&t.ID, &t.Name, &prefix, &scopes, &created, &lastUsed, &revoked); err != nil {
+		return nil, err
+	}
+	t.Prefix = prefix.String
+	t.Scopes = []string{}
+	for _, scope := range strings.Split(scopes.String, ",") {
+		if scope = strings.TrimSpace(scope); scope != "" {
+			t.Scopes = append(t.Scopes, scope)
+		}
+	}
+	t.CreatedAt = created.Time
+	t.LastUsedAt = lastUsed.Time
+	t.RevokedAt = revoked.Time
+	return &t, nil
+}
+
+func (db *DB) CreateAPIToken(name, tokenHash, prefix string, scopes []string) (*APIToken, error) {
+	result, err := db.conn.Exec(
+		`INSERT INTO api_tokens (name, token_hash, prefix, scopes, created_at) VALUES (?, ?, ?, ?, ?)`,
+		name, tokenHash, prefix, strings.Join(scopes, ","), time.Now().UTC(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	return scanAPIToken(db.conn.QueryRow("SELECT "+apiTokenColumns+" FROM api_tokens WHERE id = ?", id))
+}
+
+// GetAPITokenByHash returns the token with the given secret hash, revoked or
+// not. It returns sql.ErrNoRows if there is none.
+func (db *DB) GetAPITokenByHash(tokenHash string) (*APIToken, error) {
+	return scanAPIToken(db.conn.QueryRow("SELECT "+apiTokenColumns+" FROM api_tokens WHERE token_hash = ?", tokenHash))
+}
+
+func (db *DB) ListAPITokens() ([]APIToken, error) {
+	rows, err := db.conn.Query("SELECT " + apiTokenColumns + " FROM api_tokens ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := make([]APIToken, 0)
+	for rows.Next() {
+		t, err := scanAPIToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, *t)
+	}
+	return tokens, rows.Err()
+}
+
+// RevokeAPIToken marks a token revoked. It reports false if no active token
+// has that ID.
+func (db *DB) RevokeAPIToken(id int64) (bool, error) {
+	result, err := db.conn.Exec(`UPDATE api_tokens SET revoked_at = ? WHERE id = ? AND revoked_at IS NULL`, time.Now().UTC(), id)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+func (db *DB) TouchAPIToken(id int64, at time.Time) error {
+	_, err := db.conn.Exec(`UPDATE api_tokens SET last_used_at = ? WHERE id = ?`, at, id)
+	return err
+}
@@ -0,0 +1,399 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+)
+
+// ErrUserExists is returned when a username is already taken.
+var ErrUserExists = errors.New("username already in use")
+
+// User is a login account. Only password hashes are stored: PasswordHash is
+// a bcrypt hash of the password, and KosyncHash a bcrypt hash of its MD5,
+// which is what KOReader sends in place of the password.
+type User struct {
+	ID       int64  `json:"id"`
+	Username string `json:"username"`
+	Role     string `json:"role"`
+	// Source is how the account signs in: "local" for a GoPDS password,
+	// or the external provider that created it.
+	Source string `json:"source"`
+	// Email is where password reset links are sent; optional.
+	Email string `json:"email,omitempty"`
+	// Categories limits which books the user can see; empty means all.
+	Categories []string `json:"categories"`
+	// HideAdult hides books flagged as adult content from the user.
+	HideAdult    bool   `json:"hide_adult"`
+	PasswordHash string `json:"-"`
+	KosyncHash   string `json:"-"`
+	// TOTPEnabled is set once the user has confirmed a two-factor secret.
+	TOTPEnabled bool   `json:"totp_enabled"`
+	TOTPSecret  string `json:"-"`
+	// TOTPLastStep is the time step of the last accepted code, so a code
+	// can't be replayed.
+	TOTPLastStep int64 `json:"-"`
+	// RecoveryCodes holds SHA-256 hashes of the unused recovery codes.
+	RecoveryCodes []string `json:"-"`
+	// DownloadQuota overrides the server-wide download limits.
+	DownloadQuota DownloadQuota `json:"download_quota"`
+	CreatedAt     time.Time     `json:"created_at"`
+	UpdatedAt     time.Time     `json:"updated_at"`
+	LastLoginAt   time.Time     `json:"last_login_at,omitzero"`
+}
+
+const usersTableDDL = `
+CREATE TABLE IF NOT EXISTS users (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	username TEXT NOT NULL UNIQUE COLLATE NOCASE,
+	role TEXT NOT NULL DEFAULT 'admin',
+	source TEXT NOT NULL DEFAULT 'local',
+	email TEXT,
+	categories TEXT,
+	hide_adult INTEGER NOT NULL DEFAULT 0,
+	password_hash TEXT NOT NULL,
+	kosync_hash TEXT,
+	totp_secret TEXT,
+	totp_enabled INTEGER NOT NULL DEFAULT 0,
+	totp_last_step INTEGER NOT NULL DEFAULT 0,
+	recovery_codes TEXT,
+	reset_token_hash TEXT,
+	reset_expires_at DATETIME,
+	quota_daily_downloads INTEGER,
+	quota_monthly_downloads INTEGER,
+	quota_daily_mb INTEGER,
+	quota_monthly_mb INTEGER,
+	created_at DATETIME,
+	updated_at DATETIME,
+	last_login_at DATETIME
+);`
+
+// usersRoleColumn is added to tables created before roles existed. Those
+// accounts keep the full access they had.
+const usersRoleColumn = "role TEXT NOT NULL DEFAULT 'admin'"
+
+// UserSourceLocal marks accounts created with a GoPDS password.
+const UserSourceLocal = "local"
+
+const userColumns = "id, username, role, source, email, categories, hide_adult, password_hash, kosync_hash, totp_secret, totp_enabled, totp_last_step, recovery_codes, quota_daily_downloads, quota_monthly_downloads, quota_daily_mb, quota_monthly_mb, created_at, updated_at, last_login_at"
+
+func scanUser(row interface{ Scan(...any) error }) (*User, error) {
+	var u User
+	var email, categories, kosync, totpSecret, recovery sql.NullString
+	var quotaDailyN, quotaMonthlyN, quotaDailyMB, quotaMonthlyMB sql.NullInt64
+	var created, updated, lastLogin sql.NullTime
+	if err := row.Scan(&u.ID, &u.Username, &u.Role, &u.Source, &email, &categories, &u.HideAdult, &u.PasswordHash, &kosync, &totpSecret, &u.TOTPEnabled, &u.TOTPLastStep, &recovery,
+		&quotaDailyN, &quotaMonthlyN, &quotaDailyMB, &quotaMonthlyMB, &created, &updated, &lastLogin); err != nil {
+		return nil, err
+	}
+	u.DownloadQuota = DownloadQuota{
+		DailyDownloads:   nullIntPtr(quotaDailyN),
+		MonthlyDownloads: nullIntPtr(quotaMonthlyN),
+		DailyMB:          nullIntPtr(quotaDailyMB),
+		MonthlyMB:        nullIntPtr(quotaMonthlyMB),
+	}
+	u.Email = email.String
+	u.Categories = splitLines(categories.String)
+	u.KosyncHash = kosync.String
+	u.TOTPSecret = totpSecret.String
+	u.RecoveryCodes = splitLines(recovery.String)
+	u.CreatedAt = created.Time
+	u.UpdatedAt = updated.Time
+	u.LastLoginAt = lastLogin.Time
+	return &u, nil
+}
+
+func nullIntPtr(v sql.NullInt64) *int {
+	if !v.Valid {
+		return nil
+	}
+	n := int(v.Int64)
+	return &n
+}
+
+// splitLines splits a newline-joined list, dropping blanks. It never
+// returns nil, so lists encode as [] rather than null.
+func splitLines(raw string) []string {
+	out := []string{}
+	for _, line := range strings.Split(raw, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			out = append(out, line)
+		}
+	}
+	return out
+}
+
+// Filter returns the book filter for the user's restrictions.
+func (u User) Filter() BookFilter {
+	return BookFilter{Categories: u.Categories, HideAdult: u.HideAdult}
+}
+
+func userWriteErr(err error) error {
+	if err != nil && strings.Contains(err.Error(), "UNIQUE constraint failed") {
+		return ErrUserExists
+	}
+	return err
+}
+
+func (db *DB) CountUsers() (int, error) {
+	var n int
+	err := db.conn.QueryRow(`SELECT COUNT(*) FROM users`).Scan(&n)
+	return n, err
+}
+
+func (db *DB) CountUsersWithRole(role string) (int, error) {
+	var n int
+	err := db.conn.QueryRow(`SELECT COUNT(*) FROM users WHERE role = ?`, role).Scan(&n)
+	return n, err
+}
+
+// CreateUser adds an account. A username that differs from an existing one
+// only by case fails with ErrUserExists.
+func (db *DB) CreateUser(username, role, email string, categories []string, passwordHash, kosyncHash string) (*User, error) {
+	now := time.Now().UTC()
+	result, err := db.conn.Exec(
+		`INSERT INTO users (username, role, email, categories, password_hash, kosync_hash, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		username, role, email, strings.Join(categories, "\n"), passwordHash, kosyncHash, now, now,
+	)
+	if err != nil {
+		return nil, userWriteErr(err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	return db.GetUser(id)
+}
+
+// CreateExternalUser adds an account for a user signed in by an external
+// provider. It has no password, so it can't use the login form until an
+// admin sets one.
+func (db *DB) CreateExternalUser(username, role, source string) (*User, error) {
+	now := time.Now().UTC()
+	result, err := db.conn.Exec(
+		`INSERT INTO users (username, role, source, password_hash, created_at, updated_at) VALUES (?, ?, ?, '', ?, ?)`,
+		username, role, source, now, now,
+	)
+	if err != nil {
+		return nil, userWriteErr(err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	return db.GetUser(id)
+}
+
+// GetUser returns sql.ErrNoRows if there is no such account.
+func (db *DB) GetUser(id int64) (*User, error) {
+	return scanUser(db.conn.QueryRow("SELECT "+userColumns+" FROM users WHERE id = ?", id))
+}
+
+// GetUserByName looks a username up case-insensitively. It returns
+// sql.ErrNoRows if there is no such account.
+func (db *DB) GetUserByName(username string) (*User, error) {
+	return scanUser(db.conn.QueryRow("SELECT "+userColumns+" FROM users WHERE username = ?", username))
+}
+
+func (db *DB) ListUsers() ([]User, error) {
+	rows, err := db.conn.Query("SELECT " + userColumns + " FROM users ORDER BY username")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := make([]User, 0)
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, *u)
+	}
+	return users, rows.Err()
+}
+
+// SetUserPassword replaces both password hashes and cancels any pending
+// reset. It reports false if there is no such account.
+func (db *DB) SetUserPassword(id int64, passwordHash, kosyncHash string) (bool, error) {
+	result, err := db.conn.Exec(
+		`UPDATE users SET password_hash = ?, kosync_hash = ?, reset_token_hash = NULL, reset_expires_at = NULL, updated_at = ? WHERE id = ?`,
+		passwordHash, kosyncHash, time.Now().UTC(), id,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// SetUserRole reports false if there is no such account.
+func (db *DB) SetUserRole(id int64, role string) (bool, error) {
+	result, err := db.conn.Exec(`UPDATE users SET role = ?, updated_at = ? WHERE id = ?`, role, time.Now().UTC(), id)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// SetUserEmail reports false if there is no such account.
+func (db *DB) SetUserEmail(id int64, email string) (bool, error) {
+	result, err := db.conn.Exec(`UPDATE users SET email = ?, updated_at = ? WHERE id = ?`, email, time.Now().UTC(), id)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// SetUserPasswordReset stores the hash of a one-time reset token, replacing
+// any earlier one. It reports false if there is no such account.
+func (db *DB) SetUserPasswordReset(id int64, tokenHash string, expiresAt time.Time) (bool, error) {
+	result, err := db.conn.Exec(
+		`UPDATE users SET reset_token_hash = ?, reset_expires_at = ? WHERE id = ?`,
+		tokenHash, expiresAt.UTC(), id,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// GetUserByResetToken returns the account with an unexpired reset token of
+// the given hash, or sql.ErrNoRows.
+func (db *DB) GetUserByResetToken(tokenHash string, now time.Time) (*User, error) {
+	return scanUser(db.conn.QueryRow(
+		"SELECT "+userColumns+" FROM users WHERE reset_token_hash = ? AND reset_expires_at > ?",
+		tokenHash, now.UTC(),
+	))
+}
+
+// SetUserCategories replaces the user's category restrictions; nil or empty
+// lifts them. It reports false if there is no such account.
+func (db *DB) SetUserCategories(id int64, categories []string) (bool, error) {
+	result, err := db.conn.Exec(`UPDATE users SET categories = ?, updated_at = ? WHERE id = ?`, strings.Join(categories, "\n"), time.Now().UTC(), id)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// SetUserHideAdult sets whether adult content is hidden from the user. It
+// reports false if there is no such account.
+func (db *DB) SetUserHideAdult(id int64, hide bool) (bool, error) {
+	result, err := db.conn.Exec(`UPDATE users SET hide_adult = ?, updated_at = ? WHERE id = ?`, hide, time.Now().UTC(), id)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// SetUserTOTPSecret stores a secret awaiting confirmation, replacing any
+// earlier unconfirmed one. It reports false if there is no such account or
+// two-factor is already enabled.
+func (db *DB) SetUserTOTPSecret(id int64, secret string) (bool, error) {
+	result, err := db.conn.Exec(
+		`UPDATE users SET totp_secret = ?, totp_last_step = 0, updated_at = ? WHERE id = ? AND totp_enabled = 0`,
+		secret, time.Now().UTC(), id,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// EnableUserTOTP turns on two-factor with the stored secret and replaces the
+// recovery codes.
+func (db *DB) EnableUserTOTP(id int64, recoveryHashes []string) (bool, error) {
+	result, err := db.conn.Exec(
+		`UPDATE users SET totp_enabled = 1, recovery_codes = ?, updated_at = ? WHERE id = ? AND coalesce(totp_secret, '') != ''`,
+		strings.Join(recoveryHashes, "\n"), time.Now().UTC(), id,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// DisableUserTOTP removes the secret and recovery codes.
+func (db *DB) DisableUserTOTP(id int64) (bool, error) {
+	result, err := db.conn.Exec(
+		`UPDATE users SET totp_enabled = 0, totp_secret = NULL, totp_last_step = 0, recovery_codes = NULL, updated_at = ? WHERE id = ?`,
+		time.Now().UTC(), id,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// AdvanceUserTOTPStep records step as used. It reports false if that step or
+// a later one was already used, which rejects replayed codes even when two
+// requests race.
+func (db *DB) AdvanceUserTOTPStep(id, step int64) (bool, error) {
+	result, err := db.conn.Exec(`UPDATE users SET totp_last_step = ? WHERE id = ? AND totp_last_step < ?`, step, id, step)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// UseRecoveryCode removes hash from the user's unused recovery codes. It
+// reports false if the code isn't one of them.
+func (db *DB) UseRecoveryCode(id int64, hash string) (bool, error) {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var raw sql.NullString
+	if err := tx.QueryRow(`SELECT recovery_codes FROM users WHERE id = ?`, id).Scan(&raw); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, nil
+		}
+		return false, err
+	}
+	codes := splitLines(raw.String)
+	remaining := make([]string, 0, len(codes))
+	found := false
+	for _, c := range codes {
+		if !found && c == hash {
+			found = true
+			continue
+		}
+		remaining = append(remaining, c)
+	}
+	if !found {
+		return false, nil
+	}
+	if _, err := tx.Exec(`UPDATE users SET recovery_codes = ?, updated_at = ? WHERE id = ?`, strings.Join(remaining, "\n"), time.Now().UTC(), id); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+func (db *DB) TouchUserLogin(id int64, at time.Time) error {
+	_, err := db.conn.Exec(`UPDATE users SET last_login_at = ? WHERE id = ?`, at, id)
+	return err
+}
+
+// DeleteUser removes an account. Its shelves and reading progress are kept,
+// so recreating the username picks them up again.
+func (db *DB) DeleteUser(id int64) (bool, error) {
+	result, err := db.conn.Exec(`DELETE FROM users WHERE id = ?`, id)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
@@ -0,0 +1,56 @@
+package database
+
+// library_version holds a generation counter that triggers bump whenever
+// a book is added or removed, or anything the catalog feeds show about it
+// changes, including its file, whose cover they link to, so caches of counts and rendered feeds can tell they are stale
+// with one cheap read. Triggers also catch writes by other processes on the
+// same database, such as gopds scan or gopds watch. The update trigger is
+// recreated on every start, so columns added to it reach existing
+// databases.
+const libraryVersionDDL = `
+CREATE TABLE IF NOT EXISTS library_version (
+	id INTEGER PRIMARY KEY CHECK (id = 1),
+	version INTEGER NOT NULL
+);
+INSERT OR IGNORE INTO library_version (id, version) VALUES (1, 1);
+CREATE TRIGGER IF NOT EXISTS books_version_insert AFTER INSERT ON books
+BEGIN
+	UPDATE library_version SET version = version + 1 WHERE id = 1;
+END;
+CREATE TRIGGER IF NOT EXISTS books_version_delete AFTER DELETE ON books
+BEGIN
+	UPDATE library_version SET version = version + 1 WHERE id = 1;
+END;
+DROP TRIGGER IF EXISTS books_version_update;
+CREATE TRIGGER books_version_update AFTER UPDATE OF title, author, description, category, subcategory, series, series_index, subjects, adult, adult_override, file_hash, mod_time, unavailable ON books
+WHEN old.title IS NOT new.title
+	OR old.author IS NOT new.author
+	OR old.description IS NOT new.description
+	OR old.category IS NOT new.category
+	OR old.subcategory IS NOT new.subcategory
+	OR old.series IS NOT new.series
+	OR old.series_index IS NOT new.series_index
+	OR old.subjects IS NOT new.subjects
+	OR old.adult IS NOT new.adult
+	OR old.adult_override IS NOT new.adult_override
+	OR old.file_hash IS NOT new.file_hash
+	OR old.mod_time IS NOT new.mod_time
+	OR old.unavailable IS NOT new.unavailable
+BEGIN
+	UPDATE library_version SET version = version + 1 WHERE id = 1;
+END;`
+
+// LibraryVersion returns the library's generation, a number that changes
+// whenever the catalog feeds would.
+func (db *DB) LibraryVersion() (int64, error) {
+	var v int64
+	err := db.conn.QueryRow(`SELECT version FROM library_version WHERE id = 1`).Scan(&v)
+	return v, err
+}
+
+// BumpLibraryVersion moves the library's generation on for a change the
+// triggers can't see, such as a replaced cover image.
+func (db *DB) BumpLibraryVersion() error {
+	_, err := db.conn.Exec(`UPDATE library_version SET version = version + 1 WHERE id = 1`)
+	return err
+}
@@ -0,0 +1,139 @@
+package database
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+)
+
+// Webhook is an outbound endpoint that receives library events. Secret signs
+// each delivery and is never serialized; it is returned once on creation.
+type Webhook struct {
+	ID             int64     `json:"id"`
+	URL            string    `json:"url"`
+	Secret         string    `json:"-"`
+	Events         []string  `json:"events"`
+	Enabled        bool      `json:"enabled"`
+	CreatedAt      time.Time `json:"created_at"`
+	LastDeliveryAt time.Time `json:"last_delivery_at,omitempty"`
+	LastStatus     int       `json:"last_status,omitempty"`
+	LastError      string    `json:"last_error,omitempty"`
+}
+
+// Wants reports whether the webhook subscribes to event. An empty event list
+// or "*" subscribes to everything.
+func (h Webhook) Wants(event string) bool {
+	if len(h.Events) == 0 {
+		return true
+	}
+	for _, e := range h.Events {
+		if e == "*" || e == event {
+			return true
+		}
+	}
+	return false
+}
+
+const webhooksTableDDL = `
+CREATE TABLE IF NOT EXISTS webhooks (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	url TEXT NOT NULL,
+	secret TEXT NOT NULL,
+	events TEXT,
+	enabled INTEGER NOT NULL DEFAULT 1,
+	created_at DATETIME,
+	last_delivery_at DATETIME,
+	last_status INTEGER,
+	last_error TEXT
+);`
+
+const webhookColumns = "id, url, secret, events, enabled, created_at, last_delivery_at, last_status, last_error"
+
+func scanWebhook(row interface{ Scan(...any) error }) (*Webhook, error) {
+	var h Webhook
+	var events, lastError sql.NullString
+	var created, lastDelivery sql.NullTime
+	var lastStatus sql.NullInt64
+	if err := row.Scan(&h.ID, &h.URL, &h.Secret, &events, &h.Enabled, &created, &lastDelivery, &lastStatus, &lastError); err != nil {
+		return nil, err
+	}
+	h.Events = []string{}
+	for _, e := range strings.Split(events.String, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			h.Events = append(h.Events, e)
+		}
+	}
+	h.CreatedAt = created.Time
+	h.LastDeliveryAt = lastDelivery.Time
+	h.LastStatus = int(lastStatus.Int64)
+	h.LastError = lastError.String
+	return &h, nil
+}
+
+func (db *DB) CreateWebhook(url, secret string, events []string, enabled bool) (*Webhook, error) {
+	result, err := db.conn.Exec(
+		`INSERT INTO webhooks (url, secret, events, enabled, created_at) VALUES (?, ?, ?, ?, ?)`,
+		url, secret, strings.Join(events, ","), enabled, time.Now().UTC(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	return db.GetWebhook(id)
+}
+
+// GetWebhook returns sql.ErrNoRows if there is no webhook with that ID.
+func (db *DB) GetWebhook(id int64) (*Webhook, error) {
+	return scanWebhook(db.conn.QueryRow("SELECT "+webhookColumns+" FROM webhooks WHERE id = ?", id))
+}
+
+func (db *DB) ListWebhooks() ([]Webhook, error) {
+	rows, err := db.conn.Query("SELECT " + webhookColumns + " FROM webhooks ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	hooks := make([]Webhook, 0)
+	for rows.Next() {
+		h, err := scanWebhook(rows)
+		if err != nil {
+			return nil, err
+		}
+		hooks = append(hooks, *h)
+	}
+	return hooks, rows.Err()
+}
+
+// SetWebhookEnabled reports false if no webhook has that ID.
+func (db *DB) SetWebhookEnabled(id int64, enabled bool) (bool, error) {
+	result, err := db.conn.Exec(`UPDATE webhooks SET enabled = ? WHERE id = ?`, enabled, id)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// DeleteWebhook reports false if no webhook has that ID.
+func (db *DB) DeleteWebhook(id int64) (bool, error) {
+	result, err := db.conn.Exec(`DELETE FROM webhooks WHERE id = ?`, id)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// RecordWebhookDelivery stores the outcome of the latest delivery attempt.
+// status is the HTTP status, or zero if no response was received.
+func (db *DB) RecordWebhookDelivery(id int64, at time.Time, status int, errMsg string) error {
+	_, err := db.conn.Exec(
+		`UPDATE webhooks SET last_delivery_at = ?, last_status = ?, last_error = ? WHERE id = ?`,
+		at, status, errMsg, id,
+	)
+	return err
+}
@@ -0,0 +1,209 @@
+// Package diagnostics checks the environment GoPDS runs in: that the library
+// folder can be read, the data folder written, the database reached, and the
+// metadata providers resolved. main runs the checks at startup and refuses to
+// start on a failure; /api/admin/diagnostics runs them again on demand.
+package diagnostics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Check statuses. Only StatusFail stops startup.
+const (
+	StatusOK      = "ok"
+	StatusWarn    = "warn"
+	StatusFail    = "fail"
+	StatusSkipped = "skipped"
+)
+
+const checkTimeout = 5 * time.Second
+
+// lookupHosts are resolved to tell whether online lookups can work.
+var lookupHosts = []string{"openlibrary.org", "www.googleapis.com"}
+
+// Check is the outcome of one check. Hint says what to do about a warning
+// or failure.
+type Check struct {
+	Name       string `json:"name"`
+	Status     string `json:"status"`
+	Detail     string `json:"detail,omitempty"`
+	Hint       string `json:"hint,omitempty"`
+	DurationMS int64  `json:"duration_ms"`
+}
+
+// Report is the result of one run.
+type Report struct {
+	OK        bool      `json:"ok"`
+	CheckedAt time.Time `json:"checked_at"`
+	Checks    []Check   `json:"checks"`
+}
+
+// Checker holds what the checks look at. DB and Online may be nil, in which
+// case the database and DNS checks are skipped; main fills them in once the
+// database is open.
+type Checker struct {
+	BookPath string
+	// BookPathDefaulted is true when BOOK_PATH was unset and BookPath is
+	// the built-in ./books.
+	BookPathDefaulted bool
+	DataDir           string
+	// WriteDirs are the other folders GoPDS writes to, such as the cover
+	// cache; data_dir checks each one along with DataDir.
+	WriteDirs []string
+	DB        interface{ Ping(context.Context) error }
+	// Online reports whether external lookups are enabled.
+	Online func() bool
+}
+
+// Run runs every check.
+func (c *Checker) Run(ctx context.Context) Report {
+	r := Report{OK: true, CheckedAt: time.Now().UTC()}
+	add := func(name string, fn func(context.Context) Check) {
+		check := run(ctx, name, fn)
+		if check.Status == StatusFail {
+			r.OK = false
+		}
+		r.Checks = append(r.Checks, check)
+	}
+	add("book_path", c.checkBookPath)
+	add("data_dir", c.checkDataDir)
+	if c.DB != nil {
+		add("database", c.checkDatabase)
+	}
+	if c.Online != nil {
+		add("dns", c.checkDNS)
+	}
+	return r
+}
+
+// Log writes one line per check that did not pass.
+func (r Report) Log() {
+	for _, c := range r.Checks {
+		switch c.Status {
+		case StatusFail:
+			slog.Error("startup check failed", "check", c.Name, "detail", c.Detail, "hint", c.Hint)
+		case StatusWarn:
+			slog.Warn("startup check warning", "check", c.Name, "detail", c.Detail, "hint", c.Hint)
+		default:
+			slog.Debug("startup check", "check", c.Name, "status", c.Status, "detail", c.Detail)
+		}
+	}
+}
+
+// run calls fn with a deadline. Filesystem calls can't be interrupted, so a
+// hung network mount is reported as a failure while the call itself is left
+// to finish in the background.
+func run(ctx context.Context, name string, fn func(context.Context) Check) Check {
+	ctx, cancel := context.WithTimeout(ctx, checkTimeout)
+	defer cancel()
+	start := time.Now()
+	done := make(chan Check, 1)
+	go func() { done <- fn(ctx) }()
+
+	var c Check
+	select {
+	case c = <-done:
+	case <-ctx.Done():
+		c = Check{Status: StatusFail, Detail: fmt.Sprintf("timed out after %s", checkTimeout),
+			Hint: "The filesystem or service is not responding; check network mounts."}
+	}
+	c.Name = name
+	c.DurationMS = time.Since(start).Milliseconds()
+	return c
+}
+
+func (c *Checker) checkBookPath(context.Context) Check {
+	info, err := os.Stat(c.BookPath)
+	if errors.Is(err, os.ErrNotExist) {
+		hint := "Create the folder or point BOOK_PATH at your library."
+		if c.BookPathDefaulted {
+			hint = "BOOK_PATH is not set. Set it to your library folder, or mount the library at ./books."
+		}
+		return Check{Status: StatusFail, Detail: fmt.Sprintf("%s does not exist", c.BookPath), Hint: hint}
+	}
+	if err != nil {
+		return Check{Status: StatusFail, Detail: err.Error(), Hint: "Check that GoPDS's user can reach BOOK_PATH."}
+	}
+	if !info.IsDir() {
+		return Check{Status: StatusFail, Detail: fmt.Sprintf("%s is not a directory", c.BookPath), Hint: "Point BOOK_PATH at the folder holding your books."}
+	}
+	dir, err := os.Open(c.BookPath)
+	if err != nil {
+		return Check{Status: StatusFail, Detail: err.Error(), Hint: "Give GoPDS's user read and execute permission on BOOK_PATH."}
+	}
+	defer dir.Close()
+	if _, err := dir.Readdirnames(1); errors.Is(err, io.EOF) {
+		return Check{Status: StatusWarn, Detail: fmt.Sprintf("%s is empty", c.BookPath), Hint: "Check that the library volume is mounted; scans will find no books."}
+	} else if err != nil {
+		return Check{Status: StatusFail, Detail: err.Error(), Hint: "Give GoPDS's user read and execute permission on BOOK_PATH."}
+	}
+	return Check{Status: StatusOK, Detail: c.BookPath}
+}
+
+func (c *Checker) checkDataDir(context.Context) Check {
+	hint := "Give GoPDS's user write permission on the folder holding DB_PATH, or mount a writable volume there."
+	if err := checkWritable(c.DataDir); err != nil {
+		return Check{Status: StatusFail, Detail: err.Error(), Hint: hint}
+	}
+	checked := []string{filepath.Clean(c.DataDir)}
+	for _, dir := range c.WriteDirs {
+		if dir = filepath.Clean(dir); slices.Contains(checked, dir) {
+			continue
+		}
+		if err := checkWritable(dir); err != nil {
+			return Check{Status: StatusFail, Detail: err.Error(), Hint: fmt.Sprintf("Give GoPDS's user write permission on %s, or mount a writable volume there.", dir)}
+		}
+		checked = append(checked, dir)
+	}
+	return Check{Status: StatusOK, Detail: strings.Join(checked, ", ")}
+}
+
+// checkWritable creates dir if it is missing and a file in it.
+func checkWritable(dir string) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, ".gopds-write-check-*")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+func (c *Checker) checkDatabase(ctx context.Context) Check {
+	if err := c.DB.Ping(ctx); err != nil {
+		return Check{Status: StatusFail, Detail: err.Error(), Hint: "Check that DB_PATH is on a local disk with free space."}
+	}
+	return Check{Status: StatusOK}
+}
+
+func (c *Checker) checkDNS(ctx context.Context) Check {
+	if !c.Online() {
+		return Check{Status: StatusSkipped, Detail: "offline mode"}
+	}
+	if os.Getenv("UPSTREAM_PROXY") != "" {
+		return Check{Status: StatusSkipped, Detail: "lookups are resolved by UPSTREAM_PROXY"}
+	}
+	var failed []string
+	for _, host := range lookupHosts {
+		if _, err := net.DefaultResolver.LookupHost(ctx, host); err != nil {
+			failed = append(failed, host)
+		}
+	}
+	if len(failed) > 0 {
+		return Check{Status: StatusWarn, Detail: "cannot resolve " + strings.Join(failed, ", "),
+			Hint: "Online metadata and cover searches will fail. Check the container's DNS, or turn on offline_mode."}
+	}
+	return Check{Status: StatusOK, Detail: strings.Join(lookupHosts, ", ")}
+}
@@ -0,0 +1,309 @@
+// Package epubcheck checks an EPUB's structure: that the zip is intact,
+// the container and package documents parse, the manifest lists every
+// file the book uses and nothing it lacks, and links between its
+// documents resolve. It covers the faults that stop readers from opening
+// a book, not the full EPUB specification.
+package epubcheck
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/ab0oo/gopds/internal/storage"
+)
+
+// Severity of an Issue. Errors are faults readers commonly trip over;
+// warnings are deviations most of them tolerate.
+const (
+	SeverityError   = "error"
+	SeverityWarning = "warning"
+)
+
+// Issue is one problem found.
+type Issue struct {
+	Severity string `json:"severity"`
+	// Code names the check, for scripts: zip_invalid, zip_corrupt,
+	// mimetype, container_missing, container_invalid, opf_missing,
+	// opf_invalid, metadata_missing, manifest_duplicate_id,
+	// manifest_missing_file, not_in_manifest, spine_empty,
+	// spine_bad_ref, document_invalid, or broken_link.
+	Code string `json:"code"`
+	// Path is the file in the EPUB the issue is about, if any.
+	Path    string `json:"path,omitempty"`
+	Message string `json:"message"`
+}
+
+// Report is the outcome of checking one EPUB.
+type Report struct {
+	File string `json:"file"`
+	// Valid is true when there are no errors; warnings are allowed.
+	Valid    bool    `json:"valid"`
+	Errors   int     `json:"errors"`
+	Warnings int     `json:"warnings"`
+	Issues   []Issue `json:"issues"`
+}
+
+func (r *Report) add(severity, code, file, format string, args ...any) {
+	r.Issues = append(r.Issues, Issue{Severity: severity, Code: code, Path: file, Message: fmt.Sprintf(format, args...)})
+	if severity == SeverityError {
+		r.Errors++
+	} else {
+		r.Warnings++
+	}
+}
+
+type container struct {
+	Rootfiles []struct {
+		FullPath string `xml:"full-path,attr"`
+	} `xml:"rootfiles>rootfile"`
+}
+
+type pkg struct {
+	Title      []string `xml:"metadata>title"`
+	Identifier []string `xml:"metadata>identifier"`
+	Language   []string `xml:"metadata>language"`
+	Manifest   []struct {
+		ID        string `xml:"id,attr"`
+		Href      string `xml:"href,attr"`
+		MediaType string `xml:"media-type,attr"`
+	} `xml:"manifest>item"`
+	Spine []struct {
+		IDRef string `xml:"idref,attr"`
+	} `xml:"spine>itemref"`
+}
+
+// Check validates the EPUB at file.
+func Check(file string) *Report {
+	report := &Report{File: file, Issues: []Issue{}}
+	f, err := storage.Open(context.Background(), file)
+	if err != nil {
+		report.add(SeverityError, "zip_invalid", "", "not a readable zip archive: %v", err)
+		report.Valid = false
+		return report
+	}
+	defer f.Close()
+	var reader *zip.Reader
+	info, err := f.Stat()
+	if err == nil {
+		reader, err = zip.NewReader(f, info.Size())
+	}
+	if err != nil {
+		report.add(SeverityError, "zip_invalid", "", "not a readable zip archive: %v", err)
+		report.Valid = false
+		return report
+	}
+	check(report, reader)
+	report.Valid = report.Errors == 0
+	return report
+}
+
+func check(report *Report, zr *zip.Reader) {
+	entries := map[string]*zip.File{}
+	for _, f := range zr.File {
+		entries[f.Name] = f
+		// Reading every entry to the end verifies its checksum.
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		if err := drain(f); err != nil {
+			report.add(SeverityError, "zip_corrupt", f.Name, "cannot be read: %v", err)
+		}
+	}
+
+	checkMimetype(report, zr)
+
+	containerFile, ok := entries["META-INF/container.xml"]
+	if !ok {
+		report.add(SeverityError, "container_missing", "META-INF/container.xml", "the container file is missing, so readers can't find the package document")
+		return
+	}
+	var c container
+	if err := decodeEntry(containerFile, &c); err != nil {
+		report.add(SeverityError, "container_invalid", containerFile.Name, "is not well-formed XML: %v", err)
+		return
+	}
+	if len(c.Rootfiles) == 0 || strings.TrimSpace(c.Rootfiles[0].FullPath) == "" {
+		report.add(SeverityError, "container_invalid", containerFile.Name, "names no package document")
+		return
+	}
+	opfPath := strings.TrimSpace(c.Rootfiles[0].FullPath)
+	opfFile, ok := entries[opfPath]
+	if !ok {
+		report.add(SeverityError, "opf_missing", opfPath, "the package document named in container.xml is missing")
+		return
+	}
+	var p pkg
+	if err := decodeEntry(opfFile, &p); err != nil {
+		report.add(SeverityError, "opf_invalid", opfPath, "is not well-formed XML: %v", err)
+		return
+	}
+
+	if len(p.Title) == 0 || strings.TrimSpace(p.Title[0]) == "" {
+		report.add(SeverityError, "metadata_missing", opfPath, "has no title")
+	}
+	if len(p.Identifier) == 0 {
+		report.add(SeverityWarning, "metadata_missing", opfPath, "has no identifier")
+	}
+	if len(p.Language) == 0 {
+		report.add(SeverityWarning, "metadata_missing", opfPath, "has no language")
+	}
+
+	// Manifest: every item must exist, once.
+	opfDir := path.Dir(opfPath)
+	ids := map[string]bool{}
+	listed := map[string]bool{opfPath: true}
+	var documents []string
+	for _, item := range p.Manifest {
+		if ids[item.ID] {
+			report.add(SeverityError, "manifest_duplicate_id", opfPath, "manifest id %q is used more than once", item.ID)
+		}
+		ids[item.ID] = true
+		target, ok := resolve(opfDir, item.Href)
+		if !ok {
+			continue
+		}
+		listed[target] = true
+		if _, ok := entries[target]; !ok {
+			report.add(SeverityError, "manifest_missing_file", target, "is listed in the manifest but not in the EPUB")
+			continue
+		}
+		if item.MediaType == "application/xhtml+xml" || item.MediaType == "text/html" {
+			documents = append(documents, target)
+		}
+	}
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() || listed[f.Name] || f.Name == "mimetype" || strings.HasPrefix(f.Name, "META-INF/") {
+			continue
+		}
+		report.add(SeverityWarning, "not_in_manifest", f.Name, "is in the EPUB but not in the manifest")
+	}
+
+	// Spine: the reading order must name manifest items.
+	if len(p.Spine) == 0 {
+		report.add(SeverityError, "spine_empty", opfPath, "the spine lists no documents to read")
+	}
+	for _, ref := range p.Spine {
+		if !ids[ref.IDRef] {
+			report.add(SeverityError, "spine_bad_ref", opfPath, "the spine refers to %q, which is not in the manifest", ref.IDRef)
+		}
+	}
+
+	for _, doc := range documents {
+		checkLinks(report, entries, doc)
+	}
+}
+
+// checkMimetype checks the first entry is an uncompressed "mimetype" file
+// saying application/epub+zip, which is how readers recognize an EPUB.
+func checkMimetype(report *Report, zr *zip.Reader) {
+	if len(zr.File) == 0 || zr.File[0].Name != "mimetype" {
+		report.add(SeverityWarning, "mimetype", "mimetype", "should be the first file in the archive")
+	}
+	for _, f := range zr.File {
+		if f.Name != "mimetype" {
+			continue
+		}
+		raw, err := readEntry(f)
+		if err == nil && strings.TrimSpace(string(raw)) != "application/epub+zip" {
+			report.add(SeverityError, "mimetype", f.Name, "says %q rather than application/epub+zip", strings.TrimSpace(string(raw)))
+		}
+		if f.Method != zip.Store {
+			report.add(SeverityWarning, "mimetype", f.Name, "should be stored uncompressed")
+		}
+		return
+	}
+	report.add(SeverityError, "mimetype", "mimetype", "is missing")
+}
+
+// linkAttrs are the attributes whose values point at other files.
+var linkAttrs = map[string]bool{"href": true, "src": true, "poster": true, "data": true}
+
+// checkLinks reports links in the document doc to files the EPUB lacks.
+// Links to other sites and fragment-only links are not followed.
+func checkLinks(report *Report, entries map[string]*zip.File, doc string) {
+	raw, err := readEntry(entries[doc])
+	if err != nil {
+		return
+	}
+	decoder := xml.NewDecoder(bytes.NewReader(raw))
+	decoder.Strict = false
+	decoder.AutoClose = xml.HTMLAutoClose
+	decoder.Entity = xml.HTMLEntity
+	seen := map[string]bool{}
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				report.add(SeverityWarning, "document_invalid", doc, "could not be parsed completely: %v", err)
+			}
+			return
+		}
+		start, ok := token.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		for _, attr := range start.Attr {
+			if !linkAttrs[strings.ToLower(attr.Name.Local)] {
+				continue
+			}
+			target, ok := resolve(path.Dir(doc), attr.Value)
+			if !ok || seen[target] {
+				continue
+			}
+			seen[target] = true
+			if _, ok := entries[target]; !ok {
+				report.add(SeverityError, "broken_link", doc, "links to %s, which is not in the EPUB", target)
+			}
+		}
+	}
+}
+
+// resolve turns a reference relative to dir into an archive path. It
+// reports false for references to other sites, fragment-only links, and
+// data: URLs.
+func resolve(dir, ref string) (string, bool) {
+	ref = strings.TrimSpace(ref)
+	if ref == "" || strings.HasPrefix(ref, "#") {
+		return "", false
+	}
+	u, err := url.Parse(ref)
+	if err != nil || u.Scheme != "" || u.Host != "" || u.Path == "" {
+		return "", false
+	}
+	return strings.TrimPrefix(path.Clean(path.Join(dir, u.Path)), "/"), true
+}
+
+func drain(f *zip.File) error {
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	_, err = io.Copy(io.Discard, rc)
+	return err
+}
+
+func readEntry(f *zip.File) ([]byte, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
+
+func decodeEntry(f *zip.File, v any) error {
+	raw, err := readEntry(f)
+	if err != nil {
+		return err
+	}
+	return xml.Unmarshal(raw, v)
+}
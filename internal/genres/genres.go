@@ -0,0 +1,323 @@
+// Package genres maps free-form EPUB subjects onto a small, curated genre
+// list. Publishers fill dc:subject with BISAC paths ("Fiction / Science
+// Fiction / Space Opera"), library headings, and shorthand ("sci-fi", "SF");
+// the mapping folds those into one name per genre for feeds and filters.
+//
+// GENRE_MAP_FILE names an optional YAML file that extends or replaces the
+// built-in mapping:
+//
+//	defaults: true          # keep built-in genres not listed below
+//	order: [Cozy Mystery]   # list these first
+//	genres:
+//	  Science Fiction: [science fiction, sci fi, "=sf", space opera]
+//	  Cozy Mystery: [cozy mystery, cosy mystery]
+//	adult: [erotica, erotic, "=nsfw"]  # replaces the built-in adult keywords
+//
+// Each keyword matches whole words anywhere in a subject, ignoring case and
+// punctuation; a leading "=" makes it match only a whole subject or one
+// "/"-, ">"-, or "--"-separated part of it. A genre listed in the file
+// replaces the built-in keywords for that genre.
+//
+// The adult keywords flag books as adult content, which restricted accounts
+// don't see. They are separate from the genres.
+package genres
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Mapper assigns genres to subject lists.
+type Mapper struct {
+	genres []genre
+	adult  genre
+
+	once     sync.Once
+	byLength []keyword
+}
+
+type genre struct {
+	name  string
+	words []string // whole-word phrases, normalized
+	exact []string // whole subjects or parts, normalized
+}
+
+// defaultGenres is the built-in taxonomy, in the order feeds list it.
+var defaultGenres = []struct {
+	Name     string
+	Keywords []string
+}{
+	{"Science Fiction", []string{"science fiction", "sci fi", "scifi", "=sf", "space opera", "cyberpunk", "dystopian", "dystopia", "time travel", "alien contact", "military science fiction"}},
+	{"Fantasy", []string{"fantasy", "epic fantasy", "urban fantasy", "sword and sorcery", "dragons", "magic", "fairy tales"}},
+	{"Horror", []string{"horror", "ghost stories", "vampires", "zombies", "occult fiction"}},
+	{"Mystery", []string{"mystery", "mysteries", "detective", "crime fiction", "whodunit", "cozy mystery", "police procedural"}},
+	{"Thriller", []string{"thriller", "thrillers", "suspense", "espionage", "spy stories", "legal thriller"}},
+	{"Romance", []string{"romance", "love stories", "romantic comedy", "regency romance"}},
+	{"Historical Fiction", []string{"historical fiction", "fiction historical", "historical novel"}},
+	{"Literary Fiction", []string{"literary fiction", "fiction literary", "literary", "classics", "classic literature"}},
+	{"Young Adult", []string{"young adult", "=ya", "teen fiction", "juvenile fiction"}},
+	{"Children's", []string{"children", "childrens", "picture books", "juvenile literature", "middle grade"}},
+	{"Comics & Graphic Novels", []string{"comics", "graphic novels", "manga", "comic books"}},
+	{"Poetry", []string{"poetry", "poems", "verse"}},
+	{"Drama", []string{"drama", "plays", "theater", "theatre"}},
+	{"Humor", []string{"humor", "humour", "satire", "comedy"}},
+	{"Biography & Memoir", []string{"biography", "autobiography", "memoir", "memoirs", "biographies"}},
+	{"History", []string{"history", "military history", "world war", "ancient civilizations"}},
+	{"Science", []string{"science", "physics", "biology", "chemistry", "astronomy", "mathematics", "nature"}},
+	{"Technology", []string{"computers", "programming", "technology", "engineering", "software"}},
+	{"Philosophy", []string{"philosophy", "ethics"}},
+	{"Religion & Spirituality", []string{"religion", "spirituality", "theology", "christianity", "buddhism", "islam", "judaism"}},
+	{"Business & Economics", []string{"business", "economics", "finance", "management", "investing"}},
+	{"Self-Help", []string{"self help", "personal growth", "self improvement", "motivational"}},
+	{"Cooking", []string{"cooking", "cookbooks", "recipes", "food"}},
+	{"Travel", []string{"travel", "travel writing", "guidebooks"}},
+	{"Art & Photography", []string{"art", "photography", "design", "architecture"}},
+}
+
+// defaultAdult marks erotica and pornography. "Adult" alone is left out:
+// publishers use it for general adult fiction, and "young adult" would
+// match too.
+var defaultAdult = []string{"erotica", "erotic", "erotic romance", "pornography", "pornographic", "porn", "bdsm", "adults only", "=nsfw", "=xxx"}
+
+// file is the GENRE_MAP_FILE layout.
+type file struct {
+	Defaults *bool               `yaml:"defaults"`
+	Genres   map[string][]string `yaml:"genres"`
+	// Order lists genres in the order feeds show them. Built-in genres it
+	// leaves out follow in their usual order, then the rest by name.
+	Order []string `yaml:"order"`
+	// Adult replaces the built-in adult-content keywords; an empty list
+	// flags nothing.
+	Adult *[]string `yaml:"adult"`
+}
+
+// Default returns the built-in mapping.
+func Default() *Mapper {
+	m := &Mapper{adult: compile("adult", defaultAdult)}
+	for _, g := range defaultGenres {
+		m.genres = append(m.genres, compile(g.Name, g.Keywords))
+	}
+	return m
+}
+
+// FromEnv loads GENRE_MAP_FILE, or returns the built-in mapping if it is
+// unset.
+func FromEnv() (*Mapper, error) {
+	path := strings.TrimSpace(os.Getenv("GENRE_MAP_FILE"))
+	if path == "" {
+		return Default(), nil
+	}
+	return Load(path)
+}
+
+// Load reads a mapping file.
+func Load(path string) (*Mapper, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("genre map: %w", err)
+	}
+	var f file
+	if err := yaml.Unmarshal(raw, &f); err != nil {
+		return nil, fmt.Errorf("genre map %s: %w", path, err)
+	}
+	keepDefaults := f.Defaults == nil || *f.Defaults
+
+	m := &Mapper{adult: compile("adult", defaultAdult)}
+	if f.Adult != nil {
+		m.adult = compile("adult", *f.Adult)
+	}
+	listed := map[string]bool{}
+	for name, keywords := range f.Genres {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			return nil, fmt.Errorf("genre map %s: empty genre name", path)
+		}
+		if len(keywords) == 0 {
+			return nil, fmt.Errorf("genre map %s: %q has no keywords", path, name)
+		}
+		listed[strings.ToLower(name)] = true
+		m.genres = append(m.genres, compile(name, keywords))
+	}
+	if keepDefaults {
+		for _, g := range defaultGenres {
+			if !listed[strings.ToLower(g.Name)] {
+				m.genres = append(m.genres, compile(g.Name, g.Keywords))
+			}
+		}
+	}
+	m.sort(f.Order)
+	return m, nil
+}
+
+// sort orders genres by order, then the built-in order, then by name.
+func (m *Mapper) sort(order []string) {
+	rank := map[string]int{}
+	for i, name := range order {
+		rank[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for i, g := range defaultGenres {
+		if _, ok := rank[strings.ToLower(g.Name)]; !ok {
+			rank[strings.ToLower(g.Name)] = len(order) + i
+		}
+	}
+	pos := func(g genre) int {
+		if r, ok := rank[strings.ToLower(g.name)]; ok {
+			return r
+		}
+		return len(order) + len(defaultGenres)
+	}
+	sort.SliceStable(m.genres, func(i, j int) bool {
+		a, b := m.genres[i], m.genres[j]
+		if pa, pb := pos(a), pos(b); pa != pb {
+			return pa < pb
+		}
+		return strings.ToLower(a.name) < strings.ToLower(b.name)
+	})
+}
+
+func compile(name string, keywords []string) genre {
+	g := genre{name: name}
+	for _, k := range keywords {
+		if rest, ok := strings.CutPrefix(strings.TrimSpace(k), "="); ok {
+			if n := normalize(rest); n != "" {
+				g.exact = append(g.exact, n)
+			}
+			continue
+		}
+		if n := normalize(k); n != "" {
+			g.words = append(g.words, n)
+		}
+	}
+	return g
+}
+
+// Names lists every genre in feed order.
+func (m *Mapper) Names() []string {
+	out := make([]string, len(m.genres))
+	for i, g := range m.genres {
+		out[i] = g.name
+	}
+	return out
+}
+
+// Canonical returns the genre named name, ignoring case, and whether there
+// is one.
+func (m *Mapper) Canonical(name string) (string, bool) {
+	for _, g := range m.genres {
+		if strings.EqualFold(g.name, strings.TrimSpace(name)) {
+			return g.name, true
+		}
+	}
+	return "", false
+}
+
+// Map returns the genres subjects fall under, in feed order. Longer
+// keywords are tried first and use up the words they match, so "Science
+// Fiction" doesn't also count as "Science".
+func (m *Mapper) Map(subjects []string) []string {
+	if len(subjects) == 0 {
+		return nil
+	}
+	found := make([]bool, len(m.genres))
+	for _, s := range subjects {
+		parts := subjectParts(s)
+		for i, g := range m.genres {
+			if !found[i] && slices.ContainsFunc(g.exact, func(e string) bool { return slices.Contains(parts, e) }) {
+				found[i] = true
+			}
+		}
+
+		text := " " + parts[0] + " "
+		for _, k := range m.keywords() {
+			w := " " + k.words + " "
+			if strings.Contains(text, w) {
+				found[k.genre] = true
+				text = strings.ReplaceAll(text, w, " | ")
+			}
+		}
+	}
+
+	var out []string
+	for i, g := range m.genres {
+		if found[i] {
+			out = append(out, g.name)
+		}
+	}
+	return out
+}
+
+// Adult reports whether subjects mark a book as adult content.
+func (m *Mapper) Adult(subjects []string) bool {
+	for _, s := range subjects {
+		parts := subjectParts(s)
+		if slices.ContainsFunc(m.adult.exact, func(e string) bool { return slices.Contains(parts, e) }) {
+			return true
+		}
+		text := " " + parts[0] + " "
+		for _, w := range m.adult.words {
+			if strings.Contains(text, " "+w+" ") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// subjectParts returns the normalized subject followed by its parts, which
+// exact keywords match: "Fiction / SF", "Fiction > SF", "Fiction -- SF".
+func subjectParts(s string) []string {
+	parts := []string{normalize(s)}
+	for _, p := range strings.FieldsFunc(strings.ReplaceAll(s, "--", "/"), func(r rune) bool { return r == '/' || r == '>' || r == '|' }) {
+		parts = append(parts, normalize(p))
+	}
+	return parts
+}
+
+type keyword struct {
+	words string
+	genre int
+}
+
+// keywords lists every genre's word keywords, longest first.
+func (m *Mapper) keywords() []keyword {
+	m.once.Do(func() {
+		for i, g := range m.genres {
+			for _, w := range g.words {
+				m.byLength = append(m.byLength, keyword{w, i})
+			}
+		}
+		sort.SliceStable(m.byLength, func(i, j int) bool {
+			return strings.Count(m.byLength[i].words, " ") > strings.Count(m.byLength[j].words, " ")
+		})
+	})
+	return m.byLength
+}
+
+// normalize lower-cases s and reduces it to words separated by single
+// spaces, dropping punctuation and possessives ("Children's" is
+// "childrens").
+func normalize(s string) string {
+	var b strings.Builder
+	space := false
+	for _, r := range strings.ToLower(s) {
+		switch {
+		case r == '\'' || r == '’':
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			if space && b.Len() > 0 {
+				b.WriteByte(' ')
+			}
+			b.WriteRune(r)
+			space = false
+		default:
+			space = true
+		}
+	}
+	return b.String()
+}
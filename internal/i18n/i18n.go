@@ -0,0 +1,140 @@
+// Package i18n translates the strings GoPDS generates on the server: OPDS
+// feed titles and the plain-text error messages handlers return. Messages
+// are keyed by their English text, gettext style, so untranslated strings
+// and unknown languages fall back to English without any extra bookkeeping.
+//
+// Translations live in locales/<lang>.json, embedded in the binary, each a
+// flat object from English message to translation. Messages may contain fmt
+// verbs; a translation must use the same verbs in the same order.
+package i18n
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Fallback is the language messages are written in.
+const Fallback = "en"
+
+//go:embed locales/*.json
+var localeFS embed.FS
+
+var (
+	loadOnce sync.Once
+	catalogs map[string]map[string]string
+
+	mu      sync.RWMutex
+	current = Fallback
+)
+
+func load() {
+	catalogs = map[string]map[string]string{}
+	entries, err := fs.Glob(localeFS, "locales/*.json")
+	if err != nil {
+		return
+	}
+	for _, name := range entries {
+		raw, err := localeFS.ReadFile(name)
+		if err != nil {
+			continue
+		}
+		messages := map[string]string{}
+		if err := json.Unmarshal(raw, &messages); err != nil {
+			slog.Error("i18n: invalid locale file", "file", name, "err", err)
+			continue
+		}
+		catalogs[strings.TrimSuffix(path.Base(name), ".json")] = messages
+	}
+}
+
+// Languages lists the available languages, English included.
+func Languages() []string {
+	loadOnce.Do(load)
+	out := []string{Fallback}
+	for lang := range catalogs {
+		if lang != Fallback {
+			out = append(out, lang)
+		}
+	}
+	sort.Strings(out[1:])
+	return out
+}
+
+// Normalize reduces a locale such as "de_DE.UTF-8" or "pt-BR" to a bundled
+// language, preferring the full region code when both exist. It returns ""
+// when no bundled language matches.
+func Normalize(locale string) string {
+	loadOnce.Do(load)
+	locale, _, _ = strings.Cut(strings.TrimSpace(locale), ".")
+	locale, _, _ = strings.Cut(locale, "@")
+	locale = strings.ToLower(strings.ReplaceAll(locale, "_", "-"))
+	if locale == "" || locale == "c" || locale == "posix" {
+		return ""
+	}
+	if _, ok := catalogs[locale]; ok || locale == Fallback {
+		return locale
+	}
+	base, _, _ := strings.Cut(locale, "-")
+	if _, ok := catalogs[base]; ok || base == Fallback {
+		return base
+	}
+	return ""
+}
+
+// SetupFromEnv selects the language named by LANG, falling back to English
+// with a warning when it isn't bundled.
+func SetupFromEnv() {
+	raw := strings.TrimSpace(os.Getenv("LANG"))
+	lang := Normalize(raw)
+	if lang == "" {
+		if !isNeutral(raw) {
+			slog.Warn("i18n: no translation for LANG; using English", "lang", raw, "available", Languages())
+		}
+		lang = Fallback
+	}
+	mu.Lock()
+	current = lang
+	mu.Unlock()
+	if lang != Fallback {
+		slog.Info("i18n: server messages translated", "lang", lang)
+	}
+}
+
+// isNeutral reports whether a locale only selects a character set, as the
+// C and POSIX locales common in containers do.
+func isNeutral(locale string) bool {
+	base, _, _ := strings.Cut(locale, ".")
+	switch strings.ToLower(base) {
+	case "", "c", "posix":
+		return true
+	}
+	return false
+}
+
+// Language is the language T translates into.
+func Language() string {
+	mu.RLock()
+	defer mu.RUnlock()
+	return current
+}
+
+// T translates msg into the configured language and formats it with args
+// like fmt.Sprintf. Messages without a translation are used as they are.
+func T(msg string, args ...any) string {
+	loadOnce.Do(load)
+	if translated, ok := catalogs[Language()][msg]; ok && translated != "" {
+		msg = translated
+	}
+	if len(args) == 0 {
+		return msg
+	}
+	return fmt.Sprintf(msg, args...)
+}
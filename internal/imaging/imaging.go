@@ -0,0 +1,93 @@
+// Package imaging decodes cover images within limits that keep a small
+// server's memory in check. A decoded image takes four bytes or more per
+// pixel whatever its file size, so a few large covers decoded at once can
+// exhaust a NAS box:
+//
+//   - IMAGE_MAX_PIXELS (default 40000000): images with more pixels than
+//     this are refused, judged from their header before anything is
+//     decoded.
+//   - IMAGE_DECODERS (default 2): images decoded at once across the
+//     process; further decodes wait their turn.
+//
+// Reading an image's size only reads its header and is not limited.
+package imaging
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	// Cover formats found in EPUBs and returned by providers.
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+)
+
+const (
+	defaultMaxPixels = 40_000_000
+	defaultDecoders  = 2
+)
+
+// ErrTooLarge is returned for images with more than IMAGE_MAX_PIXELS.
+var ErrTooLarge = errors.New("image too large")
+
+type limits struct {
+	maxPixels int
+	decoders  chan struct{}
+}
+
+var current = sync.OnceValue(func() limits {
+	return limits{
+		maxPixels: intFromEnv("IMAGE_MAX_PIXELS", defaultMaxPixels),
+		decoders:  make(chan struct{}, intFromEnv("IMAGE_DECODERS", defaultDecoders)),
+	}
+})
+
+func intFromEnv(name string, def int) int {
+	raw := strings.TrimSpace(os.Getenv(name))
+	if raw == "" {
+		return def
+	}
+	v, err := strconv.Atoi(raw)
+	if err != nil || v < 1 {
+		slog.Warn("invalid "+name+"; using default", "value", raw, "default", def)
+		return def
+	}
+	return v
+}
+
+// Config reads an image's format and dimensions from the start of r,
+// without decoding it.
+func Config(r io.Reader) (image.Config, string, error) {
+	cfg, format, err := image.DecodeConfig(r)
+	if err != nil {
+		return image.Config{}, "", err
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 {
+		return image.Config{}, "", fmt.Errorf("image has no size")
+	}
+	return cfg, format, nil
+}
+
+// Decode decodes an encoded image, refusing it with ErrTooLarge if it has
+// more pixels than allowed and waiting for a free decoder first.
+func Decode(raw []byte) (image.Image, string, error) {
+	l := current()
+	cfg, _, err := Config(bytes.NewReader(raw))
+	if err != nil {
+		return nil, "", err
+	}
+	if cfg.Width > l.maxPixels/cfg.Height {
+		return nil, "", fmt.Errorf("%w: %dx%d", ErrTooLarge, cfg.Width, cfg.Height)
+	}
+	l.decoders <- struct{}{}
+	defer func() { <-l.decoders }()
+	return image.Decode(bytes.NewReader(raw))
+}
@@ -0,0 +1,307 @@
+package jobs
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/ab0oo/gopds/internal/database"
+	"github.com/ab0oo/gopds/internal/logging"
+)
+
+// Job types understood by the queue. Handlers are registered by the packages
+// that own the work; a job whose type has no handler fails when claimed.
+const (
+	TypeScan          = "scan"
+	TypeMetadataFetch = "metadata-fetch"
+	TypeConversion    = "conversion"
+	TypeOrganize      = "organize"
+	TypeBackup        = "backup"
+	TypeIntegrity     = "integrity"
+	TypePurge         = "purge"
+)
+
+var (
+	ErrNotFound      = errors.New("job not found")
+	ErrAlreadyActive = errors.New("a job of this type is already queued or running")
+	ErrNotCancelable = errors.New("job is not queued or running")
+)
+
+// Handler performs the work for one job. It should return promptly once ctx
+// is cancelled.
+type Handler func(ctx context.Context, job *database.Job, p *Progress) error
+
+type Manager struct {
+	db       *database.DB
+	workers  int
+	handlers map[string]Handler
+	wake     chan struct{}
+	workerWG sync.WaitGroup
+
+	mu      sync.Mutex
+	running map[int64]context.CancelFunc
+}
+
+func New(db *database.DB, workers int) *Manager {
+	if workers < 1 {
+		workers = 1
+	}
+	return &Manager{
+		db:       db,
+		workers:  workers,
+		handlers: make(map[string]Handler),
+		wake:     make(chan struct{}, 1),
+		running:  make(map[int64]context.CancelFunc),
+	}
+}
+
+// Register installs the handler for a job type. It must be called before Start.
+func (m *Manager) Register(jobType string, h Handler) {
+	m.handlers[jobType] = h
+}
+
+// Start launches the worker goroutines. When ctx is cancelled, running jobs
+// are cancelled and the workers exit once their handlers return; Wait blocks
+// until they have.
+func (m *Manager) Start(ctx context.Context) {
+	if n, err := m.db.FailInterruptedJobs(); err != nil {
+		slog.Error("jobs: failed to clean up interrupted jobs", "err", err)
+	} else if n > 0 {
+		slog.Warn("jobs: marked interrupted jobs as failed", "count", n)
+	}
+	if err := m.db.PruneJobs(time.Now().UTC().Add(-30 * 24 * time.Hour)); err != nil {
+		slog.Error("jobs: failed to prune old jobs", "err", err)
+	}
+
+	for i := 0; i < m.workers; i++ {
+		m.workerWG.Add(1)
+		go func() {
+			defer m.workerWG.Done()
+			m.worker(ctx)
+		}()
+	}
+	m.signal()
+}
+
+// Wait blocks until the workers started by Start have exited, or until ctx
+// is done.
+func (m *Manager) Wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		m.workerWG.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Enqueue adds a job to the queue. The payload is stored as JSON, and the
+// request ID on ctx (if any) is recorded so the job's logs can be traced
+// back to the request that queued it.
+func (m *Manager) Enqueue(ctx context.Context, jobType string, payload any, message string) (*database.Job, error) {
+	raw := ""
+	if payload != nil {
+		b, err := json.Marshal(payload)
+		if err != nil {
+			return nil, err
+		}
+		raw = string(b)
+	}
+	job, err := m.db.CreateJob(jobType, raw, message, logging.RequestID(ctx))
+	if err != nil {
+		return nil, err
+	}
+	slog.InfoContext(ctx, "jobs: queued", "job_id", job.ID, "job_type", job.Type)
+	m.signal()
+	return job, nil
+}
+
+// EnqueueUnique is like Enqueue but refuses to queue a second job of the
+// same type while one is active, returning the active job with
+// ErrAlreadyActive.
+func (m *Manager) EnqueueUnique(ctx context.Context, jobType string, payload any, message string) (*database.Job, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	active, err := m.db.GetActiveJob(jobType)
+	if err == nil {
+		return active, ErrAlreadyActive
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+	return m.Enqueue(ctx, jobType, payload, message)
+}
+
+// Cancel stops a queued or running job.
+func (m *Manager) Cancel(id int64) (*database.Job, error) {
+	job, err := m.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	switch job.Status {
+	case database.JobStatusQueued:
+		if _, err := m.db.CancelQueuedJob(id); err != nil {
+			return nil, err
+		}
+	case database.JobStatusRunning:
+		m.mu.Lock()
+		cancel, ok := m.running[id]
+		m.mu.Unlock()
+		if !ok {
+			return nil, ErrNotCancelable
+		}
+		cancel()
+	default:
+		return job, ErrNotCancelable
+	}
+	return m.Get(id)
+}
+
+func (m *Manager) Get(id int64) (*database.Job, error) {
+	job, err := m.db.GetJob(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	return job, err
+}
+
+func (m *Manager) List(jobType, status string, limit int) ([]database.Job, error) {
+	if limit < 1 || limit > 500 {
+		limit = 100
+	}
+	return m.db.ListJobs(jobType, status, limit)
+}
+
+// Latest returns the newest job of a type, or ErrNotFound.
+func (m *Manager) Latest(jobType string) (*database.Job, error) {
+	job, err := m.db.GetLatestJob(jobType)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	return job, err
+}
+
+func (m *Manager) signal() {
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (m *Manager) worker(ctx context.Context) {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	for {
+		for m.runNext(ctx) {
+			if ctx.Err() != nil {
+				return
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-m.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// runNext claims and executes one job. It reports whether a job was found.
+func (m *Manager) runNext(ctx context.Context) bool {
+	job, err := m.db.ClaimNextJob()
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			slog.Error("jobs: failed to claim next job", "err", err)
+		}
+		return false
+	}
+	// Another worker may be idle; let it check for more work.
+	m.signal()
+
+	attrs := []slog.Attr{slog.Int64("job_id", job.ID), slog.String("job_type", job.Type)}
+	if job.RequestID != "" {
+		attrs = append(attrs, slog.String("request_id", job.RequestID))
+	}
+	ctx = logging.WithAttrs(ctx, attrs...)
+
+	handler, ok := m.handlers[job.Type]
+	if !ok {
+		m.finish(ctx, job, database.JobStatusFailed, "failed", "", fmt.Sprintf("no handler registered for job type %q", job.Type))
+		return true
+	}
+
+	jobCtx, cancel := context.WithCancel(ctx)
+	m.mu.Lock()
+	m.running[job.ID] = cancel
+	m.mu.Unlock()
+	defer func() {
+		cancel()
+		m.mu.Lock()
+		delete(m.running, job.ID)
+		m.mu.Unlock()
+	}()
+
+	slog.InfoContext(jobCtx, "jobs: starting")
+	err = runHandler(jobCtx, handler, job, &Progress{ctx: jobCtx, db: m.db, id: job.ID})
+	switch {
+	case err == nil:
+		m.finish(jobCtx, job, database.JobStatusCompleted, "complete", "", "")
+	case errors.Is(err, context.Canceled) && ctx.Err() != nil:
+		m.finish(jobCtx, job, database.JobStatusCancelled, "interrupted", "Interrupted by shutdown.", "")
+	case errors.Is(err, context.Canceled) && jobCtx.Err() != nil:
+		m.finish(jobCtx, job, database.JobStatusCancelled, "cancelled", "Cancelled.", "")
+	default:
+		m.finish(jobCtx, job, database.JobStatusFailed, "failed", "", err.Error())
+	}
+	return true
+}
+
+func runHandler(ctx context.Context, h Handler, job *database.Job, p *Progress) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("job panicked: %v", r)
+		}
+	}()
+	return h(ctx, job, p)
+}
+
+func (m *Manager) finish(ctx context.Context, job *database.Job, status, phase, message, errMsg string) {
+	if err := m.db.FinishJob(job.ID, status, phase, message, errMsg); err != nil {
+		slog.ErrorContext(ctx, "jobs: failed to record result", "err", err)
+	}
+	if errMsg != "" {
+		slog.ErrorContext(ctx, "jobs: finished", "status", status, "err", errMsg)
+		return
+	}
+	slog.InfoContext(ctx, "jobs: finished", "status", status)
+}
+
+// Progress lets a running handler publish its current phase.
+type Progress struct {
+	ctx context.Context
+	db  *database.DB
+	id  int64
+}
+
+func (p *Progress) Update(phase, message string, count int) {
+	if err := p.db.UpdateJobProgress(p.id, phase, message, count); err != nil {
+		slog.WarnContext(p.ctx, "jobs: failed to update progress", "err", err)
+	}
+}
+
+// DecodePayload unmarshals a job's JSON payload into v.
+func DecodePayload(job *database.Job, v any) error {
+	if job.Payload == "" {
+		return nil
+	}
+	return json.Unmarshal([]byte(job.Payload), v)
+}
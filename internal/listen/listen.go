@@ -0,0 +1,160 @@
+package listen
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+)
+
+// UnixPrefix marks a LISTEN_ADDR that is a Unix domain socket path.
+const UnixPrefix = "unix:"
+
+const defaultSocketMode = 0o660
+
+// Listen opens addr, which is a TCP host:port or unix:/path/to.sock. Socket
+// permissions come from LISTEN_SOCKET_MODE (octal, default 0660) and
+// LISTEN_SOCKET_GROUP.
+func Listen(addr string) (net.Listener, error) {
+	path, ok := strings.CutPrefix(addr, UnixPrefix)
+	if !ok {
+		return net.Listen("tcp", addr)
+	}
+	if path == "" {
+		return nil, errors.New("unix socket path is empty")
+	}
+	mode := fs.FileMode(defaultSocketMode)
+	if raw := strings.TrimSpace(os.Getenv("LISTEN_SOCKET_MODE")); raw != "" {
+		n, err := strconv.ParseUint(raw, 8, 32)
+		if err != nil || n > 0o777 {
+			return nil, fmt.Errorf("LISTEN_SOCKET_MODE %q is not an octal permission like 0660", raw)
+		}
+		mode = fs.FileMode(n)
+	}
+	gid := -1
+	if group := strings.TrimSpace(os.Getenv("LISTEN_SOCKET_GROUP")); group != "" {
+		g, err := user.LookupGroup(group)
+		if err != nil {
+			if g, err = user.LookupGroupId(group); err != nil {
+				return nil, fmt.Errorf("LISTEN_SOCKET_GROUP: %w", err)
+			}
+		}
+		if gid, err = strconv.Atoi(g.Gid); err != nil {
+			return nil, fmt.Errorf("LISTEN_SOCKET_GROUP: %w", err)
+		}
+	}
+
+	// A socket left behind by a crash would make the bind fail. Only remove
+	// it if it really is a socket, never a regular file at a mistyped path.
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode().Type() != fs.ModeSocket {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+		slog.Info("removed stale socket", "path", path)
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	if gid >= 0 {
+		if err := os.Chown(path, -1, gid); err != nil {
+			ln.Close()
+			return nil, err
+		}
+	}
+	return unixListener{ln}, nil
+}
+
+// loopback is what Unix socket peers report as their address. Only local
+// processes with permission on the socket can connect, so they are treated
+// like loopback clients, and TRUSTED_PROXIES=127.0.0.1 trusts the proxy's
+// forwarding headers.
+var loopback = &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+
+type unixListener struct{ net.Listener }
+
+func (l unixListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return unixConn{c}, nil
+}
+
+type unixConn struct{ net.Conn }
+
+func (unixConn) RemoteAddr() net.Addr { return loopback }
+
+// Probe requests /healthz from the server listening on ln, the way a client
+// would, so it fails if the server has stopped accepting or answering
+// connections. t is the listener's TLS setup, or nil for plain HTTP.
+func Probe(ctx context.Context, ln net.Listener, t *TLS) error {
+	addr := ln.Addr()
+	return probe(ctx, addr.Network(), addr.String(), t)
+}
+
+// ProbeAddr is Probe for a server listening on addr, a LISTEN_ADDR value,
+// from another process such as a container health check. A TCP address
+// with no host, or a wildcard one, is probed on loopback.
+func ProbeAddr(ctx context.Context, addr string, t *TLS) error {
+	if path, ok := strings.CutPrefix(addr, UnixPrefix); ok {
+		return probe(ctx, "unix", path, t)
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+		host = "localhost"
+	}
+	return probe(ctx, "tcp", net.JoinHostPort(host, port), t)
+}
+
+func probe(ctx context.Context, network, address string, t *TLS) error {
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, address)
+		},
+		DisableKeepAlives: true,
+	}
+	scheme, host := "http", "localhost"
+	if t != nil {
+		scheme = "https"
+		if t.autocert != nil {
+			// autocert only answers for its own hostnames.
+			host = t.autocertHosts[0]
+		}
+		// This is a connection to ourselves; the certificate is not in
+		// question.
+		transport.TLSClientConfig = &tls.Config{ServerName: host, InsecureSkipVerify: true}
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, scheme+"://"+host+"/healthz", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := (&http.Client{Transport: transport}).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("healthz returned %s", resp.Status)
+	}
+	return nil
+}
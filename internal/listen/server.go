@@ -0,0 +1,37 @@
+package listen
+
+import (
+	"net/http"
+	"time"
+)
+
+// Limits are the server's timeouts and header size limit, so slow or
+// abusive clients can't hold connections open indefinitely. A zero timeout
+// is off.
+type Limits struct {
+	// ReadHeaderTimeout is how long a client has to send request headers.
+	ReadHeaderTimeout time.Duration
+	// ReadTimeout is how long a client has to send a whole request.
+	ReadTimeout time.Duration
+	// WriteTimeout is how long a response may take to write. Handlers that
+	// stream downloads and exports lift it for their own response.
+	WriteTimeout time.Duration
+	// IdleTimeout closes keep-alive connections after this long without a
+	// request.
+	IdleTimeout time.Duration
+	// MaxHeaderBytes is the largest request headers accepted.
+	MaxHeaderBytes int
+}
+
+// NewServer returns an http.Server for handler on addr with limits applied.
+func NewServer(addr string, handler http.Handler, limits Limits) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: limits.ReadHeaderTimeout,
+		ReadTimeout:       limits.ReadTimeout,
+		WriteTimeout:      limits.WriteTimeout,
+		IdleTimeout:       limits.IdleTimeout,
+		MaxHeaderBytes:    limits.MaxHeaderBytes,
+	}
+}
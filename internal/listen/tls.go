@@ -0,0 +1,161 @@
+// Package listen opens the sockets GoPDS serves on. By default that is plain
+// HTTP on LISTEN_ADDR; TLS_* environment variables turn on HTTPS, either with
+// a certificate and key on disk or with certificates obtained from Let's
+// Encrypt, for installs that face the internet without a reverse proxy.
+package listen
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// TLS is how the main listener serves HTTPS.
+type TLS struct {
+	// RedirectAddr, if set, is a plain HTTP address that redirects to
+	// HTTPS and, with autocert, answers ACME http-01 challenges.
+	RedirectAddr string
+
+	keypair       *keypair
+	autocert      *autocert.Manager
+	autocertHosts []string
+}
+
+// TLSFromEnv reads TLS_CERT_FILE and TLS_KEY_FILE, or TLS_AUTOCERT_HOSTS
+// (comma-separated hostnames Let's Encrypt may issue for), TLS_AUTOCERT_EMAIL,
+// and TLS_AUTOCERT_CACHE (default dataDir/autocert), plus TLS_REDIRECT_ADDR.
+// It returns nil if neither a certificate nor autocert hosts are set.
+func TLSFromEnv(dataDir string) (*TLS, error) {
+	certFile := strings.TrimSpace(os.Getenv("TLS_CERT_FILE"))
+	keyFile := strings.TrimSpace(os.Getenv("TLS_KEY_FILE"))
+	var hosts []string
+	for _, h := range strings.Split(os.Getenv("TLS_AUTOCERT_HOSTS"), ",") {
+		if h = strings.ToLower(strings.TrimSpace(h)); h != "" {
+			hosts = append(hosts, h)
+		}
+	}
+	redirect := strings.TrimSpace(os.Getenv("TLS_REDIRECT_ADDR"))
+
+	switch {
+	case certFile != "" && len(hosts) > 0:
+		return nil, errors.New("TLS_CERT_FILE and TLS_AUTOCERT_HOSTS are mutually exclusive")
+	case (certFile == "") != (keyFile == ""):
+		return nil, errors.New("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	case certFile != "":
+		kp := &keypair{certFile: certFile, keyFile: keyFile}
+		if _, err := kp.load(); err != nil {
+			return nil, err
+		}
+		slog.Info("tls enabled", "cert", certFile)
+		return &TLS{RedirectAddr: redirect, keypair: kp}, nil
+	case len(hosts) > 0:
+		cache := strings.TrimSpace(os.Getenv("TLS_AUTOCERT_CACHE"))
+		if cache == "" {
+			cache = filepath.Join(dataDir, "autocert")
+		}
+		m := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(hosts...),
+			Cache:      autocert.DirCache(cache),
+			Email:      strings.TrimSpace(os.Getenv("TLS_AUTOCERT_EMAIL")),
+		}
+		slog.Info("tls enabled with autocert", "hosts", hosts, "cache", cache)
+		if redirect == "" {
+			slog.Warn("TLS_REDIRECT_ADDR is unset; autocert can only use tls-alpn-01, which needs the listener on port 443")
+		}
+		return &TLS{RedirectAddr: redirect, autocert: m, autocertHosts: hosts}, nil
+	}
+	if redirect != "" {
+		slog.Warn("ignoring TLS_REDIRECT_ADDR without TLS_CERT_FILE or TLS_AUTOCERT_HOSTS")
+	}
+	return nil, nil
+}
+
+// Config is the tls.Config for the main server.
+func (t *TLS) Config() *tls.Config {
+	if t.autocert != nil {
+		return t.autocert.TLSConfig()
+	}
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) { return t.keypair.load() },
+	}
+}
+
+// RedirectServer is the plain HTTP server for RedirectAddr. Requests are
+// redirected to the same host and path on httpsAddr's port.
+func (t *TLS) RedirectServer(httpsAddr string) *http.Server {
+	_, port, _ := net.SplitHostPort(httpsAddr)
+	var h http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+	if t.autocert != nil {
+		h = t.autocert.HTTPHandler(h)
+	}
+	return &http.Server{
+		Addr:              t.RedirectAddr,
+		Handler:           h,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+}
+
+// keypair reloads the certificate when either file changes, so a renewal by
+// certbot or similar takes effect without a restart.
+type keypair struct {
+	certFile, keyFile string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func (k *keypair) load() (*tls.Certificate, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	var latest time.Time
+	for _, path := range []string{k.certFile, k.keyFile} {
+		info, err := os.Stat(path)
+		if err != nil {
+			if k.cert != nil {
+				return k.cert, nil
+			}
+			return nil, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	if k.cert != nil && !latest.After(k.modTime) {
+		return k.cert, nil
+	}
+	cert, err := tls.LoadX509KeyPair(k.certFile, k.keyFile)
+	if err != nil {
+		if k.cert != nil {
+			slog.Warn("keeping previous tls certificate", "cert", k.certFile, "err", err)
+			return k.cert, nil
+		}
+		return nil, fmt.Errorf("load tls certificate: %w", err)
+	}
+	if k.cert != nil {
+		slog.Info("tls certificate reloaded", "cert", k.certFile)
+	}
+	k.cert, k.modTime = &cert, latest
+	return k.cert, nil
+}
@@ -0,0 +1,182 @@
+package logging
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// backupTimeFormat is the timestamp in rotated file names. It sorts
+// chronologically and contains no colons, for Windows shares.
+const backupTimeFormat = "2006-01-02T15-04-05.000"
+
+// RotatingFile is an io.Writer that appends to a log file and, when the
+// file would grow past MaxBytes, renames it with a timestamp and starts a
+// new one. Rotated files beyond MaxBackups or older than MaxAge are
+// deleted.
+type RotatingFile struct {
+	Path       string
+	MaxBytes   int64
+	MaxBackups int           // 0 keeps every backup
+	MaxAge     time.Duration // 0 keeps backups regardless of age
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+// FileFromEnv reads LOG_FILE, LOG_FILE_MAX_MB (default 10),
+// LOG_FILE_MAX_BACKUPS (default 5), and LOG_FILE_MAX_AGE_DAYS (default 30)
+// and opens the file. It returns nil if LOG_FILE is unset.
+func FileFromEnv() (*RotatingFile, error) {
+	path := strings.TrimSpace(os.Getenv("LOG_FILE"))
+	if path == "" {
+		return nil, nil
+	}
+	maxMB, err := envNonNegative("LOG_FILE_MAX_MB", 10)
+	if err != nil {
+		return nil, err
+	}
+	backups, err := envNonNegative("LOG_FILE_MAX_BACKUPS", 5)
+	if err != nil {
+		return nil, err
+	}
+	days, err := envNonNegative("LOG_FILE_MAX_AGE_DAYS", 30)
+	if err != nil {
+		return nil, err
+	}
+	if maxMB == 0 {
+		return nil, fmt.Errorf("LOG_FILE_MAX_MB must be at least 1")
+	}
+	f := &RotatingFile{
+		Path:       path,
+		MaxBytes:   int64(maxMB) << 20,
+		MaxBackups: backups,
+		MaxAge:     time.Duration(days) * 24 * time.Hour,
+	}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func envNonNegative(name string, fallback int) (int, error) {
+	raw := strings.TrimSpace(os.Getenv(name))
+	if raw == "" {
+		return fallback, nil
+	}
+	n, err := strconv.Atoi(raw)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%s must be a whole number", name)
+	}
+	return n, nil
+}
+
+func (f *RotatingFile) open() error {
+	if err := os.MkdirAll(filepath.Dir(f.Path), 0o755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(f.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.size = file, info.Size()
+	return nil
+}
+
+// Write appends p, rotating first if p would push the file past MaxBytes.
+// A single record larger than MaxBytes still goes into one file.
+func (f *RotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		if err := f.open(); err != nil {
+			return 0, err
+		}
+	}
+	if f.size > 0 && f.size+int64(len(p)) > f.MaxBytes {
+		if err := f.rotate(); err != nil {
+			// Keep logging to the oversized file rather than lose records.
+			fmt.Fprintf(os.Stderr, "gopds: log rotation failed: %v\n", err)
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// Close closes the current file.
+func (f *RotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
+
+func (f *RotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	f.file = nil
+	ext := filepath.Ext(f.Path)
+	backup := strings.TrimSuffix(f.Path, ext) + "-" + time.Now().UTC().Format(backupTimeFormat) + ext
+	renameErr := os.Rename(f.Path, backup)
+	if err := f.open(); err != nil {
+		return err
+	}
+	if renameErr != nil {
+		return renameErr
+	}
+	f.prune()
+	return nil
+}
+
+// prune deletes backups past MaxBackups or MaxAge, oldest first.
+func (f *RotatingFile) prune() {
+	ext := filepath.Ext(f.Path)
+	prefix := filepath.Base(strings.TrimSuffix(f.Path, ext)) + "-"
+	entries, err := os.ReadDir(filepath.Dir(f.Path))
+	if err != nil {
+		return
+	}
+	type backup struct {
+		path string
+		at   time.Time
+	}
+	var backups []backup
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, ext) {
+			continue
+		}
+		at, err := time.Parse(backupTimeFormat, strings.TrimSuffix(strings.TrimPrefix(name, prefix), ext))
+		if err != nil {
+			continue
+		}
+		backups = append(backups, backup{filepath.Join(filepath.Dir(f.Path), name), at})
+	}
+	sort.Slice(backups, func(i, j int) bool { return backups[i].at.After(backups[j].at) })
+	cutoff := time.Now().UTC().Add(-f.MaxAge)
+	for i, b := range backups {
+		if (f.MaxBackups > 0 && i >= f.MaxBackups) || (f.MaxAge > 0 && b.at.Before(cutoff)) {
+			if err := os.Remove(b.path); err != nil {
+				slog.Warn("failed to remove old log file", "path", b.path, "err", err)
+			}
+		}
+	}
+}
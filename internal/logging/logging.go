@@ -0,0 +1,103 @@
+package logging
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	LevelDebug = "debug"
+	LevelInfo  = "info"
+	LevelWarn  = "warn"
+	LevelError = "error"
+)
+
+// Entry is one captured log record.
+type Entry struct {
+	Seq     uint64    `json:"seq"`
+	Time    time.Time `json:"time"`
+	Level   string    `json:"level"`
+	Message string    `json:"message"`
+}
+
+// Buffer keeps the most recent log entries in memory for /api/admin/logs.
+type Buffer struct {
+	mu      sync.Mutex
+	entries []Entry
+	next    int
+	full    bool
+	seq     uint64
+}
+
+// Default is the process-wide buffer; the slog handler Setup installs
+// appends every record to it.
+var Default = NewBuffer(2000)
+
+func NewBuffer(capacity int) *Buffer {
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &Buffer{entries: make([]Entry, capacity)}
+}
+
+// Append stores an entry, assigning its sequence number.
+func (b *Buffer) Append(e Entry) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.seq++
+	e.Seq = b.seq
+	b.entries[b.next] = e
+	b.next = (b.next + 1) % len(b.entries)
+	if b.next == 0 {
+		b.full = true
+	}
+}
+
+// Query returns entries at or above minLevel newer than since, oldest first,
+// keeping at most the newest limit entries.
+func (b *Buffer) Query(minLevel string, since time.Time, limit int) []Entry {
+	b.mu.Lock()
+	ordered := make([]Entry, 0, len(b.entries))
+	if b.full {
+		ordered = append(ordered, b.entries[b.next:]...)
+	}
+	ordered = append(ordered, b.entries[:b.next]...)
+	b.mu.Unlock()
+
+	min := levelRank(minLevel)
+	out := make([]Entry, 0, len(ordered))
+	for _, e := range ordered {
+		if levelRank(e.Level) < min {
+			continue
+		}
+		if !since.IsZero() && !e.Time.After(since) {
+			continue
+		}
+		out = append(out, e)
+	}
+	if limit > 0 && len(out) > limit {
+		out = out[len(out)-limit:]
+	}
+	return out
+}
+
+// ValidLevel reports whether s names a known level.
+func ValidLevel(s string) bool {
+	return levelRank(s) >= 0 && strings.TrimSpace(s) != ""
+}
+
+func levelRank(level string) int {
+	switch strings.ToLower(strings.TrimSpace(level)) {
+	case LevelDebug:
+		return 0
+	case "", LevelInfo:
+		return 1
+	case LevelWarn, "warning":
+		return 2
+	case LevelError:
+		return 3
+	default:
+		return -1
+	}
+}
@@ -0,0 +1,170 @@
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+type ctxKey struct{}
+
+// WithAttrs returns a context whose log records carry attrs in addition to
+// any already attached. Handlers installed by Setup read them back, so
+// passing ctx to slog.InfoContext and friends is enough to tag a record.
+func WithAttrs(ctx context.Context, attrs ...slog.Attr) context.Context {
+	prev, _ := ctx.Value(ctxKey{}).([]slog.Attr)
+	merged := make([]slog.Attr, 0, len(prev)+len(attrs))
+	merged = append(merged, prev...)
+	merged = append(merged, attrs...)
+	return context.WithValue(ctx, ctxKey{}, merged)
+}
+
+// WithRequestID tags ctx with a request ID.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return WithAttrs(ctx, slog.String("request_id", id))
+}
+
+// RequestID returns the request ID attached to ctx, if any.
+func RequestID(ctx context.Context) string {
+	attrs, _ := ctx.Value(ctxKey{}).([]slog.Attr)
+	for i := len(attrs) - 1; i >= 0; i-- {
+		if attrs[i].Key == "request_id" {
+			return attrs[i].Value.String()
+		}
+	}
+	return ""
+}
+
+// NewRequestID returns a random 16-character hex ID.
+func NewRequestID() string {
+	var b [8]byte
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// Setup installs the process-wide slog logger. LOG_LEVEL selects the minimum
+// level (debug, info, warn, error; default info) and LOG_FORMAT selects text
+// or json output on w. Every record is also kept in Default for
+// /api/admin/logs. The standard log package is routed through the same
+// handler at info level.
+func Setup(w io.Writer) *slog.Logger {
+	level := parseLevel(os.Getenv("LOG_LEVEL"))
+	opts := &slog.HandlerOptions{Level: level}
+
+	var primary slog.Handler
+	switch strings.ToLower(strings.TrimSpace(os.Getenv("LOG_FORMAT"))) {
+	case "json":
+		primary = slog.NewJSONHandler(w, opts)
+	default:
+		primary = slog.NewTextHandler(w, opts)
+	}
+
+	logger := slog.New(&contextHandler{next: primary, buf: Default})
+	slog.SetDefault(logger)
+	return logger
+}
+
+func parseLevel(raw string) slog.Level {
+	switch strings.ToLower(strings.TrimSpace(raw)) {
+	case LevelDebug:
+		return slog.LevelDebug
+	case LevelWarn, "warning":
+		return slog.LevelWarn
+	case LevelError:
+		return slog.LevelError
+	default:
+		return slog.LevelInfo
+	}
+}
+
+// contextHandler adds context attrs to each record and copies it into the
+// in-memory buffer before passing it on.
+type contextHandler struct {
+	next slog.Handler
+	buf  *Buffer
+
+	// prefix is the rendered form of attrs added with WithAttrs/WithGroup,
+	// kept for the buffer copy.
+	prefix string
+	group  string
+}
+
+func (h *contextHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+func (h *contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if attrs, ok := ctx.Value(ctxKey{}).([]slog.Attr); ok && len(attrs) > 0 {
+		r = r.Clone()
+		r.AddAttrs(attrs...)
+	}
+
+	if h.buf != nil {
+		var b strings.Builder
+		b.WriteString(r.Message)
+		b.WriteString(h.prefix)
+		r.Attrs(func(a slog.Attr) bool {
+			writeAttr(&b, h.group, a)
+			return true
+		})
+		h.buf.Append(Entry{Time: r.Time.UTC(), Level: levelName(r.Level), Message: b.String()})
+	}
+	return h.next.Handle(ctx, r)
+}
+
+func (h *contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	var b strings.Builder
+	b.WriteString(h.prefix)
+	for _, a := range attrs {
+		writeAttr(&b, h.group, a)
+	}
+	return &contextHandler{next: h.next.WithAttrs(attrs), buf: h.buf, prefix: b.String(), group: h.group}
+}
+
+func (h *contextHandler) WithGroup(name string) slog.Handler {
+	group := name
+	if h.group != "" {
+		group = h.group + "." + name
+	}
+	return &contextHandler{next: h.next.WithGroup(name), buf: h.buf, prefix: h.prefix, group: group}
+}
+
+func writeAttr(b *strings.Builder, group string, a slog.Attr) {
+	a.Value = a.Value.Resolve()
+	if a.Equal(slog.Attr{}) {
+		return
+	}
+	key := a.Key
+	if group != "" {
+		key = group + "." + key
+	}
+	if a.Value.Kind() == slog.KindGroup {
+		for _, ga := range a.Value.Group() {
+			writeAttr(b, key, ga)
+		}
+		return
+	}
+	val := a.Value.String()
+	if strings.ContainsAny(val, " \t\"=") || val == "" {
+		val = fmt.Sprintf("%q", val)
+	}
+	b.WriteString(" " + key + "=" + val)
+}
+
+func levelName(l slog.Level) string {
+	switch {
+	case l >= slog.LevelError:
+		return LevelError
+	case l >= slog.LevelWarn:
+		return LevelWarn
+	case l >= slog.LevelInfo:
+		return LevelInfo
+	default:
+		return LevelDebug
+	}
+}
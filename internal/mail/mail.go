@@ -0,0 +1,240 @@
+// Package mail sends notification email through an SMTP relay
+// configured with SMTP_* environment variables. Without SMTP_HOST it is
+// disabled, and callers fall back to showing links to the admin.
+package mail
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrDisabled is returned by Send when SMTP is not configured.
+var ErrDisabled = errors.New("smtp is not configured")
+
+// TLS modes for SMTP_TLS.
+const (
+	TLSStartTLS = "starttls"
+	TLSImplicit = "tls"
+	TLSNone     = "none"
+)
+
+const dialTimeout = 15 * time.Second
+
+type Mailer struct {
+	host     string
+	port     int
+	username string
+	password string
+	from     string
+	tlsMode  string
+}
+
+// FromEnv reads SMTP_HOST, SMTP_PORT (default 587, or 465 for implicit TLS),
+// SMTP_USERNAME, SMTP_PASSWORD, SMTP_FROM, and SMTP_TLS (starttls, tls, or
+// none; default starttls). It returns nil if SMTP_HOST is unset; a nil
+// Mailer's Send returns ErrDisabled.
+func FromEnv() *Mailer {
+	host := strings.TrimSpace(os.Getenv("SMTP_HOST"))
+	if host == "" {
+		return nil
+	}
+	m := &Mailer{
+		host:     host,
+		username: strings.TrimSpace(os.Getenv("SMTP_USERNAME")),
+		password: os.Getenv("SMTP_PASSWORD"),
+		from:     strings.TrimSpace(os.Getenv("SMTP_FROM")),
+		tlsMode:  strings.ToLower(strings.TrimSpace(os.Getenv("SMTP_TLS"))),
+	}
+	switch m.tlsMode {
+	case "":
+		m.tlsMode = TLSStartTLS
+	case TLSStartTLS, TLSImplicit, TLSNone:
+	default:
+		slog.Warn("unknown SMTP_TLS; using starttls", "value", m.tlsMode)
+		m.tlsMode = TLSStartTLS
+	}
+	m.port = 587
+	if m.tlsMode == TLSImplicit {
+		m.port = 465
+	}
+	if raw := strings.TrimSpace(os.Getenv("SMTP_PORT")); raw != "" {
+		if p, err := strconv.Atoi(raw); err == nil && p > 0 && p < 65536 {
+			m.port = p
+		} else {
+			slog.Warn("invalid SMTP_PORT; using default", "value", raw, "port", m.port)
+		}
+	}
+	if m.from == "" {
+		m.from = "gopds@" + host
+		if m.username != "" && strings.Contains(m.username, "@") {
+			m.from = m.username
+		}
+	}
+	slog.Info("smtp enabled", "host", host, "port", m.port, "tls", m.tlsMode, "from", m.from)
+	return m
+}
+
+// Enabled reports whether m can send mail.
+func (m *Mailer) Enabled() bool {
+	return m != nil
+}
+
+// Send delivers a plain-text message to one recipient.
+func (m *Mailer) Send(ctx context.Context, to, subject, body string) error {
+	if err := m.check(to, subject); err != nil {
+		return err
+	}
+	return m.deliver(ctx, to, message(m.from, to, subject, body))
+}
+
+// SendHTML delivers an HTML message to one recipient, with a plain-text
+// version for clients that don't show HTML.
+func (m *Mailer) SendHTML(ctx context.Context, to, subject, text, html string) error {
+	if err := m.check(to, subject); err != nil {
+		return err
+	}
+	msg, err := htmlMessage(m.from, to, subject, text, html)
+	if err != nil {
+		return err
+	}
+	return m.deliver(ctx, to, msg)
+}
+
+func (m *Mailer) check(to, subject string) error {
+	if m == nil {
+		return ErrDisabled
+	}
+	if _, err := mail.ParseAddress(to); err != nil {
+		return fmt.Errorf("invalid recipient %q: %w", to, err)
+	}
+	if strings.ContainsAny(subject, "\r\n") {
+		return errors.New("subject must be a single line")
+	}
+	return nil
+}
+
+func (m *Mailer) deliver(ctx context.Context, to string, msg []byte) error {
+	addr := net.JoinHostPort(m.host, strconv.Itoa(m.port))
+	dialer := &net.Dialer{Timeout: dialTimeout}
+	var conn net.Conn
+	var err error
+	if m.tlsMode == TLSImplicit {
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: &tls.Config{ServerName: m.host}}).DialContext(ctx, "tcp", addr)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	} else {
+		_ = conn.SetDeadline(time.Now().Add(time.Minute))
+	}
+
+	c, err := smtp.NewClient(conn, m.host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+	if m.tlsMode == TLSStartTLS {
+		if err := c.StartTLS(&tls.Config{ServerName: m.host}); err != nil {
+			return fmt.Errorf("starttls: %w", err)
+		}
+	}
+	if m.username != "" {
+		if err := c.Auth(smtp.PlainAuth("", m.username, m.password, m.host)); err != nil {
+			return fmt.Errorf("auth: %w", err)
+		}
+	}
+	if err := c.Mail(m.from); err != nil {
+		return err
+	}
+	if err := c.Rcpt(to); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+func headers(from, to, subject string) string {
+	var sb strings.Builder
+	sb.WriteString("From: " + from + "\r\n")
+	sb.WriteString("To: " + to + "\r\n")
+	sb.WriteString("Subject: " + mime.QEncoding.Encode("utf-8", subject) + "\r\n")
+	sb.WriteString("Date: " + time.Now().Format(time.RFC1123Z) + "\r\n")
+	sb.WriteString("MIME-Version: 1.0\r\n")
+	return sb.String()
+}
+
+func message(from, to, subject, body string) []byte {
+	var sb strings.Builder
+	sb.WriteString(headers(from, to, subject))
+	sb.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	sb.WriteString("Content-Transfer-Encoding: 8bit\r\n\r\n")
+	// net/smtp dot-stuffs the body but leaves line endings alone.
+	for _, line := range strings.Split(strings.ReplaceAll(body, "\r\n", "\n"), "\n") {
+		sb.WriteString(line + "\r\n")
+	}
+	return []byte(sb.String())
+}
+
+// htmlMessage builds a multipart/alternative message. Both parts are
+// quoted-printable, which keeps long HTML lines inside SMTP's line limit.
+func htmlMessage(from, to, subject, text, html string) ([]byte, error) {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for _, part := range []struct{ contentType, content string }{
+		{"text/plain; charset=utf-8", text},
+		{"text/html; charset=utf-8", html},
+	} {
+		pw, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		qp := quotedprintable.NewWriter(pw)
+		if _, err := qp.Write([]byte(part.content)); err != nil {
+			return nil, err
+		}
+		if err := qp.Close(); err != nil {
+			return nil, err
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+
+	var sb bytes.Buffer
+	sb.WriteString(headers(from, to, subject))
+	sb.WriteString("Content-Type: multipart/alternative; boundary=\"" + mw.Boundary() + "\"\r\n\r\n")
+	sb.Write(body.Bytes())
+	return sb.Bytes(), nil
+}
@@ -0,0 +1,82 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Metrics exported by gopds. Label values are kept low-cardinality: routes
+// are chi patterns, not raw paths, and upstreams are hostnames.
+var (
+	HTTPRequests = NewCounterVec("gopds_http_requests_total",
+		"HTTP requests served, by route pattern, method, and status code.",
+		"route", "method", "code")
+	HTTPDuration = NewHistogramVec("gopds_http_request_duration_seconds",
+		"HTTP request latency by route pattern and method.",
+		DefBuckets, "route", "method")
+
+	Scans = NewCounterVec("gopds_scans_total",
+		"Library scans by operation and result.",
+		"operation", "result")
+	ScanDuration = NewHistogramVec("gopds_scan_duration_seconds",
+		"Library scan duration by operation.",
+		[]float64{1, 5, 15, 30, 60, 120, 300, 600, 1800, 3600}, "operation")
+
+	CoverCache = NewCounterVec("gopds_cover_cache_requests_total",
+		"Cover image requests by cache result (hit or miss).",
+		"result")
+
+	UpstreamRequests = NewCounterVec("gopds_upstream_requests_total",
+		"Outbound metadata and cover API calls by host and result (ok, http_error, or error).",
+		"host", "result")
+	UpstreamDuration = NewHistogramVec("gopds_upstream_request_duration_seconds",
+		"Outbound metadata and cover API latency by host.",
+		DefBuckets, "host")
+
+	WebhookDeliveries = NewCounterVec("gopds_webhook_deliveries_total",
+		"Webhook delivery attempts by event and result (ok, retry, failed, or dropped).",
+		"event", "result")
+
+	DBQueryDuration = NewHistogramVec("gopds_db_query_duration_seconds",
+		"SQLite statement latency by statement kind (select, insert, update, ...).",
+		[]float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1}, "op")
+)
+
+// UpstreamTransport records UpstreamRequests and UpstreamDuration for every
+// request it carries. Use it as the Transport of outbound API clients.
+var UpstreamTransport = InstrumentUpstream(http.DefaultTransport)
+
+// InstrumentUpstream wraps next like UpstreamTransport, for clients that
+// need their own transport settings.
+func InstrumentUpstream(next http.RoundTripper) http.RoundTripper {
+	return upstreamTransport{next: next}
+}
+
+type upstreamTransport struct {
+	next http.RoundTripper
+}
+
+func (t upstreamTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	res, err := t.next.RoundTrip(req)
+	host := req.URL.Hostname()
+	UpstreamDuration.Observe(time.Since(start).Seconds(), host)
+	switch {
+	case err != nil:
+		UpstreamRequests.Inc(host, "error")
+	case res.StatusCode >= 400:
+		UpstreamRequests.Inc(host, "http_error")
+	default:
+		UpstreamRequests.Inc(host, "ok")
+	}
+	return res, err
+}
+
+// StatusLabel formats an HTTP status code for the "code" label.
+func StatusLabel(code int) string {
+	if code == 0 {
+		code = http.StatusOK
+	}
+	return strconv.Itoa(code)
+}
@@ -0,0 +1,90 @@
+package organize
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// A journal lists the moves of one organize run, one JSON object per line,
+// so the run can be undone. Each move is written and synced as soon as it
+// is made, so a run that is interrupted can still be undone.
+
+// Entry is one journaled move.
+type Entry struct {
+	Move
+	// CreatedDirs are the folders the move created, which undoing it
+	// removes.
+	CreatedDirs []string `json:"created_dirs,omitempty"`
+}
+
+// Journal records a run's moves as they are made.
+type Journal struct {
+	f *os.File
+}
+
+// JournalName is the default journal path for a run over dir started at t.
+// The leading dot keeps it out of the way in file browsers; scans only
+// look at EPUBs.
+func JournalName(dir string, t time.Time) string {
+	return filepath.Join(dir, ".gopds-organize-"+t.Format("20060102-150405")+".jsonl")
+}
+
+// CreateJournal starts a journal at path. It refuses to replace an
+// existing one.
+func CreateJournal(path string) (*Journal, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &Journal{f: f}, nil
+}
+
+// Record appends a move.
+func (j *Journal) Record(m Move, createdDirs []string) error {
+	line, err := json.Marshal(Entry{Move: m, CreatedDirs: createdDirs})
+	if err != nil {
+		return err
+	}
+	if _, err := j.f.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return j.f.Sync()
+}
+
+// Close closes the journal, removing it if nothing was recorded.
+func (j *Journal) Close() error {
+	info, err := j.f.Stat()
+	if closeErr := j.f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && info.Size() == 0 {
+		err = os.Remove(j.f.Name())
+	}
+	return err
+}
+
+// ReadJournal returns a journal's moves in the order they were made.
+func ReadJournal(path string) ([]Entry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var entries []Entry
+	lines := bufio.NewScanner(f)
+	for n := 1; lines.Scan(); n++ {
+		if len(lines.Bytes()) == 0 {
+			continue
+		}
+		var e Entry
+		if err := json.Unmarshal(lines.Bytes(), &e); err != nil || e.From == "" || e.To == "" {
+			return nil, fmt.Errorf("%s line %d: not a journal entry", path, n)
+		}
+		entries = append(entries, e)
+	}
+	return entries, lines.Err()
+}
@@ -0,0 +1,249 @@
+// Package organize tidies a folder of loose EPUBs into one folder per book,
+// named after the book's title, with the file renamed to match, or into
+// any layout a Template describes. Libraries that were dumped into a
+// single directory, often under hash-like file names, become browsable
+// and get a folder each for their covers.
+package organize
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ab0oo/gopds/internal/scanner"
+)
+
+// Move is one EPUB's planned relocation.
+type Move struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+	// Renamed is set when the title's usual destination was taken and a
+	// numbered one is used instead.
+	Renamed bool `json:"-"`
+}
+
+// Skip is an EPUB left where it is, and why.
+type Skip struct {
+	Path   string
+	Reason string
+}
+
+// Conflict says what Plan does with a book whose destination is taken,
+// by an existing file or by another book with the same title.
+type Conflict string
+
+const (
+	// SkipConflicts leaves the book where it is.
+	SkipConflicts Conflict = "skip"
+	// SuffixConflicts numbers the destination: "Title (2)/Title (2).epub".
+	SuffixConflicts Conflict = "suffix"
+)
+
+// ParseConflict parses a -on-conflict value.
+func ParseConflict(s string) (Conflict, error) {
+	switch c := Conflict(strings.ToLower(strings.TrimSpace(s))); c {
+	case SkipConflicts, SuffixConflicts:
+		return c, nil
+	}
+	return "", fmt.Errorf("unknown conflict policy %q (want skip or suffix)", s)
+}
+
+// Options control Plan and PlanFiles.
+type Options struct {
+	// Dest is the folder books are laid out in. For Plan, "" is the
+	// folder being organized; PlanFiles requires it.
+	Dest string
+	// Template lays out the organized folder; nil is DefaultTemplate.
+	Template *Template
+	// OnConflict handles taken destinations; "" is SkipConflicts.
+	OnConflict Conflict
+	// Recursive also takes books from subfolders, so a whole library can
+	// be moved to a new layout. Otherwise only the EPUBs directly inside
+	// the folder are moved.
+	Recursive bool
+}
+
+// Plan works out where each EPUB in dir belongs. Books whose title can't
+// be read are left where they are, as are books already where they
+// belong. Taken destinations are handled as opts.OnConflict says.
+func Plan(dir string, opts Options) ([]Move, []Skip, error) {
+	var books []string
+	if opts.Recursive {
+		var err error
+		if books, err = FindEPUBs(dir); err != nil {
+			return nil, nil, err
+		}
+	} else {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, entry := range entries {
+			if !entry.IsDir() && strings.EqualFold(filepath.Ext(entry.Name()), ".epub") {
+				books = append(books, filepath.Join(dir, entry.Name()))
+			}
+		}
+	}
+	if opts.Dest == "" {
+		opts.Dest = dir
+	}
+	return PlanFiles(books, opts)
+}
+
+// FindEPUBs lists the EPUBs in dir and its subfolders, leaving out hidden
+// folders.
+func FindEPUBs(dir string) ([]string, error) {
+	var books []string
+	err := filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() && path != dir && strings.HasPrefix(d.Name(), ".") {
+			return filepath.SkipDir
+		}
+		if !d.IsDir() && strings.EqualFold(filepath.Ext(d.Name()), ".epub") {
+			books = append(books, path)
+		}
+		return nil
+	})
+	return books, err
+}
+
+// PlanFiles works out where each of books belongs under opts.Dest, as Plan
+// does.
+func PlanFiles(books []string, opts Options) ([]Move, []Skip, error) {
+	if opts.Dest == "" {
+		return nil, nil, errors.New("organize: no destination folder")
+	}
+	tmpl := opts.Template
+	if tmpl == nil {
+		var err error
+		if tmpl, err = ParseTemplate(DefaultTemplate); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	var moves []Move
+	var skips []Skip
+	claimed := map[string]bool{}
+	for _, from := range books {
+		meta, err := scanner.ExtractLiveMetadata(from)
+		if err != nil || meta == nil || strings.TrimSpace(meta.Title) == "" {
+			skips = append(skips, Skip{Path: from, Reason: "could not read a title"})
+			continue
+		}
+		book := BookFromMetadata(meta)
+		if SafeName(book.Title) == "" {
+			skips = append(skips, Skip{Path: from, Reason: "title has no usable characters"})
+			continue
+		}
+		ext := filepath.Ext(from)
+		to := filepath.Join(opts.Dest, tmpl.Path(book, ext))
+		if to == from {
+			claimed[to] = true
+			continue
+		}
+		if reason := taken(to, claimed); reason != "" {
+			if opts.OnConflict != SuffixConflicts {
+				skips = append(skips, Skip{Path: from, Reason: reason})
+				continue
+			}
+			numbered := book
+			for n := 2; taken(to, claimed) != ""; n++ {
+				numbered.Title = fmt.Sprintf("%s (%d)", book.Title, n)
+				to = filepath.Join(opts.Dest, tmpl.Path(numbered, ext))
+			}
+			claimed[to] = true
+			moves = append(moves, Move{From: from, To: to, Renamed: true})
+			continue
+		}
+		claimed[to] = true
+		moves = append(moves, Move{From: from, To: to})
+	}
+	return moves, skips, nil
+}
+
+// taken says why a destination can't be used, or returns "" if it can.
+func taken(to string, claimed map[string]bool) string {
+	if claimed[to] {
+		return "another book has the same title"
+	}
+	if _, err := os.Stat(to); err == nil {
+		return "destination already exists"
+	}
+	return ""
+}
+
+// Apply carries out a move, creating the book's folders, and returns the
+// folders it had to create, outermost first. It refuses to replace an
+// existing file.
+func Apply(m Move) ([]string, error) {
+	return move(m.From, m.To)
+}
+
+// Undo moves a book back to where it was before m, and removes the
+// folders Apply created for it that are now empty. It refuses to replace
+// an existing file.
+func Undo(m Move, createdDirs []string) error {
+	if _, err := move(m.To, m.From); err != nil {
+		return err
+	}
+	removeDirs(createdDirs)
+	return nil
+}
+
+// RemoveEmptyDirs removes the folder path was in, and its parents up to
+// but not including root, while they are empty.
+func RemoveEmptyDirs(root, path string) {
+	for dir := filepath.Dir(path); dir != root && strings.HasPrefix(dir, root+string(filepath.Separator)); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			return
+		}
+	}
+}
+
+// removeDirs removes dirs, innermost first. Folders that something else
+// has been put in since are kept.
+func removeDirs(dirs []string) {
+	for i := len(dirs) - 1; i >= 0; i-- {
+		_ = os.Remove(dirs[i])
+	}
+}
+
+func move(from, to string) ([]string, error) {
+	var created []string
+	for dir := filepath.Dir(to); ; dir = filepath.Dir(dir) {
+		if _, err := os.Stat(dir); !errors.Is(err, os.ErrNotExist) || dir == filepath.Dir(dir) {
+			break
+		}
+		created = append([]string{dir}, created...)
+	}
+	if err := os.MkdirAll(filepath.Dir(to), 0o755); err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(to); err == nil {
+		return nil, fmt.Errorf("%s: %w", to, os.ErrExist)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err := os.Rename(from, to); err != nil {
+		removeDirs(created)
+		return nil, err
+	}
+	return created, nil
+}
+
+// SafeName turns a title into a file or folder name that is valid on Linux
+// and Windows: a subtitle's ": " becomes " - ", other characters those
+// reject become "-", and leading and trailing spaces and dots are dropped.
+func SafeName(title string) string {
+	name := strings.Map(func(r rune) rune {
+		if r < 0x20 || strings.ContainsRune(`<>:"/\|?*`, r) {
+			return '-'
+		}
+		return r
+	}, strings.ReplaceAll(title, ": ", " - "))
+	return strings.Trim(name, " .")
+}
@@ -0,0 +1,91 @@
+package organize
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Placer moves books into a library's layout as they are added to it, for
+// ORGANIZE_ON_IMPORT. Its moves are journaled in the library root, one
+// journal per Placer, so gopds organize -undo can put them back.
+type Placer struct {
+	opts Options
+
+	mu      sync.Mutex
+	journal *Journal
+}
+
+// NewPlacer returns a Placer for the library at dir, laid out by tmpl.
+func NewPlacer(dir string, tmpl *Template) *Placer {
+	if real, err := filepath.EvalSymlinks(dir); err == nil {
+		dir = real
+	}
+	return &Placer{opts: Options{Dest: dir, Template: tmpl}}
+}
+
+// PlacerFromEnv returns a Placer for the library at dir laid out by
+// ORGANIZE_TEMPLATE, or nil if ORGANIZE_ON_IMPORT is not true.
+func PlacerFromEnv(dir string) (*Placer, error) {
+	if strings.TrimSpace(os.Getenv("ORGANIZE_ON_IMPORT")) != "true" {
+		return nil, nil
+	}
+	tmpl, err := ParseTemplate(os.Getenv("ORGANIZE_TEMPLATE"))
+	if err != nil {
+		return nil, err
+	}
+	return NewPlacer(dir, tmpl), nil
+}
+
+// Place moves the EPUB at path to where the template puts it, and returns
+// its new path. A book already in place is left alone. A book that can't
+// be moved, because its title can't be read or its destination is taken,
+// stays where it is, and the error says why.
+func (p *Placer) Place(path string) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	moves, skips, err := PlanFiles([]string{path}, p.opts)
+	if err != nil {
+		return path, err
+	}
+	if len(skips) > 0 {
+		return path, errors.New(skips[0].Reason)
+	}
+	if len(moves) == 0 {
+		return path, nil
+	}
+	m := moves[0]
+	if p.journal == nil {
+		if p.journal, err = CreateJournal(JournalName(p.opts.Dest, time.Now())); err != nil {
+			return path, err
+		}
+	}
+	createdDirs, err := Apply(m)
+	if err != nil {
+		return path, err
+	}
+	if err := p.journal.Record(m, createdDirs); err != nil {
+		// Only moves that can be undone are kept.
+		if undoErr := Undo(m, createdDirs); undoErr != nil {
+			return m.To, nil
+		}
+		return path, err
+	}
+	RemoveEmptyDirs(p.opts.Dest, m.From)
+	return m.To, nil
+}
+
+// Close closes the journal, removing it if nothing was moved.
+func (p *Placer) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.journal == nil {
+		return nil
+	}
+	err := p.journal.Close()
+	p.journal = nil
+	return err
+}
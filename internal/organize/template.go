@@ -0,0 +1,234 @@
+package organize
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/ab0oo/gopds/internal/database"
+	"github.com/ab0oo/gopds/internal/scanner"
+)
+
+// DefaultTemplate puts each book in a folder named after its title.
+const DefaultTemplate = "{title}/{title}.epub"
+
+// maxSegment is the longest folder or file name a template produces, in
+// bytes. Most filesystems allow 255; the margin leaves room for " (2)"
+// suffixes and keeps whole paths well inside Windows shares' limits.
+const maxSegment = 150
+
+// fields are the placeholders a template can use.
+var fields = map[string]func(Book) string{
+	"title":        func(b Book) string { return b.Title },
+	"author":       func(b Book) string { return b.Author },
+	"author_sort":  func(b Book) string { return b.AuthorSort },
+	"series":       func(b Book) string { return b.Series },
+	"series_index": func(b Book) string { return b.SeriesIndex },
+	"year":         func(b Book) string { return b.Year },
+	"language":     func(b Book) string { return b.Language },
+	"publisher":    func(b Book) string { return b.Publisher },
+}
+
+var placeholder = regexp.MustCompile(`\{([a-z_]+)\}`)
+
+// Book is the metadata a template is filled from.
+type Book struct {
+	Title       string
+	Author      string
+	AuthorSort  string
+	Series      string
+	SeriesIndex string
+	Year        string
+	Language    string
+	Publisher   string
+}
+
+var yearPattern = regexp.MustCompile(`\b(\d{4})\b`)
+
+// BookFromMetadata fills a Book from an EPUB's metadata. Books without an
+// author are filed under "Unknown Author", and the sort name falls back
+// to "Last, First" built from the author.
+func BookFromMetadata(meta *scanner.EPUBMetadata) Book {
+	b := Book{
+		Title:       strings.TrimSpace(meta.Title),
+		Author:      strings.TrimSpace(meta.Author),
+		AuthorSort:  strings.TrimSpace(meta.AuthorSort),
+		Series:      strings.TrimSpace(meta.Series),
+		SeriesIndex: formatSeriesIndex(meta.SeriesIndex),
+		Language:    strings.TrimSpace(meta.Language),
+		Publisher:   strings.TrimSpace(meta.Publisher),
+	}
+	if m := yearPattern.FindStringSubmatch(meta.Date); m != nil {
+		b.Year = m[1]
+	}
+	if b.Author == "" {
+		b.Author = "Unknown Author"
+	}
+	if b.AuthorSort == "" {
+		b.AuthorSort = sortName(b.Author)
+	}
+	return b
+}
+
+// BookFromRecord fills a Book from a library record, as BookFromMetadata
+// does from the EPUB. The year, language, and publisher aren't stored in
+// the library, so they stay empty.
+func BookFromRecord(r database.Book) Book {
+	b := Book{
+		Title:       strings.TrimSpace(r.Title),
+		Author:      strings.TrimSpace(r.Author),
+		Series:      strings.TrimSpace(r.Series),
+		SeriesIndex: formatSeriesIndex(r.SeriesIndex),
+	}
+	if b.Author == "" {
+		b.Author = "Unknown Author"
+	}
+	b.AuthorSort = sortName(b.Author)
+	return b
+}
+
+// formatSeriesIndex drops the ".0" calibre writes after whole numbers.
+func formatSeriesIndex(raw string) string {
+	raw = strings.TrimSpace(raw)
+	if f, err := strconv.ParseFloat(raw, 64); err == nil {
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	return raw
+}
+
+// sortName turns "Ursula K. Le Guin" into "Le Guin, Ursula K." for the
+// common particles, and "Anne McCaffrey" into "McCaffrey, Anne". Names
+// that already have a comma, or are a single word, are kept.
+func sortName(name string) string {
+	if strings.Contains(name, ",") {
+		return name
+	}
+	words := strings.Fields(name)
+	if len(words) < 2 {
+		return name
+	}
+	last := len(words) - 1
+	switch strings.ToLower(strings.TrimSuffix(words[last], ".")) {
+	case "jr", "sr", "ii", "iii", "iv":
+		if last > 1 {
+			last--
+		}
+	}
+	for last > 1 {
+		switch strings.ToLower(words[last-1]) {
+		case "le", "la", "de", "du", "van", "von", "der", "den", "di", "da", "del":
+			last--
+			continue
+		}
+		break
+	}
+	return strings.Join(words[last:], " ") + ", " + strings.Join(words[:last], " ")
+}
+
+// Template builds a book's path, relative to the organized folder, from
+// its metadata.
+type Template struct {
+	segments []string
+}
+
+// ParseTemplate checks a template such as
+// "{author_sort}/{series}/{series_index} - {title}.epub". It must use
+// {title}, so that no two books share a path merely for lack of one, and
+// only the known placeholders. A template whose file name doesn't end in
+// .epub gets the book's own extension.
+func ParseTemplate(s string) (*Template, error) {
+	s = strings.TrimSpace(filepath.ToSlash(s))
+	if s == "" {
+		s = DefaultTemplate
+	}
+	for _, m := range placeholder.FindAllStringSubmatch(s, -1) {
+		if _, ok := fields[m[1]]; !ok {
+			return nil, fmt.Errorf("template %q: unknown placeholder {%s}", s, m[1])
+		}
+	}
+	if !strings.Contains(s, "{title}") {
+		return nil, fmt.Errorf("template %q: must use {title}", s)
+	}
+	if strings.HasPrefix(s, "/") || strings.Contains("/"+s+"/", "/../") {
+		return nil, fmt.Errorf("template %q: must stay inside the folder", s)
+	}
+	t := &Template{}
+	for _, seg := range strings.Split(s, "/") {
+		if seg != "" && seg != "." {
+			t.segments = append(t.segments, seg)
+		}
+	}
+	return t, nil
+}
+
+// ParseFileTemplate parses a template that names a single file, such as a
+// download, rather than a path in the library: it can't contain folders,
+// and a trailing .epub is dropped because the caller picks the extension.
+func ParseFileTemplate(s string) (*Template, error) {
+	s = strings.TrimSpace(s)
+	if strings.HasSuffix(strings.ToLower(s), ".epub") {
+		s = s[:len(s)-len(".epub")]
+	}
+	if strings.ContainsAny(s, `/\`) {
+		return nil, fmt.Errorf("template %q: must not contain folders", s)
+	}
+	return ParseTemplate(s)
+}
+
+// Path fills in the template for b. Placeholders are made safe for file
+// names; a folder that comes out empty, such as {series} for a book not
+// in one, is dropped, and separators left dangling by an empty
+// placeholder ("{series_index} - {title}") are trimmed. ext is used when
+// the template's file name has no .epub extension.
+func (t *Template) Path(b Book, ext string) string {
+	parts := make([]string, 0, len(t.segments))
+	for i, seg := range t.segments {
+		file := i == len(t.segments)-1
+		if file && strings.HasSuffix(strings.ToLower(seg), ".epub") {
+			ext = seg[len(seg)-len(".epub"):]
+			seg = seg[:len(seg)-len(".epub")]
+		}
+		name := placeholder.ReplaceAllStringFunc(seg, func(m string) string {
+			return SafeName(fields[m[1:len(m)-1]](b))
+		})
+		name = truncate(trimSeparators(SafeName(name)), maxSegment)
+		if file {
+			if name == "" {
+				name = truncate(SafeName(b.Title), maxSegment)
+			}
+			name += ext
+		}
+		if name != "" {
+			parts = append(parts, name)
+		}
+	}
+	return filepath.Join(parts...)
+}
+
+// trimSeparators drops what an empty placeholder leaves behind: empty
+// brackets, doubled spaces and " - " separators, and punctuation at
+// either end.
+func trimSeparators(s string) string {
+	s = strings.NewReplacer("()", "", "[]", "").Replace(s)
+	s = strings.Join(strings.Fields(s), " ")
+	for strings.Contains(s, " - - ") {
+		s = strings.ReplaceAll(s, " - - ", " - ")
+	}
+	return strings.Trim(s, " -_.,;")
+}
+
+// truncate shortens s to at most n bytes without splitting a character,
+// then drops trailing spaces and dots, which Windows rejects.
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	s = s[:n]
+	for !utf8.ValidString(s) {
+		s = s[:len(s)-1]
+	}
+	return strings.TrimRight(s, " .")
+}
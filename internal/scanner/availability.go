@@ -0,0 +1,58 @@
+package scanner
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/ab0oo/gopds/internal/database"
+	"github.com/ab0oo/gopds/internal/storage"
+)
+
+// ErrLibraryUnavailable means a library root can't be read, usually
+// because the network share it lives on is down. Scans don't run against
+// it, so books aren't dropped or re-added while it is away.
+var ErrLibraryUnavailable = errors.New("library is unavailable")
+
+// CheckLibrary reports whether the local library root can be read. A root
+// that reads as empty although books were indexed from it counts as
+// unavailable too: that is what the mount point of an unmounted share
+// looks like. Remote libraries report their own errors as they are walked,
+// so they always pass.
+func CheckLibrary(db *database.DB, root string) error {
+	if storage.IsRemote(root) {
+		return nil
+	}
+	dir, err := os.Open(root)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrLibraryUnavailable, err)
+	}
+	defer dir.Close()
+	info, err := dir.Stat()
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrLibraryUnavailable, err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%w: %s is not a directory", ErrLibraryUnavailable, root)
+	}
+	if _, err := dir.Readdirnames(1); err == nil {
+		return nil
+	} else if !errors.Is(err, io.EOF) {
+		return fmt.Errorf("%w: %v", ErrLibraryUnavailable, err)
+	}
+
+	indexed := root
+	if real, err := filepath.EvalSymlinks(root); err == nil {
+		indexed = real
+	}
+	n, err := db.CountBooksUnder(indexed)
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return fmt.Errorf("%w: %s is empty but %d books were indexed from it; is the share mounted?", ErrLibraryUnavailable, root, n)
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package scanner
+
+import (
+	"context"
+	"log/slog"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// coverJob asks for one book's cover to be extracted into the cache.
+type coverJob struct {
+	path   string
+	bookID int
+}
+
+// coverQueue extracts covers on worker goroutines while the scan goes on
+// indexing metadata, so decoding images doesn't hold up the catalog. Jobs
+// are queued only once their book is committed: a book ID from a batch
+// that was rolled back could be reused, and would then show the wrong
+// cover.
+type coverQueue struct {
+	jobs    chan coverJob
+	wg      sync.WaitGroup
+	missing atomic.Int64
+}
+
+// startCoverQueue starts CoverWorkers workers. The queue holds up to depth
+// jobs; beyond that, queueing blocks until a worker catches up.
+func (s *Scanner) startCoverQueue(ctx context.Context, depth int) *coverQueue {
+	workers := s.CoverWorkers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	q := &coverQueue{jobs: make(chan coverJob, depth)}
+	for range workers {
+		q.wg.Add(1)
+		go func() {
+			defer q.wg.Done()
+			for job := range q.jobs {
+				release, err := s.limits.open(ctx)
+				if err != nil {
+					// Cancelled: finish still drains the queue, but
+					// without limits.
+					release = func() {}
+				}
+				err = SaveCover(job.path, job.bookID)
+				release()
+				if err != nil {
+					q.missing.Add(1)
+					slog.DebugContext(ctx, "scan: no cover extracted", "path", job.path, "book_id", job.bookID, "err", err)
+				}
+				if err := s.db.CoverDone(job.bookID); err != nil {
+					slog.WarnContext(ctx, "scan: failed to clear pending cover", "book_id", job.bookID, "err", err)
+				}
+			}
+		}()
+	}
+	return q
+}
+
+func (q *coverQueue) add(job coverJob) {
+	q.jobs <- job
+}
+
+// finish waits for every queued cover, even after the scan is cancelled:
+// their books are committed and a later scan won't revisit them. It
+// returns how many books had no cover to extract.
+func (q *coverQueue) finish() int {
+	close(q.jobs)
+	q.wg.Wait()
+	return int(q.missing.Load())
+}
+
+// requeuePending queues the covers a previous run committed but never
+// extracted, typically because it crashed or was killed first.
+func (s *Scanner) requeuePending(ctx context.Context, q *coverQueue) error {
+	pending, err := s.db.PendingCovers()
+	if err != nil {
+		return err
+	}
+	if len(pending) > 0 {
+		slog.InfoContext(ctx, "scan: extracting covers left pending by an earlier run", "books", len(pending))
+	}
+	for _, c := range pending {
+		q.add(coverJob{path: c.Path, bookID: c.BookID})
+	}
+	return nil
+}
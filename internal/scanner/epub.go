@@ -0,0 +1,500 @@
+package scanner
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ab0oo/gopds/internal/imaging"
+	"github.com/ab0oo/gopds/internal/storage"
+)
+
+var errNoPackage = errors.New("opf package document not found")
+
+// EPUB is an EPUB file opened once, so a request or a scan can read its
+// metadata, list its images, and rewrite its cover without reopening the
+// archive or re-parsing the package document each time. It is not safe
+// for concurrent use.
+type EPUB struct {
+	path    string
+	zr      *zip.Reader
+	closer  io.Closer
+	loaded  bool
+	opfPath string
+	opfRaw  []byte
+	opfErr  error
+	opf     *OPF
+}
+
+// OpenEPUB opens the EPUB at path, which may be in a remote library.
+// Close it when done.
+func OpenEPUB(path string) (*EPUB, error) {
+	zr, f, err := openZip(path)
+	if err != nil {
+		return nil, err
+	}
+	return &EPUB{path: path, zr: zr, closer: f}, nil
+}
+
+// openZip opens the archive at path through storage, so remote books are
+// read in ranges rather than downloaded whole.
+func openZip(path string) (*zip.Reader, io.Closer, error) {
+	f, err := storage.Open(context.Background(), path)
+	if err != nil {
+		return nil, nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	zr, err := zip.NewReader(f, info.Size())
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return zr, f, nil
+}
+
+// Close closes the archive.
+func (e *EPUB) Close() error {
+	return e.closer.Close()
+}
+
+// Path is the file the EPUB was opened from.
+func (e *EPUB) Path() string {
+	return e.path
+}
+
+// bytesPerPage is how much XHTML, markup included, makes about one
+// printed page.
+const bytesPerPage = 2000
+
+// EstimatedPages guesses the book's length in printed pages from the
+// uncompressed size of its content documents, which the archive's
+// directory records, so nothing is decompressed.
+func (e *EPUB) EstimatedPages() int {
+	var total uint64
+	for _, f := range e.zr.File {
+		switch strings.ToLower(filepath.Ext(f.Name)) {
+		case ".xhtml", ".html", ".htm":
+			total += f.UncompressedSize64
+		}
+	}
+	return max(1, int(total/bytesPerPage))
+}
+
+// packageDocument returns the package document's path in the archive and
+// its content, read on first use. The path is "" if the EPUB names none.
+func (e *EPUB) packageDocument() (string, []byte, error) {
+	if !e.loaded {
+		e.loaded = true
+		e.opfPath, e.opfErr = findOPFPath(e.zr.File)
+		if e.opfErr == nil && e.opfPath != "" {
+			e.opfRaw, e.opfErr = readZipEntry(e.zr.File, e.opfPath)
+		}
+	}
+	return e.opfPath, e.opfRaw, e.opfErr
+}
+
+// Package returns the parsed package document and its path in the archive.
+// The result is shared by later calls and must not be modified.
+func (e *EPUB) Package() (*OPF, string, error) {
+	opfPath, raw, err := e.packageDocument()
+	if err != nil {
+		return nil, "", err
+	}
+	if opfPath == "" {
+		return nil, "", errNoPackage
+	}
+	if e.opf == nil {
+		var opf OPF
+		if err := xml.Unmarshal(raw, &opf); err != nil {
+			return nil, "", err
+		}
+		e.opf = &opf
+	}
+	return e.opf, opfPath, nil
+}
+
+// Metadata returns the package document with its subjects cleaned up, as
+// the scanner indexes it, or nil if the EPUB has none.
+func (e *EPUB) Metadata() (*OPF, error) {
+	pkg, _, err := e.Package()
+	if errors.Is(err, errNoPackage) || errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	opf := *pkg
+	if len(opf.Subjects) == 0 {
+		_, raw, _ := e.packageDocument()
+		if metaBlock, err := extractMetadataBlock(raw); err == nil {
+			opf.Subjects = extractAllTagValues(metaBlock, "subject")
+		}
+	} else {
+		opf.Subjects = normalizeSubjectList(opf.Subjects)
+	}
+	return &opf, nil
+}
+
+// LiveMetadata reads the metadata fields the editor shows.
+func (e *EPUB) LiveMetadata() (*EPUBMetadata, error) {
+	opfPath, opfContent, err := e.packageDocument()
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, errNoPackage
+		}
+		return nil, err
+	}
+	if opfPath == "" {
+		return nil, errNoPackage
+	}
+
+	metaBlock, err := extractMetadataBlock(opfContent)
+	if err != nil {
+		return nil, err
+	}
+
+	subjects := extractAllTagValues(metaBlock, "subject")
+	identifier := extractPreferredIdentifier(metaBlock)
+
+	return &EPUBMetadata{
+		Title:       extractFirstTagValue(metaBlock, "title"),
+		Author:      extractFirstTagValue(metaBlock, "creator"),
+		AuthorSort:  extractCreatorFileAs(metaBlock),
+		Language:    extractFirstTagValue(metaBlock, "language"),
+		Identifier:  identifier,
+		Publisher:   extractFirstTagValue(metaBlock, "publisher"),
+		Date:        extractFirstTagValue(metaBlock, "date"),
+		Description: extractFirstTagValue(metaBlock, "description"),
+		Subjects:    subjects,
+		Series:      extractMetaContentByName(metaBlock, "calibre:series"),
+		SeriesIndex: extractMetaContentByName(metaBlock, "calibre:series_index"),
+	}, nil
+}
+
+// CoverOptions lists the manifest's JPEG and PNG images that could serve
+// as the cover, only those shaped like one when there are any.
+func (e *EPUB) CoverOptions() ([]CoverOption, error) {
+	opf, opfPath, err := e.Package()
+	if err != nil {
+		return nil, err
+	}
+
+	opfDir := filepath.Dir(opfPath)
+	currentCoverPath := detectCurrentCoverZipPath(*opf, opfDir)
+
+	all := make([]CoverOption, 0, 12)
+	suitable := make([]CoverOption, 0, 8)
+
+	for _, item := range opf.Manifest {
+		mt := strings.ToLower(strings.TrimSpace(item.MediaType))
+		if mt != "image/jpeg" && mt != "image/jpg" && mt != "image/png" {
+			continue
+		}
+		zipPath := normalizeZipPath(filepath.Join(opfDir, item.Href))
+		if zipPath == "" {
+			continue
+		}
+
+		f := e.file(zipPath)
+		if f == nil {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			continue
+		}
+		cfg, _, err := imaging.Config(rc)
+		rc.Close()
+		if err != nil {
+			continue
+		}
+
+		opt := CoverOption{
+			ZipPath:   zipPath,
+			Name:      filepath.Base(zipPath),
+			MediaType: mt,
+			Width:     cfg.Width,
+			Height:    cfg.Height,
+			IsCurrent: zipPath == currentCoverPath,
+		}
+		all = append(all, opt)
+		if isSuitableCoverDimension(cfg.Width, cfg.Height) {
+			suitable = append(suitable, opt)
+		}
+	}
+
+	if len(suitable) > 0 {
+		return suitable, nil
+	}
+	return all, nil
+}
+
+// file returns the archive entry at zipPath, compared after normalizing
+// both, or nil.
+func (e *EPUB) file(zipPath string) *zip.File {
+	target := normalizeZipPath(zipPath)
+	for _, f := range e.zr.File {
+		if normalizeZipPath(f.Name) == target {
+			return f
+		}
+	}
+	return nil
+}
+
+// ReadCoverOption returns an image from the archive and its media type.
+func (e *EPUB) ReadCoverOption(zipPath string) ([]byte, string, error) {
+	normalized := normalizeZipPath(zipPath)
+	if normalized == "" {
+		return nil, "", fmt.Errorf("invalid cover path")
+	}
+	f := e.file(normalized)
+	if f == nil {
+		return nil, "", os.ErrNotExist
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return nil, "", err
+	}
+	defer rc.Close()
+	b, err := io.ReadAll(rc)
+	if err != nil {
+		return nil, "", err
+	}
+	return b, mediaTypeFromPath(f.Name), nil
+}
+
+// SaveCover caches the book's cover for bookID: a cover.jpg beside the
+// EPUB if there is one, otherwise the best-named image inside it or the
+// one its package document marks as the cover.
+func (e *EPUB) SaveCover(bookID int) error {
+	if local := siblingCover(e.path); local != "" {
+		return saveExternalCover(local, bookID)
+	}
+
+	for _, f := range e.zr.File {
+		if isPreferredCoverFilename(f.Name) {
+			return extractZipFile(f, bookID)
+		}
+	}
+
+	for _, f := range e.zr.File {
+		low := strings.ToLower(f.Name)
+		if (strings.Contains(low, "cover") || strings.Contains(low, "folder")) &&
+			(strings.HasSuffix(low, ".jpg") || strings.HasSuffix(low, ".jpeg") || strings.HasSuffix(low, ".png")) {
+			return extractZipFile(f, bookID)
+		}
+	}
+
+	if opf, opfPath, err := e.Package(); err == nil {
+		var coverHref string
+		for _, item := range opf.Manifest {
+			if strings.Contains(item.Properties, "cover-image") {
+				coverHref = item.Href
+				break
+			}
+		}
+		if coverHref == "" {
+			if coverID := opf.MetaContent("cover"); coverID != "" {
+				for _, item := range opf.Manifest {
+					if item.ID == coverID {
+						coverHref = item.Href
+						break
+					}
+				}
+			}
+		}
+
+		if coverHref != "" {
+			baseDir := filepath.Dir(opfPath)
+			fullCoverPath := filepath.ToSlash(filepath.Join(baseDir, coverHref))
+			for _, f := range e.zr.File {
+				if f.Name == fullCoverPath || f.Name == coverHref {
+					return extractZipFile(f, bookID)
+				}
+			}
+		}
+	}
+
+	return fmt.Errorf("no cover found for %s", e.path)
+}
+
+// WriteCover makes the image at selectedZipPath the EPUB's cover,
+// re-encoded as a JPEG at the canonical cover.jpg next to the package
+// document. The file is rewritten and reopened.
+func (e *EPUB) WriteCover(selectedZipPath string) error {
+	selectedRaw, err := readZipEntry(e.zr.File, normalizeZipPath(selectedZipPath))
+	if err != nil {
+		return err
+	}
+	img, _, err := imaging.Decode(selectedRaw)
+	if err != nil {
+		return fmt.Errorf("selected cover decode failed: %w", err)
+	}
+	return e.writeCoverImage(img)
+}
+
+// WriteCoverBytes is WriteCover for an image from outside the EPUB.
+func (e *EPUB) WriteCoverBytes(imageBytes []byte) error {
+	img, _, err := imaging.Decode(imageBytes)
+	if err != nil {
+		return fmt.Errorf("remote cover decode failed: %w", err)
+	}
+	return e.writeCoverImage(img)
+}
+
+func (e *EPUB) writeCoverImage(img image.Image) error {
+	pkg, opfPath, err := e.Package()
+	if err != nil {
+		return err
+	}
+	_, opfContent, _ := e.packageDocument()
+	opfDir := filepath.Dir(opfPath)
+	canonicalCoverPath := normalizeZipPath(filepath.Join(opfDir, "cover.jpg"))
+	canonicalHref := relativeHrefFromOPFDir(opfDir, canonicalCoverPath)
+	updatedOPF, err := rewriteOPFCoverReference(opfContent, canonicalHref)
+	if err != nil {
+		return err
+	}
+	rewritten, err := encodeImageForMediaType(img, "image/jpeg", canonicalCoverPath)
+	if err != nil {
+		return err
+	}
+	if err := e.rewriteWithCover(opfPath, *pkg, opfDir, updatedOPF, rewritten); err != nil {
+		return err
+	}
+	return e.reopen()
+}
+
+// reopen reads the EPUB again after it has been rewritten.
+func (e *EPUB) reopen() error {
+	zr, f, err := openZip(e.path)
+	if err != nil {
+		return err
+	}
+	e.closer.Close()
+	*e = EPUB{path: e.path, zr: zr, closer: f}
+	return nil
+}
+
+// rewriteWithCover replaces the EPUB with a copy holding updatedOPF as its
+// package document and rewritten as its only cover image.
+func (e *EPUB) rewriteWithCover(opfPath string, opf OPF, opfDir string, updatedOPF []byte, rewritten []byte) error {
+	if storage.IsRemote(e.path) {
+		return storage.ErrReadOnly
+	}
+	canonicalCoverPath := normalizeZipPath(filepath.Join(opfDir, "cover.jpg"))
+
+	tempFile, err := os.CreateTemp(filepath.Dir(e.path), ".gopds-cover-*.epub")
+	if err != nil {
+		return err
+	}
+	tempPath := tempFile.Name()
+	cleanupTemp := true
+	defer func() {
+		_ = tempFile.Close()
+		if cleanupTemp {
+			_ = os.Remove(tempPath)
+		}
+	}()
+
+	writer := zip.NewWriter(tempFile)
+	removePaths := collectExistingCoverPaths(opf, opfDir)
+	delete(removePaths, canonicalCoverPath)
+
+	wroteCover := false
+	wroteOPF := false
+	for _, f := range e.zr.File {
+		normalized := normalizeZipPath(f.Name)
+
+		if normalized == normalizeZipPath(opfPath) {
+			h := f.FileHeader
+			dst, err := writer.CreateHeader(&h)
+			if err != nil {
+				_ = writer.Close()
+				return err
+			}
+			if _, err := dst.Write(updatedOPF); err != nil {
+				_ = writer.Close()
+				return err
+			}
+			wroteOPF = true
+			continue
+		}
+
+		if normalized == canonicalCoverPath {
+			h := f.FileHeader
+			dst, err := writer.CreateHeader(&h)
+			if err != nil {
+				_ = writer.Close()
+				return err
+			}
+			if _, err := dst.Write(rewritten); err != nil {
+				_ = writer.Close()
+				return err
+			}
+			wroteCover = true
+			continue
+		}
+
+		if _, drop := removePaths[normalized]; drop {
+			continue
+		}
+
+		h := f.FileHeader
+		dst, err := writer.CreateHeader(&h)
+		if err != nil {
+			_ = writer.Close()
+			return err
+		}
+		src, err := f.Open()
+		if err != nil {
+			_ = writer.Close()
+			return err
+		}
+		if _, err := io.Copy(dst, src); err != nil {
+			src.Close()
+			_ = writer.Close()
+			return err
+		}
+		src.Close()
+	}
+
+	if !wroteOPF {
+		_ = writer.Close()
+		return fmt.Errorf("opf package document missing during rewrite")
+	}
+	if !wroteCover {
+		dst, err := writer.Create(canonicalCoverPath)
+		if err != nil {
+			_ = writer.Close()
+			return err
+		}
+		if _, err := dst.Write(rewritten); err != nil {
+			_ = writer.Close()
+			return err
+		}
+	}
+
+	if err := writer.Close(); err != nil {
+		return err
+	}
+	if err := tempFile.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tempPath, e.path); err != nil {
+		return err
+	}
+	cleanupTemp = false
+	return nil
+}
@@ -0,0 +1,76 @@
+package scanner
+
+import "strings"
+
+// ISBN returns the book's ISBN from its dc:identifier entries, or "" if
+// none holds a valid one. Identifiers marked as ISBNs are tried first;
+// after them, any identifier whose digits check out as an ISBN counts, as
+// many tools write a bare ISBN without a scheme.
+func (o *OPF) ISBN() string {
+	for _, marked := range []bool{true, false} {
+		for _, id := range o.Identifiers {
+			isISBN := strings.EqualFold(strings.TrimSpace(id.Scheme), "isbn") || strings.Contains(strings.ToLower(id.Value), "isbn")
+			if isISBN != marked {
+				continue
+			}
+			if v := ParseISBN(id.Value); v != "" {
+				return v
+			}
+		}
+	}
+	return ""
+}
+
+// ParseISBN returns the ISBN-10 or ISBN-13 in an identifier such as
+// "urn:isbn:978-0-261-10328-3", without separators, or "" if it doesn't
+// hold one with a valid check digit.
+func ParseISBN(raw string) string {
+	raw = strings.ToUpper(strings.TrimSpace(raw))
+	raw = strings.TrimPrefix(raw, "URN:")
+	raw = strings.TrimPrefix(raw, "ISBN")
+	raw = strings.TrimLeft(raw, ":= ")
+	var b strings.Builder
+	for _, r := range raw {
+		switch {
+		case r >= '0' && r <= '9', r == 'X':
+			b.WriteRune(r)
+		case r == '-' || r == ' ':
+		default:
+			return ""
+		}
+	}
+	v := b.String()
+	if strings.Contains(strings.TrimSuffix(v, "X"), "X") {
+		return ""
+	}
+	switch len(v) {
+	case 10:
+		sum := 0
+		for i, r := range v {
+			d := int(r - '0')
+			if r == 'X' {
+				d = 10
+			}
+			sum += d * (10 - i)
+		}
+		if sum%11 == 0 {
+			return v
+		}
+	case 13:
+		if v[12] == 'X' {
+			return ""
+		}
+		sum := 0
+		for i, r := range v {
+			d := int(r - '0')
+			if i%2 == 1 {
+				d *= 3
+			}
+			sum += d
+		}
+		if sum%10 == 0 {
+			return v
+		}
+	}
+	return ""
+}
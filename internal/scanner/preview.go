@@ -0,0 +1,325 @@
+package scanner
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"net/url"
+	"path"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// previewChapterMinText is how much text a spine item needs before it
+	// counts as the first chapter rather than a cover, title page, or
+	// table of contents.
+	previewChapterMinText = 1500
+	// previewMaxHTML caps the sanitized output so one huge chapter can't
+	// produce a multi-megabyte response.
+	previewMaxHTML = 512 << 10
+)
+
+// Preview is a sanitized excerpt from the start of a book.
+type Preview struct {
+	HTML string
+	// Sections are the spine hrefs the excerpt was taken from.
+	Sections []string
+	// Percent is the share of the spine's bytes the sections make up.
+	Percent   float64
+	Truncated bool
+}
+
+type spineItem struct {
+	file *zip.File
+	href string
+}
+
+// ExtractPreview returns the start of the book as sanitized HTML. With
+// percent <= 0 it returns the first chapter: the first spine item with a
+// meaningful amount of text. Otherwise it returns leading spine items up to
+// that percentage of the book.
+func ExtractPreview(epubPath string, percent int) (*Preview, error) {
+	reader, f, err := openZip(epubPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	items, err := readSpine(reader.File)
+	if err != nil {
+		return nil, err
+	}
+	if len(items) == 0 {
+		return nil, errors.New("epub has no readable spine items")
+	}
+
+	var total uint64
+	for _, it := range items {
+		total += it.file.UncompressedSize64
+	}
+
+	var chosen []int
+	var sections []string
+	if percent <= 0 {
+		// First chapter: the first item with enough text, or failing that
+		// the first item with any text at all.
+		fallback := -1
+		for i, it := range items {
+			section, textLen, err := sanitizeZipEntry(it.file)
+			if err != nil {
+				return nil, err
+			}
+			if textLen >= previewChapterMinText {
+				chosen, sections = []int{i}, []string{section}
+				break
+			}
+			if fallback < 0 && textLen > 0 {
+				fallback = i
+				sections = []string{section}
+			}
+		}
+		if chosen == nil {
+			if fallback < 0 {
+				return nil, errors.New("epub has no text to preview")
+			}
+			chosen = []int{fallback}
+		}
+	} else {
+		var used uint64
+		for i, it := range items {
+			if i > 0 && used*100 >= total*uint64(percent) {
+				break
+			}
+			section, _, err := sanitizeZipEntry(it.file)
+			if err != nil {
+				return nil, err
+			}
+			chosen = append(chosen, i)
+			sections = append(sections, section)
+			used += it.file.UncompressedSize64
+		}
+	}
+
+	p := &Preview{}
+	var b strings.Builder
+	var used uint64
+	for n, i := range chosen {
+		section := sections[n]
+		if b.Len()+len(section) > previewMaxHTML {
+			section = truncateHTML(section, previewMaxHTML-b.Len())
+			p.Truncated = true
+		}
+		b.WriteString(`<section data-href="` + html.EscapeString(items[i].href) + `">`)
+		b.WriteString(section)
+		b.WriteString("</section>\n")
+		p.Sections = append(p.Sections, items[i].href)
+		used += items[i].file.UncompressedSize64
+		if p.Truncated {
+			break
+		}
+	}
+	p.HTML = b.String()
+	if total > 0 {
+		p.Percent = float64(used) * 100 / float64(total)
+	}
+	return p, nil
+}
+
+func sanitizeZipEntry(f *zip.File) (string, int, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return "", 0, err
+	}
+	defer rc.Close()
+	section, textLen := SanitizeHTML(io.LimitReader(rc, 16<<20))
+	return section, textLen, nil
+}
+
+// readSpine resolves the OPF spine to zip entries in reading order, skipping
+// non-linear items and anything that isn't (X)HTML.
+func readSpine(files []*zip.File) ([]spineItem, error) {
+	opfPath, err := findOPFPath(files)
+	if err != nil {
+		return nil, err
+	}
+	if opfPath == "" {
+		return nil, fmt.Errorf("opf package document not found")
+	}
+	raw, err := readZipEntry(files, opfPath)
+	if err != nil {
+		return nil, err
+	}
+	var opf OPF
+	if err := xml.Unmarshal(raw, &opf); err != nil {
+		return nil, err
+	}
+
+	byName := make(map[string]*zip.File, len(files))
+	for _, f := range files {
+		byName[normalizeZipPath(f.Name)] = f
+	}
+	hrefs := make(map[string]string, len(opf.Manifest))
+	for _, m := range opf.Manifest {
+		mt := strings.ToLower(m.MediaType)
+		if mt == "application/xhtml+xml" || mt == "text/html" {
+			hrefs[m.ID] = m.Href
+		}
+	}
+
+	opfDir := path.Dir(normalizeZipPath(opfPath))
+	items := make([]spineItem, 0, len(opf.Spine))
+	for _, ref := range opf.Spine {
+		if strings.EqualFold(strings.TrimSpace(ref.Linear), "no") {
+			continue
+		}
+		href, ok := hrefs[ref.IDRef]
+		if !ok {
+			continue
+		}
+		if unescaped, err := url.PathUnescape(href); err == nil {
+			href = unescaped
+		}
+		f, ok := byName[normalizeZipPath(path.Join(opfDir, href))]
+		if !ok {
+			continue
+		}
+		items = append(items, spineItem{file: f, href: href})
+	}
+	return items, nil
+}
+
+// Elements kept by SanitizeHTML, without attributes. Anything else is
+// unwrapped: its tags are dropped and its text kept.
+var previewAllowedTags = map[string]bool{
+	"p": true, "br": true, "hr": true, "div": true, "span": true,
+	"h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
+	"em": true, "strong": true, "i": true, "b": true, "u": true, "s": true, "small": true,
+	"sub": true, "sup": true, "blockquote": true, "pre": true, "code": true, "cite": true, "q": true,
+	"ul": true, "ol": true, "li": true, "dl": true, "dt": true, "dd": true,
+	"table": true, "thead": true, "tbody": true, "tr": true, "th": true, "td": true,
+	"section": true, "article": true, "aside": true, "header": true, "footer": true,
+	"figure": true, "figcaption": true, "a": true,
+}
+
+// Elements dropped together with everything inside them.
+var previewDroppedTags = map[string]bool{
+	"head": true, "title": true, "script": true, "style": true, "noscript": true, "template": true,
+	"iframe": true, "object": true, "embed": true, "svg": true, "math": true, "form": true,
+	"button": true, "input": true, "select": true, "textarea": true, "audio": true, "video": true,
+}
+
+var previewVoidTags = map[string]bool{"br": true, "hr": true}
+
+// SanitizeHTML reduces an XHTML document to a safe fragment of its body:
+// only allowlisted elements survive, attributes are stripped (except an
+// absolute http(s) href on links), and scripts, styles, media, and embedded
+// content are removed. It also returns the length of the visible text.
+// Malformed markup ends the fragment early rather than failing.
+func SanitizeHTML(r io.Reader) (string, int) {
+	dec := xml.NewDecoder(r)
+	dec.Strict = false
+	dec.AutoClose = xml.HTMLAutoClose
+	dec.Entity = xml.HTMLEntity
+	dec.CharsetReader = func(_ string, input io.Reader) (io.Reader, error) { return input, nil }
+
+	var b strings.Builder
+	textLen := 0
+	skip := 0
+	var open []string
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			break
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			name := strings.ToLower(t.Name.Local)
+			if skip > 0 || previewDroppedTags[name] {
+				skip++
+				continue
+			}
+			if !previewAllowedTags[name] {
+				continue
+			}
+			b.WriteString("<" + name)
+			if name == "a" {
+				if href := safeLinkHref(t.Attr); href != "" {
+					b.WriteString(` href="` + html.EscapeString(href) + `" rel="noopener noreferrer nofollow" target="_blank"`)
+				}
+			}
+			b.WriteString(">")
+			if !previewVoidTags[name] {
+				open = append(open, name)
+			}
+		case xml.EndElement:
+			name := strings.ToLower(t.Name.Local)
+			if skip > 0 {
+				skip--
+				continue
+			}
+			if !previewAllowedTags[name] || previewVoidTags[name] {
+				continue
+			}
+			// Close back to the matching open tag so the output stays
+			// balanced even if the source wasn't.
+			for i := len(open) - 1; i >= 0; i-- {
+				if open[i] != name {
+					continue
+				}
+				for j := len(open) - 1; j >= i; j-- {
+					b.WriteString("</" + open[j] + ">")
+				}
+				open = open[:i]
+				break
+			}
+		case xml.CharData:
+			if skip > 0 {
+				continue
+			}
+			text := string(t)
+			textLen += len(strings.TrimSpace(text))
+			b.WriteString(html.EscapeString(text))
+		}
+	}
+	for i := len(open) - 1; i >= 0; i-- {
+		b.WriteString("</" + open[i] + ">")
+	}
+	return b.String(), textLen
+}
+
+func safeLinkHref(attrs []xml.Attr) string {
+	for _, a := range attrs {
+		if strings.ToLower(a.Name.Local) != "href" {
+			continue
+		}
+		u, err := url.Parse(strings.TrimSpace(a.Value))
+		if err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "" {
+			return u.String()
+		}
+	}
+	return ""
+}
+
+// truncateHTML cuts s to at most n bytes without splitting a rune or a
+// tag. Elements left open are closed by the browser when the fragment is
+// inserted.
+func truncateHTML(s string, n int) string {
+	if n <= 0 {
+		return ""
+	}
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	s = s[:n]
+	if lt := strings.LastIndexByte(s, '<'); lt > strings.LastIndexByte(s, '>') {
+		s = s[:lt]
+	}
+	return s
+}
@@ -3,6 +3,11 @@ package scanner
 import (
 	"archive/zip"
 	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
 	"encoding/xml"
 	"errors"
 	"fmt"
@@ -12,14 +17,17 @@ import (
 	"image/png"
 	"io"
 	"io/fs"
-	"log"
+	"log/slog"
 	"os"
 	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/ab0oo/gopds/internal/database"
+	"github.com/ab0oo/gopds/internal/imaging"
+	"github.com/ab0oo/gopds/internal/storage"
 )
 
 // EPUB internal XML structures
@@ -34,7 +42,11 @@ type OPF struct {
 	Creator     string   `xml:"metadata>creator"`
 	Description string   `xml:"metadata>description"`
 	Subjects    []string `xml:"metadata>subject"`
-	Meta        []struct {
+	Identifiers []struct {
+		Scheme string `xml:"scheme,attr"`
+		Value  string `xml:",chardata"`
+	} `xml:"metadata>identifier"`
+	Meta []struct {
 		Name    string `xml:"name,attr"`
 		Content string `xml:"content,attr"`
 	} `xml:"metadata>meta"`
@@ -44,11 +56,26 @@ type OPF struct {
 		Properties string `xml:"properties,attr"`
 		MediaType  string `xml:"media-type,attr"`
 	} `xml:"manifest>item"`
+	Spine []struct {
+		IDRef  string `xml:"idref,attr"`
+		Linear string `xml:"linear,attr"`
+	} `xml:"spine>itemref"`
+}
+
+// MetaContent returns the content of the first <meta name="..."> entry.
+func (o *OPF) MetaContent(name string) string {
+	for _, m := range o.Meta {
+		if strings.EqualFold(strings.TrimSpace(m.Name), name) {
+			return strings.TrimSpace(m.Content)
+		}
+	}
+	return ""
 }
 
 type EPUBMetadata struct {
 	Title       string   `json:"title"`
 	Author      string   `json:"author"`
+	AuthorSort  string   `json:"author_sort,omitempty"`
 	Language    string   `json:"language"`
 	Identifier  string   `json:"identifier"`
 	Publisher   string   `json:"publisher"`
@@ -90,80 +117,27 @@ func ErrMetadataTagNotFound() error {
 }
 
 func ExtractMetadata(path string) (*OPF, error) {
-	reader, err := zip.OpenReader(path)
-	if err != nil {
-		return nil, err
-	}
-	defer reader.Close()
-
-	opfPath, err := findOPFPath(reader.File)
+	e, err := OpenEPUB(path)
 	if err != nil {
 		return nil, err
 	}
-	if opfPath == "" {
-		return nil, nil
-	}
-
-	for _, f := range reader.File {
-		if f.Name == opfPath {
-			rc, err := f.Open()
-			if err != nil {
-				return nil, err
-			}
-			defer rc.Close()
-
-			opfContent, err := io.ReadAll(rc)
-			if err != nil {
-				return nil, err
-			}
-
-			var opf OPF
-			if err := xml.Unmarshal(opfContent, &opf); err != nil {
-				return nil, err
-			}
-			if len(opf.Subjects) == 0 {
-				if metaBlock, err := extractMetadataBlock(opfContent); err == nil {
-					opf.Subjects = extractAllTagValues(metaBlock, "subject")
-				}
-			} else {
-				opf.Subjects = normalizeSubjectList(opf.Subjects)
-			}
-			return &opf, nil
-		}
-	}
-
-	return nil, nil
+	defer e.Close()
+	return e.Metadata()
 }
 
 func ExtractLiveMetadata(epubPath string) (*EPUBMetadata, error) {
-	opfContent, _, err := readOPFContent(epubPath)
-	if err != nil {
-		return nil, err
-	}
-
-	metaBlock, err := extractMetadataBlock(opfContent)
+	e, err := OpenEPUB(epubPath)
 	if err != nil {
 		return nil, err
 	}
-
-	subjects := extractAllTagValues(metaBlock, "subject")
-	identifier := extractPreferredIdentifier(metaBlock)
-
-	return &EPUBMetadata{
-		Title:       extractFirstTagValue(metaBlock, "title"),
-		Author:      extractFirstTagValue(metaBlock, "creator"),
-		Language:    extractFirstTagValue(metaBlock, "language"),
-		Identifier:  identifier,
-		Publisher:   extractFirstTagValue(metaBlock, "publisher"),
-		Date:        extractFirstTagValue(metaBlock, "date"),
-		Description: extractFirstTagValue(metaBlock, "description"),
-		Subjects:    subjects,
-		Series:      extractMetaContentByName(metaBlock, "calibre:series"),
-		SeriesIndex: extractMetaContentByName(metaBlock, "calibre:series_index"),
-	}, nil
+	defer e.Close()
+	return e.LiveMetadata()
 }
 
 func UpdateEPUBMetadata(epubPath string, update MetadataUpdate) (*EPUBMetadata, error) {
+	if storage.IsRemote(epubPath) {
+		return nil, storage.ErrReadOnly
+	}
 	reader, err := zip.OpenReader(epubPath)
 	if err != nil {
 		return nil, err
@@ -250,39 +224,6 @@ func UpdateEPUBMetadata(epubPath string, update MetadataUpdate) (*EPUBMetadata,
 	return ExtractLiveMetadata(epubPath)
 }
 
-func readOPFContent(epubPath string) ([]byte, string, error) {
-	reader, err := zip.OpenReader(epubPath)
-	if err != nil {
-		return nil, "", err
-	}
-	defer reader.Close()
-
-	opfPath, err := findOPFPath(reader.File)
-	if err != nil {
-		return nil, "", err
-	}
-	if opfPath == "" {
-		return nil, "", fmt.Errorf("opf package document not found")
-	}
-
-	for _, f := range reader.File {
-		if f.Name == opfPath {
-			rc, err := f.Open()
-			if err != nil {
-				return nil, "", err
-			}
-			defer rc.Close()
-			content, err := io.ReadAll(rc)
-			if err != nil {
-				return nil, "", err
-			}
-			return content, opfPath, nil
-		}
-	}
-
-	return nil, "", fmt.Errorf("opf package document not found")
-}
-
 func findOPFPath(files []*zip.File) (string, error) {
 	for _, f := range files {
 		if f.Name == "META-INF/container.xml" {
@@ -432,6 +373,31 @@ func extractPreferredIdentifier(metadata []byte) string {
 	return first
 }
 
+// extractCreatorFileAs returns the first creator's sort name, from the
+// EPUB 2 opf:file-as attribute or an EPUB 3 file-as meta refining it.
+func extractCreatorFileAs(metadata []byte) string {
+	m := regexp.MustCompile(`(?is)<(?:dc:)?creator\b([^>]*)>`).FindSubmatch(metadata)
+	if m == nil {
+		return ""
+	}
+	attrs := string(m[1])
+	if v := cleanXMLValue(extractAttrValue(attrs, "file-as")); v != "" {
+		return v
+	}
+	id := strings.TrimSpace(extractAttrValue(attrs, "id"))
+	if id == "" {
+		return ""
+	}
+	re := regexp.MustCompile(`(?is)<meta\b([^>]*)>(.*?)</meta>`)
+	for _, meta := range re.FindAllSubmatch(metadata, -1) {
+		attrs := string(meta[1])
+		if strings.EqualFold(extractAttrValue(attrs, "property"), "file-as") && strings.TrimSpace(extractAttrValue(attrs, "refines")) == "#"+id {
+			return cleanXMLValue(string(meta[2]))
+		}
+	}
+	return ""
+}
+
 func extractMetaContentByName(metadata []byte, name string) string {
 	re := regexp.MustCompile(`(?is)<(?:[a-zA-Z_][\w.-]*:)?meta\b([^>]*)/?>`)
 	matches := re.FindAllSubmatch(metadata, -1)
@@ -586,588 +552,833 @@ func xmlEscape(s string) (string, error) {
 
 type Scanner struct {
 	db *database.DB
+
+	// Progress, if set, is called for every EPUB the walk visits with the
+	// running total. It must be cheap; it runs on the scan goroutine.
+	Progress func(found int)
+
+	// Added, if set, is called after each commit with every book that
+	// was not in the library before.
+	Added func(book database.Book)
+
+	// Removed, if set, is called after a full walk with every book whose
+	// file it no longer found.
+	Removed func(book database.Book)
+
+	// Place, if set, is called with each local EPUB that is not in the
+	// library yet, before it is indexed, and returns the path to index it
+	// from, having moved it there; see organize.Placer. On error the book
+	// is indexed where it is.
+	Place func(path string) (string, error)
+
+	// CategorySource is "path", "subject", "auto", or "none". Empty means
+	// CategorySourceFromEnv.
+	CategorySource string
+
+	// Adult, if set, reports whether a book's subjects mark it as adult
+	// content.
+	Adult func(subjects []string) bool
+
+	// BatchSize is how many files a scan indexes per transaction. Zero
+	// means DefaultBatchSize.
+	BatchSize int
+
+	// CoverWorkers is how many covers are extracted at once, alongside the
+	// walk. Zero means one per CPU.
+	CoverWorkers int
+
+	// Throttle limits how fast scans read files.
+	Throttle Throttle
+
+	limits *throttle // Throttle, for the scan in progress
 }
 
+// DefaultBatchSize is the BatchSize used when none is set.
+const DefaultBatchSize = 500
+
 func New(db *database.DB) *Scanner {
 	return &Scanner{db: db}
 }
 
-func (s *Scanner) Start(root string) error {
-	realPath, err := filepath.EvalSymlinks(root)
-	if err != nil {
-		log.Printf("❌ Error resolving symlink %s: %v", root, err)
+// Start indexes every EPUB under root, committing BatchSize files at a
+// time. Log records carry ctx's attributes (request and job IDs). If ctx is
+// cancelled the walk stops early, the books indexed so far are committed,
+// and ctx's error is returned; the next Start of the same root resumes
+// after the last committed file rather than walking it all again. Covers
+// are extracted in the background as batches commit, so books are listed
+// before their covers exist; Start returns once every cover is done. A
+// local root that CheckLibrary finds unavailable isn't walked at all. After
+// a walk that wasn't resumed, books under root whose files it didn't find
+// are marked unavailable rather than removed, and those it found again
+// available.
+func (s *Scanner) Start(ctx context.Context, root string) error {
+	if err := CheckLibrary(s.db, root); err != nil {
+		slog.WarnContext(ctx, "scan: library unavailable, not scanning", "root", root, "err", err)
 		return err
 	}
+	realPath := root
+	if !storage.IsRemote(root) {
+		var err error
+		if realPath, err = filepath.EvalSymlinks(root); err != nil {
+			slog.ErrorContext(ctx, "scan: cannot resolve library root", "root", root, "err", err)
+			return err
+		}
+	}
 
-	log.Printf("🚀 Starting scan of %s (resolved to: %s)...", root, realPath)
+	slog.InfoContext(ctx, "scan: starting", "root", root, "resolved", realPath)
 	start := time.Now()
-	categorySource := resolveCategorySource()
-
-	stats := struct {
-		Total     int
-		Rescanned int
-		NoMeta    int
-		NoCover   int
-	}{}
+	s.limits = newThrottle(s.Throttle)
+	categorySource := s.CategorySource
+	if categorySource == "" {
+		categorySource = CategorySourceFromEnv()
+	}
 
-	tx, err := s.db.Begin()
+	batchSize := s.BatchSize
+	if batchSize <= 0 {
+		batchSize = DefaultBatchSize
+	}
+	resume, err := s.db.ScanResumePoint(realPath)
 	if err != nil {
 		return err
 	}
-	defer func() { _ = tx.Rollback() }()
-
-	err = filepath.WalkDir(realPath, func(path string, d fs.DirEntry, err error) error {
-		if err != nil || d.IsDir() || !strings.HasSuffix(strings.ToLower(d.Name()), ".epub") {
-			return nil
-		}
-
-		stats.Total++
-		info, _ := d.Info()
+	if resume != "" {
+		slog.InfoContext(ctx, "scan: resuming", "root", realPath, "after", resume)
+	}
 
-		if !s.db.NeedsReScan(path, info.ModTime()) {
-			return nil
-		}
-		stats.Rescanned++
+	// A walk from the top sees every file, so afterwards the books it
+	// didn't see can be marked unavailable. A resumed walk skips what the
+	// interrupted one saw and leaves that to the next full scan.
+	var seen map[string]bool
+	if resume == "" {
+		seen = map[string]bool{}
+	}
 
-		meta, err := ExtractMetadata(path)
-		if err != nil || meta == nil || meta.Title == "" {
-			stats.NoMeta++
-			log.Printf("⚠  Metadata missing for %s, using filename.", d.Name())
-			meta = &OPF{
-				Title:   strings.TrimSuffix(d.Name(), filepath.Ext(d.Name())),
-				Creator: "Unknown Author",
-			}
-		}
+	var stats scanStats
+	b := &scanBatch{s: s, root: realPath, source: database.BookSourceScan, size: batchSize, covers: s.startCoverQueue(ctx, batchSize)}
+	defer b.close()
+	if err := s.requeuePending(ctx, b.covers); err != nil {
+		slog.WarnContext(ctx, "scan: failed to read pending covers", "err", err)
+	}
 
-		book := database.Book{
-			Path:        path,
-			Title:       meta.Title,
-			Author:      meta.Creator,
-			Description: meta.Description,
-			ModTime:     info.ModTime(),
-		}
-		switch categorySource {
-		case "path":
-			book.Category, book.Subcategory = categoriesFromPath(realPath, path)
-		case "subject":
-			book.Category, book.Subcategory = categoriesFromSubjects(meta.Subjects)
-		case "auto":
-			book.Category, book.Subcategory = categoriesFromSubjects(meta.Subjects)
-			if book.Category == "" {
-				book.Category, book.Subcategory = categoriesFromPath(realPath, path)
-			}
+	visit := func(path string, info fs.FileInfo) error {
+		if seen != nil {
+			seen[path] = true
 		}
-
-		id, err := s.db.SaveBookTx(tx, book)
-		if err != nil {
-			log.Printf("❌ Error saving book to DB: %v", err)
-			return nil
+		stats.Total++
+		if s.Progress != nil {
+			s.Progress(stats.Total)
 		}
-
-		if err := SaveCover(path, int(id)); err != nil {
-			stats.NoCover++
+		book, _, err := b.index(ctx, realPath, path, info, categorySource, &stats)
+		if seen != nil && book.Path != "" {
+			// Where Place moved it, so the sweep doesn't miss it.
+			seen[book.Path] = true
 		}
-
-		return nil
-	})
+		return err
+	}
+	if storage.IsRemote(realPath) {
+		// Remote libraries list their files in path order, so everything
+		// up to the resume point was committed by the interrupted scan.
+		err = storage.Walk(ctx, realPath, func(path string, info fs.FileInfo) error {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return ctxErr
+			}
+			if (resume != "" && path <= resume) || !strings.HasSuffix(strings.ToLower(path), ".epub") {
+				return nil
+			}
+			return visit(path, info)
+		})
+	} else {
+		err = filepath.WalkDir(realPath, func(path string, d fs.DirEntry, err error) error {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return ctxErr
+			}
+			if resume != "" && !walksAfter(path, resume) {
+				// Committed by the interrupted scan. Directories that hold
+				// the resume point still have to be entered.
+				if d != nil && d.IsDir() && path != realPath && !strings.HasPrefix(resume, path+string(filepath.Separator)) {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if err != nil || d.IsDir() || !strings.HasSuffix(strings.ToLower(d.Name()), ".epub") {
+				return nil
+			}
+			info, _ := d.Info()
+			return visit(path, info)
+		})
+	}
+	if err != nil && ctx.Err() != nil {
+		// Cancelled, usually by shutdown: keep the books indexed so far so
+		// the next scan picks up where this one stopped.
+		if commitErr := b.commit(ctx); commitErr != nil {
+			return commitErr
+		}
+		b.close()
+		slog.WarnContext(ctx, "scan: interrupted, partial progress saved",
+			"duration", time.Since(start).Round(time.Millisecond),
+			"found", stats.Total,
+			"updated", stats.Rescanned,
+			"resume_after", b.last,
+		)
+		return err
+	}
 	if err != nil {
 		return err
 	}
 
-	if err := tx.Commit(); err != nil {
+	if err := b.commit(ctx); err != nil {
+		return err
+	}
+	if err := s.db.ClearScanResumePoint(realPath); err != nil {
 		return err
 	}
+	if seen != nil {
+		gone, back, err := s.db.SweepAvailability(realPath, seen)
+		if err != nil {
+			return err
+		}
+		if len(gone) > 0 || back > 0 {
+			slog.InfoContext(ctx, "scan: book availability changed", "root", realPath, "unavailable", len(gone), "available_again", back)
+		}
+		stats.Gone = len(gone)
+		if s.Removed != nil {
+			for _, id := range gone {
+				if book, err := s.db.GetBookByID(strconv.Itoa(id)); err == nil {
+					s.Removed(*book)
+				}
+			}
+		}
+	}
+	stats.NoCover = b.close()
+	s.backfillPartialMD5(ctx)
+	s.backfillSubjects(ctx)
+	s.backfillISBNs(ctx)
 
-	elapsed := time.Since(start)
-	log.Printf("\n--- 🏁 Scan Complete (%v) ---", elapsed)
-	log.Printf("Total Books Found:  %d", stats.Total)
-	log.Printf("New/Updated:       %d", stats.Rescanned)
-	log.Printf("Missing Metadata:   %d (Used filename instead)", stats.NoMeta)
-	log.Printf("Missing Covers:     %d", stats.NoCover)
-	log.Printf("-------------------------------\n")
+	slog.InfoContext(ctx, "scan: complete",
+		"duration", time.Since(start).Round(time.Millisecond),
+		"found", stats.Total,
+		"updated", stats.Rescanned,
+		"missing_metadata", stats.NoMeta,
+		"missing_covers", stats.NoCover,
+		"gone", stats.Gone,
+	)
 
 	return nil
 }
 
-func isPathCategoryEnabled() bool {
-	raw := strings.ToLower(strings.TrimSpace(os.Getenv("CATEGORY_FROM_PATH")))
-	return raw == "1" || raw == "true" || raw == "yes" || raw == "on"
+// StartAll runs Start over root and then over each remote library. A
+// remote library that fails, or a root that is unavailable, doesn't stop
+// the others; the errors are returned together.
+func (s *Scanner) StartAll(ctx context.Context, root string) error {
+	var errs []error
+	if err := s.Start(ctx, root); err != nil {
+		if !errors.Is(err, ErrLibraryUnavailable) {
+			return err
+		}
+		errs = append(errs, err)
+	}
+	for _, remote := range storage.Roots() {
+		if err := s.Start(ctx, remote); err != nil {
+			if ctx.Err() != nil {
+				return err
+			}
+			slog.ErrorContext(ctx, "scan: remote library failed", "root", remote, "err", err)
+			errs = append(errs, fmt.Errorf("%s: %w", remote, err))
+		}
+	}
+	return errors.Join(errs...)
 }
 
-func isSubjectCategoryEnabled() bool {
-	raw := strings.ToLower(strings.TrimSpace(os.Getenv("CATEGORY_FROM_SUBJECT")))
-	return raw == "1" || raw == "true" || raw == "yes" || raw == "on"
+// scanBatch is the open transaction of a scan that commits every size
+// files. For a walk of root, each commit also records the last file it
+// covers as the scan's resume point, so the two can't disagree after a
+// crash. Covers of the books a batch saved are recorded as pending in the
+// same transaction, and queued once it commits.
+type scanBatch struct {
+	s       *Scanner
+	root    string // "" to record no resume point
+	source  string // recorded for the books the batch adds
+	size    int
+	covers  *coverQueue
+	open    *sql.Tx
+	files   int
+	last    string
+	added   []database.Book
+	saved   []coverJob
+	closed  bool
+	noCover int
 }
 
-func resolveCategorySource() string {
-	source := strings.ToLower(strings.TrimSpace(os.Getenv("CATEGORY_SOURCE")))
-	switch source {
-	case "path", "subject", "auto", "none":
-		return source
-	case "":
-		// Backward compatibility with old toggles.
-		if isSubjectCategoryEnabled() {
-			return "subject"
+// index indexes one file in the open batch, committing the batch when it
+// is full. It returns the book and true if it was not in the library
+// before.
+func (b *scanBatch) index(ctx context.Context, root, path string, info fs.FileInfo, categorySource string, stats *scanStats) (database.Book, bool, error) {
+	walked := path
+	path, info = b.s.place(ctx, root, path, info)
+	// Only files that will be read are paced. The batch is committed
+	// before waiting so the scan doesn't sit on the database's write lock.
+	if b.s.limits.paced() && b.s.db.NeedsReScan(path, info.ModTime()) {
+		if wait := b.s.limits.delay(); wait > 0 {
+			if err := b.commit(ctx); err != nil {
+				return database.Book{}, false, err
+			}
+			if err := sleep(ctx, wait); err != nil {
+				return database.Book{}, false, err
+			}
 		}
-		if isPathCategoryEnabled() {
-			return "path"
+	}
+	tx, err := b.tx()
+	if err != nil {
+		return database.Book{}, false, err
+	}
+	book, isNew := b.s.indexFile(ctx, tx, root, path, info, categorySource, stats)
+	if book.ID != 0 {
+		if err := database.QueueCoverTx(tx, book.ID); err != nil {
+			return database.Book{}, false, err
 		}
-		return "none"
-	default:
-		return "none"
+		b.saved = append(b.saved, coverJob{path: path, bookID: book.ID})
 	}
+	if isNew {
+		if err := database.RecordBookAddedTx(tx, path, b.source); err != nil {
+			slog.WarnContext(ctx, "scan: failed to record book addition", "path", path, "err", err)
+		}
+		b.added = append(b.added, book)
+	}
+	b.last = walked
+	if b.files++; b.files >= b.size {
+		return book, isNew, b.commit(ctx)
+	}
+	return book, isNew, nil
 }
 
-func categoriesFromPath(root, bookPath string) (string, string) {
-	root = filepath.Clean(root)
-	bookPath = filepath.Clean(bookPath)
-	rel, err := filepath.Rel(root, bookPath)
-	if err != nil {
-		return "", ""
+// place hands a local book that isn't in the library yet to s.Place, and
+// returns the path and file info to index it from.
+func (s *Scanner) place(ctx context.Context, root, path string, info fs.FileInfo) (string, fs.FileInfo) {
+	if s.Place == nil || storage.IsRemote(root) {
+		return path, info
 	}
-	dir := filepath.Dir(rel)
-	if dir == "." || dir == string(filepath.Separator) {
-		return "", ""
+	if _, err := s.db.GetBookByPath(path); !errors.Is(err, sql.ErrNoRows) {
+		return path, info
 	}
-	parts := strings.Split(filepath.ToSlash(dir), "/")
-	if len(parts) == 0 {
-		return "", ""
+	to, err := s.Place(path)
+	if err != nil {
+		slog.WarnContext(ctx, "scan: new book not organized", "path", path, "err", err)
 	}
-	category := strings.TrimSpace(parts[0])
-	subcategory := ""
-	if len(parts) > 1 {
-		subcategory = strings.TrimSpace(parts[1])
+	if to == path {
+		return path, info
 	}
-	return category, subcategory
+	moved, err := os.Stat(to)
+	if err != nil {
+		slog.WarnContext(ctx, "scan: organized book not found", "path", to, "err", err)
+		return to, info
+	}
+	slog.InfoContext(ctx, "scan: organized new book", "from", path, "to", to)
+	return to, moved
 }
 
-func categoriesFromSubjects(subjects []string) (string, string) {
-	clean := normalizeSubjectList(subjects)
-	if len(clean) == 0 {
-		return "", ""
+// tx returns the batch's transaction, beginning one if needed.
+func (b *scanBatch) tx() (*sql.Tx, error) {
+	if b.open == nil {
+		tx, err := b.s.db.Begin()
+		if err != nil {
+			return nil, err
+		}
+		b.open = tx
 	}
+	return b.open, nil
+}
 
-	for _, sep := range []string{" > ", ">", "/", "|", "::", "»"} {
-		if strings.Contains(clean[0], sep) {
-			parts := normalizeSubjectList(strings.Split(clean[0], sep))
-			if len(parts) >= 2 {
-				return parts[0], parts[1]
-			}
-			if len(parts) == 1 {
-				return parts[0], ""
-			}
+// commit saves the batch and the resume point, then announces the books it
+// added. It does nothing when no batch is open.
+func (b *scanBatch) commit(ctx context.Context) error {
+	if b.open == nil {
+		return nil
+	}
+	tx := b.open
+	b.open = nil
+	if b.root != "" {
+		if err := database.SetScanResumePointTx(tx, b.root, b.last); err != nil {
+			_ = tx.Rollback()
+			return err
 		}
 	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	slog.DebugContext(ctx, "scan: batch committed", "files", b.files, "last", b.last)
+	for _, job := range b.saved {
+		b.covers.add(job)
+	}
+	b.s.announce(b.added)
+	b.files, b.added, b.saved = 0, nil, nil
+	return nil
+}
 
-	category := clean[0]
-	subcategory := ""
-	if len(clean) > 1 {
-		subcategory = clean[1]
+// close rolls back a batch left open by an error and waits for the queued
+// covers. It returns how many of them could not be extracted, and is safe
+// to call more than once.
+func (b *scanBatch) close() int {
+	if b.open != nil {
+		_ = b.open.Rollback()
+		b.open = nil
 	}
-	return category, subcategory
+	if !b.closed {
+		b.closed = true
+		b.noCover = b.covers.finish()
+	}
+	return b.noCover
 }
 
-func normalizeSubjectList(values []string) []string {
-	out := make([]string, 0, len(values))
-	seen := map[string]struct{}{}
-	for _, v := range values {
-		v = strings.TrimSpace(v)
-		if v == "" {
-			continue
-		}
-		if _, ok := seen[v]; ok {
-			continue
+// walksAfter reports whether filepath.WalkDir visits path after resume.
+// The walk goes through each directory in name order, so paths compare
+// element by element rather than as plain strings: "a/b.epub" comes
+// before "a b.epub" even though '/' sorts after ' '.
+func walksAfter(path, resume string) bool {
+	p := strings.Split(path, string(filepath.Separator))
+	r := strings.Split(resume, string(filepath.Separator))
+	for i := 0; i < len(p) && i < len(r); i++ {
+		if p[i] != r[i] {
+			return p[i] > r[i]
 		}
-		seen[v] = struct{}{}
-		out = append(out, v)
 	}
-	return out
+	return len(p) > len(r)
 }
 
-func SaveCover(epubPath string, bookID int) error {
-	localCoverPath := filepath.Join(filepath.Dir(epubPath), "cover.jpg")
-	if info, err := os.Stat(localCoverPath); err == nil && !info.IsDir() {
-		return saveExternalCover(localCoverPath, bookID)
-	}
+// IndexFiles indexes the given EPUBs, which must be under root, as Start
+// would, without walking the rest of the library. It returns the books
+// that were not in the library before. Files are committed BatchSize at a
+// time; if ctx is cancelled, the batches already committed are kept. New
+// books are recorded as imported.
+func (s *Scanner) IndexFiles(ctx context.Context, root string, paths []string) ([]database.Book, error) {
+	return s.indexFiles(ctx, root, paths, database.BookSourceImport)
+}
 
-	reader, err := zip.OpenReader(epubPath)
+func (s *Scanner) indexFiles(ctx context.Context, root string, paths []string, source string) ([]database.Book, error) {
+	realRoot, err := filepath.EvalSymlinks(root)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer reader.Close()
-
-	for _, f := range reader.File {
-		if isPreferredCoverFilename(f.Name) {
-			return extractZipFile(f, bookID)
-		}
+	s.limits = newThrottle(s.Throttle)
+	categorySource := s.CategorySource
+	if categorySource == "" {
+		categorySource = CategorySourceFromEnv()
 	}
 
-	for _, f := range reader.File {
-		low := strings.ToLower(f.Name)
-		if (strings.Contains(low, "cover") || strings.Contains(low, "folder")) &&
-			(strings.HasSuffix(low, ".jpg") || strings.HasSuffix(low, ".jpeg") || strings.HasSuffix(low, ".png")) {
-			return extractZipFile(f, bookID)
-		}
+	batchSize := s.BatchSize
+	if batchSize <= 0 {
+		batchSize = DefaultBatchSize
 	}
 
-	var opfPath string
-	for _, f := range reader.File {
-		if strings.HasSuffix(f.Name, ".opf") {
-			opfPath = f.Name
-			break
+	var stats scanStats
+	var added []database.Book
+	b := &scanBatch{s: s, source: source, size: batchSize, covers: s.startCoverQueue(ctx, batchSize)}
+	defer b.close()
+	for _, path := range paths {
+		if err := ctx.Err(); err != nil {
+			return nil, err
 		}
-	}
-
-	if opfPath != "" {
-		rc, _ := reader.Open(opfPath)
-		var opf OPF
-		xml.NewDecoder(rc).Decode(&opf)
-		rc.Close()
-
-		var coverHref string
-		for _, item := range opf.Manifest {
-			if strings.Contains(item.Properties, "cover-image") {
-				coverHref = item.Href
-				break
-			}
+		// Resolved like the walk's paths, so a book keeps one row whether
+		// it was found by a scan or indexed here.
+		if real, err := filepath.EvalSymlinks(filepath.Dir(path)); err == nil {
+			path = filepath.Join(real, filepath.Base(path))
 		}
-		if coverHref == "" {
-			var coverID string
-			for _, m := range opf.Meta {
-				if m.Name == "cover" {
-					coverID = m.Content
-					break
-				}
-			}
-			if coverID != "" {
-				for _, item := range opf.Manifest {
-					if item.ID == coverID {
-						coverHref = item.Href
-						break
-					}
-				}
-			}
+		info, err := os.Stat(path)
+		if err != nil {
+			slog.WarnContext(ctx, "scan: cannot index file", "path", path, "err", err)
+			continue
 		}
-
-		if coverHref != "" {
-			baseDir := filepath.Dir(opfPath)
-			fullCoverPath := filepath.ToSlash(filepath.Join(baseDir, coverHref))
-			for _, f := range reader.File {
-				if f.Name == fullCoverPath || f.Name == coverHref {
-					return extractZipFile(f, bookID)
-				}
-			}
+		stats.Total++
+		book, isNew, err := b.index(ctx, realRoot, path, info, categorySource, &stats)
+		if err != nil {
+			return nil, err
+		}
+		if isNew {
+			added = append(added, book)
 		}
 	}
-
-	return fmt.Errorf("no cover found for %s", epubPath)
-}
-
-func ListCoverOptions(epubPath string) ([]CoverOption, error) {
-	reader, err := zip.OpenReader(epubPath)
-	if err != nil {
+	if err := b.commit(ctx); err != nil {
 		return nil, err
 	}
-	defer reader.Close()
+	slog.InfoContext(ctx, "scan: files indexed", "files", stats.Total, "updated", stats.Rescanned, "added", len(added))
+	return added, nil
+}
 
-	opfPath, err := findOPFPath(reader.File)
-	if err != nil {
-		return nil, err
+// announce passes the books a scan added to Added.
+func (s *Scanner) announce(added []database.Book) {
+	if s.Added == nil {
+		return
 	}
-	if opfPath == "" {
-		return nil, fmt.Errorf("opf package document not found")
+	for _, book := range added {
+		s.Added(book)
 	}
+}
 
-	opfContent, err := readZipEntry(reader.File, opfPath)
-	if err != nil {
-		return nil, err
+type scanStats struct {
+	Total     int
+	Rescanned int
+	NoMeta    int
+	NoCover   int
+	Gone      int
+}
+
+// indexFile saves one EPUB under root if it is new or has changed since it
+// was last indexed. It returns the book, with an ID of 0 if nothing was
+// saved, and true if it was not in the library before. The cover is left
+// to the caller's cover queue.
+func (s *Scanner) indexFile(ctx context.Context, tx *sql.Tx, root, path string, info fs.FileInfo, categorySource string, stats *scanStats) (database.Book, bool) {
+	if !s.db.NeedsReScan(path, info.ModTime()) {
+		return database.Book{}, false
 	}
-	var opf OPF
-	if err := xml.Unmarshal(opfContent, &opf); err != nil {
-		return nil, err
+	stats.Rescanned++
+	release, err := s.limits.open(ctx)
+	if err != nil {
+		return database.Book{}, false
 	}
+	defer release()
 
-	opfDir := filepath.Dir(opfPath)
-	currentCoverPath := detectCurrentCoverZipPath(opf, opfDir)
+	meta, err := ExtractMetadata(path)
+	if err != nil || meta == nil || meta.Title == "" {
+		stats.NoMeta++
+		slog.WarnContext(ctx, "scan: metadata missing, using filename", "path", path)
+		meta = &OPF{
+			Title:   strings.TrimSuffix(info.Name(), filepath.Ext(info.Name())),
+			Creator: "Unknown Author",
+		}
+	}
 
-	all := make([]CoverOption, 0, 12)
-	suitable := make([]CoverOption, 0, 8)
+	fileHash, err := HashFile(path)
+	if err != nil {
+		slog.WarnContext(ctx, "scan: could not hash file", "path", path, "err", err)
+	}
 
-	for _, item := range opf.Manifest {
-		mt := strings.ToLower(strings.TrimSpace(item.MediaType))
-		if mt != "image/jpeg" && mt != "image/jpg" && mt != "image/png" {
-			continue
-		}
-		zipPath := normalizeZipPath(filepath.Join(opfDir, item.Href))
-		if zipPath == "" {
-			continue
+	book := database.Book{
+		Path:        path,
+		Title:       meta.Title,
+		Author:      meta.Creator,
+		Description: meta.Description,
+		Series:      meta.MetaContent("calibre:series"),
+		SeriesIndex: meta.MetaContent("calibre:series_index"),
+		FileHash:    fileHash,
+		ModTime:     info.ModTime(),
+	}
+	switch categorySource {
+	case "path":
+		book.Category, book.Subcategory = categoriesFromPath(root, path)
+	case "subject":
+		book.Category, book.Subcategory = categoriesFromSubjects(meta.Subjects)
+	case "auto":
+		book.Category, book.Subcategory = categoriesFromSubjects(meta.Subjects)
+		if book.Category == "" {
+			book.Category, book.Subcategory = categoriesFromPath(root, path)
 		}
+	}
 
-		raw, err := readZipEntry(reader.File, zipPath)
-		if err != nil {
-			continue
-		}
+	partialMD5, err := PartialMD5(path)
+	if err != nil {
+		slog.WarnContext(ctx, "scan: could not compute partial md5", "path", path, "err", err)
+	}
 
-		cfg, _, err := image.DecodeConfig(bytes.NewReader(raw))
-		if err != nil || cfg.Width <= 0 || cfg.Height <= 0 {
-			continue
-		}
+	_, lookupErr := s.db.GetBookByPath(path)
+	isNew := errors.Is(lookupErr, sql.ErrNoRows)
 
-		opt := CoverOption{
-			ZipPath:   zipPath,
-			Name:      filepath.Base(zipPath),
-			MediaType: mt,
-			Width:     cfg.Width,
-			Height:    cfg.Height,
-			IsCurrent: zipPath == currentCoverPath,
-		}
-		all = append(all, opt)
-		if isSuitableCoverDimension(cfg.Width, cfg.Height) {
-			suitable = append(suitable, opt)
+	id, err := s.db.SaveBookTx(tx, book)
+	if err != nil {
+		slog.ErrorContext(ctx, "scan: failed to save book", "path", path, "err", err)
+		return database.Book{}, false
+	}
+	if partialMD5 != "" {
+		if err := s.db.SetBookPartialMD5Tx(tx, path, partialMD5); err != nil {
+			slog.WarnContext(ctx, "scan: failed to store partial md5", "path", path, "err", err)
 		}
 	}
-
-	if len(suitable) > 0 {
-		return suitable, nil
+	if err := s.db.SetBookSubjectsTx(tx, path, meta.Subjects, s.isAdult(meta.Subjects)); err != nil {
+		slog.WarnContext(ctx, "scan: failed to store subjects", "path", path, "err", err)
 	}
-	return all, nil
+	if err := s.db.SetBookISBNTx(tx, path, meta.ISBN()); err != nil {
+		slog.WarnContext(ctx, "scan: failed to store isbn", "path", path, "err", err)
+	}
+
+	book.ID = int(id)
+	return book, isNew
 }
 
-func ReadCoverOption(epubPath, zipPath string) ([]byte, string, error) {
-	reader, err := zip.OpenReader(epubPath)
+// HashFile returns the hex-encoded SHA-256 of the file's contents.
+func HashFile(path string) (string, error) {
+	f, err := storage.Open(context.Background(), path)
 	if err != nil {
-		return nil, "", err
+		return "", err
 	}
-	defer reader.Close()
+	defer f.Close()
 
-	normalized := normalizeZipPath(zipPath)
-	if normalized == "" {
-		return nil, "", fmt.Errorf("invalid cover path")
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
 	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
 
-	for _, f := range reader.File {
-		if normalizeZipPath(f.Name) != normalized {
-			continue
+// PartialMD5 returns KOReader's document ID for a file: the MD5 of 1 KiB
+// samples taken at offsets 0 and 1024<<(2*i) for i = 0..10, stopping at the
+// end of the file.
+func PartialMD5(path string) (string, error) {
+	f, err := storage.Open(context.Background(), path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := md5.New()
+	buf := make([]byte, 1024)
+	for i := -1; i <= 10; i++ {
+		var offset int64
+		if i >= 0 {
+			offset = 1024 << (2 * i)
 		}
-		rc, err := f.Open()
-		if err != nil {
-			return nil, "", err
+		n, err := f.ReadAt(buf, offset)
+		if n > 0 {
+			h.Write(buf[:n])
 		}
-		defer rc.Close()
-		b, err := io.ReadAll(rc)
 		if err != nil {
-			return nil, "", err
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return "", err
 		}
-		return b, mediaTypeFromPath(f.Name), nil
 	}
-
-	return nil, "", os.ErrNotExist
+	return hex.EncodeToString(h.Sum(nil)), nil
 }
 
-func WriteCoverToEPUB(epubPath, selectedZipPath string) error {
-	reader, err := zip.OpenReader(epubPath)
+// backfillPartialMD5 records KOReader document IDs for books indexed before
+// they were tracked, then relinks reading progress and shelves to the
+// current book IDs.
+func (s *Scanner) backfillPartialMD5(ctx context.Context) {
+	books, err := s.db.BooksMissingPartialMD5()
 	if err != nil {
-		return err
+		slog.WarnContext(ctx, "scan: failed to list books without partial md5", "err", err)
+		return
 	}
-	defer reader.Close()
-
-	opfPath, err := findOPFPath(reader.File)
-	if err != nil {
-		return err
+	for _, b := range books {
+		release, err := s.limits.wait(ctx)
+		if err != nil {
+			return
+		}
+		hash, err := PartialMD5(b.Path)
+		release()
+		if err != nil {
+			continue
+		}
+		if err := s.db.SetBookPartialMD5(b.ID, hash); err != nil {
+			slog.WarnContext(ctx, "scan: failed to store partial md5", "book_id", b.ID, "err", err)
+		}
 	}
-	if opfPath == "" {
-		return fmt.Errorf("opf package document not found")
+	if err := s.db.RelinkReadingProgress(); err != nil {
+		slog.WarnContext(ctx, "scan: failed to relink reading progress", "err", err)
 	}
-	opfContent, err := readZipEntry(reader.File, opfPath)
-	if err != nil {
-		return err
+	if err := s.db.RelinkShelfBooks(); err != nil {
+		slog.WarnContext(ctx, "scan: failed to relink shelf books", "err", err)
 	}
-	var opf OPF
-	if err := xml.Unmarshal(opfContent, &opf); err != nil {
-		return err
+	if err := s.db.RelinkAnnotations(); err != nil {
+		slog.WarnContext(ctx, "scan: failed to relink annotations", "err", err)
 	}
-	opfDir := filepath.Dir(opfPath)
-	canonicalCoverPath := normalizeZipPath(filepath.Join(opfDir, "cover.jpg"))
-	canonicalHref := relativeHrefFromOPFDir(opfDir, canonicalCoverPath)
-	updatedOPF, err := rewriteOPFCoverReference(opfContent, canonicalHref)
-	if err != nil {
-		return err
+	if err := s.db.RelinkRatings(); err != nil {
+		slog.WarnContext(ctx, "scan: failed to relink ratings", "err", err)
 	}
+}
 
-	selectedRaw, err := readZipEntry(reader.File, normalizeZipPath(selectedZipPath))
+// backfillSubjects records EPUB subjects for books indexed before they were
+// stored, so similarity ranking can use them without a full rebuild.
+func (s *Scanner) backfillSubjects(ctx context.Context) {
+	books, err := s.db.BooksMissingSubjects()
 	if err != nil {
-		return err
+		slog.WarnContext(ctx, "scan: failed to list books without subjects", "err", err)
+		return
 	}
-
-	img, _, err := image.Decode(bytes.NewReader(selectedRaw))
-	if err != nil {
-		return fmt.Errorf("selected cover decode failed: %w", err)
+	for _, b := range books {
+		release, err := s.limits.wait(ctx)
+		if err != nil {
+			return
+		}
+		var subjects []string
+		if meta, err := ExtractMetadata(b.Path); err == nil && meta != nil {
+			subjects = meta.Subjects
+		}
+		release()
+		if err := s.db.SetBookSubjects(b.ID, subjects, s.isAdult(subjects)); err != nil {
+			slog.WarnContext(ctx, "scan: failed to store subjects", "book_id", b.ID, "err", err)
+		}
 	}
+}
 
-	rewritten, err := encodeImageForMediaType(img, "image/jpeg", canonicalCoverPath)
+// backfillISBNs records the ISBNs of books indexed before they were
+// tracked.
+func (s *Scanner) backfillISBNs(ctx context.Context) {
+	books, err := s.db.BooksMissingISBN()
 	if err != nil {
-		return err
+		slog.WarnContext(ctx, "scan: failed to list books without isbn", "err", err)
+		return
 	}
+	for _, b := range books {
+		release, err := s.limits.wait(ctx)
+		if err != nil {
+			return
+		}
+		isbn := ""
+		if meta, err := ExtractMetadata(b.Path); err == nil && meta != nil {
+			isbn = meta.ISBN()
+		}
+		release()
+		if err := s.db.SetBookISBN(b.ID, isbn); err != nil {
+			slog.WarnContext(ctx, "scan: failed to store isbn", "book_id", b.ID, "err", err)
+		}
+	}
+}
 
-	return writeNormalizedCoverToEPUB(epubPath, opfPath, opf, opfDir, updatedOPF, rewritten)
+func (s *Scanner) isAdult(subjects []string) bool {
+	return s.Adult != nil && s.Adult(subjects)
 }
 
-func WriteCoverBytesToEPUB(epubPath string, imageBytes []byte) error {
-	reader, err := zip.OpenReader(epubPath)
-	if err != nil {
-		return err
-	}
-	defer reader.Close()
+func isPathCategoryEnabled() bool {
+	raw := strings.ToLower(strings.TrimSpace(os.Getenv("CATEGORY_FROM_PATH")))
+	return raw == "1" || raw == "true" || raw == "yes" || raw == "on"
+}
 
-	opfPath, err := findOPFPath(reader.File)
-	if err != nil {
-		return err
-	}
-	if opfPath == "" {
-		return fmt.Errorf("opf package document not found")
+func isSubjectCategoryEnabled() bool {
+	raw := strings.ToLower(strings.TrimSpace(os.Getenv("CATEGORY_FROM_SUBJECT")))
+	return raw == "1" || raw == "true" || raw == "yes" || raw == "on"
+}
+
+// CategorySourceFromEnv reads CATEGORY_SOURCE, falling back to the older
+// CATEGORY_FROM_SUBJECT / CATEGORY_FROM_PATH toggles.
+func CategorySourceFromEnv() string {
+	source := strings.ToLower(strings.TrimSpace(os.Getenv("CATEGORY_SOURCE")))
+	switch source {
+	case "path", "subject", "auto", "none":
+		return source
+	case "":
+		// Backward compatibility with old toggles.
+		if isSubjectCategoryEnabled() {
+			return "subject"
+		}
+		if isPathCategoryEnabled() {
+			return "path"
+		}
+		return "none"
+	default:
+		return "none"
 	}
-	opfContent, err := readZipEntry(reader.File, opfPath)
+}
+
+func categoriesFromPath(root, bookPath string) (string, string) {
+	root = filepath.Clean(root)
+	bookPath = filepath.Clean(bookPath)
+	rel, err := filepath.Rel(root, bookPath)
 	if err != nil {
-		return err
-	}
-	var opf OPF
-	if err := xml.Unmarshal(opfContent, &opf); err != nil {
-		return err
+		return "", ""
 	}
-	opfDir := filepath.Dir(opfPath)
-	canonicalCoverPath := normalizeZipPath(filepath.Join(opfDir, "cover.jpg"))
-	canonicalHref := relativeHrefFromOPFDir(opfDir, canonicalCoverPath)
-	updatedOPF, err := rewriteOPFCoverReference(opfContent, canonicalHref)
-	if err != nil {
-		return err
+	dir := filepath.Dir(rel)
+	if dir == "." || dir == string(filepath.Separator) {
+		return "", ""
 	}
-
-	img, _, err := image.Decode(bytes.NewReader(imageBytes))
-	if err != nil {
-		return fmt.Errorf("remote cover decode failed: %w", err)
+	parts := strings.Split(filepath.ToSlash(dir), "/")
+	if len(parts) == 0 {
+		return "", ""
 	}
-	rewritten, err := encodeImageForMediaType(img, "image/jpeg", canonicalCoverPath)
-	if err != nil {
-		return err
+	category := strings.TrimSpace(parts[0])
+	subcategory := ""
+	if len(parts) > 1 {
+		subcategory = strings.TrimSpace(parts[1])
 	}
-	return writeNormalizedCoverToEPUB(epubPath, opfPath, opf, opfDir, updatedOPF, rewritten)
+	return category, subcategory
 }
 
-func writeNormalizedCoverToEPUB(epubPath, opfPath string, opf OPF, opfDir string, updatedOPF []byte, rewritten []byte) error {
-	reader, err := zip.OpenReader(epubPath)
-	if err != nil {
-		return err
-	}
-	defer reader.Close()
-
-	canonicalCoverPath := normalizeZipPath(filepath.Join(opfDir, "cover.jpg"))
-
-	tempFile, err := os.CreateTemp(filepath.Dir(epubPath), ".gopds-cover-*.epub")
-	if err != nil {
-		return err
+func categoriesFromSubjects(subjects []string) (string, string) {
+	clean := normalizeSubjectList(subjects)
+	if len(clean) == 0 {
+		return "", ""
 	}
-	tempPath := tempFile.Name()
-	cleanupTemp := true
-	defer func() {
-		_ = tempFile.Close()
-		if cleanupTemp {
-			_ = os.Remove(tempPath)
-		}
-	}()
 
-	writer := zip.NewWriter(tempFile)
-	removePaths := collectExistingCoverPaths(opf, opfDir)
-	delete(removePaths, canonicalCoverPath)
-
-	wroteCover := false
-	wroteOPF := false
-	for _, f := range reader.File {
-		normalized := normalizeZipPath(f.Name)
-
-		if normalized == normalizeZipPath(opfPath) {
-			h := f.FileHeader
-			dst, err := writer.CreateHeader(&h)
-			if err != nil {
-				_ = writer.Close()
-				return err
+	for _, sep := range []string{" > ", ">", "/", "|", "::", "»"} {
+		if strings.Contains(clean[0], sep) {
+			parts := normalizeSubjectList(strings.Split(clean[0], sep))
+			if len(parts) >= 2 {
+				return parts[0], parts[1]
 			}
-			if _, err := dst.Write(updatedOPF); err != nil {
-				_ = writer.Close()
-				return err
+			if len(parts) == 1 {
+				return parts[0], ""
 			}
-			wroteOPF = true
-			continue
 		}
+	}
 
-		if normalized == canonicalCoverPath {
-			h := f.FileHeader
-			dst, err := writer.CreateHeader(&h)
-			if err != nil {
-				_ = writer.Close()
-				return err
-			}
-			if _, err := dst.Write(rewritten); err != nil {
-				_ = writer.Close()
-				return err
-			}
-			wroteCover = true
-			continue
-		}
+	category := clean[0]
+	subcategory := ""
+	if len(clean) > 1 {
+		subcategory = clean[1]
+	}
+	return category, subcategory
+}
 
-		if _, drop := removePaths[normalized]; drop {
+func normalizeSubjectList(values []string) []string {
+	out := make([]string, 0, len(values))
+	seen := map[string]struct{}{}
+	for _, v := range values {
+		v = strings.TrimSpace(v)
+		if v == "" {
 			continue
 		}
-
-		h := f.FileHeader
-		dst, err := writer.CreateHeader(&h)
-		if err != nil {
-			_ = writer.Close()
-			return err
-		}
-		src, err := f.Open()
-		if err != nil {
-			_ = writer.Close()
-			return err
-		}
-		if _, err := io.Copy(dst, src); err != nil {
-			src.Close()
-			_ = writer.Close()
-			return err
+		if _, ok := seen[v]; ok {
+			continue
 		}
-		src.Close()
+		seen[v] = struct{}{}
+		out = append(out, v)
 	}
+	return out
+}
 
-	if !wroteOPF {
-		_ = writer.Close()
-		return fmt.Errorf("opf package document missing during rewrite")
+func SaveCover(epubPath string, bookID int) error {
+	if local := siblingCover(epubPath); local != "" {
+		return saveExternalCover(local, bookID)
 	}
-	if !wroteCover {
-		dst, err := writer.Create(canonicalCoverPath)
-		if err != nil {
-			_ = writer.Close()
-			return err
-		}
-		if _, err := dst.Write(rewritten); err != nil {
-			_ = writer.Close()
-			return err
-		}
+	e, err := OpenEPUB(epubPath)
+	if err != nil {
+		return err
 	}
+	defer e.Close()
+	return e.SaveCover(bookID)
+}
 
-	if err := writer.Close(); err != nil {
-		return err
+// siblingCover returns the cover.jpg beside an EPUB, or "" if there is
+// none. It wins over any image inside the EPUB.
+func siblingCover(epubPath string) string {
+	if storage.IsRemote(epubPath) {
+		return ""
 	}
-	if err := tempFile.Close(); err != nil {
-		return err
+	local := filepath.Join(filepath.Dir(epubPath), "cover.jpg")
+	if info, err := os.Stat(local); err == nil && !info.IsDir() {
+		return local
 	}
-	if err := os.Rename(tempPath, epubPath); err != nil {
+	return ""
+}
+
+func ReadCoverOption(epubPath, zipPath string) ([]byte, string, error) {
+	e, err := OpenEPUB(epubPath)
+	if err != nil {
+		return nil, "", err
+	}
+	defer e.Close()
+	return e.ReadCoverOption(zipPath)
+}
+
+func WriteCoverBytesToEPUB(epubPath string, imageBytes []byte) error {
+	e, err := OpenEPUB(epubPath)
+	if err != nil {
 		return err
 	}
-	cleanupTemp = false
-	return nil
+	defer e.Close()
+	return e.WriteCoverBytes(imageBytes)
 }
 
 func ConvertImageToJPEG(raw []byte) ([]byte, error) {
-	img, _, err := image.Decode(bytes.NewReader(raw))
+	img, _, err := imaging.Decode(raw)
 	if err != nil {
 		return nil, err
 	}
@@ -1405,22 +1616,11 @@ func normalizeZipPath(path string) string {
 }
 
 func saveExternalCover(srcPath string, bookID int) error {
-	src, err := os.Open(srcPath)
+	raw, err := os.ReadFile(srcPath)
 	if err != nil {
 		return err
 	}
-	defer src.Close()
-
-	os.MkdirAll("./data/covers", 0755)
-	dstPath := fmt.Sprintf("./data/covers/%d.jpg", bookID)
-	dst, err := os.Create(dstPath)
-	if err != nil {
-		return err
-	}
-	defer dst.Close()
-
-	_, err = io.Copy(dst, src)
-	return err
+	return storage.Covers().Write(context.Background(), CoverName(bookID), raw)
 }
 
 func extractZipFile(f *zip.File, bookID int) error {
@@ -1430,13 +1630,14 @@ func extractZipFile(f *zip.File, bookID int) error {
 	}
 	defer rc.Close()
 
-	os.MkdirAll("./data/covers", 0755)
-	out, err := os.Create(fmt.Sprintf("./data/covers/%d.jpg", bookID))
+	raw, err := io.ReadAll(rc)
 	if err != nil {
 		return err
 	}
-	defer out.Close()
+	return storage.Covers().Write(context.Background(), CoverName(bookID), raw)
+}
 
-	_, err = io.Copy(out, rc)
-	return err
+// CoverName is the name book bookID's cover is cached under.
+func CoverName(bookID int) string {
+	return fmt.Sprintf("%d.jpg", bookID)
 }
@@ -0,0 +1,150 @@
+package scanner
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Throttle limits how hard a scan works the disk, so a full rescan doesn't
+// starve a NAS that is also serving other things. Zero values mean no
+// limit.
+type Throttle struct {
+	// FilesPerSecond caps how many EPUBs are read per second. Files that
+	// haven't changed since they were indexed cost only a stat and a
+	// lookup, and aren't counted.
+	FilesPerSecond int
+	// MaxOpenFiles caps how many EPUBs are open at once, across the walk
+	// and the cover workers.
+	MaxOpenFiles int
+	// IdleHours is when the disk is expected to be quiet. Neither limit
+	// applies then.
+	IdleHours Hours
+}
+
+// Hours is a daily window of local time from hour Start up to hour End,
+// wrapping past midnight when End is before Start. The zero value, or any
+// with Start == End, is no window at all.
+type Hours struct {
+	Start, End int
+}
+
+// ParseHours parses a window such as "1-6" or "22-7"; "" is no window.
+func ParseHours(s string) (Hours, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return Hours{}, nil
+	}
+	from, to, ok := strings.Cut(s, "-")
+	start, err1 := strconv.Atoi(strings.TrimSpace(from))
+	end, err2 := strconv.Atoi(strings.TrimSpace(to))
+	if !ok || err1 != nil || err2 != nil || start < 0 || start > 23 || end < 0 || end > 24 || start == end%24 {
+		return Hours{}, fmt.Errorf("hours must look like 1-6: a start hour from 0 to 23 and a different end hour from 0 to 24")
+	}
+	return Hours{Start: start, End: end % 24}, nil
+}
+
+func (h Hours) String() string {
+	if h.Start == h.End {
+		return ""
+	}
+	return fmt.Sprintf("%d-%d", h.Start, h.End)
+}
+
+// Contains reports whether t falls in the window.
+func (h Hours) Contains(t time.Time) bool {
+	hour := t.Hour()
+	switch {
+	case h.Start == h.End:
+		return false
+	case h.Start < h.End:
+		return hour >= h.Start && hour < h.End
+	default:
+		return hour >= h.Start || hour < h.End
+	}
+}
+
+// throttle applies a Throttle for one scan. A nil *throttle limits
+// nothing.
+type throttle struct {
+	cfg   Throttle
+	slots chan struct{} // nil without MaxOpenFiles
+
+	mu   sync.Mutex
+	next time.Time // when the next read may start
+}
+
+func newThrottle(cfg Throttle) *throttle {
+	if cfg.FilesPerSecond <= 0 && cfg.MaxOpenFiles <= 0 {
+		return nil
+	}
+	t := &throttle{cfg: cfg}
+	if cfg.MaxOpenFiles > 0 {
+		t.slots = make(chan struct{}, cfg.MaxOpenFiles)
+	}
+	return t
+}
+
+func (t *throttle) idle() bool {
+	return t.cfg.IdleHours.Contains(time.Now())
+}
+
+// paced reports whether reads are being paced right now.
+func (t *throttle) paced() bool {
+	return t != nil && t.cfg.FilesPerSecond > 0 && !t.idle()
+}
+
+// delay reserves the next read and returns how long to wait before it.
+func (t *throttle) delay() time.Duration {
+	if !t.paced() {
+		return 0
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	if t.next.Before(now) {
+		t.next = now
+	}
+	wait := t.next.Sub(now)
+	t.next = t.next.Add(time.Second / time.Duration(t.cfg.FilesPerSecond))
+	return wait
+}
+
+// open waits until another file may be opened and returns the function
+// that gives its slot back.
+func (t *throttle) open(ctx context.Context) (func(), error) {
+	if t == nil || t.slots == nil || t.idle() {
+		return func() {}, nil
+	}
+	select {
+	case t.slots <- struct{}{}:
+		return func() { <-t.slots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// wait paces one read outside a scan batch and then holds a slot for it.
+func (t *throttle) wait(ctx context.Context) (func(), error) {
+	if err := sleep(ctx, t.delay()); err != nil {
+		return nil, err
+	}
+	return t.open(ctx)
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
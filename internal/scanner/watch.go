@@ -0,0 +1,127 @@
+package scanner
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ab0oo/gopds/internal/database"
+	"github.com/fsnotify/fsnotify"
+)
+
+// Watch indexes EPUBs under root as they are added or replaced, until ctx
+// is cancelled. A file is indexed once it has gone settle without changing,
+// so books still being copied in aren't read half-written. Like Start, it
+// doesn't remove books whose files disappear. If the kernel drops events,
+// the whole library is scanned again so nothing is missed.
+func (s *Scanner) Watch(ctx context.Context, root string, settle time.Duration) error {
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return err
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	// pending maps EPUBs that changed to the time of their last event.
+	pending := map[string]time.Time{}
+	if err := watchTree(watcher, realRoot, nil); err != nil {
+		return err
+	}
+	slog.InfoContext(ctx, "watch: watching library", "root", realRoot)
+
+	tick := time.NewTicker(min(settle, time.Second))
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			if !event.Has(fsnotify.Create) && !event.Has(fsnotify.Write) {
+				continue
+			}
+			if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+				// A folder moved or copied in: watch it, and index what it
+				// already holds, since no events come for that.
+				if event.Has(fsnotify.Create) {
+					if err := watchTree(watcher, event.Name, pending); err != nil {
+						slog.WarnContext(ctx, "watch: cannot watch folder", "path", event.Name, "err", err)
+					}
+				}
+				continue
+			}
+			if isEPUB(event.Name) {
+				pending[event.Name] = time.Now()
+			}
+
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			if errors.Is(err, fsnotify.ErrEventOverflow) {
+				slog.WarnContext(ctx, "watch: events were dropped, rescanning the library")
+				if err := s.Start(ctx, realRoot); err != nil {
+					return err
+				}
+				continue
+			}
+			slog.WarnContext(ctx, "watch: error", "err", err)
+
+		case now := <-tick.C:
+			var ready []string
+			for path, last := range pending {
+				if now.Sub(last) < settle {
+					continue
+				}
+				delete(pending, path)
+				if _, err := os.Stat(path); err == nil {
+					ready = append(ready, path)
+				}
+			}
+			if len(ready) == 0 {
+				continue
+			}
+			if _, err := s.indexFiles(ctx, realRoot, ready, database.BookSourceWatch); err != nil {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				slog.ErrorContext(ctx, "watch: indexing failed", "files", len(ready), "err", err)
+			}
+		}
+	}
+}
+
+// watchTree adds dir and every folder under it to watcher. If pending is
+// not nil, the EPUBs found are added to it to be indexed.
+func watchTree(watcher *fsnotify.Watcher, dir string, pending map[string]time.Time) error {
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if path == dir {
+				return err
+			}
+			return nil
+		}
+		if d.IsDir() {
+			return watcher.Add(path)
+		}
+		if pending != nil && isEPUB(d.Name()) {
+			pending[path] = time.Now()
+		}
+		return nil
+	})
+}
+
+func isEPUB(name string) bool {
+	return strings.HasSuffix(strings.ToLower(name), ".epub")
+}
@@ -0,0 +1,472 @@
+// Package settings resolves runtime tunables. Each setting can be overridden
+// in the database through the admin API; otherwise it comes from its
+// environment variable, and failing that from a built-in default. Values are
+// read on every call, so a change applies without a restart.
+package settings
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ab0oo/gopds/internal/database"
+	"github.com/ab0oo/gopds/internal/listen"
+	"github.com/ab0oo/gopds/internal/organize"
+	"github.com/ab0oo/gopds/internal/scanner"
+)
+
+// Setting keys.
+const (
+	OnlineCoverMinWidth    = "online_cover_min_width"
+	OnlineCoverMinHeight   = "online_cover_min_height"
+	CategorySource         = "category_source"
+	ScanIntervalMinutes    = "scan_interval_minutes"
+	ScanStallSeconds       = "scan_stall_seconds"
+	ScanBatchSize          = "scan_batch_size"
+	ScanFilesPerSecond     = "scan_files_per_second"
+	ScanMaxOpenFiles       = "scan_max_open_files"
+	ScanIdleHours          = "scan_idle_hours"
+	IntegrityIntervalHours = "integrity_interval_hours"
+	MissingRetentionDays   = "missing_retention_days"
+	ProviderOpenLibrary    = "provider_openlibrary"
+	ProviderGoogleBooks    = "provider_googlebooks"
+	ProviderWikipedia      = "provider_wikipedia"
+	ProviderHardcover      = "provider_hardcover"
+	ProviderWikidata       = "provider_wikidata"
+	ProviderDouban         = "provider_douban"
+	QuotaOpenLibrary       = "quota_openlibrary"
+	QuotaGoogleBooks       = "quota_googlebooks"
+	QuotaHardcover         = "quota_hardcover"
+	QuotaDouban            = "quota_douban"
+	QuotaWikipedia         = "quota_wikipedia"
+	QuotaWikidata          = "quota_wikidata"
+	LookupCacheHours       = "lookup_cache_hours"
+	AutoApplyConfidence    = "metadata_auto_apply_confidence"
+	OfflineMode            = "offline_mode"
+	PublicBrowse           = "public_browse"
+	PublicCovers           = "public_covers"
+	PublicDownloads        = "public_downloads"
+	PublicAPI              = "public_api"
+	HideAdult              = "hide_adult"
+	DownloadDailyLimit     = "download_daily_limit"
+	DownloadMonthlyLimit   = "download_monthly_limit"
+	DownloadDailyMB        = "download_daily_mb"
+	DownloadMonthlyMB      = "download_monthly_mb"
+	HTTPReadHeaderTimeout  = "http_read_header_timeout_seconds"
+	HTTPReadTimeout        = "http_read_timeout_seconds"
+	HTTPWriteTimeout       = "http_write_timeout_seconds"
+	HTTPIdleTimeout        = "http_idle_timeout_seconds"
+	HTTPMaxHeaderKB        = "http_max_header_kb"
+	MaxBodyKB              = "max_body_kb"
+	MaxUploadMB            = "max_upload_mb"
+	DownloadFilename       = "download_filename"
+)
+
+// Value types.
+const (
+	TypeInt    = "int"
+	TypeBool   = "bool"
+	TypeEnum   = "enum"
+	TypeString = "string"
+)
+
+// Definition describes one setting.
+type Definition struct {
+	Key         string   `json:"key"`
+	Type        string   `json:"type"`
+	Env         string   `json:"env,omitempty"`
+	Default     string   `json:"default"`
+	Options     []string `json:"options,omitempty"`
+	Min         *int     `json:"min,omitempty"`
+	Max         *int     `json:"max,omitempty"`
+	Description string   `json:"description"`
+
+	// fromEnv replaces the plain Env lookup for settings with legacy
+	// variables. It returns "" when nothing is set.
+	fromEnv func() string
+	// check validates a TypeString value beyond it not being empty.
+	check func(string) error
+}
+
+func intPtr(n int) *int { return &n }
+
+// Definitions lists every setting, in the order the API reports them.
+var Definitions = []Definition{
+	{
+		Key: OnlineCoverMinWidth, Type: TypeInt, Env: "ONLINE_COVER_MIN_WIDTH", Default: "300", Min: intPtr(0), Max: intPtr(5000),
+		Description: "Online cover candidates narrower than this many pixels are dropped.",
+	},
+	{
+		Key: OnlineCoverMinHeight, Type: TypeInt, Env: "ONLINE_COVER_MIN_HEIGHT", Default: "420", Min: intPtr(0), Max: intPtr(5000),
+		Description: "Online cover candidates shorter than this many pixels are dropped.",
+	},
+	{
+		Key: CategorySource, Type: TypeEnum, Env: "CATEGORY_SOURCE", Default: "none", Options: []string{"path", "subject", "auto", "none"},
+		Description: "Where scans take book categories from. Applies to books indexed by the next scan; rebuild to recategorize everything.",
+		fromEnv: func() string {
+			if os.Getenv("CATEGORY_SOURCE") == "" && os.Getenv("CATEGORY_FROM_SUBJECT") == "" && os.Getenv("CATEGORY_FROM_PATH") == "" {
+				return ""
+			}
+			return scanner.CategorySourceFromEnv()
+		},
+	},
+	{
+		Key: ScanIntervalMinutes, Type: TypeInt, Env: "SCAN_INTERVAL_MINUTES", Default: "0", Min: intPtr(0), Max: intPtr(7 * 24 * 60),
+		Description: "Queue an incremental rescan this often. 0 disables scheduled scans.",
+	},
+	{
+		Key: ScanStallSeconds, Type: TypeInt, Env: "SCAN_STALL_SECONDS", Default: "600", Min: intPtr(30), Max: intPtr(86400),
+		Description: "How long a scan may go without visiting a file before /readyz reports it as wedged.",
+	},
+	{
+		Key: ScanBatchSize, Type: TypeInt, Env: "SCAN_BATCH_SIZE", Default: "500", Min: intPtr(1), Max: intPtr(100000),
+		Description: "Scans commit after this many files, so an interrupted scan keeps its work and resumes where it stopped.",
+	},
+	{
+		Key: ScanFilesPerSecond, Type: TypeInt, Env: "SCAN_FILES_PER_SECOND", Default: "0", Min: intPtr(0), Max: intPtr(10000),
+		Description: "Most new or changed EPUBs a scan reads per second, outside scan_idle_hours. 0 means unlimited.",
+	},
+	{
+		Key: ScanMaxOpenFiles, Type: TypeInt, Env: "SCAN_MAX_OPEN_FILES", Default: "0", Min: intPtr(0), Max: intPtr(256),
+		Description: "Most EPUBs a scan and its cover extraction have open at once, outside scan_idle_hours. 0 means unlimited.",
+	},
+	{
+		Key: ScanIdleHours, Type: TypeString, Env: "SCAN_IDLE_HOURS", Default: "",
+		Description: "Local hours, such as 1-6, when scans run at full speed whatever the other scan limits say. Empty means never.",
+		check: func(v string) error {
+			_, err := scanner.ParseHours(v)
+			return err
+		},
+	},
+	{
+		Key: IntegrityIntervalHours, Type: TypeInt, Env: "INTEGRITY_INTERVAL_HOURS", Default: "0", Min: intPtr(0), Max: intPtr(90 * 24),
+		Description: "Re-hash every book file this often to catch bit rot and truncated files. 0 disables scheduled checks.",
+	},
+	{
+		Key: MissingRetentionDays, Type: TypeInt, Env: "MISSING_RETENTION_DAYS", Default: "0", Min: intPtr(0), Max: intPtr(3650),
+		Description: "Purge books whose files have been missing for this many days, with their cached covers. 0 keeps them forever.",
+	},
+	{
+		Key: ProviderOpenLibrary, Type: TypeBool, Env: "PROVIDER_OPENLIBRARY", Default: "true",
+		Description: "Use Open Library for metadata and cover lookups.",
+	},
+	{
+		Key: ProviderGoogleBooks, Type: TypeBool, Env: "PROVIDER_GOOGLEBOOKS", Default: "true",
+		Description: "Use Google Books for metadata and cover lookups.",
+	},
+	{
+		Key: ProviderWikipedia, Type: TypeBool, Env: "PROVIDER_WIKIPEDIA", Default: "true",
+		Description: "Use Wikipedia for cover lookups.",
+	},
+	{
+		Key: ProviderHardcover, Type: TypeBool, Env: "PROVIDER_HARDCOVER", Default: "true",
+		Description: "Use Hardcover for metadata lookups when HARDCOVER_API_TOKEN is set.",
+	},
+	{
+		Key: ProviderWikidata, Type: TypeBool, Env: "PROVIDER_WIKIDATA", Default: "true",
+		Description: "Fill in series and author details from Wikidata during metadata lookups.",
+	},
+	{
+		Key: ProviderDouban, Type: TypeBool, Env: "PROVIDER_DOUBAN", Default: "false",
+		Description: "Use Douban Books for metadata and cover lookups, for Chinese-language libraries.",
+	},
+	{
+		Key: QuotaOpenLibrary, Type: TypeInt, Env: "QUOTA_OPENLIBRARY", Default: "0", Min: intPtr(0), Max: intPtr(10000000),
+		Description: "Open Library API requests allowed per UTC day. 0 means unlimited.",
+	},
+	{
+		Key: QuotaGoogleBooks, Type: TypeInt, Env: "QUOTA_GOOGLEBOOKS", Default: "1000", Min: intPtr(0), Max: intPtr(10000000),
+		Description: "Google Books API requests allowed per UTC day, matching Google's default quota. 0 means unlimited.",
+	},
+	{
+		Key: QuotaHardcover, Type: TypeInt, Env: "QUOTA_HARDCOVER", Default: "0", Min: intPtr(0), Max: intPtr(10000000),
+		Description: "Hardcover API requests allowed per UTC day. 0 means unlimited.",
+	},
+	{
+		Key: QuotaDouban, Type: TypeInt, Env: "QUOTA_DOUBAN", Default: "0", Min: intPtr(0), Max: intPtr(10000000),
+		Description: "Douban API requests allowed per UTC day. 0 means unlimited.",
+	},
+	{
+		Key: QuotaWikipedia, Type: TypeInt, Env: "QUOTA_WIKIPEDIA", Default: "0", Min: intPtr(0), Max: intPtr(10000000),
+		Description: "Wikipedia API requests allowed per UTC day. 0 means unlimited.",
+	},
+	{
+		Key: QuotaWikidata, Type: TypeInt, Env: "QUOTA_WIKIDATA", Default: "0", Min: intPtr(0), Max: intPtr(10000000),
+		Description: "Wikidata queries allowed per UTC day. 0 means unlimited.",
+	},
+	{
+		Key: LookupCacheHours, Type: TypeInt, Env: "LOOKUP_CACHE_HOURS", Default: "168", Min: intPtr(0), Max: intPtr(24 * 365),
+		Description: "How long metadata lookups and cover probes are cached. 0 turns the cache off.",
+	},
+	{
+		Key: AutoApplyConfidence, Type: TypeInt, Env: "METADATA_AUTO_APPLY_CONFIDENCE", Default: "90", Min: intPtr(0), Max: intPtr(100),
+		Description: "Match confidence, in percent, at which a metadata candidate is safe to apply without review. 0 turns auto-apply off.",
+	},
+	{
+		Key: OfflineMode, Type: TypeBool, Env: "OFFLINE_MODE", Default: "false",
+		Description: "Turn off every external metadata and cover lookup, whatever the provider settings say.",
+	},
+	{
+		Key: PublicBrowse, Type: TypeBool, Env: "PUBLIC_BROWSE", Default: "true",
+		Description: "Let anonymous visitors browse the OPDS catalog.",
+	},
+	{
+		Key: PublicCovers, Type: TypeBool, Env: "PUBLIC_COVERS", Default: "true",
+		Description: "Let anonymous visitors load cover images.",
+	},
+	{
+		Key: PublicDownloads, Type: TypeBool, Env: "PUBLIC_DOWNLOADS", Default: "true",
+		Description: "Let anonymous visitors download and preview books.",
+	},
+	{
+		Key: PublicAPI, Type: TypeBool, Env: "PUBLIC_API", Default: "true",
+		Description: "Let anonymous visitors use the JSON book API, which the web UI's library view is built on.",
+	},
+	{
+		Key: HideAdult, Type: TypeBool, Env: "HIDE_ADULT", Default: "false",
+		Description: "Hide books flagged as adult content from anonymous visitors and every account that isn't an admin.",
+	},
+	{
+		Key: DownloadDailyLimit, Type: TypeInt, Env: "DOWNLOAD_DAILY_LIMIT", Default: "0", Min: intPtr(0), Max: intPtr(100000),
+		Description: "Books each signed-in user may download per UTC day, unless their account overrides it. 0 means unlimited.",
+	},
+	{
+		Key: DownloadMonthlyLimit, Type: TypeInt, Env: "DOWNLOAD_MONTHLY_LIMIT", Default: "0", Min: intPtr(0), Max: intPtr(1000000),
+		Description: "Books each signed-in user may download per calendar month (UTC). 0 means unlimited.",
+	},
+	{
+		Key: DownloadDailyMB, Type: TypeInt, Env: "DOWNLOAD_DAILY_MB", Default: "0", Min: intPtr(0), Max: intPtr(10000000),
+		Description: "Megabytes each signed-in user may download per UTC day. 0 means unlimited.",
+	},
+	{
+		Key: DownloadMonthlyMB, Type: TypeInt, Env: "DOWNLOAD_MONTHLY_MB", Default: "0", Min: intPtr(0), Max: intPtr(100000000),
+		Description: "Megabytes each signed-in user may download per calendar month (UTC). 0 means unlimited.",
+	},
+	{
+		Key: HTTPReadHeaderTimeout, Type: TypeInt, Env: "HTTP_READ_HEADER_TIMEOUT_SECONDS", Default: "10", Min: intPtr(0), Max: intPtr(3600),
+		Description: "Seconds a client may take to send request headers. 0 means unlimited. Applies from the next start.",
+	},
+	{
+		Key: HTTPReadTimeout, Type: TypeInt, Env: "HTTP_READ_TIMEOUT_SECONDS", Default: "60", Min: intPtr(0), Max: intPtr(86400),
+		Description: "Seconds a client may take to send a whole request; uploads are exempt. 0 means unlimited. Applies from the next start.",
+	},
+	{
+		Key: HTTPWriteTimeout, Type: TypeInt, Env: "HTTP_WRITE_TIMEOUT_SECONDS", Default: "60", Min: intPtr(0), Max: intPtr(86400),
+		Description: "Seconds a response may take to write; downloads, exports, and uploads are exempt. 0 means unlimited. Applies from the next start.",
+	},
+	{
+		Key: HTTPIdleTimeout, Type: TypeInt, Env: "HTTP_IDLE_TIMEOUT_SECONDS", Default: "120", Min: intPtr(0), Max: intPtr(86400),
+		Description: "Seconds an idle keep-alive connection is kept open. 0 means unlimited. Applies from the next start.",
+	},
+	{
+		Key: HTTPMaxHeaderKB, Type: TypeInt, Env: "HTTP_MAX_HEADER_KB", Default: "64", Min: intPtr(1), Max: intPtr(1024),
+		Description: "Largest request headers accepted, in kilobytes. Larger requests get 431. Applies from the next start.",
+	},
+	{
+		Key: MaxBodyKB, Type: TypeInt, Env: "MAX_BODY_KB", Default: "1024", Min: intPtr(16), Max: intPtr(1 << 20),
+		Description: "Largest request body accepted, in kilobytes, except for file uploads. Larger requests get 413.",
+	},
+	{
+		Key: MaxUploadMB, Type: TypeInt, Env: "MAX_UPLOAD_MB", Default: "20", Min: intPtr(1), Max: intPtr(1024),
+		Description: "Largest file upload accepted, such as a metadata CSV import, in megabytes.",
+	},
+	{
+		Key: DownloadFilename, Type: TypeString, Env: "DOWNLOAD_FILENAME", Default: "{author} - {title}",
+		Description: "Name given to downloaded books, using the organize template placeholders; the format's extension is added.",
+		check: func(v string) error {
+			_, err := organize.ParseFileTemplate(v)
+			return err
+		},
+	},
+}
+
+// Lookup returns the definition for key.
+func Lookup(key string) (Definition, bool) {
+	i := slices.IndexFunc(Definitions, func(d Definition) bool { return d.Key == key })
+	if i < 0 {
+		return Definition{}, false
+	}
+	return Definitions[i], true
+}
+
+// Sources of an effective value.
+const (
+	SourceDatabase = "database"
+	SourceEnv      = "env"
+	SourceDefault  = "default"
+)
+
+// Value is a setting's effective value and where it came from.
+type Value struct {
+	Definition
+	Value  string `json:"value"`
+	Source string `json:"source"`
+}
+
+// ErrInvalid wraps validation failures from Update.
+var ErrInvalid = errors.New("invalid setting")
+
+// Store reads settings through the database.
+type Store struct {
+	db *database.DB
+}
+
+func New(db *database.DB) *Store {
+	return &Store{db: db}
+}
+
+// Normalize checks raw against the definition and returns its canonical
+// form.
+func (d Definition) Normalize(raw string) (string, error) {
+	raw = strings.TrimSpace(raw)
+	switch d.Type {
+	case TypeInt:
+		n, err := strconv.Atoi(raw)
+		if err != nil {
+			return "", fmt.Errorf("%s must be an integer", d.Key)
+		}
+		if (d.Min != nil && n < *d.Min) || (d.Max != nil && n > *d.Max) {
+			return "", fmt.Errorf("%s must be between %d and %d", d.Key, *d.Min, *d.Max)
+		}
+		return strconv.Itoa(n), nil
+	case TypeBool:
+		switch strings.ToLower(raw) {
+		case "1", "true", "yes", "on":
+			return "true", nil
+		case "0", "false", "no", "off":
+			return "false", nil
+		}
+		return "", fmt.Errorf("%s must be true or false", d.Key)
+	case TypeEnum:
+		v := strings.ToLower(raw)
+		if !slices.Contains(d.Options, v) {
+			return "", fmt.Errorf("%s must be one of %s", d.Key, strings.Join(d.Options, ", "))
+		}
+		return v, nil
+	case TypeString:
+		if raw == "" {
+			return "", fmt.Errorf("%s must not be empty", d.Key)
+		}
+		if d.check != nil {
+			if err := d.check(raw); err != nil {
+				return "", fmt.Errorf("%s: %v", d.Key, err)
+			}
+		}
+		return raw, nil
+	}
+	return raw, nil
+}
+
+func (d Definition) envValue() string {
+	if d.fromEnv != nil {
+		return d.fromEnv()
+	}
+	if d.Env == "" {
+		return ""
+	}
+	return os.Getenv(d.Env)
+}
+
+// resolve applies database > environment > default. Invalid environment
+// values fall through to the default, as the env helpers always have.
+func (d Definition) resolve(stored string, hasStored bool) Value {
+	if hasStored {
+		if v, err := d.Normalize(stored); err == nil {
+			return Value{Definition: d, Value: v, Source: SourceDatabase}
+		}
+	}
+	if raw := d.envValue(); strings.TrimSpace(raw) != "" {
+		if v, err := d.Normalize(raw); err == nil {
+			return Value{Definition: d, Value: v, Source: SourceEnv}
+		}
+	}
+	return Value{Definition: d, Value: d.Default, Source: SourceDefault}
+}
+
+// Get returns the effective value of key. A database error is treated as
+// "no override" so a locked database can't break callers.
+func (s *Store) Get(key string) string {
+	d, ok := Lookup(key)
+	if !ok {
+		return ""
+	}
+	var stored string
+	var hasStored bool
+	if s != nil && s.db != nil {
+		stored, hasStored, _ = s.db.GetSetting(key)
+	}
+	return d.resolve(stored, hasStored).Value
+}
+
+func (s *Store) Int(key string) int {
+	n, _ := strconv.Atoi(s.Get(key))
+	return n
+}
+
+func (s *Store) Bool(key string) bool {
+	return s.Get(key) == "true"
+}
+
+// ScanThrottle is the scan limits the settings ask for.
+func (s *Store) ScanThrottle() scanner.Throttle {
+	hours, _ := scanner.ParseHours(s.Get(ScanIdleHours))
+	return scanner.Throttle{
+		FilesPerSecond: s.Int(ScanFilesPerSecond),
+		MaxOpenFiles:   s.Int(ScanMaxOpenFiles),
+		IdleHours:      hours,
+	}
+}
+
+// HTTPLimits is the server timeouts and header limit the settings ask for.
+func (s *Store) HTTPLimits() listen.Limits {
+	seconds := func(key string) time.Duration { return time.Duration(s.Int(key)) * time.Second }
+	return listen.Limits{
+		ReadHeaderTimeout: seconds(HTTPReadHeaderTimeout),
+		ReadTimeout:       seconds(HTTPReadTimeout),
+		WriteTimeout:      seconds(HTTPWriteTimeout),
+		IdleTimeout:       seconds(HTTPIdleTimeout),
+		MaxHeaderBytes:    s.Int(HTTPMaxHeaderKB) << 10,
+	}
+}
+
+// List returns every setting's effective value.
+func (s *Store) List() ([]Value, error) {
+	stored, err := s.db.ListSettings()
+	if err != nil {
+		return nil, err
+	}
+	out := make([]Value, 0, len(Definitions))
+	for _, d := range Definitions {
+		v, ok := stored[d.Key]
+		out = append(out, d.resolve(v, ok))
+	}
+	return out, nil
+}
+
+// Update validates and applies changes. A nil value removes the database
+// override so the setting falls back to its environment variable or
+// default. Nothing is written unless every change is valid.
+func (s *Store) Update(changes map[string]*string, by string) error {
+	set := map[string]string{}
+	var reset []string
+	for key, raw := range changes {
+		d, ok := Lookup(key)
+		if !ok {
+			return fmt.Errorf("%w: unknown setting %q", ErrInvalid, key)
+		}
+		if raw == nil {
+			reset = append(reset, key)
+			continue
+		}
+		v, err := d.Normalize(*raw)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalid, err)
+		}
+		set[key] = v
+	}
+	return s.db.UpdateSettings(set, reset, by)
+}
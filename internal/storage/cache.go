@@ -0,0 +1,271 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultCoverCache is where covers are cached unless COVER_CACHE says
+// otherwise.
+const DefaultCoverCache = "./data/covers"
+
+// cacheStatTTL is how long an S3 cache trusts what it last learned about
+// a file. Feeds look up every listed book's cover, which would otherwise
+// cost a request each.
+const cacheStatTTL = time.Minute
+
+// Cache holds files derived from the library, such as cover images, by
+// name: in a local directory, or under a prefix in an S3 bucket so that
+// stateless deployments need no volume for them.
+type Cache interface {
+	// Stat describes the named file, with an error matching
+	// fs.ErrNotExist if there is none.
+	Stat(ctx context.Context, name string) (fs.FileInfo, error)
+	Open(ctx context.Context, name string) (File, error)
+	// Write replaces the named file with data, so readers see the old
+	// file or the new one, never part of it.
+	Write(ctx context.Context, name string, data []byte) error
+	// Remove deletes the named file, if there is one.
+	Remove(ctx context.Context, name string) error
+	// Clear deletes every file in the cache.
+	Clear(ctx context.Context) error
+	// String is the directory or s3:// URL, for logs.
+	String() string
+}
+
+var (
+	cacheMu sync.RWMutex
+	covers  Cache = dirCache(DefaultCoverCache)
+)
+
+// Covers is the cache holding cover images.
+func Covers() Cache {
+	cacheMu.RLock()
+	defer cacheMu.RUnlock()
+	return covers
+}
+
+// ConfigureCovers keeps covers in location, a directory or an
+// s3://bucket/prefix URL; empty means DefaultCoverCache.
+func ConfigureCovers(location string, opts Options) error {
+	c, err := NewCache(strings.TrimSpace(location), opts)
+	if err != nil {
+		return err
+	}
+	cacheMu.Lock()
+	covers = c
+	cacheMu.Unlock()
+	return nil
+}
+
+// NewCache opens the cache at location, a directory or an
+// s3://bucket/prefix URL; empty means DefaultCoverCache.
+func NewCache(location string, opts Options) (Cache, error) {
+	switch {
+	case location == "":
+		return dirCache(DefaultCoverCache), nil
+	case strings.HasPrefix(location, "s3://"):
+		b, err := newS3Backend(strings.TrimRight(location, "/"), opts)
+		if err != nil {
+			return nil, err
+		}
+		return &s3Cache{b: b, stats: map[string]cachedStat{}}, nil
+	case IsRemote(location):
+		return nil, fmt.Errorf("storage: caches can be directories or s3:// URLs, not %q", location)
+	}
+	return dirCache(location), nil
+}
+
+// validCacheName reports whether name is a plain file name, so it can't
+// reach outside the cache.
+func validCacheName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, `/\`)
+}
+
+func invalidName(op, name string) error {
+	return &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+}
+
+// dirCache is a Cache in a local directory.
+type dirCache string
+
+// LocalDir returns the directory c keeps its files in, or false if it
+// keeps them in S3.
+func LocalDir(c Cache) (string, bool) {
+	d, ok := c.(dirCache)
+	return string(d), ok
+}
+
+func (d dirCache) String() string { return string(d) }
+
+func (d dirCache) path(op, name string) (string, error) {
+	if !validCacheName(name) {
+		return "", invalidName(op, name)
+	}
+	return filepath.Join(string(d), name), nil
+}
+
+func (d dirCache) Stat(_ context.Context, name string) (fs.FileInfo, error) {
+	path, err := d.path("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Stat(path)
+}
+
+func (d dirCache) Open(_ context.Context, name string) (File, error) {
+	path, err := d.path("open", name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(path)
+}
+
+func (d dirCache) Write(_ context.Context, name string, data []byte) error {
+	path, err := d.path("write", name)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(string(d), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(string(d), ".tmp-"+name+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (d dirCache) Remove(_ context.Context, name string) error {
+	path, err := d.path("remove", name)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (d dirCache) Clear(context.Context) error {
+	if err := os.RemoveAll(string(d)); err != nil {
+		return err
+	}
+	return os.MkdirAll(string(d), 0755)
+}
+
+// s3Cache is a Cache under a prefix in an S3 bucket. What it learns of
+// each file, including that there is none, is kept for cacheStatTTL; its
+// own writes and removals update that at once, while other servers'
+// changes to the same bucket show up once it expires.
+type s3Cache struct {
+	b *s3Backend
+
+	mu    sync.Mutex
+	stats map[string]cachedStat
+}
+
+type cachedStat struct {
+	info fs.FileInfo
+	err  error
+	at   time.Time
+}
+
+func (c *s3Cache) String() string { return c.b.root }
+
+func (c *s3Cache) path(op, name string) (string, error) {
+	if !validCacheName(name) {
+		return "", invalidName(op, name)
+	}
+	return "s3://" + c.b.bucket + "/" + c.b.prefix + name, nil
+}
+
+func (c *s3Cache) remember(name string, info fs.FileInfo, err error) {
+	c.mu.Lock()
+	c.stats[name] = cachedStat{info: info, err: err, at: time.Now()}
+	c.mu.Unlock()
+}
+
+func (c *s3Cache) Stat(ctx context.Context, name string) (fs.FileInfo, error) {
+	path, err := c.path("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	s, ok := c.stats[name]
+	c.mu.Unlock()
+	if ok && time.Since(s.at) < cacheStatTTL {
+		return s.info, s.err
+	}
+	info, err := c.b.Stat(ctx, path)
+	if err == nil || errors.Is(err, fs.ErrNotExist) {
+		c.remember(name, info, err)
+	}
+	return info, err
+}
+
+func (c *s3Cache) Open(ctx context.Context, name string) (File, error) {
+	path, err := c.path("open", name)
+	if err != nil {
+		return nil, err
+	}
+	f, err := c.b.Open(ctx, path)
+	if errors.Is(err, fs.ErrNotExist) {
+		c.remember(name, nil, err)
+	}
+	return f, err
+}
+
+// Write stores data in one PUT, which S3 applies atomically.
+func (c *s3Cache) Write(ctx context.Context, name string, data []byte) error {
+	path, err := c.path("write", name)
+	if err != nil {
+		return err
+	}
+	if err := c.b.put(ctx, path, data); err != nil {
+		return err
+	}
+	c.remember(name, fileInfo{name: name, size: int64(len(data)), modTime: time.Now()}, nil)
+	return nil
+}
+
+func (c *s3Cache) Remove(ctx context.Context, name string) error {
+	path, err := c.path("remove", name)
+	if err != nil {
+		return err
+	}
+	if err := c.b.remove(ctx, path); err != nil {
+		return err
+	}
+	c.remember(name, nil, notExist("stat", path))
+	return nil
+}
+
+func (c *s3Cache) Clear(ctx context.Context) error {
+	err := c.b.Walk(ctx, func(path string, _ fs.FileInfo) error {
+		return c.b.remove(ctx, path)
+	})
+	c.mu.Lock()
+	c.stats = map[string]cachedStat{}
+	c.mu.Unlock()
+	return err
+}
@@ -0,0 +1,149 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// blockSize is how much a remote file is fetched at a time. Reading an
+	// EPUB's directory and package document takes a few small reads near
+	// the end and start of the file, which one block each covers.
+	blockSize = 256 << 10
+	// cachedBlocks is how many blocks an open file keeps.
+	cachedBlocks = 16
+	// requestTimeout bounds one request to a remote library.
+	requestTimeout = time.Minute
+)
+
+var httpClient = &http.Client{Timeout: requestTimeout}
+
+// fetchFunc returns n bytes of a remote file from off.
+type fetchFunc func(ctx context.Context, off, n int64) (io.ReadCloser, error)
+
+// rangeFile reads a remote file with ranged GETs, fetched a block at a time
+// and cached, so the small scattered reads of a zip archive don't each
+// cost a request.
+type rangeFile struct {
+	ctx   context.Context
+	info  fileInfo
+	fetch fetchFunc
+
+	mu     sync.Mutex
+	blocks map[int64][]byte
+	order  []int64
+	off    int64
+}
+
+func newRangeFile(ctx context.Context, info fileInfo, fetch fetchFunc) *rangeFile {
+	return &rangeFile{ctx: ctx, info: info, fetch: fetch, blocks: map[int64][]byte{}}
+}
+
+func (f *rangeFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+
+func (f *rangeFile) Close() error {
+	f.mu.Lock()
+	f.blocks, f.order = map[int64][]byte{}, nil
+	f.mu.Unlock()
+	return nil
+}
+
+// block returns block i, fetching it if it isn't cached. f.mu is held.
+func (f *rangeFile) block(i int64) ([]byte, error) {
+	if b, ok := f.blocks[i]; ok {
+		return b, nil
+	}
+	start := i * blockSize
+	n := min(blockSize, f.info.size-start)
+	body, err := f.fetch(f.ctx, start, n)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	b := make([]byte, n)
+	if _, err := io.ReadFull(body, b); err != nil {
+		return nil, fmt.Errorf("storage: reading %s: %w", f.info.name, err)
+	}
+	if len(f.order) >= cachedBlocks {
+		delete(f.blocks, f.order[0])
+		f.order = f.order[1:]
+	}
+	f.blocks[i] = b
+	f.order = append(f.order, i)
+	return b, nil
+}
+
+func (f *rangeFile) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("storage: negative offset")
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	read := 0
+	for read < len(p) {
+		pos := off + int64(read)
+		if pos >= f.info.size {
+			return read, io.EOF
+		}
+		b, err := f.block(pos / blockSize)
+		if err != nil {
+			return read, err
+		}
+		read += copy(p[read:], b[pos%blockSize:])
+	}
+	return read, nil
+}
+
+func (f *rangeFile) Read(p []byte) (int, error) {
+	n, err := f.ReadAt(p, f.off)
+	f.off += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *rangeFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.off
+	case io.SeekEnd:
+		offset += f.info.size
+	default:
+		return 0, errors.New("storage: invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("storage: negative position")
+	}
+	f.off = offset
+	return offset, nil
+}
+
+// getRange sends req for n bytes from off and checks that the server
+// returned them.
+func getRange(req *http.Request, off, n int64) (io.ReadCloser, error) {
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", off, off+n-1))
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case resp.StatusCode == http.StatusPartialContent:
+		return resp.Body, nil
+	case resp.StatusCode == http.StatusOK && off == 0:
+		// The whole file, from a server that ignores ranges.
+		return resp.Body, nil
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusPreconditionFailed {
+		return nil, fmt.Errorf("storage: %s changed while it was being read", req.URL.Redacted())
+	}
+	return nil, fmt.Errorf("storage: GET %s: %s", req.URL.Redacted(), resp.Status)
+}
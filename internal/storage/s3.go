@@ -0,0 +1,321 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// emptySHA256 is the hash of an empty request body.
+const emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// s3Backend reads a bucket, or a prefix of one, over the S3 REST API.
+// Requests are signed with AWS Signature Version 4 when keys are set, and
+// sent unsigned for public buckets otherwise.
+type s3Backend struct {
+	root     string // s3://bucket/prefix
+	bucket   string
+	prefix   string // "" or ending in "/"
+	endpoint *url.URL
+	region   string
+	keyID    string
+	secret   string
+}
+
+func newS3Backend(root string, opts Options) (*s3Backend, error) {
+	_, bucket, prefix := splitRemote(root)
+	if bucket == "" {
+		return nil, fmt.Errorf("storage: %q names no bucket", root)
+	}
+	b := &s3Backend{root: root, bucket: bucket, region: opts.S3Region, keyID: opts.S3AccessKeyID, secret: opts.S3SecretKey}
+	if prefix = strings.Trim(prefix, "/"); prefix != "" {
+		b.prefix = prefix + "/"
+	}
+	if b.region == "" {
+		b.region = "us-east-1"
+	}
+	if opts.S3Endpoint != "" {
+		u, err := url.Parse(strings.TrimRight(opts.S3Endpoint, "/"))
+		if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+			return nil, fmt.Errorf("storage: S3_ENDPOINT %q is not an http(s) URL", opts.S3Endpoint)
+		}
+		b.endpoint = u
+	}
+	if (b.keyID == "") != (b.secret == "") {
+		return nil, fmt.Errorf("storage: S3_ACCESS_KEY_ID and S3_SECRET_ACCESS_KEY must be set together")
+	}
+	return b, nil
+}
+
+// objectURL addresses key in the bucket: path-style on a custom endpoint,
+// which S3-compatible services expect, and virtual-hosted on Amazon S3.
+func (b *s3Backend) objectURL(key string) *url.URL {
+	u := &url.URL{Scheme: "https", Host: fmt.Sprintf("%s.s3.%s.amazonaws.com", b.bucket, b.region), Path: "/" + key}
+	if b.endpoint != nil {
+		u = &url.URL{Scheme: b.endpoint.Scheme, Host: b.endpoint.Host, Path: b.endpoint.Path + "/" + b.bucket}
+		if key != "" {
+			u.Path += "/" + key
+		}
+	}
+	u.RawPath = awsEscape(u.Path, true)
+	return u
+}
+
+func (b *s3Backend) key(path string) string {
+	_, _, rest := splitRemote(path)
+	return strings.TrimPrefix(rest, "/")
+}
+
+// request makes a signed request for u with body, which may be nil.
+func (b *s3Backend) request(ctx context.Context, method string, u *url.URL, body []byte) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	payloadHash := emptySHA256
+	if len(body) > 0 {
+		sum := sha256.Sum256(body)
+		payloadHash = hex.EncodeToString(sum[:])
+	}
+	b.sign(req, time.Now(), payloadHash)
+	return req, nil
+}
+
+// sign adds AWS Signature Version 4 headers to req, whose body hashes to
+// payloadHash.
+func (b *s3Backend) sign(req *http.Request, now time.Time, payloadHash string) {
+	if b.keyID == "" {
+		return
+	}
+	stamp := now.UTC().Format("20060102T150405Z")
+	day := stamp[:8]
+	req.Header.Set("x-amz-date", stamp)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+
+	const signedHeaders = "host;x-amz-content-sha256;x-amz-date"
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		"host:" + req.URL.Host,
+		"x-amz-content-sha256:" + payloadHash,
+		"x-amz-date:" + stamp,
+		"",
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := day + "/" + b.region + "/s3/aws4_request"
+	digest := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + stamp + "\n" + scope + "\n" + hex.EncodeToString(digest[:])
+
+	key := hmacSHA256([]byte("AWS4"+b.secret), day)
+	key = hmacSHA256(key, b.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", b.keyID, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// awsEscape percent-encodes s as Signature Version 4 requires: every byte
+// but letters, digits, and -_.~, and slashes too unless keepSlash.
+func awsEscape(s string, keepSlash bool) string {
+	var out strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			out.WriteByte(c)
+		case c == '/' && keepSlash:
+			out.WriteByte(c)
+		default:
+			fmt.Fprintf(&out, "%%%02X", c)
+		}
+	}
+	return out.String()
+}
+
+// awsQuery encodes query parameters sorted by name, as both the request
+// and its signature need them.
+func awsQuery(params map[string]string) string {
+	names := make([]string, 0, len(params))
+	for name := range params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	parts := make([]string, len(names))
+	for i, name := range names {
+		parts[i] = awsEscape(name, false) + "=" + awsEscape(params[name], false)
+	}
+	return strings.Join(parts, "&")
+}
+
+type s3ListResult struct {
+	Contents []struct {
+		Key          string    `xml:"Key"`
+		LastModified time.Time `xml:"LastModified"`
+		Size         int64     `xml:"Size"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// Walk lists the objects under the prefix with ListObjectsV2, which
+// returns keys in UTF-8 order.
+func (b *s3Backend) Walk(ctx context.Context, fn func(path string, info fs.FileInfo) error) error {
+	token := ""
+	for {
+		params := map[string]string{"list-type": "2"}
+		if b.prefix != "" {
+			params["prefix"] = b.prefix
+		}
+		if token != "" {
+			params["continuation-token"] = token
+		}
+		u := b.objectURL("")
+		u.RawQuery = awsQuery(params)
+		req, err := b.request(ctx, http.MethodGet, u, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			return err
+		}
+		var result s3ListResult
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return fmt.Errorf("storage: listing %s: %s", b.root, resp.Status)
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("storage: listing %s: %w", b.root, err)
+		}
+		for _, obj := range result.Contents {
+			if strings.HasSuffix(obj.Key, "/") {
+				continue
+			}
+			path := "s3://" + b.bucket + "/" + obj.Key
+			if err := fn(path, fileInfo{name: baseName(obj.Key), size: obj.Size, modTime: obj.LastModified}); err != nil {
+				return err
+			}
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+func (b *s3Backend) head(ctx context.Context, path string) (fileInfo, string, error) {
+	req, err := b.request(ctx, http.MethodHead, b.objectURL(b.key(path)), nil)
+	if err != nil {
+		return fileInfo{}, "", err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return fileInfo{}, "", err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return fileInfo{}, "", notExist("stat", path)
+	default:
+		return fileInfo{}, "", fmt.Errorf("storage: HEAD %s: %s", path, resp.Status)
+	}
+	size, err := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
+	if err != nil {
+		return fileInfo{}, "", fmt.Errorf("storage: HEAD %s: no length", path)
+	}
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return fileInfo{name: baseName(path), size: size, modTime: modTime}, resp.Header.Get("ETag"), nil
+}
+
+func (b *s3Backend) Stat(ctx context.Context, path string) (fs.FileInfo, error) {
+	info, _, err := b.head(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// Open reads the object in ranges, each made conditional on the ETag it
+// had when opened so a replaced object fails loudly instead of mixing
+// two versions.
+func (b *s3Backend) Open(ctx context.Context, path string) (File, error) {
+	info, etag, err := b.head(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	u := b.objectURL(b.key(path))
+	return newRangeFile(ctx, info, func(ctx context.Context, off, n int64) (io.ReadCloser, error) {
+		req, err := b.request(ctx, http.MethodGet, u, nil)
+		if err != nil {
+			return nil, err
+		}
+		if etag != "" {
+			req.Header.Set("If-Match", etag)
+		}
+		return getRange(req, off, n)
+	}), nil
+}
+
+// put stores data as the object at path.
+func (b *s3Backend) put(ctx context.Context, path string, data []byte) error {
+	req, err := b.request(ctx, http.MethodPut, b.objectURL(b.key(path)), data)
+	if err != nil {
+		return err
+	}
+	if t := mime.TypeByExtension(filepath.Ext(path)); t != "" {
+		req.Header.Set("Content-Type", t)
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("storage: PUT %s: %s", path, resp.Status)
+	}
+	return nil
+}
+
+// remove deletes the object at path. S3 succeeds whether or not there was
+// one.
+func (b *s3Backend) remove(ctx context.Context, path string) error {
+	req, err := b.request(ctx, http.MethodDelete, b.objectURL(b.key(path)), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNoContent, http.StatusNotFound:
+		return nil
+	}
+	return fmt.Errorf("storage: DELETE %s: %s", path, resp.Status)
+}
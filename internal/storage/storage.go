@@ -0,0 +1,213 @@
+// Package storage reads book files wherever the library keeps them: on the
+// local disk, or in a read-only remote library on S3-compatible object
+// storage or a WebDAV server. Local paths are plain file paths; remote
+// ones are URLs such as s3://bucket/books/Dune.epub, so a book's stored
+// path says where to find it. It also holds the cover cache, on the local
+// disk or in S3.
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrReadOnly is returned for writes to a book in a remote library.
+var ErrReadOnly = errors.New("storage: remote libraries are read-only")
+
+// File is a book file opened for reading. *os.File is one.
+type File interface {
+	io.ReadSeekCloser
+	io.ReaderAt
+	Stat() (fs.FileInfo, error)
+}
+
+// Backend lists and reads the files of one remote library.
+type Backend interface {
+	// Walk calls fn with every file in the library, in path order.
+	Walk(ctx context.Context, fn func(path string, info fs.FileInfo) error) error
+	// Stat describes one file, with an error matching fs.ErrNotExist if
+	// there is none.
+	Stat(ctx context.Context, path string) (fs.FileInfo, error)
+	// Open opens one file. Reads made through it use ctx.
+	Open(ctx context.Context, path string) (File, error)
+}
+
+// Options holds the credentials remote libraries use.
+type Options struct {
+	// S3Endpoint is the base URL of an S3-compatible service, such as
+	// http://minio:9000; empty means Amazon S3 itself.
+	S3Endpoint     string
+	S3Region       string
+	S3AccessKeyID  string
+	S3SecretKey    string
+	WebDAVUsername string
+	WebDAVPassword string
+}
+
+var (
+	mu       sync.RWMutex
+	backends = map[string]Backend{}
+)
+
+var remoteSchemes = []string{"s3://", "webdav://", "webdavs://"}
+
+// IsRemote reports whether path names a file in a remote library.
+func IsRemote(path string) bool {
+	for _, scheme := range remoteSchemes {
+		if strings.HasPrefix(path, scheme) {
+			return true
+		}
+	}
+	return false
+}
+
+// Configure sets up a backend for each remote library root, replacing any
+// set up before.
+func Configure(roots []string, opts Options) error {
+	configured := map[string]Backend{}
+	for _, root := range roots {
+		root = strings.TrimRight(strings.TrimSpace(root), "/")
+		if root == "" {
+			continue
+		}
+		var b Backend
+		var err error
+		switch {
+		case strings.HasPrefix(root, "s3://"):
+			b, err = newS3Backend(root, opts)
+		case strings.HasPrefix(root, "webdav://"), strings.HasPrefix(root, "webdavs://"):
+			b, err = newWebDAVBackend(root, opts)
+		default:
+			err = fmt.Errorf("storage: %q is not an s3://, webdav://, or webdavs:// URL", root)
+		}
+		if err != nil {
+			return err
+		}
+		configured[root] = b
+	}
+	mu.Lock()
+	backends = configured
+	mu.Unlock()
+	return nil
+}
+
+// ConfigureFromEnv sets up the remote libraries listed in
+// REMOTE_LIBRARIES and the cover cache in COVER_CACHE, with credentials
+// from S3_* and WEBDAV_*.
+func ConfigureFromEnv() error {
+	var roots []string
+	for _, root := range strings.Split(os.Getenv("REMOTE_LIBRARIES"), ",") {
+		if root = strings.TrimSpace(root); root != "" {
+			roots = append(roots, root)
+		}
+	}
+	opts := Options{
+		S3Endpoint:     strings.TrimSpace(os.Getenv("S3_ENDPOINT")),
+		S3Region:       strings.TrimSpace(os.Getenv("S3_REGION")),
+		S3AccessKeyID:  strings.TrimSpace(os.Getenv("S3_ACCESS_KEY_ID")),
+		S3SecretKey:    os.Getenv("S3_SECRET_ACCESS_KEY"),
+		WebDAVUsername: os.Getenv("WEBDAV_USERNAME"),
+		WebDAVPassword: os.Getenv("WEBDAV_PASSWORD"),
+	}
+	if err := Configure(roots, opts); err != nil {
+		return err
+	}
+	return ConfigureCovers(os.Getenv("COVER_CACHE"), opts)
+}
+
+// Roots lists the configured remote library roots, sorted.
+func Roots() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+	roots := make([]string, 0, len(backends))
+	for root := range backends {
+		roots = append(roots, root)
+	}
+	sort.Strings(roots)
+	return roots
+}
+
+// backendFor finds the library path belongs to.
+func backendFor(path string) (Backend, error) {
+	mu.RLock()
+	defer mu.RUnlock()
+	for root, b := range backends {
+		if path == root || strings.HasPrefix(path, root+"/") {
+			return b, nil
+		}
+	}
+	return nil, &fs.PathError{Op: "open", Path: path, Err: errors.New("not in a configured remote library")}
+}
+
+// Open opens a local or remote file for reading.
+func Open(ctx context.Context, path string) (File, error) {
+	if !IsRemote(path) {
+		return os.Open(path)
+	}
+	b, err := backendFor(path)
+	if err != nil {
+		return nil, err
+	}
+	return b.Open(ctx, path)
+}
+
+// Stat describes a local or remote file.
+func Stat(ctx context.Context, path string) (fs.FileInfo, error) {
+	if !IsRemote(path) {
+		return os.Stat(path)
+	}
+	b, err := backendFor(path)
+	if err != nil {
+		return nil, err
+	}
+	return b.Stat(ctx, path)
+}
+
+// Walk calls fn with every file in the remote library at root, in path
+// order.
+func Walk(ctx context.Context, root string, fn func(path string, info fs.FileInfo) error) error {
+	b, err := backendFor(root)
+	if err != nil {
+		return err
+	}
+	return b.Walk(ctx, fn)
+}
+
+// fileInfo describes a remote file.
+type fileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+func (fi fileInfo) Name() string       { return fi.name }
+func (fi fileInfo) Size() int64        { return fi.size }
+func (fi fileInfo) Mode() fs.FileMode  { return 0444 }
+func (fi fileInfo) ModTime() time.Time { return fi.modTime }
+func (fi fileInfo) IsDir() bool        { return false }
+func (fi fileInfo) Sys() any           { return nil }
+
+func baseName(path string) string {
+	return path[strings.LastIndex(path, "/")+1:]
+}
+
+// splitRemote splits a remote path such as webdavs://host/dav/a.epub into
+// its scheme, host, and unescaped path ("/dav/a.epub"). Remote paths are
+// stored unescaped, so they are split by hand rather than parsed as URLs.
+func splitRemote(path string) (scheme, host, rest string) {
+	scheme, rest, _ = strings.Cut(path, "://")
+	host, rest, _ = strings.Cut(rest, "/")
+	return scheme, host, "/" + rest
+}
+
+func notExist(op, path string) error {
+	return &fs.PathError{Op: op, Path: path, Err: fs.ErrNotExist}
+}
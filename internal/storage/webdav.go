@@ -0,0 +1,206 @@
+package storage
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const propfindBody = `<?xml version="1.0" encoding="utf-8"?>
+<propfind xmlns="DAV:"><prop><resourcetype/><getcontentlength/><getlastmodified/><getetag/></prop></propfind>`
+
+// webdavBackend reads a folder on a WebDAV server: webdav:// is reached
+// over http and webdavs:// over https.
+type webdavBackend struct {
+	root     string
+	scheme   string // webdav or webdavs
+	host     string
+	dir      string // unescaped, without a trailing slash
+	username string
+	password string
+}
+
+func newWebDAVBackend(root string, opts Options) (*webdavBackend, error) {
+	scheme, host, dir := splitRemote(root)
+	if host == "" {
+		return nil, fmt.Errorf("storage: %q names no host", root)
+	}
+	return &webdavBackend{root: root, scheme: scheme, host: host, dir: strings.TrimRight(dir, "/"), username: opts.WebDAVUsername, password: opts.WebDAVPassword}, nil
+}
+
+// httpURL is the address of a file or folder, given its unescaped path on
+// the server.
+func (b *webdavBackend) httpURL(dir string) string {
+	u := url.URL{Scheme: "http", Host: b.host, Path: dir}
+	if b.scheme == "webdavs" {
+		u.Scheme = "https"
+	}
+	return u.String()
+}
+
+func (b *webdavBackend) request(ctx context.Context, method, dir string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, b.httpURL(dir), body)
+	if err != nil {
+		return nil, err
+	}
+	if b.username != "" || b.password != "" {
+		req.SetBasicAuth(b.username, b.password)
+	}
+	return req, nil
+}
+
+type davMultistatus struct {
+	Responses []struct {
+		Href     string `xml:"DAV: href"`
+		Propstat []struct {
+			Status string `xml:"DAV: status"`
+			Prop   struct {
+				ResourceType struct {
+					Collection *struct{} `xml:"DAV: collection"`
+				} `xml:"DAV: resourcetype"`
+				ContentLength string `xml:"DAV: getcontentlength"`
+				LastModified  string `xml:"DAV: getlastmodified"`
+				ETag          string `xml:"DAV: getetag"`
+			} `xml:"DAV: prop"`
+		} `xml:"DAV: propstat"`
+	} `xml:"DAV: response"`
+}
+
+// davEntry is one resource from a PROPFIND listing.
+type davEntry struct {
+	path string // unescaped path on the server
+	dir  bool
+	info fileInfo
+	etag string
+}
+
+// propfind lists dir itself (depth "0") or its children as well ("1").
+func (b *webdavBackend) propfind(ctx context.Context, dir, depth string) ([]davEntry, error) {
+	req, err := b.request(ctx, "PROPFIND", dir, strings.NewReader(propfindBody))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Depth", depth)
+	req.Header.Set("Content-Type", "application/xml; charset=utf-8")
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusMultiStatus:
+	case http.StatusNotFound:
+		return nil, notExist("propfind", b.scheme+"://"+b.host+dir)
+	default:
+		return nil, fmt.Errorf("storage: PROPFIND %s: %s", b.httpURL(dir), resp.Status)
+	}
+	var ms davMultistatus
+	if err := xml.NewDecoder(resp.Body).Decode(&ms); err != nil {
+		return nil, fmt.Errorf("storage: PROPFIND %s: %w", b.httpURL(dir), err)
+	}
+	entries := make([]davEntry, 0, len(ms.Responses))
+	for _, r := range ms.Responses {
+		// Servers give hrefs as escaped paths or as full URLs.
+		u, err := url.Parse(strings.TrimSpace(r.Href))
+		if err != nil {
+			continue
+		}
+		e := davEntry{path: u.Path}
+		for _, ps := range r.Propstat {
+			if !strings.Contains(ps.Status, " 200 ") {
+				continue
+			}
+			e.dir = ps.Prop.ResourceType.Collection != nil
+			e.info.name = baseName(strings.TrimRight(u.Path, "/"))
+			e.info.size, _ = strconv.ParseInt(strings.TrimSpace(ps.Prop.ContentLength), 10, 64)
+			e.info.modTime, _ = http.ParseTime(strings.TrimSpace(ps.Prop.LastModified))
+			e.etag = strings.TrimSpace(ps.Prop.ETag)
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// Walk lists the folder tree one level at a time, as many servers refuse
+// "Depth: infinity", and calls fn with the files in path order.
+func (b *webdavBackend) Walk(ctx context.Context, fn func(path string, info fs.FileInfo) error) error {
+	var files []davEntry
+	pending := []string{b.dir + "/"}
+	for len(pending) > 0 {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		dir := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		entries, err := b.propfind(ctx, dir, "1")
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if strings.TrimRight(e.path, "/") == strings.TrimRight(dir, "/") {
+				continue
+			}
+			if e.dir {
+				if !strings.HasPrefix(e.info.name, ".") {
+					pending = append(pending, strings.TrimRight(e.path, "/")+"/")
+				}
+				continue
+			}
+			files = append(files, e)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].path < files[j].path })
+	for _, e := range files {
+		if err := fn(b.scheme+"://"+b.host+e.path, e.info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *webdavBackend) stat(ctx context.Context, path string) (davEntry, error) {
+	_, _, dir := splitRemote(path)
+	entries, err := b.propfind(ctx, dir, "0")
+	if err != nil {
+		return davEntry{}, err
+	}
+	if len(entries) == 0 || entries[0].dir {
+		return davEntry{}, notExist("stat", path)
+	}
+	return entries[0], nil
+}
+
+func (b *webdavBackend) Stat(ctx context.Context, path string) (fs.FileInfo, error) {
+	e, err := b.stat(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	return e.info, nil
+}
+
+// Open reads the file in ranges, each made conditional on the ETag it had
+// when opened, if the server gives one.
+func (b *webdavBackend) Open(ctx context.Context, path string) (File, error) {
+	e, err := b.stat(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	_, _, dir := splitRemote(path)
+	return newRangeFile(ctx, e.info, func(ctx context.Context, off, n int64) (io.ReadCloser, error) {
+		req, err := b.request(ctx, http.MethodGet, dir, nil)
+		if err != nil {
+			return nil, err
+		}
+		if e.etag != "" {
+			req.Header.Set("If-Match", e.etag)
+		}
+		return getRange(req, off, n)
+	}), nil
+}
@@ -0,0 +1,80 @@
+// Package systemd implements the parts of the sd_notify protocol GoPDS uses
+// when it runs as a Type=notify unit: readiness, stopping, and watchdog
+// keep-alives. Outside systemd NOTIFY_SOCKET is unset and everything here is
+// a no-op.
+package systemd
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Notify sends state (such as "READY=1") to the service manager. It reports
+// false without error when not running under systemd.
+func Notify(state string) (bool, error) {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return false, nil
+	}
+	// A leading @ names an abstract socket, which net handles itself.
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// WatchdogInterval is the WatchdogSec= of the unit, or 0 if the watchdog is
+// off or meant for another process.
+func WatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(strings.TrimSpace(os.Getenv("WATCHDOG_USEC")), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := strings.TrimSpace(os.Getenv("WATCHDOG_PID")); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// RunWatchdog sends WATCHDOG=1 twice per watchdog interval for as long as
+// check passes, until ctx is cancelled. When check fails the ping is
+// withheld, so if the process stays wedged systemd kills and restarts it.
+// It returns at once if the watchdog is not enabled.
+func RunWatchdog(ctx context.Context, check func(context.Context) error) {
+	interval := WatchdogInterval()
+	if interval == 0 {
+		return
+	}
+	period := interval / 2
+	slog.Info("systemd watchdog enabled", "interval", interval)
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	for {
+		checkCtx, cancel := context.WithTimeout(ctx, period)
+		err := check(checkCtx)
+		cancel()
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			slog.Warn("liveness check failed; withholding systemd watchdog ping", "err", err)
+		} else if _, err := Notify("WATCHDOG=1"); err != nil {
+			slog.Warn("failed to ping systemd watchdog", "err", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,223 @@
+// Package upstream builds the HTTP client GoPDS uses for external metadata
+// and cover providers (Open Library, Google Books, Wikipedia). Every lookup
+// goes through the same client so that timeouts, proxying, retries, and
+// politeness towards each host are configured in one place:
+//
+//   - UPSTREAM_TIMEOUT_SECONDS (default 20): limit on each attempt, from
+//     connecting until the response body has been read.
+//   - UPSTREAM_PROXY (optional): http://, https://, socks5://, or socks5h://
+//     proxy URL. Without it the standard HTTPS_PROXY/HTTP_PROXY/NO_PROXY
+//     variables apply.
+//   - UPSTREAM_RETRIES (default 2): extra attempts for GET and HEAD requests
+//     that fail to connect or get 429 or a 5xx, with exponential backoff
+//     from 500ms that honors Retry-After.
+//   - UPSTREAM_HOST_RATE (default 5): requests per second to any one host;
+//     0 removes the limit.
+package upstream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ab0oo/gopds/internal/metrics"
+)
+
+const (
+	defaultTimeout  = 20 * time.Second
+	defaultRetries  = 2
+	defaultHostRate = 5
+	baseBackoff     = 500 * time.Millisecond
+	maxBackoff      = 10 * time.Second
+)
+
+// FromEnv returns a client configured from the UPSTREAM_* variables. It
+// fails only if UPSTREAM_PROXY is not a usable URL.
+func FromEnv() (*http.Client, error) {
+	base := http.DefaultTransport.(*http.Transport).Clone()
+	proxy := strings.TrimSpace(os.Getenv("UPSTREAM_PROXY"))
+	if proxy != "" {
+		u, err := url.Parse(proxy)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("UPSTREAM_PROXY %q is not a proxy URL", proxy)
+		}
+		switch u.Scheme {
+		case "http", "https", "socks5", "socks5h":
+		default:
+			return nil, fmt.Errorf("UPSTREAM_PROXY scheme %q is not http, https, socks5, or socks5h", u.Scheme)
+		}
+		base.Proxy = http.ProxyURL(u)
+	}
+
+	timeout := time.Duration(envInt("UPSTREAM_TIMEOUT_SECONDS", int(defaultTimeout/time.Second))) * time.Second
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	t := &transport{
+		next:     metrics.InstrumentUpstream(base),
+		timeout:  timeout,
+		retries:  envInt("UPSTREAM_RETRIES", defaultRetries),
+		hostRate: envInt("UPSTREAM_HOST_RATE", defaultHostRate),
+		nextSlot: map[string]time.Time{},
+	}
+	if proxy != "" {
+		slog.Info("upstream lookups use a proxy", "proxy", redact(proxy))
+	}
+	return &http.Client{Transport: t}, nil
+}
+
+func envInt(name string, fallback int) int {
+	raw := strings.TrimSpace(os.Getenv(name))
+	if raw == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(raw)
+	if err != nil || n < 0 {
+		slog.Warn("ignoring invalid setting", "env", name, "value", raw)
+		return fallback
+	}
+	return n
+}
+
+// redact hides proxy credentials from logs.
+func redact(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return raw
+	}
+	return u.Redacted()
+}
+
+// transport applies the per-attempt timeout, per-host pacing, and retries
+// on top of the instrumented base transport.
+type transport struct {
+	next     http.RoundTripper
+	timeout  time.Duration
+	retries  int
+	hostRate int
+
+	mu       sync.Mutex
+	nextSlot map[string]time.Time
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	attempts := 1
+	if req.Method == http.MethodGet || req.Method == http.MethodHead {
+		attempts += t.retries
+	}
+	ctx := req.Context()
+	for attempt := 1; ; attempt++ {
+		if err := t.wait(ctx, req.URL.Hostname()); err != nil {
+			return nil, err
+		}
+		res, err := t.try(req)
+		if attempt >= attempts || !retryable(res, err) || ctx.Err() != nil {
+			return res, err
+		}
+		delay := backoff(attempt, res)
+		if res != nil {
+			io.Copy(io.Discard, io.LimitReader(res.Body, 4096))
+			res.Body.Close()
+		}
+		slog.DebugContext(ctx, "upstream: retrying", "host", req.URL.Hostname(), "attempt", attempt, "delay", delay, "status", statusOf(res), "err", err)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+// try makes one attempt under its own deadline, which stays in force until
+// the caller closes the body.
+func (t *transport) try(req *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithTimeout(req.Context(), t.timeout)
+	attempt := req.Clone(ctx)
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		attempt.Body = body
+	}
+	res, err := t.next.RoundTrip(attempt)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	res.Body = cancelOnClose{ReadCloser: res.Body, cancel: cancel}
+	return res, nil
+}
+
+// wait blocks until host may be sent another request.
+func (t *transport) wait(ctx context.Context, host string) error {
+	if t.hostRate <= 0 {
+		return nil
+	}
+	t.mu.Lock()
+	now := time.Now()
+	slot := t.nextSlot[host]
+	if slot.Before(now) {
+		slot = now
+	}
+	t.nextSlot[host] = slot.Add(time.Second / time.Duration(t.hostRate))
+	t.mu.Unlock()
+
+	delay := time.Until(slot)
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+func retryable(res *http.Response, err error) bool {
+	if err != nil {
+		return !errors.Is(err, context.Canceled)
+	}
+	return res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= 500
+}
+
+func backoff(attempt int, res *http.Response) time.Duration {
+	delay := baseBackoff << (attempt - 1)
+	if res != nil {
+		if secs, err := strconv.Atoi(strings.TrimSpace(res.Header.Get("Retry-After"))); err == nil && secs >= 0 {
+			delay = time.Duration(secs) * time.Second
+		}
+	}
+	return min(delay, maxBackoff)
+}
+
+func statusOf(res *http.Response) int {
+	if res == nil {
+		return 0
+	}
+	return res.StatusCode
+}
+
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
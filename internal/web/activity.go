@@ -0,0 +1,104 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ab0oo/gopds/internal/database"
+	"github.com/ab0oo/gopds/internal/i18n"
+	"github.com/ab0oo/gopds/internal/webhooks"
+)
+
+// activityRetention is how long the activity feed keeps events.
+const activityRetention = 90 * 24 * time.Hour
+
+// maxActivityPage caps the limit an /api/activity request may ask for.
+const maxActivityPage = 500
+
+// activityEvents are the webhook events that are also library activity.
+// Downloads are left out: they say nothing about the library and would
+// drown out everything else.
+var activityEvents = []string{webhooks.EventBookAdded, webhooks.EventBookRemoved, webhooks.EventMetadataChanged, webhooks.EventScanCompleted}
+
+type activityPayload struct {
+	Activity []database.Activity `json:"activity"`
+}
+
+// publish records a library event in the activity feed and sends it to the
+// webhooks subscribed to it, so the two always carry the same payload.
+// bookID is 0 for events that aren't about one book.
+func (s *Server) publish(ctx context.Context, event string, bookID int, data any) {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to encode activity", "event", event, "err", err)
+	} else if _, err := s.db.AddActivity(database.Activity{Event: event, BookID: bookID, Data: raw}); err != nil {
+		slog.ErrorContext(ctx, "failed to record activity", "event", event, "err", err)
+	}
+	s.hooks.Emit(ctx, event, data)
+}
+
+// HandleActivity lists recent library events, newest first, a page at a
+// time. A Link header points to the next, older page while there is one.
+func (s *Server) HandleActivity(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	f := database.ActivityFilter{Limit: 50}
+	if raw := strings.TrimSpace(q.Get("limit")); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > maxActivityPage {
+			http.Error(w, i18n.T("limit must be between 1 and %d", maxActivityPage), http.StatusBadRequest)
+			return
+		}
+		f.Limit = n
+	}
+	if raw := strings.TrimSpace(q.Get("before")); raw != "" {
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || n < 1 {
+			http.Error(w, i18n.T("Invalid before cursor"), http.StatusBadRequest)
+			return
+		}
+		f.Before = n
+	}
+	if raw := strings.TrimSpace(q.Get("book")); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 {
+			http.Error(w, i18n.T("Invalid book ID"), http.StatusBadRequest)
+			return
+		}
+		f.BookID = n
+	}
+	if f.Event = strings.TrimSpace(q.Get("event")); f.Event != "" && !slices.Contains(activityEvents, f.Event) {
+		http.Error(w, i18n.T("Unknown event"), http.StatusBadRequest)
+		return
+	}
+
+	// One extra row says whether there is another page.
+	want := f.Limit
+	f.Limit++
+	entries, err := s.db.ListActivity(f)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to list activity", "err", err)
+		http.Error(w, i18n.T("Internal Server Error"), http.StatusInternalServerError)
+		return
+	}
+	if len(entries) > want {
+		entries = entries[:want]
+		next := url.Values{}
+		for k, v := range q {
+			next[k] = v
+		}
+		next.Set("limit", fmt.Sprint(want))
+		next.Set("before", fmt.Sprint(entries[len(entries)-1].ID))
+		w.Header().Set("Link", fmt.Sprintf(`<%s?%s>; rel="next"`, r.URL.Path, next.Encode()))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(activityPayload{Activity: entries})
+}
@@ -0,0 +1,89 @@
+package web
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/ab0oo/gopds/internal/i18n"
+)
+
+// adultRequest sets or clears an admin's adult-content decision. Adult is
+// required; null hands the decision back to the book's subjects.
+type adultRequest struct {
+	Adult *bool `json:"adult"`
+}
+
+type adultPayload struct {
+	// Adult is whether the book is flagged now.
+	Adult bool `json:"adult"`
+	// FromSubjects is what the book's subjects say.
+	FromSubjects bool `json:"from_subjects"`
+	// Override is the admin's decision, or null if the subjects decide.
+	Override *bool `json:"override"`
+}
+
+// HandleSetBookAdult flags a book as adult content, or clears the flag,
+// regardless of its subjects.
+func (s *Server) HandleSetBookAdult(w http.ResponseWriter, r *http.Request) {
+	book, ok := s.loadBook(w, r)
+	if !ok {
+		return
+	}
+	var raw map[string]json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&raw); err != nil {
+		http.Error(w, i18n.T("Invalid JSON body"), http.StatusBadRequest)
+		return
+	}
+	value, present := raw["adult"]
+	if !present {
+		http.Error(w, i18n.T("adult is required"), http.StatusBadRequest)
+		return
+	}
+	var req adultRequest
+	if err := json.Unmarshal(value, &req.Adult); err != nil {
+		http.Error(w, i18n.T("adult must be true, false, or null"), http.StatusBadRequest)
+		return
+	}
+	if _, err := s.db.SetBookAdultOverride(book.ID, req.Adult); err != nil {
+		http.Error(w, i18n.T("Failed to update book"), http.StatusInternalServerError)
+		return
+	}
+	override := "subjects"
+	if req.Adult != nil {
+		override = strconv.FormatBool(*req.Adult)
+	}
+	slog.InfoContext(r.Context(), "book adult flag changed", "book_id", book.ID, "override", override, "by", s.actorName(r))
+	s.writeBookAdult(w, book.ID)
+}
+
+// HandleBookAdult reports whether a book is flagged as adult content, and
+// why.
+func (s *Server) HandleBookAdult(w http.ResponseWriter, r *http.Request) {
+	book, ok := s.loadBook(w, r)
+	if !ok {
+		return
+	}
+	s.writeBookAdult(w, book.ID)
+}
+
+func (s *Server) writeBookAdult(w http.ResponseWriter, id int) {
+	subjects, err := s.db.GetBookSubjects(id)
+	if err != nil {
+		http.Error(w, i18n.T("Internal Server Error"), http.StatusInternalServerError)
+		return
+	}
+	override, err := s.db.BookAdultOverride(id)
+	if err != nil {
+		http.Error(w, i18n.T("Internal Server Error"), http.StatusInternalServerError)
+		return
+	}
+	payload := adultPayload{FromSubjects: s.genres.Adult(subjects), Override: override}
+	payload.Adult = payload.FromSubjects
+	if override != nil {
+		payload.Adult = *override
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(payload)
+}
@@ -0,0 +1,373 @@
+package web
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ab0oo/gopds/internal/database"
+	"github.com/ab0oo/gopds/internal/i18n"
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	maxLocatorLen        = 2000
+	maxAnnotationTextLen = 20000
+	defaultHighlight     = "yellow"
+)
+
+// highlightColors are the named colors KOReader and the web reader use;
+// any #rrggbb color is accepted too.
+var highlightColors = map[string]bool{
+	"yellow": true, "red": true, "orange": true, "green": true, "olive": true,
+	"cyan": true, "blue": true, "purple": true, "gray": true,
+}
+
+var hexColor = regexp.MustCompile(`^#[0-9a-f]{6}$`)
+
+type annotationRequest struct {
+	Locator string `json:"locator"`
+	Chapter string `json:"chapter"`
+	Text    string `json:"text"`
+	Note    string `json:"note"`
+	Color   string `json:"color"`
+}
+
+type annotationsPayload struct {
+	Annotations []database.Annotation `json:"annotations"`
+}
+
+type annotationImportPayload struct {
+	Added   int `json:"added"`
+	Skipped int `json:"skipped"`
+}
+
+// koreaderExport is a document in KOReader's JSON highlight export. A file
+// holds one document, a list of them, or {"documents": [...]} when all
+// books were exported at once.
+type koreaderExport struct {
+	Title     string            `json:"title"`
+	Author    string            `json:"author"`
+	Entries   []koreaderEntry   `json:"entries"`
+	Documents []*koreaderExport `json:"documents"`
+}
+
+type koreaderEntry struct {
+	Page    json.Number `json:"page"`
+	Time    int64       `json:"time"`
+	Chapter string      `json:"chapter"`
+	Text    string      `json:"text"`
+	Note    string      `json:"note"`
+	Color   string      `json:"color"`
+}
+
+// normalize trims req and checks its lengths and color. An empty color
+// means the default highlight. The error is meant for the client.
+func (req *annotationRequest) normalize() error {
+	req.Locator = strings.TrimSpace(req.Locator)
+	req.Chapter = strings.TrimSpace(req.Chapter)
+	req.Note = strings.TrimSpace(req.Note)
+	req.Color = strings.ToLower(strings.TrimSpace(req.Color))
+	if req.Color == "" {
+		req.Color = defaultHighlight
+	}
+	switch {
+	case req.Locator == "" || len(req.Locator) > maxLocatorLen:
+		return errors.New(i18n.T("Locator is required and must be at most %d characters", maxLocatorLen))
+	case req.Text == "" && req.Note == "":
+		return errors.New(i18n.T("An annotation needs highlighted text or a note"))
+	case len(req.Chapter) > maxLocatorLen || len(req.Text) > maxAnnotationTextLen || len(req.Note) > maxAnnotationTextLen:
+		return errors.New(i18n.T("Annotation text and notes must be at most %d characters", maxAnnotationTextLen))
+	case !highlightColors[req.Color] && !hexColor.MatchString(req.Color):
+		return errors.New(i18n.T("Unknown highlight color"))
+	}
+	return nil
+}
+
+func decodeAnnotationRequest(w http.ResponseWriter, r *http.Request) (annotationRequest, bool) {
+	var req annotationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, i18n.T("Invalid JSON body"), http.StatusBadRequest)
+		return req, false
+	}
+	if err := req.normalize(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return req, false
+	}
+	return req, true
+}
+
+// requestedBook resolves {id} to a book the caller may see, writing 404 if
+// it can't.
+func (s *Server) requestedBook(w http.ResponseWriter, r *http.Request) (*database.Book, bool) {
+	book, err := s.visibleBook(r, chi.URLParam(r, "id"))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, i18n.T("Book not found"), http.StatusNotFound)
+			return nil, false
+		}
+		http.Error(w, i18n.T("Internal Server Error"), http.StatusInternalServerError)
+		return nil, false
+	}
+	return book, true
+}
+
+// loadAnnotation resolves {annotationID} to one of the caller's
+// annotations, writing 400 or 404 if it can't.
+func (s *Server) loadAnnotation(w http.ResponseWriter, r *http.Request) (*database.Annotation, bool) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "annotationID"), 10, 64)
+	if err != nil {
+		http.Error(w, i18n.T("Invalid annotation ID"), http.StatusBadRequest)
+		return nil, false
+	}
+	a, err := s.db.GetAnnotation(s.shelfOwner(r), id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, i18n.T("Annotation not found"), http.StatusNotFound)
+			return nil, false
+		}
+		http.Error(w, i18n.T("Internal Server Error"), http.StatusInternalServerError)
+		return nil, false
+	}
+	return a, true
+}
+
+// HandleBookAnnotations lists the caller's annotations in one book.
+func (s *Server) HandleBookAnnotations(w http.ResponseWriter, r *http.Request) {
+	book, ok := s.requestedBook(w, r)
+	if !ok {
+		return
+	}
+	annotations, err := s.db.ListAnnotations(s.shelfOwner(r), book.ID)
+	if err != nil {
+		http.Error(w, i18n.T("Internal Server Error"), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(annotationsPayload{Annotations: annotations})
+}
+
+func (s *Server) HandleCreateAnnotation(w http.ResponseWriter, r *http.Request) {
+	book, ok := s.requestedBook(w, r)
+	if !ok {
+		return
+	}
+	req, ok := decodeAnnotationRequest(w, r)
+	if !ok {
+		return
+	}
+	a, err := s.db.CreateAnnotation(*book, database.Annotation{
+		Username: s.shelfOwner(r),
+		Locator:  req.Locator,
+		Chapter:  req.Chapter,
+		Text:     req.Text,
+		Note:     req.Note,
+		Color:    req.Color,
+	})
+	if err != nil {
+		http.Error(w, i18n.T("Failed to save annotation"), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(a)
+}
+
+func (s *Server) HandleUpdateAnnotation(w http.ResponseWriter, r *http.Request) {
+	a, ok := s.loadAnnotation(w, r)
+	if !ok {
+		return
+	}
+	req, ok := decodeAnnotationRequest(w, r)
+	if !ok {
+		return
+	}
+	a.Locator, a.Chapter, a.Text, a.Note, a.Color = req.Locator, req.Chapter, req.Text, req.Note, req.Color
+	if _, err := s.db.UpdateAnnotation(*a); err != nil {
+		http.Error(w, i18n.T("Failed to save annotation"), http.StatusInternalServerError)
+		return
+	}
+	updated, err := s.db.GetAnnotation(a.Username, a.ID)
+	if err != nil {
+		http.Error(w, i18n.T("Internal Server Error"), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(updated)
+}
+
+func (s *Server) HandleDeleteAnnotation(w http.ResponseWriter, r *http.Request) {
+	a, ok := s.loadAnnotation(w, r)
+	if !ok {
+		return
+	}
+	if _, err := s.db.DeleteAnnotation(a.Username, a.ID); err != nil {
+		http.Error(w, i18n.T("Failed to delete annotation"), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleListAnnotations returns all of the caller's annotations, or one
+// book's with ?book=, grouped by book. ?format=markdown exports them as a
+// Markdown file instead.
+func (s *Server) HandleListAnnotations(w http.ResponseWriter, r *http.Request) {
+	bookID := 0
+	if raw := r.URL.Query().Get("book"); raw != "" {
+		id, err := strconv.Atoi(raw)
+		if err != nil || id < 1 {
+			http.Error(w, i18n.T("Invalid book ID"), http.StatusBadRequest)
+			return
+		}
+		bookID = id
+	}
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "json" && format != "markdown" {
+		http.Error(w, i18n.T("Unknown format"), http.StatusBadRequest)
+		return
+	}
+	annotations, err := s.db.ListAnnotations(s.shelfOwner(r), bookID)
+	if err != nil {
+		http.Error(w, i18n.T("Internal Server Error"), http.StatusInternalServerError)
+		return
+	}
+	if format != "markdown" {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(annotationsPayload{Annotations: annotations})
+		return
+	}
+	w.Header().Set("Content-Type", "text/markdown; charset=utf-8")
+	w.Header().Set("Content-Disposition", attachment("annotations.md"))
+	_, _ = w.Write(annotationsMarkdown(annotations))
+}
+
+// annotationsMarkdown renders annotations, already grouped by book and in
+// reading order, with a heading per book and per chapter.
+func annotationsMarkdown(annotations []database.Annotation) []byte {
+	var buf bytes.Buffer
+	lastBook, lastChapter := -1, ""
+	for _, a := range annotations {
+		if a.BookID != lastBook {
+			if lastBook != -1 {
+				buf.WriteString("\n")
+			}
+			title := a.BookTitle
+			if title == "" {
+				title = i18n.T("Unknown book")
+			}
+			fmt.Fprintf(&buf, "# %s\n", title)
+			if a.BookAuthor != "" {
+				fmt.Fprintf(&buf, "\n%s\n", a.BookAuthor)
+			}
+			lastBook, lastChapter = a.BookID, ""
+		}
+		if a.Chapter != "" && a.Chapter != lastChapter {
+			fmt.Fprintf(&buf, "\n## %s\n", a.Chapter)
+			lastChapter = a.Chapter
+		}
+		buf.WriteString("\n")
+		if a.Text != "" {
+			for _, line := range strings.Split(strings.TrimSpace(a.Text), "\n") {
+				fmt.Fprintf(&buf, "> %s\n", line)
+			}
+		}
+		if a.Note != "" {
+			if a.Text != "" {
+				buf.WriteString("\n")
+			}
+			fmt.Fprintf(&buf, "%s\n", a.Note)
+		}
+		fmt.Fprintf(&buf, "\n_%s_\n", a.CreatedAt.UTC().Format("2006-01-02 15:04"))
+	}
+	return buf.Bytes()
+}
+
+// HandleImportAnnotations adds the highlights and notes from a KOReader
+// JSON export to a book. A file with several documents contributes the ones
+// titled like the book, or its only one. Entries already imported are
+// skipped.
+func (s *Server) HandleImportAnnotations(w http.ResponseWriter, r *http.Request) {
+	book, ok := s.requestedBook(w, r)
+	if !ok {
+		return
+	}
+	dec := json.NewDecoder(r.Body)
+	dec.UseNumber()
+	var raw json.RawMessage
+	if err := dec.Decode(&raw); err != nil {
+		http.Error(w, i18n.T("Invalid JSON body"), http.StatusBadRequest)
+		return
+	}
+	var docs []*koreaderExport
+	if err := json.Unmarshal(raw, &docs); err != nil {
+		var doc koreaderExport
+		if err := json.Unmarshal(raw, &doc); err != nil {
+			http.Error(w, i18n.T("Invalid KOReader export"), http.StatusBadRequest)
+			return
+		}
+		docs = []*koreaderExport{&doc}
+		if len(doc.Documents) > 0 {
+			docs = doc.Documents
+		}
+	}
+	if len(docs) > 1 {
+		matched := docs[:0:0]
+		for _, d := range docs {
+			if d != nil && strings.EqualFold(strings.TrimSpace(d.Title), strings.TrimSpace(book.Title)) {
+				matched = append(matched, d)
+			}
+		}
+		docs = matched
+	}
+	if len(docs) == 0 {
+		http.Error(w, i18n.T("The export has no highlights for this book"), http.StatusBadRequest)
+		return
+	}
+
+	var annotations []database.Annotation
+	skipped := 0
+	for _, d := range docs {
+		if d == nil {
+			continue
+		}
+		for _, e := range d.Entries {
+			req := annotationRequest{Chapter: e.Chapter, Text: e.Text, Note: e.Note, Color: e.Color}
+			if e.Page != "" {
+				req.Locator = "page:" + e.Page.String()
+			}
+			if !highlightColors[strings.ToLower(strings.TrimSpace(req.Color))] {
+				req.Color = ""
+			}
+			if req.normalize() != nil {
+				skipped++
+				continue
+			}
+			a := database.Annotation{Locator: req.Locator, Chapter: req.Chapter, Text: req.Text, Note: req.Note, Color: req.Color}
+			if e.Time > 0 {
+				a.CreatedAt = time.Unix(e.Time, 0).UTC()
+			}
+			annotations = append(annotations, a)
+		}
+	}
+
+	owner := s.shelfOwner(r)
+	added, err := s.db.ImportAnnotations(owner, *book, annotations)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to import annotations", "book_id", book.ID, "err", err)
+		http.Error(w, i18n.T("Failed to save annotation"), http.StatusInternalServerError)
+		return
+	}
+	skipped += len(annotations) - added
+	slog.InfoContext(r.Context(), "annotations imported", "book_id", book.ID, "user", owner, "added", added, "skipped", skipped)
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(annotationImportPayload{Added: added, Skipped: skipped})
+}
@@ -0,0 +1,368 @@
+package web
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ab0oo/gopds/internal/database"
+	"github.com/ab0oo/gopds/internal/i18n"
+	"github.com/ab0oo/gopds/internal/scanner"
+	"github.com/ab0oo/gopds/internal/storage"
+	"github.com/go-chi/chi/v5"
+)
+
+const coverHistoryDir = "./data/history/covers"
+
+// coverSnapshot is the before/after payload of a cover audit entry. Image is
+// a file name under coverHistoryDir.
+type coverSnapshot struct {
+	Image       string `json:"image,omitempty"`
+	WroteToEPUB bool   `json:"wrote_to_epub"`
+	Source      string `json:"source,omitempty"`
+}
+
+type bookHistoryPayload struct {
+	BookID  int                   `json:"book_id"`
+	Entries []database.AuditEntry `json:"entries"`
+}
+
+type revertPayload struct {
+	OK       bool  `json:"ok"`
+	BookID   int   `json:"book_id"`
+	Reverted int64 `json:"reverted"`
+}
+
+// actorName identifies who made a change for the audit log.
+func (s *Server) actorName(r *http.Request) string {
+	if username, ok := s.authenticatedUser(r); ok {
+		return username
+	}
+	return "system"
+}
+
+func (s *Server) recordMetadataChange(r *http.Request, bookID int, before, after *scanner.EPUBMetadata, revertOf int64) {
+	s.recordMetadataChangeBy(r.Context(), s.actorName(r), bookID, before, after, revertOf)
+}
+
+// recordMetadataChangeBy is recordMetadataChange for changes made outside a
+// request, by background jobs, on behalf of actor.
+func (s *Server) recordMetadataChangeBy(ctx context.Context, actor string, bookID int, before, after *scanner.EPUBMetadata, revertOf int64) {
+	beforeJSON, _ := json.Marshal(before)
+	afterJSON, _ := json.Marshal(after)
+	auditID, err := s.db.AddAuditEntry(database.AuditEntry{
+		BookID:   bookID,
+		Actor:    actor,
+		Action:   database.AuditActionMetadata,
+		Before:   beforeJSON,
+		After:    afterJSON,
+		RevertOf: revertOf,
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "audit: failed to record metadata change", "book_id", bookID, "err", err)
+	}
+	s.emitMetadataChangedBy(ctx, actor, bookID, database.AuditActionMetadata, auditID)
+}
+
+// catalogSnapshot is the before/after payload of a catalog-only audit entry.
+type catalogSnapshot struct {
+	Title       string `json:"title"`
+	Author      string `json:"author"`
+	Description string `json:"description"`
+	Series      string `json:"series"`
+	SeriesIndex string `json:"series_index"`
+}
+
+func catalogSnapshotOf(b *database.Book) catalogSnapshot {
+	return catalogSnapshot{
+		Title:       b.Title,
+		Author:      b.Author,
+		Description: b.Description,
+		Series:      b.Series,
+		SeriesIndex: b.SeriesIndex,
+	}
+}
+
+func (s *Server) recordCatalogChange(r *http.Request, bookID int, before, after catalogSnapshot, revertOf int64) {
+	beforeJSON, _ := json.Marshal(before)
+	afterJSON, _ := json.Marshal(after)
+	auditID, err := s.db.AddAuditEntry(database.AuditEntry{
+		BookID:   bookID,
+		Actor:    s.actorName(r),
+		Action:   database.AuditActionCatalog,
+		Before:   beforeJSON,
+		After:    afterJSON,
+		RevertOf: revertOf,
+	})
+	if err != nil {
+		slog.ErrorContext(r.Context(), "audit: failed to record catalog change", "book_id", bookID, "err", err)
+	}
+	s.emitMetadataChanged(r, bookID, database.AuditActionCatalog, auditID)
+}
+
+// applyCatalogUpdate changes only the cached row, leaving the EPUB untouched.
+func (s *Server) applyCatalogUpdate(book *database.Book, snap catalogSnapshot) error {
+	if err := s.db.UpdateBookMetadata(book.ID, snap.Title, snap.Author, snap.Description, book.ModTime); err != nil {
+		return err
+	}
+	return s.db.UpdateBookSeries(book.ID, snap.Series, snap.SeriesIndex)
+}
+
+func (s *Server) recordCoverChange(r *http.Request, bookID int, previousImage string, newJPG []byte, wroteToEPUB bool, source string, revertOf int64) {
+	beforeJSON, _ := json.Marshal(coverSnapshot{Image: previousImage})
+	afterJSON, _ := json.Marshal(coverSnapshot{
+		Image:       saveCoverHistoryImage(bookID, newJPG),
+		WroteToEPUB: wroteToEPUB,
+		Source:      source,
+	})
+	auditID, err := s.db.AddAuditEntry(database.AuditEntry{
+		BookID:   bookID,
+		Actor:    s.actorName(r),
+		Action:   database.AuditActionCover,
+		Before:   beforeJSON,
+		After:    afterJSON,
+		RevertOf: revertOf,
+	})
+	if err != nil {
+		slog.ErrorContext(r.Context(), "audit: failed to record cover change", "book_id", bookID, "err", err)
+	}
+	s.emitMetadataChanged(r, bookID, database.AuditActionCover, auditID)
+}
+
+// snapshotCoverForHistory copies the current cached cover into the history
+// directory and returns its file name, or "" when there is no cover.
+func snapshotCoverForHistory(bookID int) string {
+	raw, err := readCover(context.Background(), bookID)
+	if err != nil {
+		return ""
+	}
+	return saveCoverHistoryImage(bookID, raw)
+}
+
+func saveCoverHistoryImage(bookID int, raw []byte) string {
+	if err := os.MkdirAll(coverHistoryDir, 0755); err != nil {
+		slog.Error("audit: failed to prepare cover history dir", "err", err)
+		return ""
+	}
+	name := fmt.Sprintf("%d-%d.jpg", bookID, time.Now().UTC().UnixNano())
+	if err := os.WriteFile(filepath.Join(coverHistoryDir, name), raw, 0644); err != nil {
+		slog.Error("audit: failed to save cover history image", "err", err)
+		return ""
+	}
+	return name
+}
+
+func (s *Server) HandleBookHistory(w http.ResponseWriter, r *http.Request) {
+	book, ok := s.lookupBook(w, r)
+	if !ok {
+		return
+	}
+
+	limit := parseIntDefault(r.URL.Query().Get("limit"), 100)
+	if limit < 1 || limit > 1000 {
+		limit = 100
+	}
+	entries, err := s.db.GetBookAuditHistory(book.ID, limit)
+	if err != nil {
+		http.Error(w, i18n.T("Internal Server Error"), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(bookHistoryPayload{
+		BookID:  book.ID,
+		Entries: entries,
+	})
+}
+
+// HandleHistoryCoverImage serves the before or after image of a cover change.
+func (s *Server) HandleHistoryCoverImage(w http.ResponseWriter, r *http.Request) {
+	book, ok := s.lookupBook(w, r)
+	if !ok {
+		return
+	}
+	entry, ok := s.lookupAuditEntry(w, r, book.ID)
+	if !ok {
+		return
+	}
+	if entry.Action != database.AuditActionCover {
+		http.Error(w, i18n.T("History entry is not a cover change"), http.StatusBadRequest)
+		return
+	}
+
+	raw := entry.After
+	if r.URL.Query().Get("version") == "before" {
+		raw = entry.Before
+	}
+	var snap coverSnapshot
+	if err := json.Unmarshal(raw, &snap); err != nil || snap.Image == "" {
+		http.Error(w, i18n.T("No image recorded for this version"), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Cache-Control", "no-store")
+	http.ServeFile(w, r, filepath.Join(coverHistoryDir, filepath.Base(snap.Image)))
+}
+
+// HandleRevertHistory restores the "before" state of a history entry. The
+// revert is itself recorded, so it can be undone the same way.
+func (s *Server) HandleRevertHistory(w http.ResponseWriter, r *http.Request) {
+	book, ok := s.lookupBook(w, r)
+	if !ok {
+		return
+	}
+	entry, ok := s.lookupAuditEntry(w, r, book.ID)
+	if !ok {
+		return
+	}
+
+	if entry.Action == database.AuditActionCatalog {
+		var before catalogSnapshot
+		if err := json.Unmarshal(entry.Before, &before); err != nil || strings.TrimSpace(before.Title) == "" {
+			http.Error(w, i18n.T("No previous metadata recorded for this entry"), http.StatusConflict)
+			return
+		}
+		current := catalogSnapshotOf(book)
+		if err := s.applyCatalogUpdate(book, before); err != nil {
+			http.Error(w, i18n.T("Failed to update metadata cache"), http.StatusInternalServerError)
+			return
+		}
+		s.recordCatalogChange(r, book.ID, current, before, entry.ID)
+		writeRevertResult(w, book.ID, entry.ID)
+		return
+	}
+
+	bookPath, err := s.resolveBookPath(book)
+	if err != nil {
+		http.Error(w, i18n.T("Failed to locate EPUB: %v", err), http.StatusUnprocessableEntity)
+		return
+	}
+
+	switch entry.Action {
+	case database.AuditActionMetadata:
+		var before scanner.EPUBMetadata
+		if err := json.Unmarshal(entry.Before, &before); err != nil || strings.TrimSpace(before.Title) == "" {
+			http.Error(w, i18n.T("No previous metadata recorded for this entry"), http.StatusConflict)
+			return
+		}
+		current, _ := scanner.ExtractLiveMetadata(bookPath)
+		meta, err := s.applyMetadataUpdate(book, bookPath, metadataUpdateFromEPUB(before))
+		if err != nil {
+			writeMetadataUpdateError(w, r, bookPath, err)
+			return
+		}
+		s.recordMetadataChange(r, book.ID, current, meta, entry.ID)
+
+	case database.AuditActionCover:
+		var before, after coverSnapshot
+		_ = json.Unmarshal(entry.After, &after)
+		if err := json.Unmarshal(entry.Before, &before); err != nil || before.Image == "" {
+			http.Error(w, i18n.T("No previous cover recorded for this entry"), http.StatusConflict)
+			return
+		}
+		if after.WroteToEPUB && storage.IsRemote(bookPath) {
+			http.Error(w, i18n.T("Books in remote libraries are read-only"), http.StatusConflict)
+			return
+		}
+		raw, err := os.ReadFile(filepath.Join(coverHistoryDir, filepath.Base(before.Image)))
+		if err != nil {
+			http.Error(w, i18n.T("Previous cover image is no longer available"), http.StatusGone)
+			return
+		}
+
+		previousCover := snapshotCoverForHistory(book.ID)
+		if err := writeCover(r.Context(), book.ID, raw); err != nil {
+			http.Error(w, i18n.T("Failed to update cover cache: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if after.WroteToEPUB {
+			if err := scanner.WriteCoverBytesToEPUB(bookPath, raw); err != nil {
+				http.Error(w, i18n.T("Failed writing cover to EPUB: %v", err), http.StatusUnprocessableEntity)
+				return
+			}
+			if err := os.WriteFile(filepath.Join(filepath.Dir(bookPath), "cover.jpg"), raw, 0644); err != nil {
+				http.Error(w, i18n.T("Failed writing sibling cover.jpg: %v", err), http.StatusUnprocessableEntity)
+				return
+			}
+			if info, err := os.Stat(bookPath); err == nil {
+				_ = s.db.UpdateBookMetadata(book.ID, book.Title, book.Author, book.Description, info.ModTime())
+			}
+			s.refreshBookHash(book.ID, bookPath)
+		}
+		s.recordCoverChange(r, book.ID, previousCover, raw, after.WroteToEPUB, "revert", entry.ID)
+		s.libraryChanged()
+
+	default:
+		http.Error(w, i18n.T("History entry cannot be reverted"), http.StatusBadRequest)
+		return
+	}
+
+	writeRevertResult(w, book.ID, entry.ID)
+}
+
+func writeRevertResult(w http.ResponseWriter, bookID int, entryID int64) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(revertPayload{
+		OK:       true,
+		BookID:   bookID,
+		Reverted: entryID,
+	})
+}
+
+func metadataUpdateFromEPUB(m scanner.EPUBMetadata) scanner.MetadataUpdate {
+	return scanner.MetadataUpdate{
+		Title:       m.Title,
+		Creator:     m.Author,
+		Language:    m.Language,
+		Identifier:  m.Identifier,
+		Publisher:   m.Publisher,
+		Date:        m.Date,
+		Description: m.Description,
+		Subjects:    m.Subjects,
+		Series:      m.Series,
+		SeriesIndex: m.SeriesIndex,
+	}
+}
+
+// lookupBook loads the book named by the {id} URL parameter, writing a 404 or
+// 500 response and returning false when it cannot.
+func (s *Server) lookupBook(w http.ResponseWriter, r *http.Request) (*database.Book, bool) {
+	book, err := s.visibleBook(r, chi.URLParam(r, "id"))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, i18n.T("Book not found"), http.StatusNotFound)
+			return nil, false
+		}
+		http.Error(w, i18n.T("Internal Server Error"), http.StatusInternalServerError)
+		return nil, false
+	}
+	return book, true
+}
+
+func (s *Server) lookupAuditEntry(w http.ResponseWriter, r *http.Request, bookID int) (*database.AuditEntry, bool) {
+	entryID, err := strconv.ParseInt(chi.URLParam(r, "entryID"), 10, 64)
+	if err != nil {
+		http.Error(w, i18n.T("Invalid history entry ID"), http.StatusBadRequest)
+		return nil, false
+	}
+	entry, err := s.db.GetAuditEntry(entryID)
+	if err != nil || entry.BookID != bookID {
+		if err == nil || errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, i18n.T("History entry not found"), http.StatusNotFound)
+			return nil, false
+		}
+		http.Error(w, i18n.T("Internal Server Error"), http.StatusInternalServerError)
+		return nil, false
+	}
+	return entry, true
+}
@@ -0,0 +1,359 @@
+package web
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ab0oo/gopds/internal/database"
+	"github.com/ab0oo/gopds/internal/i18n"
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	// defaultAuthorMatchScore is how alike two spellings must be to be
+	// proposed as the same author, unless ?min_score= says otherwise.
+	defaultAuthorMatchScore = 0.88
+	// initialsMatchScore is the score of spellings that differ only in
+	// initials, e.g. "J. R. R. Tolkien" and "John Ronald Reuel Tolkien".
+	initialsMatchScore      = 0.9
+	authorMergeHistoryLimit = 100
+)
+
+type authorVariant struct {
+	Name  string `json:"name"`
+	Books int    `json:"books"`
+}
+
+// authorDuplicateGroup is a set of spellings that look like one author.
+// Score is the weakest match that joined the group; 1 means every spelling
+// has the same words, ignoring order, case, accents, and punctuation.
+type authorDuplicateGroup struct {
+	Canonical string          `json:"canonical"`
+	Score     float64         `json:"score"`
+	Books     int             `json:"books"`
+	Variants  []authorVariant `json:"variants"`
+}
+
+type authorDuplicatesPayload struct {
+	Groups []authorDuplicateGroup `json:"groups"`
+}
+
+type authorMergeRequest struct {
+	Canonical string   `json:"canonical"`
+	Variants  []string `json:"variants"`
+}
+
+type authorMergesPayload struct {
+	Merges []database.AuthorMerge `json:"merges"`
+}
+
+type authorMergeUndoPayload struct {
+	Merge    *database.AuthorMerge `json:"merge"`
+	Restored int                   `json:"restored"`
+	// Skipped are books whose author was changed again after the merge;
+	// undo leaves them alone.
+	Skipped []int `json:"skipped"`
+}
+
+// mergeKey normalizes an author for comparison: accents, case, and
+// punctuation dropped and the words sorted, so "Márquez, Gabriel García"
+// and "Gabriel Garcia Marquez" share a key.
+func mergeKey(name string) string {
+	return authorKey(normalizeForMatch(name))
+}
+
+// givenNames returns the words of a name other than the surname, in order.
+// "Last, First" is understood.
+func givenNames(name string) []string {
+	if _, first, ok := strings.Cut(name, ","); ok {
+		return strings.Fields(normalizeForMatch(first))
+	}
+	words := strings.Fields(normalizeForMatch(name))
+	if len(words) < 2 {
+		return nil
+	}
+	return words[:len(words)-1]
+}
+
+// initialsAgree reports whether two lists of given names could be the same
+// person's, with an initial standing for any name it begins.
+func initialsAgree(a, b []string) bool {
+	if len(a) == 0 || len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		x, y := a[i], b[i]
+		switch {
+		case x == y:
+		case len([]rune(x)) == 1 && strings.HasPrefix(y, x):
+		case len([]rune(y)) == 1 && strings.HasPrefix(x, y):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// authorMatchScore scores how likely two spellings are to name the same
+// author, from 0 to 1.
+func authorMatchScore(a, b string) float64 {
+	ka, kb := mergeKey(a), mergeKey(b)
+	if ka == kb {
+		return 1
+	}
+	score := levenshteinRatio(ka, kb)
+	if sa := surname(a); sa != "" && sa == surname(b) && initialsAgree(givenNames(a), givenNames(b)) {
+		score = max(score, initialsMatchScore)
+	}
+	return score
+}
+
+// findDuplicateAuthors groups spellings that score at least minScore
+// against another spelling in the group. Only spellings whose surnames
+// begin alike are compared, which keeps large libraries quick at the cost
+// of missing a typo in a surname's first two letters.
+func findDuplicateAuthors(counts []database.AuthorCount, minScore float64) []authorDuplicateGroup {
+	parent := make([]int, len(counts))
+	score := make([]float64, len(counts))
+	for i := range parent {
+		parent[i], score[i] = i, 1
+	}
+	var find func(int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+
+	blocks := map[string][]int{}
+	for i, c := range counts {
+		key := []rune(normalizeForMatch(surname(c.Name)))
+		if len(key) == 0 {
+			continue
+		}
+		block := string(key[:min(2, len(key))])
+		blocks[block] = append(blocks[block], i)
+	}
+	for _, members := range blocks {
+		for x := 0; x < len(members); x++ {
+			for y := x + 1; y < len(members); y++ {
+				i, j := members[x], members[y]
+				s := authorMatchScore(counts[i].Name, counts[j].Name)
+				if s < minScore {
+					continue
+				}
+				ri, rj := find(i), find(j)
+				if ri != rj {
+					parent[rj] = ri
+					score[ri] = min(s, score[ri], score[rj])
+				}
+			}
+		}
+	}
+
+	byRoot := map[int]*authorDuplicateGroup{}
+	for i, c := range counts {
+		root := find(i)
+		g, ok := byRoot[root]
+		if !ok {
+			g = &authorDuplicateGroup{Score: score[root]}
+			byRoot[root] = g
+		}
+		g.Books += c.Books
+		g.Variants = append(g.Variants, authorVariant{Name: c.Name, Books: c.Books})
+	}
+	groups := []authorDuplicateGroup{}
+	for _, g := range byRoot {
+		if len(g.Variants) < 2 {
+			continue
+		}
+		sort.Slice(g.Variants, func(i, j int) bool { return preferAuthorSpelling(g.Variants[i], g.Variants[j]) })
+		g.Canonical = g.Variants[0].Name
+		groups = append(groups, *g)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		if groups[i].Books != groups[j].Books {
+			return groups[i].Books > groups[j].Books
+		}
+		return groups[i].Canonical < groups[j].Canonical
+	})
+	return groups
+}
+
+// preferAuthorSpelling orders the spellings of one author, best canonical
+// candidate first: the one on the most books, then "First Last" over
+// "Last, First", then the fuller name.
+func preferAuthorSpelling(a, b authorVariant) bool {
+	if a.Books != b.Books {
+		return a.Books > b.Books
+	}
+	if ac, bc := strings.Contains(a.Name, ","), strings.Contains(b.Name, ","); ac != bc {
+		return bc
+	}
+	if len(a.Name) != len(b.Name) {
+		return len(a.Name) > len(b.Name)
+	}
+	return a.Name < b.Name
+}
+
+// HandleAuthorDuplicates proposes merges: groups of author spellings that
+// look like the same person, each with a suggested canonical name.
+func (s *Server) HandleAuthorDuplicates(w http.ResponseWriter, r *http.Request) {
+	minScore := defaultAuthorMatchScore
+	if raw := r.URL.Query().Get("min_score"); raw != "" {
+		v, err := strconv.ParseFloat(raw, 64)
+		if err != nil || v < 0.5 || v > 1 {
+			http.Error(w, i18n.T("min_score must be between 0.5 and 1"), http.StatusBadRequest)
+			return
+		}
+		minScore = v
+	}
+	counts, err := s.db.AuthorCounts()
+	if err != nil {
+		http.Error(w, i18n.T("Internal Server Error"), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(authorDuplicatesPayload{Groups: findDuplicateAuthors(counts, minScore)})
+}
+
+// HandleMergeAuthors renames every book by one of the variant spellings to
+// the canonical name. Only the catalog changes, as with a metadata import
+// without write_epub; each book's change goes into its history, and the
+// merge as a whole can be undone.
+func (s *Server) HandleMergeAuthors(w http.ResponseWriter, r *http.Request) {
+	var req authorMergeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, i18n.T("Invalid JSON body"), http.StatusBadRequest)
+		return
+	}
+	canonical := strings.TrimSpace(req.Canonical)
+	if canonical == "" {
+		http.Error(w, i18n.T("canonical is required"), http.StatusBadRequest)
+		return
+	}
+	var variants []string
+	seen := map[string]bool{canonical: true}
+	for _, v := range req.Variants {
+		if v = strings.TrimSpace(v); v != "" && !seen[v] {
+			seen[v] = true
+			variants = append(variants, v)
+		}
+	}
+	if len(variants) == 0 {
+		http.Error(w, i18n.T("variants must name at least one other spelling"), http.StatusBadRequest)
+		return
+	}
+
+	books, err := s.db.GetBooksByAuthors(variants)
+	if err != nil {
+		http.Error(w, i18n.T("Internal Server Error"), http.StatusInternalServerError)
+		return
+	}
+	if len(books) == 0 {
+		http.Error(w, i18n.T("No books have those authors"), http.StatusNotFound)
+		return
+	}
+
+	renamed := make([]database.AuthorMergeBook, 0, len(books))
+	for i := range books {
+		book := &books[i]
+		before := catalogSnapshotOf(book)
+		after := before
+		after.Author = canonical
+		if err := s.applyCatalogUpdate(book, after); err != nil {
+			slog.ErrorContext(r.Context(), "author merge: failed to rename book", "book_id", book.ID, "err", err)
+			continue
+		}
+		s.recordCatalogChange(r, book.ID, before, after, 0)
+		renamed = append(renamed, database.AuthorMergeBook{BookID: book.ID, Path: book.Path, PreviousAuthor: before.Author})
+	}
+	merge, err := s.db.RecordAuthorMerge(database.AuthorMerge{Canonical: canonical, Variants: variants, Actor: s.actorName(r)}, renamed)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "author merge: failed to record merge", "canonical", canonical, "err", err)
+		http.Error(w, i18n.T("Internal Server Error"), http.StatusInternalServerError)
+		return
+	}
+	slog.InfoContext(r.Context(), "authors merged", "canonical", canonical, "variants", variants, "books", merge.Books)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(merge)
+}
+
+// HandleAuthorMerges lists recent merges, newest first.
+func (s *Server) HandleAuthorMerges(w http.ResponseWriter, r *http.Request) {
+	merges, err := s.db.AuthorMerges(authorMergeHistoryLimit)
+	if err != nil {
+		http.Error(w, i18n.T("Internal Server Error"), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(authorMergesPayload{Merges: merges})
+}
+
+// HandleUndoAuthorMerge gives the books a merge renamed their previous
+// authors back. Books renamed again since then are left as they are.
+func (s *Server) HandleUndoAuthorMerge(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "mergeID"), 10, 64)
+	if err != nil {
+		http.Error(w, i18n.T("Invalid merge ID"), http.StatusBadRequest)
+		return
+	}
+	merge, err := s.db.GetAuthorMerge(id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, i18n.T("Merge not found"), http.StatusNotFound)
+			return
+		}
+		http.Error(w, i18n.T("Internal Server Error"), http.StatusInternalServerError)
+		return
+	}
+	undone, err := s.db.MarkAuthorMergeUndone(id)
+	if err != nil {
+		http.Error(w, i18n.T("Internal Server Error"), http.StatusInternalServerError)
+		return
+	}
+	if !undone {
+		http.Error(w, i18n.T("Merge was already undone"), http.StatusConflict)
+		return
+	}
+	books, err := s.db.AuthorMergeBooks(id)
+	if err != nil {
+		http.Error(w, i18n.T("Internal Server Error"), http.StatusInternalServerError)
+		return
+	}
+
+	payload := authorMergeUndoPayload{Skipped: []int{}}
+	for _, mb := range books {
+		book, err := s.db.GetBookByPath(mb.Path)
+		if err != nil || book.Author != merge.Canonical {
+			payload.Skipped = append(payload.Skipped, mb.BookID)
+			continue
+		}
+		before := catalogSnapshotOf(book)
+		after := before
+		after.Author = mb.PreviousAuthor
+		if err := s.applyCatalogUpdate(book, after); err != nil {
+			slog.ErrorContext(r.Context(), "author merge: failed to restore book", "book_id", book.ID, "err", err)
+			payload.Skipped = append(payload.Skipped, mb.BookID)
+			continue
+		}
+		s.recordCatalogChange(r, book.ID, before, after, 0)
+		payload.Restored++
+	}
+	if payload.Merge, err = s.db.GetAuthorMerge(id); err != nil {
+		payload.Merge = merge
+	}
+	slog.InfoContext(r.Context(), "author merge undone", "merge_id", id, "restored", payload.Restored, "skipped", len(payload.Skipped))
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(payload)
+}
@@ -0,0 +1,170 @@
+package web
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/ab0oo/gopds/internal/jobs"
+	"github.com/ab0oo/gopds/internal/scanner"
+)
+
+// libraryCheckInterval is how often RunLibraryMonitor checks that the
+// library root can still be read.
+const libraryCheckInterval = time.Minute
+
+// errBookUnavailable is returned for a book whose library is unavailable.
+var errBookUnavailable = errors.New("book is temporarily unavailable")
+
+// libraryStatus is the library root's availability as last checked.
+type libraryStatus struct {
+	Available bool      `json:"available"`
+	Since     time.Time `json:"since,omitempty"`
+	CheckedAt time.Time `json:"checked_at,omitempty"`
+	Message   string    `json:"message,omitempty"`
+}
+
+// libraryState is what the server knows of the library root's
+// availability. Until the first check it is assumed to be available.
+type libraryState struct {
+	mu       sync.Mutex
+	status   libraryStatus
+	checked  bool
+	checking bool
+	// resolved is the root with symlinks resolved, as books are stored,
+	// from the last time it could be resolved.
+	resolved string
+}
+
+// libraryStatus returns the library's availability as last checked.
+func (s *Server) libraryStatus() libraryStatus {
+	s.library.mu.Lock()
+	defer s.library.mu.Unlock()
+	if !s.library.checked {
+		return libraryStatus{Available: true}
+	}
+	return s.library.status
+}
+
+// checkLibrary checks whether the library root can be read, records the
+// result, and returns scanner.ErrLibraryUnavailable if it can't. A hung
+// network mount can block the check indefinitely, so it is given
+// readyCheckTimeout, and no second check starts while one is stuck.
+func (s *Server) checkLibrary(ctx context.Context) error {
+	root := libraryRoot()
+	s.library.mu.Lock()
+	if s.library.checking {
+		s.library.mu.Unlock()
+		err := fmt.Errorf("%w: %s has not answered the previous check", scanner.ErrLibraryUnavailable, root)
+		s.recordLibrary(ctx, err)
+		return err
+	}
+	s.library.checking = true
+	s.library.mu.Unlock()
+
+	done := make(chan error, 1)
+	go func() {
+		err := scanner.CheckLibrary(s.db, root)
+		s.library.mu.Lock()
+		s.library.checking = false
+		if err == nil {
+			if resolved, rerr := filepath.EvalSymlinks(root); rerr == nil {
+				s.library.resolved = resolved
+			}
+		}
+		s.library.mu.Unlock()
+		done <- err
+	}()
+	var err error
+	select {
+	case err = <-done:
+	case <-time.After(readyCheckTimeout):
+		err = fmt.Errorf("%w: %s did not answer within %s", scanner.ErrLibraryUnavailable, root, readyCheckTimeout)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if err != nil && !errors.Is(err, scanner.ErrLibraryUnavailable) {
+		// The database, not the library, failed; that says nothing about
+		// whether the share is there.
+		return err
+	}
+	s.recordLibrary(ctx, err)
+	return err
+}
+
+// recordLibrary stores the outcome of a check. When the library goes away
+// its books are flagged unavailable rather than dropped; when it comes
+// back they are unflagged and a rescan is queued to catch up on anything
+// that changed meanwhile.
+func (s *Server) recordLibrary(ctx context.Context, err error) {
+	now := time.Now().UTC()
+	s.library.mu.Lock()
+	first := !s.library.checked
+	was := first || s.library.status.Available
+	s.library.checked = true
+	s.library.status.Available = err == nil
+	s.library.status.CheckedAt = now
+	s.library.status.Message = ""
+	if err != nil {
+		s.library.status.Message = err.Error()
+	}
+	if was != s.library.status.Available || s.library.status.Since.IsZero() {
+		s.library.status.Since = now
+	}
+	root := s.library.resolved
+	s.library.mu.Unlock()
+	if root == "" {
+		root = filepath.Clean(libraryRoot())
+	}
+
+	switch {
+	case was && err != nil:
+		n, dbErr := s.db.SetBooksUnavailable(root, true)
+		if dbErr != nil {
+			slog.ErrorContext(ctx, "failed to flag books unavailable", "root", root, "err", dbErr)
+		}
+		slog.WarnContext(ctx, "library unavailable; scans paused", "root", root, "books", n, "err", err)
+	case (first || !was) && err == nil:
+		// The first check also clears flags left by a run that stopped
+		// while the library was away. Books a scan found missing stay
+		// unavailable.
+		n, dbErr := s.db.SetBooksUnavailable(root, false)
+		if dbErr != nil {
+			slog.ErrorContext(ctx, "failed to clear unavailable books", "root", root, "err", dbErr)
+		}
+		if first {
+			if n > 0 {
+				slog.InfoContext(ctx, "library available again", "root", root, "books", n)
+			}
+			return
+		}
+		slog.InfoContext(ctx, "library available again; queueing rescan", "root", root, "books", n)
+		if s.jobs != nil {
+			if _, err := s.QueueScan(ctx, "rescan"); err != nil && !errors.Is(err, jobs.ErrAlreadyActive) {
+				slog.ErrorContext(ctx, "failed to queue rescan", "err", err)
+			}
+		}
+	}
+}
+
+// RunLibraryMonitor checks the library root at once and then every
+// libraryCheckInterval until ctx is cancelled, so an unmounted share is
+// noticed, and its return acted on, without waiting for a scan.
+func (s *Server) RunLibraryMonitor(ctx context.Context) {
+	ticker := time.NewTicker(libraryCheckInterval)
+	defer ticker.Stop()
+	for {
+		if err := s.checkLibrary(ctx); err != nil && !errors.Is(err, scanner.ErrLibraryUnavailable) && ctx.Err() == nil {
+			slog.ErrorContext(ctx, "library check failed", "err", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
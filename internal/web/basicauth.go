@@ -0,0 +1,150 @@
+package web
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ab0oo/gopds/internal/i18n"
+)
+
+// E-reader OPDS clients and feed readers only speak HTTP Basic auth, so
+// Basic credentials are accepted on the routes those clients fetch.
+// Everywhere else a browser session or bearer token is required, which
+// keeps Basic credentials that a browser has cached from authorizing API
+// calls.
+var basicAuthPrefixes = []string{"/opds", "/rss/", "/covers/", "/download/"}
+
+// basicAuthCacheTTL bounds how long a verified Basic credential is trusted
+// without re-checking its bcrypt hash. Clients send the header on every
+// request, including each cover image, so hashing every time would be slow.
+const basicAuthCacheTTL = 5 * time.Minute
+
+const basicAuthRealm = `Basic realm="GoPDS", charset="UTF-8"`
+
+type basicAuthCache struct {
+	mu      sync.Mutex
+	entries map[string]basicAuthEntry
+}
+
+type basicAuthEntry struct {
+	Username  string
+	ExpiresAt time.Time
+}
+
+func newBasicAuthCache() *basicAuthCache {
+	return &basicAuthCache{entries: make(map[string]basicAuthEntry)}
+}
+
+func basicAuthKey(username, password string) string {
+	sum := sha256.Sum256([]byte(username + "\x00" + password))
+	return hex.EncodeToString(sum[:])
+}
+
+func (c *basicAuthCache) get(key string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return "", false
+	}
+	if time.Now().After(e.ExpiresAt) {
+		delete(c.entries, key)
+		return "", false
+	}
+	return e.Username, true
+}
+
+func (c *basicAuthCache) put(key, username string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	for k, e := range c.entries {
+		if now.After(e.ExpiresAt) {
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = basicAuthEntry{Username: username, ExpiresAt: now.Add(basicAuthCacheTTL)}
+}
+
+// forget drops every cached credential for username, after its password
+// changes or the account is deleted.
+func (c *basicAuthCache) forget(username string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k, e := range c.entries {
+		if strings.EqualFold(e.Username, username) {
+			delete(c.entries, k)
+		}
+	}
+}
+
+func acceptsBasicAuth(r *http.Request) bool {
+	for _, prefix := range basicAuthPrefixes {
+		if strings.HasPrefix(r.URL.Path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// basicAuthUser checks Basic credentials against the user table and returns
+// the account's username.
+func (s *Server) basicAuthUser(r *http.Request, username, password string) (string, bool) {
+	key := basicAuthKey(username, password)
+	if name, ok := s.basicCache.get(key); ok {
+		return name, true
+	}
+	// Uncached checks share the login rate limit, so Basic auth can't be
+	// used to guess passwords faster than the login form.
+	if ok, _ := s.loginLimiter.allow(clientIP(r)); !ok {
+		rateLimited.Inc(s.loginLimiter.name)
+		return "", false
+	}
+	if wait := s.loginGuard.wait(username, clientIP(r)); wait > 0 {
+		slog.WarnContext(r.Context(), "login throttled", "username", username, "remote", clientIP(r), "retry_after", wait.Round(time.Second))
+		return "", false
+	}
+	user, ok := s.checkPassword(r, username, password)
+	if !ok {
+		s.loginFailed(r, "basic", username)
+		return "", false
+	}
+	s.loginGuard.succeed(user.Username)
+	// OPDS clients have no way to send a second factor, and accepting the
+	// password alone would defeat it.
+	if user.TOTPEnabled {
+		slog.WarnContext(r.Context(), "basic auth refused for account with two-factor enabled", "username", user.Username)
+		return "", false
+	}
+	s.basicCache.put(key, user.Username)
+	return user.Username, true
+}
+
+// challengeBasic asks OPDS clients for credentials on the routes that accept
+// them.
+func challengeBasic(w http.ResponseWriter, r *http.Request) {
+	if acceptsBasicAuth(r) {
+		w.Header().Set("WWW-Authenticate", basicAuthRealm)
+	}
+}
+
+// basicAuthGate rejects bad Basic credentials on the OPDS routes instead of
+// silently serving the anonymous view, so a client with a mistyped password
+// is prompted again rather than seeing a different catalog.
+func (s *Server) basicAuthGate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, _, ok := r.BasicAuth(); ok && acceptsBasicAuth(r) {
+			if _, ok := s.principal(r); !ok {
+				challengeBasic(w, r)
+				http.Error(w, i18n.T("Unauthorized"), http.StatusUnauthorized)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
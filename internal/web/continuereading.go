@@ -0,0 +1,44 @@
+package web
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+	"time"
+
+	"github.com/ab0oo/gopds/internal/i18n"
+)
+
+// HandleContinueReading is the OPDS acquisition feed of books the caller
+// has started on a KOReader device and not finished, most recently read
+// first, paginated like the shelf feeds.
+func (s *Server) HandleContinueReading(w http.ResponseWriter, r *http.Request) {
+	owner := s.shelfOwner(r)
+	filter := s.bookFilter(r)
+	total, err := s.db.CountInProgressBooks(owner, finishedAt, filter)
+	if err != nil {
+		http.Error(w, i18n.T("Internal Server Error"), http.StatusInternalServerError)
+		return
+	}
+
+	p := parseFeedPage(r, "/opds/continue", total)
+
+	books, err := s.db.InProgressBooks(owner, finishedAt, filter, p.limit, p.offset())
+	if err != nil {
+		http.Error(w, i18n.T("Internal Server Error"), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/atom+xml;profile=opds-catalog;kind=acquisition;charset=utf-8")
+	fmt.Fprint(w, opdsFeedStart)
+	fmt.Fprintf(w, `<title>%s</title>`, html.EscapeString(feedTitle(i18n.T("Continue Reading"))))
+	fmt.Fprint(w, `<id>gopds:continue</id>`)
+	fmt.Fprintf(w, `<updated>%s</updated>`, time.Now().UTC().Format(time.RFC3339))
+	fmt.Fprintf(w, `<link rel="self" href="%s" type="application/atom+xml;profile=opds-catalog;kind=acquisition"/>`, html.EscapeString(p.href(p.page)))
+	fmt.Fprint(w, `<link rel="up" href="/opds" type="application/atom+xml;profile=opds-catalog;kind=navigation"/>`)
+	p.writeLinks(w)
+	for _, b := range books {
+		writeOPDSEntry(w, b)
+	}
+	fmt.Fprint(w, `</feed>`)
+}
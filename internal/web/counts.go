@@ -0,0 +1,81 @@
+package web
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/ab0oo/gopds/internal/database"
+)
+
+// navCounts are the counts the root and category navigation feeds show.
+type navCounts struct {
+	// authors holds a count per defaultAuthorBuckets entry.
+	authors    []int
+	categories map[string]int
+}
+
+// countCache keeps navCounts for each library filter in use, so OPDS
+// clients reloading the root feed don't run eight aggregate queries each
+// time. Entries are dropped together when the database's library version
+// moves, which triggers bump on every change that affects the counts.
+type countCache struct {
+	mu      sync.Mutex
+	version int64
+	entries map[string]navCounts
+}
+
+func newCountCache() *countCache {
+	return &countCache{entries: make(map[string]navCounts)}
+}
+
+// filterKey identifies the books a filter admits.
+func filterKey(f database.BookFilter) string {
+	categories := make([]string, len(f.Categories))
+	for i, c := range f.Categories {
+		categories[i] = strings.ToLower(strings.TrimSpace(c))
+	}
+	sort.Strings(categories)
+	return strconv.FormatBool(f.HideAdult) + "\x00" + strings.Join(categories, "\x00")
+}
+
+// navCounts returns the navigation counts for the books f admits, from the
+// cache while the library is unchanged. The result must not be modified.
+func (s *Server) navCounts(f database.BookFilter) (navCounts, error) {
+	version, err := s.libraryVersion()
+	if err != nil {
+		return navCounts{}, err
+	}
+	key := filterKey(f)
+	c := s.counts
+	c.mu.Lock()
+	if c.version != version {
+		c.version = version
+		clear(c.entries)
+	}
+	counts, ok := c.entries[key]
+	c.mu.Unlock()
+	if ok {
+		return counts, nil
+	}
+
+	counts.authors = make([]int, len(defaultAuthorBuckets))
+	for i, b := range defaultAuthorBuckets {
+		if counts.authors[i], err = s.db.CountBooksByAuthorRange(f, b.Start, b.End, false); err != nil {
+			return navCounts{}, err
+		}
+	}
+	if counts.categories, err = s.db.GetCategoryCounts(f); err != nil {
+		return navCounts{}, err
+	}
+
+	c.mu.Lock()
+	// Another request may have seen a newer version meanwhile; counts made
+	// for an older one must not be stored under it.
+	if c.version == version {
+		c.entries[key] = counts
+	}
+	c.mu.Unlock()
+	return counts, nil
+}
@@ -0,0 +1,218 @@
+package web
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ab0oo/gopds/internal/i18n"
+	"github.com/ab0oo/gopds/internal/scanner"
+	"github.com/ab0oo/gopds/internal/storage"
+)
+
+// coverEncoding is a compact cover format produced from the cached JPEG
+// by an external encoder, for clients whose Accept header allows it.
+type coverEncoding struct {
+	Name        string
+	Ext         string
+	ContentType string
+	// Env names the variable holding the encoder's path.
+	Env  string
+	args func(in, out string) []string
+}
+
+// coverEncodings are in order of preference: AVIF is usually the smaller.
+var coverEncodings = []coverEncoding{
+	{Name: "avif", Ext: ".avif", ContentType: "image/avif", Env: "COVER_AVIF_ENCODER", args: func(in, out string) []string {
+		return []string{in, out}
+	}},
+	{Name: "webp", Ext: ".webp", ContentType: "image/webp", Env: "COVER_WEBP_ENCODER", args: func(in, out string) []string {
+		return []string{"-quiet", "-q", "75", in, "-o", out}
+	}},
+}
+
+const coverEncodeTimeout = 30 * time.Second
+
+// coverEncodeSlots bounds how many encoders run at once, so a grid of
+// uncached covers doesn't start a process per image.
+var coverEncodeSlots = make(chan struct{}, runtime.NumCPU())
+
+func (e coverEncoding) encoder() string {
+	return strings.TrimSpace(os.Getenv(e.Env))
+}
+
+// coverEncodingsEnabled reports whether any cover encoder is configured,
+// in which case cover responses vary by Accept.
+func coverEncodingsEnabled() bool {
+	for _, e := range coverEncodings {
+		if e.encoder() != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// negotiateCoverEncoding picks the preferred configured encoding that
+// accept names explicitly. Wildcards don't count: e-readers that send
+// "*/*" get the JPEG the OPDS feed advertises.
+func negotiateCoverEncoding(accept string) (coverEncoding, bool) {
+	for _, e := range coverEncodings {
+		if e.encoder() != "" && acceptsMediaType(accept, e.ContentType) {
+			return e, true
+		}
+	}
+	return coverEncoding{}, false
+}
+
+func acceptsMediaType(accept, mediaType string) bool {
+	for _, part := range strings.Split(accept, ",") {
+		fields := strings.Split(part, ";")
+		if !strings.EqualFold(strings.TrimSpace(fields[0]), mediaType) {
+			continue
+		}
+		for _, param := range fields[1:] {
+			k, v, _ := strings.Cut(strings.TrimSpace(param), "=")
+			if strings.EqualFold(k, "q") {
+				if q, err := strconv.ParseFloat(v, 64); err == nil && q <= 0 {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// encodedCover returns the name of the cached cover jpgName in encoding e,
+// encoding it first if it is missing or older than the JPEG. Encoders work
+// on local files, so the JPEG is copied to a temporary directory and the
+// result stored in the cover cache, wherever that is.
+func encodedCover(ctx context.Context, jpgName string, e coverEncoding) (string, error) {
+	covers := storage.Covers()
+	src, err := covers.Stat(ctx, jpgName)
+	if err != nil {
+		return "", err
+	}
+	out := strings.TrimSuffix(jpgName, ".jpg") + e.Ext
+	if info, err := covers.Stat(ctx, out); err == nil && !info.ModTime().Before(src.ModTime()) {
+		return out, nil
+	}
+
+	select {
+	case coverEncodeSlots <- struct{}{}:
+		defer func() { <-coverEncodeSlots }()
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+	ctx, cancel := context.WithTimeout(ctx, coverEncodeTimeout)
+	defer cancel()
+
+	dir, err := os.MkdirTemp("", "gopds-cover-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(dir)
+	f, err := covers.Open(ctx, jpgName)
+	if err != nil {
+		return "", err
+	}
+	raw, err := io.ReadAll(f)
+	f.Close()
+	if err != nil {
+		return "", err
+	}
+	// Encoders pick the format from the output's suffix.
+	in, tmp := filepath.Join(dir, "cover.jpg"), filepath.Join(dir, "cover"+e.Ext)
+	if err := os.WriteFile(in, raw, 0600); err != nil {
+		return "", err
+	}
+	if output, err := exec.CommandContext(ctx, e.encoder(), e.args(in, tmp)...).CombinedOutput(); err != nil {
+		tail := strings.TrimSpace(string(output))
+		if len(tail) > 500 {
+			tail = tail[len(tail)-500:]
+		}
+		return "", fmt.Errorf("%s encoder failed: %w: %s", e.Name, err, tail)
+	}
+	encoded, err := os.ReadFile(tmp)
+	if err != nil {
+		return "", err
+	}
+	if err := covers.Write(ctx, out, encoded); err != nil {
+		return "", err
+	}
+	return out, nil
+}
+
+// EncodeCover produces every configured encoding of book bookID's cached
+// cover that is missing or stale, for the covers command. The server
+// otherwise encodes a cover the first time a client asks for it.
+func EncodeCover(ctx context.Context, bookID int) error {
+	for _, e := range coverEncodings {
+		if e.encoder() == "" {
+			continue
+		}
+		if _, err := encodedCover(ctx, scanner.CoverName(bookID), e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// serveNegotiatedCover serves the cached cover jpgName in the best format
+// r accepts, falling back to the JPEG if encoding fails. version, if set,
+// is the JPEG's content hash, from which each format's ETag is made.
+func serveNegotiatedCover(w http.ResponseWriter, r *http.Request, jpgName, version string) {
+	if coverEncodingsEnabled() {
+		w.Header().Add("Vary", "Accept")
+	}
+	if e, ok := negotiateCoverEncoding(r.Header.Get("Accept")); ok {
+		name, err := encodedCover(r.Context(), jpgName, e)
+		if err == nil {
+			w.Header().Set("Content-Type", e.ContentType)
+			if version != "" {
+				w.Header().Set("ETag", `"`+version+"-"+e.Name+`"`)
+			}
+			serveCachedCover(w, r, name)
+			return
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			slog.WarnContext(r.Context(), "cover encoding failed; serving JPEG", "name", jpgName, "format", e.Name, "err", err)
+		}
+	}
+	if version != "" {
+		w.Header().Set("ETag", `"`+version+`"`)
+	}
+	serveCachedCover(w, r, jpgName)
+}
+
+// serveCachedCover serves one file from the cover cache.
+func serveCachedCover(w http.ResponseWriter, r *http.Request, name string) {
+	f, err := storage.Covers().Open(r.Context(), name)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) || errors.Is(err, fs.ErrInvalid) {
+			http.Error(w, i18n.T("Cover not found"), http.StatusNotFound)
+			return
+		}
+		slog.ErrorContext(r.Context(), "failed to open cover", "name", name, "err", err)
+		http.Error(w, i18n.T("Internal Server Error"), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		http.Error(w, i18n.T("Internal Server Error"), http.StatusInternalServerError)
+		return
+	}
+	http.ServeContent(w, r, name, info.ModTime(), f)
+}
@@ -0,0 +1,106 @@
+package web
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/ab0oo/gopds/internal/i18n"
+	"github.com/ab0oo/gopds/internal/imaging"
+)
+
+// proxiedCoverTypes are the image types the cover proxy passes on. SVG is
+// left out: it can carry scripts.
+var proxiedCoverTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+	"image/webp": true,
+}
+
+// coverProxyURL is the server-relative URL that previews a remote cover
+// through HandleCoverProxy.
+func coverProxyURL(imageURL string) string {
+	return "/api/covers/proxy?url=" + url.QueryEscape(imageURL)
+}
+
+// remoteCoverImage downloads a cover from an allowed host, keeping it in
+// the lookup cache so the preview, the dimension probe, and applying the
+// cover fetch it once between them.
+func (s *Server) remoteCoverImage(raw string) ([]byte, string, error) {
+	ttl := s.lookupCacheTTL()
+	key := "image " + raw
+	if ttl > 0 {
+		if body, contentType, ok, err := s.db.GetLookupCache(key); err == nil && ok {
+			return body, contentType, nil
+		}
+	}
+	body, err := fetchAllowedRemoteImage(s.upstream, raw)
+	if err != nil {
+		return nil, "", err
+	}
+	contentType := http.DetectContentType(body)
+	if ttl > 0 && len(body) <= maxCachedResponse && proxiedCoverTypes[contentType] {
+		if err := s.db.PutLookupCache(key, contentType, body, ttl); err != nil {
+			slog.Warn("lookup cache write failed", "err", err)
+		}
+	}
+	return body, contentType, nil
+}
+
+// HandleCoverProxy serves a remote cover candidate from this server, so
+// the browser never contacts Google, Open Library, or Wikimedia itself.
+// Only the hosts cover searches use are fetched.
+func (s *Server) HandleCoverProxy(w http.ResponseWriter, r *http.Request) {
+	raw := strings.TrimSpace(r.URL.Query().Get("url"))
+	if raw == "" {
+		http.Error(w, i18n.T("url is required"), http.StatusBadRequest)
+		return
+	}
+	if !isAllowedRemoteCoverURL(raw) {
+		http.Error(w, i18n.T("Remote URL host is not allowed"), http.StatusBadRequest)
+		return
+	}
+	body, contentType, err := s.remoteCoverImage(raw)
+	if err != nil {
+		slog.WarnContext(r.Context(), "cover proxy fetch failed", "url", raw, "err", err)
+		http.Error(w, i18n.T("Failed to fetch remote cover: %v", err), http.StatusBadGateway)
+		return
+	}
+	if !proxiedCoverTypes[contentType] {
+		http.Error(w, i18n.T("Remote URL is not an image"), http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", "private, max-age=86400")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	_, _ = w.Write(body)
+}
+
+// remoteImageDimensions reads a remote cover's width and height from the
+// start of its body, leaving the rest of the image undownloaded.
+func remoteImageDimensions(client *http.Client, raw string) (int, int, error) {
+	body, err := openAllowedRemoteImage(client, raw)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer body.Close()
+	cfg, _, err := imaging.Config(io.LimitReader(body, maxRemoteImage))
+	if err != nil {
+		return 0, 0, fmt.Errorf("reading image size: %w", err)
+	}
+	return cfg.Width, cfg.Height, nil
+}
+
+// imageDimensions reads the width and height from an encoded image.
+func imageDimensions(body []byte) (int, int, bool) {
+	cfg, _, err := imaging.Config(bytes.NewReader(body))
+	if err != nil {
+		return 0, 0, false
+	}
+	return cfg.Width, cfg.Height, true
+}
@@ -0,0 +1,159 @@
+package web
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// onlineCoverDeadline bounds a whole online cover search. Sources and
+// probes still running when it passes are abandoned and the candidates
+// found so far are returned.
+const onlineCoverDeadline = 15 * time.Second
+
+// onlineCoverProbes is how many candidate images are downloaded at once
+// to read their size and hash.
+const onlineCoverProbes = 6
+
+// coverSource is one lookup an online cover search runs.
+type coverSource struct {
+	name  string
+	fetch func() ([]coverCandidate, error)
+}
+
+// onlineCoverSources lists the lookups for a book, skipping providers that
+// are turned off.
+func (s *Server) onlineCoverSources(title, author, isbn string) []coverSource {
+	client := s.upstream
+	useOpenLibrary := s.providerAvailable(providerOpenLibrary)
+	query := strings.TrimSpace(strings.Join([]string{title, author, "book"}, " "))
+	var sources []coverSource
+
+	// Open Library ISBN cover tends to be high quality when ISBN is available.
+	if isbn != "" && useOpenLibrary {
+		sources = append(sources, coverSource{"openlibrary isbn", func() ([]coverCandidate, error) {
+			ol := fmt.Sprintf("https://covers.openlibrary.org/b/isbn/%s-L.jpg?default=false", url.PathEscape(isbn))
+			if !s.remoteImageReachableCached(ol) {
+				return nil, nil
+			}
+			return []coverCandidate{makeRemoteCoverCandidate(ol, fmt.Sprintf("Open Library ISBN %s", isbn), "openlibrary")}, nil
+		}})
+	}
+	if (query != "" || isbn != "") && s.providerAvailable(providerGoogleBooks) {
+		sources = append(sources, coverSource{"googlebooks", func() ([]coverCandidate, error) {
+			return fetchGoogleBookCoverCandidates(client, query, isbn, 8)
+		}})
+	}
+	if query != "" && useOpenLibrary {
+		sources = append(sources, coverSource{"openlibrary search", func() ([]coverCandidate, error) {
+			return fetchOpenLibrarySearchCoverCandidates(client, query, 8)
+		}})
+	}
+	if (title != "" || isbn != "") && s.providerAvailable(providerDouban) {
+		sources = append(sources, coverSource{"douban", func() ([]coverCandidate, error) {
+			return s.douban.coverCandidates(client, strings.TrimSpace(title+" "+author), isbn, 6)
+		}})
+	}
+	if s.providerAvailable(providerWikipedia) {
+		for _, q := range []string{query, strings.TrimSpace(title + " book")} {
+			if q == "" || q == "book" {
+				continue
+			}
+			sources = append(sources, coverSource{"wikipedia", func() ([]coverCandidate, error) {
+				return fetchWikipediaCoverCandidates(client, q, 6)
+			}})
+		}
+	}
+	return sources
+}
+
+// onlineCover is a candidate found by searchOnlineCovers, with the image
+// it was measured from, if it could be downloaded.
+type onlineCover struct {
+	candidate coverCandidate
+	body      []byte
+}
+
+// searchOnlineCovers runs every source at once and downloads each
+// candidate they return, a few at a time, to fill in its size. Candidates
+// smaller than the configured minimum are dropped; the rest go to found as
+// they are measured, one at a time. It returns when everything has
+// finished or ctx is done, whichever is first.
+func (s *Server) searchOnlineCovers(ctx context.Context, bookID int, sources []coverSource, minW, minH int, found func(onlineCover)) {
+	var mu sync.Mutex
+	done := false
+	report := func(c onlineCover) {
+		mu.Lock()
+		defer mu.Unlock()
+		if !done {
+			found(c)
+		}
+	}
+
+	probes := make(chan struct{}, onlineCoverProbes)
+	var wg sync.WaitGroup
+	var seenMu sync.Mutex
+	seen := map[string]struct{}{}
+	probe := func(c coverCandidate) {
+		defer wg.Done()
+		select {
+		case probes <- struct{}{}:
+		case <-ctx.Done():
+			return
+		}
+		defer func() { <-probes }()
+		if w, h, ok := s.probeCoverCached(c.ImageURL); ok {
+			c.Width, c.Height = w, h
+		}
+		if c.Width > 0 && c.Height > 0 && (c.Width < minW || c.Height < minH) {
+			return
+		}
+		body, _, err := s.remoteCoverImage(c.ImageURL)
+		if err != nil {
+			body = nil
+		}
+		report(onlineCover{candidate: c, body: body})
+	}
+
+	for _, src := range sources {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			candidates, err := src.fetch()
+			if err != nil {
+				slog.WarnContext(ctx, "covers.online: source error", "book_id", bookID, "source", src.name, "err", err)
+				return
+			}
+			slog.DebugContext(ctx, "covers.online: source candidates", "book_id", bookID, "source", src.name, "count", len(candidates))
+			for _, c := range candidates {
+				seenMu.Lock()
+				_, dup := seen[c.ImageURL]
+				seen[c.ImageURL] = struct{}{}
+				seenMu.Unlock()
+				if dup {
+					continue
+				}
+				wg.Add(1)
+				go probe(c)
+			}
+		}()
+	}
+
+	finished := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-ctx.Done():
+		slog.WarnContext(ctx, "covers.online: deadline reached; returning candidates found so far", "book_id", bookID)
+	}
+	mu.Lock()
+	done = true
+	mu.Unlock()
+}
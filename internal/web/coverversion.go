@@ -0,0 +1,103 @@
+package web
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ab0oo/gopds/internal/scanner"
+	"github.com/ab0oo/gopds/internal/settings"
+	"github.com/ab0oo/gopds/internal/storage"
+)
+
+// coverMaxAge is how long clients may keep a cover fetched through a
+// versioned URL, one whose v parameter matches the current cover. A new
+// cover gets a new URL, so these never go stale.
+const coverMaxAge = 365 * 24 * time.Hour
+
+// coverRevalidateAge is how long clients may keep a cover fetched without
+// a current version before asking again with its ETag.
+const coverRevalidateAge = time.Hour
+
+// coverVersions caches each cover's content hash by name, recomputed when
+// the file's size or modification time changes.
+var coverVersions sync.Map // string -> coverVersionEntry
+
+type coverVersionEntry struct {
+	modTime time.Time
+	size    int64
+	version string
+}
+
+// coverVersion returns a short hash of the cached cover named name, or ""
+// if there is none.
+func coverVersion(ctx context.Context, name string) string {
+	covers := storage.Covers()
+	info, err := covers.Stat(ctx, name)
+	if err != nil {
+		coverVersions.Delete(name)
+		return ""
+	}
+	if v, ok := coverVersions.Load(name); ok {
+		e := v.(coverVersionEntry)
+		if e.size == info.Size() && e.modTime.Equal(info.ModTime()) {
+			return e.version
+		}
+	}
+	f, err := covers.Open(ctx, name)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return ""
+	}
+	version := hex.EncodeToString(h.Sum(nil)[:8])
+	coverVersions.Store(name, coverVersionEntry{modTime: info.ModTime(), size: info.Size(), version: version})
+	return version
+}
+
+// coverURL is book id's cover link, versioned so clients can cache it
+// for good.
+func coverURL(id int) string {
+	if v := coverVersion(context.Background(), scanner.CoverName(id)); v != "" {
+		return fmt.Sprintf("/covers/%d.jpg?v=%s", id, v)
+	}
+	return fmt.Sprintf("/covers/%d.jpg", id)
+}
+
+// readCover returns book id's cached cover.
+func readCover(ctx context.Context, id int) ([]byte, error) {
+	f, err := storage.Covers().Open(ctx, scanner.CoverName(id))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+// writeCover replaces book id's cached cover.
+func writeCover(ctx context.Context, id int, jpg []byte) error {
+	return storage.Covers().Write(ctx, scanner.CoverName(id), jpg)
+}
+
+// setCoverCacheHeaders lets clients and proxies keep a cover. Shared
+// caches may only keep it when anyone may see every cover; otherwise a
+// cover one user may see could be handed to another who may not.
+func (s *Server) setCoverCacheHeaders(w http.ResponseWriter, r *http.Request, version string) {
+	scope := "public"
+	if !s.settings.Bool(settings.PublicCovers) || s.settings.Bool(settings.HideAdult) {
+		scope = "private"
+	}
+	if r.URL.Query().Get("v") == version {
+		w.Header().Set("Cache-Control", fmt.Sprintf("%s, max-age=%d, immutable", scope, int(coverMaxAge.Seconds())))
+	} else {
+		w.Header().Set("Cache-Control", fmt.Sprintf("%s, max-age=%d", scope, int(coverRevalidateAge.Seconds())))
+	}
+}
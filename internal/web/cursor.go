@@ -0,0 +1,95 @@
+package web
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/ab0oo/gopds/internal/database"
+	"github.com/ab0oo/gopds/internal/i18n"
+)
+
+// maxBooksPage caps the limit a paged /api/books request may ask for.
+const maxBooksPage = 1000
+
+// errPageFull stops a book iteration once a page has been filled.
+var errPageFull = errors.New("page full")
+
+// afterParam parses the ?after= cursor, which is nil when absent.
+func afterParam(r *http.Request) (*database.BookCursor, error) {
+	token := strings.TrimSpace(r.URL.Query().Get("after"))
+	if token == "" {
+		return nil, nil
+	}
+	return database.ParseBookCursor(token)
+}
+
+// pageBooks writes one page of the books the caller may see, in catalog
+// order, starting after the ?after= cursor. A Link header points to the
+// next page while there is one. ?genre= applies as in streamBooks.
+func (s *Server) pageBooks(w http.ResponseWriter, r *http.Request, stream *bookStream) {
+	q := r.URL.Query()
+	limit := parseIntDefault(q.Get("limit"), 100)
+	if limit < 1 {
+		limit = 100
+	}
+	if limit > maxBooksPage {
+		limit = maxBooksPage
+	}
+	after, err := afterParam(r)
+	if err != nil {
+		http.Error(w, i18n.T("Invalid after cursor"), http.StatusBadRequest)
+		return
+	}
+	genre := ""
+	if raw := strings.TrimSpace(q.Get("genre")); raw != "" {
+		var ok bool
+		if genre, ok = s.genres.Canonical(raw); !ok {
+			http.Error(w, i18n.T("Unknown genre"), http.StatusBadRequest)
+			return
+		}
+	}
+
+	books := make([]database.Book, 0, limit)
+	more := false
+	err = s.db.ForEachBookAfter(s.bookFilter(r), after, func(b database.Book, subjects []string) error {
+		if genre != "" && !slices.Contains(s.genres.Map(subjects), genre) {
+			return nil
+		}
+		if len(books) == limit {
+			more = true
+			return errPageFull
+		}
+		books = append(books, b)
+		return nil
+	})
+	if err != nil && !errors.Is(err, errPageFull) {
+		slog.ErrorContext(r.Context(), "failed to list books", "err", err)
+		http.Error(w, i18n.T("Internal Server Error"), http.StatusInternalServerError)
+		return
+	}
+
+	if more {
+		next := url.Values{}
+		for k, v := range q {
+			next[k] = v
+		}
+		next.Set("limit", fmt.Sprint(limit))
+		next.Set("after", database.CursorAfter(books[len(books)-1]).String())
+		w.Header().Set("Link", fmt.Sprintf(`<%s?%s>; rel="next"`, r.URL.Path, next.Encode()))
+	}
+	w.Header().Set("Content-Type", stream.contentType)
+	if err := stream.begin(w); err != nil {
+		return
+	}
+	for _, b := range books {
+		if err := stream.write(w, b); err != nil {
+			return
+		}
+	}
+	_ = stream.end(w)
+}
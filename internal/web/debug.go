@@ -0,0 +1,36 @@
+package web
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// mountDebug exposes net/http/pprof under /debug/pprof/ when ENABLE_PPROF is
+// set. Profiles reveal memory contents and cost CPU, so every route sits
+// behind admin auth and the whole tree is off by default.
+func (s *Server) mountDebug(r chi.Router) {
+	if !envBool("ENABLE_PPROF") {
+		return
+	}
+	slog.Info("pprof enabled at /debug/pprof/ (admin only)")
+	r.Get("/debug/pprof/cmdline", s.requireScope(scopeAdmin, pprof.Cmdline))
+	r.Get("/debug/pprof/profile", s.requireScope(scopeAdmin, pprof.Profile))
+	r.Get("/debug/pprof/symbol", s.requireScope(scopeAdmin, pprof.Symbol))
+	r.Post("/debug/pprof/symbol", s.requireScope(scopeAdmin, pprof.Symbol))
+	r.Get("/debug/pprof/trace", s.requireScope(scopeAdmin, pprof.Trace))
+	// Index also serves the named profiles (heap, goroutine, allocs, ...).
+	r.Get("/debug/pprof/*", s.requireScope(scopeAdmin, pprof.Index))
+	r.Get("/debug/pprof", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/debug/pprof/", http.StatusMovedPermanently)
+	})
+}
+
+func envBool(name string) bool {
+	raw := strings.ToLower(strings.TrimSpace(os.Getenv(name)))
+	return raw == "1" || raw == "true" || raw == "yes" || raw == "on"
+}
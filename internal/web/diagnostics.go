@@ -0,0 +1,16 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// HandleDiagnostics runs the startup checks again: library and data folders,
+// database, and DNS for online lookups. It answers 200 even when a check
+// fails, since the report itself is the answer.
+func (s *Server) HandleDiagnostics(w http.ResponseWriter, r *http.Request) {
+	report := s.diagnostics.Run(r.Context())
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	_ = json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,275 @@
+package web
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/ab0oo/gopds/internal/database"
+	"github.com/ab0oo/gopds/internal/i18n"
+)
+
+const (
+	// maxDigestBooks caps one email; the rest are summarized with a link
+	// to the new-additions feed.
+	maxDigestBooks = 50
+	// maxDigestDescription is how much of each book's description a
+	// digest quotes, in characters.
+	maxDigestDescription = 400
+	digestCheckInterval  = 15 * time.Minute
+	digestSendTimeout    = time.Minute
+)
+
+var digestPeriods = map[string]time.Duration{
+	database.DigestDaily:  24 * time.Hour,
+	database.DigestWeekly: 7 * 24 * time.Hour,
+}
+
+type digestRequest struct {
+	Frequency string `json:"frequency"`
+}
+
+// HandleDigest returns the caller's digest subscription.
+func (s *Server) HandleDigest(w http.ResponseWriter, r *http.Request) {
+	username, _ := s.authenticatedUser(r)
+	sub, err := s.db.GetDigestSubscription(username)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, i18n.T("You aren't subscribed to digests"), http.StatusNotFound)
+			return
+		}
+		http.Error(w, i18n.T("Internal Server Error"), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(sub)
+}
+
+// HandleSubscribeDigest subscribes the caller to a daily or weekly email of
+// new books, sent to their account's address. Links in the email use the
+// address this request came in on.
+func (s *Server) HandleSubscribeDigest(w http.ResponseWriter, r *http.Request) {
+	if !s.mailer.Enabled() {
+		http.Error(w, i18n.T("Email is not configured"), http.StatusServiceUnavailable)
+		return
+	}
+	var req digestRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, i18n.T("Invalid JSON body"), http.StatusBadRequest)
+		return
+	}
+	frequency := strings.ToLower(strings.TrimSpace(req.Frequency))
+	if _, ok := digestPeriods[frequency]; !ok {
+		http.Error(w, i18n.T("frequency must be daily or weekly"), http.StatusBadRequest)
+		return
+	}
+	username, _ := s.authenticatedUser(r)
+	user, err := s.db.GetUserByName(username)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, i18n.T("Internal Server Error"), http.StatusInternalServerError)
+		return
+	}
+	if err != nil || user.Email == "" {
+		http.Error(w, i18n.T("Digests need an account with an email address"), http.StatusBadRequest)
+		return
+	}
+	token, err := generateLinkToken()
+	if err != nil {
+		http.Error(w, i18n.T("Failed to generate token"), http.StatusInternalServerError)
+		return
+	}
+	sub, err := s.db.SubscribeDigest(user.Username, frequency, requestBaseURL(r), token)
+	if err != nil {
+		http.Error(w, i18n.T("Internal Server Error"), http.StatusInternalServerError)
+		return
+	}
+	slog.InfoContext(r.Context(), "digest subscription saved", "username", user.Username, "frequency", frequency)
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(sub)
+}
+
+// HandleUnsubscribeDigest cancels the caller's digest subscription.
+func (s *Server) HandleUnsubscribeDigest(w http.ResponseWriter, r *http.Request) {
+	username, _ := s.authenticatedUser(r)
+	found, err := s.db.UnsubscribeDigest(username)
+	if err != nil {
+		http.Error(w, i18n.T("Internal Server Error"), http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.Error(w, i18n.T("You aren't subscribed to digests"), http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleDigestUnsubscribeLink is where the unsubscribe link in each digest
+// leads. It works without signing in, since the token in the link is only
+// good for cancelling that one subscription. GET only asks to confirm, as
+// mail scanners open links to check them, and the form POSTs back here.
+func (s *Server) HandleDigestUnsubscribeLink(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimSpace(r.URL.Query().Get("token"))
+	if token == "" {
+		http.Error(w, i18n.T("token is required"), http.StatusBadRequest)
+		return
+	}
+	if r.Method == http.MethodGet {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprintf(w, `<!DOCTYPE html><html><body style="font-family: sans-serif;"><form method="post" action="?token=%s"><p>%s</p><button type="submit">%s</button></form></body></html>`,
+			html.EscapeString(url.QueryEscape(token)), html.EscapeString(i18n.T("Stop getting GoPDS digests of new books?")), html.EscapeString(i18n.T("Unsubscribe")))
+		return
+	}
+	found, err := s.db.UnsubscribeDigestByToken(token)
+	if err != nil {
+		http.Error(w, i18n.T("Internal Server Error"), http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.Error(w, i18n.T("This unsubscribe link is no longer valid"), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintln(w, i18n.T("You won't get any more GoPDS digests."))
+}
+
+// RunDigestSchedule emails each subscriber the books added since their last
+// digest once their day or week is up, until ctx is cancelled. A digest
+// with nothing new isn't sent, and one that fails is retried at the next
+// check.
+func (s *Server) RunDigestSchedule(ctx context.Context) {
+	if !s.mailer.Enabled() {
+		return
+	}
+	ticker := time.NewTicker(digestCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			subs, err := s.db.DigestSubscriptions()
+			if err != nil {
+				slog.ErrorContext(ctx, "failed to list digest subscriptions", "err", err)
+				continue
+			}
+			for _, sub := range subs {
+				if now.Sub(sub.LastSentAt) < digestPeriods[sub.Frequency] {
+					continue
+				}
+				if err := s.sendDigest(ctx, sub, now); err != nil {
+					slog.WarnContext(ctx, "failed to send digest", "username", sub.Username, "err", err)
+				}
+			}
+		}
+	}
+}
+
+// sendDigest emails sub's user the books added since their last digest
+// that they may see, and records the digest as sent up to now.
+func (s *Server) sendDigest(ctx context.Context, sub database.DigestSubscription, now time.Time) error {
+	user, err := s.db.GetUserByName(sub.Username)
+	if errors.Is(err, sql.ErrNoRows) {
+		slog.InfoContext(ctx, "dropping digest subscription of deleted account", "username", sub.Username)
+		_, err = s.db.UnsubscribeDigest(sub.Username)
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	if user.Email == "" {
+		// Kept until an address is added, when the books since are sent.
+		return nil
+	}
+	filter := s.principalFilter(principal{Name: user.Username, Role: user.Role, Scopes: roleScopes[user.Role], Filter: user.Filter()})
+	books, err := s.db.RecentlyAddedBooks(filter, database.AdditionFilter{Since: sub.LastSentAt}, maxDigestBooks+1, nil)
+	if err != nil {
+		return err
+	}
+	if len(books) > 0 {
+		subject := i18n.T("1 new book in your GoPDS library")
+		if len(books) > 1 {
+			subject = i18n.T("%d new books in your GoPDS library", len(books))
+		}
+		if len(books) > maxDigestBooks {
+			subject = i18n.T("More than %d new books in your GoPDS library", maxDigestBooks)
+		}
+		text, body := s.digestBodies(sub, books)
+		sendCtx, cancel := context.WithTimeout(ctx, digestSendTimeout)
+		err := s.mailer.SendHTML(sendCtx, user.Email, subject, text, body)
+		cancel()
+		if err != nil {
+			return err
+		}
+		slog.InfoContext(ctx, "digest sent", "username", user.Username, "books", min(len(books), maxDigestBooks))
+	}
+	return s.db.MarkDigestSent(user.Username, now)
+}
+
+// digestBodies renders a digest as plain text and as HTML. Descriptions
+// come from the EPUBs, so only their text is used.
+func (s *Server) digestBodies(sub database.DigestSubscription, books []database.AddedBook) (string, string) {
+	base := strings.TrimRight(sub.BaseURL, "/")
+	more := len(books) > maxDigestBooks
+	books = books[:min(len(books), maxDigestBooks)]
+	unsubscribe := base + "/api/digest/unsubscribe?token=" + url.QueryEscape(sub.UnsubscribeToken)
+
+	var text, body strings.Builder
+	body.WriteString(`<!DOCTYPE html><html><body style="font-family: sans-serif;">`)
+	fmt.Fprintf(&body, `<h2>%s</h2>`, html.EscapeString(i18n.T("New in your GoPDS library")))
+	for _, b := range books {
+		download := fmt.Sprintf("%s/download/%d", base, b.ID)
+		series := ""
+		if b.Series != "" {
+			series = b.Series
+			if b.SeriesIndex != "" {
+				series += " #" + strings.TrimSuffix(b.SeriesIndex, ".0")
+			}
+		}
+		description := strings.Join(strings.Fields(html.UnescapeString(htmlTagPattern.ReplaceAllString(b.Description, " "))), " ")
+		if r := []rune(description); len(r) > maxDigestDescription {
+			description = strings.TrimSpace(string(r[:maxDigestDescription])) + "…"
+		}
+
+		fmt.Fprintf(&text, "%s\n", b.Title)
+		if b.Author != "" {
+			fmt.Fprintf(&text, "%s\n", b.Author)
+		}
+		if series != "" {
+			fmt.Fprintf(&text, "%s\n", series)
+		}
+		fmt.Fprintf(&text, "%s\n\n", download)
+
+		body.WriteString(`<table cellpadding="6" style="margin-bottom: 12px;"><tr>`)
+		fmt.Fprintf(&body, `<td valign="top"><a href="%s"><img src="%s" width="80" alt=""></a></td>`,
+			html.EscapeString(download), html.EscapeString(base+coverURL(b.ID)))
+		fmt.Fprintf(&body, `<td valign="top"><a href="%s"><strong>%s</strong></a>`, html.EscapeString(download), html.EscapeString(b.Title))
+		if b.Author != "" {
+			fmt.Fprintf(&body, `<br>%s`, html.EscapeString(b.Author))
+		}
+		if series != "" {
+			fmt.Fprintf(&body, `<br><em>%s</em>`, html.EscapeString(series))
+		}
+		if description != "" {
+			fmt.Fprintf(&body, `<p>%s</p>`, html.EscapeString(description))
+		}
+		body.WriteString(`</td></tr></table>`)
+	}
+	if more {
+		feed := base + "/rss/new"
+		fmt.Fprintf(&text, "%s\n%s\n\n", i18n.T("More were added; see the full list:"), feed)
+		fmt.Fprintf(&body, `<p>%s <a href="%s">%s</a></p>`, html.EscapeString(i18n.T("More were added; see the full list:")), html.EscapeString(feed), html.EscapeString(feed))
+	}
+	footer := i18n.T("You get this %s digest because you subscribed in GoPDS.", sub.Frequency)
+	fmt.Fprintf(&text, "--\n%s\n%s %s\n", footer, i18n.T("Unsubscribe:"), unsubscribe)
+	fmt.Fprintf(&body, `<hr><p style="color: #666; font-size: small;">%s <a href="%s">%s</a></p></body></html>`,
+		html.EscapeString(footer), html.EscapeString(unsubscribe), html.EscapeString(i18n.T("Unsubscribe")))
+	return text.String(), body.String()
+}
@@ -0,0 +1,174 @@
+package web
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const defaultDoubanAPIURL = "https://api.douban.com/v2/book"
+
+// doubanAPI is a Douban Books v2-compatible API. Douban closed public
+// registration for its own API, so DOUBAN_API_URL may point at a
+// self-hosted service that answers in the same format instead.
+type doubanAPI struct {
+	baseURL string
+	apiKey  string
+}
+
+// doubanFromEnv reads DOUBAN_API_URL (default https://api.douban.com/v2/book)
+// and DOUBAN_API_KEY.
+func doubanFromEnv() doubanAPI {
+	base := strings.TrimRight(strings.TrimSpace(os.Getenv("DOUBAN_API_URL")), "/")
+	if base == "" {
+		base = defaultDoubanAPIURL
+	}
+	return doubanAPI{baseURL: base, apiKey: strings.TrimSpace(os.Getenv("DOUBAN_API_KEY"))}
+}
+
+type doubanBook struct {
+	ID        string   `json:"id"`
+	Title     string   `json:"title"`
+	Subtitle  string   `json:"subtitle"`
+	Author    []string `json:"author"`
+	Publisher string   `json:"publisher"`
+	PubDate   string   `json:"pubdate"`
+	ISBN13    string   `json:"isbn13"`
+	ISBN10    string   `json:"isbn10"`
+	Summary   string   `json:"summary"`
+	Tags      []struct {
+		Name string `json:"name"`
+	} `json:"tags"`
+	Series *struct {
+		Title string `json:"title"`
+	} `json:"series"`
+	Rating struct {
+		// Average is a string out of 10 in Douban's responses.
+		Average   string `json:"average"`
+		NumRaters int    `json:"numRaters"`
+	} `json:"rating"`
+	Images struct {
+		Large  string `json:"large"`
+		Medium string `json:"medium"`
+	} `json:"images"`
+	URL string `json:"alt"`
+}
+
+type doubanSearchResponse struct {
+	Books []doubanBook `json:"books"`
+}
+
+func (d doubanAPI) endpoint(path string, q url.Values) string {
+	if q == nil {
+		q = url.Values{}
+	}
+	if d.apiKey != "" {
+		q.Set("apikey", d.apiKey)
+	}
+	endpoint := d.baseURL + path
+	if len(q) > 0 {
+		endpoint += "?" + q.Encode()
+	}
+	return endpoint
+}
+
+// search runs a keyword search.
+func (d doubanAPI) search(client *http.Client, q string, limit int) ([]doubanBook, error) {
+	if limit <= 0 {
+		limit = 6
+	}
+	var decoded doubanSearchResponse
+	err := fetchJSON(client, d.endpoint("/search", url.Values{"q": {q}, "count": {strconv.Itoa(limit)}}), &decoded)
+	return decoded.Books, err
+}
+
+// byISBN looks up one edition.
+func (d doubanAPI) byISBN(client *http.Client, isbn string) (*doubanBook, error) {
+	isbn = normalizeISBN(isbn)
+	if isbn == "" {
+		return nil, fmt.Errorf("invalid isbn")
+	}
+	var book doubanBook
+	if err := fetchJSON(client, d.endpoint("/isbn/"+url.PathEscape(isbn), nil), &book); err != nil {
+		return nil, err
+	}
+	return &book, nil
+}
+
+func (b doubanBook) candidate(source string) metadataCandidate {
+	title := strings.TrimSpace(b.Title)
+	if sub := strings.TrimSpace(b.Subtitle); sub != "" && title != "" {
+		title += ": " + sub
+	}
+	var tags []string
+	for _, t := range b.Tags {
+		tags = append(tags, t.Name)
+	}
+	tags = uniqueClean(tags)
+	if len(tags) > 12 {
+		tags = tags[:12]
+	}
+	c := metadataCandidate{
+		Source:      source,
+		Title:       title,
+		Author:      firstNonEmpty(b.Author),
+		Identifier:  pickISBN([]string{b.ISBN13}, []string{b.ISBN10}, ""),
+		Publisher:   strings.TrimSpace(b.Publisher),
+		Date:        strings.TrimSpace(b.PubDate),
+		Description: strings.TrimSpace(b.Summary),
+		Subjects:    tags,
+		Key:         strings.TrimSpace(b.URL),
+	}
+	if c.Key == "" && b.ID != "" {
+		c.Key = "https://book.douban.com/subject/" + b.ID + "/"
+	}
+	if b.Series != nil {
+		c.Series = strings.TrimSpace(b.Series.Title)
+	}
+	if avg, err := strconv.ParseFloat(strings.TrimSpace(b.Rating.Average), 64); err == nil && avg > 0 {
+		c.Rating = avg / 2
+		c.RatingsCount = b.Rating.NumRaters
+	}
+	return c
+}
+
+// coverURL is the largest cover Douban has for b.
+func (b doubanBook) coverURL() string {
+	raw := pickFirstNonEmpty(b.Images.Large, b.Images.Medium)
+	return strings.Replace(raw, "http://", "https://", 1)
+}
+
+// coverCandidates returns the covers of the editions matching
+// isbn and query.
+func (d doubanAPI) coverCandidates(client *http.Client, query, isbn string, limit int) ([]coverCandidate, error) {
+	var books []doubanBook
+	if isbn != "" {
+		if b, err := d.byISBN(client, isbn); err == nil {
+			books = append(books, *b)
+		}
+	}
+	if query != "" {
+		found, err := d.search(client, query, limit)
+		if err != nil && len(books) == 0 {
+			return nil, err
+		}
+		books = append(books, found...)
+	}
+	out := make([]coverCandidate, 0, len(books))
+	for _, b := range books {
+		if img := b.coverURL(); img != "" && isAllowedRemoteCoverURL(img) {
+			out = append(out, makeRemoteCoverCandidate(img, "Douban "+strings.TrimSpace(b.Title), "douban"))
+		}
+	}
+	return out, nil
+}
+
+// isDoubanImageHost reports whether host serves Douban images, which are
+// refused without a douban.com Referer.
+func isDoubanImageHost(host string) bool {
+	host = strings.ToLower(host)
+	return host == "doubanio.com" || strings.HasSuffix(host, ".doubanio.com")
+}
@@ -0,0 +1,210 @@
+package web
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ab0oo/gopds/internal/database"
+	"github.com/ab0oo/gopds/internal/i18n"
+)
+
+// exportColumns is the header row of CSV exports; bookExportRecord must
+// emit fields in the same order.
+var exportColumns = []string{"id", "path", "title", "author", "description", "category", "subcategory", "series", "series_index", "file_hash", "mod_time"}
+
+func bookExportRecord(b database.Book) []string {
+	return []string{
+		strconv.Itoa(b.ID),
+		b.Path,
+		b.Title,
+		b.Author,
+		b.Description,
+		b.Category,
+		b.Subcategory,
+		b.Series,
+		b.SeriesIndex,
+		b.FileHash,
+		b.ModTime.UTC().Format(time.RFC3339),
+	}
+}
+
+// bookStream writes books one at a time in a particular format.
+type bookStream struct {
+	contentType string
+	ext         string
+	begin       func(io.Writer) error
+	write       func(io.Writer, database.Book) error
+	end         func(io.Writer) error
+}
+
+func newBookStream(format string) (*bookStream, bool) {
+	switch strings.ToLower(strings.TrimSpace(format)) {
+	case "json":
+		first := true
+		return &bookStream{
+			contentType: "application/json",
+			ext:         "json",
+			begin: func(w io.Writer) error {
+				_, err := io.WriteString(w, "[")
+				return err
+			},
+			write: func(w io.Writer, b database.Book) error {
+				if !first {
+					if _, err := io.WriteString(w, ","); err != nil {
+						return err
+					}
+				}
+				first = false
+				raw, err := json.Marshal(b)
+				if err != nil {
+					return err
+				}
+				_, err = w.Write(raw)
+				return err
+			},
+			end: func(w io.Writer) error {
+				_, err := io.WriteString(w, "]\n")
+				return err
+			},
+		}, true
+	case "ndjson":
+		return &bookStream{
+			contentType: "application/x-ndjson",
+			ext:         "ndjson",
+			begin:       func(io.Writer) error { return nil },
+			write: func(w io.Writer, b database.Book) error {
+				return json.NewEncoder(w).Encode(b)
+			},
+			end: func(io.Writer) error { return nil },
+		}, true
+	case "csv":
+		var cw *csv.Writer
+		return &bookStream{
+			contentType: "text/csv; charset=utf-8",
+			ext:         "csv",
+			begin: func(w io.Writer) error {
+				cw = csv.NewWriter(w)
+				return cw.Write(exportColumns)
+			},
+			write: func(w io.Writer, b database.Book) error {
+				return cw.Write(bookExportRecord(b))
+			},
+			end: func(io.Writer) error {
+				cw.Flush()
+				return cw.Error()
+			},
+		}, true
+	default:
+		return nil, false
+	}
+}
+
+// formatFromAccept maps an Accept header to a bookStream format, preferring
+// NDJSON and CSV when the client lists them and falling back to JSON.
+func formatFromAccept(accept string) string {
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, _, _ := strings.Cut(part, ";")
+		switch strings.ToLower(strings.TrimSpace(mediaType)) {
+		case "application/x-ndjson", "application/ndjson", "application/jsonl":
+			return "ndjson"
+		case "text/csv":
+			return "csv"
+		}
+	}
+	return "json"
+}
+
+// streamBooks writes every book the caller may see using the given format,
+// flushing as it goes so memory use stays flat regardless of library size.
+// ?genre= limits it to one genre's books.
+func (s *Server) streamBooks(w http.ResponseWriter, r *http.Request, stream *bookStream) {
+	genre := ""
+	if raw := strings.TrimSpace(r.URL.Query().Get("genre")); raw != "" {
+		var ok bool
+		if genre, ok = s.genres.Canonical(raw); !ok {
+			http.Error(w, i18n.T("Unknown genre"), http.StatusBadRequest)
+			return
+		}
+	}
+	flusher, _ := w.(http.Flusher)
+	streamWithoutDeadline(w)
+	w.Header().Set("Content-Type", stream.contentType)
+	if err := stream.begin(w); err != nil {
+		return
+	}
+
+	n := 0
+	write := func(b database.Book) error {
+		if err := stream.write(w, b); err != nil {
+			return err
+		}
+		n++
+		if flusher != nil && n%500 == 0 {
+			flusher.Flush()
+		}
+		return nil
+	}
+	var err error
+	if genre != "" {
+		err = s.db.ForEachBookWithSubjects(s.bookFilter(r), func(b database.Book, subjects []string) error {
+			if !slices.Contains(s.genres.Map(subjects), genre) {
+				return nil
+			}
+			return write(b)
+		})
+	} else {
+		err = s.db.ForEachVisibleBook(s.bookFilter(r), write)
+	}
+	if err != nil {
+		// Headers are already sent; all we can do is stop and log.
+		slog.WarnContext(r.Context(), "book stream aborted", "rows", n, "err", err)
+		return
+	}
+	_ = stream.end(w)
+}
+
+// HandleExport streams the full catalog for backup or migration.
+// Query: format=csv|json|ndjson (default json).
+func (s *Server) HandleExport(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if strings.TrimSpace(format) == "" {
+		format = "json"
+	}
+	stream, ok := newBookStream(format)
+	if !ok {
+		http.Error(w, i18n.T("Invalid format. Use csv, json, or ndjson"), http.StatusBadRequest)
+		return
+	}
+
+	filename := fmt.Sprintf("gopds-export-%s.%s", time.Now().UTC().Format("20060102"), stream.ext)
+	w.Header().Set("Content-Disposition", attachment(filename))
+	s.streamBooks(w, r, stream)
+}
+
+// ExportBooks writes every book to w in format (csv, json, or ndjson), as
+// HandleExport does, for the export command.
+func ExportBooks(db *database.DB, w io.Writer, format string) (int, error) {
+	stream, ok := newBookStream(format)
+	if !ok {
+		return 0, fmt.Errorf("invalid format %q: use csv, json, or ndjson", format)
+	}
+	if err := stream.begin(w); err != nil {
+		return 0, err
+	}
+	n := 0
+	if err := db.ForEachBook(func(b database.Book) error {
+		n++
+		return stream.write(w, b)
+	}); err != nil {
+		return n, err
+	}
+	return n, stream.end(w)
+}
@@ -0,0 +1,145 @@
+package web
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/ab0oo/gopds/internal/database"
+)
+
+// errUnknownUser is returned when an external login names an account that
+// doesn't exist and auto-creation is off.
+var errUnknownUser = errors.New("no such user and auto-creation is disabled")
+
+// roleMapping turns the groups an external identity provider reports into a
+// GoPDS role.
+type roleMapping struct {
+	AdminGroups  []string
+	EditorGroups []string
+	DefaultRole  string
+}
+
+// roleMappingFromEnv reads <prefix>_ADMIN_GROUPS, <prefix>_EDITOR_GROUPS, and
+// <prefix>_DEFAULT_ROLE.
+func roleMappingFromEnv(prefix string) roleMapping {
+	m := roleMapping{
+		AdminGroups:  splitEnvList(prefix + "_ADMIN_GROUPS"),
+		EditorGroups: splitEnvList(prefix + "_EDITOR_GROUPS"),
+		DefaultRole:  roleReader,
+	}
+	if raw := os.Getenv(prefix + "_DEFAULT_ROLE"); strings.TrimSpace(raw) != "" {
+		role, err := parseRole(raw, roleReader)
+		if err != nil {
+			slog.Warn("ignoring invalid default role", "env", prefix+"_DEFAULT_ROLE", "value", raw)
+		} else {
+			m.DefaultRole = role
+		}
+	}
+	return m
+}
+
+// splitEnvList reads a comma-separated environment variable.
+func splitEnvList(env string) []string {
+	var out []string
+	for _, part := range strings.Split(os.Getenv(env), ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			out = append(out, part)
+		}
+	}
+	return out
+}
+
+// isFalse reports whether raw explicitly turns an option off, for settings
+// that default to on.
+func isFalse(raw string) bool {
+	switch strings.ToLower(strings.TrimSpace(raw)) {
+	case "0", "false", "no", "off":
+		return true
+	}
+	return false
+}
+
+// syncsRoles reports whether group mappings are configured. Without them,
+// roles of existing accounts are left to the admin API.
+func (m roleMapping) syncsRoles() bool {
+	return len(m.AdminGroups) > 0 || len(m.EditorGroups) > 0
+}
+
+func (m roleMapping) role(groups []string) string {
+	member := func(want []string) bool {
+		for _, g := range groups {
+			for _, w := range want {
+				if strings.EqualFold(strings.TrimSpace(g), w) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	switch {
+	case member(m.AdminGroups):
+		return roleAdmin
+	case member(m.EditorGroups):
+		return roleEditor
+	}
+	return m.DefaultRole
+}
+
+// provisionExternalUser returns the account for a user an external provider
+// has authenticated, creating it on first sight when autoCreate is set. If
+// group mappings are configured the role is re-derived on every login, except
+// that the last admin is never demoted.
+func (s *Server) provisionExternalUser(ctx context.Context, source, username string, groups []string, m roleMapping, autoCreate bool) (*database.User, error) {
+	username = strings.TrimSpace(username)
+	if !usernamePattern.MatchString(username) {
+		return nil, fmt.Errorf("username %q from %s is not a valid GoPDS username", username, source)
+	}
+	role := m.role(groups)
+
+	user, err := s.db.GetUserByName(username)
+	if errors.Is(err, sql.ErrNoRows) {
+		if !autoCreate {
+			return nil, errUnknownUser
+		}
+		// With no admin yet, e.g. a server that only uses SSO, the first
+		// account to sign in takes the role so the server can be managed.
+		if n, err := s.db.CountUsersWithRole(roleAdmin); err == nil && n == 0 {
+			role = roleAdmin
+		}
+		user, err = s.db.CreateExternalUser(username, role, source)
+		if errors.Is(err, database.ErrUserExists) {
+			// Another request created it first.
+			return s.db.GetUserByName(username)
+		}
+		if err != nil {
+			return nil, err
+		}
+		slog.InfoContext(ctx, "user created", "user_id", user.ID, "username", user.Username, "role", user.Role, "source", source)
+		return user, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if m.syncsRoles() && role != user.Role {
+		last, err := s.isLastAdmin(user)
+		if err != nil {
+			return nil, err
+		}
+		if last {
+			slog.WarnContext(ctx, "not demoting the last admin from group membership", "username", user.Username, "source", source, "groups", strings.Join(groups, ","))
+			return user, nil
+		}
+		if _, err := s.db.SetUserRole(user.ID, role); err != nil {
+			return nil, err
+		}
+		slog.InfoContext(ctx, "user role changed", "user_id", user.ID, "username", user.Username, "from", user.Role, "to", role, "by", source)
+		user.Role = role
+	}
+	return user, nil
+}
@@ -0,0 +1,179 @@
+package web
+
+import (
+	"bytes"
+	"container/list"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// versionTTL is how long a library version read from the database is
+// trusted, so bursts of feed requests don't each query it. Changes show up
+// in cached feeds within this long.
+const versionTTL = time.Second
+
+// libraryVersion returns the library's generation, re-reading it from the
+// database at most once per versionTTL.
+func (s *Server) libraryVersion() (int64, error) {
+	s.versionMu.Lock()
+	defer s.versionMu.Unlock()
+	if time.Since(s.versionRead) < versionTTL {
+		return s.version, nil
+	}
+	v, err := s.db.LibraryVersion()
+	if err != nil {
+		return 0, err
+	}
+	s.version, s.versionRead = v, time.Now()
+	return v, nil
+}
+
+// libraryChanged records a change to the library that the database's
+// triggers can't see, and makes this server notice it at once.
+func (s *Server) libraryChanged() {
+	if err := s.db.BumpLibraryVersion(); err != nil {
+		slog.Error("failed to bump library version", "err", err)
+	}
+	s.versionMu.Lock()
+	s.versionRead = time.Time{}
+	s.versionMu.Unlock()
+}
+
+// feedCache keeps rendered OPDS feed pages in memory, least recently used
+// first out once they pass maxBytes. Like countCache, it is emptied when
+// the library version moves.
+type feedCache struct {
+	mu       sync.Mutex
+	maxBytes int
+	size     int
+	version  int64
+	order    *list.List // of *feedEntry, most recently used first
+	entries  map[string]*list.Element
+}
+
+type feedEntry struct {
+	key         string
+	contentType string
+	body        []byte
+}
+
+// newFeedCacheFromEnv sizes the cache from FEED_CACHE_MB. It returns nil,
+// which caches nothing, when that is 0.
+func newFeedCacheFromEnv() *feedCache {
+	mb := 16
+	if raw := strings.TrimSpace(os.Getenv("FEED_CACHE_MB")); raw != "" {
+		v, err := strconv.Atoi(raw)
+		if err != nil || v < 0 {
+			slog.Warn("invalid FEED_CACHE_MB; using default", "value", raw, "mb", mb)
+		} else {
+			mb = v
+		}
+	}
+	if mb == 0 {
+		return nil
+	}
+	return &feedCache{maxBytes: mb << 20, order: list.New(), entries: make(map[string]*list.Element)}
+}
+
+func (c *feedCache) get(version int64, key string) (*feedEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.version != version {
+		c.reset(version)
+		return nil, false
+	}
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(el)
+	return el.Value.(*feedEntry), true
+}
+
+func (c *feedCache) put(version int64, e *feedEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.version != version || len(e.body) > c.maxBytes/4 {
+		return
+	}
+	if el, ok := c.entries[e.key]; ok {
+		c.size -= len(el.Value.(*feedEntry).body)
+		c.order.Remove(el)
+	}
+	c.entries[e.key] = c.order.PushFront(e)
+	c.size += len(e.body)
+	for c.size > c.maxBytes {
+		oldest := c.order.Back()
+		old := oldest.Value.(*feedEntry)
+		c.order.Remove(oldest)
+		delete(c.entries, old.key)
+		c.size -= len(old.body)
+	}
+}
+
+// reset empties the cache for a new library version.
+func (c *feedCache) reset(version int64) {
+	c.version = version
+	c.order.Init()
+	clear(c.entries)
+	c.size = 0
+}
+
+// feedRecorder captures a feed as it is written to the client.
+type feedRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (r *feedRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *feedRecorder) Write(p []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	r.body.Write(p)
+	return r.ResponseWriter.Write(p)
+}
+
+// cacheFeed serves repeated requests for a feed from memory. A page is
+// cached per URL and per what the caller may see: their library filter,
+// and whether they have shelves and reading progress, which the root feed
+// links to. Only successful responses are kept.
+func (s *Server) cacheFeed(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.feeds == nil {
+			next(w, r)
+			return
+		}
+		version, err := s.libraryVersion()
+		if err != nil {
+			next(w, r)
+			return
+		}
+		p, _ := s.principal(r)
+		key := r.URL.Path + "?" + r.URL.RawQuery + "\x00" + filterKey(s.principalFilter(p)) + "\x00" + strconv.FormatBool(p.has(scopeOPDS))
+		if e, ok := s.feeds.get(version, key); ok {
+			w.Header().Set("Content-Type", e.contentType)
+			w.Header().Set("X-Cache", "HIT")
+			_, _ = w.Write(e.body)
+			return
+		}
+		w.Header().Set("X-Cache", "MISS")
+		rec := &feedRecorder{ResponseWriter: w}
+		next(rec, r)
+		if rec.status == http.StatusOK {
+			s.feeds.put(version, &feedEntry{key: key, contentType: w.Header().Get("Content-Type"), body: rec.body.Bytes()})
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package web
+
+import (
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// opdsFeedStart opens every OPDS feed. Besides Atom it declares OpenSearch,
+// for the result counts on paged feeds, and feed history (RFC 5005), for
+// marking feeds that are complete in one document.
+const opdsFeedStart = `<?xml version="1.0" encoding="UTF-8"?><feed xmlns="http://www.w3.org/2005/Atom" xmlns:opensearch="http://a9.com/-/spec/opensearch/1.1/" xmlns:fh="http://purl.org/syndication/history/1.0">`
+
+// fhComplete marks a feed whose every entry is in the one document, so
+// readers such as Calibre don't go looking for more pages.
+const fhComplete = `<fh:complete/>`
+
+// feedPage is one page of a paged OPDS acquisition feed.
+type feedPage struct {
+	page, limit, lastPage, total int
+	// base is the feed's URL without limit, page, or after.
+	base string
+	// next replaces the plain link to the next page, for feeds that walk
+	// forward with a cursor.
+	next string
+}
+
+// parseFeedPage reads ?page= and ?limit= for a feed of total books at base.
+// A page past the end is the last page.
+func parseFeedPage(r *http.Request, base string, total int) feedPage {
+	p := feedPage{base: base, total: total, lastPage: 1}
+	p.page = parseIntDefault(r.URL.Query().Get("page"), 1)
+	if p.page < 1 {
+		p.page = 1
+	}
+	p.limit = parseIntDefault(r.URL.Query().Get("limit"), 100)
+	if p.limit < 1 {
+		p.limit = 100
+	}
+	if p.limit > 250 {
+		p.limit = 250
+	}
+	if total > 0 {
+		p.lastPage = (total + p.limit - 1) / p.limit
+	}
+	if p.page > p.lastPage {
+		p.page = p.lastPage
+	}
+	return p
+}
+
+func (p feedPage) offset() int {
+	return (p.page - 1) * p.limit
+}
+
+// href is the URL of page n of the feed.
+func (p feedPage) href(n int) string {
+	sep := "?"
+	if strings.Contains(p.base, "?") {
+		sep = "&"
+	}
+	return fmt.Sprintf("%s%slimit=%d&page=%d", p.base, sep, p.limit, n)
+}
+
+// writeLinks writes the page's OpenSearch counts and its first, last,
+// previous, and next links, or fh:complete if the whole feed fits on it.
+func (p feedPage) writeLinks(w io.Writer) {
+	fmt.Fprintf(w, `<opensearch:totalResults>%d</opensearch:totalResults>`, p.total)
+	fmt.Fprintf(w, `<opensearch:itemsPerPage>%d</opensearch:itemsPerPage>`, p.limit)
+	fmt.Fprintf(w, `<opensearch:startIndex>%d</opensearch:startIndex>`, p.offset()+1)
+	if p.lastPage == 1 {
+		fmt.Fprint(w, fhComplete)
+		return
+	}
+	fmt.Fprintf(w, `<link rel="first" href="%s" type="application/atom+xml;profile=opds-catalog;kind=acquisition"/>`, html.EscapeString(p.href(1)))
+	fmt.Fprintf(w, `<link rel="last" href="%s" type="application/atom+xml;profile=opds-catalog;kind=acquisition"/>`, html.EscapeString(p.href(p.lastPage)))
+	if p.page > 1 {
+		fmt.Fprintf(w, `<link rel="previous" href="%s" type="application/atom+xml;profile=opds-catalog;kind=acquisition"/>`, html.EscapeString(p.href(p.page-1)))
+	}
+	if p.page < p.lastPage {
+		next := p.next
+		if next == "" {
+			next = p.href(p.page + 1)
+		}
+		fmt.Fprintf(w, `<link rel="next" href="%s" type="application/atom+xml;profile=opds-catalog;kind=acquisition"/>`, html.EscapeString(next))
+	}
+}
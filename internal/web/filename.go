@@ -0,0 +1,66 @@
+package web
+
+import (
+	"strings"
+	"unicode"
+
+	"github.com/ab0oo/gopds/internal/database"
+	"github.com/ab0oo/gopds/internal/organize"
+	"github.com/ab0oo/gopds/internal/settings"
+	"golang.org/x/text/unicode/norm"
+)
+
+// downloadFilename names a download of book with the given suffix, such as
+// ".epub", from the download_filename setting.
+func (s *Server) downloadFilename(book *database.Book, suffix string) string {
+	t, err := organize.ParseFileTemplate(s.settings.Get(settings.DownloadFilename))
+	if err != nil {
+		// The setting is validated when saved, so only a bad value left
+		// in the database by an older version gets here.
+		d, _ := settings.Lookup(settings.DownloadFilename)
+		t, _ = organize.ParseFileTemplate(d.Default)
+	}
+	return t.Path(organize.BookFromRecord(*book), suffix)
+}
+
+// attachment returns a Content-Disposition header value that downloads the
+// response as filename. The quoted filename is an ASCII stand-in for old
+// clients; filename* carries the real name, encoded as RFC 5987 requires,
+// so quotes, line breaks, and non-ASCII characters can't break the header.
+func attachment(filename string) string {
+	return `attachment; filename="` + asciiFilename(filename) + `"; filename*=UTF-8''` + encodeRFC5987(filename)
+}
+
+// asciiFilename strips accents from name and replaces whatever is still
+// not printable ASCII, and the quote and backslash, with "_".
+func asciiFilename(name string) string {
+	var b strings.Builder
+	for _, r := range norm.NFD.String(name) {
+		switch {
+		case unicode.Is(unicode.Mn, r):
+		case r < 0x20 || r > 0x7e || r == '"' || r == '\\':
+			b.WriteByte('_')
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// encodeRFC5987 percent-encodes every byte of s outside RFC 5987's
+// attr-char set.
+func encodeRFC5987(s string) string {
+	const hex = "0123456789ABCDEF"
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || strings.IndexByte("!#$&+-.^_`|~", c) >= 0 {
+			b.WriteByte(c)
+			continue
+		}
+		b.WriteByte('%')
+		b.WriteByte(hex[c>>4])
+		b.WriteByte(hex[c&0xf])
+	}
+	return b.String()
+}
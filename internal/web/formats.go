@@ -0,0 +1,244 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ab0oo/gopds/internal/database"
+	"github.com/ab0oo/gopds/internal/i18n"
+	"github.com/ab0oo/gopds/internal/jobs"
+	"github.com/ab0oo/gopds/internal/storage"
+)
+
+const conversionsDir = "./data/conversions"
+
+// bookFormat is a download format. Suffix is appended to the EPUB's base
+// name to find a sibling copy in that format next to it.
+type bookFormat struct {
+	Name        string
+	Suffix      string
+	ContentType string
+	// Convertible formats can be produced from the EPUB by EBOOK_CONVERT.
+	Convertible bool
+}
+
+var bookFormats = []bookFormat{
+	{Name: "epub", Suffix: ".epub", ContentType: "application/epub+zip"},
+	{Name: "kepub", Suffix: ".kepub.epub", ContentType: "application/kepub+zip"},
+	{Name: "azw3", Suffix: ".azw3", ContentType: "application/vnd.amazon.ebook", Convertible: true},
+	{Name: "mobi", Suffix: ".mobi", ContentType: "application/x-mobipocket-ebook", Convertible: true},
+	{Name: "pdf", Suffix: ".pdf", ContentType: "application/pdf", Convertible: true},
+}
+
+func lookupBookFormat(name string) (bookFormat, bool) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	for _, f := range bookFormats {
+		if f.Name == name {
+			return f, true
+		}
+	}
+	return bookFormat{}, false
+}
+
+type conversionJobPayload struct {
+	BookID int    `json:"book_id"`
+	Format string `json:"format"`
+}
+
+type conversionQueuedPayload struct {
+	Format string        `json:"format"`
+	Job    *database.Job `json:"job"`
+}
+
+// ebookConverter is EBOOK_CONVERT, the path to a converter invoked as
+// "<converter> <input.epub> <output.ext>" (e.g. Calibre's ebook-convert).
+// Conversion is disabled when it is unset.
+func ebookConverter() string {
+	return strings.TrimSpace(os.Getenv("EBOOK_CONVERT"))
+}
+
+func conversionPath(bookID int, f bookFormat) string {
+	return filepath.Join(conversionsDir, strconv.Itoa(bookID)+f.Suffix)
+}
+
+// formatFile returns the file holding book in format f: the EPUB itself, a
+// sibling file with the same base name, or a cached conversion that is newer
+// than the EPUB.
+func formatFile(book *database.Book, epubPath string, f bookFormat) (string, bool) {
+	if f.Name == "epub" {
+		return epubPath, true
+	}
+	base := strings.TrimSuffix(epubPath, filepath.Ext(epubPath))
+	// Remote libraries aren't searched for siblings, which would cost a
+	// request per format.
+	if !storage.IsRemote(epubPath) {
+		if info, err := os.Stat(base + f.Suffix); err == nil && !info.IsDir() {
+			return base + f.Suffix, true
+		}
+	}
+	if f.Convertible {
+		converted := conversionPath(book.ID, f)
+		if info, err := os.Stat(converted); err == nil && !info.ModTime().Before(book.ModTime) {
+			return converted, true
+		}
+	}
+	return "", false
+}
+
+// availableFormats lists the formats that can be downloaded right now.
+func availableFormats(book *database.Book, epubPath string) []string {
+	names := make([]string, 0, len(bookFormats))
+	for _, f := range bookFormats {
+		if _, ok := formatFile(book, epubPath, f); ok {
+			names = append(names, f.Name)
+		}
+	}
+	return names
+}
+
+// serveBookFormat handles /download/{id}?format=. It serves the requested
+// format if a copy exists, queues a conversion (202) if EBOOK_CONVERT can
+// produce it, and otherwise answers 406 listing what is available.
+func (s *Server) serveBookFormat(w http.ResponseWriter, r *http.Request, book *database.Book, epubPath, name string) {
+	f, known := lookupBookFormat(name)
+	if known {
+		if path, ok := formatFile(book, epubPath, f); ok {
+			s.serveBookFile(w, r, book, path, f)
+			return
+		}
+	}
+
+	if known && f.Convertible && ebookConverter() != "" {
+		job, err := s.queueConversion(r.Context(), book.ID, f.Name)
+		if err != nil {
+			http.Error(w, i18n.T("Failed to queue conversion: %v", err), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Retry-After", "30")
+		w.WriteHeader(http.StatusAccepted)
+		_ = json.NewEncoder(w).Encode(conversionQueuedPayload{Format: f.Name, Job: job})
+		return
+	}
+
+	available := strings.Join(availableFormats(book, epubPath), ", ")
+	if !known {
+		http.Error(w, i18n.T("Unknown format %q. Available for this book: %s", name, available), http.StatusNotAcceptable)
+		return
+	}
+	http.Error(w, i18n.T("Format %s is not available for this book. Available: %s", f.Name, available), http.StatusNotAcceptable)
+}
+
+func (s *Server) serveBookFile(w http.ResponseWriter, r *http.Request, book *database.Book, path string, f bookFormat) {
+	w.Header().Set("Content-Disposition", attachment(s.downloadFilename(book, f.Suffix)))
+	w.Header().Set("Content-Type", f.ContentType)
+	s.serveCountedFile(w, r, book, path, f.Name)
+}
+
+// queueConversion enqueues a conversion job for the book and format unless
+// one is already queued or running, in which case that job is returned.
+func (s *Server) queueConversion(ctx context.Context, bookID int, format string) (*database.Job, error) {
+	for _, status := range []string{database.JobStatusQueued, database.JobStatusRunning} {
+		active, err := s.jobs.List(jobs.TypeConversion, status, 100)
+		if err != nil {
+			return nil, err
+		}
+		for i := range active {
+			var payload conversionJobPayload
+			if jobs.DecodePayload(&active[i], &payload) == nil && payload.BookID == bookID && payload.Format == format {
+				return &active[i], nil
+			}
+		}
+	}
+	return s.jobs.Enqueue(ctx, jobs.TypeConversion, conversionJobPayload{BookID: bookID, Format: format},
+		fmt.Sprintf("Conversion of book %d to %s queued.", bookID, format))
+}
+
+func (s *Server) runConversionJob(ctx context.Context, job *database.Job, p *jobs.Progress) error {
+	var payload conversionJobPayload
+	if err := jobs.DecodePayload(job, &payload); err != nil {
+		return fmt.Errorf("invalid conversion payload: %w", err)
+	}
+	f, ok := lookupBookFormat(payload.Format)
+	if !ok || !f.Convertible {
+		return fmt.Errorf("format %q cannot be converted to", payload.Format)
+	}
+	converter := ebookConverter()
+	if converter == "" {
+		return errors.New("EBOOK_CONVERT is not set")
+	}
+
+	book, err := s.db.GetBookByID(strconv.Itoa(payload.BookID))
+	if err != nil {
+		return fmt.Errorf("book %d: %w", payload.BookID, err)
+	}
+	epubPath, err := s.resolveBookPath(book)
+	if err != nil {
+		return fmt.Errorf("book %d: %w", payload.BookID, err)
+	}
+	if err := os.MkdirAll(conversionsDir, 0755); err != nil {
+		return fmt.Errorf("failed to prepare conversions directory: %w", err)
+	}
+
+	// The converter picks its output format from the extension, so the
+	// temporary file keeps the real suffix.
+	dest := conversionPath(book.ID, f)
+	tmp := filepath.Join(conversionsDir, fmt.Sprintf("%d.job%d%s", book.ID, job.ID, f.Suffix))
+	defer os.Remove(tmp)
+	if storage.IsRemote(epubPath) {
+		// The converter reads local files only.
+		local := filepath.Join(conversionsDir, fmt.Sprintf("%d.job%d.epub", book.ID, job.ID))
+		defer os.Remove(local)
+		if err := copyToLocal(ctx, epubPath, local); err != nil {
+			return fmt.Errorf("failed to fetch %s: %w", epubPath, err)
+		}
+		epubPath = local
+	}
+
+	p.Update("converting", fmt.Sprintf("Converting %q to %s...", book.Title, f.Name), 0)
+	start := time.Now()
+	out, err := exec.CommandContext(ctx, converter, epubPath, tmp).CombinedOutput()
+	if err != nil {
+		tail := strings.TrimSpace(string(out))
+		if len(tail) > 500 {
+			tail = tail[len(tail)-500:]
+		}
+		slog.WarnContext(ctx, "conversion failed", "book_id", book.ID, "format", f.Name, "err", err, "output", tail)
+		return fmt.Errorf("converter failed: %w", err)
+	}
+	if err := os.Rename(tmp, dest); err != nil {
+		return fmt.Errorf("failed to store converted file: %w", err)
+	}
+	slog.InfoContext(ctx, "conversion complete", "book_id", book.ID, "format", f.Name, "duration_ms", time.Since(start).Milliseconds())
+	p.Update("complete", fmt.Sprintf("Converted %q to %s.", book.Title, f.Name), 1)
+	return nil
+}
+
+// copyToLocal copies a book from a remote library to the local file dest.
+func copyToLocal(ctx context.Context, path, dest string) error {
+	src, err := storage.Open(ctx, path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, src); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
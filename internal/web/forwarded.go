@@ -0,0 +1,137 @@
+package web
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// Behind a TLS-terminating reverse proxy every request arrives over plain
+// HTTP from the proxy's address. X-Forwarded-For, X-Forwarded-Proto, and
+// X-Forwarded-Host carry what the client actually used, but any client can
+// send them, so they are only read from the proxies listed in
+// TRUSTED_PROXIES (or PROXY_AUTH_TRUSTED_PROXIES).
+
+type forwardedKey struct{}
+
+// forwarded is what trusted proxy headers say about the original request.
+type forwarded struct {
+	ClientIP string
+	HTTPS    bool
+}
+
+// parseTrustedProxies reads a comma-separated list of addresses and CIDRs
+// from env, warning about and skipping invalid entries.
+func parseTrustedProxies(env string) []netip.Prefix {
+	var out []netip.Prefix
+	for _, raw := range splitEnvList(env) {
+		prefix, err := parseTrustedProxy(raw)
+		if err != nil {
+			slog.Warn("ignoring invalid trusted proxy", "env", env, "value", raw, "err", err)
+			continue
+		}
+		out = append(out, prefix)
+	}
+	return out
+}
+
+// trustedProxiesFromEnv returns the proxies whose forwarding headers are
+// believed: TRUSTED_PROXIES plus any proxy trusted for header logins.
+func trustedProxiesFromEnv(pa *proxyAuth) []netip.Prefix {
+	trusted := parseTrustedProxies("TRUSTED_PROXIES")
+	if pa != nil {
+		trusted = append(trusted, pa.Trusted...)
+	}
+	if len(trusted) > 0 {
+		slog.Info("forwarded headers trusted", "proxies", len(trusted))
+	}
+	return trusted
+}
+
+// peerAddr is the address of the host that opened the connection.
+func peerAddr(r *http.Request) (netip.Addr, bool) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap(), true
+}
+
+func prefixesContain(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// firstHeaderValue returns the first comma-separated element of a header
+// that proxies may repeat or append to.
+func firstHeaderValue(r *http.Request, name string) string {
+	first, _, _ := strings.Cut(r.Header.Get(name), ",")
+	return strings.TrimSpace(first)
+}
+
+// forwardedHeaders applies X-Forwarded-* from trusted proxies: clientIP sees
+// the real client, isHTTPS the scheme the client used, and r.Host the host
+// it asked for. It must run before anything that logs or rate-limits.
+func (s *Server) forwardedHeaders(next http.Handler) http.Handler {
+	if len(s.trustedProxies) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		peer, ok := peerAddr(r)
+		if !ok || !prefixesContain(s.trustedProxies, peer) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// Each proxy appends the address it received the request from, so
+		// walk back from the right past our own proxies; the first address
+		// that isn't one of them is the client.
+		client := peer
+		var hops []string
+		for _, value := range r.Header.Values("X-Forwarded-For") {
+			hops = append(hops, strings.Split(value, ",")...)
+		}
+		for i := len(hops) - 1; i >= 0; i-- {
+			addr, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+			if err != nil {
+				break
+			}
+			client = addr.Unmap()
+			if !prefixesContain(s.trustedProxies, client) {
+				break
+			}
+		}
+
+		f := forwarded{ClientIP: client.String(), HTTPS: r.TLS != nil}
+		switch strings.ToLower(firstHeaderValue(r, "X-Forwarded-Proto")) {
+		case "https":
+			f.HTTPS = true
+		case "http":
+			f.HTTPS = false
+		}
+		if host := firstHeaderValue(r, "X-Forwarded-Host"); host != "" && !strings.ContainsAny(host, "/ \\@") {
+			r.Host = host
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), forwardedKey{}, f)))
+	})
+}
+
+// isHTTPS reports whether the client reached us over TLS, directly or
+// through a trusted proxy.
+func isHTTPS(r *http.Request) bool {
+	if f, ok := r.Context().Value(forwardedKey{}).(forwarded); ok {
+		return f.HTTPS
+	}
+	return r.TLS != nil
+}
@@ -0,0 +1,125 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ab0oo/gopds/internal/database"
+	"github.com/ab0oo/gopds/internal/i18n"
+)
+
+type genreCount struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+type genresPayload struct {
+	Genres []genreCount `json:"genres"`
+}
+
+// booksByGenre groups the books f allows by the genres their subjects map
+// to. A book can be in several genres, or none.
+func (s *Server) booksByGenre(f database.BookFilter) (map[string][]database.Book, error) {
+	out := map[string][]database.Book{}
+	err := s.db.ForEachBookWithSubjects(f, func(b database.Book, subjects []string) error {
+		for _, g := range s.genres.Map(subjects) {
+			out[g] = append(out[g], b)
+		}
+		return nil
+	})
+	return out, err
+}
+
+// genreCounts lists the genres that have books, in feed order.
+func (s *Server) genreCounts(byGenre map[string][]database.Book) []genreCount {
+	out := []genreCount{}
+	for _, name := range s.genres.Names() {
+		if n := len(byGenre[name]); n > 0 {
+			out = append(out, genreCount{Name: name, Count: n})
+		}
+	}
+	return out
+}
+
+// HandleGenres lists the genres in the library with their book counts.
+func (s *Server) HandleGenres(w http.ResponseWriter, r *http.Request) {
+	byGenre, err := s.booksByGenre(s.bookFilter(r))
+	if err != nil {
+		http.Error(w, i18n.T("Internal Server Error"), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(genresPayload{Genres: s.genreCounts(byGenre)})
+}
+
+// HandleGenresCatalog is the OPDS genre navigation feed, or with ?genre=
+// the acquisition feed of one genre's books.
+func (s *Server) HandleGenresCatalog(w http.ResponseWriter, r *http.Request) {
+	byGenre, err := s.booksByGenre(s.bookFilter(r))
+	if err != nil {
+		http.Error(w, i18n.T("Internal Server Error"), http.StatusInternalServerError)
+		return
+	}
+	if raw := strings.TrimSpace(r.URL.Query().Get("genre")); raw != "" {
+		genre, ok := s.genres.Canonical(raw)
+		if !ok {
+			http.Error(w, i18n.T("Unknown genre"), http.StatusNotFound)
+			return
+		}
+		s.handleGenreBooksFeed(w, r, genre, byGenre[genre])
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/atom+xml;profile=opds-catalog;kind=navigation;charset=utf-8")
+	fmt.Fprint(w, opdsFeedStart)
+	fmt.Fprintf(w, `<title>%s</title><id>gopds:genres</id>`, html.EscapeString(feedTitle(i18n.T("Genres"))))
+	fmt.Fprintf(w, `<updated>%s</updated>`, time.Now().UTC().Format(time.RFC3339))
+	fmt.Fprint(w, `<link rel="self" href="/opds/genres" type="application/atom+xml;profile=opds-catalog;kind=navigation"/>`)
+	fmt.Fprint(w, `<link rel="start" href="/opds" type="application/atom+xml;profile=opds-catalog;kind=navigation"/>`)
+	fmt.Fprint(w, fhComplete)
+	for _, g := range s.genreCounts(byGenre) {
+		href := fmt.Sprintf("/opds/genres?genre=%s&page=1&limit=100", url.QueryEscape(g.Name))
+		fmt.Fprintf(w, `
+    <entry>
+        <title>%s (%d)</title>
+        <id>gopds:genre:%s</id>
+        <link rel="subsection" href="%s" type="application/atom+xml;profile=opds-catalog;kind=acquisition"/>
+    </entry>`,
+			html.EscapeString(g.Name), g.Count, html.EscapeString(strings.ToLower(g.Name)), html.EscapeString(href))
+	}
+	fmt.Fprint(w, `</feed>`)
+}
+
+func (s *Server) handleGenreBooksFeed(w http.ResponseWriter, r *http.Request, genre string, books []database.Book) {
+	// Same order as the category and author feeds.
+	sort.SliceStable(books, func(i, j int) bool {
+		a, b := strings.ToLower(books[i].Author), strings.ToLower(books[j].Author)
+		if a != b {
+			return a < b
+		}
+		return strings.ToLower(books[i].Title) < strings.ToLower(books[j].Title)
+	})
+	p := parseFeedPage(r, "/opds/genres?genre="+url.QueryEscape(genre), len(books))
+	end := min(p.offset()+p.limit, len(books))
+
+	w.Header().Set("Content-Type", "application/atom+xml;profile=opds-catalog;kind=acquisition;charset=utf-8")
+	fmt.Fprint(w, opdsFeedStart)
+	fmt.Fprintf(w, `<title>%s</title>`, html.EscapeString(feedTitle(fmt.Sprintf("%s (%d)", genre, len(books)))))
+	fmt.Fprintf(w, `<id>gopds:genre:%s</id>`, html.EscapeString(strings.ToLower(genre)))
+	fmt.Fprintf(w, `<updated>%s</updated>`, time.Now().UTC().Format(time.RFC3339))
+	fmt.Fprintf(w, `<link rel="self" href="%s" type="application/atom+xml;profile=opds-catalog;kind=acquisition"/>`, html.EscapeString(p.href(p.page)))
+	fmt.Fprint(w, `<link rel="start" href="/opds" type="application/atom+xml;profile=opds-catalog;kind=navigation"/>`)
+	fmt.Fprint(w, `<link rel="up" href="/opds/genres" type="application/atom+xml;profile=opds-catalog;kind=navigation"/>`)
+	fmt.Fprintf(w, `<link rel="alternate" href="%s" type="application/rss+xml" title="%s"/>`, html.EscapeString("/rss/new?genre="+url.QueryEscape(genre)), html.EscapeString(i18n.T("New Additions")))
+	p.writeLinks(w)
+	for _, b := range books[p.offset():end] {
+		writeOPDSEntry(w, b)
+	}
+	fmt.Fprint(w, `</feed>`)
+}
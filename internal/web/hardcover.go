@@ -0,0 +1,282 @@
+package web
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const hardcoverEndpoint = "https://api.hardcover.app/v1/graphql"
+
+// hardcoverTokenFromEnv reads HARDCOVER_API_TOKEN, the token shown on
+// Hardcover's account API page. Hardcover is only queried when it is set.
+func hardcoverTokenFromEnv() string {
+	token := strings.TrimSpace(os.Getenv("HARDCOVER_API_TOKEN"))
+	// The account page shows the token with its "Bearer " prefix; accept it
+	// either way.
+	if token != "" && !strings.HasPrefix(strings.ToLower(token), "bearer ") {
+		token = "Bearer " + token
+	}
+	return token
+}
+
+const hardcoverSearchQuery = `query Search($q: String!, $perPage: Int!) {
+  search(query: $q, query_type: "Book", per_page: $perPage, page: 1) { results }
+}`
+
+const hardcoverEditionQuery = `query Edition($isbn: String!) {
+  editions(where: {_or: [{isbn_13: {_eq: $isbn}}, {isbn_10: {_eq: $isbn}}]}, limit: 1) {
+    title isbn_13 isbn_10 release_date
+    publisher { name }
+    book {
+      slug title description rating ratings_count
+      contributions(limit: 1) { author { name } }
+      book_series(limit: 1) { position series { name } }
+      cached_tags
+    }
+  }
+}`
+
+type hardcoverSearchResponse struct {
+	Search struct {
+		Results struct {
+			Hits []struct {
+				Document hardcoverDocument `json:"document"`
+			} `json:"hits"`
+		} `json:"results"`
+	} `json:"search"`
+}
+
+// hardcoverDocument is a book in Hardcover's search index. Series fields
+// vary in shape between index versions, so they are decoded leniently.
+type hardcoverDocument struct {
+	ID             json.RawMessage `json:"id"`
+	Slug           string          `json:"slug"`
+	Title          string          `json:"title"`
+	AuthorNames    []string        `json:"author_names"`
+	ISBNs          []string        `json:"isbns"`
+	ReleaseYear    json.RawMessage `json:"release_year"`
+	Description    string          `json:"description"`
+	Rating         float64         `json:"rating"`
+	RatingsCount   int             `json:"ratings_count"`
+	Genres         []string        `json:"genres"`
+	SeriesNames    []string        `json:"series_names"`
+	FeaturedSeries json.RawMessage `json:"featured_series"`
+}
+
+type hardcoverEditionResponse struct {
+	Editions []struct {
+		Title       string `json:"title"`
+		ISBN13      string `json:"isbn_13"`
+		ISBN10      string `json:"isbn_10"`
+		ReleaseDate string `json:"release_date"`
+		Publisher   *struct {
+			Name string `json:"name"`
+		} `json:"publisher"`
+		Book struct {
+			Slug          string  `json:"slug"`
+			Title         string  `json:"title"`
+			Description   string  `json:"description"`
+			Rating        float64 `json:"rating"`
+			RatingsCount  int     `json:"ratings_count"`
+			Contributions []struct {
+				Author struct {
+					Name string `json:"name"`
+				} `json:"author"`
+			} `json:"contributions"`
+			BookSeries []hardcoverSeriesRef `json:"book_series"`
+			CachedTags json.RawMessage      `json:"cached_tags"`
+		} `json:"book"`
+	} `json:"editions"`
+}
+
+type hardcoverSeriesRef struct {
+	Position *float64 `json:"position"`
+	Series   struct {
+		Name string `json:"name"`
+	} `json:"series"`
+}
+
+// searchHardcover runs a full-text book search.
+func (s *Server) searchHardcover(client *http.Client, q string, limit int) ([]metadataCandidate, error) {
+	if limit <= 0 {
+		limit = 6
+	}
+	var decoded hardcoverSearchResponse
+	if err := s.hardcoverQuery(client, hardcoverSearchQuery, map[string]any{"q": q, "perPage": limit}, &decoded); err != nil {
+		return nil, err
+	}
+
+	results := make([]metadataCandidate, 0, len(decoded.Search.Results.Hits))
+	for _, hit := range decoded.Search.Results.Hits {
+		d := hit.Document
+		series, index := hardcoverFeaturedSeries(d.FeaturedSeries)
+		if series == "" {
+			series = firstNonEmpty(d.SeriesNames)
+		}
+		subjects := uniqueClean(d.Genres)
+		if len(subjects) > 12 {
+			subjects = subjects[:12]
+		}
+		year := strings.Trim(string(d.ReleaseYear), `"`)
+		if year == "null" || year == "0" {
+			year = ""
+		}
+		results = append(results, metadataCandidate{
+			Source:       "hardcover:search",
+			Title:        strings.TrimSpace(d.Title),
+			Author:       firstNonEmpty(d.AuthorNames),
+			Identifier:   pickISBN(filterISBNLength(d.ISBNs, 13), filterISBNLength(d.ISBNs, 10), ""),
+			Date:         year,
+			Description:  strings.TrimSpace(d.Description),
+			Subjects:     subjects,
+			Series:       series,
+			SeriesIndex:  index,
+			Key:          hardcoverKey(d.Slug),
+			Rating:       d.Rating,
+			RatingsCount: d.RatingsCount,
+		})
+	}
+	return results, nil
+}
+
+// fetchHardcoverByISBN looks up the edition with isbn and the book it
+// belongs to.
+func (s *Server) fetchHardcoverByISBN(client *http.Client, isbn string) (*metadataCandidate, error) {
+	isbn = normalizeISBN(isbn)
+	if isbn == "" {
+		return nil, fmt.Errorf("invalid isbn")
+	}
+	var decoded hardcoverEditionResponse
+	if err := s.hardcoverQuery(client, hardcoverEditionQuery, map[string]any{"isbn": isbn}, &decoded); err != nil {
+		return nil, err
+	}
+	if len(decoded.Editions) == 0 {
+		return nil, nil
+	}
+
+	e := decoded.Editions[0]
+	c := &metadataCandidate{
+		Source:       "hardcover:isbn",
+		Title:        strings.TrimSpace(e.Title),
+		Identifier:   pickISBN([]string{e.ISBN13}, []string{e.ISBN10}, isbn),
+		Date:         strings.TrimSpace(e.ReleaseDate),
+		Description:  strings.TrimSpace(e.Book.Description),
+		Subjects:     hardcoverGenres(e.Book.CachedTags),
+		Key:          hardcoverKey(e.Book.Slug),
+		Rating:       e.Book.Rating,
+		RatingsCount: e.Book.RatingsCount,
+	}
+	if c.Title == "" {
+		c.Title = strings.TrimSpace(e.Book.Title)
+	}
+	if e.Publisher != nil {
+		c.Publisher = strings.TrimSpace(e.Publisher.Name)
+	}
+	if len(e.Book.Contributions) > 0 {
+		c.Author = strings.TrimSpace(e.Book.Contributions[0].Author.Name)
+	}
+	if len(e.Book.BookSeries) > 0 {
+		c.Series, c.SeriesIndex = e.Book.BookSeries[0].nameAndIndex()
+	}
+	return c, nil
+}
+
+// hardcoverQuery posts a GraphQL query and decodes its data into target.
+func (s *Server) hardcoverQuery(client *http.Client, query string, vars map[string]any, target any) error {
+	body, err := json.Marshal(map[string]any{"query": query, "variables": vars})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, hardcoverEndpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	applyOutboundHeaders(req)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", s.hardcoverToken)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s (%d)", strings.TrimSpace(string(msg)), resp.StatusCode)
+	}
+
+	var envelope struct {
+		Data   json.RawMessage `json:"data"`
+		Errors []struct {
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&envelope); err != nil {
+		return err
+	}
+	if len(envelope.Errors) > 0 {
+		return fmt.Errorf("hardcover: %s", envelope.Errors[0].Message)
+	}
+	return json.Unmarshal(envelope.Data, target)
+}
+
+func (r hardcoverSeriesRef) nameAndIndex() (string, string) {
+	name := strings.TrimSpace(r.Series.Name)
+	if name == "" || r.Position == nil {
+		return name, ""
+	}
+	return name, strconv.FormatFloat(*r.Position, 'f', -1, 64)
+}
+
+// hardcoverFeaturedSeries reads a search document's featured_series, which
+// is {"position": 2, "series": {"name": ...}} when present.
+func hardcoverFeaturedSeries(raw json.RawMessage) (string, string) {
+	var ref hardcoverSeriesRef
+	if len(raw) == 0 || json.Unmarshal(raw, &ref) != nil {
+		return "", ""
+	}
+	return ref.nameAndIndex()
+}
+
+// hardcoverGenres reads the "Genre" tags from a book's cached_tags, a map
+// of tag category to [{"tag": ...}].
+func hardcoverGenres(raw json.RawMessage) []string {
+	var tags map[string][]struct {
+		Tag string `json:"tag"`
+	}
+	if len(raw) == 0 || json.Unmarshal(raw, &tags) != nil {
+		return nil
+	}
+	var genres []string
+	for _, t := range tags["Genre"] {
+		genres = append(genres, t.Tag)
+	}
+	genres = uniqueClean(genres)
+	if len(genres) > 12 {
+		genres = genres[:12]
+	}
+	return genres
+}
+
+func hardcoverKey(slug string) string {
+	if slug = strings.TrimSpace(slug); slug == "" {
+		return ""
+	}
+	return "https://hardcover.app/books/" + slug
+}
+
+func filterISBNLength(values []string, n int) []string {
+	var out []string
+	for _, v := range values {
+		if v = normalizeISBN(v); len(v) == n {
+			out = append(out, v)
+		}
+	}
+	return out
+}
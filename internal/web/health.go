@@ -0,0 +1,143 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ab0oo/gopds/internal/jobs"
+	"github.com/ab0oo/gopds/internal/settings"
+)
+
+var processStart = time.Now()
+
+const readyCheckTimeout = 3 * time.Second
+
+type healthPayload struct {
+	Status        string    `json:"status"`
+	StartedAt     time.Time `json:"started_at"`
+	UptimeSeconds int64     `json:"uptime_seconds"`
+	// Library is whether the library root could be read when last
+	// checked.
+	Library libraryStatus `json:"library"`
+}
+
+type readyPayload struct {
+	Status string                `json:"status"`
+	Checks map[string]readyCheck `json:"checks"`
+}
+
+type readyCheck struct {
+	OK         bool   `json:"ok"`
+	Message    string `json:"message,omitempty"`
+	DurationMS int64  `json:"duration_ms"`
+}
+
+// libraryRoot is the configured book directory.
+func libraryRoot() string {
+	root := strings.TrimSpace(os.Getenv("BOOK_PATH"))
+	if root == "" {
+		root = "./books"
+	}
+	return root
+}
+
+// HandleHealthz reports that the process is up and serving. It deliberately
+// checks nothing else so a slow disk never gets the container restarted;
+// the library's availability is the last check's, and doesn't change the
+// status.
+func (s *Server) HandleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	_ = json.NewEncoder(w).Encode(healthPayload{
+		Status:        "ok",
+		StartedAt:     processStart.UTC(),
+		UptimeSeconds: int64(time.Since(processStart).Seconds()),
+		Library:       s.libraryStatus(),
+	})
+}
+
+// HandleReadyz reports whether the server can do useful work: the database
+// answers, the library root is readable, and any running scan is still
+// making progress. It returns 503 when a check fails.
+func (s *Server) HandleReadyz(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), readyCheckTimeout)
+	defer cancel()
+
+	checks := map[string]readyCheck{
+		"database": runReadyCheck(ctx, s.db.Ping),
+		"library":  runReadyCheck(ctx, s.checkLibrary),
+		"scanner":  runReadyCheck(ctx, s.checkScanner),
+	}
+
+	ready := true
+	for _, c := range checks {
+		ready = ready && c.OK
+	}
+	status := "ready"
+	code := http.StatusOK
+	if !ready {
+		status = "not_ready"
+		code = http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(readyPayload{Status: status, Checks: checks})
+}
+
+// runReadyCheck runs fn with a deadline. Filesystem calls can't be
+// interrupted, so a hung network mount is reported as a timeout while the
+// call itself is left to finish in the background.
+func runReadyCheck(ctx context.Context, fn func(context.Context) error) readyCheck {
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() { done <- fn(ctx) }()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = fmt.Errorf("timed out after %s", readyCheckTimeout)
+	}
+
+	c := readyCheck{OK: err == nil, DurationMS: time.Since(start).Milliseconds()}
+	if err != nil {
+		c.Message = err.Error()
+	}
+	return c
+}
+
+// checkScanner fails when a scan job has been running without progress for
+// longer than SCAN_STALL_SECONDS (default 600).
+func (s *Server) checkScanner(context.Context) error {
+	job, err := s.jobs.Latest(jobs.TypeScan)
+	if errors.Is(err, jobs.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !job.Active() || job.StartedAt.IsZero() {
+		return nil
+	}
+
+	last := job.StartedAt
+	if job.UpdatedAt.After(last) {
+		last = job.UpdatedAt
+	}
+	if beat := time.Unix(0, s.scanBeat.Load()); beat.After(last) {
+		last = beat
+	}
+	limit := time.Duration(s.settings.Int(settings.ScanStallSeconds)) * time.Second
+	if idle := time.Since(last); idle > limit {
+		return fmt.Errorf("scan job %d has made no progress for %s", job.ID, idle.Round(time.Second))
+	}
+	return nil
+}
@@ -0,0 +1,232 @@
+package web
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/ab0oo/gopds/internal/database"
+	"github.com/ab0oo/gopds/internal/i18n"
+	"github.com/ab0oo/gopds/internal/scanner"
+)
+
+// importableColumns are the CSV columns HandleImportMetadata knows how to
+// apply. Empty cells leave the existing value untouched.
+var importableColumns = []string{"title", "author", "description", "series", "series_index"}
+
+type importRowResult struct {
+	Row     int      `json:"row"`
+	Key     string   `json:"key"`
+	BookID  int      `json:"book_id,omitempty"`
+	Status  string   `json:"status"`
+	Changes []string `json:"changes,omitempty"`
+	Error   string   `json:"error,omitempty"`
+}
+
+type importSummary struct {
+	DryRun    bool              `json:"dry_run"`
+	WriteEPUB bool              `json:"write_epub"`
+	Total     int               `json:"total"`
+	Updated   int               `json:"updated"`
+	Unchanged int               `json:"unchanged"`
+	Failed    int               `json:"failed"`
+	Results   []importRowResult `json:"results"`
+}
+
+// HandleImportMetadata applies metadata corrections from a CSV file. The
+// first row is a header; rows are matched on an "id" or "path" column and
+// may set any of importableColumns. The CSV is read from a multipart "file"
+// field or from the raw request body.
+// Query: write_epub=true also rewrites each EPUB; dry_run=true only reports.
+func (s *Server) HandleImportMetadata(w http.ResponseWriter, r *http.Request) {
+	src, err := importSource(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer src.Close()
+
+	q := r.URL.Query()
+	summary := importSummary{
+		DryRun:    parseBool(q.Get("dry_run")),
+		WriteEPUB: parseBool(q.Get("write_epub")),
+		Results:   make([]importRowResult, 0),
+	}
+
+	reader := csv.NewReader(src)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	header, err := reader.Read()
+	if err != nil {
+		http.Error(w, i18n.T("CSV header row is required"), http.StatusBadRequest)
+		return
+	}
+	cols := map[string]int{}
+	for i, name := range header {
+		cols[strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))] = i
+	}
+	_, hasID := cols["id"]
+	_, hasPath := cols["path"]
+	if !hasID && !hasPath {
+		http.Error(w, i18n.T("CSV must have an id or path column"), http.StatusBadRequest)
+		return
+	}
+
+	rowNum := 1
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		rowNum++
+		if err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				http.Error(w, i18n.T("CSV is too large"), http.StatusRequestEntityTooLarge)
+				return
+			}
+			summary.add(importRowResult{Row: rowNum, Status: "error", Error: err.Error()})
+			continue
+		}
+		summary.add(s.importRow(r, rowNum, record, cols, summary.WriteEPUB, summary.DryRun))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(summary)
+}
+
+func (sum *importSummary) add(res importRowResult) {
+	sum.Total++
+	switch res.Status {
+	case "updated", "would_update":
+		sum.Updated++
+	case "unchanged":
+		sum.Unchanged++
+	default:
+		sum.Failed++
+	}
+	sum.Results = append(sum.Results, res)
+}
+
+func (s *Server) importRow(r *http.Request, rowNum int, record []string, cols map[string]int, writeEPUB, dryRun bool) importRowResult {
+	cell := func(name string) string {
+		i, ok := cols[name]
+		if !ok || i >= len(record) {
+			return ""
+		}
+		return strings.TrimSpace(record[i])
+	}
+
+	res := importRowResult{Row: rowNum}
+	var book *database.Book
+	var err error
+	if id := cell("id"); id != "" {
+		res.Key = id
+		book, err = s.db.GetBookByID(id)
+	} else if path := cell("path"); path != "" {
+		res.Key = path
+		book, err = s.db.GetBookByPath(path)
+	} else {
+		res.Status = "error"
+		res.Error = "row has no id or path"
+		return res
+	}
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			res.Status = "not_found"
+			return res
+		}
+		res.Status = "error"
+		res.Error = err.Error()
+		return res
+	}
+	res.BookID = book.ID
+
+	before := catalogSnapshotOf(book)
+	after := before
+	fields := map[string]*string{
+		"title":        &after.Title,
+		"author":       &after.Author,
+		"description":  &after.Description,
+		"series":       &after.Series,
+		"series_index": &after.SeriesIndex,
+	}
+	for _, name := range importableColumns {
+		if v := cell(name); v != "" && v != *fields[name] {
+			*fields[name] = v
+			res.Changes = append(res.Changes, name)
+		}
+	}
+	if len(res.Changes) == 0 {
+		res.Status = "unchanged"
+		return res
+	}
+	if dryRun {
+		res.Status = "would_update"
+		return res
+	}
+
+	if !writeEPUB {
+		if err := s.applyCatalogUpdate(book, after); err != nil {
+			res.Status = "error"
+			res.Error = err.Error()
+			return res
+		}
+		s.recordCatalogChange(r, book.ID, before, after, 0)
+		res.Status = "updated"
+		return res
+	}
+
+	bookPath, err := s.resolveBookPath(book)
+	if err != nil {
+		res.Status = "error"
+		res.Error = fmt.Sprintf("failed to locate EPUB: %v", err)
+		return res
+	}
+	live, err := scanner.ExtractLiveMetadata(bookPath)
+	if err != nil {
+		res.Status = "error"
+		res.Error = fmt.Sprintf("failed to read EPUB metadata: %v", err)
+		return res
+	}
+	update := metadataUpdateFromEPUB(*live)
+	update.Title = after.Title
+	update.Creator = after.Author
+	update.Description = after.Description
+	update.Series = after.Series
+	update.SeriesIndex = after.SeriesIndex
+
+	meta, err := s.applyMetadataUpdate(book, bookPath, update)
+	if err != nil {
+		res.Status = "error"
+		res.Error = err.Error()
+		return res
+	}
+	s.recordMetadataChange(r, book.ID, live, meta, 0)
+	res.Status = "updated"
+	return res
+}
+
+// importSource returns the uploaded CSV, accepting either a multipart "file"
+// field or a raw text/csv body.
+func importSource(r *http.Request) (io.ReadCloser, error) {
+	if strings.HasPrefix(strings.ToLower(r.Header.Get("Content-Type")), "multipart/form-data") {
+		file, _, err := r.FormFile("file")
+		if err != nil {
+			return nil, fmt.Errorf("multipart upload must include a \"file\" field")
+		}
+		return file, nil
+	}
+	return r.Body, nil
+}
+
+func parseBool(raw string) bool {
+	v, err := strconv.ParseBool(strings.TrimSpace(raw))
+	return err == nil && v
+}
@@ -0,0 +1,180 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/ab0oo/gopds/internal/database"
+	"github.com/ab0oo/gopds/internal/i18n"
+	"github.com/ab0oo/gopds/internal/jobs"
+	"github.com/ab0oo/gopds/internal/scanner"
+	"github.com/ab0oo/gopds/internal/settings"
+	"github.com/ab0oo/gopds/internal/storage"
+)
+
+type integrityReport struct {
+	// Job is the latest integrity check, which may still be running;
+	// Issues are from the last one that completed.
+	Job    *database.Job             `json:"job,omitempty"`
+	Issues []database.IntegrityIssue `json:"issues"`
+}
+
+// checkBookFile re-reads one book's file and reports what is wrong with it,
+// or nil if nothing is. A file whose hash no longer matches is only
+// flagged if its modification time hasn't moved on: a newer file was
+// replaced or edited on purpose, and the next scan will index it again.
+func (s *Server) checkBookFile(b database.Book) *database.IntegrityIssue {
+	issue := &database.IntegrityIssue{
+		BookID:       b.ID,
+		Path:         b.Path,
+		Title:        b.Title,
+		Author:       b.Author,
+		ExpectedHash: b.FileHash,
+		DetectedAt:   time.Now().UTC(),
+	}
+	info, err := storage.Stat(context.Background(), b.Path)
+	if err != nil {
+		issue.Problem, issue.Detail = database.IntegrityMissing, err.Error()
+		return issue
+	}
+	if info.ModTime().After(b.ModTime) {
+		return nil
+	}
+	hash, err := scanner.HashFile(b.Path)
+	if err != nil {
+		issue.Problem, issue.Detail = database.IntegrityMissing, err.Error()
+		return issue
+	}
+	if b.FileHash != "" && hash != b.FileHash {
+		// The book may have been rewritten, e.g. by a metadata edit, since
+		// the list was read.
+		if current, err := s.db.GetBookByPath(b.Path); err == nil && current.FileHash == hash {
+			return nil
+		}
+		issue.Problem, issue.ActualHash = database.IntegrityMismatch, hash
+		issue.Detail = fmt.Sprintf("%d bytes, modified %s", info.Size(), info.ModTime().UTC().Format(time.RFC3339))
+		return issue
+	}
+	e, err := scanner.OpenEPUB(b.Path)
+	if err != nil {
+		issue.Problem, issue.Detail, issue.ActualHash = database.IntegrityUnreadable, err.Error(), hash
+		return issue
+	}
+	e.Close()
+	return nil
+}
+
+// runIntegrityJob re-hashes every book file and compares it with the hash
+// recorded when the book was indexed, replacing the stored report once
+// every file has been checked.
+func (s *Server) runIntegrityJob(ctx context.Context, job *database.Job, p *jobs.Progress) error {
+	// With the share gone every file would be reported missing, replacing
+	// a useful report with a useless one.
+	if err := s.checkLibrary(ctx); err != nil {
+		return fmt.Errorf("integrity check paused: %w", err)
+	}
+	books, err := s.db.GetAllBooks()
+	if err != nil {
+		return fmt.Errorf("failed to list books: %w", err)
+	}
+	p.Update("checking", fmt.Sprintf("Checking %d book files...", len(books)), 0)
+
+	issues := []database.IntegrityIssue{}
+	for i, b := range books {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if issue := s.checkBookFile(b); issue != nil {
+			slog.WarnContext(ctx, "integrity: book file damaged", "book_id", b.ID, "path", b.Path, "problem", issue.Problem, "detail", issue.Detail)
+			issues = append(issues, *issue)
+		}
+		if (i+1)%100 == 0 {
+			p.Update("checking", fmt.Sprintf("Checked %d of %d book files...", i+1, len(books)), i+1)
+		}
+	}
+	if err := s.db.ReplaceIntegrityIssues(issues); err != nil {
+		return fmt.Errorf("failed to save integrity report: %w", err)
+	}
+	slog.InfoContext(ctx, "integrity check complete", "books", len(books), "issues", len(issues))
+	p.Update("complete", fmt.Sprintf("Integrity check complete. %d of %d book files have problems.", len(issues), len(books)), len(books))
+	return nil
+}
+
+// HandleCheckIntegrity queues an integrity check of every book file.
+func (s *Server) HandleCheckIntegrity(w http.ResponseWriter, r *http.Request) {
+	job, err := s.jobs.EnqueueUnique(r.Context(), jobs.TypeIntegrity, nil, "Integrity check queued.")
+	if err != nil && !errors.Is(err, jobs.ErrAlreadyActive) {
+		http.Error(w, i18n.T("Failed to queue integrity check: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if errors.Is(err, jobs.ErrAlreadyActive) {
+		w.WriteHeader(http.StatusConflict)
+	} else {
+		w.WriteHeader(http.StatusAccepted)
+	}
+	_ = json.NewEncoder(w).Encode(job)
+}
+
+// HandleIntegrityReport returns the files the last integrity check found
+// damaged, with the latest check's job.
+func (s *Server) HandleIntegrityReport(w http.ResponseWriter, r *http.Request) {
+	var report integrityReport
+	job, err := s.jobs.Latest(jobs.TypeIntegrity)
+	if err == nil {
+		report.Job = job
+	} else if !errors.Is(err, jobs.ErrNotFound) {
+		http.Error(w, i18n.T("Internal Server Error"), http.StatusInternalServerError)
+		return
+	}
+	report.Issues, err = s.db.IntegrityIssues()
+	if err != nil {
+		http.Error(w, i18n.T("Internal Server Error"), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(report)
+}
+
+// RunIntegritySchedule queues an integrity check every
+// integrity_interval_hours until ctx is cancelled. The interval counts from
+// when the last check was queued, so restarts don't postpone it; 0 pauses
+// the schedule.
+func (s *Server) RunIntegritySchedule(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			interval := time.Duration(s.settings.Int(settings.IntegrityIntervalHours)) * time.Hour
+			if interval <= 0 {
+				continue
+			}
+			last, err := s.jobs.Latest(jobs.TypeIntegrity)
+			if err == nil && now.Sub(last.CreatedAt) < interval {
+				continue
+			}
+			if err != nil && !errors.Is(err, jobs.ErrNotFound) {
+				slog.ErrorContext(ctx, "failed to read last integrity check", "err", err)
+				continue
+			}
+			_, err = s.jobs.EnqueueUnique(ctx, jobs.TypeIntegrity, nil, "Integrity check queued.")
+			switch {
+			case errors.Is(err, jobs.ErrAlreadyActive):
+			case err != nil:
+				slog.ErrorContext(ctx, "failed to queue scheduled integrity check", "err", err)
+			default:
+				slog.InfoContext(ctx, "scheduled integrity check queued", "interval", interval)
+			}
+		}
+	}
+}
@@ -0,0 +1,235 @@
+package web
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ab0oo/gopds/internal/database"
+	"github.com/ab0oo/gopds/internal/i18n"
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	defaultInviteTTL = 7 * 24 * time.Hour
+	maxInviteTTL     = 30 * 24 * time.Hour
+)
+
+type createInviteRequest struct {
+	// Role defaults to reader.
+	Role string `json:"role,omitempty"`
+	// Email is suggested to the invitee and, with SMTP configured, where the
+	// link is sent.
+	Email      string   `json:"email,omitempty"`
+	Categories []string `json:"categories,omitempty"`
+	// ExpiresHours defaults to 168 (a week); at most 720.
+	ExpiresHours int `json:"expires_hours,omitempty"`
+}
+
+type inviteCreatedPayload struct {
+	Invite  database.Invite `json:"invite"`
+	URL     string          `json:"url"`
+	Emailed bool            `json:"emailed"`
+}
+
+type invitesPayload struct {
+	Invites []database.Invite `json:"invites"`
+}
+
+// inviteInfoPayload is what an invitee may learn about their invite before
+// accepting it.
+type inviteInfoPayload struct {
+	Role      string    `json:"role"`
+	Email     string    `json:"email,omitempty"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type acceptInviteRequest struct {
+	Token    string `json:"token"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	// Email defaults to the one on the invite.
+	Email *string `json:"email,omitempty"`
+}
+
+func (s *Server) HandleListInvites(w http.ResponseWriter, r *http.Request) {
+	invites, err := s.db.ListInvites()
+	if err != nil {
+		http.Error(w, i18n.T("Failed to list invites"), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(invitesPayload{Invites: invites})
+}
+
+// HandleCreateInvite issues a one-time signup link for a new user with a
+// preset role, emailing it when SMTP is configured and an address is given.
+func (s *Server) HandleCreateInvite(w http.ResponseWriter, r *http.Request) {
+	var req createInviteRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, i18n.T("Invalid JSON body"), http.StatusBadRequest)
+		return
+	}
+	role, err := parseRole(req.Role, roleReader)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	email, err := normalizeEmail(req.Email)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ttl := defaultInviteTTL
+	if req.ExpiresHours != 0 {
+		ttl = time.Duration(req.ExpiresHours) * time.Hour
+		if ttl < time.Hour || ttl > maxInviteTTL {
+			http.Error(w, i18n.T("expires_hours must be between 1 and 720"), http.StatusBadRequest)
+			return
+		}
+	}
+	token, err := generateLinkToken()
+	if err != nil {
+		http.Error(w, i18n.T("Failed to generate token"), http.StatusInternalServerError)
+		return
+	}
+	invite, err := s.db.CreateInvite(hashAPIToken(token), role, email, normalizeCategories(req.Categories), s.actorName(r), time.Now().Add(ttl))
+	if err != nil {
+		http.Error(w, i18n.T("Failed to create invite"), http.StatusInternalServerError)
+		return
+	}
+	payload := inviteCreatedPayload{Invite: *invite, URL: requestBaseURL(r) + "/#invite=" + token}
+
+	if s.mailer.Enabled() && email != "" {
+		ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+		body := fmt.Sprintf("Hello,\n\n%s has invited you to their GoPDS library. Open this link to choose a username and password:\n\n%s\n\nThe link works once and expires at %s.\n",
+			invite.CreatedBy, payload.URL, invite.ExpiresAt.Format(time.RFC1123))
+		err := s.mailer.Send(ctx, email, "You're invited to GoPDS", body)
+		cancel()
+		if err != nil {
+			slog.WarnContext(r.Context(), "failed to email invite", "invite_id", invite.ID, "err", err)
+		} else {
+			payload.Emailed = true
+		}
+	}
+	slog.InfoContext(r.Context(), "invite created", "invite_id", invite.ID, "role", invite.Role, "emailed", payload.Emailed, "by", s.actorName(r))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(payload)
+}
+
+func (s *Server) HandleRevokeInvite(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "inviteID"), 10, 64)
+	if err != nil {
+		http.Error(w, i18n.T("Invalid invite ID"), http.StatusBadRequest)
+		return
+	}
+	deleted, err := s.db.DeleteInvite(id)
+	if err != nil {
+		http.Error(w, i18n.T("Failed to revoke invite"), http.StatusInternalServerError)
+		return
+	}
+	if !deleted {
+		http.Error(w, i18n.T("Invite not found"), http.StatusNotFound)
+		return
+	}
+	slog.InfoContext(r.Context(), "invite revoked", "invite_id", id, "by", s.actorName(r))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// openInvite looks up an invite by its link token, writing 404 or 500 if it
+// can't be used.
+func (s *Server) openInvite(w http.ResponseWriter, token string) (*database.Invite, bool) {
+	invite, err := s.db.GetOpenInvite(hashAPIToken(strings.TrimSpace(token)), time.Now())
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, i18n.T("Invalid or expired invite"), http.StatusNotFound)
+			return nil, false
+		}
+		http.Error(w, i18n.T("Internal Server Error"), http.StatusInternalServerError)
+		return nil, false
+	}
+	return invite, true
+}
+
+// HandleInviteInfo lets the signup form check an invite before asking for a
+// username.
+func (s *Server) HandleInviteInfo(w http.ResponseWriter, r *http.Request) {
+	invite, ok := s.openInvite(w, r.URL.Query().Get("token"))
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(inviteInfoPayload{Role: invite.Role, Email: invite.Email, ExpiresAt: invite.ExpiresAt})
+}
+
+// HandleAcceptInvite creates the invited account with the invitee's chosen
+// username and password, and signs them in.
+func (s *Server) HandleAcceptInvite(w http.ResponseWriter, r *http.Request) {
+	var req acceptInviteRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, i18n.T("Invalid JSON body"), http.StatusBadRequest)
+		return
+	}
+	invite, ok := s.openInvite(w, req.Token)
+	if !ok {
+		return
+	}
+	req.Username = strings.TrimSpace(req.Username)
+	if !usernamePattern.MatchString(req.Username) {
+		http.Error(w, i18n.T("Username must be 1-64 letters, digits, or . _ @ -"), http.StatusBadRequest)
+		return
+	}
+	if err := validatePassword(req.Password); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	email := invite.Email
+	if req.Email != nil {
+		var err error
+		if email, err = normalizeEmail(*req.Email); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	passwordHash, kosyncHash, err := hashPassword(req.Password)
+	if err != nil {
+		http.Error(w, i18n.T("Failed to hash password"), http.StatusInternalServerError)
+		return
+	}
+	user, err := s.db.AcceptInvite(invite.ID, req.Username, email, passwordHash, kosyncHash, time.Now())
+	switch {
+	case errors.Is(err, database.ErrUserExists):
+		http.Error(w, i18n.T("Username already in use"), http.StatusConflict)
+		return
+	case errors.Is(err, database.ErrInviteUnavailable):
+		http.Error(w, i18n.T("Invalid or expired invite"), http.StatusNotFound)
+		return
+	case err != nil:
+		http.Error(w, i18n.T("Failed to create user"), http.StatusInternalServerError)
+		return
+	}
+	slog.InfoContext(r.Context(), "user created", "user_id", user.ID, "username", user.Username, "role", user.Role, "invite_id", invite.ID, "by", invite.CreatedBy)
+
+	if err := s.startSession(w, r, user); err != nil {
+		http.Error(w, i18n.T("Failed to create session"), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(authStatusPayload{
+		Authenticated: true,
+		Username:      user.Username,
+		Role:          user.Role,
+		Scopes:        roleScopes[user.Role],
+	})
+}
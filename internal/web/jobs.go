@@ -0,0 +1,306 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/ab0oo/gopds/internal/database"
+	"github.com/ab0oo/gopds/internal/i18n"
+	"github.com/ab0oo/gopds/internal/jobs"
+	"github.com/ab0oo/gopds/internal/metrics"
+	"github.com/ab0oo/gopds/internal/organize"
+	"github.com/ab0oo/gopds/internal/scanner"
+	"github.com/ab0oo/gopds/internal/settings"
+	"github.com/ab0oo/gopds/internal/storage"
+	"github.com/ab0oo/gopds/internal/webhooks"
+	"github.com/go-chi/chi/v5"
+)
+
+// backupsDir holds the database snapshots backup jobs write.
+const backupsDir = "./data/backups"
+
+// WriteDirs lists the folders the server writes to besides the database's
+// and the cover cache, for the startup check that they are writable.
+func WriteDirs() []string {
+	return []string{coverHistoryDir, conversionsDir, backupsDir}
+}
+
+type scanJobPayload struct {
+	Operation string `json:"operation"`
+}
+
+type jobsPayload struct {
+	Jobs []database.Job `json:"jobs"`
+}
+
+func (s *Server) registerJobHandlers() {
+	if s.jobs == nil {
+		return
+	}
+	s.jobs.Register(jobs.TypeScan, s.runScanJob)
+	s.jobs.Register(jobs.TypeMetadataFetch, s.runMetadataFetchJob)
+	s.jobs.Register(jobs.TypeOrganize, s.runOrganizeJob)
+	s.jobs.Register(jobs.TypeBackup, s.runBackupJob)
+	s.jobs.Register(jobs.TypeConversion, s.runConversionJob)
+	s.jobs.Register(jobs.TypeIntegrity, s.runIntegrityJob)
+	s.jobs.Register(jobs.TypePurge, s.runPurgeJob)
+}
+
+// QueueScan enqueues a library scan unless one is already queued or running.
+// Operation is either "rescan" (incremental) or "rebuild" (drop and reindex).
+func (s *Server) QueueScan(ctx context.Context, operation string) (*database.Job, error) {
+	label := "Rebuild"
+	if operation == "rescan" {
+		label = "Rescan"
+	}
+	return s.jobs.EnqueueUnique(ctx, jobs.TypeScan, scanJobPayload{Operation: operation}, label+" queued.")
+}
+
+func (s *Server) HandleRebuildLibrary(w http.ResponseWriter, r *http.Request) {
+	s.startScanJob(w, r, "rebuild")
+}
+
+func (s *Server) HandleRescanLibrary(w http.ResponseWriter, r *http.Request) {
+	s.startScanJob(w, r, "rescan")
+}
+
+func (s *Server) startScanJob(w http.ResponseWriter, r *http.Request, operation string) {
+	job, err := s.QueueScan(r.Context(), operation)
+	if err != nil && !errors.Is(err, jobs.ErrAlreadyActive) {
+		http.Error(w, i18n.T("Failed to queue scan: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if errors.Is(err, jobs.ErrAlreadyActive) {
+		w.WriteHeader(http.StatusConflict)
+	} else {
+		w.WriteHeader(http.StatusAccepted)
+	}
+	_ = json.NewEncoder(w).Encode(rebuildStatusFromJob(job))
+}
+
+func (s *Server) HandleRebuildStatus(w http.ResponseWriter, r *http.Request) {
+	status := rebuildStatus{}
+	job, err := s.jobs.Latest(jobs.TypeScan)
+	if err == nil {
+		status = rebuildStatusFromJob(job)
+	} else if !errors.Is(err, jobs.ErrNotFound) {
+		http.Error(w, i18n.T("Internal Server Error"), http.StatusInternalServerError)
+		return
+	}
+	library := s.libraryStatus()
+	status.Library = &library
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(status)
+}
+
+// rebuildStatusFromJob maps a scan job onto the status payload the web UI polls.
+func rebuildStatusFromJob(job *database.Job) rebuildStatus {
+	var payload scanJobPayload
+	_ = jobs.DecodePayload(job, &payload)
+	status := rebuildStatus{
+		JobID:       job.ID,
+		Running:     job.Active(),
+		Operation:   payload.Operation,
+		Phase:       job.Phase,
+		Message:     job.Message,
+		StartedAt:   job.StartedAt,
+		CompletedAt: job.CompletedAt,
+		Count:       job.Count,
+		Error:       job.Error,
+	}
+	if status.StartedAt.IsZero() {
+		status.StartedAt = job.CreatedAt
+	}
+	if job.Status == database.JobStatusFailed {
+		label := "Rebuild"
+		if payload.Operation == "rescan" {
+			label = "Rescan"
+		}
+		status.Message = label + " failed."
+	}
+	return status
+}
+
+func (s *Server) runScanJob(ctx context.Context, job *database.Job, p *jobs.Progress) error {
+	var payload scanJobPayload
+	if err := jobs.DecodePayload(job, &payload); err != nil {
+		return fmt.Errorf("invalid scan payload: %w", err)
+	}
+	operation := payload.Operation
+	label := "Rebuild"
+	if operation == "rescan" {
+		label = "Rescan"
+	}
+
+	// A rebuild of an unmounted share would empty the library, and a
+	// rescan would find nothing; either waits until the share is back,
+	// when RunLibraryMonitor queues a rescan.
+	if err := s.checkLibrary(ctx); err != nil {
+		return fmt.Errorf("%s paused: %w", label, err)
+	}
+
+	if operation == "rebuild" {
+		p.Update("resetting_db", "Resetting database cache...", 0)
+		if err := s.db.RebuildBooksTable(); err != nil {
+			return fmt.Errorf("failed to reset database: %w", err)
+		}
+
+		p.Update("clearing_covers", "Clearing covers cache...", 0)
+		if err := storage.Covers().Clear(ctx); err != nil {
+			return fmt.Errorf("failed to clear covers cache: %w", err)
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	bookPath := libraryRoot()
+
+	p.Update("scanning", "Scanning library...", 0)
+	s.scanBeat.Store(time.Now().UnixNano())
+	sc := scanner.New(s.db)
+	sc.CategorySource = s.settings.Get(settings.CategorySource)
+	sc.BatchSize = s.settings.Int(settings.ScanBatchSize)
+	sc.Throttle = s.settings.ScanThrottle()
+	sc.Adult = s.genres.Adult
+	// The scan holds SQLite's write lock for most of its run, so the
+	// heartbeat lives in memory rather than in the jobs table.
+	sc.Progress = func(int) { s.scanBeat.Store(time.Now().UnixNano()) }
+	// A rebuild or the first index of an empty library adds every book,
+	// which is not news to subscribers, and finds books that were already
+	// there, so ORGANIZE_ON_IMPORT leaves them where they are.
+	if existing, _ := s.db.CountBooks(); operation == "rescan" && existing > 0 {
+		sc.Added = func(b database.Book) {
+			s.publish(ctx, webhooks.EventBookAdded, b.ID, bookAddedEvent{Book: webhookBookOf(b)})
+		}
+		placer, err := organize.PlacerFromEnv(bookPath)
+		if err != nil {
+			slog.ErrorContext(ctx, "invalid organize template, new books stay where they are", "err", err)
+		} else if placer != nil {
+			defer placer.Close()
+			sc.Place = placer.Place
+		}
+	}
+	sc.Removed = func(b database.Book) {
+		s.publish(ctx, webhooks.EventBookRemoved, b.ID, bookRemovedEvent{Book: webhookBookOf(b)})
+	}
+	scanStart := time.Now()
+	err := sc.StartAll(ctx, bookPath)
+	elapsed := time.Since(scanStart)
+	metrics.ScanDuration.Observe(elapsed.Seconds(), operation)
+	event := scanCompletedEvent{JobID: job.ID, Operation: operation, DurationSeconds: elapsed.Seconds()}
+	if err != nil {
+		metrics.Scans.Inc(operation, "failed")
+		event.Status, event.Error = "failed", err.Error()
+		s.publish(ctx, webhooks.EventScanCompleted, 0, event)
+		return fmt.Errorf("%s scan failed: %w", label, err)
+	}
+	metrics.Scans.Inc(operation, "completed")
+
+	books, err := s.db.GetAllBooks()
+	if err != nil {
+		return fmt.Errorf("%s finished but listing failed: %w", label, err)
+	}
+	event.Status, event.Books = "completed", len(books)
+	s.publish(ctx, webhooks.EventScanCompleted, 0, event)
+
+	p.Update("complete", fmt.Sprintf("%s complete. %d books indexed.", label, len(books)), len(books))
+	return nil
+}
+
+func (s *Server) runBackupJob(ctx context.Context, job *database.Job, p *jobs.Progress) error {
+	if err := os.MkdirAll(backupsDir, 0755); err != nil {
+		return fmt.Errorf("failed to prepare backups directory: %w", err)
+	}
+	dest := filepath.Join(backupsDir, fmt.Sprintf("gopds-%s.db", time.Now().UTC().Format("20060102-150405")))
+
+	p.Update("backing_up", "Writing database snapshot...", 0)
+	if err := s.db.BackupTo(dest); err != nil {
+		return fmt.Errorf("database backup failed: %w", err)
+	}
+	slog.InfoContext(ctx, "database backup written", "path", dest)
+	p.Update("complete", "Backup written to "+dest, 1)
+	return nil
+}
+
+func (s *Server) HandleBackup(w http.ResponseWriter, r *http.Request) {
+	job, err := s.jobs.EnqueueUnique(r.Context(), jobs.TypeBackup, nil, "Backup queued.")
+	if err != nil && !errors.Is(err, jobs.ErrAlreadyActive) {
+		http.Error(w, i18n.T("Failed to queue backup: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if errors.Is(err, jobs.ErrAlreadyActive) {
+		w.WriteHeader(http.StatusConflict)
+	} else {
+		w.WriteHeader(http.StatusAccepted)
+	}
+	_ = json.NewEncoder(w).Encode(job)
+}
+
+func (s *Server) HandleJobs(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	list, err := s.jobs.List(q.Get("type"), q.Get("status"), parseIntDefault(q.Get("limit"), 100))
+	if err != nil {
+		http.Error(w, i18n.T("Internal Server Error"), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(jobsPayload{Jobs: list})
+}
+
+func (s *Server) HandleJob(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "jobID"), 10, 64)
+	if err != nil {
+		http.Error(w, i18n.T("Invalid job ID"), http.StatusBadRequest)
+		return
+	}
+	job, err := s.jobs.Get(id)
+	if err != nil {
+		writeJobError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(job)
+}
+
+func (s *Server) HandleCancelJob(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "jobID"), 10, 64)
+	if err != nil {
+		http.Error(w, i18n.T("Invalid job ID"), http.StatusBadRequest)
+		return
+	}
+	job, err := s.jobs.Cancel(id)
+	if err != nil {
+		writeJobError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(job)
+}
+
+func writeJobError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, jobs.ErrNotFound):
+		http.Error(w, i18n.T("Job not found"), http.StatusNotFound)
+	case errors.Is(err, jobs.ErrNotCancelable):
+		http.Error(w, i18n.T("Job is not queued or running"), http.StatusConflict)
+	default:
+		http.Error(w, i18n.T("Internal Server Error"), http.StatusInternalServerError)
+	}
+}
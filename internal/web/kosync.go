@@ -0,0 +1,204 @@
+package web
+
+import (
+	"crypto/md5"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/ab0oo/gopds/internal/database"
+	"github.com/ab0oo/gopds/internal/i18n"
+	"github.com/go-chi/chi/v5"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// KOReader's progress sync plugin speaks the koreader-sync-server API:
+// credentials travel in x-auth-user / x-auth-key headers, where the key is
+// the hex MD5 of the password, and errors carry a numeric code.
+const (
+	kosyncCodeUnauthorized    = 2001
+	kosyncCodeUserExists      = 2002
+	kosyncCodeInvalidRequest  = 2003
+	kosyncCodeDocumentMissing = 2004
+)
+
+type kosyncError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type kosyncAuthPayload struct {
+	Authorized string `json:"authorized"`
+}
+
+type kosyncProgressRequest struct {
+	Document   string  `json:"document"`
+	Progress   string  `json:"progress"`
+	Percentage float64 `json:"percentage"`
+	Device     string  `json:"device"`
+	DeviceID   string  `json:"device_id"`
+}
+
+type kosyncUpdatePayload struct {
+	Document  string `json:"document"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+type kosyncProgressPayload struct {
+	Document   string  `json:"document"`
+	Progress   string  `json:"progress"`
+	Percentage float64 `json:"percentage"`
+	Device     string  `json:"device"`
+	DeviceID   string  `json:"device_id"`
+	Timestamp  int64   `json:"timestamp"`
+}
+
+func writeKosync(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeKosyncError(w http.ResponseWriter, status, code int, message string) {
+	writeKosync(w, status, kosyncError{Code: code, Message: message})
+}
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// kosyncUser checks the KOReader credential headers against the user
+// accounts, and against a sync-only account from
+// KOSYNC_USERNAME/KOSYNC_PASSWORD for devices that shouldn't hold a real
+// password.
+func (s *Server) kosyncUser(r *http.Request) (string, bool) {
+	user := strings.TrimSpace(r.Header.Get("x-auth-user"))
+	key := strings.ToLower(strings.TrimSpace(r.Header.Get("x-auth-key")))
+	if user == "" || key == "" {
+		return "", false
+	}
+	if wait := s.loginGuard.wait(user, clientIP(r)); wait > 0 {
+		return "", false
+	}
+	name, ok := s.checkKosyncKey(r, user, key)
+	if !ok {
+		s.loginFailed(r, "kosync", user)
+		return "", false
+	}
+	return name, true
+}
+
+func (s *Server) checkKosyncKey(r *http.Request, user, key string) (string, bool) {
+	if name, pass := strings.TrimSpace(os.Getenv("KOSYNC_USERNAME")), os.Getenv("KOSYNC_PASSWORD"); name != "" && user == name && strings.TrimSpace(pass) != "" {
+		if subtle.ConstantTimeCompare([]byte(key), []byte(md5Hex(pass))) == 1 {
+			return user, true
+		}
+		return "", false
+	}
+	account, err := s.db.GetUserByName(user)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			slog.ErrorContext(r.Context(), "kosync: user lookup failed", "user", user, "err", err)
+		}
+		return "", false
+	}
+	if account.KosyncHash == "" || bcrypt.CompareHashAndPassword([]byte(account.KosyncHash), []byte(key)) != nil {
+		return "", false
+	}
+	return account.Username, true
+}
+
+// requireKosyncUser writes KOReader's unauthorized error when the request's
+// credentials don't match.
+func (s *Server) requireKosyncUser(w http.ResponseWriter, r *http.Request) (string, bool) {
+	user, ok := s.kosyncUser(r)
+	if !ok {
+		writeKosyncError(w, http.StatusUnauthorized, kosyncCodeUnauthorized, "Unauthorized")
+	}
+	return user, ok
+}
+
+// HandleKosyncCreateUser refuses registration: accounts come from the gopds
+// configuration, so KOReader's "register" button reports that the user
+// already exists and the device can log in with it.
+func (s *Server) HandleKosyncCreateUser(w http.ResponseWriter, r *http.Request) {
+	writeKosyncError(w, http.StatusPaymentRequired, kosyncCodeUserExists, "Registration is disabled; log in with your gopds account")
+}
+
+func (s *Server) HandleKosyncAuth(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.requireKosyncUser(w, r); !ok {
+		return
+	}
+	writeKosync(w, http.StatusOK, kosyncAuthPayload{Authorized: "OK"})
+}
+
+func (s *Server) HandleKosyncUpdateProgress(w http.ResponseWriter, r *http.Request) {
+	user, ok := s.requireKosyncUser(w, r)
+	if !ok {
+		return
+	}
+	var req kosyncProgressRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeKosyncError(w, http.StatusForbidden, kosyncCodeInvalidRequest, "Invalid request")
+		return
+	}
+	req.Document = strings.TrimSpace(req.Document)
+	if req.Document == "" || req.Progress == "" {
+		writeKosyncError(w, http.StatusForbidden, kosyncCodeDocumentMissing, "Field 'document' and 'progress' are required")
+		return
+	}
+
+	saved, err := s.db.SaveReadingProgress(database.ReadingProgress{
+		Username:   user,
+		Document:   req.Document,
+		Progress:   req.Progress,
+		Percentage: req.Percentage,
+		Device:     req.Device,
+		DeviceID:   req.DeviceID,
+	})
+	if err != nil {
+		slog.ErrorContext(r.Context(), "kosync: failed to save progress", "document", req.Document, "err", err)
+		http.Error(w, i18n.T("Internal Server Error"), http.StatusInternalServerError)
+		return
+	}
+	slog.DebugContext(r.Context(), "kosync: progress saved", "user", user, "document", saved.Document, "book_id", saved.BookID, "percentage", saved.Percentage, "device", saved.Device)
+	writeKosync(w, http.StatusOK, kosyncUpdatePayload{Document: saved.Document, Timestamp: saved.UpdatedAt.Unix()})
+}
+
+// HandleKosyncGetProgress returns the stored position, or an empty object
+// when there is none, as koreader-sync-server does.
+func (s *Server) HandleKosyncGetProgress(w http.ResponseWriter, r *http.Request) {
+	user, ok := s.requireKosyncUser(w, r)
+	if !ok {
+		return
+	}
+	document := strings.TrimSpace(chi.URLParam(r, "document"))
+	if document == "" {
+		writeKosyncError(w, http.StatusForbidden, kosyncCodeDocumentMissing, "Field 'document' is required")
+		return
+	}
+	p, err := s.db.GetReadingProgress(user, document)
+	if errors.Is(err, sql.ErrNoRows) {
+		writeKosync(w, http.StatusOK, struct{}{})
+		return
+	}
+	if err != nil {
+		http.Error(w, i18n.T("Internal Server Error"), http.StatusInternalServerError)
+		return
+	}
+	writeKosync(w, http.StatusOK, kosyncProgressPayload{
+		Document:   p.Document,
+		Progress:   p.Progress,
+		Percentage: p.Percentage,
+		Device:     p.Device,
+		DeviceID:   p.DeviceID,
+		Timestamp:  p.UpdatedAt.Unix(),
+	})
+}
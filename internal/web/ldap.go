@@ -0,0 +1,175 @@
+package web
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+
+	"github.com/ab0oo/gopds/internal/database"
+)
+
+// LDAP authentication: the service account (or an anonymous bind) searches
+// for the user's entry, then the user's own DN is bound with the submitted
+// password. Successful logins are provisioned like any external account.
+
+const (
+	ldapSource  = "ldap"
+	ldapTimeout = 10 * time.Second
+)
+
+type ldapConfig struct {
+	URL            string
+	StartTLS       bool
+	SkipVerify     bool
+	BindDN         string
+	BindPassword   string
+	BaseDN         string
+	UserFilter     string // {username} is replaced with the escaped username
+	GroupAttribute string
+	AutoCreate     bool
+	Roles          roleMapping
+}
+
+type ldapAuthenticator struct {
+	cfg ldapConfig
+}
+
+// newLDAPFromEnv returns nil unless LDAP_URL and LDAP_BASE_DN are set.
+func newLDAPFromEnv() *ldapAuthenticator {
+	cfg := ldapConfig{
+		URL:            strings.TrimSpace(os.Getenv("LDAP_URL")),
+		StartTLS:       envBool("LDAP_START_TLS"),
+		SkipVerify:     envBool("LDAP_INSECURE_SKIP_VERIFY"),
+		BindDN:         strings.TrimSpace(os.Getenv("LDAP_BIND_DN")),
+		BindPassword:   os.Getenv("LDAP_BIND_PASSWORD"),
+		BaseDN:         strings.TrimSpace(os.Getenv("LDAP_BASE_DN")),
+		UserFilter:     strings.TrimSpace(os.Getenv("LDAP_USER_FILTER")),
+		GroupAttribute: strings.TrimSpace(os.Getenv("LDAP_GROUP_ATTRIBUTE")),
+		AutoCreate:     !isFalse(os.Getenv("LDAP_AUTO_CREATE")),
+		Roles:          roleMappingFromEnv("LDAP"),
+	}
+	if cfg.URL == "" || cfg.BaseDN == "" {
+		return nil
+	}
+	if cfg.UserFilter == "" {
+		cfg.UserFilter = "(uid={username})"
+	}
+	if !strings.Contains(cfg.UserFilter, "{username}") {
+		slog.Error("LDAP_USER_FILTER must contain {username}; LDAP login disabled", "filter", cfg.UserFilter)
+		return nil
+	}
+	if cfg.GroupAttribute == "" {
+		cfg.GroupAttribute = "memberOf"
+	}
+	slog.Info("ldap login enabled", "url", cfg.URL, "base_dn", cfg.BaseDN, "auto_create", cfg.AutoCreate)
+	return &ldapAuthenticator{cfg: cfg}
+}
+
+func (a *ldapAuthenticator) dial() (*ldap.Conn, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: a.cfg.SkipVerify}
+	conn, err := ldap.DialURL(a.cfg.URL, ldap.DialWithTLSConfig(tlsConfig))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(ldapTimeout)
+	if a.cfg.StartTLS {
+		if err := conn.StartTLS(tlsConfig); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("starttls: %w", err)
+		}
+	}
+	return conn, nil
+}
+
+// authenticate checks username and password against the directory and
+// returns the user's groups. A wrong password or unknown user returns
+// ok=false with a nil error; err is for directory failures.
+func (a *ldapAuthenticator) authenticate(username, password string) (groups []string, ok bool, err error) {
+	// An empty password would be an unauthenticated bind, which many
+	// servers accept for any DN.
+	if password == "" {
+		return nil, false, nil
+	}
+	conn, err := a.dial()
+	if err != nil {
+		return nil, false, err
+	}
+	defer conn.Close()
+
+	if a.cfg.BindDN != "" {
+		err = conn.Bind(a.cfg.BindDN, a.cfg.BindPassword)
+	} else {
+		err = conn.UnauthenticatedBind("")
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("service bind: %w", err)
+	}
+
+	filter := strings.ReplaceAll(a.cfg.UserFilter, "{username}", ldap.EscapeFilter(username))
+	res, err := conn.Search(ldap.NewSearchRequest(
+		a.cfg.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, int(ldapTimeout.Seconds()), false,
+		filter, []string{a.cfg.GroupAttribute}, nil,
+	))
+	if err != nil {
+		return nil, false, fmt.Errorf("user search: %w", err)
+	}
+	if len(res.Entries) != 1 {
+		if len(res.Entries) > 1 {
+			slog.Warn("ldap user filter matched more than one entry", "username", username)
+		}
+		return nil, false, nil
+	}
+	entry := res.Entries[0]
+
+	if err := conn.Bind(entry.DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return nil, false, nil
+		}
+		return nil, false, fmt.Errorf("user bind: %w", err)
+	}
+	return ldapGroupNames(entry.GetAttributeValues(a.cfg.GroupAttribute)), true, nil
+}
+
+// ldapGroupNames returns each group both as given (usually a DN) and, for
+// DNs, by its first RDN value, so LDAP_ADMIN_GROUPS can list either
+// "cn=admins,ou=groups,dc=example,dc=com" or just "admins".
+func ldapGroupNames(values []string) []string {
+	out := make([]string, 0, 2*len(values))
+	for _, v := range values {
+		out = append(out, v)
+		dn, err := ldap.ParseDN(v)
+		if err == nil && len(dn.RDNs) > 0 && len(dn.RDNs[0].Attributes) > 0 {
+			out = append(out, dn.RDNs[0].Attributes[0].Value)
+		}
+	}
+	return out
+}
+
+// checkLDAPPassword authenticates against the directory and provisions the
+// account. Local accounts never reach it, so a directory user can't take
+// over a local account by sharing its name.
+func (s *Server) checkLDAPPassword(r *http.Request, username, password string) (*database.User, bool) {
+	groups, ok, err := s.ldap.authenticate(username, password)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "ldap authentication failed", "username", username, "err", err)
+		return nil, false
+	}
+	if !ok {
+		return nil, false
+	}
+	user, err := s.provisionExternalUser(r.Context(), ldapSource, username, groups, s.ldap.cfg.Roles, s.ldap.cfg.AutoCreate)
+	if err != nil {
+		if !errors.Is(err, errUnknownUser) {
+			slog.ErrorContext(r.Context(), "ldap account provisioning failed", "username", username, "err", err)
+		}
+		return nil, false
+	}
+	return user, true
+}
@@ -0,0 +1,49 @@
+package web
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/ab0oo/gopds/internal/i18n"
+	"github.com/ab0oo/gopds/internal/settings"
+)
+
+// uploadRoutes take file uploads, which are limited by max_upload_mb
+// instead of max_body_kb.
+var uploadRoutes = map[string]bool{
+	"/api/import/metadata": true,
+}
+
+// limitBodies caps request bodies at the configured size. A request that
+// declares a larger Content-Length gets 413 straight away; one that sends
+// more than it declared is cut off, and the handler fails to read it.
+// Uploads may take longer to arrive than the server's read timeout allows,
+// and longer to process than its write timeout, which counts from the
+// request headers, so both are lifted for them.
+func (s *Server) limitBodies(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Body == nil || r.Body == http.NoBody {
+			next.ServeHTTP(w, r)
+			return
+		}
+		limit := int64(s.settings.Int(settings.MaxBodyKB)) << 10
+		if uploadRoutes[r.URL.Path] {
+			limit = int64(s.settings.Int(settings.MaxUploadMB)) << 20
+			_ = http.NewResponseController(w).SetReadDeadline(time.Time{})
+			streamWithoutDeadline(w)
+		}
+		if r.ContentLength > limit {
+			http.Error(w, i18n.T("Request body too large"), http.StatusRequestEntityTooLarge)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// streamWithoutDeadline lifts the server's write timeout for a response
+// that may rightly take longer, such as a book download over a slow link
+// or a full library export.
+func streamWithoutDeadline(w http.ResponseWriter) {
+	_ = http.NewResponseController(w).SetWriteDeadline(time.Time{})
+}
@@ -0,0 +1,185 @@
+package web
+
+import (
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ab0oo/gopds/internal/i18n"
+	"github.com/ab0oo/gopds/internal/metrics"
+)
+
+var loginFailures = metrics.NewCounterVec("gopds_login_failures_total",
+	"Failed password checks, by where the password was sent.", "method")
+
+var loginLockouts = metrics.NewCounterVec("gopds_login_lockouts_total",
+	"Usernames and client IPs locked out after repeated failed logins.", "kind")
+
+// loginGuard slows down password guessing. Failures are counted per username
+// and per client IP; after a few free attempts each further failure doubles
+// the wait before the next attempt, and enough failures lock the username or
+// IP out for a while. The per-IP token bucket in front of the login route
+// still applies; this adds memory of who has been failing.
+type loginGuard struct {
+	freeAttempts int
+	threshold    int
+	lockout      time.Duration
+	window       time.Duration
+
+	mu        sync.Mutex
+	entries   map[string]*loginFailureEntry
+	lastSweep time.Time
+}
+
+type loginFailureEntry struct {
+	count       int
+	last        time.Time
+	lockedUntil time.Time
+}
+
+const (
+	loginBackoffBase = time.Second
+	loginBackoffMax  = 5 * time.Minute
+)
+
+// newLoginGuardFromEnv reads LOGIN_LOCKOUT_THRESHOLD (default 10 failures;
+// 0 disables the guard) and LOGIN_LOCKOUT_MINUTES (default 15).
+func newLoginGuardFromEnv() *loginGuard {
+	threshold := envInt("LOGIN_LOCKOUT_THRESHOLD", 10)
+	if threshold <= 0 {
+		return nil
+	}
+	minutes := envInt("LOGIN_LOCKOUT_MINUTES", 15)
+	if minutes <= 0 {
+		minutes = 15
+	}
+	lockout := time.Duration(minutes) * time.Minute
+	return &loginGuard{
+		freeAttempts: 3,
+		threshold:    threshold,
+		lockout:      lockout,
+		// Failures older than this are forgotten.
+		window:  max(lockout, time.Hour),
+		entries: make(map[string]*loginFailureEntry),
+	}
+}
+
+func envInt(env string, fallback int) int {
+	raw := strings.TrimSpace(os.Getenv(env))
+	if raw == "" {
+		return fallback
+	}
+	v, err := strconv.Atoi(raw)
+	if err != nil || v < 0 {
+		slog.Warn("invalid integer setting; using default", "env", env, "value", raw, "default", fallback)
+		return fallback
+	}
+	return v
+}
+
+func loginUserKey(username string) string {
+	return "user:" + strings.ToLower(strings.TrimSpace(username))
+}
+func loginIPKey(ip string) string { return "ip:" + ip }
+
+// wait reports how long a login for username from ip must wait; zero means
+// it may go ahead.
+func (g *loginGuard) wait(username, ip string) time.Duration {
+	if g == nil {
+		return 0
+	}
+	now := time.Now()
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return max(g.waitLocked(loginUserKey(username), now), g.waitLocked(loginIPKey(ip), now))
+}
+
+func (g *loginGuard) waitLocked(key string, now time.Time) time.Duration {
+	e, ok := g.entries[key]
+	if !ok {
+		return 0
+	}
+	if now.Sub(e.last) > g.window && now.After(e.lockedUntil) {
+		delete(g.entries, key)
+		return 0
+	}
+	until := e.lockedUntil
+	if e.count > g.freeAttempts {
+		backoff := loginBackoffBase * time.Duration(math.Pow(2, float64(e.count-g.freeAttempts-1)))
+		until = later(until, e.last.Add(min(backoff, loginBackoffMax)))
+	}
+	if until.After(now) {
+		return until.Sub(now)
+	}
+	return 0
+}
+
+func later(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
+
+// fail records a failed login and logs a lockout when one starts.
+func (g *loginGuard) fail(r *http.Request, username, ip string) {
+	if g == nil {
+		return
+	}
+	now := time.Now()
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.sweep(now)
+	for _, key := range []string{loginUserKey(username), loginIPKey(ip)} {
+		e, ok := g.entries[key]
+		if !ok || (now.Sub(e.last) > g.window && now.After(e.lockedUntil)) {
+			e = &loginFailureEntry{}
+			g.entries[key] = e
+		}
+		e.count++
+		e.last = now
+		if e.count >= g.threshold && !e.lockedUntil.After(now) {
+			e.lockedUntil = now.Add(g.lockout)
+			e.count = 0
+			kind, subject, _ := strings.Cut(key, ":")
+			loginLockouts.Inc(kind)
+			slog.WarnContext(r.Context(), "login locked out", "kind", kind, "subject", subject, "until", e.lockedUntil.UTC(), "remote", ip)
+		}
+	}
+}
+
+// succeed clears the username's failures after a good login. The IP's are
+// kept, so one valid account can't be used to reset guessing at others.
+func (g *loginGuard) succeed(username string) {
+	if g == nil {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.entries, loginUserKey(username))
+}
+
+// sweep forgets stale entries at most once a minute. Callers hold g.mu.
+func (g *loginGuard) sweep(now time.Time) {
+	if now.Sub(g.lastSweep) < time.Minute {
+		return
+	}
+	g.lastSweep = now
+	for key, e := range g.entries {
+		if now.Sub(e.last) > g.window && now.After(e.lockedUntil) {
+			delete(g.entries, key)
+		}
+	}
+}
+
+// refuseLogin answers a throttled login with 429 and Retry-After.
+func refuseLogin(w http.ResponseWriter, r *http.Request, username string, wait time.Duration) {
+	slog.WarnContext(r.Context(), "login throttled", "username", username, "remote", clientIP(r), "retry_after", wait.Round(time.Second))
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	http.Error(w, i18n.T("Too many failed logins; try again later"), http.StatusTooManyRequests)
+}
@@ -0,0 +1,49 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ab0oo/gopds/internal/i18n"
+	"github.com/ab0oo/gopds/internal/logging"
+)
+
+type logsPayload struct {
+	Entries []logging.Entry `json:"entries"`
+}
+
+// HandleAdminLogs returns recent log output captured in memory.
+// Query: level (debug|info|warn|error, minimum severity), since (RFC3339
+// timestamp or a duration such as 15m), limit (default 500).
+func (s *Server) HandleAdminLogs(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	level := strings.TrimSpace(q.Get("level"))
+	if level != "" && !logging.ValidLevel(level) {
+		http.Error(w, i18n.T("Invalid level. Use debug, info, warn, or error"), http.StatusBadRequest)
+		return
+	}
+
+	var since time.Time
+	if raw := strings.TrimSpace(q.Get("since")); raw != "" {
+		if t, err := time.Parse(time.RFC3339, raw); err == nil {
+			since = t
+		} else if d, err := time.ParseDuration(raw); err == nil && d > 0 {
+			since = time.Now().UTC().Add(-d)
+		} else {
+			http.Error(w, i18n.T("Invalid since. Use an RFC3339 timestamp or a duration like 15m"), http.StatusBadRequest)
+			return
+		}
+	}
+
+	limit := parseIntDefault(q.Get("limit"), 500)
+	if limit < 1 || limit > 5000 {
+		limit = 500
+	}
+
+	entries := logging.Default.Query(level, since, limit)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	_ = json.NewEncoder(w).Encode(logsPayload{Entries: entries})
+}
@@ -0,0 +1,198 @@
+package web
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/ab0oo/gopds/internal/i18n"
+	"github.com/ab0oo/gopds/internal/settings"
+)
+
+// maxCachedResponse is the largest provider response kept in the lookup
+// cache. Search results are a few kilobytes; anything bigger is passed
+// through uncached.
+const maxCachedResponse = 2 << 20
+
+// lookupCacheTTL is how long lookups are cached, or 0 if caching is off.
+func (s *Server) lookupCacheTTL() time.Duration {
+	return time.Duration(s.settings.Int(settings.LookupCacheHours)) * time.Hour
+}
+
+// lookupCacheKey identifies a provider request: its method, URL, and, for
+// GraphQL POSTs, a hash of the body. API keys are added after this, so
+// they never reach the cache. It reports false for requests that can't be
+// replayed from a cache.
+func lookupCacheKey(req *http.Request) (string, bool) {
+	switch req.Method {
+	case http.MethodGet:
+		return "GET " + req.URL.String(), true
+	case http.MethodPost:
+		if req.GetBody == nil {
+			return "", false
+		}
+		body, err := req.GetBody()
+		if err != nil {
+			return "", false
+		}
+		defer body.Close()
+		h := sha256.New()
+		if _, err := io.Copy(h, body); err != nil {
+			return "", false
+		}
+		return "POST " + req.URL.String() + " " + hex.EncodeToString(h.Sum(nil)), true
+	}
+	return "", false
+}
+
+// cachedResponse answers req from the lookup cache, or returns nil.
+func (s *Server) cachedResponse(req *http.Request, key string) *http.Response {
+	body, contentType, ok, err := s.db.GetLookupCache(key)
+	if err != nil {
+		slog.WarnContext(req.Context(), "lookup cache read failed", "err", err)
+		return nil
+	}
+	if !ok {
+		return nil
+	}
+	h := http.Header{}
+	h.Set("Content-Type", contentType)
+	h.Set("X-GoPDS-Cache", "hit")
+	return &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        h,
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
+
+// storeResponse caches a successful response and returns it with its body
+// still readable.
+func (s *Server) storeResponse(key string, res *http.Response, ttl time.Duration) *http.Response {
+	body, err := io.ReadAll(io.LimitReader(res.Body, maxCachedResponse+1))
+	if err != nil || len(body) > maxCachedResponse {
+		// Hand back what was read followed by the rest, uncached.
+		res.Body = readCloser{io.MultiReader(bytes.NewReader(body), res.Body), res.Body}
+		return res
+	}
+	res.Body.Close()
+	if err := s.db.PutLookupCache(key, res.Header.Get("Content-Type"), body, ttl); err != nil {
+		slog.WarnContext(res.Request.Context(), "lookup cache write failed", "err", err)
+	}
+	res.Body = io.NopCloser(bytes.NewReader(body))
+	return res
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+type coverProbe struct {
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+// probeCoverCached reads a remote cover's dimensions, with successful
+// results kept in the lookup cache, so re-opening a book's cover search
+// doesn't download every candidate again. The image itself is cached too,
+// for the preview.
+func (s *Server) probeCoverCached(raw string) (int, int, bool) {
+	ttl := s.lookupCacheTTL()
+	key := "probe " + raw
+	if ttl > 0 {
+		if body, _, ok, err := s.db.GetLookupCache(key); err == nil && ok {
+			var p coverProbe
+			if json.Unmarshal(body, &p) == nil {
+				return p.Width, p.Height, true
+			}
+		}
+	}
+	// An image already downloaded is measured from the cache; otherwise
+	// only its header is fetched.
+	var w, h int
+	var ok bool
+	if body, _, cached, err := s.db.GetLookupCache("image " + raw); err == nil && cached {
+		w, h, ok = imageDimensions(body)
+	} else {
+		var err error
+		w, h, err = remoteImageDimensions(s.upstream, raw)
+		ok = err == nil
+	}
+	if ok && ttl > 0 {
+		body, _ := json.Marshal(coverProbe{Width: w, Height: h})
+		if err := s.db.PutLookupCache(key, "application/json", body, ttl); err != nil {
+			slog.Warn("lookup cache write failed", "err", err)
+		}
+	}
+	return w, h, ok
+}
+
+// remoteImageReachableCached is remoteImageReachable with positive answers
+// cached.
+func (s *Server) remoteImageReachableCached(raw string) bool {
+	ttl := s.lookupCacheTTL()
+	key := "head " + raw
+	if ttl > 0 {
+		if _, _, ok, err := s.db.GetLookupCache(key); err == nil && ok {
+			return true
+		}
+	}
+	ok := remoteImageReachable(s.upstream, raw)
+	if ok && ttl > 0 {
+		if err := s.db.PutLookupCache(key, "", []byte{}, ttl); err != nil {
+			slog.Warn("lookup cache write failed", "err", err)
+		}
+	}
+	return ok
+}
+
+type lookupCachePayload struct {
+	Entries  int    `json:"entries"`
+	Bytes    int64  `json:"bytes"`
+	TTLHours int    `json:"ttl_hours"`
+	Cleared  *int64 `json:"cleared,omitempty"`
+}
+
+// HandleLookupCache reports the lookup cache's size.
+func (s *Server) HandleLookupCache(w http.ResponseWriter, r *http.Request) {
+	s.writeLookupCache(w, nil)
+}
+
+// HandleClearLookupCache empties the lookup cache, so the next lookups go
+// to the providers.
+func (s *Server) HandleClearLookupCache(w http.ResponseWriter, r *http.Request) {
+	n, err := s.db.ClearLookupCache()
+	if err != nil {
+		http.Error(w, i18n.T("Internal Server Error"), http.StatusInternalServerError)
+		return
+	}
+	slog.InfoContext(r.Context(), "lookup cache cleared", "entries", n)
+	s.writeLookupCache(w, &n)
+}
+
+func (s *Server) writeLookupCache(w http.ResponseWriter, cleared *int64) {
+	entries, size, err := s.db.LookupCacheStats()
+	if err != nil {
+		http.Error(w, i18n.T("Internal Server Error"), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	_ = json.NewEncoder(w).Encode(lookupCachePayload{
+		Entries:  entries,
+		Bytes:    size,
+		TTLHours: s.settings.Int(settings.LookupCacheHours),
+		Cleared:  cleared,
+	})
+}
@@ -0,0 +1,181 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/ab0oo/gopds/internal/database"
+	"github.com/ab0oo/gopds/internal/i18n"
+	"github.com/ab0oo/gopds/internal/jobs"
+	"github.com/ab0oo/gopds/internal/scanner"
+	"github.com/ab0oo/gopds/internal/settings"
+)
+
+type metadataFetchJobPayload struct {
+	// BookIDs are the books to look up; empty means every book without a
+	// description.
+	BookIDs []int `json:"book_ids,omitempty"`
+	// Actor is who queued the job, for the metadata history.
+	Actor string `json:"actor"`
+}
+
+type metadataFetchRequest struct {
+	BookIDs []int `json:"book_ids"`
+}
+
+// HandleFetchMetadata queues a metadata-fetch job for the books in the
+// body's book_ids, or for every book without a description.
+func (s *Server) HandleFetchMetadata(w http.ResponseWriter, r *http.Request) {
+	var req metadataFetchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, i18n.T("Invalid JSON body"), http.StatusBadRequest)
+		return
+	}
+	payload := metadataFetchJobPayload{BookIDs: req.BookIDs, Actor: s.actorName(r)}
+	job, err := s.jobs.EnqueueUnique(r.Context(), jobs.TypeMetadataFetch, payload, "Metadata fetch queued.")
+	if err != nil && !errors.Is(err, jobs.ErrAlreadyActive) {
+		http.Error(w, i18n.T("Failed to queue metadata fetch: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if errors.Is(err, jobs.ErrAlreadyActive) {
+		w.WriteHeader(http.StatusConflict)
+	} else {
+		w.WriteHeader(http.StatusAccepted)
+	}
+	_ = json.NewEncoder(w).Encode(job)
+}
+
+// runMetadataFetchJob looks each book up in the metadata providers and,
+// where a candidate is confident enough to apply without review, fills in
+// the fields the book is missing. Fields the book already has, and its
+// title and author, are never changed.
+func (s *Server) runMetadataFetchJob(ctx context.Context, job *database.Job, p *jobs.Progress) error {
+	var payload metadataFetchJobPayload
+	if err := jobs.DecodePayload(job, &payload); err != nil {
+		return fmt.Errorf("invalid metadata fetch payload: %w", err)
+	}
+	if s.settings.Bool(settings.OfflineMode) {
+		return errors.New(errExternalLookupsDisabled)
+	}
+	if s.settings.Int(settings.AutoApplyConfidence) <= 0 {
+		return errors.New("metadata_auto_apply_confidence is 0, so no candidate can be applied without review")
+	}
+
+	var books []database.Book
+	if len(payload.BookIDs) > 0 {
+		for _, id := range payload.BookIDs {
+			book, err := s.db.GetBookByID(strconv.Itoa(id))
+			if err != nil {
+				slog.WarnContext(ctx, "metadata fetch: book not found", "book_id", id, "err", err)
+				continue
+			}
+			books = append(books, *book)
+		}
+	} else {
+		all, err := s.db.GetAllBooks()
+		if err != nil {
+			return fmt.Errorf("failed to list books: %w", err)
+		}
+		for _, b := range all {
+			if strings.TrimSpace(b.Description) == "" {
+				books = append(books, b)
+			}
+		}
+	}
+	p.Update("fetching", fmt.Sprintf("Looking up %d books...", len(books)), 0)
+
+	updated := 0
+	for i := range books {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		ok, err := s.fetchBookMetadata(ctx, &books[i], payload.Actor)
+		if err != nil {
+			slog.WarnContext(ctx, "metadata fetch: book not updated", "book_id", books[i].ID, "err", err)
+		} else if ok {
+			updated++
+		}
+		p.Update("fetching", fmt.Sprintf("Looked up %d of %d books, %d updated...", i+1, len(books), updated), updated)
+	}
+	slog.InfoContext(ctx, "metadata fetch complete", "books", len(books), "updated", updated)
+	p.Update("complete", fmt.Sprintf("Metadata fetch complete. %d of %d books updated.", updated, len(books)), updated)
+	return nil
+}
+
+// fetchBookMetadata fills in one book's missing fields from its best
+// auto-apply candidate, and reports whether anything was written.
+func (s *Server) fetchBookMetadata(ctx context.Context, book *database.Book, actor string) (bool, error) {
+	bookPath, err := s.resolveBookPath(book)
+	if err != nil {
+		return false, err
+	}
+	before, err := scanner.ExtractLiveMetadata(bookPath)
+	if err != nil {
+		return false, err
+	}
+	ref := s.bookMatchReference(book, matchReference{})
+	q := strings.TrimSpace(ref.Title + " " + ref.Author)
+	var match *metadataCandidate
+	for _, c := range s.searchMetadata(ctx, q, ref.ISBN, ref) {
+		if c.AutoApply {
+			match = &c
+			break
+		}
+	}
+	if match == nil {
+		return false, nil
+	}
+
+	update := scanner.MetadataUpdate{
+		Title:       before.Title,
+		Creator:     before.Author,
+		Language:    fillIn(before.Language, match.Language),
+		Identifier:  before.Identifier,
+		Publisher:   fillIn(before.Publisher, match.Publisher),
+		Date:        fillIn(before.Date, match.Date),
+		Description: fillIn(before.Description, match.Description),
+		Subjects:    before.Subjects,
+		Series:      before.Series,
+		SeriesIndex: before.SeriesIndex,
+	}
+	if len(update.Subjects) == 0 {
+		update.Subjects = match.Subjects
+	}
+	if update.Series == "" && match.Series != "" {
+		update.Series, update.SeriesIndex = match.Series, match.SeriesIndex
+	}
+	if update.Title == "" {
+		update.Title = book.Title
+	}
+	if update.Creator == "" {
+		update.Creator = book.Author
+	}
+	if update.Language == before.Language && update.Publisher == before.Publisher && update.Date == before.Date &&
+		update.Description == before.Description && len(update.Subjects) == len(before.Subjects) && update.Series == before.Series {
+		return false, nil
+	}
+
+	after, err := s.applyMetadataUpdate(book, bookPath, update)
+	if err != nil {
+		return false, err
+	}
+	s.recordMetadataChangeBy(ctx, actor, book.ID, before, after, 0)
+	return true, nil
+}
+
+// fillIn returns current, or found if current is empty.
+func fillIn(current, found string) string {
+	if strings.TrimSpace(current) != "" {
+		return current
+	}
+	return strings.TrimSpace(found)
+}
@@ -0,0 +1,40 @@
+package web
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/ab0oo/gopds/internal/metrics"
+	"github.com/go-chi/chi/middleware"
+	"github.com/go-chi/chi/v5"
+)
+
+func (s *Server) registerMetrics() {
+	metrics.NewGaugeFunc("gopds_books_indexed", "Books currently in the catalog.", func() (float64, bool) {
+		n, err := s.db.CountBooks()
+		return float64(n), err == nil
+	})
+}
+
+// HandleMetrics serves Prometheus metrics in the text exposition format.
+func (s *Server) HandleMetrics(w http.ResponseWriter, r *http.Request) {
+	metrics.Handler().ServeHTTP(w, r)
+}
+
+// instrumentRequests records request counts and latency per route. The route
+// label is the matched chi pattern (e.g. /api/books/{id}/cover) so book IDs
+// don't explode the series count.
+func instrumentRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+
+		route := "unmatched"
+		if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+			route = rctx.RoutePattern()
+		}
+		metrics.HTTPRequests.Inc(route, r.Method, metrics.StatusLabel(ww.Status()))
+		metrics.HTTPDuration.Observe(time.Since(start).Seconds(), route, r.Method)
+	})
+}
@@ -0,0 +1,25 @@
+package web
+
+import (
+	"net/http"
+
+	"github.com/ab0oo/gopds/internal/i18n"
+	"github.com/ab0oo/gopds/internal/settings"
+)
+
+// errExternalLookupsDisabled is the body of every response refused because
+// of offline_mode, so the UI shows why a search did nothing.
+const errExternalLookupsDisabled = "External lookups are disabled (offline_mode is on)"
+
+// requireOnline answers 503 instead of calling next while offline_mode is
+// on. It wraps every handler that talks to Open Library, Google Books, or
+// Wikipedia, so an air-gapped install never attempts an outbound request.
+func (s *Server) requireOnline(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.settings.Bool(settings.OfflineMode) {
+			http.Error(w, i18n.T(errExternalLookupsDisabled), http.StatusServiceUnavailable)
+			return
+		}
+		next(w, r)
+	}
+}
@@ -0,0 +1,415 @@
+package web
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ab0oo/gopds/internal/i18n"
+	"github.com/ab0oo/gopds/internal/metrics"
+)
+
+// OpenID Connect single sign-on using the authorization code flow with PKCE.
+// The ID token is taken straight from the issuer's token endpoint over TLS,
+// which OIDC Core 3.1.3.7 accepts in place of checking its signature; its
+// issuer, audience, expiry, and nonce are still verified.
+
+const (
+	oidcSource       = "oidc"
+	oidcStateCookie  = "gopds_oidc_state"
+	oidcStateTTL     = 10 * time.Minute
+	oidcCallbackPath = "/api/auth/oidc/callback"
+)
+
+type oidcConfig struct {
+	Issuer        string
+	ClientID      string
+	ClientSecret  string
+	RedirectURL   string // empty: derived from the request
+	Scopes        []string
+	UsernameClaim string
+	GroupsClaim   string
+	AutoCreate    bool
+	Roles         roleMapping
+}
+
+type oidcProvider struct {
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	Issuer                string `json:"issuer"`
+}
+
+// oidcLogin is a login in flight, keyed by its state parameter.
+type oidcLogin struct {
+	Nonce     string
+	Verifier  string
+	Redirect  string
+	ExpiresAt time.Time
+}
+
+type oidcClient struct {
+	cfg    oidcConfig
+	client *http.Client
+
+	mu       sync.Mutex
+	provider *oidcProvider
+	pending  map[string]oidcLogin
+}
+
+// newOIDCFromEnv returns nil unless OIDC_ISSUER_URL and OIDC_CLIENT_ID are
+// set.
+func newOIDCFromEnv() *oidcClient {
+	issuer := strings.TrimRight(strings.TrimSpace(os.Getenv("OIDC_ISSUER_URL")), "/")
+	clientID := strings.TrimSpace(os.Getenv("OIDC_CLIENT_ID"))
+	if issuer == "" || clientID == "" {
+		return nil
+	}
+	cfg := oidcConfig{
+		Issuer:        issuer,
+		ClientID:      clientID,
+		ClientSecret:  os.Getenv("OIDC_CLIENT_SECRET"),
+		RedirectURL:   strings.TrimSpace(os.Getenv("OIDC_REDIRECT_URL")),
+		Scopes:        strings.Fields(strings.ReplaceAll(os.Getenv("OIDC_SCOPES"), ",", " ")),
+		UsernameClaim: strings.TrimSpace(os.Getenv("OIDC_USERNAME_CLAIM")),
+		GroupsClaim:   strings.TrimSpace(os.Getenv("OIDC_GROUPS_CLAIM")),
+		AutoCreate:    !isFalse(os.Getenv("OIDC_AUTO_CREATE")),
+		Roles:         roleMappingFromEnv("OIDC"),
+	}
+	if len(cfg.Scopes) == 0 {
+		cfg.Scopes = []string{"openid", "profile", "email", "groups"}
+	}
+	if cfg.UsernameClaim == "" {
+		cfg.UsernameClaim = "preferred_username"
+	}
+	if cfg.GroupsClaim == "" {
+		cfg.GroupsClaim = "groups"
+	}
+	slog.Info("oidc login enabled", "issuer", issuer, "client_id", clientID, "auto_create", cfg.AutoCreate)
+	return &oidcClient{
+		cfg:     cfg,
+		client:  &http.Client{Timeout: 15 * time.Second, Transport: metrics.UpstreamTransport},
+		pending: make(map[string]oidcLogin),
+	}
+}
+
+// discover fetches the issuer's metadata once. A failure isn't cached, so a
+// provider that was down at first use is retried on the next login.
+func (c *oidcClient) discover(ctx context.Context) (*oidcProvider, error) {
+	c.mu.Lock()
+	if c.provider != nil {
+		p := c.provider
+		c.mu.Unlock()
+		return p, nil
+	}
+	c.mu.Unlock()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.cfg.Issuer+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("discovery returned %s", resp.Status)
+	}
+	var p oidcProvider
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&p); err != nil {
+		return nil, err
+	}
+	if p.AuthorizationEndpoint == "" || p.TokenEndpoint == "" {
+		return nil, errors.New("discovery document lacks authorization or token endpoint")
+	}
+	if strings.TrimRight(p.Issuer, "/") != c.cfg.Issuer {
+		return nil, fmt.Errorf("discovery issuer %q does not match OIDC_ISSUER_URL", p.Issuer)
+	}
+
+	c.mu.Lock()
+	c.provider = &p
+	c.mu.Unlock()
+	return &p, nil
+}
+
+func randomURLString(n int) (string, error) {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+func (c *oidcClient) redirectURL(r *http.Request) string {
+	if c.cfg.RedirectURL != "" {
+		return c.cfg.RedirectURL
+	}
+	return requestBaseURL(r) + oidcCallbackPath
+}
+
+// begin records a new login and returns its state.
+func (c *oidcClient) begin(redirect string) (string, oidcLogin, error) {
+	state, err := randomURLString(24)
+	if err != nil {
+		return "", oidcLogin{}, err
+	}
+	nonce, err := randomURLString(24)
+	if err != nil {
+		return "", oidcLogin{}, err
+	}
+	verifier, err := randomURLString(32)
+	if err != nil {
+		return "", oidcLogin{}, err
+	}
+	login := oidcLogin{Nonce: nonce, Verifier: verifier, Redirect: redirect, ExpiresAt: time.Now().Add(oidcStateTTL)}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	for k, l := range c.pending {
+		if now.After(l.ExpiresAt) {
+			delete(c.pending, k)
+		}
+	}
+	c.pending[state] = login
+	return state, login, nil
+}
+
+// finish consumes the login for state; each state can be used once.
+func (c *oidcClient) finish(state string) (oidcLogin, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	login, ok := c.pending[state]
+	delete(c.pending, state)
+	if !ok || time.Now().After(login.ExpiresAt) {
+		return oidcLogin{}, false
+	}
+	return login, true
+}
+
+type oidcTokenResponse struct {
+	IDToken string `json:"id_token"`
+	Error   string `json:"error"`
+	Detail  string `json:"error_description"`
+}
+
+func (c *oidcClient) exchange(ctx context.Context, p *oidcProvider, code, redirect, verifier string) (string, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {redirect},
+		"client_id":     {c.cfg.ClientID},
+		"code_verifier": {verifier},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if c.cfg.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(c.cfg.ClientID), url.QueryEscape(c.cfg.ClientSecret))
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var tok oidcTokenResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&tok); err != nil {
+		return "", fmt.Errorf("token endpoint returned %s", resp.Status)
+	}
+	if tok.Error != "" {
+		return "", fmt.Errorf("token endpoint: %s: %s", tok.Error, tok.Detail)
+	}
+	if tok.IDToken == "" {
+		return "", errors.New("token response has no id_token")
+	}
+	return tok.IDToken, nil
+}
+
+// claims decodes and checks the ID token's payload.
+func (c *oidcClient) claims(idToken, nonce string) (map[string]any, error) {
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed id_token")
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return nil, fmt.Errorf("malformed id_token payload: %w", err)
+	}
+	var claims map[string]any
+	if err := json.Unmarshal(raw, &claims); err != nil {
+		return nil, fmt.Errorf("malformed id_token payload: %w", err)
+	}
+
+	if iss, _ := claims["iss"].(string); strings.TrimRight(iss, "/") != c.cfg.Issuer {
+		return nil, fmt.Errorf("id_token issuer %q does not match", iss)
+	}
+	audOK := false
+	switch aud := claims["aud"].(type) {
+	case string:
+		audOK = aud == c.cfg.ClientID
+	case []any:
+		for _, a := range aud {
+			if a == c.cfg.ClientID {
+				audOK = true
+			}
+		}
+	}
+	if !audOK {
+		return nil, errors.New("id_token was not issued for this client")
+	}
+	if exp, ok := claims["exp"].(float64); !ok || time.Now().After(time.Unix(int64(exp), 0).Add(time.Minute)) {
+		return nil, errors.New("id_token has expired")
+	}
+	if got, _ := claims["nonce"].(string); got != nonce {
+		return nil, errors.New("id_token nonce does not match")
+	}
+	return claims, nil
+}
+
+// claimStrings reads a claim that may be a string or a list of strings.
+func claimStrings(claims map[string]any, name string) []string {
+	switch v := claims[name].(type) {
+	case string:
+		return []string{v}
+	case []any:
+		out := make([]string, 0, len(v))
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				out = append(out, s)
+			}
+		}
+		return out
+	}
+	return nil
+}
+
+// HandleOIDCLogin redirects the browser to the identity provider.
+func (s *Server) HandleOIDCLogin(w http.ResponseWriter, r *http.Request) {
+	if s.oidc == nil {
+		http.Error(w, i18n.T("Single sign-on is not configured"), http.StatusNotFound)
+		return
+	}
+	p, err := s.oidc.discover(r.Context())
+	if err != nil {
+		slog.ErrorContext(r.Context(), "oidc discovery failed", "issuer", s.oidc.cfg.Issuer, "err", err)
+		http.Error(w, i18n.T("Identity provider is unavailable"), http.StatusBadGateway)
+		return
+	}
+	redirect := s.oidc.redirectURL(r)
+	state, login, err := s.oidc.begin(redirect)
+	if err != nil {
+		http.Error(w, i18n.T("Failed to start login"), http.StatusInternalServerError)
+		return
+	}
+	challenge := sha256.Sum256([]byte(login.Verifier))
+
+	authURL, err := url.Parse(p.AuthorizationEndpoint)
+	if err != nil {
+		http.Error(w, i18n.T("Identity provider is misconfigured"), http.StatusBadGateway)
+		return
+	}
+	q := authURL.Query()
+	q.Set("response_type", "code")
+	q.Set("client_id", s.oidc.cfg.ClientID)
+	q.Set("redirect_uri", redirect)
+	q.Set("scope", strings.Join(s.oidc.cfg.Scopes, " "))
+	q.Set("state", state)
+	q.Set("nonce", login.Nonce)
+	q.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	q.Set("code_challenge_method", "S256")
+	authURL.RawQuery = q.Encode()
+
+	// The state is also bound to this browser, so a callback URL can't be
+	// replayed in someone else's session.
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    state,
+		Path:     "/api/auth/oidc",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+		MaxAge:   int(oidcStateTTL.Seconds()),
+		Secure:   isHTTPS(r),
+	})
+	http.Redirect(w, r, authURL.String(), http.StatusFound)
+}
+
+// HandleOIDCCallback completes the login the provider redirected back from.
+func (s *Server) HandleOIDCCallback(w http.ResponseWriter, r *http.Request) {
+	if s.oidc == nil {
+		http.Error(w, i18n.T("Single sign-on is not configured"), http.StatusNotFound)
+		return
+	}
+	q := r.URL.Query()
+	if e := q.Get("error"); e != "" {
+		slog.WarnContext(r.Context(), "oidc login refused by provider", "error", e, "description", q.Get("error_description"))
+		http.Error(w, i18n.T("Login was refused by the identity provider"), http.StatusUnauthorized)
+		return
+	}
+	state := q.Get("state")
+	c, err := r.Cookie(oidcStateCookie)
+	if err != nil || state == "" || c.Value != state {
+		http.Error(w, i18n.T("Login state mismatch; start the login again"), http.StatusBadRequest)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Value: "", Path: "/api/auth/oidc", MaxAge: -1, HttpOnly: true})
+	login, ok := s.oidc.finish(state)
+	if !ok {
+		http.Error(w, i18n.T("Login expired; start the login again"), http.StatusBadRequest)
+		return
+	}
+
+	p, err := s.oidc.discover(r.Context())
+	if err != nil {
+		http.Error(w, i18n.T("Identity provider is unavailable"), http.StatusBadGateway)
+		return
+	}
+	idToken, err := s.oidc.exchange(r.Context(), p, q.Get("code"), login.Redirect, login.Verifier)
+	if err != nil {
+		slog.WarnContext(r.Context(), "oidc code exchange failed", "err", err)
+		http.Error(w, i18n.T("Login failed"), http.StatusBadGateway)
+		return
+	}
+	claims, err := s.oidc.claims(idToken, login.Nonce)
+	if err != nil {
+		slog.WarnContext(r.Context(), "oidc id_token rejected", "err", err)
+		http.Error(w, i18n.T("Login failed"), http.StatusUnauthorized)
+		return
+	}
+
+	var username string
+	if names := claimStrings(claims, s.oidc.cfg.UsernameClaim); len(names) > 0 {
+		username = names[0]
+	}
+	groups := claimStrings(claims, s.oidc.cfg.GroupsClaim)
+	user, err := s.provisionExternalUser(r.Context(), oidcSource, username, groups, s.oidc.cfg.Roles, s.oidc.cfg.AutoCreate)
+	if err != nil {
+		slog.WarnContext(r.Context(), "oidc login rejected", "username", username, "err", err)
+		if errors.Is(err, errUnknownUser) {
+			http.Error(w, i18n.T("No GoPDS account for %s", username), http.StatusForbidden)
+			return
+		}
+		http.Error(w, i18n.T("Login failed"), http.StatusForbidden)
+		return
+	}
+	if err := s.startSession(w, r, user); err != nil {
+		http.Error(w, i18n.T("Failed to create session"), http.StatusInternalServerError)
+		return
+	}
+	slog.InfoContext(r.Context(), "oidc login", "username", user.Username, "role", user.Role)
+	http.Redirect(w, r, "/", http.StatusFound)
+}
@@ -0,0 +1,469 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ab0oo/gopds/internal/database"
+	"github.com/ab0oo/gopds/internal/diagnostics"
+	"github.com/ab0oo/gopds/internal/epubcheck"
+	"github.com/ab0oo/gopds/internal/logging"
+	"github.com/ab0oo/gopds/internal/scanner"
+	"github.com/ab0oo/gopds/internal/settings"
+)
+
+// apiOperation describes one route for the OpenAPI document. Request and
+// Response are zero values of the Go types the handler decodes and encodes;
+// their schemas are derived by reflection so the document tracks the code.
+type apiOperation struct {
+	Method      string
+	Path        string
+	Tag         string
+	Summary     string
+	Scope       string // required token scope; empty for public routes
+	Public      string // public_* setting that gates anonymous access
+	Params      []apiParam
+	Request     any
+	RequestType string // non-JSON request body media type, e.g. text/csv
+	Response    any
+	ContentType string // non-JSON response media type
+	Status      int    // success status; defaults to 200
+	Errors      []int
+}
+
+type apiParam struct {
+	Name        string
+	In          string // path or query
+	Type        string // string, integer, or boolean
+	Description string
+	Enum        []string
+}
+
+func pathParam(name, description string) apiParam {
+	return apiParam{Name: name, In: "path", Type: "integer", Description: description}
+}
+
+func queryParam(name, typ, description string, enum ...string) apiParam {
+	return apiParam{Name: name, In: "query", Type: typ, Description: description, Enum: enum}
+}
+
+var (
+	bookIDParam  = pathParam("id", "Book ID.")
+	entryIDParam = pathParam("entryID", "Change history entry ID.")
+	jobIDParam   = pathParam("jobID", "Job ID.")
+
+	webhookIDPathParam = pathParam("webhookID", "Webhook ID.")
+	shelfIDParam       = pathParam("shelfID", "Shelf ID.")
+	annotationIDParam  = pathParam("annotationID", "Annotation ID.")
+	mergeIDParam       = pathParam("mergeID", "Author merge ID.")
+	userIDParam        = pathParam("userID", "User ID.")
+)
+
+// apiOperations lists the documented routes. Keep it in step with Router.
+var apiOperations = []apiOperation{
+	{Method: "GET", Path: "/healthz", Tag: "system", Summary: "Liveness probe", Response: healthPayload{}},
+	{Method: "GET", Path: "/readyz", Tag: "system", Summary: "Readiness probe (database, library root, scanner)", Response: readyPayload{}, Errors: []int{503}},
+	{Method: "GET", Path: "/metrics", Tag: "system", Summary: "Prometheus metrics", ContentType: "text/plain"},
+
+	{Method: "GET", Path: "/api/auth/status", Tag: "auth", Summary: "Current session", Response: authStatusPayload{}},
+	{Method: "POST", Path: "/api/auth/login", Tag: "auth", Summary: "Log in and set the session cookie; accounts with two-factor authentication answer 401 with totp_required until a code is sent", Request: loginRequest{}, Response: authStatusPayload{}, Errors: []int{400, 401, 429, 503}},
+	{Method: "POST", Path: "/api/auth/logout", Tag: "auth", Summary: "End the session", Response: authStatusPayload{}},
+	{Method: "POST", Path: "/api/auth/password", Tag: "auth", Summary: "Change the signed-in user's password; their other sessions are signed out", Request: changePasswordRequest{}, Status: 204, Errors: []int{400, 401, 403, 409, 429}},
+	{Method: "POST", Path: "/api/auth/password/reset", Tag: "auth", Summary: "Set a new password with a one-time reset token", Request: resetPasswordRequest{}, Status: 204, Errors: []int{400, 429}},
+	{Method: "GET", Path: "/api/auth/invite", Tag: "auth", Summary: "Check an invite link before signing up", Params: []apiParam{queryParam("token", "string", "Token from the invite link.")}, Response: inviteInfoPayload{}, Errors: []int{404, 429}},
+	{Method: "POST", Path: "/api/auth/invite", Tag: "auth", Summary: "Create the invited account with a chosen username and password, and sign in", Request: acceptInviteRequest{}, Response: authStatusPayload{}, Status: 201, Errors: []int{400, 404, 409, 429}},
+	{Method: "GET", Path: "/api/auth/sessions", Tag: "auth", Summary: "List the signed-in user's browser sessions with device, IP, and last use", Response: sessionsPayload{}, Errors: []int{401, 403}},
+	{Method: "DELETE", Path: "/api/auth/sessions", Tag: "auth", Summary: "Sign out every other session of the signed-in user", Response: revokedSessionsPayload{}, Errors: []int{401, 403}},
+	{Method: "DELETE", Path: "/api/auth/sessions/{sessionID}", Tag: "auth", Summary: "Sign out one of the signed-in user's sessions", Params: []apiParam{pathParam("sessionID", "Session ID.")}, Status: 204, Errors: []int{400, 401, 403, 404}},
+	{Method: "POST", Path: "/api/auth/totp/enroll", Tag: "auth", Summary: "Start two-factor enrollment for the signed-in local account; returns the secret and a QR code", Request: totpEnrollRequest{}, Response: totpEnrollPayload{}, Errors: []int{400, 401, 403, 409, 429}},
+	{Method: "POST", Path: "/api/auth/totp/confirm", Tag: "auth", Summary: "Enable two-factor with a code from the enrolled secret; returns one-time recovery codes", Request: totpCodeRequest{}, Response: recoveryCodesPayload{}, Errors: []int{400, 401, 403, 409, 429}},
+	{Method: "POST", Path: "/api/auth/totp/disable", Tag: "auth", Summary: "Disable two-factor with the password and a code or recovery code", Request: totpDisableRequest{}, Status: 204, Errors: []int{400, 401, 403, 409, 429}},
+	{Method: "GET", Path: "/api/auth/oidc/login", Tag: "auth", Summary: "Redirect to the OpenID Connect provider to sign in", Status: 302, Errors: []int{404, 429, 502}},
+	{Method: "GET", Path: "/api/auth/oidc/callback", Tag: "auth", Summary: "Complete an OpenID Connect sign-in, set the session cookie, and redirect to the UI", Params: []apiParam{
+		queryParam("code", "string", "Authorization code from the provider."),
+		queryParam("state", "string", "State issued by /api/auth/oidc/login."),
+	}, Status: 302, Errors: []int{400, 401, 403, 404, 502}},
+
+	{Method: "GET", Path: "/api/stats", Tag: "books", Summary: "Library totals, the caller's download usage and quotas, and for admins every user's usage", Public: settings.PublicAPI, Response: statsPayload{}},
+	{Method: "GET", Path: "/api/stats/reading", Tag: "books", Summary: "Reading statistics from synced progress and downloads: books finished per month, estimated pages and hours read, and top authors; admins also get a summary per user", Scope: scopeOPDS, Response: readingStatsPayload{}},
+	{Method: "GET", Path: "/api/stats/timeline", Tag: "books", Summary: "Library growth: books added per day or month, by source (scan, watch, import), with the running total", Public: settings.PublicAPI, Params: []apiParam{queryParam("bucket", "string", "Period of each point (default month).", "day", "month"), queryParam("since", "string", "First day to chart, as YYYY-MM-DD (default 90 days ago for days, the first book for months).")}, Response: timelinePayload{}, Errors: []int{400}},
+	{Method: "GET", Path: "/api/books", Tag: "books", Summary: "Stream every book as JSON, NDJSON (Accept: application/x-ndjson), or CSV (Accept: text/csv); with limit or after, one page in author and title order, with a Link header to the next; with sort, the most popular or top rated books", Public: settings.PublicAPI, Params: []apiParam{queryParam("format", "string", "Output format; overrides Accept (default json).", "json", "ndjson", "csv"), queryParam("genre", "string", "Only books in this genre, as listed by /api/genres."), queryParam("limit", "integer", "Page size, 1-1000 (default 100 when after is set)."), queryParam("after", "string", "Cursor from the previous page's next link."), queryParam("sort", "string", "Rank the top limit books instead: most downloaded by distinct readers, or best average rating. Can't be combined with after or genre.", "popular", "top_rated"), queryParam("days", "integer", "With sort=popular, count downloads from this many days back, 1-3650 (default 90).")}, Response: []database.Book{}, Errors: []int{400}},
+	{Method: "GET", Path: "/api/genres", Tag: "books", Summary: "Genres in the library, mapped from EPUB subjects, with book counts", Public: settings.PublicAPI, Response: genresPayload{}},
+	{Method: "GET", Path: "/covers/{id}.jpg", Tag: "books", Summary: "Cached cover image, with an ETag; cacheable for a year when v matches the current cover", Public: settings.PublicCovers, Params: []apiParam{bookIDParam, queryParam("v", "string", "Cover version from a feed's cover link.")}, ContentType: "image/jpeg", Errors: []int{404}},
+	{Method: "GET", Path: "/download/{id}", Tag: "books", Summary: "Download the book, as EPUB by default; a format that must be converted first returns 202 with the queued job, and a user past their download quota gets 429, and a book whose library is unavailable gets 503", Public: settings.PublicDownloads, Params: []apiParam{bookIDParam, queryParam("format", "string", "Download format (default epub).", "epub", "kepub", "azw3", "mobi", "pdf")}, ContentType: "application/epub+zip", Errors: []int{404, 406, 429, 503}},
+	{Method: "GET", Path: "/api/openlibrary/search", Tag: "metadata", Summary: "Search Open Library, Google Books, Hardcover, and Douban for metadata, with series and author details from Wikidata, best matches first; 503 in offline mode", Public: settings.PublicAPI, Params: []apiParam{
+		queryParam("q", "string", "Free-text query."),
+		queryParam("isbn", "string", "ISBN-10 or ISBN-13."),
+		queryParam("title", "string", "Title, used when q is empty."),
+		queryParam("author", "string", "Author, used when q is empty."),
+		queryParam("book_id", "integer", "Score and order results by how well they match this book."),
+	}, Response: metadataSearchPayload{}, Errors: []int{400, 429, 503}},
+
+	{Method: "GET", Path: "/api/books/{id}", Tag: "books", Summary: "Get a book with its subjects, genres, and the most similar books in the library", Public: settings.PublicAPI, Params: []apiParam{bookIDParam}, Response: bookDetailPayload{}, Errors: []int{404}},
+	{Method: "GET", Path: "/api/books/{id}/similar", Tag: "books", Summary: "Rank other books by shared series, author, subjects, and description keywords", Public: settings.PublicAPI, Params: []apiParam{bookIDParam, queryParam("limit", "integer", "Maximum results, 1-50 (default 10).")}, Response: similarPayload{}, Errors: []int{400, 404}},
+	{Method: "GET", Path: "/api/books/{id}/preview", Tag: "books", Summary: "First chapter, or the first N% of the book, as sanitized HTML", Public: settings.PublicDownloads, Params: []apiParam{bookIDParam, queryParam("percent", "integer", "Return leading spine items up to this percentage (1-100) instead of the first chapter.")}, Response: previewPayload{}, Errors: []int{400, 404, 422, 429}},
+	{Method: "GET", Path: "/api/books/{id}/metadata/live", Tag: "metadata", Summary: "Read metadata from the EPUB file", Scope: scopeMetadata, Params: []apiParam{bookIDParam}, Response: scanner.EPUBMetadata{}, Errors: []int{404}},
+	{Method: "GET", Path: "/api/books/{id}/validate", Tag: "metadata", Summary: "Check the EPUB's structure: zip integrity, container and package documents, manifest, spine, and internal links", Scope: scopeMetadata, Params: []apiParam{bookIDParam}, Response: epubcheck.Report{}, Errors: []int{404}},
+	{Method: "PUT", Path: "/api/books/{id}/metadata", Tag: "metadata", Summary: "Write metadata to the EPUB and catalog", Scope: scopeMetadata, Params: []apiParam{bookIDParam}, Request: metadataRequest{}, Response: bookMetadataPayload{}, Errors: []int{400, 404, 409}},
+	{Method: "GET", Path: "/api/books/{id}/covers/candidates", Tag: "covers", Summary: "Images inside the EPUB that could be the cover", Scope: scopeMetadata, Params: []apiParam{bookIDParam}, Response: coverCandidatesPayload{}, Errors: []int{404}},
+	{Method: "GET", Path: "/api/books/{id}/covers/online", Tag: "covers", Summary: "Cover candidates from online sources, searched in parallel for up to 15 seconds; with Accept: application/x-ndjson, streamed one per line as each is found; 503 in offline mode", Scope: scopeMetadata, Params: []apiParam{bookIDParam}, Response: coverCandidatesPayload{}, Errors: []int{404, 429, 503}},
+	{Method: "GET", Path: "/api/covers/proxy", Tag: "covers", Summary: "Fetch a remote cover candidate through the server, cached in the lookup cache; 503 in offline mode", Scope: scopeMetadata, Params: []apiParam{queryParam("url", "string", "Image URL on an allowed cover host.")}, ContentType: "image/jpeg", Errors: []int{400, 502, 503}},
+	{Method: "GET", Path: "/api/books/{id}/covers/candidates/{key}", Tag: "covers", Summary: "Preview an in-EPUB cover candidate", Scope: scopeMetadata, Params: []apiParam{bookIDParam, {Name: "key", In: "path", Type: "string", Description: "Candidate key from the candidates list."}}, ContentType: "image/*", Errors: []int{404}},
+	{Method: "PUT", Path: "/api/books/{id}/cover", Tag: "covers", Summary: "Replace the cover", Scope: scopeMetadata, Params: []apiParam{bookIDParam}, Request: updateCoverRequest{}, Response: coverUpdatePayload{}, Errors: []int{400, 404, 503}},
+
+	{Method: "GET", Path: "/api/books/{id}/history", Tag: "history", Summary: "Metadata and cover change history", Scope: scopeMetadata, Params: []apiParam{bookIDParam, queryParam("limit", "integer", "Maximum entries (default 100).")}, Response: bookHistoryPayload{}, Errors: []int{404}},
+	{Method: "GET", Path: "/api/books/{id}/adult", Tag: "books", Summary: "Whether a book is flagged as adult content, by its subjects or an admin", Scope: scopeAdmin, Params: []apiParam{bookIDParam}, Response: adultPayload{}, Errors: []int{404}},
+	{Method: "PUT", Path: "/api/books/{id}/adult", Tag: "books", Summary: "Flag or unflag a book as adult content regardless of its subjects; null lets the subjects decide again", Scope: scopeAdmin, Params: []apiParam{bookIDParam}, Request: adultRequest{}, Response: adultPayload{}, Errors: []int{400, 404}},
+	{Method: "GET", Path: "/api/books/{id}/history/{entryID}/cover", Tag: "history", Summary: "Cover image recorded in a history entry", Scope: scopeMetadata, Params: []apiParam{bookIDParam, entryIDParam, queryParam("version", "string", "Which side of the change to show.", "before", "after")}, ContentType: "image/jpeg", Errors: []int{404}},
+	{Method: "POST", Path: "/api/books/{id}/history/{entryID}/revert", Tag: "history", Summary: "Revert a recorded change", Scope: scopeMetadata, Params: []apiParam{bookIDParam, entryIDParam}, Response: revertPayload{}, Errors: []int{400, 404, 409}},
+
+	{Method: "POST", Path: "/api/admin/rescan", Tag: "admin", Summary: "Queue an incremental scan", Scope: scopeAdmin, Response: rebuildStatus{}, Status: 202, Errors: []int{409}},
+	{Method: "POST", Path: "/api/admin/rebuild", Tag: "admin", Summary: "Queue a full rebuild", Scope: scopeAdmin, Response: rebuildStatus{}, Status: 202, Errors: []int{409}},
+	{Method: "GET", Path: "/api/admin/rebuild/status", Tag: "admin", Summary: "Status of the latest scan, and whether the library is available to scan", Scope: scopeAdmin, Response: rebuildStatus{}},
+	{Method: "POST", Path: "/api/admin/backup", Tag: "admin", Summary: "Queue a database backup", Scope: scopeAdmin, Response: database.Job{}, Status: 202, Errors: []int{409}},
+	{Method: "POST", Path: "/api/admin/integrity", Tag: "admin", Summary: "Queue a check that re-hashes every book file against the hash recorded when it was indexed", Scope: scopeAdmin, Response: database.Job{}, Status: 202, Errors: []int{409}},
+	{Method: "GET", Path: "/api/admin/integrity", Tag: "admin", Summary: "Book files the last integrity check found missing, changed, or unreadable, with the latest check's job", Scope: scopeAdmin, Response: integrityReport{}},
+	{Method: "POST", Path: "/api/admin/purge", Tag: "admin", Summary: "Queue a purge of books whose files have been missing for longer than missing_retention_days, with their cached covers", Scope: scopeAdmin, Response: database.Job{}, Status: 202, Errors: []int{400, 409}},
+	{Method: "POST", Path: "/api/admin/metadata/fetch", Tag: "admin", Summary: "Queue a lookup that fills in missing metadata from each book's auto-apply candidate, for the listed books or every book without a description", Scope: scopeAdmin, Request: metadataFetchRequest{}, Response: database.Job{}, Status: 202, Errors: []int{400, 409, 503}},
+	{Method: "POST", Path: "/api/admin/organize", Tag: "admin", Summary: "Queue a job that moves every book into the layout ORGANIZE_TEMPLATE describes, journaled for gopds organize -undo", Scope: scopeAdmin, Request: organizeRequest{}, Response: database.Job{}, Status: 202, Errors: []int{400, 409}},
+	{Method: "GET", Path: "/api/admin/quality", Tag: "admin", Summary: "Metadata problems across the library, most common first: unknown authors, missing descriptions, covers, and ISBNs, titles that look like file names, and duplicate titles, each with links to the affected books", Scope: scopeAdmin, Params: []apiParam{queryParam("problem", "string", "Only this problem.", qualityUnknownAuthor, qualityMissingDescription, qualityMissingCover, qualityMissingISBN, qualitySuspiciousTitle, qualityDuplicateTitle), queryParam("limit", "integer", "Books listed per problem, 0-5000 (default 100); counts cover every book.")}, Response: qualityPayload{}, Errors: []int{400}},
+	{Method: "GET", Path: "/api/admin/authors/duplicates", Tag: "admin", Summary: "Groups of author spellings that look like the same person, each with a suggested canonical name", Scope: scopeAdmin, Params: []apiParam{queryParam("min_score", "number", "How alike spellings must be to be grouped, 0.5-1 (default 0.88).")}, Response: authorDuplicatesPayload{}, Errors: []int{400}},
+	{Method: "POST", Path: "/api/admin/authors/merge", Tag: "admin", Summary: "Rename every book by one of the variant spellings to the canonical author name, in the catalog only", Scope: scopeAdmin, Request: authorMergeRequest{}, Response: database.AuthorMerge{}, Status: 201, Errors: []int{400, 404}},
+	{Method: "GET", Path: "/api/admin/authors/merges", Tag: "admin", Summary: "Recent author merges, newest first", Scope: scopeAdmin, Response: authorMergesPayload{}},
+	{Method: "POST", Path: "/api/admin/authors/merges/{mergeID}/undo", Tag: "admin", Summary: "Give the books a merge renamed their previous authors back, skipping books renamed again since", Scope: scopeAdmin, Params: []apiParam{mergeIDParam}, Response: authorMergeUndoPayload{}, Errors: []int{400, 404, 409}},
+	{Method: "GET", Path: "/api/admin/logs", Tag: "admin", Summary: "Recent log output", Scope: scopeAdmin, Params: []apiParam{
+		queryParam("level", "string", "Minimum severity.", "debug", "info", "warn", "error"),
+		queryParam("since", "string", "RFC3339 timestamp or a duration such as 15m."),
+		queryParam("limit", "integer", "Maximum entries (default 500)."),
+	}, Response: logsPayload{}, Errors: []int{400}},
+	{Method: "GET", Path: "/api/admin/providers", Tag: "admin", Summary: "Metadata provider keys, quotas, and today's usage", Scope: scopeAdmin, Response: providersPayload{}},
+	{Method: "GET", Path: "/api/admin/lookup-cache", Tag: "admin", Summary: "Size of the metadata lookup cache", Scope: scopeAdmin, Response: lookupCachePayload{}},
+	{Method: "DELETE", Path: "/api/admin/lookup-cache", Tag: "admin", Summary: "Empty the metadata lookup cache", Scope: scopeAdmin, Response: lookupCachePayload{}},
+	{Method: "GET", Path: "/api/admin/diagnostics", Tag: "admin", Summary: "Check folders, database, and DNS", Scope: scopeAdmin, Response: diagnostics.Report{}},
+	{Method: "GET", Path: "/api/export", Tag: "admin", Summary: "Stream the catalog", Scope: scopeAdmin, Params: []apiParam{queryParam("format", "string", "Output format (default json).", "json", "ndjson", "csv")}, Response: []database.Book{}, Errors: []int{400}},
+	{Method: "POST", Path: "/api/import/metadata", Tag: "admin", Summary: "Apply metadata corrections from CSV", Scope: scopeAdmin, Params: []apiParam{
+		queryParam("write_epub", "boolean", "Also rewrite each EPUB."),
+		queryParam("dry_run", "boolean", "Report changes without applying them."),
+	}, RequestType: "text/csv", Response: importSummary{}, Errors: []int{400, 413}},
+
+	{Method: "GET", Path: "/api/jobs", Tag: "jobs", Summary: "List background jobs", Scope: scopeAdmin, Params: []apiParam{
+		queryParam("type", "string", "Filter by job type."),
+		queryParam("status", "string", "Filter by status.", "queued", "running", "completed", "failed", "cancelled"),
+		queryParam("limit", "integer", "Maximum jobs (default 100)."),
+	}, Response: jobsPayload{}},
+	{Method: "GET", Path: "/api/activity", Tag: "jobs", Summary: "Recent library events, newest first: books added or removed, metadata and cover changes, and finished scans, each with the payload webhooks receive; a Link header points to the next page", Scope: scopeAdmin, Params: []apiParam{
+		queryParam("event", "string", "Only this event.", activityEvents...),
+		queryParam("book", "integer", "Only events about this book."),
+		queryParam("before", "integer", "Only events older than this activity ID, from the previous page's next link."),
+		queryParam("limit", "integer", "Page size, 1-500 (default 50)."),
+	}, Response: activityPayload{}, Errors: []int{400}},
+	{Method: "GET", Path: "/api/jobs/{jobID}", Tag: "jobs", Summary: "Get a job", Scope: scopeAdmin, Params: []apiParam{jobIDParam}, Response: database.Job{}, Errors: []int{404}},
+	{Method: "GET", Path: "/api/admin/tokens", Tag: "tokens", Summary: "List API tokens", Scope: scopeAdmin, Response: tokensPayload{}},
+	{Method: "POST", Path: "/api/admin/tokens", Tag: "tokens", Summary: "Create an API token; the secret is only returned once", Scope: scopeAdmin, Request: createTokenRequest{}, Response: createTokenPayload{}, Status: 201, Errors: []int{400}},
+	{Method: "DELETE", Path: "/api/admin/tokens/{tokenID}", Tag: "tokens", Summary: "Revoke an API token", Scope: scopeAdmin, Params: []apiParam{pathParam("tokenID", "Token ID.")}, Status: 204, Errors: []int{404}},
+	{Method: "GET", Path: "/api/shelves", Tag: "shelves", Summary: "List your shelves", Scope: scopeOPDS, Response: shelvesPayload{}},
+	{Method: "POST", Path: "/api/shelves", Tag: "shelves", Summary: "Create a shelf", Scope: scopeOPDS, Request: shelfRequest{}, Response: database.Shelf{}, Status: 201, Errors: []int{400, 409}},
+	{Method: "GET", Path: "/api/shelves/{shelfID}", Tag: "shelves", Summary: "Get a shelf and its books in shelf order", Scope: scopeOPDS, Params: []apiParam{shelfIDParam}, Response: shelfPayload{}, Errors: []int{404}},
+	{Method: "PATCH", Path: "/api/shelves/{shelfID}", Tag: "shelves", Summary: "Rename a shelf or change its description", Scope: scopeOPDS, Params: []apiParam{shelfIDParam}, Request: shelfRequest{}, Response: shelfPayload{}, Errors: []int{400, 404, 409}},
+	{Method: "DELETE", Path: "/api/shelves/{shelfID}", Tag: "shelves", Summary: "Delete a shelf (the books stay in the library)", Scope: scopeOPDS, Params: []apiParam{shelfIDParam}, Status: 204, Errors: []int{404}},
+	{Method: "PUT", Path: "/api/shelves/{shelfID}/books/{id}", Tag: "shelves", Summary: "Add a book to the end of a shelf", Scope: scopeOPDS, Params: []apiParam{shelfIDParam, bookIDParam}, Response: shelfPayload{}, Errors: []int{404}},
+	{Method: "DELETE", Path: "/api/shelves/{shelfID}/books/{id}", Tag: "shelves", Summary: "Remove a book from a shelf", Scope: scopeOPDS, Params: []apiParam{shelfIDParam, bookIDParam}, Response: shelfPayload{}, Errors: []int{400, 404}},
+	{Method: "PUT", Path: "/api/shelves/{shelfID}/order", Tag: "shelves", Summary: "Move the listed books to the front of a shelf in the given order", Scope: scopeOPDS, Params: []apiParam{shelfIDParam}, Request: reorderShelfRequest{}, Response: shelfPayload{}, Errors: []int{400, 404}},
+	{Method: "GET", Path: "/api/annotations", Tag: "annotations", Summary: "List or export your highlights and notes, grouped by book in reading order", Scope: scopeOPDS, Params: []apiParam{queryParam("book", "integer", "Only this book's annotations."), queryParam("format", "string", "json (default), or markdown to download a Markdown file.", "json", "markdown")}, Response: annotationsPayload{}, Errors: []int{400}},
+	{Method: "PATCH", Path: "/api/annotations/{annotationID}", Tag: "annotations", Summary: "Replace an annotation's locator, chapter, text, note, and color", Scope: scopeOPDS, Params: []apiParam{annotationIDParam}, Request: annotationRequest{}, Response: database.Annotation{}, Errors: []int{400, 404}},
+	{Method: "DELETE", Path: "/api/annotations/{annotationID}", Tag: "annotations", Summary: "Delete an annotation", Scope: scopeOPDS, Params: []apiParam{annotationIDParam}, Status: 204, Errors: []int{400, 404}},
+	{Method: "GET", Path: "/api/books/{id}/annotations", Tag: "annotations", Summary: "Your highlights and notes in a book", Scope: scopeOPDS, Params: []apiParam{bookIDParam}, Response: annotationsPayload{}, Errors: []int{404}},
+	{Method: "POST", Path: "/api/books/{id}/annotations", Tag: "annotations", Summary: "Add a highlight or note to a book", Scope: scopeOPDS, Params: []apiParam{bookIDParam}, Request: annotationRequest{}, Response: database.Annotation{}, Status: 201, Errors: []int{400, 404}},
+	{Method: "POST", Path: "/api/books/{id}/annotations/import", Tag: "annotations", Summary: "Import highlights and notes from a KOReader JSON export, skipping ones already imported", Scope: scopeOPDS, Params: []apiParam{bookIDParam}, Response: annotationImportPayload{}, Errors: []int{400, 404}},
+	{Method: "GET", Path: "/api/books/{id}/rating", Tag: "books", Summary: "A book's average star rating, how many people rated it, and your own rating", Scope: scopeOPDS, Params: []apiParam{bookIDParam}, Response: database.BookRating{}, Errors: []int{404}},
+	{Method: "PUT", Path: "/api/books/{id}/rating", Tag: "books", Summary: "Rate a book from 1 to 5 stars, replacing your earlier rating", Scope: scopeOPDS, Params: []apiParam{bookIDParam}, Request: ratingRequest{}, Response: database.BookRating{}, Errors: []int{400, 404}},
+	{Method: "DELETE", Path: "/api/books/{id}/rating", Tag: "books", Summary: "Withdraw your rating of a book", Scope: scopeOPDS, Params: []apiParam{bookIDParam}, Response: database.BookRating{}, Errors: []int{404}},
+	{Method: "GET", Path: "/api/digest", Tag: "digests", Summary: "Your subscription to the email digest of new books", Scope: scopeOPDS, Response: database.DigestSubscription{}, Errors: []int{404}},
+	{Method: "PUT", Path: "/api/digest", Tag: "digests", Summary: "Subscribe to a daily or weekly email of new books, sent to your account's address; links in it use the address of this request", Scope: scopeOPDS, Request: digestRequest{}, Response: database.DigestSubscription{}, Errors: []int{400, 503}},
+	{Method: "DELETE", Path: "/api/digest", Tag: "digests", Summary: "Stop the email digest", Scope: scopeOPDS, Status: 204, Errors: []int{404}},
+	{Method: "GET", Path: "/api/digest/unsubscribe", Tag: "digests", Summary: "Page asking to confirm stopping an email digest, from the link at the bottom of it", Params: []apiParam{queryParam("token", "string", "Token from the unsubscribe link.")}, ContentType: "text/html", Errors: []int{400, 429}},
+	{Method: "POST", Path: "/api/digest/unsubscribe", Tag: "digests", Summary: "Stop an email digest without signing in", Params: []apiParam{queryParam("token", "string", "Token from the unsubscribe link.")}, ContentType: "text/plain", Errors: []int{400, 404, 429}},
+	{Method: "POST", Path: "/users/create", Tag: "koreader", Summary: "KOReader sync registration; always refused because accounts come from the gopds configuration", Errors: []int{402, 429}},
+	{Method: "GET", Path: "/users/auth", Tag: "koreader", Summary: "Check KOReader sync credentials (x-auth-user, x-auth-key = MD5 of the password)", Response: kosyncAuthPayload{}, Errors: []int{401, 429}},
+	{Method: "PUT", Path: "/syncs/progress", Tag: "koreader", Summary: "Store a KOReader reading position (x-auth-user / x-auth-key headers)", Request: kosyncProgressRequest{}, Response: kosyncUpdatePayload{}, Errors: []int{401, 403}},
+	{Method: "GET", Path: "/syncs/progress/{document}", Tag: "koreader", Summary: "Fetch the stored KOReader position for a document; {} if there is none", Params: []apiParam{{Name: "document", In: "path", Type: "string", Description: "KOReader document ID (partial MD5 of the file)."}}, Response: kosyncProgressPayload{}, Errors: []int{401, 403}},
+	{Method: "GET", Path: "/api/admin/users", Tag: "users", Summary: "List user accounts", Scope: scopeAdmin, Response: usersPayload{}},
+	{Method: "POST", Path: "/api/admin/users", Tag: "users", Summary: "Create a user account", Scope: scopeAdmin, Request: createUserRequest{}, Response: database.User{}, Status: 201, Errors: []int{400, 409}},
+	{Method: "PATCH", Path: "/api/admin/users/{userID}", Tag: "users", Summary: "Change a user's role, password, email, categories, adult-content filter, or download quota; a new password signs out their sessions", Scope: scopeAdmin, Params: []apiParam{userIDParam}, Request: updateUserRequest{}, Response: database.User{}, Errors: []int{400, 404, 409}},
+	{Method: "POST", Path: "/api/admin/users/{userID}/password-reset", Tag: "users", Summary: "Issue a one-time password reset link, emailed to the user when SMTP is configured", Scope: scopeAdmin, Params: []apiParam{userIDParam}, Response: passwordResetPayload{}, Errors: []int{404}},
+	{Method: "DELETE", Path: "/api/admin/users/{userID}", Tag: "users", Summary: "Delete a user account; the last admin cannot be deleted", Scope: scopeAdmin, Params: []apiParam{userIDParam}, Status: 204, Errors: []int{404, 409}},
+	{Method: "GET", Path: "/api/admin/invites", Tag: "users", Summary: "List invites, including used and expired ones", Scope: scopeAdmin, Response: invitesPayload{}},
+	{Method: "POST", Path: "/api/admin/invites", Tag: "users", Summary: "Create a one-time signup link with a preset role, emailed when SMTP is configured", Scope: scopeAdmin, Request: createInviteRequest{}, Response: inviteCreatedPayload{}, Status: 201, Errors: []int{400}},
+	{Method: "DELETE", Path: "/api/admin/invites/{inviteID}", Tag: "users", Summary: "Revoke an invite", Scope: scopeAdmin, Params: []apiParam{pathParam("inviteID", "Invite ID.")}, Status: 204, Errors: []int{400, 404}},
+	{Method: "GET", Path: "/api/admin/settings", Tag: "settings", Summary: "List runtime settings with their effective values and sources", Scope: scopeAdmin, Response: settingsPayload{}},
+	{Method: "PUT", Path: "/api/admin/settings", Tag: "settings", Summary: "Override settings by key; null restores the environment or default value", Scope: scopeAdmin, Request: updateSettingsRequest{}, Response: settingsPayload{}, Errors: []int{400}},
+	{Method: "GET", Path: "/api/admin/webhooks", Tag: "webhooks", Summary: "List webhooks and the events they can subscribe to", Scope: scopeAdmin, Response: webhooksPayload{}},
+	{Method: "POST", Path: "/api/admin/webhooks", Tag: "webhooks", Summary: "Create a webhook; the signing secret is only returned once", Scope: scopeAdmin, Request: createWebhookRequest{}, Response: createWebhookPayload{}, Status: 201, Errors: []int{400}},
+	{Method: "PATCH", Path: "/api/admin/webhooks/{webhookID}", Tag: "webhooks", Summary: "Enable or disable a webhook", Scope: scopeAdmin, Params: []apiParam{webhookIDPathParam}, Request: updateWebhookRequest{}, Response: database.Webhook{}, Errors: []int{400, 404}},
+	{Method: "DELETE", Path: "/api/admin/webhooks/{webhookID}", Tag: "webhooks", Summary: "Delete a webhook", Scope: scopeAdmin, Params: []apiParam{webhookIDPathParam}, Status: 204, Errors: []int{404}},
+	{Method: "POST", Path: "/api/admin/webhooks/{webhookID}/test", Tag: "webhooks", Summary: "Send a signed ping to a webhook and report the result", Scope: scopeAdmin, Params: []apiParam{webhookIDPathParam}, Response: webhookTestPayload{}, Errors: []int{404}},
+	{Method: "POST", Path: "/api/jobs/{jobID}/cancel", Tag: "jobs", Summary: "Cancel a queued or running job", Scope: scopeAdmin, Params: []apiParam{jobIDParam}, Response: database.Job{}, Errors: []int{404, 409}},
+}
+
+var (
+	openAPIOnce sync.Once
+	openAPIDoc  []byte
+)
+
+// HandleOpenAPI serves the OpenAPI 3 description of the REST API.
+func (s *Server) HandleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	openAPIOnce.Do(func() {
+		openAPIDoc, _ = json.MarshalIndent(buildOpenAPI(apiOperations), "", "  ")
+	})
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(openAPIDoc)
+}
+
+// HandleAPIDocs serves a Swagger UI page for /api/openapi.json. The UI
+// assets load from the unpkg CDN.
+func (s *Server) HandleAPIDocs(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_, _ = w.Write([]byte(swaggerUIPage))
+}
+
+const swaggerUIPage = `<!doctype html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>GoPDS API</title>
+<link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@5/swagger-ui.css">
+</head>
+<body>
+<div id="swagger-ui"></div>
+<script src="https://unpkg.com/swagger-ui-dist@5/swagger-ui-bundle.js" crossorigin></script>
+<script>
+window.ui = SwaggerUIBundle({ url: "/api/openapi.json", dom_id: "#swagger-ui", withCredentials: true });
+</script>
+</body>
+</html>
+`
+
+type jsonObject = map[string]any
+
+func buildOpenAPI(ops []apiOperation) jsonObject {
+	schemas := jsonObject{}
+	gen := &schemaGen{components: schemas}
+
+	paths := jsonObject{}
+	for _, op := range ops {
+		item, _ := paths[op.Path].(jsonObject)
+		if item == nil {
+			item = jsonObject{}
+			paths[op.Path] = item
+		}
+		item[strings.ToLower(op.Method)] = gen.operation(op)
+	}
+
+	return jsonObject{
+		"openapi": "3.0.3",
+		"info": jsonObject{
+			"title":       "GoPDS API",
+			"version":     "1",
+			"description": "REST API for the GoPDS EPUB server. Protected routes accept the gopds_session cookie from POST /api/auth/login or an `Authorization: Bearer` API token.",
+		},
+		"paths": paths,
+		"components": jsonObject{
+			"schemas": schemas,
+			"securitySchemes": jsonObject{
+				"session": jsonObject{"type": "apiKey", "in": "cookie", "name": sessionCookieName},
+				"bearer":  jsonObject{"type": "http", "scheme": "bearer", "description": "API token from POST /api/admin/tokens."},
+			},
+		},
+	}
+}
+
+func (g *schemaGen) operation(op apiOperation) jsonObject {
+	out := jsonObject{
+		"summary":     op.Summary,
+		"tags":        []string{op.Tag},
+		"operationId": operationID(op),
+	}
+	if op.Scope != "" {
+		out["security"] = []jsonObject{{"session": []string{}}, {"bearer": []string{}}}
+		out["description"] = "Requires a session whose role grants the `" + op.Scope + "` scope (" + strings.Join(rolesGranting(op.Scope), ", ") + "), or a bearer token with it."
+	}
+	if op.Public != "" {
+		out["security"] = []jsonObject{{}, {"session": []string{}}, {"bearer": []string{}}}
+		out["description"] = "Anonymous while the `" + op.Public + "` setting is on; otherwise requires a signed-in user or a bearer token with the `" + scopeOPDS + "` scope."
+	}
+
+	params := make([]jsonObject, 0, len(op.Params))
+	for _, p := range op.Params {
+		schema := jsonObject{"type": p.Type}
+		if len(p.Enum) > 0 {
+			schema["enum"] = p.Enum
+		}
+		params = append(params, jsonObject{
+			"name":        p.Name,
+			"in":          p.In,
+			"required":    p.In == "path",
+			"description": p.Description,
+			"schema":      schema,
+		})
+	}
+	if len(params) > 0 {
+		out["parameters"] = params
+	}
+
+	switch {
+	case op.Request != nil:
+		out["requestBody"] = jsonObject{
+			"required": true,
+			"content":  jsonObject{"application/json": jsonObject{"schema": g.schemaFor(reflect.TypeOf(op.Request))}},
+		}
+	case op.RequestType != "":
+		out["requestBody"] = jsonObject{
+			"required": true,
+			"content":  jsonObject{op.RequestType: jsonObject{"schema": jsonObject{"type": "string", "format": "binary"}}},
+		}
+	}
+
+	status := op.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	success := jsonObject{"description": http.StatusText(status)}
+	switch {
+	case op.Response != nil:
+		success["content"] = jsonObject{"application/json": jsonObject{"schema": g.schemaFor(reflect.TypeOf(op.Response))}}
+	case op.ContentType != "":
+		success["content"] = jsonObject{op.ContentType: jsonObject{"schema": jsonObject{"type": "string", "format": "binary"}}}
+	}
+	responses := jsonObject{strconv.Itoa(status): success}
+	if op.Public != "" {
+		responses["401"] = jsonObject{"description": http.StatusText(http.StatusUnauthorized)}
+	}
+	if op.Scope != "" {
+		responses["403"] = jsonObject{"description": "Token lacks the required scope"}
+		responses["401"] = jsonObject{"description": http.StatusText(http.StatusUnauthorized)}
+	}
+	for _, code := range op.Errors {
+		responses[strconv.Itoa(code)] = jsonObject{"description": http.StatusText(code)}
+	}
+	out["responses"] = responses
+	return out
+}
+
+func operationID(op apiOperation) string {
+	var b strings.Builder
+	b.WriteString(strings.ToLower(op.Method))
+	for _, part := range strings.FieldsFunc(op.Path, func(r rune) bool { return r == '/' || r == '.' || r == '{' || r == '}' }) {
+		for _, word := range strings.FieldsFunc(part, func(r rune) bool { return r == '-' || r == '_' }) {
+			b.WriteString(strings.ToUpper(word[:1]) + word[1:])
+		}
+	}
+	return b.String()
+}
+
+// schemaGen converts Go types to OpenAPI schemas. Named structs become
+// components and are referenced by $ref; everything else is inlined.
+type schemaGen struct {
+	components jsonObject
+}
+
+var (
+	timeType = reflect.TypeOf(time.Time{})
+	rawType  = reflect.TypeOf(json.RawMessage{})
+)
+
+func (g *schemaGen) schemaFor(t reflect.Type) jsonObject {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch t {
+	case timeType:
+		return jsonObject{"type": "string", "format": "date-time"}
+	case rawType:
+		return jsonObject{"description": "Arbitrary JSON."}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return jsonObject{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return jsonObject{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return jsonObject{"type": "number"}
+	case reflect.String:
+		return jsonObject{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return jsonObject{"type": "array", "items": g.schemaFor(t.Elem())}
+	case reflect.Map:
+		return jsonObject{"type": "object", "additionalProperties": g.schemaFor(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return g.structSchema(t)
+		}
+		name := schemaName(t)
+		if _, ok := g.components[name]; !ok {
+			g.components[name] = jsonObject{} // placeholder guards recursion
+			g.components[name] = g.structSchema(t)
+		}
+		return jsonObject{"$ref": "#/components/schemas/" + name}
+	default:
+		return jsonObject{}
+	}
+}
+
+func (g *schemaGen) structSchema(t reflect.Type) jsonObject {
+	props := jsonObject{}
+	g.addFields(t, props)
+	return jsonObject{"type": "object", "properties": props}
+}
+
+// addFields collects JSON-visible fields, flattening embedded structs the way
+// encoding/json does.
+func (g *schemaGen) addFields(t reflect.Type, props jsonObject) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, _, _ := strings.Cut(tag, ",")
+		if f.Anonymous && name == "" {
+			ft := f.Type
+			for ft.Kind() == reflect.Pointer {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				g.addFields(ft, props)
+				continue
+			}
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		props[name] = g.schemaFor(f.Type)
+	}
+}
+
+// schemaNameOverrides renames types whose bare name is too vague to stand
+// alone in the components list.
+var schemaNameOverrides = map[reflect.Type]string{
+	reflect.TypeOf(logging.Entry{}): "LogEntry",
+}
+
+// schemaName turns web.coverCandidate into CoverCandidate and
+// database.Book into Book.
+func schemaName(t reflect.Type) string {
+	if name, ok := schemaNameOverrides[t]; ok {
+		return name
+	}
+	name := t.Name()
+	return strings.ToUpper(name[:1]) + name[1:]
+}
@@ -0,0 +1,155 @@
+package web
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/ab0oo/gopds/internal/database"
+	"github.com/ab0oo/gopds/internal/i18n"
+	"github.com/ab0oo/gopds/internal/jobs"
+	"github.com/ab0oo/gopds/internal/organize"
+	"github.com/ab0oo/gopds/internal/storage"
+)
+
+type organizeJobPayload struct {
+	OnConflict organize.Conflict `json:"on_conflict,omitempty"`
+}
+
+type organizeRequest struct {
+	OnConflict string `json:"on_conflict"`
+}
+
+// HandleOrganize queues an organize job, which moves every book in the
+// library into the layout ORGANIZE_TEMPLATE describes.
+func (s *Server) HandleOrganize(w http.ResponseWriter, r *http.Request) {
+	var req organizeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, i18n.T("Invalid JSON body"), http.StatusBadRequest)
+		return
+	}
+	payload := organizeJobPayload{OnConflict: organize.SkipConflicts}
+	if req.OnConflict != "" {
+		conflict, err := organize.ParseConflict(req.OnConflict)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		payload.OnConflict = conflict
+	}
+	if _, err := organize.ParseTemplate(os.Getenv("ORGANIZE_TEMPLATE")); err != nil {
+		http.Error(w, i18n.T("Invalid ORGANIZE_TEMPLATE: %v", err), http.StatusBadRequest)
+		return
+	}
+	job, err := s.jobs.EnqueueUnique(r.Context(), jobs.TypeOrganize, payload, "Organize queued.")
+	if err != nil && !errors.Is(err, jobs.ErrAlreadyActive) {
+		http.Error(w, i18n.T("Failed to queue organize: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if errors.Is(err, jobs.ErrAlreadyActive) {
+		w.WriteHeader(http.StatusConflict)
+	} else {
+		w.WriteHeader(http.StatusAccepted)
+	}
+	_ = json.NewEncoder(w).Encode(job)
+}
+
+// runOrganizeJob lays the whole library out anew, as gopds organize
+// -recursive would, and moves each book's row along with its file so the
+// book keeps its ID, cover, and reading progress. The moves are journaled
+// in the library root for gopds organize -undo.
+func (s *Server) runOrganizeJob(ctx context.Context, job *database.Job, p *jobs.Progress) error {
+	var payload organizeJobPayload
+	if err := jobs.DecodePayload(job, &payload); err != nil {
+		return fmt.Errorf("invalid organize payload: %w", err)
+	}
+	if err := s.checkLibrary(ctx); err != nil {
+		return fmt.Errorf("organize paused: %w", err)
+	}
+	// A scan running alongside would see the moved books vanish from one
+	// path and appear at another.
+	if scan, err := s.jobs.Latest(jobs.TypeScan); err == nil && scan.Active() {
+		return fmt.Errorf("a library scan (job %d) is in progress; organize again once it has finished", scan.ID)
+	}
+	tmpl, err := organize.ParseTemplate(os.Getenv("ORGANIZE_TEMPLATE"))
+	if err != nil {
+		return fmt.Errorf("invalid ORGANIZE_TEMPLATE: %w", err)
+	}
+
+	root := libraryRoot()
+	if storage.IsRemote(root) {
+		return storage.ErrReadOnly
+	}
+	p.Update("planning", "Working out where each book belongs...", 0)
+	moves, skips, err := organize.Plan(root, organize.Options{Template: tmpl, OnConflict: payload.OnConflict, Recursive: true})
+	if err != nil {
+		return fmt.Errorf("failed to plan moves: %w", err)
+	}
+	for _, skip := range skips {
+		slog.InfoContext(ctx, "organize: book left in place", "path", skip.Path, "reason", skip.Reason)
+	}
+	if len(moves) == 0 {
+		p.Update("complete", fmt.Sprintf("Organize complete. Nothing to move, %d books skipped.", len(skips)), 0)
+		return nil
+	}
+
+	journalPath := organize.JournalName(root, time.Now())
+	journal, err := organize.CreateJournal(journalPath)
+	if err != nil {
+		return fmt.Errorf("failed to create journal: %w", err)
+	}
+	defer func() {
+		if err := journal.Close(); err != nil {
+			slog.ErrorContext(ctx, "organize: failed to close journal", "path", journalPath, "err", err)
+		}
+	}()
+	p.Update("moving", fmt.Sprintf("Moving %d books...", len(moves)), 0)
+
+	moved, failed := 0, 0
+	for _, m := range moves {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		book, err := s.db.GetBookByPath(m.From)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("failed to look up %s: %w", m.From, err)
+		}
+		createdDirs, err := organize.Apply(m)
+		if err != nil {
+			slog.WarnContext(ctx, "organize: failed to move book", "from", m.From, "to", m.To, "err", err)
+			failed++
+			continue
+		}
+		if err := journal.Record(m, createdDirs); err != nil {
+			// Only moves that can be undone are kept.
+			if undoErr := organize.Undo(m, createdDirs); undoErr != nil {
+				slog.ErrorContext(ctx, "organize: book moved but not journaled", "from", m.From, "to", m.To, "err", undoErr)
+			}
+			return fmt.Errorf("failed to write journal: %w", err)
+		}
+		if book != nil {
+			if err := s.db.UpdateBookPath(book.ID, m.To); err != nil {
+				slog.ErrorContext(ctx, "organize: failed to record new path, the next scan will pick it up", "book_id", book.ID, "path", m.To, "err", err)
+			}
+		}
+		organize.RemoveEmptyDirs(root, m.From)
+		moved++
+		p.Update("moving", fmt.Sprintf("Moved %d of %d books...", moved, len(moves)), moved)
+	}
+	slog.InfoContext(ctx, "organize complete", "moved", moved, "skipped", len(skips), "failed", failed, "journal", journalPath)
+	msg := fmt.Sprintf("Organize complete. %d moved, %d skipped, %d failed.", moved, len(skips), failed)
+	if moved > 0 {
+		msg += fmt.Sprintf(" To undo: gopds organize -undo %q", journalPath)
+	}
+	p.Update("complete", msg, moved)
+	return nil
+}
@@ -0,0 +1,218 @@
+package web
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/ab0oo/gopds/internal/database"
+	"github.com/ab0oo/gopds/internal/i18n"
+)
+
+// passwordResetTTL is how long an admin-issued reset link stays valid.
+const passwordResetTTL = 24 * time.Hour
+
+type changePasswordRequest struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+type resetPasswordRequest struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+type passwordResetPayload struct {
+	// URL opens the web UI's reset form. It is also returned when emailed,
+	// so the admin can pass it on another way if the mail goes missing.
+	URL       string    `json:"url"`
+	ExpiresAt time.Time `json:"expires_at"`
+	Emailed   bool      `json:"emailed"`
+}
+
+// normalizeEmail validates an optional address; empty clears it.
+func normalizeEmail(raw string) (string, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return "", nil
+	}
+	addr, err := mail.ParseAddress(raw)
+	if err != nil {
+		return "", fmt.Errorf("Invalid email address %q", raw)
+	}
+	return addr.Address, nil
+}
+
+// generateLinkToken returns the secret for a one-time link, such as a
+// password reset or an invite.
+func generateLinkToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// requestBaseURL is the scheme and host the client used to reach the server.
+func requestBaseURL(r *http.Request) string {
+	scheme := "http"
+	if isHTTPS(r) {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+// HandleChangePassword lets a signed-in local user change their own password.
+// Their other sessions are signed out; this one stays.
+func (s *Server) HandleChangePassword(w http.ResponseWriter, r *http.Request) {
+	p, ok := s.principal(r)
+	if !ok {
+		http.Error(w, i18n.T("Unauthorized"), http.StatusUnauthorized)
+		return
+	}
+	if p.TokenID != 0 {
+		http.Error(w, i18n.T("API tokens have no password"), http.StatusForbidden)
+		return
+	}
+	var req changePasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, i18n.T("Invalid JSON body"), http.StatusBadRequest)
+		return
+	}
+	user, err := s.db.GetUserByName(p.Name)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, i18n.T("Unauthorized"), http.StatusUnauthorized)
+			return
+		}
+		http.Error(w, i18n.T("Internal Server Error"), http.StatusInternalServerError)
+		return
+	}
+	if user.Source == ldapSource || user.PasswordHash == "" {
+		http.Error(w, i18n.T("This account signs in through %s; change the password there", user.Source), http.StatusConflict)
+		return
+	}
+	if err := validatePassword(req.NewPassword); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if wait := s.loginGuard.wait(user.Username, clientIP(r)); wait > 0 {
+		refuseLogin(w, r, user.Username, wait)
+		return
+	}
+	if _, ok := s.checkPassword(r, user.Username, req.CurrentPassword); !ok {
+		s.loginFailed(r, "password_change", user.Username)
+		http.Error(w, i18n.T("Current password is incorrect"), http.StatusUnauthorized)
+		return
+	}
+
+	if !s.setPassword(w, user, req.NewPassword) {
+		return
+	}
+	var keepID int64
+	if cur, ok := s.currentSession(r); ok {
+		keepID = cur.ID
+	}
+	if _, err := s.db.DeleteOtherUserSessions(user.Username, keepID); err != nil {
+		slog.ErrorContext(r.Context(), "failed to delete sessions", "username", user.Username, "err", err)
+	}
+	slog.InfoContext(r.Context(), "user password changed", "user_id", user.ID, "username", user.Username, "by", user.Username)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// setPassword stores a new password and forgets cached credentials for it,
+// writing a 500 on failure.
+func (s *Server) setPassword(w http.ResponseWriter, user *database.User, password string) bool {
+	passwordHash, kosyncHash, err := hashPassword(password)
+	if err != nil {
+		http.Error(w, i18n.T("Failed to hash password"), http.StatusInternalServerError)
+		return false
+	}
+	if _, err := s.db.SetUserPassword(user.ID, passwordHash, kosyncHash); err != nil {
+		http.Error(w, i18n.T("Failed to update password"), http.StatusInternalServerError)
+		return false
+	}
+	s.basicCache.forget(user.Username)
+	s.loginGuard.succeed(user.Username)
+	return true
+}
+
+// HandleCreatePasswordReset issues a one-time reset link for a user, replacing
+// any earlier one, and emails it when SMTP is configured and the user has an
+// address.
+func (s *Server) HandleCreatePasswordReset(w http.ResponseWriter, r *http.Request) {
+	user, ok := s.loadUser(w, r)
+	if !ok {
+		return
+	}
+	token, err := generateLinkToken()
+	if err != nil {
+		http.Error(w, i18n.T("Failed to generate token"), http.StatusInternalServerError)
+		return
+	}
+	expiresAt := time.Now().UTC().Add(passwordResetTTL)
+	if _, err := s.db.SetUserPasswordReset(user.ID, hashAPIToken(token), expiresAt); err != nil {
+		http.Error(w, i18n.T("Failed to save reset token"), http.StatusInternalServerError)
+		return
+	}
+	payload := passwordResetPayload{
+		URL:       requestBaseURL(r) + "/#reset=" + token,
+		ExpiresAt: expiresAt,
+	}
+
+	if s.mailer.Enabled() && user.Email != "" {
+		ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+		body := fmt.Sprintf("Hello %s,\n\nA GoPDS administrator has started a password reset for your account. Open this link to choose a new password:\n\n%s\n\nThe link works once and expires at %s.\n",
+			user.Username, payload.URL, expiresAt.Format(time.RFC1123))
+		err := s.mailer.Send(ctx, user.Email, "Reset your GoPDS password", body)
+		cancel()
+		if err != nil {
+			slog.WarnContext(r.Context(), "failed to email password reset", "user_id", user.ID, "username", user.Username, "err", err)
+		} else {
+			payload.Emailed = true
+		}
+	}
+	slog.InfoContext(r.Context(), "password reset issued", "user_id", user.ID, "username", user.Username, "emailed", payload.Emailed, "by", s.actorName(r))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	_ = json.NewEncoder(w).Encode(payload)
+}
+
+// HandleResetPassword sets a new password with a reset token, then signs the
+// user out everywhere.
+func (s *Server) HandleResetPassword(w http.ResponseWriter, r *http.Request) {
+	var req resetPasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, i18n.T("Invalid JSON body"), http.StatusBadRequest)
+		return
+	}
+	if err := validatePassword(req.Password); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	user, err := s.db.GetUserByResetToken(hashAPIToken(strings.TrimSpace(req.Token)), time.Now())
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, i18n.T("Invalid or expired reset link"), http.StatusBadRequest)
+			return
+		}
+		http.Error(w, i18n.T("Internal Server Error"), http.StatusInternalServerError)
+		return
+	}
+	if !s.setPassword(w, user, req.Password) {
+		return
+	}
+	s.dropSessions(user.Username)
+	slog.InfoContext(r.Context(), "user password reset", "user_id", user.ID, "username", user.Username, "remote", clientIP(r))
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,224 @@
+package web
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"log/slog"
+	"math"
+	"math/bits"
+	"sort"
+
+	"github.com/ab0oo/gopds/internal/imaging"
+	"github.com/ab0oo/gopds/internal/scanner"
+)
+
+// nearDuplicateDistance is the largest number of differing pHash bits at
+// which two covers count as the same picture. Re-encoding, resizing, and
+// slight crops usually stay under it; a different edition's artwork lands
+// well above 20.
+const nearDuplicateDistance = 8
+
+const phashSize = 32
+
+// perceptualHash is the 64-bit DCT pHash of img: the signs of the lowest
+// 8x8 frequencies of a 32x32 greyscale thumbnail, against their median.
+// Similar-looking images get hashes a few bits apart whatever their size
+// or encoding.
+func perceptualHash(img image.Image) uint64 {
+	b := img.Bounds()
+	var px [phashSize][phashSize]float64
+	for y := 0; y < phashSize; y++ {
+		y0 := b.Min.Y + y*b.Dy()/phashSize
+		y1 := max(b.Min.Y+(y+1)*b.Dy()/phashSize, y0+1)
+		for x := 0; x < phashSize; x++ {
+			x0 := b.Min.X + x*b.Dx()/phashSize
+			x1 := max(b.Min.X+(x+1)*b.Dx()/phashSize, x0+1)
+			// Average the block rather than point-sample it, so small
+			// details don't alias.
+			var sum float64
+			var n int
+			for sy := y0; sy < y1; sy += max(1, (y1-y0)/4) {
+				for sx := x0; sx < x1; sx += max(1, (x1-x0)/4) {
+					r, g, bl, _ := img.At(sx, sy).RGBA()
+					sum += 0.299*float64(r) + 0.587*float64(g) + 0.114*float64(bl)
+					n++
+				}
+			}
+			px[y][x] = sum / float64(n)
+		}
+	}
+
+	var rows [phashSize][8]float64
+	for y := range phashSize {
+		for u := range 8 {
+			rows[y][u] = dctTerm(func(i int) float64 { return px[y][i] }, u)
+		}
+	}
+	coeffs := make([]float64, 0, 64)
+	for v := range 8 {
+		for u := range 8 {
+			coeffs = append(coeffs, dctTerm(func(i int) float64 { return rows[i][u] }, v))
+		}
+	}
+
+	// The DC term is the overall brightness; leave it out of the median.
+	sorted := append([]float64(nil), coeffs[1:]...)
+	sort.Float64s(sorted)
+	median := sorted[len(sorted)/2]
+
+	var hash uint64
+	for i, c := range coeffs {
+		if c > median {
+			hash |= 1 << uint(i)
+		}
+	}
+	return hash
+}
+
+// dctTerm is the k-th DCT-II coefficient of the phashSize values at(i).
+func dctTerm(at func(int) float64, k int) float64 {
+	var sum float64
+	for i := range phashSize {
+		sum += at(i) * math.Cos(math.Pi/phashSize*(float64(i)+0.5)*float64(k))
+	}
+	return sum
+}
+
+// coverHash decodes an image and returns its perceptual hash.
+func coverHash(body []byte) (uint64, bool) {
+	img, _, err := imaging.Decode(body)
+	if err != nil {
+		return 0, false
+	}
+	return perceptualHash(img), true
+}
+
+func hashDistance(a, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
+
+func formatHash(h uint64) string {
+	return fmt.Sprintf("%016x", h)
+}
+
+// currentCoverHash hashes the book's cached cover, if it has one.
+func currentCoverHash(bookID int) (uint64, bool) {
+	raw, err := readCover(context.Background(), bookID)
+	if err != nil {
+		return 0, false
+	}
+	return coverHash(raw)
+}
+
+// dedupeCoverCandidates hashes each candidate, keeping the first of any
+// near-identical group, so candidates should already be in order of
+// preference; the current cover is always kept. Candidates that look like
+// the current cover are marked SameAsCurrent. read returns a candidate's
+// image; ones that can't be read or decoded are kept unhashed.
+func dedupeCoverCandidates(in []coverCandidate, current uint64, hasCurrent bool, read func(coverCandidate) ([]byte, error)) []coverCandidate {
+	hashes := make([]uint64, len(in))
+	hashed := make([]bool, len(in))
+	for i, c := range in {
+		body, err := read(c)
+		if err != nil {
+			slog.Debug("cover hash: candidate unreadable", "key", c.Key, "err", err)
+			continue
+		}
+		hashes[i], hashed[i] = coverHash(body)
+	}
+
+	// The current cover claims its group first, whatever its position.
+	order := make([]int, 0, len(in))
+	for i, c := range in {
+		if c.IsCurrent {
+			order = append(order, i)
+		}
+	}
+	for i, c := range in {
+		if !c.IsCurrent {
+			order = append(order, i)
+		}
+	}
+
+	keep := make([]bool, len(in))
+	var kept []uint64
+	for _, i := range order {
+		if !hashed[i] {
+			keep[i] = true
+			continue
+		}
+		dup := false
+		for _, k := range kept {
+			if hashDistance(hashes[i], k) <= nearDuplicateDistance {
+				dup = true
+				break
+			}
+		}
+		if dup && !in[i].IsCurrent {
+			continue
+		}
+		keep[i] = true
+		kept = append(kept, hashes[i])
+	}
+
+	out := make([]coverCandidate, 0, len(in))
+	for i, c := range in {
+		if !keep[i] {
+			continue
+		}
+		if hashed[i] {
+			c.Hash = formatHash(hashes[i])
+			c.SameAsCurrent = !c.IsCurrent && hasCurrent && hashDistance(hashes[i], current) <= nearDuplicateDistance
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+// coverDeduper is dedupeCoverCandidates for candidates that arrive one at
+// a time, such as a streamed online search: each is kept unless it looks
+// like one kept before it.
+type coverDeduper struct {
+	current    uint64
+	hasCurrent bool
+	kept       []uint64
+}
+
+// add hashes c's image, if there is one, marks c as dedupeCoverCandidates
+// would, and reports whether it should be kept.
+func (d *coverDeduper) add(c *coverCandidate, body []byte) bool {
+	if body == nil {
+		return true
+	}
+	h, ok := coverHash(body)
+	if !ok {
+		return true
+	}
+	for _, k := range d.kept {
+		if hashDistance(h, k) <= nearDuplicateDistance {
+			return false
+		}
+	}
+	d.kept = append(d.kept, h)
+	c.Hash = formatHash(h)
+	c.SameAsCurrent = d.hasCurrent && hashDistance(h, d.current) <= nearDuplicateDistance
+	return true
+}
+
+// readCoverCandidate returns a candidate's image, from the open EPUB or
+// the remote host.
+func (s *Server) readCoverCandidate(epub *scanner.EPUB) func(coverCandidate) ([]byte, error) {
+	return func(c coverCandidate) ([]byte, error) {
+		if c.Remote {
+			body, _, err := s.remoteCoverImage(c.ImageURL)
+			return body, err
+		}
+		zipPath, err := decodeCoverKey(c.Key)
+		if err != nil {
+			return nil, err
+		}
+		body, _, err := epub.ReadCoverOption(zipPath)
+		return body, err
+	}
+}
@@ -0,0 +1,201 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/ab0oo/gopds/internal/database"
+	"github.com/ab0oo/gopds/internal/i18n"
+)
+
+// popularDays is how far back downloads count towards popularity, unless
+// the API caller asks for another window with ?days=.
+const popularDays = 90
+
+type ratingRequest struct {
+	Rating int `json:"rating"`
+}
+
+// rankedList is a ranking of the library: its size as the caller sees it,
+// and one page of it.
+type rankedList struct {
+	count func() (int, error)
+	page  func(limit, offset int) ([]database.Book, error)
+}
+
+// popular ranks the books the caller may see by how many people
+// downloaded them in the last days days.
+func (s *Server) popular(r *http.Request, days int) rankedList {
+	filter := s.bookFilter(r)
+	since := time.Now().AddDate(0, 0, -days)
+	return rankedList{
+		count: func() (int, error) { return s.db.CountPopularBooks(filter, since) },
+		page: func(limit, offset int) ([]database.Book, error) {
+			return s.db.PopularBooks(filter, since, limit, offset)
+		},
+	}
+}
+
+// topRated ranks the rated books the caller may see by average rating.
+func (s *Server) topRated(r *http.Request) rankedList {
+	filter := s.bookFilter(r)
+	return rankedList{
+		count: func() (int, error) { return s.db.CountRatedBooks(filter) },
+		page: func(limit, offset int) ([]database.Book, error) {
+			return s.db.TopRatedBooks(filter, limit, offset)
+		},
+	}
+}
+
+// HandlePopularCatalog is the OPDS acquisition feed of the books most
+// people downloaded in the last popularDays days.
+func (s *Server) HandlePopularCatalog(w http.ResponseWriter, r *http.Request) {
+	s.writeRankedFeed(w, r, "popular", i18n.T("Most Popular"), s.popular(r, popularDays))
+}
+
+// HandleTopRatedCatalog is the OPDS acquisition feed of the best rated
+// books.
+func (s *Server) HandleTopRatedCatalog(w http.ResponseWriter, r *http.Request) {
+	s.writeRankedFeed(w, r, "top-rated", i18n.T("Top Rated"), s.topRated(r))
+}
+
+// writeRankedFeed writes one page of a ranking as an OPDS acquisition feed
+// at /opds/<name>, paginated like the shelf feeds.
+func (s *Server) writeRankedFeed(w http.ResponseWriter, r *http.Request, name, title string, list rankedList) {
+	total, err := list.count()
+	if err != nil {
+		http.Error(w, i18n.T("Internal Server Error"), http.StatusInternalServerError)
+		return
+	}
+	p := parseFeedPage(r, "/opds/"+name, total)
+	books, err := list.page(p.limit, p.offset())
+	if err != nil {
+		http.Error(w, i18n.T("Internal Server Error"), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/atom+xml;profile=opds-catalog;kind=acquisition;charset=utf-8")
+	fmt.Fprint(w, opdsFeedStart)
+	fmt.Fprintf(w, `<title>%s</title>`, html.EscapeString(feedTitle(title)))
+	fmt.Fprintf(w, `<id>gopds:%s</id>`, name)
+	fmt.Fprintf(w, `<updated>%s</updated>`, time.Now().UTC().Format(time.RFC3339))
+	fmt.Fprintf(w, `<link rel="self" href="%s" type="application/atom+xml;profile=opds-catalog;kind=acquisition"/>`, html.EscapeString(p.href(p.page)))
+	fmt.Fprint(w, `<link rel="up" href="/opds" type="application/atom+xml;profile=opds-catalog;kind=navigation"/>`)
+	p.writeLinks(w)
+	for _, b := range books {
+		writeOPDSEntry(w, b)
+	}
+	fmt.Fprint(w, `</feed>`)
+}
+
+// rankBooks answers /api/books?sort=popular|top_rated with the top limit
+// books of the ranking. Rankings change as people download and rate, so
+// they are not paged with cursors.
+func (s *Server) rankBooks(w http.ResponseWriter, r *http.Request, stream *bookStream, sort string) {
+	q := r.URL.Query()
+	if q.Has("after") || q.Has("genre") {
+		http.Error(w, i18n.T("sort can't be combined with after or genre"), http.StatusBadRequest)
+		return
+	}
+	limit := parseIntDefault(q.Get("limit"), 100)
+	if limit < 1 {
+		limit = 100
+	}
+	if limit > maxBooksPage {
+		limit = maxBooksPage
+	}
+	var list rankedList
+	switch sort {
+	case "popular":
+		days := parseIntDefault(q.Get("days"), popularDays)
+		if days < 1 || days > 3650 {
+			http.Error(w, i18n.T("days must be between 1 and 3650"), http.StatusBadRequest)
+			return
+		}
+		list = s.popular(r, days)
+	case "top_rated":
+		list = s.topRated(r)
+	default:
+		http.Error(w, i18n.T("Invalid sort. Use popular or top_rated"), http.StatusBadRequest)
+		return
+	}
+	books, err := list.page(limit, 0)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to rank books", "sort", sort, "err", err)
+		http.Error(w, i18n.T("Internal Server Error"), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", stream.contentType)
+	if err := stream.begin(w); err != nil {
+		return
+	}
+	for _, b := range books {
+		if err := stream.write(w, b); err != nil {
+			return
+		}
+	}
+	_ = stream.end(w)
+}
+
+// HandleBookRating returns a book's average rating and the caller's own.
+func (s *Server) HandleBookRating(w http.ResponseWriter, r *http.Request) {
+	book, ok := s.requestedBook(w, r)
+	if !ok {
+		return
+	}
+	s.writeBookRating(w, r, book.ID)
+}
+
+// HandleRateBook sets the caller's rating of a book, 1 to 5 stars.
+func (s *Server) HandleRateBook(w http.ResponseWriter, r *http.Request) {
+	book, ok := s.requestedBook(w, r)
+	if !ok {
+		return
+	}
+	var req ratingRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, i18n.T("Invalid JSON body"), http.StatusBadRequest)
+		return
+	}
+	if req.Rating < 1 || req.Rating > 5 {
+		http.Error(w, i18n.T("Rating must be from 1 to 5"), http.StatusBadRequest)
+		return
+	}
+	if err := s.db.RateBook(s.shelfOwner(r), *book, req.Rating); err != nil {
+		http.Error(w, i18n.T("Failed to save rating"), http.StatusInternalServerError)
+		return
+	}
+	s.writeBookRating(w, r, book.ID)
+}
+
+// HandleDeleteBookRating withdraws the caller's rating of a book.
+func (s *Server) HandleDeleteBookRating(w http.ResponseWriter, r *http.Request) {
+	book, ok := s.requestedBook(w, r)
+	if !ok {
+		return
+	}
+	found, err := s.db.DeleteBookRating(s.shelfOwner(r), book.ID)
+	if err != nil {
+		http.Error(w, i18n.T("Failed to save rating"), http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.Error(w, i18n.T("You haven't rated this book"), http.StatusNotFound)
+		return
+	}
+	s.writeBookRating(w, r, book.ID)
+}
+
+func (s *Server) writeBookRating(w http.ResponseWriter, r *http.Request, bookID int) {
+	rating, err := s.db.GetBookRating(s.shelfOwner(r), bookID)
+	if err != nil {
+		http.Error(w, i18n.T("Internal Server Error"), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(rating)
+}
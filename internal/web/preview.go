@@ -0,0 +1,74 @@
+package web
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/ab0oo/gopds/internal/i18n"
+	"github.com/ab0oo/gopds/internal/scanner"
+	"github.com/go-chi/chi/v5"
+)
+
+type previewPayload struct {
+	BookID int    `json:"book_id"`
+	Title  string `json:"title"`
+	Author string `json:"author"`
+	// HTML is a sanitized fragment: one <section> per spine item.
+	HTML      string   `json:"html"`
+	Sections  []string `json:"sections"`
+	Percent   float64  `json:"percent"`
+	Truncated bool     `json:"truncated"`
+}
+
+// HandleBookPreview returns the first chapter of a book, or with
+// ?percent=N the first N% of its spine, as sanitized HTML.
+func (s *Server) HandleBookPreview(w http.ResponseWriter, r *http.Request) {
+	percent := 0
+	if raw := strings.TrimSpace(r.URL.Query().Get("percent")); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > 100 {
+			http.Error(w, i18n.T("percent must be between 1 and 100"), http.StatusBadRequest)
+			return
+		}
+		percent = n
+	}
+
+	id := chi.URLParam(r, "id")
+	book, err := s.visibleBook(r, id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, i18n.T("Book not found"), http.StatusNotFound)
+			return
+		}
+		http.Error(w, i18n.T("Internal Server Error"), http.StatusInternalServerError)
+		return
+	}
+	bookPath, err := s.resolveBookPath(book)
+	if err != nil {
+		http.Error(w, i18n.T("Book file not found"), http.StatusNotFound)
+		return
+	}
+
+	preview, err := scanner.ExtractPreview(bookPath, percent)
+	if err != nil {
+		slog.WarnContext(r.Context(), "preview failed", "book_id", book.ID, "err", err)
+		http.Error(w, i18n.T("Preview unavailable: %v", err), http.StatusUnprocessableEntity)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(previewPayload{
+		BookID:    book.ID,
+		Title:     book.Title,
+		Author:    book.Author,
+		HTML:      preview.HTML,
+		Sections:  preview.Sections,
+		Percent:   preview.Percent,
+		Truncated: preview.Truncated,
+	})
+}
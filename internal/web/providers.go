@@ -0,0 +1,200 @@
+package web
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ab0oo/gopds/internal/i18n"
+	"github.com/ab0oo/gopds/internal/settings"
+)
+
+// External metadata providers, as named in quotas and usage counts.
+const (
+	providerOpenLibrary = "openlibrary"
+	providerGoogleBooks = "googlebooks"
+	providerHardcover   = "hardcover"
+	providerDouban      = "douban"
+	providerWikipedia   = "wikipedia"
+	providerWikidata    = "wikidata"
+)
+
+// providerUsageRetention is how long daily usage counts are kept.
+const providerUsageRetention = 30 * 24 * time.Hour
+
+// providerInfo describes a provider's toggle, quota, and API hosts.
+// Image hosts are left out: downloading covers doesn't count against API
+// quotas.
+type providerInfo struct {
+	Name    string
+	Enabled string
+	Quota   string
+	Hosts   []string
+}
+
+var providers = []providerInfo{
+	{providerOpenLibrary, settings.ProviderOpenLibrary, settings.QuotaOpenLibrary, []string{"openlibrary.org"}},
+	{providerGoogleBooks, settings.ProviderGoogleBooks, settings.QuotaGoogleBooks, []string{"www.googleapis.com"}},
+	{providerHardcover, settings.ProviderHardcover, settings.QuotaHardcover, []string{"api.hardcover.app"}},
+	// Douban's host depends on DOUBAN_API_URL; see providerForHost.
+	{providerDouban, settings.ProviderDouban, settings.QuotaDouban, nil},
+	{providerWikipedia, settings.ProviderWikipedia, settings.QuotaWikipedia, []string{"en.wikipedia.org"}},
+	{providerWikidata, settings.ProviderWikidata, settings.QuotaWikidata, []string{"query.wikidata.org"}},
+}
+
+var errProviderQuota = errors.New("daily request quota for this provider is used up")
+
+// googleBooksKeyFromEnv reads GOOGLE_BOOKS_API_KEY. Without a key Google
+// Books requests share an anonymous quota that is often exhausted.
+func googleBooksKeyFromEnv() string {
+	return strings.TrimSpace(os.Getenv("GOOGLE_BOOKS_API_KEY"))
+}
+
+// providerForHost names the provider whose API host is host, or "".
+func (s *Server) providerForHost(host string) string {
+	host = strings.ToLower(host)
+	if u, err := url.Parse(s.douban.baseURL); err == nil && strings.EqualFold(u.Hostname(), host) {
+		return providerDouban
+	}
+	for _, p := range providers {
+		for _, h := range p.Hosts {
+			if host == h {
+				return p.Name
+			}
+		}
+	}
+	return ""
+}
+
+func providerByName(name string) (providerInfo, bool) {
+	for _, p := range providers {
+		if p.Name == name {
+			return p, true
+		}
+	}
+	return providerInfo{}, false
+}
+
+// providerAvailable reports whether provider may be queried: it is turned
+// on and has quota left today.
+func (s *Server) providerAvailable(name string) bool {
+	p, ok := providerByName(name)
+	if !ok || !s.settings.Bool(p.Enabled) {
+		return false
+	}
+	limit := s.settings.Int(p.Quota)
+	if limit == 0 {
+		return true
+	}
+	usage, err := s.db.ProviderUsageToday()
+	return err != nil || usage[name] < limit
+}
+
+// providerTransport answers repeated requests to a provider's API from the
+// lookup cache. Requests that do go out count against the provider's daily
+// quota, are refused once it is used up, and carry the provider's API key.
+type providerTransport struct {
+	next   http.RoundTripper
+	server *Server
+}
+
+func (t providerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	s := t.server
+	p, ok := providerByName(s.providerForHost(req.URL.Hostname()))
+	if !ok {
+		return t.next.RoundTrip(req)
+	}
+	ttl := s.lookupCacheTTL()
+	key, cacheable := lookupCacheKey(req)
+	cacheable = cacheable && ttl > 0
+	if cacheable {
+		if res := s.cachedResponse(req, key); res != nil {
+			return res, nil
+		}
+	}
+
+	limit := s.settings.Int(p.Quota)
+	if limit > 0 {
+		if usage, err := s.db.ProviderUsageToday(); err == nil && usage[p.Name] >= limit {
+			return nil, errProviderQuota
+		}
+	}
+	used, err := s.db.AddProviderUsage(p.Name)
+	if err != nil {
+		slog.WarnContext(req.Context(), "failed to count provider request", "provider", p.Name, "err", err)
+	} else if limit > 0 && used == limit {
+		slog.WarnContext(req.Context(), "provider daily quota reached; no more lookups until midnight UTC", "provider", p.Name, "quota", limit)
+	}
+
+	if p.Name == providerGoogleBooks && s.googleBooksKey != "" {
+		req = req.Clone(req.Context())
+		q := req.URL.Query()
+		q.Set("key", s.googleBooksKey)
+		req.URL.RawQuery = q.Encode()
+	}
+	res, err := t.next.RoundTrip(req)
+	if err == nil && cacheable && res.StatusCode == http.StatusOK {
+		res = s.storeResponse(key, res, ttl)
+	}
+	return res, err
+}
+
+// withProviderQuotas wraps client's transport in a providerTransport.
+func (s *Server) withProviderQuotas(client *http.Client) *http.Client {
+	next := client.Transport
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	wrapped := *client
+	wrapped.Transport = providerTransport{next: next, server: s}
+	return &wrapped
+}
+
+type providerStatus struct {
+	Name       string `json:"name"`
+	Enabled    bool   `json:"enabled"`
+	HasKey     bool   `json:"has_key"`
+	DailyQuota int    `json:"daily_quota"`
+	UsedToday  int    `json:"used_today"`
+	Exhausted  bool   `json:"exhausted"`
+}
+
+type providersPayload struct {
+	Offline   bool             `json:"offline"`
+	Providers []providerStatus `json:"providers"`
+}
+
+// HandleProviders reports each external provider's toggle, whether an API
+// key is configured, and today's usage against its quota.
+func (s *Server) HandleProviders(w http.ResponseWriter, r *http.Request) {
+	usage, err := s.db.ProviderUsageToday()
+	if err != nil {
+		http.Error(w, i18n.T("Internal Server Error"), http.StatusInternalServerError)
+		return
+	}
+	keys := map[string]bool{
+		providerGoogleBooks: s.googleBooksKey != "",
+		providerHardcover:   s.hardcoverToken != "",
+		providerDouban:      s.douban.apiKey != "",
+	}
+	out := providersPayload{Offline: s.settings.Bool(settings.OfflineMode), Providers: make([]providerStatus, 0, len(providers))}
+	for _, p := range providers {
+		st := providerStatus{
+			Name:       p.Name,
+			Enabled:    s.settings.Bool(p.Enabled),
+			HasKey:     keys[p.Name],
+			DailyQuota: s.settings.Int(p.Quota),
+			UsedToday:  usage[p.Name],
+		}
+		st.Exhausted = st.DailyQuota > 0 && st.UsedToday >= st.DailyQuota
+		out.Providers = append(out.Providers, st)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	_ = json.NewEncoder(w).Encode(out)
+}
@@ -0,0 +1,107 @@
+package web
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+)
+
+// Reverse-proxy header authentication, for deployments behind Authelia,
+// oauth2-proxy, or similar: the proxy signs the user in and names them in a
+// request header. The header is only believed when the connection comes
+// straight from one of the configured proxy addresses; from anywhere else it
+// is ignored, since any client can set it.
+
+const proxySource = "proxy"
+
+type proxyAuth struct {
+	UserHeader   string
+	GroupsHeader string
+	Trusted      []netip.Prefix
+	AutoCreate   bool
+	Roles        roleMapping
+}
+
+// newProxyAuthFromEnv returns nil unless PROXY_AUTH_TRUSTED_PROXIES lists at
+// least one valid address or CIDR.
+func newProxyAuthFromEnv() *proxyAuth {
+	trusted := parseTrustedProxies("PROXY_AUTH_TRUSTED_PROXIES")
+	if len(trusted) == 0 {
+		return nil
+	}
+	p := &proxyAuth{
+		UserHeader:   strings.TrimSpace(os.Getenv("PROXY_AUTH_USER_HEADER")),
+		GroupsHeader: strings.TrimSpace(os.Getenv("PROXY_AUTH_GROUPS_HEADER")),
+		Trusted:      trusted,
+		AutoCreate:   !isFalse(os.Getenv("PROXY_AUTH_AUTO_CREATE")),
+		Roles:        roleMappingFromEnv("PROXY_AUTH"),
+	}
+	if p.UserHeader == "" {
+		p.UserHeader = "Remote-User"
+	}
+	if p.GroupsHeader == "" {
+		p.GroupsHeader = "Remote-Groups"
+	}
+	slog.Info("proxy header login enabled", "header", p.UserHeader, "trusted_proxies", len(trusted), "auto_create", p.AutoCreate)
+	return p
+}
+
+// parseTrustedProxy accepts a CIDR or a single address.
+func parseTrustedProxy(raw string) (netip.Prefix, error) {
+	if strings.Contains(raw, "/") {
+		prefix, err := netip.ParsePrefix(raw)
+		return prefix.Masked(), err
+	}
+	addr, err := netip.ParseAddr(raw)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// trusts reports whether r arrived directly from a trusted proxy.
+func (p *proxyAuth) trusts(r *http.Request) bool {
+	addr, ok := peerAddr(r)
+	return ok && prefixesContain(p.Trusted, addr)
+}
+
+// groups splits the groups header, which proxies send comma-separated.
+func (p *proxyAuth) groups(r *http.Request) []string {
+	var out []string
+	for _, value := range r.Header.Values(p.GroupsHeader) {
+		for _, g := range strings.Split(value, ",") {
+			if g = strings.TrimSpace(g); g != "" {
+				out = append(out, g)
+			}
+		}
+	}
+	return out
+}
+
+// proxyPrincipal resolves the user named by a trusted proxy. handled is false
+// when the request doesn't carry proxy authentication, so other methods
+// should be tried.
+func (s *Server) proxyPrincipal(r *http.Request) (p principal, ok, handled bool) {
+	if s.proxyAuth == nil {
+		return principal{}, false, false
+	}
+	username := strings.TrimSpace(r.Header.Get(s.proxyAuth.UserHeader))
+	if username == "" {
+		return principal{}, false, false
+	}
+	if !s.proxyAuth.trusts(r) {
+		slog.DebugContext(r.Context(), "ignoring proxy auth header from untrusted address", "remote", r.RemoteAddr)
+		return principal{}, false, false
+	}
+	user, err := s.provisionExternalUser(r.Context(), proxySource, username, s.proxyAuth.groups(r), s.proxyAuth.Roles, s.proxyAuth.AutoCreate)
+	if err != nil {
+		if !errors.Is(err, errUnknownUser) {
+			slog.WarnContext(r.Context(), "proxy auth user rejected", "username", username, "err", err)
+		}
+		return principal{}, false, true
+	}
+	return principal{Name: user.Username, Role: user.Role, Scopes: roleScopes[user.Role], Filter: user.Filter()}, true, true
+}
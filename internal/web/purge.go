@@ -0,0 +1,155 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ab0oo/gopds/internal/database"
+	"github.com/ab0oo/gopds/internal/i18n"
+	"github.com/ab0oo/gopds/internal/jobs"
+	"github.com/ab0oo/gopds/internal/scanner"
+	"github.com/ab0oo/gopds/internal/settings"
+	"github.com/ab0oo/gopds/internal/storage"
+)
+
+// purgeInterval is how often RunPurgeSchedule queues a purge while
+// missing_retention_days is set.
+const purgeInterval = 24 * time.Hour
+
+// purgeCovers deletes book id's cached cover and any re-encoded copies of
+// it, returning how many bytes that freed.
+func purgeCovers(ctx context.Context, id int) (int64, error) {
+	covers := storage.Covers()
+	jpg := scanner.CoverName(id)
+	names := []string{jpg}
+	for _, e := range coverEncodings {
+		names = append(names, strings.TrimSuffix(jpg, ".jpg")+e.Ext)
+	}
+	var freed int64
+	for _, name := range names {
+		info, err := covers.Stat(ctx, name)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return freed, err
+		}
+		if err := covers.Remove(ctx, name); err != nil {
+			return freed, err
+		}
+		coverVersions.Delete(name)
+		freed += info.Size()
+	}
+	return freed, nil
+}
+
+// runPurgeJob deletes the books whose files have been missing for longer
+// than missing_retention_days, along with their cached covers.
+func (s *Server) runPurgeJob(ctx context.Context, job *database.Job, p *jobs.Progress) error {
+	days := s.settings.Int(settings.MissingRetentionDays)
+	if days <= 0 {
+		p.Update("complete", "Purge skipped: missing_retention_days is 0.", 0)
+		return nil
+	}
+	books, err := s.db.MissingBooks(time.Now().AddDate(0, 0, -days))
+	if err != nil {
+		return fmt.Errorf("failed to list missing books: %w", err)
+	}
+	p.Update("purging", fmt.Sprintf("Purging %d books missing for over %d days...", len(books), days), 0)
+
+	var reclaimed int64
+	for i, b := range books {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		freed, err := purgeCovers(ctx, b.ID)
+		reclaimed += freed
+		if err != nil {
+			return fmt.Errorf("failed to remove cover of book %d: %w", b.ID, err)
+		}
+		if err := s.db.DeleteBook(b.ID); err != nil {
+			return fmt.Errorf("failed to delete book %d: %w", b.ID, err)
+		}
+		slog.InfoContext(ctx, "purge: book removed", "book_id", b.ID, "path", b.Path)
+		if (i+1)%100 == 0 {
+			p.Update("purging", fmt.Sprintf("Purged %d of %d books...", i+1, len(books)), i+1)
+		}
+	}
+	slog.InfoContext(ctx, "purge complete", "books", len(books), "retention_days", days, "reclaimed_bytes", reclaimed)
+	p.Update("complete", fmt.Sprintf("Purge complete. Removed %d books missing for over %d days and %s of covers.", len(books), days, formatSize(reclaimed)), len(books))
+	return nil
+}
+
+// HandlePurge queues a purge of books whose files have been missing for
+// longer than missing_retention_days.
+func (s *Server) HandlePurge(w http.ResponseWriter, r *http.Request) {
+	if s.settings.Int(settings.MissingRetentionDays) <= 0 {
+		http.Error(w, i18n.T("Set missing_retention_days to purge missing books"), http.StatusBadRequest)
+		return
+	}
+	job, err := s.jobs.EnqueueUnique(r.Context(), jobs.TypePurge, nil, "Purge queued.")
+	if err != nil && !errors.Is(err, jobs.ErrAlreadyActive) {
+		http.Error(w, i18n.T("Failed to queue purge: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if errors.Is(err, jobs.ErrAlreadyActive) {
+		w.WriteHeader(http.StatusConflict)
+	} else {
+		w.WriteHeader(http.StatusAccepted)
+	}
+	_ = json.NewEncoder(w).Encode(job)
+}
+
+// RunPurgeSchedule queues a purge once a day while missing_retention_days
+// is set, until ctx is cancelled.
+func (s *Server) RunPurgeSchedule(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if s.settings.Int(settings.MissingRetentionDays) <= 0 {
+				continue
+			}
+			last, err := s.jobs.Latest(jobs.TypePurge)
+			if err == nil && now.Sub(last.CreatedAt) < purgeInterval {
+				continue
+			}
+			if err != nil && !errors.Is(err, jobs.ErrNotFound) {
+				slog.ErrorContext(ctx, "failed to read last purge", "err", err)
+				continue
+			}
+			_, err = s.jobs.EnqueueUnique(ctx, jobs.TypePurge, nil, "Purge queued.")
+			switch {
+			case errors.Is(err, jobs.ErrAlreadyActive):
+			case err != nil:
+				slog.ErrorContext(ctx, "failed to queue scheduled purge", "err", err)
+			default:
+				slog.InfoContext(ctx, "scheduled purge queued")
+			}
+		}
+	}
+}
+
+func formatSize(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1f GB", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1f KB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%d bytes", n)
+}
@@ -0,0 +1,211 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/ab0oo/gopds/internal/database"
+	"github.com/ab0oo/gopds/internal/i18n"
+	"github.com/ab0oo/gopds/internal/scanner"
+	"github.com/ab0oo/gopds/internal/storage"
+)
+
+const (
+	defaultQualityBooks = 100
+	maxQualityBooks     = 5000
+)
+
+// The problems the quality report looks for, in the order they are listed
+// when their counts tie.
+const (
+	qualityUnknownAuthor      = "unknown_author"
+	qualityMissingDescription = "missing_description"
+	qualityMissingCover       = "missing_cover"
+	qualityMissingISBN        = "missing_isbn"
+	qualitySuspiciousTitle    = "suspicious_title"
+	qualityDuplicateTitle     = "duplicate_title"
+)
+
+var qualityProblems = []struct {
+	name, description string
+	// fix is the path, after the book's, where the problem is fixed.
+	fix string
+}{
+	{qualityUnknownAuthor, "No author, or \"Unknown Author\"", "/metadata/live"},
+	{qualityMissingDescription, "No description", "/metadata/live"},
+	{qualityMissingCover, "No cover image", "/covers/candidates"},
+	{qualityMissingISBN, "No valid ISBN among the EPUB's identifiers", "/metadata/live"},
+	{qualitySuspiciousTitle, "Title looks like a file name rather than a book title", "/metadata/live"},
+	{qualityDuplicateTitle, "Another book has the same title and author", ""},
+}
+
+type qualityLinks struct {
+	Book string `json:"book"`
+	// Fix is where the problem can be corrected: the metadata editor, or
+	// the cover candidates.
+	Fix string `json:"fix"`
+}
+
+type qualityBook struct {
+	ID     int          `json:"id"`
+	Title  string       `json:"title"`
+	Author string       `json:"author"`
+	Detail string       `json:"detail,omitempty"`
+	Links  qualityLinks `json:"links"`
+}
+
+type qualityProblem struct {
+	Problem     string        `json:"problem"`
+	Description string        `json:"description"`
+	Count       int           `json:"count"`
+	Books       []qualityBook `json:"books"`
+}
+
+type qualityPayload struct {
+	TotalBooks int `json:"total_books"`
+	// BooksWithProblems counts books with at least one problem.
+	BooksWithProblems int              `json:"books_with_problems"`
+	Problems          []qualityProblem `json:"problems"`
+}
+
+var (
+	ebookExtPattern = regexp.MustCompile(`(?i)\.(epub|kepub|mobi|azw3?|pdf|fb2|txt|zip)$`)
+	idTitlePattern  = regexp.MustCompile(`(?i)^[0-9a-f-]{16,}$`)
+)
+
+// suspiciousTitle says why b's title looks like a file name or an ID
+// rather than a title, or returns "" if it looks fine.
+func suspiciousTitle(b database.Book) string {
+	title := strings.TrimSpace(b.Title)
+	stem := strings.TrimSuffix(filepath.Base(b.Path), filepath.Ext(b.Path))
+	switch {
+	case title == "":
+		return "empty title"
+	case ebookExtPattern.MatchString(title):
+		return "ends in a file extension"
+	case strings.Contains(title, "%20"):
+		return "URL-encoded"
+	case strings.Contains(title, "_") && !strings.Contains(title, " "):
+		return "underscores instead of spaces"
+	case scanner.ParseISBN(title) != "" || idTitlePattern.MatchString(title):
+		return "a number or ID"
+	case title == stem && isUnknownAuthor(b.Author):
+		// The scanner's fallback for an EPUB without metadata.
+		return "copied from the file name"
+	case !isUnknownAuthor(b.Author) && strings.HasPrefix(strings.ToLower(title), strings.ToLower(strings.TrimSpace(b.Author))+" - "):
+		return "starts with the author's name"
+	}
+	return ""
+}
+
+func isUnknownAuthor(author string) bool {
+	author = strings.TrimSpace(author)
+	return author == "" || strings.EqualFold(author, "Unknown Author") || strings.EqualFold(author, "Unknown")
+}
+
+// HandleQualityReport lists the library's metadata problems, most common
+// first, with links to each affected book so cleanup can be prioritized.
+// ?problem= reports just one; ?limit= caps the books listed per problem,
+// while counts always cover the whole library.
+func (s *Server) HandleQualityReport(w http.ResponseWriter, r *http.Request) {
+	only := strings.TrimSpace(r.URL.Query().Get("problem"))
+	if only != "" {
+		known := false
+		for _, p := range qualityProblems {
+			known = known || p.name == only
+		}
+		if !known {
+			http.Error(w, i18n.T("Unknown problem"), http.StatusBadRequest)
+			return
+		}
+	}
+	limit := parseIntDefault(r.URL.Query().Get("limit"), defaultQualityBooks)
+	if limit < 0 || limit > maxQualityBooks {
+		http.Error(w, i18n.T("limit must be between 0 and %d", maxQualityBooks), http.StatusBadRequest)
+		return
+	}
+
+	found := map[string][]qualityBook{}
+	flagged := map[int]bool{}
+	add := func(problem string, b database.Book, detail string) {
+		found[problem] = append(found[problem], qualityBook{ID: b.ID, Title: b.Title, Author: b.Author, Detail: detail})
+		flagged[b.ID] = true
+	}
+	total := 0
+	titles := map[string][]database.Book{}
+	err := s.db.ForEachBookWithISBN(s.bookFilter(r), func(b database.Book, isbn string) error {
+		total++
+		if isUnknownAuthor(b.Author) {
+			add(qualityUnknownAuthor, b, "")
+		}
+		if strings.TrimSpace(html.UnescapeString(htmlTagPattern.ReplaceAllString(b.Description, ""))) == "" {
+			add(qualityMissingDescription, b, "")
+		}
+		if _, err := storage.Covers().Stat(r.Context(), scanner.CoverName(b.ID)); err != nil {
+			add(qualityMissingCover, b, "")
+		}
+		if isbn == "" {
+			add(qualityMissingISBN, b, "")
+		}
+		if reason := suspiciousTitle(b); reason != "" {
+			add(qualitySuspiciousTitle, b, reason)
+		}
+		if key := normalizeForMatch(b.Title); key != "" {
+			key += "\x00" + mergeKey(b.Author)
+			titles[key] = append(titles[key], b)
+		}
+		return nil
+	})
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to build quality report", "err", err)
+		http.Error(w, i18n.T("Internal Server Error"), http.StatusInternalServerError)
+		return
+	}
+
+	var groups [][]database.Book
+	for _, books := range titles {
+		if len(books) > 1 {
+			groups = append(groups, books)
+		}
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i][0].ID < groups[j][0].ID })
+	for _, books := range groups {
+		for _, b := range books {
+			var others []string
+			for _, o := range books {
+				if o.ID != b.ID {
+					others = append(others, fmt.Sprintf("#%d", o.ID))
+				}
+			}
+			add(qualityDuplicateTitle, b, "same as "+strings.Join(others, ", "))
+		}
+	}
+
+	payload := qualityPayload{TotalBooks: total, BooksWithProblems: len(flagged), Problems: []qualityProblem{}}
+	for _, p := range qualityProblems {
+		if only != "" && p.name != only {
+			continue
+		}
+		books := found[p.name]
+		problem := qualityProblem{Problem: p.name, Description: p.description, Count: len(books), Books: books[:min(len(books), limit)]}
+		for i := range problem.Books {
+			book := fmt.Sprintf("/api/books/%d", problem.Books[i].ID)
+			problem.Books[i].Links = qualityLinks{Book: book, Fix: book + p.fix}
+		}
+		if problem.Books == nil {
+			problem.Books = []qualityBook{}
+		}
+		payload.Problems = append(payload.Problems, problem)
+	}
+	sort.SliceStable(payload.Problems, func(i, j int) bool { return payload.Problems[i].Count > payload.Problems[j].Count })
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(payload)
+}
@@ -0,0 +1,234 @@
+package web
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ab0oo/gopds/internal/database"
+	"github.com/ab0oo/gopds/internal/i18n"
+	"github.com/ab0oo/gopds/internal/metrics"
+	"github.com/ab0oo/gopds/internal/settings"
+	"github.com/ab0oo/gopds/internal/storage"
+)
+
+var downloadQuotaRefusals = metrics.NewCounterVec("gopds_download_quota_refusals_total",
+	"Downloads refused because the user's quota for the period was used up.", "period")
+
+// quotaPeriod is a user's usage and limits for one day or month. Zero limits
+// are unlimited.
+type quotaPeriod struct {
+	database.DownloadUsage
+	DownloadLimit int       `json:"download_limit"`
+	ByteLimit     int64     `json:"byte_limit"`
+	ResetsAt      time.Time `json:"resets_at"`
+}
+
+type downloadUsagePayload struct {
+	Username string `json:"username"`
+	// Exempt is set for admins, whose downloads are counted but not limited.
+	Exempt bool        `json:"exempt,omitempty"`
+	Today  quotaPeriod `json:"today"`
+	Month  quotaPeriod `json:"month"`
+}
+
+// quotaPeriods returns when the current UTC day and month started and when
+// they end.
+func quotaPeriods(now time.Time) (dayStart, dayEnd, monthStart, monthEnd time.Time) {
+	now = now.UTC()
+	dayStart = time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	monthStart = time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	return dayStart, dayStart.AddDate(0, 0, 1), monthStart, monthStart.AddDate(0, 1, 0)
+}
+
+// quotaLimit is the user's override if set, else the server-wide setting.
+func (s *Server) quotaLimit(override *int, key string) int {
+	if override != nil {
+		return *override
+	}
+	return s.settings.Int(key)
+}
+
+// downloadUsage reports user's downloads this day and month against their
+// limits.
+func (s *Server) downloadUsage(user *database.User, now time.Time) (downloadUsagePayload, error) {
+	dayStart, _, monthStart, _ := quotaPeriods(now)
+	today, err := s.db.DownloadUsageSince(user.Username, dayStart)
+	if err != nil {
+		return downloadUsagePayload{}, err
+	}
+	month, err := s.db.DownloadUsageSince(user.Username, monthStart)
+	if err != nil {
+		return downloadUsagePayload{}, err
+	}
+	return s.quotaUsage(user, today, month, now), nil
+}
+
+// quotaUsage pairs already-totalled usage with user's limits.
+func (s *Server) quotaUsage(user *database.User, today, month database.DownloadUsage, now time.Time) downloadUsagePayload {
+	_, dayEnd, _, monthEnd := quotaPeriods(now)
+	q := user.DownloadQuota
+	return downloadUsagePayload{
+		Username: user.Username,
+		Exempt:   user.Role == roleAdmin,
+		Today: quotaPeriod{
+			DownloadUsage: today,
+			DownloadLimit: s.quotaLimit(q.DailyDownloads, settings.DownloadDailyLimit),
+			ByteLimit:     int64(s.quotaLimit(q.DailyMB, settings.DownloadDailyMB)) << 20,
+			ResetsAt:      dayEnd,
+		},
+		Month: quotaPeriod{
+			DownloadUsage: month,
+			DownloadLimit: s.quotaLimit(q.MonthlyDownloads, settings.DownloadMonthlyLimit),
+			ByteLimit:     int64(s.quotaLimit(q.MonthlyMB, settings.DownloadMonthlyMB)) << 20,
+			ResetsAt:      monthEnd,
+		},
+	}
+}
+
+// exceeds reports whether one more download of size bytes would go over
+// either limit.
+func (p quotaPeriod) exceeds(size int64) bool {
+	return (p.DownloadLimit > 0 && p.Downloads+1 > p.DownloadLimit) ||
+		(p.ByteLimit > 0 && p.Bytes+size > p.ByteLimit)
+}
+
+// overLimit reports whether usage already recorded is over either limit.
+func (p quotaPeriod) overLimit() bool {
+	return (p.DownloadLimit > 0 && p.Downloads > p.DownloadLimit) ||
+		(p.ByteLimit > 0 && p.Bytes > p.ByteLimit)
+}
+
+// rangeFromMiddle reports whether r asks for a byte range that doesn't
+// start at the beginning of the file, as a client resuming a download does.
+func rangeFromMiddle(r *http.Request) bool {
+	spec, ok := strings.CutPrefix(r.Header.Get("Range"), "bytes=")
+	if !ok {
+		return false
+	}
+	start, _, _ := strings.Cut(spec, "-")
+	n, err := strconv.ParseInt(strings.TrimSpace(start), 10, 64)
+	return err == nil && n > 0
+}
+
+// sendsBody reports whether http.ServeContent will answer r with the file
+// last modified at modtime: not for HEAD, and not for a GET whose
+// If-None-Match or If-Modified-Since it answers 304 Not Modified.
+func sendsBody(w http.ResponseWriter, r *http.Request, modtime time.Time) bool {
+	if r.Method != http.MethodGet {
+		return false
+	}
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		etag := strings.TrimPrefix(w.Header().Get("ETag"), "W/")
+		for _, tag := range strings.Split(inm, ",") {
+			tag = strings.TrimSpace(tag)
+			if tag == "*" || etag != "" && strings.TrimPrefix(tag, "W/") == etag {
+				return false
+			}
+		}
+		return true
+	}
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil || modtime.IsZero() || modtime.Equal(time.Unix(0, 0)) {
+		return true
+	}
+	return modtime.Truncate(time.Second).After(since)
+}
+
+// checkDownloadQuota answers 429 and returns false if the signed-in user has
+// used up a download quota. Anonymous downloads, API tokens, and admins are
+// not limited. It returns the username to charge the download to, and
+// whether the request starts a download that should be recorded rather than
+// resuming one already recorded today. Every request is checked: a resume is
+// refused once usage is over a limit, and a range from the middle of a book
+// the user hasn't downloaded today is charged as a new download.
+func (s *Server) checkDownloadQuota(w http.ResponseWriter, r *http.Request, book *database.Book, size int64) (username string, record, ok bool) {
+	resuming := rangeFromMiddle(r)
+	p, ok := s.principal(r)
+	if !ok || p.TokenID != 0 {
+		return "", !resuming, true
+	}
+	user, err := s.db.GetUserByName(p.Name)
+	if err != nil {
+		// The account was deleted mid-session; principal() will catch up.
+		return p.Name, !resuming, true
+	}
+	if user.Role == roleAdmin {
+		return user.Username, !resuming, true
+	}
+	now := time.Now()
+	if resuming {
+		dayStart, _, _, _ := quotaPeriods(now)
+		resuming, err = s.db.DownloadedSince(user.Username, book.ID, dayStart)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "failed to read download history", "username", user.Username, "book_id", book.ID, "err", err)
+			http.Error(w, i18n.T("Internal Server Error"), http.StatusInternalServerError)
+			return "", false, false
+		}
+	}
+	usage, err := s.downloadUsage(user, now)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to read download usage", "username", user.Username, "err", err)
+		http.Error(w, i18n.T("Internal Server Error"), http.StatusInternalServerError)
+		return "", false, false
+	}
+	for _, period := range []struct {
+		name string
+		q    quotaPeriod
+	}{{"day", usage.Today}, {"month", usage.Month}} {
+		if resuming && !period.q.overLimit() || !resuming && !period.q.exceeds(size) {
+			continue
+		}
+		downloadQuotaRefusals.Inc(period.name)
+		slog.WarnContext(r.Context(), "download quota exceeded", "username", user.Username, "period", period.name,
+			"downloads", period.q.Downloads, "bytes", period.q.Bytes, "resets_at", period.q.ResetsAt)
+		w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(period.q.ResetsAt).Seconds())+1))
+		http.Error(w, i18n.T("Download quota for this %s is used up; it resets at %s", period.name, period.q.ResetsAt.Format(time.RFC3339)), http.StatusTooManyRequests)
+		return "", false, false
+	}
+	return user.Username, !resuming, true
+}
+
+// serveCountedFile serves a book file, enforcing download quotas on every
+// request that sends it and recording the requests that start a download.
+func (s *Server) serveCountedFile(w http.ResponseWriter, r *http.Request, book *database.Book, path, format string) {
+	f, err := storage.Open(r.Context(), path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			http.Error(w, i18n.T("Book file not found"), http.StatusNotFound)
+			return
+		}
+		http.Error(w, i18n.T("Internal Server Error"), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
+		http.Error(w, i18n.T("Internal Server Error"), http.StatusInternalServerError)
+		return
+	}
+	// HEAD requests and revalidations answered 304 transfer no book, so
+	// they are neither limited nor counted.
+	if !sendsBody(w, r, info.ModTime()) {
+		http.ServeContent(w, r, "", info.ModTime(), f)
+		return
+	}
+	username, record, ok := s.checkDownloadQuota(w, r, book, info.Size())
+	if !ok {
+		return
+	}
+	if record {
+		s.emitDownload(r, book, format)
+		if err := s.db.RecordDownload(username, book.ID, format, info.Size(), time.Now()); err != nil {
+			slog.ErrorContext(r.Context(), "failed to record download", "book_id", book.ID, "err", err)
+		}
+	}
+	// ServeContent handles ranges and conditional requests, and unlike
+	// ServeFile never redirects; the caller has set the Content-Type.
+	streamWithoutDeadline(w)
+	http.ServeContent(w, r, "", info.ModTime(), f)
+}
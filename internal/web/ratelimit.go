@@ -0,0 +1,130 @@
+package web
+
+import (
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ab0oo/gopds/internal/i18n"
+	"github.com/ab0oo/gopds/internal/metrics"
+)
+
+var rateLimited = metrics.NewCounterVec("gopds_rate_limited_total",
+	"Requests rejected by a per-IP rate limiter.", "limiter")
+
+// rateLimiter is a per-client token bucket. Each client may burst up to the
+// per-minute limit and then refills at limit/60 tokens per second. A nil
+// limiter allows everything.
+type rateLimiter struct {
+	name  string
+	rate  float64 // tokens per second
+	burst float64
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiterFromEnv builds a limiter from a requests-per-minute env var.
+// Unset uses fallback; 0 disables the limiter.
+func newRateLimiterFromEnv(name, env string, fallback int) *rateLimiter {
+	perMinute := fallback
+	if raw := strings.TrimSpace(os.Getenv(env)); raw != "" {
+		v, err := strconv.Atoi(raw)
+		if err != nil || v < 0 {
+			slog.Warn("invalid rate limit; using default", "env", env, "value", raw, "per_minute", fallback)
+		} else {
+			perMinute = v
+		}
+	}
+	if perMinute == 0 {
+		return nil
+	}
+	return &rateLimiter{
+		name:    name,
+		rate:    float64(perMinute) / 60,
+		burst:   float64(perMinute),
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// allow takes a token for key, or reports how long until one is available.
+func (l *rateLimiter) allow(key string) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.sweep(now)
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	return false, wait
+}
+
+// sweep drops buckets that have refilled completely, so memory tracks active
+// clients rather than every address ever seen. Callers hold l.mu.
+func (l *rateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+	full := time.Duration(l.burst / l.rate * float64(time.Second))
+	for key, b := range l.buckets {
+		if now.Sub(b.last) > full {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// rateLimit rejects requests over l's per-IP budget with 429 and a
+// Retry-After header.
+func (s *Server) rateLimit(l *rateLimiter, next http.HandlerFunc) http.HandlerFunc {
+	if l == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		ok, wait := l.allow(clientIP(r))
+		if !ok {
+			rateLimited.Inc(l.name)
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			http.Error(w, i18n.T("Too Many Requests"), http.StatusTooManyRequests)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// clientIP is the remote address without its port.
+func clientIP(r *http.Request) string {
+	if f, ok := r.Context().Value(forwardedKey{}).(forwarded); ok {
+		return f.ClientIP
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
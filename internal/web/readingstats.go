@@ -0,0 +1,215 @@
+package web
+
+import (
+	"encoding/json"
+	"log/slog"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ab0oo/gopds/internal/i18n"
+	"github.com/ab0oo/gopds/internal/scanner"
+)
+
+// finishedAt is the KOReader percentage from which a book counts as
+// finished; readers rarely page through to the very end.
+const finishedAt = 0.99
+
+// minutesPerPage turns estimated pages into reading time, at about 250
+// words a minute.
+const minutesPerPage = 1.2
+
+// readingStatsMonths is how many calendar months the monthly series cover,
+// this one included.
+const readingStatsMonths = 12
+
+type readingStatsPayload struct {
+	// Months runs oldest first and ends with the current month.
+	Months     []readingMonth `json:"months"`
+	Finished   int            `json:"finished"`
+	InProgress int            `json:"in_progress"`
+	// PagesRead and HoursRead are estimates from the length of each book's
+	// text and how far through it the reader is.
+	PagesRead  int           `json:"pages_read"`
+	HoursRead  float64       `json:"hours_read"`
+	TopAuthors []authorReads `json:"top_authors"`
+	// Users is only reported to admins.
+	Users []userReadingSummary `json:"users,omitempty"`
+}
+
+type readingMonth struct {
+	Month     string `json:"month"`
+	Finished  int    `json:"finished"`
+	Downloads int    `json:"downloads"`
+}
+
+type authorReads struct {
+	Author   string `json:"author"`
+	Books    int    `json:"books"`
+	Finished int    `json:"finished"`
+}
+
+type userReadingSummary struct {
+	Username   string     `json:"username"`
+	Finished   int        `json:"finished"`
+	InProgress int        `json:"in_progress"`
+	PagesRead  int        `json:"pages_read"`
+	Downloads  int        `json:"downloads"`
+	LastRead   *time.Time `json:"last_read,omitempty"`
+}
+
+// pageCount is a book's estimated length, remembered for the file version
+// it was measured from.
+type pageCount struct {
+	modTime time.Time
+	pages   int
+}
+
+// estimatedPages returns the estimated length of the book at path, or 0 if
+// it can't be opened.
+func (s *Server) estimatedPages(path string, modTime time.Time) int {
+	if v, ok := s.pageCounts.Load(path); ok && v.(pageCount).modTime.Equal(modTime) {
+		return v.(pageCount).pages
+	}
+	e, err := scanner.OpenEPUB(path)
+	if err != nil {
+		return 0
+	}
+	defer e.Close()
+	pages := e.EstimatedPages()
+	s.pageCounts.Store(path, pageCount{modTime: modTime, pages: pages})
+	return pages
+}
+
+// HandleReadingStats summarizes reading progress synced from KOReader and
+// download history: books finished and downloaded per month, estimated
+// pages and hours read, and the most-read authors. Signed-in users see
+// their own reading; admins see everyone's, with a summary per user.
+func (s *Server) HandleReadingStats(w http.ResponseWriter, r *http.Request) {
+	p, _ := s.principal(r)
+	admin := p.has(scopeAdmin)
+	username := p.Name
+	if admin {
+		username = ""
+	}
+
+	activity, err := s.db.ReadingActivity(username)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to read reading progress", "err", err)
+		http.Error(w, i18n.T("Internal Server Error"), http.StatusInternalServerError)
+		return
+	}
+	now := time.Now().UTC()
+	firstMonth := time.Date(now.Year(), now.Month()-readingStatsMonths+1, 1, 0, 0, 0, 0, time.UTC)
+	downloads, err := s.db.DownloadsByMonth(firstMonth)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to read download history", "err", err)
+		http.Error(w, i18n.T("Internal Server Error"), http.StatusInternalServerError)
+		return
+	}
+
+	payload := readingStatsPayload{Months: make([]readingMonth, readingStatsMonths), TopAuthors: []authorReads{}}
+	monthIndex := map[string]int{}
+	for i := range payload.Months {
+		month := firstMonth.AddDate(0, i, 0).Format("2006-01")
+		payload.Months[i].Month = month
+		monthIndex[month] = i
+	}
+	users := map[string]*userReadingSummary{}
+	user := func(name string) *userReadingSummary {
+		key := strings.ToLower(name)
+		u, ok := users[key]
+		if !ok {
+			u = &userReadingSummary{Username: name}
+			users[key] = u
+		}
+		return u
+	}
+
+	authors := map[string]*authorReads{}
+	pages := 0.0
+	for _, a := range activity {
+		u := user(a.Username)
+		if u.LastRead == nil || a.UpdatedAt.After(*u.LastRead) {
+			at := a.UpdatedAt
+			u.LastRead = &at
+		}
+		finished := a.Percentage >= finishedAt
+		if finished {
+			payload.Finished++
+			u.Finished++
+			if i, ok := monthIndex[a.UpdatedAt.UTC().Format("2006-01")]; ok {
+				payload.Months[i].Finished++
+			}
+		} else {
+			payload.InProgress++
+			u.InProgress++
+		}
+		if a.BookID == 0 {
+			continue
+		}
+		read := float64(s.estimatedPages(a.Path, a.ModTime)) * min(a.Percentage, 1)
+		pages += read
+		u.PagesRead += int(math.Round(read))
+
+		key := strings.ToLower(strings.TrimSpace(a.Author))
+		if key == "" {
+			continue
+		}
+		ar, ok := authors[key]
+		if !ok {
+			ar = &authorReads{Author: strings.TrimSpace(a.Author)}
+			authors[key] = ar
+		}
+		ar.Books++
+		if finished {
+			ar.Finished++
+		}
+	}
+	payload.PagesRead = int(math.Round(pages))
+	payload.HoursRead = math.Round(pages*minutesPerPage/60*10) / 10
+
+	for _, d := range downloads {
+		if username != "" && d.Username != strings.ToLower(username) {
+			continue
+		}
+		if i, ok := monthIndex[d.Month]; ok {
+			payload.Months[i].Downloads += d.Downloads
+		}
+		if d.Username != "" && admin {
+			user(d.Username).Downloads += d.Downloads
+		}
+	}
+
+	for _, a := range authors {
+		payload.TopAuthors = append(payload.TopAuthors, *a)
+	}
+	sort.Slice(payload.TopAuthors, func(i, j int) bool {
+		a, b := payload.TopAuthors[i], payload.TopAuthors[j]
+		if a.Books != b.Books {
+			return a.Books > b.Books
+		}
+		if a.Finished != b.Finished {
+			return a.Finished > b.Finished
+		}
+		return strings.ToLower(a.Author) < strings.ToLower(b.Author)
+	})
+	if len(payload.TopAuthors) > 10 {
+		payload.TopAuthors = payload.TopAuthors[:10]
+	}
+
+	if admin {
+		payload.Users = make([]userReadingSummary, 0, len(users))
+		for _, u := range users {
+			payload.Users = append(payload.Users, *u)
+		}
+		sort.Slice(payload.Users, func(i, j int) bool {
+			return strings.ToLower(payload.Users[i].Username) < strings.ToLower(payload.Users[j].Username)
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(payload)
+}
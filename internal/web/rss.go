@@ -0,0 +1,141 @@
+package web
+
+import (
+	"fmt"
+	"html"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ab0oo/gopds/internal/database"
+	"github.com/ab0oo/gopds/internal/i18n"
+)
+
+const (
+	defaultRSSItems = 50
+	maxRSSItems     = 200
+)
+
+// HandleNewAdditionsRSS is an RSS 2.0 feed of the books most recently added
+// to the library, for feed readers. ?category= (with ?subcategory=),
+// ?author=, and ?genre= narrow it, so readers can follow only what they
+// are interested in. Links are absolute, as feed readers need, and are
+// built from the host the request came in on.
+func (s *Server) HandleNewAdditionsRSS(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	only := database.AdditionFilter{
+		Category:    strings.TrimSpace(q.Get("category")),
+		Subcategory: strings.TrimSpace(q.Get("subcategory")),
+		Author:      strings.TrimSpace(q.Get("author")),
+	}
+	if only.Subcategory != "" && only.Category == "" {
+		http.Error(w, i18n.T("subcategory needs a category"), http.StatusBadRequest)
+		return
+	}
+	limit := parseIntDefault(q.Get("limit"), defaultRSSItems)
+	if limit < 1 || limit > maxRSSItems {
+		http.Error(w, i18n.T("limit must be between 1 and %d", maxRSSItems), http.StatusBadRequest)
+		return
+	}
+
+	var labels []string
+	var keep func([]string) bool
+	if raw := strings.TrimSpace(q.Get("genre")); raw != "" {
+		genre, ok := s.genres.Canonical(raw)
+		if !ok {
+			http.Error(w, i18n.T("Unknown genre"), http.StatusNotFound)
+			return
+		}
+		keep = func(subjects []string) bool {
+			for _, g := range s.genres.Map(subjects) {
+				if g == genre {
+					return true
+				}
+			}
+			return false
+		}
+		labels = append(labels, genre)
+	}
+	if only.Category != "" {
+		label := only.Category
+		if only.Subcategory != "" {
+			label += " / " + only.Subcategory
+		}
+		labels = append(labels, label)
+	}
+	if only.Author != "" {
+		labels = append(labels, only.Author)
+	}
+
+	books, err := s.db.RecentlyAddedBooks(s.bookFilter(r), only, limit, keep)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to list new additions", "err", err)
+		http.Error(w, i18n.T("Internal Server Error"), http.StatusInternalServerError)
+		return
+	}
+
+	title := i18n.T("New Additions")
+	if len(labels) > 0 {
+		title += ": " + strings.Join(labels, ", ")
+	}
+	base := requestBaseURL(r)
+	w.Header().Set("Content-Type", "application/rss+xml; charset=utf-8")
+	fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8"?><rss version="2.0" xmlns:atom="http://www.w3.org/2005/Atom" xmlns:dc="http://purl.org/dc/elements/1.1/"><channel>`)
+	fmt.Fprintf(w, `<title>%s</title>`, html.EscapeString(feedTitle(title)))
+	fmt.Fprintf(w, `<link>%s/</link>`, html.EscapeString(base))
+	fmt.Fprintf(w, `<description>%s</description>`, html.EscapeString(title))
+	fmt.Fprintf(w, `<atom:link href="%s" rel="self" type="application/rss+xml"/>`, html.EscapeString(base+r.URL.RequestURI()))
+	if len(books) > 0 {
+		fmt.Fprintf(w, `<lastBuildDate>%s</lastBuildDate>`, books[0].AddedAt.UTC().Format(time.RFC1123Z))
+	}
+	for _, b := range books {
+		s.writeRSSItem(w, base, b)
+	}
+	fmt.Fprint(w, `</channel></rss>`)
+}
+
+// writeRSSItem writes one book as an RSS item. The guid is the book's
+// content hash rather than its ID, which a rebuild changes, so readers
+// don't see the whole library as new again.
+func (s *Server) writeRSSItem(w http.ResponseWriter, base string, b database.AddedBook) {
+	download := fmt.Sprintf("%s/download/%d", base, b.ID)
+	guid := b.FileHash
+	if guid == "" {
+		guid = b.Path
+	}
+	fmt.Fprint(w, `<item>`)
+	fmt.Fprintf(w, `<title>%s</title>`, html.EscapeString(b.Title))
+	fmt.Fprintf(w, `<link>%s</link>`, html.EscapeString(download))
+	fmt.Fprintf(w, `<guid isPermaLink="false">gopds:%s</guid>`, html.EscapeString(guid))
+	if b.Author != "" {
+		fmt.Fprintf(w, `<dc:creator>%s</dc:creator>`, html.EscapeString(b.Author))
+	}
+	if c := strings.TrimSpace(b.Category); c != "" {
+		fmt.Fprintf(w, `<category>%s</category>`, html.EscapeString(c))
+	}
+	for _, g := range s.genres.Map(b.Subjects) {
+		fmt.Fprintf(w, `<category>%s</category>`, html.EscapeString(g))
+	}
+	fmt.Fprintf(w, `<pubDate>%s</pubDate>`, b.AddedAt.UTC().Format(time.RFC1123Z))
+
+	// Descriptions come from the EPUB, so only their text is passed on.
+	summary := fmt.Sprintf(`<p><img src="%s" alt=""/></p>`, html.EscapeString(base+coverURL(b.ID)))
+	if b.Series != "" {
+		series := b.Series
+		if b.SeriesIndex != "" {
+			// calibre writes whole numbers as "1.0".
+			series += " #" + strings.TrimSuffix(b.SeriesIndex, ".0")
+		}
+		summary += "<p>" + html.EscapeString(series) + "</p>"
+	}
+	if text := strings.Join(strings.Fields(html.UnescapeString(htmlTagPattern.ReplaceAllString(b.Description, " "))), " "); text != "" {
+		summary += "<p>" + html.EscapeString(text) + "</p>"
+	}
+	fmt.Fprintf(w, `<description>%s</description>`, html.EscapeString(summary))
+	if info, err := os.Stat(b.Path); err == nil {
+		fmt.Fprintf(w, `<enclosure url="%s" length="%d" type="application/epub+zip"/>`, html.EscapeString(download), info.Size())
+	}
+	fmt.Fprint(w, `</item>`)
+}
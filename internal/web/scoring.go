@@ -0,0 +1,332 @@
+package web
+
+import (
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/ab0oo/gopds/internal/database"
+	"github.com/ab0oo/gopds/internal/scanner"
+	"golang.org/x/text/unicode/norm"
+)
+
+// matchReference is what metadata candidates are scored against: the book
+// being edited, or whatever the search named.
+type matchReference struct {
+	Title  string
+	Author string
+	ISBN   string
+	Year   int
+	// Query is the free-text search, used when there is no title.
+	Query string
+}
+
+func (ref matchReference) empty() bool {
+	return ref.Title == "" && ref.Author == "" && ref.ISBN == "" && ref.Query == ""
+}
+
+// bookMatchReference fills the blanks in ref from book: its title and
+// author from the library, and ISBN and year from the EPUB itself when the
+// file can be read.
+func (s *Server) bookMatchReference(book *database.Book, ref matchReference) matchReference {
+	if ref.Title == "" {
+		ref.Title = strings.TrimSpace(book.Title)
+	}
+	if ref.Author == "" {
+		ref.Author = strings.TrimSpace(book.Author)
+	}
+	bookPath, err := s.resolveBookPath(book)
+	if err != nil {
+		return ref
+	}
+	meta, err := scanner.ExtractLiveMetadata(bookPath)
+	if err != nil {
+		return ref
+	}
+	if ref.ISBN == "" {
+		ref.ISBN = isbn13(meta.Identifier)
+	}
+	ref.Year = yearOfDate(meta.Date)
+	return ref
+}
+
+// scoreCandidates sets each candidate's Confidence against ref and sorts
+// the most likely matches first. Candidates that reach autoApply (a
+// fraction; 0 turns it off) are marked safe to apply without review.
+func scoreCandidates(ref matchReference, candidates []metadataCandidate, autoApply float64) {
+	if ref.empty() {
+		return
+	}
+	for i := range candidates {
+		c := &candidates[i]
+		c.Confidence = math.Round(matchConfidence(ref, *c)*100) / 100
+		// A bare search query says too little about the book to trust.
+		c.AutoApply = autoApply > 0 && c.Confidence >= autoApply && (ref.Title != "" || ref.ISBN != "")
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].Confidence > candidates[j].Confidence
+	})
+}
+
+// matchConfidence estimates, from 0 to 1, how likely c describes the same
+// book as ref. Title carries the most weight, then author, then how close
+// the publication years are. A matching ISBN settles it; two different
+// ISBNs suggest another edition and lower the score.
+func matchConfidence(ref matchReference, c metadataCandidate) float64 {
+	var score, weight float64
+	add := func(s, w float64) {
+		score += s * w
+		weight += w
+	}
+
+	switch {
+	case ref.Title != "":
+		add(titleSimilarity(ref.Title, c.Title), 0.6)
+	case ref.Query != "":
+		// Every query word should appear in the candidate, and every
+		// title word in the query, so "Dune" beats "Dune Messiah".
+		found := tokenContainment(ref.Query, c.Title+" "+c.Author)
+		add((found+tokenContainment(c.Title, ref.Query))/2, 0.6)
+	}
+	if ref.Author != "" {
+		add(authorSimilarity(ref.Author, c.Author), 0.3)
+	}
+	if cy := yearOfDate(c.Date); ref.Year > 0 && cy > 0 {
+		add(yearPlausibility(ref.Year, cy), 0.1)
+	} else if cy > time.Now().Year()+1 {
+		// A publication date in the future is a data error.
+		add(0, 0.1)
+	}
+	if weight > 0 {
+		score /= weight
+	}
+
+	if ref.ISBN != "" && c.Identifier != "" {
+		a, b := isbn13(ref.ISBN), isbn13(c.Identifier)
+		if a != "" && b != "" {
+			if a == b {
+				return 0.9 + 0.1*score
+			}
+			score *= 0.85
+		}
+	}
+	return score
+}
+
+var parenthetical = regexp.MustCompile(`\([^)]*\)|\[[^\]]*\]`)
+
+// titleSimilarity compares titles with and without subtitles and series
+// notes, since providers disagree on whether to include them.
+func titleSimilarity(a, b string) float64 {
+	best := stringSimilarity(a, b)
+	for _, x := range titleVariants(a) {
+		for _, y := range titleVariants(b) {
+			best = math.Max(best, stringSimilarity(x, y))
+		}
+	}
+	return best
+}
+
+// titleVariants is t, t without bracketed notes, and its main title
+// before any subtitle or alternative title ("Frankenstein; or, The Modern
+// Prometheus"), each also without a leading article.
+func titleVariants(t string) []string {
+	out := []string{t}
+	stripped := strings.TrimSpace(parenthetical.ReplaceAllString(t, ""))
+	out = append(out, stripped)
+	if i := strings.IndexAny(stripped, ":;"); i > 0 {
+		out = append(out, stripped[:i])
+	}
+	if i := strings.Index(strings.ToLower(stripped), ", or "); i > 0 {
+		out = append(out, stripped[:i])
+	}
+	for _, v := range out {
+		n := normalizeForMatch(v)
+		for _, article := range []string{"the ", "a ", "an "} {
+			if rest, ok := strings.CutPrefix(n, article); ok {
+				out = append(out, rest)
+			}
+		}
+	}
+	return out
+}
+
+// authorSimilarity treats a shared surname as a strong match, so "Tolkien,
+// J.R.R." and "J. R. R. Tolkien" agree.
+func authorSimilarity(a, b string) float64 {
+	if b == "" {
+		return 0
+	}
+	s := stringSimilarity(a, b)
+	if sa := surname(a); sa != "" && sa == surname(b) {
+		s = math.Max(s, 0.9)
+	}
+	return s
+}
+
+// stringSimilarity is the better of edit-distance similarity and token
+// overlap between the normalized strings.
+func stringSimilarity(a, b string) float64 {
+	na, nb := normalizeForMatch(a), normalizeForMatch(b)
+	if na == "" || nb == "" {
+		return 0
+	}
+	if na == nb {
+		return 1
+	}
+	return math.Max(levenshteinRatio(na, nb), tokenDice(na, nb))
+}
+
+// normalizeForMatch lower-cases s, strips accents and punctuation, and
+// collapses spaces.
+func normalizeForMatch(s string) string {
+	var b strings.Builder
+	space := false
+	for _, r := range norm.NFD.String(strings.ToLower(s)) {
+		switch {
+		case unicode.Is(unicode.Mn, r):
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			if space && b.Len() > 0 {
+				b.WriteByte(' ')
+			}
+			b.WriteRune(r)
+			space = false
+		default:
+			space = true
+		}
+	}
+	return b.String()
+}
+
+func levenshteinRatio(a, b string) float64 {
+	ra, rb := []rune(a), []rune(b)
+	longest := max(len(ra), len(rb))
+	if longest == 0 {
+		return 1
+	}
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return 1 - float64(prev[len(rb)])/float64(longest)
+}
+
+func tokenDice(a, b string) float64 {
+	ta, tb := strings.Fields(a), strings.Fields(b)
+	if len(ta) == 0 || len(tb) == 0 {
+		return 0
+	}
+	set := map[string]int{}
+	for _, t := range ta {
+		set[t]++
+	}
+	shared := 0
+	for _, t := range tb {
+		if set[t] > 0 {
+			set[t]--
+			shared++
+		}
+	}
+	return 2 * float64(shared) / float64(len(ta)+len(tb))
+}
+
+// tokenContainment is the share of the query's words found in s.
+func tokenContainment(query, s string) float64 {
+	tq := strings.Fields(normalizeForMatch(query))
+	if len(tq) == 0 {
+		return 0
+	}
+	have := map[string]bool{}
+	for _, t := range strings.Fields(normalizeForMatch(s)) {
+		have[t] = true
+	}
+	found := 0
+	for _, t := range tq {
+		if have[t] {
+			found++
+		}
+	}
+	return float64(found) / float64(len(tq))
+}
+
+var yearPattern = regexp.MustCompile(`\b(1[5-9]\d\d|20\d\d)\b`)
+
+// yearOfDate finds a four-digit year in a date such as "2003",
+// "2003-04-01", or "April 1, 2003". It returns 0 if there is none.
+func yearOfDate(date string) int {
+	m := yearPattern.FindString(date)
+	if m == "" {
+		return 0
+	}
+	y, _ := strconv.Atoi(m)
+	return y
+}
+
+// yearPlausibility is 1 for the same year, falling off as editions and
+// reprints drift apart.
+func yearPlausibility(a, b int) float64 {
+	switch d := max(a-b, b-a); {
+	case d <= 1:
+		return 1
+	case d <= 5:
+		return 0.7
+	case d <= 20:
+		return 0.4
+	default:
+		return 0.1
+	}
+}
+
+// isbn13 converts an ISBN-10 or ISBN-13 to ISBN-13 so editions compare
+// equal however they are written. It returns "" for anything whose check
+// digit is wrong, such as a UUID identifier that happens to hold digits.
+func isbn13(raw string) string {
+	v := normalizeISBN(raw)
+	switch len(v) {
+	case 13:
+		if !strings.ContainsRune(v, 'X') && isbn13CheckDigit(v[:12]) == v[12:] {
+			return v
+		}
+	case 10:
+		sum := 0
+		for i, r := range v {
+			d := int(r - '0')
+			if r == 'X' {
+				d = 10
+			}
+			sum += d * (10 - i)
+		}
+		if sum%11 == 0 {
+			return "978" + v[:9] + isbn13CheckDigit("978"+v[:9])
+		}
+	}
+	return ""
+}
+
+func isbn13CheckDigit(first12 string) string {
+	sum := 0
+	for i, r := range first12 {
+		d := int(r - '0')
+		if i%2 == 1 {
+			d *= 3
+		}
+		sum += d
+	}
+	return strconv.Itoa((10 - sum%10) % 10)
+}
@@ -1,8 +1,9 @@
 package web
 
 import (
-	"bytes"
+	"context"
 	"crypto/rand"
+	"crypto/sha256"
 	"database/sql"
 	"embed"
 	"encoding/base64"
@@ -11,11 +12,11 @@ import (
 	"errors"
 	"fmt"
 	"html"
-	"image"
 	"io"
 	"io/fs"
-	"log"
+	"log/slog"
 	"net/http"
+	"net/netip"
 	"net/url"
 	"os"
 	"path/filepath"
@@ -23,41 +24,103 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/ab0oo/gopds/internal/database"
+	"github.com/ab0oo/gopds/internal/diagnostics"
+	"github.com/ab0oo/gopds/internal/epubcheck"
+	"github.com/ab0oo/gopds/internal/genres"
+	"github.com/ab0oo/gopds/internal/i18n"
+	"github.com/ab0oo/gopds/internal/jobs"
+	"github.com/ab0oo/gopds/internal/mail"
+	"github.com/ab0oo/gopds/internal/metrics"
 	"github.com/ab0oo/gopds/internal/scanner"
+	"github.com/ab0oo/gopds/internal/settings"
+	"github.com/ab0oo/gopds/internal/storage"
+	"github.com/ab0oo/gopds/internal/webhooks"
 	"github.com/go-chi/chi/middleware"
 	"github.com/go-chi/chi/v5"
 )
 
 type Server struct {
-	db   *database.DB
-	uiFS embed.FS
-
-	rebuildMu    sync.Mutex
-	rebuildState rebuildStatus
-
-	adminUser string
-	adminPass string
-
-	sessionMu sync.Mutex
-	sessions  map[string]authSession
-}
-
-type authSession struct {
-	Username  string
-	ExpiresAt time.Time
+	db *database.DB
+	// ui is the web UI's files; see uiFromEnv.
+	ui fs.FS
+
+	jobs     *jobs.Manager
+	hooks    *webhooks.Dispatcher
+	settings *settings.Store
+	genres   *genres.Mapper
+	// scanBeat is the UnixNano time the running scan last made progress.
+	scanBeat atomic.Int64
+	// library is whether the library root could be read when last checked.
+	library libraryState
+
+	// counts caches the navigation feeds' book counts, and feeds whole
+	// rendered feeds; both follow the library version, which is re-read
+	// from the database at most once a second (see libraryVersion).
+	counts      *countCache
+	feeds       *feedCache
+	versionMu   sync.Mutex
+	version     int64
+	versionRead time.Time
+	// pageCounts caches estimated page counts for reading statistics, by
+	// book path; see estimatedPages.
+	pageCounts sync.Map
+
+	basicCache *basicAuthCache
+	oidc       *oidcClient
+	ldap       *ldapAuthenticator
+	proxyAuth  *proxyAuth
+	mailer     *mail.Mailer
+	// upstream carries every request to external metadata and cover
+	// providers.
+	upstream *http.Client
+	// hardcoverToken authorizes Hardcover lookups; empty leaves Hardcover
+	// out.
+	hardcoverToken string
+	douban         doubanAPI
+	googleBooksKey string
+	// diagnostics re-runs the startup checks for /api/admin/diagnostics.
+	diagnostics *diagnostics.Checker
+	// trustedProxies may set X-Forwarded-* headers.
+	trustedProxies []netip.Prefix
+
+	loginLimiter    *rateLimiter
+	loginGuard      *loginGuard
+	searchLimiter   *rateLimiter
+	downloadLimiter *rateLimiter
 }
 
 type loginRequest struct {
 	Username string `json:"username"`
 	Password string `json:"password"`
+	// Code is required for accounts with two-factor authentication: an
+	// authenticator code or an unused recovery code.
+	Code string `json:"code,omitempty"`
 }
 
 type authStatusPayload struct {
-	Authenticated bool   `json:"authenticated"`
-	Username      string `json:"username,omitempty"`
+	Authenticated bool     `json:"authenticated"`
+	Username      string   `json:"username,omitempty"`
+	Role          string   `json:"role,omitempty"`
+	Scopes        []string `json:"scopes,omitempty"`
+	// OIDCEnabled tells the login form to offer single sign-on.
+	OIDCEnabled bool `json:"oidc_enabled,omitempty"`
+	// TOTPRequired is set on a 401 from login when the password was right
+	// but a two-factor code is needed.
+	TOTPRequired bool `json:"totp_required,omitempty"`
+	// Public says what anonymous visitors may do, so the UI can ask them to
+	// log in instead of showing errors.
+	Public *publicAccess `json:"public,omitempty"`
+}
+
+type publicAccess struct {
+	Browse    bool `json:"browse"`
+	Covers    bool `json:"covers"`
+	Downloads bool `json:"downloads"`
+	API       bool `json:"api"`
 }
 
 const (
@@ -66,6 +129,7 @@ const (
 )
 
 type rebuildStatus struct {
+	JobID       int64     `json:"job_id,omitempty"`
 	Running     bool      `json:"running"`
 	Operation   string    `json:"operation"`
 	Phase       string    `json:"phase"`
@@ -74,6 +138,9 @@ type rebuildStatus struct {
 	CompletedAt time.Time `json:"completed_at,omitempty"`
 	Count       int       `json:"count"`
 	Error       string    `json:"error,omitempty"`
+	// Library is whether the library root could be read when last
+	// checked; scans are paused while it can't.
+	Library *libraryStatus `json:"library,omitempty"`
 }
 
 type metadataRequest struct {
@@ -102,6 +169,18 @@ type metadataCandidate struct {
 	Series      string   `json:"series"`
 	SeriesIndex string   `json:"series_index"`
 	Key         string   `json:"key"`
+	// Rating is the provider's average reader rating out of 5, where it
+	// has one.
+	Rating       float64 `json:"rating,omitempty"`
+	RatingsCount int     `json:"ratings_count,omitempty"`
+	// AuthorInfo is the author's canonical name and birth year from
+	// Wikidata.
+	AuthorInfo *database.AuthorInfo `json:"author_info,omitempty"`
+	// Confidence is how closely the candidate matches the book being
+	// looked up, from 0 to 1. AutoApply marks candidates confident enough
+	// to apply without review.
+	Confidence float64 `json:"confidence"`
+	AutoApply  bool    `json:"auto_apply"`
 }
 
 type metadataSearchPayload struct {
@@ -121,6 +200,10 @@ type coverCandidate struct {
 	Source     string `json:"source"`
 	Remote     bool   `json:"remote"`
 	ImageURL   string `json:"image_url,omitempty"`
+	// Hash is the image's perceptual hash, in hex. SameAsCurrent marks
+	// candidates that look the same as the book's current cover.
+	Hash          string `json:"phash,omitempty"`
+	SameAsCurrent bool   `json:"same_as_current,omitempty"`
 }
 
 type updateCoverRequest struct {
@@ -129,6 +212,25 @@ type updateCoverRequest struct {
 	ImageURL    string `json:"image_url,omitempty"`
 }
 
+type coverCandidatesPayload struct {
+	BookID     int              `json:"book_id"`
+	Candidates []coverCandidate `json:"candidates"`
+}
+
+type coverUpdatePayload struct {
+	OK          bool `json:"ok"`
+	BookID      int  `json:"book_id"`
+	WroteToEPUB bool `json:"wrote_to_epub"`
+	// SameAsPrevious reports that the new cover looks the same as the one
+	// it replaced.
+	SameAsPrevious bool `json:"same_as_previous"`
+}
+
+type bookMetadataPayload struct {
+	BookID int `json:"book_id"`
+	*scanner.EPUBMetadata
+}
+
 type openLibrarySearchResponse struct {
 	NumFound int `json:"numFound"`
 	Docs     []struct {
@@ -219,58 +321,183 @@ func (f *flexText) UnmarshalJSON(data []byte) error {
 	return nil
 }
 
-func NewServer(db *database.DB, uiFS embed.FS) *Server {
-	adminUser := strings.TrimSpace(os.Getenv("ADMIN_USERNAME"))
-	if adminUser == "" {
-		adminUser = "admin"
-	}
-	adminPass := os.Getenv("ADMIN_PASSWORD")
-	if strings.TrimSpace(adminPass) == "" {
-		log.Printf("warning: ADMIN_PASSWORD is empty; authenticated features are disabled until it is set")
-	}
-
-	return &Server{
-		db:        db,
-		uiFS:      uiFS,
-		adminUser: adminUser,
-		adminPass: adminPass,
-		sessions:  make(map[string]authSession),
+func NewServer(db *database.DB, uiFS embed.FS, jobManager *jobs.Manager, hooks *webhooks.Dispatcher, upstream *http.Client, checker *diagnostics.Checker, genreMap *genres.Mapper) *Server {
+	seedAdminUser(db)
+
+	s := &Server{
+		db:             db,
+		jobs:           jobManager,
+		hooks:          hooks,
+		settings:       settings.New(db),
+		genres:         genreMap,
+		basicCache:     newBasicAuthCache(),
+		counts:         newCountCache(),
+		feeds:          newFeedCacheFromEnv(),
+		oidc:           newOIDCFromEnv(),
+		ldap:           newLDAPFromEnv(),
+		proxyAuth:      newProxyAuthFromEnv(),
+		mailer:         mail.FromEnv(),
+		googleBooksKey: googleBooksKeyFromEnv(),
+		hardcoverToken: hardcoverTokenFromEnv(),
+		douban:         doubanFromEnv(),
+		diagnostics:    checker,
+
+		loginLimiter:    newRateLimiterFromEnv("login", "RATE_LIMIT_LOGIN", 10),
+		loginGuard:      newLoginGuardFromEnv(),
+		searchLimiter:   newRateLimiterFromEnv("search", "RATE_LIMIT_SEARCH", 30),
+		downloadLimiter: newRateLimiterFromEnv("download", "RATE_LIMIT_DOWNLOAD", 120),
+	}
+	s.trustedProxies = trustedProxiesFromEnv(s.proxyAuth)
+	s.upstream = s.withProviderQuotas(upstream)
+	ui, err := uiFromEnv(uiFS)
+	if err != nil {
+		slog.Error("embedded UI is missing web/ui", "err", err)
+		os.Exit(1)
 	}
+	s.ui = ui
+	s.registerJobHandlers()
+	s.registerMetrics()
+	return s
 }
 
 func (s *Server) Router() http.Handler {
 	r := chi.NewRouter()
-	r.Use(middleware.Logger)
+	r.Use(s.forwardedHeaders)
+	r.Use(requestLogger)
 	r.Use(middleware.Recoverer)
-
-	publicFS, err := fs.Sub(s.uiFS, "web/ui")
-	if err != nil {
-		log.Fatalf("FS Sub Error: %v", err)
-	}
-
-	r.Get("/opds", s.HandleCatalog)
-	r.Get("/opds/authors", s.HandleAuthorsCatalog)
-	r.Get("/opds/categories", s.HandleCategoriesCatalog)
+	r.Use(instrumentRequests)
+	r.Use(s.basicAuthGate)
+	r.Use(s.limitBodies)
+
+	r.Get("/opds", s.requirePublic(settings.PublicBrowse, s.cacheFeed(s.HandleCatalog)))
+	r.Get("/opds/authors", s.requirePublic(settings.PublicBrowse, s.cacheFeed(s.HandleAuthorsCatalog)))
+	r.Get("/opds/categories", s.requirePublic(settings.PublicBrowse, s.cacheFeed(s.HandleCategoriesCatalog)))
+	r.Get("/opds/genres", s.requirePublic(settings.PublicBrowse, s.cacheFeed(s.HandleGenresCatalog)))
+	r.Get("/opds/books/{id}/similar", s.requirePublic(settings.PublicBrowse, s.cacheFeed(s.HandleSimilarCatalog)))
+	r.Get("/opds/popular", s.requirePublic(settings.PublicBrowse, s.HandlePopularCatalog))
+	r.Get("/opds/top-rated", s.requirePublic(settings.PublicBrowse, s.HandleTopRatedCatalog))
+	r.Get("/opds/shelves", s.requireScope(scopeOPDS, s.HandleShelvesCatalog))
+	r.Get("/opds/shelves/{shelfID}", s.requireScope(scopeOPDS, s.HandleShelfCatalog))
+	r.Get("/opds/continue", s.requireScope(scopeOPDS, s.HandleContinueReading))
+	r.Get("/rss/new", s.requirePublic(settings.PublicBrowse, s.HandleNewAdditionsRSS))
 	r.Get("/", s.HandleRoot)
+	r.Get("/healthz", s.HandleHealthz)
+	r.Get("/readyz", s.HandleReadyz)
+	r.Get("/metrics", s.HandleMetrics)
+	r.Get("/api/openapi.json", s.HandleOpenAPI)
+	r.Get("/api/docs", s.HandleAPIDocs)
 	r.Get("/favicon.ico", func(w http.ResponseWriter, _ *http.Request) { w.WriteHeader(http.StatusNoContent) })
 	r.Get("/api/auth/status", s.HandleAuthStatus)
-	r.Post("/api/auth/login", s.HandleAuthLogin)
+	r.Post("/api/auth/login", s.rateLimit(s.loginLimiter, s.HandleAuthLogin))
 	r.Post("/api/auth/logout", s.HandleAuthLogout)
-	r.Get("/api/books", s.HandleBooksJSON)
-	r.Get("/api/books/{id}/metadata/live", s.requireAuth(s.HandleLiveMetadata))
-	r.Put("/api/books/{id}/metadata", s.requireAuth(s.HandleUpdateMetadata))
-	r.Get("/api/books/{id}/covers/candidates", s.requireAuth(s.HandleCoverCandidates))
-	r.Get("/api/books/{id}/covers/online", s.requireAuth(s.HandleOnlineCoverCandidates))
-	r.Get("/api/books/{id}/covers/candidates/{key}", s.requireAuth(s.HandleCoverCandidateImage))
-	r.Put("/api/books/{id}/cover", s.requireAuth(s.HandleUpdateCover))
-	r.Post("/api/admin/rebuild", s.requireAuth(s.HandleRebuildLibrary))
-	r.Post("/api/admin/rescan", s.requireAuth(s.HandleRescanLibrary))
-	r.Get("/api/admin/rebuild/status", s.requireAuth(s.HandleRebuildStatus))
-	r.Get("/api/openlibrary/search", s.HandleOpenLibrarySearch)
-	r.Get("/covers/{id}.jpg", s.HandleCover)
-	r.Get("/download/{id}", s.HandleDownload)
-
-	r.Handle("/*", http.FileServer(http.FS(publicFS)))
+	r.Post("/api/auth/password", s.HandleChangePassword)
+	r.Post("/api/auth/password/reset", s.rateLimit(s.loginLimiter, s.HandleResetPassword))
+	r.Get("/api/auth/invite", s.rateLimit(s.loginLimiter, s.HandleInviteInfo))
+	r.Post("/api/auth/invite", s.rateLimit(s.loginLimiter, s.HandleAcceptInvite))
+	r.Get("/api/auth/sessions", s.HandleListSessions)
+	r.Delete("/api/auth/sessions", s.HandleRevokeOtherSessions)
+	r.Delete("/api/auth/sessions/{sessionID}", s.HandleRevokeSession)
+	r.Post("/api/auth/totp/enroll", s.rateLimit(s.loginLimiter, s.HandleTOTPEnroll))
+	r.Post("/api/auth/totp/confirm", s.rateLimit(s.loginLimiter, s.HandleTOTPConfirm))
+	r.Post("/api/auth/totp/disable", s.rateLimit(s.loginLimiter, s.HandleTOTPDisable))
+	r.Get("/api/auth/oidc/login", s.rateLimit(s.loginLimiter, s.HandleOIDCLogin))
+	r.Get("/api/auth/oidc/callback", s.HandleOIDCCallback)
+	r.Get("/api/stats", s.requirePublic(settings.PublicAPI, s.HandleStats))
+	r.Get("/api/stats/reading", s.requireScope(scopeOPDS, s.HandleReadingStats))
+	r.Get("/api/stats/timeline", s.requirePublic(settings.PublicAPI, s.HandleTimeline))
+	r.Get("/api/books", s.requirePublic(settings.PublicAPI, s.HandleBooksJSON))
+	r.Get("/api/books/{id}", s.requirePublic(settings.PublicAPI, s.HandleBook))
+	r.Get("/api/books/{id}/similar", s.requirePublic(settings.PublicAPI, s.HandleSimilarBooks))
+	r.Get("/api/genres", s.requirePublic(settings.PublicAPI, s.HandleGenres))
+	r.Get("/api/books/{id}/preview", s.requirePublic(settings.PublicDownloads, s.rateLimit(s.downloadLimiter, s.HandleBookPreview)))
+	r.Get("/api/books/{id}/metadata/live", s.requireScope(scopeMetadata, s.HandleLiveMetadata))
+	r.Get("/api/books/{id}/validate", s.requireScope(scopeMetadata, s.HandleValidateBook))
+	r.Put("/api/books/{id}/metadata", s.requireScope(scopeMetadata, s.HandleUpdateMetadata))
+	r.Get("/api/books/{id}/covers/candidates", s.requireScope(scopeMetadata, s.HandleCoverCandidates))
+	r.Get("/api/books/{id}/covers/online", s.requireScope(scopeMetadata, s.requireOnline(s.rateLimit(s.searchLimiter, s.HandleOnlineCoverCandidates))))
+	r.Get("/api/books/{id}/covers/candidates/{key}", s.requireScope(scopeMetadata, s.HandleCoverCandidateImage))
+	r.Get("/api/covers/proxy", s.requireScope(scopeMetadata, s.requireOnline(s.HandleCoverProxy)))
+	r.Put("/api/books/{id}/cover", s.requireScope(scopeMetadata, s.HandleUpdateCover))
+	r.Get("/api/books/{id}/history", s.requireScope(scopeMetadata, s.HandleBookHistory))
+	r.Get("/api/books/{id}/adult", s.requireScope(scopeAdmin, s.HandleBookAdult))
+	r.Put("/api/books/{id}/adult", s.requireScope(scopeAdmin, s.HandleSetBookAdult))
+	r.Get("/api/books/{id}/history/{entryID}/cover", s.requireScope(scopeMetadata, s.HandleHistoryCoverImage))
+	r.Post("/api/books/{id}/history/{entryID}/revert", s.requireScope(scopeMetadata, s.HandleRevertHistory))
+	r.Post("/api/admin/rebuild", s.requireScope(scopeAdmin, s.HandleRebuildLibrary))
+	r.Post("/api/admin/rescan", s.requireScope(scopeAdmin, s.HandleRescanLibrary))
+	r.Get("/api/admin/rebuild/status", s.requireScope(scopeAdmin, s.HandleRebuildStatus))
+	r.Post("/api/admin/backup", s.requireScope(scopeAdmin, s.HandleBackup))
+	r.Post("/api/admin/integrity", s.requireScope(scopeAdmin, s.HandleCheckIntegrity))
+	r.Get("/api/admin/integrity", s.requireScope(scopeAdmin, s.HandleIntegrityReport))
+	r.Post("/api/admin/purge", s.requireScope(scopeAdmin, s.HandlePurge))
+	r.Post("/api/admin/metadata/fetch", s.requireScope(scopeAdmin, s.requireOnline(s.HandleFetchMetadata)))
+	r.Post("/api/admin/organize", s.requireScope(scopeAdmin, s.HandleOrganize))
+	r.Get("/api/admin/quality", s.requireScope(scopeAdmin, s.HandleQualityReport))
+	r.Get("/api/admin/authors/duplicates", s.requireScope(scopeAdmin, s.HandleAuthorDuplicates))
+	r.Post("/api/admin/authors/merge", s.requireScope(scopeAdmin, s.HandleMergeAuthors))
+	r.Get("/api/admin/authors/merges", s.requireScope(scopeAdmin, s.HandleAuthorMerges))
+	r.Post("/api/admin/authors/merges/{mergeID}/undo", s.requireScope(scopeAdmin, s.HandleUndoAuthorMerge))
+	r.Get("/api/admin/logs", s.requireScope(scopeAdmin, s.HandleAdminLogs))
+	r.Get("/api/admin/diagnostics", s.requireScope(scopeAdmin, s.HandleDiagnostics))
+	r.Get("/api/admin/providers", s.requireScope(scopeAdmin, s.HandleProviders))
+	r.Get("/api/admin/lookup-cache", s.requireScope(scopeAdmin, s.HandleLookupCache))
+	r.Delete("/api/admin/lookup-cache", s.requireScope(scopeAdmin, s.HandleClearLookupCache))
+	r.Get("/api/export", s.requireScope(scopeAdmin, s.HandleExport))
+	r.Post("/api/import/metadata", s.requireScope(scopeAdmin, s.HandleImportMetadata))
+	r.Get("/api/jobs", s.requireScope(scopeAdmin, s.HandleJobs))
+	r.Get("/api/activity", s.requireScope(scopeAdmin, s.HandleActivity))
+	r.Get("/api/jobs/{jobID}", s.requireScope(scopeAdmin, s.HandleJob))
+	r.Post("/api/jobs/{jobID}/cancel", s.requireScope(scopeAdmin, s.HandleCancelJob))
+	r.Get("/api/admin/tokens", s.requireScope(scopeAdmin, s.HandleListTokens))
+	r.Post("/api/admin/tokens", s.requireScope(scopeAdmin, s.HandleCreateToken))
+	r.Delete("/api/admin/tokens/{tokenID}", s.requireScope(scopeAdmin, s.HandleRevokeToken))
+	r.Get("/api/admin/users", s.requireScope(scopeAdmin, s.HandleListUsers))
+	r.Post("/api/admin/users", s.requireScope(scopeAdmin, s.HandleCreateUser))
+	r.Patch("/api/admin/users/{userID}", s.requireScope(scopeAdmin, s.HandleUpdateUser))
+	r.Delete("/api/admin/users/{userID}", s.requireScope(scopeAdmin, s.HandleDeleteUser))
+	r.Post("/api/admin/users/{userID}/password-reset", s.requireScope(scopeAdmin, s.HandleCreatePasswordReset))
+	r.Get("/api/admin/invites", s.requireScope(scopeAdmin, s.HandleListInvites))
+	r.Post("/api/admin/invites", s.requireScope(scopeAdmin, s.HandleCreateInvite))
+	r.Delete("/api/admin/invites/{inviteID}", s.requireScope(scopeAdmin, s.HandleRevokeInvite))
+	r.Get("/api/admin/settings", s.requireScope(scopeAdmin, s.HandleSettings))
+	r.Put("/api/admin/settings", s.requireScope(scopeAdmin, s.HandleUpdateSettings))
+	r.Get("/api/admin/webhooks", s.requireScope(scopeAdmin, s.HandleListWebhooks))
+	r.Post("/api/admin/webhooks", s.requireScope(scopeAdmin, s.HandleCreateWebhook))
+	r.Patch("/api/admin/webhooks/{webhookID}", s.requireScope(scopeAdmin, s.HandleUpdateWebhook))
+	r.Delete("/api/admin/webhooks/{webhookID}", s.requireScope(scopeAdmin, s.HandleDeleteWebhook))
+	r.Post("/api/admin/webhooks/{webhookID}/test", s.requireScope(scopeAdmin, s.HandleTestWebhook))
+	r.Get("/api/shelves", s.requireScope(scopeOPDS, s.HandleListShelves))
+	r.Post("/api/shelves", s.requireScope(scopeOPDS, s.HandleCreateShelf))
+	r.Get("/api/shelves/{shelfID}", s.requireScope(scopeOPDS, s.HandleShelf))
+	r.Patch("/api/shelves/{shelfID}", s.requireScope(scopeOPDS, s.HandleUpdateShelf))
+	r.Delete("/api/shelves/{shelfID}", s.requireScope(scopeOPDS, s.HandleDeleteShelf))
+	r.Put("/api/shelves/{shelfID}/books/{id}", s.requireScope(scopeOPDS, s.HandleAddShelfBook))
+	r.Delete("/api/shelves/{shelfID}/books/{id}", s.requireScope(scopeOPDS, s.HandleRemoveShelfBook))
+	r.Put("/api/shelves/{shelfID}/order", s.requireScope(scopeOPDS, s.HandleReorderShelf))
+	r.Get("/api/annotations", s.requireScope(scopeOPDS, s.HandleListAnnotations))
+	r.Patch("/api/annotations/{annotationID}", s.requireScope(scopeOPDS, s.HandleUpdateAnnotation))
+	r.Delete("/api/annotations/{annotationID}", s.requireScope(scopeOPDS, s.HandleDeleteAnnotation))
+	r.Get("/api/books/{id}/annotations", s.requireScope(scopeOPDS, s.HandleBookAnnotations))
+	r.Post("/api/books/{id}/annotations", s.requireScope(scopeOPDS, s.HandleCreateAnnotation))
+	r.Post("/api/books/{id}/annotations/import", s.requireScope(scopeOPDS, s.HandleImportAnnotations))
+	r.Get("/api/books/{id}/rating", s.requireScope(scopeOPDS, s.HandleBookRating))
+	r.Put("/api/books/{id}/rating", s.requireScope(scopeOPDS, s.HandleRateBook))
+	r.Delete("/api/books/{id}/rating", s.requireScope(scopeOPDS, s.HandleDeleteBookRating))
+	r.Get("/api/digest", s.requireScope(scopeOPDS, s.HandleDigest))
+	r.Put("/api/digest", s.requireScope(scopeOPDS, s.HandleSubscribeDigest))
+	r.Delete("/api/digest", s.requireScope(scopeOPDS, s.HandleUnsubscribeDigest))
+	r.Get("/api/digest/unsubscribe", s.rateLimit(s.loginLimiter, s.HandleDigestUnsubscribeLink))
+	r.Post("/api/digest/unsubscribe", s.rateLimit(s.loginLimiter, s.HandleDigestUnsubscribeLink))
+	r.Post("/users/create", s.rateLimit(s.loginLimiter, s.HandleKosyncCreateUser))
+	r.Get("/users/auth", s.rateLimit(s.loginLimiter, s.HandleKosyncAuth))
+	r.Put("/syncs/progress", s.HandleKosyncUpdateProgress)
+	r.Get("/syncs/progress/{document}", s.HandleKosyncGetProgress)
+	r.Get("/api/openlibrary/search", s.requirePublic(settings.PublicAPI, s.requireOnline(s.rateLimit(s.searchLimiter, s.HandleOpenLibrarySearch))))
+	r.Get("/covers/{id}.jpg", s.requirePublic(settings.PublicCovers, s.HandleCover))
+	r.Get("/download/{id}", s.requirePublic(settings.PublicDownloads, s.rateLimit(s.downloadLimiter, s.HandleDownload)))
+	s.mountDebug(r)
+
+	r.Handle("/*", http.FileServer(http.FS(s.ui)))
 	return r
 }
 
@@ -320,9 +547,9 @@ func (s *Server) HandleCategoriesCatalog(w http.ResponseWriter, r *http.Request)
 		s.handleCategoryBooksFeed(w, r, category, subcategory)
 		return
 	}
-	subCounts, err := s.db.GetSubcategoryCounts(category)
+	subCounts, err := s.db.GetSubcategoryCounts(s.bookFilter(r), category)
 	if err != nil {
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		http.Error(w, i18n.T("Internal Server Error"), http.StatusInternalServerError)
 		return
 	}
 	if len(subCounts) == 0 {
@@ -333,38 +560,72 @@ func (s *Server) HandleCategoriesCatalog(w http.ResponseWriter, r *http.Request)
 }
 
 func (s *Server) handleCatalogNavigation(w http.ResponseWriter, r *http.Request) {
+	counts, err := s.navCounts(s.bookFilter(r))
+	if err != nil {
+		http.Error(w, i18n.T("Internal Server Error"), http.StatusInternalServerError)
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/atom+xml;profile=opds-catalog;kind=navigation;charset=utf-8")
-	fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8"?><feed xmlns="http://www.w3.org/2005/Atom">`)
-	fmt.Fprint(w, `<title>GoPDS Library</title><id>gopds:catalog:root</id>`)
+	fmt.Fprint(w, opdsFeedStart)
+	fmt.Fprintf(w, `<title>%s</title><id>gopds:catalog:root</id>`, html.EscapeString(i18n.T("GoPDS Library")))
 	fmt.Fprintf(w, `<updated>%s</updated>`, time.Now().UTC().Format(time.RFC3339))
 	fmt.Fprint(w, `<link rel="self" href="/opds" type="application/atom+xml;profile=opds-catalog;kind=navigation"/>`)
+	fmt.Fprint(w, fhComplete)
 
-	for _, b := range defaultAuthorBuckets {
-		count, err := s.db.CountBooksByAuthorRange(b.Start, b.End, false)
-		if err != nil {
-			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-			return
-		}
+	for i, b := range defaultAuthorBuckets {
+		count := counts.authors[i]
 		href := fmt.Sprintf("/opds?authors=%s&page=1&limit=100", url.QueryEscape(b.Selector))
 		fmt.Fprintf(w, `
     <entry>
-        <title>Authors %s (%d)</title>
+        <title>%s</title>
         <id>gopds:authors:%s</id>
         <link rel="subsection" href="%s" type="application/atom+xml;profile=opds-catalog;kind=acquisition"/>
-    </entry>`, html.EscapeString(b.Label), count, html.EscapeString(b.Selector), html.EscapeString(href))
+    </entry>`, html.EscapeString(i18n.T("Authors %s (%d)", i18n.T(b.Label), count)), html.EscapeString(b.Selector), html.EscapeString(href))
 	}
-	categoryCounts, err := s.db.GetCategoryCounts()
-	if err == nil && len(categoryCounts) > 0 {
+	if len(counts.categories) > 0 {
 		total := 0
-		for _, c := range categoryCounts {
+		for _, c := range counts.categories {
 			total += c
 		}
 		fmt.Fprintf(w, `
     <entry>
-        <title>Browse by Category (%d)</title>
+        <title>%s</title>
         <id>gopds:categories</id>
         <link rel="subsection" href="/opds/categories" type="application/atom+xml;profile=opds-catalog;kind=navigation"/>
-    </entry>`, total)
+    </entry>`, html.EscapeString(i18n.T("Browse by Category (%d)", total)))
+	}
+	fmt.Fprintf(w, `
+    <entry>
+        <title>%s</title>
+        <id>gopds:genres</id>
+        <link rel="subsection" href="/opds/genres" type="application/atom+xml;profile=opds-catalog;kind=navigation"/>
+    </entry>`, html.EscapeString(i18n.T("Browse by Genre")))
+	fmt.Fprintf(w, `
+    <entry>
+        <title>%s</title>
+        <id>gopds:popular</id>
+        <link rel="subsection" href="/opds/popular" type="application/atom+xml;profile=opds-catalog;kind=acquisition"/>
+    </entry>`, html.EscapeString(i18n.T("Most Popular")))
+	fmt.Fprintf(w, `
+    <entry>
+        <title>%s</title>
+        <id>gopds:top-rated</id>
+        <link rel="subsection" href="/opds/top-rated" type="application/atom+xml;profile=opds-catalog;kind=acquisition"/>
+    </entry>`, html.EscapeString(i18n.T("Top Rated")))
+	if p, ok := s.principal(r); ok && p.has(scopeOPDS) {
+		fmt.Fprintf(w, `
+    <entry>
+        <title>%s</title>
+        <id>gopds:shelves</id>
+        <link rel="subsection" href="/opds/shelves" type="application/atom+xml;profile=opds-catalog;kind=navigation"/>
+    </entry>`, html.EscapeString(i18n.T("My Shelves")))
+		fmt.Fprintf(w, `
+    <entry>
+        <title>%s</title>
+        <id>gopds:continue</id>
+        <link rel="subsection" href="/opds/continue" type="application/atom+xml;profile=opds-catalog;kind=acquisition"/>
+    </entry>`, html.EscapeString(i18n.T("Continue Reading")))
 	}
 	fmt.Fprint(w, `</feed>`)
 }
@@ -372,66 +633,49 @@ func (s *Server) handleCatalogNavigation(w http.ResponseWriter, r *http.Request)
 func (s *Server) handleAuthorRangeFeed(w http.ResponseWriter, r *http.Request, selector string) {
 	start, end, label, err := parseAuthorRangeSelector(selector)
 	if err != nil {
-		http.Error(w, "Invalid authors selector. Use authors=a or authors=a-d", http.StatusBadRequest)
+		http.Error(w, i18n.T("Invalid authors selector. Use authors=a or authors=a-d"), http.StatusBadRequest)
 		return
 	}
 
-	page := parseIntDefault(r.URL.Query().Get("page"), 1)
-	if page < 1 {
-		page = 1
-	}
-	limit := parseIntDefault(r.URL.Query().Get("limit"), 100)
-	if limit < 1 {
-		limit = 100
-	}
-	if limit > 250 {
-		limit = 250
-	}
-
-	total, err := s.db.CountBooksByAuthorRange(start, end, false)
+	after, err := afterParam(r)
 	if err != nil {
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		http.Error(w, i18n.T("Invalid after cursor"), http.StatusBadRequest)
 		return
 	}
 
-	lastPage := 1
-	if total > 0 {
-		lastPage = (total + limit - 1) / limit
-	}
-	if page > lastPage {
-		page = lastPage
+	filter := s.bookFilter(r)
+	total, err := s.db.CountBooksByAuthorRange(filter, start, end, false)
+	if err != nil {
+		http.Error(w, i18n.T("Internal Server Error"), http.StatusInternalServerError)
+		return
 	}
-	offset := (page - 1) * limit
+	p := parseFeedPage(r, "/opds?authors="+url.QueryEscape(strings.ToLower(selector)), total)
 
-	books, err := s.db.GetBooksByAuthorRange(start, end, false, limit, offset)
+	books, err := s.db.GetBooksByAuthorRange(filter, start, end, false, p.limit, p.offset(), after)
 	if err != nil {
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		http.Error(w, i18n.T("Internal Server Error"), http.StatusInternalServerError)
 		return
 	}
 
-	base := fmt.Sprintf("/opds?authors=%s&limit=%d", url.QueryEscape(strings.ToLower(selector)), limit)
-	self := fmt.Sprintf("%s&page=%d", base, page)
-	first := fmt.Sprintf("%s&page=1", base)
-	last := fmt.Sprintf("%s&page=%d", base, lastPage)
+	self := p.href(p.page)
+	if after != nil {
+		self += "&after=" + after.String()
+	}
+	if len(books) > 0 {
+		// Walking forward continues from this page's last book, so deep
+		// pages cost the same as the first.
+		p.next = p.href(p.page+1) + "&after=" + database.CursorAfter(books[len(books)-1]).String()
+	}
 
 	w.Header().Set("Content-Type", "application/atom+xml;profile=opds-catalog;kind=acquisition;charset=utf-8")
-	fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8"?><feed xmlns="http://www.w3.org/2005/Atom">`)
-	fmt.Fprintf(w, `<title>GoPDS Library - Authors %s (%d)</title>`, html.EscapeString(label), total)
-	fmt.Fprintf(w, `<id>gopds:authors:%s:page:%d</id>`, html.EscapeString(strings.ToLower(selector)), page)
+	fmt.Fprint(w, opdsFeedStart)
+	fmt.Fprintf(w, `<title>%s</title>`, html.EscapeString(feedTitle(i18n.T("Authors %s (%d)", i18n.T(label), total))))
+	fmt.Fprintf(w, `<id>gopds:authors:%s</id>`, html.EscapeString(strings.ToLower(selector)))
 	fmt.Fprintf(w, `<updated>%s</updated>`, time.Now().UTC().Format(time.RFC3339))
 	fmt.Fprintf(w, `<link rel="self" href="%s" type="application/atom+xml;profile=opds-catalog;kind=acquisition"/>`, html.EscapeString(self))
 	fmt.Fprint(w, `<link rel="start" href="/opds" type="application/atom+xml;profile=opds-catalog;kind=navigation"/>`)
 	fmt.Fprint(w, `<link rel="up" href="/opds" type="application/atom+xml;profile=opds-catalog;kind=navigation"/>`)
-	fmt.Fprintf(w, `<link rel="first" href="%s" type="application/atom+xml;profile=opds-catalog;kind=acquisition"/>`, html.EscapeString(first))
-	fmt.Fprintf(w, `<link rel="last" href="%s" type="application/atom+xml;profile=opds-catalog;kind=acquisition"/>`, html.EscapeString(last))
-	if page > 1 {
-		prev := fmt.Sprintf("%s&page=%d", base, page-1)
-		fmt.Fprintf(w, `<link rel="previous" href="%s" type="application/atom+xml;profile=opds-catalog;kind=acquisition"/>`, html.EscapeString(prev))
-	}
-	if page < lastPage {
-		next := fmt.Sprintf("%s&page=%d", base, page+1)
-		fmt.Fprintf(w, `<link rel="next" href="%s" type="application/atom+xml;profile=opds-catalog;kind=acquisition"/>`, html.EscapeString(next))
-	}
+	p.writeLinks(w)
 
 	for _, b := range books {
 		writeOPDSEntry(w, b)
@@ -440,18 +684,20 @@ func (s *Server) handleAuthorRangeFeed(w http.ResponseWriter, r *http.Request, s
 }
 
 func (s *Server) handleCategoryNavigation(w http.ResponseWriter, r *http.Request) {
-	counts, err := s.db.GetCategoryCounts()
+	nav, err := s.navCounts(s.bookFilter(r))
 	if err != nil {
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		http.Error(w, i18n.T("Internal Server Error"), http.StatusInternalServerError)
 		return
 	}
+	counts := nav.categories
 
 	w.Header().Set("Content-Type", "application/atom+xml;profile=opds-catalog;kind=navigation;charset=utf-8")
-	fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8"?><feed xmlns="http://www.w3.org/2005/Atom">`)
-	fmt.Fprint(w, `<title>GoPDS Library - Categories</title><id>gopds:categories</id>`)
+	fmt.Fprint(w, opdsFeedStart)
+	fmt.Fprintf(w, `<title>%s</title><id>gopds:categories</id>`, html.EscapeString(feedTitle(i18n.T("Categories"))))
 	fmt.Fprintf(w, `<updated>%s</updated>`, time.Now().UTC().Format(time.RFC3339))
 	fmt.Fprint(w, `<link rel="self" href="/opds/categories" type="application/atom+xml;profile=opds-catalog;kind=navigation"/>`)
 	fmt.Fprint(w, `<link rel="start" href="/opds" type="application/atom+xml;profile=opds-catalog;kind=navigation"/>`)
+	fmt.Fprint(w, fhComplete)
 
 	keys := make([]string, 0, len(counts))
 	for k := range counts {
@@ -476,12 +722,13 @@ func (s *Server) handleCategoryNavigation(w http.ResponseWriter, r *http.Request
 
 func (s *Server) handleSubcategoryNavigation(w http.ResponseWriter, r *http.Request, category string, subCounts map[string]int) {
 	w.Header().Set("Content-Type", "application/atom+xml;profile=opds-catalog;kind=navigation;charset=utf-8")
-	fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8"?><feed xmlns="http://www.w3.org/2005/Atom">`)
-	fmt.Fprintf(w, `<title>GoPDS Library - %s</title>`, html.EscapeString(category))
+	fmt.Fprint(w, opdsFeedStart)
+	fmt.Fprintf(w, `<title>%s</title>`, html.EscapeString(feedTitle(category)))
 	fmt.Fprintf(w, `<id>gopds:category:%s</id>`, html.EscapeString(strings.ToLower(category)))
 	fmt.Fprintf(w, `<updated>%s</updated>`, time.Now().UTC().Format(time.RFC3339))
 	fmt.Fprintf(w, `<link rel="self" href="/opds/categories?category=%s" type="application/atom+xml;profile=opds-catalog;kind=navigation"/>`, url.QueryEscape(category))
 	fmt.Fprint(w, `<link rel="up" href="/opds/categories" type="application/atom+xml;profile=opds-catalog;kind=navigation"/>`)
+	fmt.Fprint(w, fhComplete)
 
 	keys := make([]string, 0, len(subCounts))
 	for k := range subCounts {
@@ -490,13 +737,13 @@ func (s *Server) handleSubcategoryNavigation(w http.ResponseWriter, r *http.Requ
 	sort.Slice(keys, func(i, j int) bool { return strings.ToLower(keys[i]) < strings.ToLower(keys[j]) })
 
 	totalHref := fmt.Sprintf("/opds/categories?category=%s&page=1&limit=100", url.QueryEscape(category))
-	totalCount, _ := s.db.CountBooksByCategory(category, "")
+	totalCount, _ := s.db.CountBooksByCategory(s.bookFilter(r), category, "")
 	fmt.Fprintf(w, `
     <entry>
-        <title>All in %s (%d)</title>
+        <title>%s</title>
         <id>gopds:category:%s:all</id>
         <link rel="subsection" href="%s" type="application/atom+xml;profile=opds-catalog;kind=acquisition"/>
-    </entry>`, html.EscapeString(category), totalCount, html.EscapeString(strings.ToLower(category)), html.EscapeString(totalHref))
+    </entry>`, html.EscapeString(i18n.T("All in %s (%d)", category, totalCount)), html.EscapeString(strings.ToLower(category)), html.EscapeString(totalHref))
 
 	for _, sub := range keys {
 		count := subCounts[sub]
@@ -515,67 +762,61 @@ func (s *Server) handleSubcategoryNavigation(w http.ResponseWriter, r *http.Requ
 }
 
 func (s *Server) handleCategoryBooksFeed(w http.ResponseWriter, r *http.Request, category, subcategory string) {
-	page := parseIntDefault(r.URL.Query().Get("page"), 1)
-	if page < 1 {
-		page = 1
-	}
-	limit := parseIntDefault(r.URL.Query().Get("limit"), 100)
-	if limit < 1 {
-		limit = 100
-	}
-	if limit > 250 {
-		limit = 250
+	after, err := afterParam(r)
+	if err != nil {
+		http.Error(w, i18n.T("Invalid after cursor"), http.StatusBadRequest)
+		return
 	}
 
-	total, err := s.db.CountBooksByCategory(category, subcategory)
+	filter := s.bookFilter(r)
+	total, err := s.db.CountBooksByCategory(filter, category, subcategory)
 	if err != nil {
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		http.Error(w, i18n.T("Internal Server Error"), http.StatusInternalServerError)
 		return
 	}
-	lastPage := 1
-	if total > 0 {
-		lastPage = (total + limit - 1) / limit
-	}
-	if page > lastPage {
-		page = lastPage
+	base := "/opds/categories?category=" + url.QueryEscape(category)
+	if subcategory != "" {
+		base += "&subcategory=" + url.QueryEscape(subcategory)
 	}
-	offset := (page - 1) * limit
+	p := parseFeedPage(r, base, total)
 
-	books, err := s.db.GetBooksByCategory(category, subcategory, limit, offset)
+	books, err := s.db.GetBooksByCategory(filter, category, subcategory, p.limit, p.offset(), after)
 	if err != nil {
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		http.Error(w, i18n.T("Internal Server Error"), http.StatusInternalServerError)
 		return
 	}
 
-	base := fmt.Sprintf("/opds/categories?category=%s&limit=%d", url.QueryEscape(category), limit)
-	if subcategory != "" {
-		base += "&subcategory=" + url.QueryEscape(subcategory)
+	self := p.href(p.page)
+	if after != nil {
+		self += "&after=" + after.String()
+	}
+	if len(books) > 0 {
+		// Walking forward continues from this page's last book, so deep
+		// pages cost the same as the first.
+		p.next = p.href(p.page+1) + "&after=" + database.CursorAfter(books[len(books)-1]).String()
 	}
-	self := fmt.Sprintf("%s&page=%d", base, page)
-	first := fmt.Sprintf("%s&page=1", base)
-	last := fmt.Sprintf("%s&page=%d", base, lastPage)
 	title := category
+	// The same ID as the entry in the subcategory navigation feed that
+	// links here.
+	id := strings.ToLower(category) + ":all"
 	if subcategory != "" {
 		title = category + " / " + subcategory
+		id = strings.ToLower(category) + ":" + strings.ToLower(subcategory)
 	}
 
 	w.Header().Set("Content-Type", "application/atom+xml;profile=opds-catalog;kind=acquisition;charset=utf-8")
-	fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8"?><feed xmlns="http://www.w3.org/2005/Atom">`)
-	fmt.Fprintf(w, `<title>GoPDS Library - %s (%d)</title>`, html.EscapeString(title), total)
-	fmt.Fprintf(w, `<id>gopds:category:%s:%d</id>`, html.EscapeString(strings.ToLower(title)), page)
+	fmt.Fprint(w, opdsFeedStart)
+	fmt.Fprintf(w, `<title>%s</title>`, html.EscapeString(feedTitle(fmt.Sprintf("%s (%d)", title, total))))
+	fmt.Fprintf(w, `<id>gopds:category:%s</id>`, html.EscapeString(id))
 	fmt.Fprintf(w, `<updated>%s</updated>`, time.Now().UTC().Format(time.RFC3339))
 	fmt.Fprintf(w, `<link rel="self" href="%s" type="application/atom+xml;profile=opds-catalog;kind=acquisition"/>`, html.EscapeString(self))
 	fmt.Fprint(w, `<link rel="up" href="/opds/categories" type="application/atom+xml;profile=opds-catalog;kind=navigation"/>`)
-	fmt.Fprintf(w, `<link rel="first" href="%s" type="application/atom+xml;profile=opds-catalog;kind=acquisition"/>`, html.EscapeString(first))
-	fmt.Fprintf(w, `<link rel="last" href="%s" type="application/atom+xml;profile=opds-catalog;kind=acquisition"/>`, html.EscapeString(last))
-	if page > 1 {
-		prev := fmt.Sprintf("%s&page=%d", base, page-1)
-		fmt.Fprintf(w, `<link rel="previous" href="%s" type="application/atom+xml;profile=opds-catalog;kind=acquisition"/>`, html.EscapeString(prev))
-	}
-	if page < lastPage {
-		next := fmt.Sprintf("%s&page=%d", base, page+1)
-		fmt.Fprintf(w, `<link rel="next" href="%s" type="application/atom+xml;profile=opds-catalog;kind=acquisition"/>`, html.EscapeString(next))
+	rss := "/rss/new?category=" + url.QueryEscape(category)
+	if subcategory != "" {
+		rss += "&subcategory=" + url.QueryEscape(subcategory)
 	}
+	fmt.Fprintf(w, `<link rel="alternate" href="%s" type="application/rss+xml" title="%s"/>`, html.EscapeString(rss), html.EscapeString(i18n.T("New Additions")))
+	p.writeLinks(w)
 
 	for _, b := range books {
 		writeOPDSEntry(w, b)
@@ -583,13 +824,18 @@ func (s *Server) handleCategoryBooksFeed(w http.ResponseWriter, r *http.Request,
 	fmt.Fprint(w, `</feed>`)
 }
 
+// feedTitle prefixes a feed's own title with the library name.
+func feedTitle(title string) string {
+	return i18n.T("GoPDS Library - %s", title)
+}
+
 func writeOPDSEntry(w io.Writer, b database.Book) {
 	safeTitle := html.EscapeString(b.Title)
 	safeAuthor := html.EscapeString(b.Author)
 	fmt.Fprintf(w, `
     <entry>
         <title>%s</title>
-        <id>%d</id>
+        <id>gopds:book:%d</id>
         <author><name>%s</name></author>`, safeTitle, b.ID, safeAuthor)
 	if strings.TrimSpace(b.Category) != "" {
 		fmt.Fprintf(w, `<category term="%s" label="%s"/>`, html.EscapeString(b.Category), html.EscapeString(b.Category))
@@ -599,9 +845,19 @@ func writeOPDSEntry(w io.Writer, b database.Book) {
 		fmt.Fprintf(w, `<category term="%s" label="%s"/>`, html.EscapeString(label), html.EscapeString(label))
 	}
 	fmt.Fprintf(w, `
-        <link rel="http://opds-spec.org/image" href="/covers/%d.jpg" type="image/jpeg"/>
-        <link rel="http://opds-spec.org/acquisition" href="/download/%d" type="application/epub+zip"/>
-    </entry>`, b.ID, b.ID)
+        <link rel="http://opds-spec.org/image" href="%s" type="image/jpeg"/>`, html.EscapeString(coverURL(b.ID)))
+	if b.Available {
+		fmt.Fprintf(w, `
+        <link rel="http://opds-spec.org/acquisition" href="/download/%d" type="application/epub+zip"/>`, b.ID)
+	} else {
+		// Readers would only get an error for it, so the entry says why
+		// there is nothing to download instead.
+		fmt.Fprintf(w, `
+        <summary>%s</summary>`, html.EscapeString(i18n.T("This book's file is currently unavailable.")))
+	}
+	fmt.Fprintf(w, `
+        <link rel="related" href="/opds/books/%d/similar" type="application/atom+xml;profile=opds-catalog;kind=acquisition" title="%s"/>
+    </entry>`, b.ID, html.EscapeString(i18n.T("Similar books")))
 }
 
 func parseAuthorRangeSelector(selector string) (string, string, string, error) {
@@ -646,51 +902,51 @@ func (s *Server) HandleRoot(w http.ResponseWriter, r *http.Request) {
 		strings.Contains(ua, "thorium")
 
 	if wantsOPDS || r.URL.Query().Get("opds") == "1" {
-		s.HandleCatalog(w, r)
+		s.requirePublic(settings.PublicBrowse, s.cacheFeed(s.HandleCatalog))(w, r)
 		return
 	}
 
-	indexContent, err := s.uiFS.ReadFile("web/ui/index.html")
+	indexContent, err := fs.ReadFile(s.ui, "index.html")
 	if err != nil {
-		http.Error(w, "UI not found", http.StatusInternalServerError)
+		http.Error(w, i18n.T("UI not found"), http.StatusInternalServerError)
 		return
 	}
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
 	_, _ = w.Write(indexContent)
 }
 
-func (s *Server) requireAuth(next http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		if _, ok := s.authenticatedUser(r); !ok {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
-			return
-		}
-		next(w, r)
-	}
-}
-
 func (s *Server) HandleAuthStatus(w http.ResponseWriter, r *http.Request) {
-	username, ok := s.authenticatedUser(r)
+	p, ok := s.principal(r)
+	public := &publicAccess{
+		Browse:    s.settings.Bool(settings.PublicBrowse),
+		Covers:    s.settings.Bool(settings.PublicCovers),
+		Downloads: s.settings.Bool(settings.PublicDownloads),
+		API:       s.settings.Bool(settings.PublicAPI),
+	}
 	w.Header().Set("Content-Type", "application/json")
 	if !ok {
-		_ = json.NewEncoder(w).Encode(authStatusPayload{Authenticated: false})
+		_ = json.NewEncoder(w).Encode(authStatusPayload{Authenticated: false, OIDCEnabled: s.oidc != nil, Public: public})
 		return
 	}
 	_ = json.NewEncoder(w).Encode(authStatusPayload{
 		Authenticated: true,
-		Username:      username,
+		Username:      p.Name,
+		Role:          p.Role,
+		Scopes:        p.Scopes,
+		OIDCEnabled:   s.oidc != nil,
+		Public:        public,
 	})
 }
 
 func (s *Server) HandleAuthLogin(w http.ResponseWriter, r *http.Request) {
-	if strings.TrimSpace(s.adminPass) == "" {
-		http.Error(w, "Authentication is not configured on server", http.StatusServiceUnavailable)
+	if n, err := s.db.CountUsers(); s.ldap == nil && (err != nil || n == 0) {
+		http.Error(w, i18n.T("Authentication is not configured on server"), http.StatusServiceUnavailable)
 		return
 	}
 
 	var req loginRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		http.Error(w, i18n.T("Invalid JSON body"), http.StatusBadRequest)
 		return
 	}
 	req.Username = strings.TrimSpace(req.Username)
@@ -698,24 +954,74 @@ func (s *Server) HandleAuthLogin(w http.ResponseWriter, r *http.Request) {
 		req.Username = "admin"
 	}
 
-	if req.Username != s.adminUser || req.Password != s.adminPass {
-		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+	ip := clientIP(r)
+	if wait := s.loginGuard.wait(req.Username, ip); wait > 0 {
+		refuseLogin(w, r, req.Username, wait)
 		return
 	}
+	user, ok := s.checkPassword(r, req.Username, req.Password)
+	if !ok {
+		s.loginFailed(r, "form", req.Username)
+		http.Error(w, i18n.T("Invalid credentials"), http.StatusUnauthorized)
+		return
+	}
+	if user.TOTPEnabled {
+		if strings.TrimSpace(req.Code) == "" {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusUnauthorized)
+			_ = json.NewEncoder(w).Encode(authStatusPayload{TOTPRequired: true})
+			return
+		}
+		ok, err := s.checkSecondFactor(user, req.Code)
+		if err != nil {
+			http.Error(w, i18n.T("Internal Server Error"), http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			s.loginFailed(r, "totp", user.Username)
+			http.Error(w, i18n.T("Invalid two-factor code"), http.StatusUnauthorized)
+			return
+		}
+	}
+	s.loginGuard.succeed(user.Username)
+	if err := s.startSession(w, r, user); err != nil {
+		http.Error(w, i18n.T("Failed to create session"), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(authStatusPayload{
+		Authenticated: true,
+		Username:      user.Username,
+		Role:          user.Role,
+		Scopes:        roleScopes[user.Role],
+	})
+}
 
+// loginFailed counts a failed login toward throttling and logs it. method
+// is where the credentials were sent: form, totp, basic, or kosync.
+func (s *Server) loginFailed(r *http.Request, method, username string) {
+	loginFailures.Inc(method)
+	slog.WarnContext(r.Context(), "login failed", "method", method, "username", username, "remote", clientIP(r))
+	s.loginGuard.fail(r, username, clientIP(r))
+}
+
+// startSession signs user in on this browser by setting the session cookie.
+func (s *Server) startSession(w http.ResponseWriter, r *http.Request, user *database.User) error {
 	token, err := generateSessionToken()
 	if err != nil {
-		http.Error(w, "Failed to create session", http.StatusInternalServerError)
-		return
+		return err
 	}
+	s.recordLogin(r, user)
 
 	expiresAt := time.Now().UTC().Add(sessionTTL)
-	s.sessionMu.Lock()
-	s.sessions[token] = authSession{
-		Username:  req.Username,
-		ExpiresAt: expiresAt,
+	userAgent := r.UserAgent()
+	if len(userAgent) > 512 {
+		userAgent = userAgent[:512]
+	}
+	if err := s.db.CreateSession(hashSessionToken(token), user.Username, clientIP(r), userAgent, expiresAt); err != nil {
+		return err
 	}
-	s.sessionMu.Unlock()
 
 	http.SetCookie(w, &http.Cookie{
 		Name:     sessionCookieName,
@@ -725,23 +1031,18 @@ func (s *Server) HandleAuthLogin(w http.ResponseWriter, r *http.Request) {
 		SameSite: http.SameSiteLaxMode,
 		Expires:  expiresAt,
 		MaxAge:   int(sessionTTL.Seconds()),
-		Secure:   r.TLS != nil,
-	})
-
-	w.Header().Set("Content-Type", "application/json")
-	_ = json.NewEncoder(w).Encode(authStatusPayload{
-		Authenticated: true,
-		Username:      req.Username,
+		Secure:   isHTTPS(r),
 	})
+	return nil
 }
 
 func (s *Server) HandleAuthLogout(w http.ResponseWriter, r *http.Request) {
 	if c, err := r.Cookie(sessionCookieName); err == nil {
 		token := strings.TrimSpace(c.Value)
 		if token != "" {
-			s.sessionMu.Lock()
-			delete(s.sessions, token)
-			s.sessionMu.Unlock()
+			if _, err := s.db.DeleteSessionByHash(hashSessionToken(token)); err != nil {
+				slog.ErrorContext(r.Context(), "failed to delete session", "err", err)
+			}
 		}
 	}
 
@@ -753,39 +1054,102 @@ func (s *Server) HandleAuthLogout(w http.ResponseWriter, r *http.Request) {
 		SameSite: http.SameSiteLaxMode,
 		MaxAge:   -1,
 		Expires:  time.Unix(0, 0),
-		Secure:   r.TLS != nil,
+		Secure:   isHTTPS(r),
 	})
 
 	w.Header().Set("Content-Type", "application/json")
 	_ = json.NewEncoder(w).Encode(authStatusPayload{Authenticated: false})
 }
 
+// authenticatedUser names whoever r is authenticated as, by session cookie
+// or bearer token.
 func (s *Server) authenticatedUser(r *http.Request) (string, bool) {
-	if strings.TrimSpace(s.adminPass) == "" {
+	p, ok := s.principal(r)
+	return p.Name, ok
+}
+
+func (s *Server) sessionUser(r *http.Request) (string, bool) {
+	sess, ok := s.currentSession(r)
+	if !ok {
 		return "", false
 	}
+	return sess.Username, true
+}
+
+// sessionTouchInterval limits how often a session's last-seen time and IP
+// are written, so browsing doesn't turn every request into a write.
+const sessionTouchInterval = time.Minute
 
+// currentSession returns the session r's cookie belongs to.
+func (s *Server) currentSession(r *http.Request) (*database.Session, bool) {
 	c, err := r.Cookie(sessionCookieName)
 	if err != nil {
-		return "", false
+		return nil, false
 	}
 	token := strings.TrimSpace(c.Value)
 	if token == "" {
-		return "", false
+		return nil, false
 	}
 
 	now := time.Now().UTC()
-	s.sessionMu.Lock()
-	defer s.sessionMu.Unlock()
-	sess, ok := s.sessions[token]
-	if !ok {
-		return "", false
+	sess, err := s.db.GetSessionByHash(hashSessionToken(token), now)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			slog.ErrorContext(r.Context(), "session lookup failed", "err", err)
+		}
+		return nil, false
 	}
-	if now.After(sess.ExpiresAt) {
-		delete(s.sessions, token)
-		return "", false
+	if ip := clientIP(r); now.Sub(sess.LastSeenAt) >= sessionTouchInterval || ip != sess.IP {
+		if err := s.db.TouchSession(sess.ID, ip, now); err != nil {
+			slog.WarnContext(r.Context(), "failed to update session", "err", err)
+		}
+		sess.LastSeenAt, sess.IP = now, ip
+	}
+	return sess, true
+}
+
+// hashSessionToken is what the sessions table stores in place of the cookie
+// value.
+func hashSessionToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// RunMaintenance prunes the tables that only grow, every hour until ctx is
+// cancelled:
+//
+//   - sessions: expired sessions, which are already refused at lookup
+//   - provider_usage: daily request counts older than 30 days
+//   - lookup_cache: expired metadata provider responses
+//   - library_activity: events older than 90 days
+func (s *Server) RunMaintenance(ctx context.Context) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		if n, err := s.db.PruneSessions(time.Now()); err != nil {
+			slog.ErrorContext(ctx, "failed to prune sessions", "err", err)
+		} else if n > 0 {
+			slog.DebugContext(ctx, "pruned expired sessions", "count", n)
+		}
+		if err := s.db.PruneProviderUsage(providerUsageRetention); err != nil {
+			slog.ErrorContext(ctx, "failed to prune provider usage", "err", err)
+		}
+		if n, err := s.db.PruneLookupCache(); err != nil {
+			slog.ErrorContext(ctx, "failed to prune lookup cache", "err", err)
+		} else if n > 0 {
+			slog.DebugContext(ctx, "pruned expired lookups", "count", n)
+		}
+		if n, err := s.db.PruneActivity(activityRetention); err != nil {
+			slog.ErrorContext(ctx, "failed to prune activity", "err", err)
+		} else if n > 0 {
+			slog.DebugContext(ctx, "pruned old activity", "count", n)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
 	}
-	return sess.Username, true
 }
 
 func generateSessionToken() (string, error) {
@@ -796,40 +1160,52 @@ func generateSessionToken() (string, error) {
 	return hex.EncodeToString(buf), nil
 }
 
+// HandleBooksJSON streams the catalog row by row. The format comes from
+// ?format=json|ndjson|csv, or failing that the Accept header; JSON is the
+// default.
 func (s *Server) HandleBooksJSON(w http.ResponseWriter, r *http.Request) {
-	books, err := s.db.GetAllBooks()
-	if err != nil {
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	format := r.URL.Query().Get("format")
+	if strings.TrimSpace(format) == "" {
+		format = formatFromAccept(r.Header.Get("Accept"))
+	}
+	stream, ok := newBookStream(format)
+	if !ok {
+		http.Error(w, i18n.T("Invalid format. Use csv, json, or ndjson"), http.StatusBadRequest)
 		return
 	}
-
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(books); err != nil {
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	w.Header().Add("Vary", "Accept")
+	if sort := r.URL.Query().Get("sort"); sort != "" {
+		s.rankBooks(w, r, stream, sort)
+		return
+	}
+	if r.URL.Query().Has("after") || r.URL.Query().Has("limit") {
+		s.pageBooks(w, r, stream)
+		return
 	}
+	s.streamBooks(w, r, stream)
 }
 
 func (s *Server) HandleLiveMetadata(w http.ResponseWriter, r *http.Request) {
 	id := chi.URLParam(r, "id")
-	book, err := s.db.GetBookByID(id)
+	book, err := s.visibleBook(r, id)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			http.Error(w, "Book not found", http.StatusNotFound)
+			http.Error(w, i18n.T("Book not found"), http.StatusNotFound)
 			return
 		}
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		http.Error(w, i18n.T("Internal Server Error"), http.StatusInternalServerError)
 		return
 	}
 
 	bookPath, err := s.resolveBookPath(book)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to read EPUB metadata: %v", err), http.StatusUnprocessableEntity)
+		http.Error(w, i18n.T("Failed to read EPUB metadata: %v", err), http.StatusUnprocessableEntity)
 		return
 	}
 
 	meta, err := scanner.ExtractLiveMetadata(bookPath)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to read EPUB metadata: %v", err), http.StatusUnprocessableEntity)
+		http.Error(w, i18n.T("Failed to read EPUB metadata: %v", err), http.StatusUnprocessableEntity)
 		return
 	}
 
@@ -837,52 +1213,151 @@ func (s *Server) HandleLiveMetadata(w http.ResponseWriter, r *http.Request) {
 	_ = json.NewEncoder(w).Encode(meta)
 }
 
+// HandleValidateBook checks the book's EPUB structure and returns the
+// report. A book with problems is still a 200; the report says what they are.
+func (s *Server) HandleValidateBook(w http.ResponseWriter, r *http.Request) {
+	book, ok := s.loadBook(w, r)
+	if !ok {
+		return
+	}
+	bookPath, err := s.resolveBookPath(book)
+	if err != nil {
+		http.Error(w, i18n.T("Book file not found"), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(epubcheck.Check(bookPath))
+}
+
 func (s *Server) HandleOpenLibrarySearch(w http.ResponseWriter, r *http.Request) {
 	q := strings.TrimSpace(r.URL.Query().Get("q"))
 	isbn := normalizeISBN(r.URL.Query().Get("isbn"))
+	title := strings.TrimSpace(r.URL.Query().Get("title"))
+	author := strings.TrimSpace(r.URL.Query().Get("author"))
+
+	ref := matchReference{Title: title, Author: author, ISBN: isbn}
+	if id := strings.TrimSpace(r.URL.Query().Get("book_id")); id != "" {
+		book, err := s.visibleBook(r, id)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				http.Error(w, i18n.T("Book not found"), http.StatusNotFound)
+				return
+			}
+			http.Error(w, i18n.T("Internal Server Error"), http.StatusInternalServerError)
+			return
+		}
+		ref = s.bookMatchReference(book, ref)
+	}
 
 	if q == "" {
-		title := strings.TrimSpace(r.URL.Query().Get("title"))
-		author := strings.TrimSpace(r.URL.Query().Get("author"))
 		q = strings.TrimSpace(strings.Join([]string{title, author}, " "))
 	}
+	if ref.Title == "" {
+		ref.Query = q
+	}
 
 	if q == "" && isbn == "" {
-		http.Error(w, "Query or ISBN is required", http.StatusBadRequest)
+		http.Error(w, i18n.T("Query or ISBN is required"), http.StatusBadRequest)
 		return
 	}
 
-	client := &http.Client{Timeout: 12 * time.Second}
+	results := s.searchMetadata(r.Context(), q, isbn, ref)
+	if s.providerAvailable(providerWikidata) {
+		s.enrichWithWikidata(r.Context(), s.upstream, results)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(metadataSearchPayload{
+		NumFound: len(results),
+		Query:    q,
+		Results:  results,
+	})
+}
+
+// searchMetadata looks the book up by ISBN and by the free-text query q in
+// every enabled provider, and returns the merged candidates scored against
+// ref, the likeliest first.
+func (s *Server) searchMetadata(ctx context.Context, q, isbn string, ref matchReference) []metadataCandidate {
+	client := s.upstream
 	results := make([]metadataCandidate, 0, 20)
 
+	useOpenLibrary := s.providerAvailable(providerOpenLibrary)
+	useGoogleBooks := s.providerAvailable(providerGoogleBooks)
+	useHardcover := s.hardcoverToken != "" && s.providerAvailable(providerHardcover)
+	useDouban := s.providerAvailable(providerDouban)
+
 	if isbn != "" {
-		if olByISBN, err := s.fetchOpenLibraryByISBN(client, isbn); err == nil && olByISBN != nil {
-			results = append(results, *olByISBN)
-		} else if err != nil {
-			log.Printf("open library isbn lookup failed (%s): %v", isbn, err)
+		if useOpenLibrary {
+			if olByISBN, err := s.fetchOpenLibraryByISBN(client, isbn); err == nil && olByISBN != nil {
+				results = append(results, *olByISBN)
+			} else if err != nil {
+				slog.WarnContext(ctx, "open library isbn lookup failed", "isbn", isbn, "err", err)
+			}
 		}
 
-		gbByISBN, err := s.fetchGoogleBooks(client, "isbn:"+isbn, 4, "googlebooks:isbn")
-		if err == nil {
-			results = append(results, gbByISBN...)
-		} else {
-			log.Printf("google books isbn lookup failed (%s): %v", isbn, err)
+		if useGoogleBooks {
+			gbByISBN, err := s.fetchGoogleBooks(client, "isbn:"+isbn, 4, "googlebooks:isbn")
+			if err == nil {
+				results = append(results, gbByISBN...)
+			} else {
+				slog.WarnContext(ctx, "google books isbn lookup failed", "isbn", isbn, "err", err)
+			}
+		}
+
+		if useHardcover {
+			if hcByISBN, err := s.fetchHardcoverByISBN(client, isbn); err == nil && hcByISBN != nil {
+				results = append(results, *hcByISBN)
+			} else if err != nil {
+				slog.WarnContext(ctx, "hardcover isbn lookup failed", "isbn", isbn, "err", err)
+			}
+		}
+
+		if useDouban {
+			if dbByISBN, err := s.douban.byISBN(client, isbn); err == nil {
+				results = append(results, dbByISBN.candidate("douban:isbn"))
+			} else {
+				slog.WarnContext(ctx, "douban isbn lookup failed", "isbn", isbn, "err", err)
+			}
 		}
 	}
 
 	if q != "" {
-		olSearch, err := s.searchOpenLibrary(client, q, 8)
-		if err == nil {
-			results = append(results, olSearch...)
-		} else {
-			log.Printf("open library search failed (%s): %v", q, err)
+		if useOpenLibrary {
+			olSearch, err := s.searchOpenLibrary(client, q, 8)
+			if err == nil {
+				results = append(results, olSearch...)
+			} else {
+				slog.WarnContext(ctx, "open library search failed", "query", q, "err", err)
+			}
 		}
 
-		gbSearch, err := s.fetchGoogleBooks(client, q, 6, "googlebooks:search")
-		if err == nil {
-			results = append(results, gbSearch...)
-		} else {
-			log.Printf("google books search failed (%s): %v", q, err)
+		if useGoogleBooks {
+			gbSearch, err := s.fetchGoogleBooks(client, q, 6, "googlebooks:search")
+			if err == nil {
+				results = append(results, gbSearch...)
+			} else {
+				slog.WarnContext(ctx, "google books search failed", "query", q, "err", err)
+			}
+		}
+
+		if useHardcover {
+			hcSearch, err := s.searchHardcover(client, q, 6)
+			if err == nil {
+				results = append(results, hcSearch...)
+			} else {
+				slog.WarnContext(ctx, "hardcover search failed", "query", q, "err", err)
+			}
+		}
+
+		if useDouban {
+			dbSearch, err := s.douban.search(client, q, 6)
+			if err == nil {
+				for _, b := range dbSearch {
+					results = append(results, b.candidate("douban:search"))
+				}
+			} else {
+				slog.WarnContext(ctx, "douban search failed", "query", q, "err", err)
+			}
 		}
 	}
 
@@ -890,13 +1365,8 @@ func (s *Server) HandleOpenLibrarySearch(w http.ResponseWriter, r *http.Request)
 	if len(results) > 20 {
 		results = results[:20]
 	}
-
-	w.Header().Set("Content-Type", "application/json")
-	_ = json.NewEncoder(w).Encode(metadataSearchPayload{
-		NumFound: len(results),
-		Query:    q,
-		Results:  results,
-	})
+	scoreCandidates(ref, results, float64(s.settings.Int(settings.AutoApplyConfidence))/100)
+	return results
 }
 
 func (s *Server) searchOpenLibrary(client *http.Client, q string, limit int) ([]metadataCandidate, error) {
@@ -1103,6 +1573,9 @@ func applyOutboundHeaders(req *http.Request) {
 	// Wikimedia APIs require a descriptive User-Agent; reuse this for all upstream lookups.
 	req.Header.Set("User-Agent", "GoPDS/1.0 (+https://github.com/ab0oo/gopds)")
 	req.Header.Set("Accept", "application/json, image/*;q=0.9, */*;q=0.8")
+	if isDoubanImageHost(req.URL.Hostname()) {
+		req.Header.Set("Referer", "https://book.douban.com/")
+	}
 }
 
 func dedupeAndMergeCandidates(in []metadataCandidate) []metadataCandidate {
@@ -1165,6 +1638,17 @@ func mergeCandidates(base, incoming metadataCandidate) metadataCandidate {
 	if strings.TrimSpace(base.Key) == "" {
 		base.Key = incoming.Key
 	}
+	if base.AuthorInfo == nil {
+		base.AuthorInfo = incoming.AuthorInfo
+	}
+	if strings.TrimSpace(base.Series) == "" {
+		base.Series = incoming.Series
+		base.SeriesIndex = incoming.SeriesIndex
+	}
+	if incoming.RatingsCount > base.RatingsCount {
+		base.Rating = incoming.Rating
+		base.RatingsCount = incoming.RatingsCount
+	}
 	if strings.HasPrefix(base.Source, "openlibrary") && strings.HasPrefix(incoming.Source, "googlebooks") {
 		return base
 	}
@@ -1271,25 +1755,25 @@ func mergeSubjects(a []string, b []string) []string {
 func (s *Server) HandleUpdateMetadata(w http.ResponseWriter, r *http.Request) {
 	id := chi.URLParam(r, "id")
 
-	book, err := s.db.GetBookByID(id)
+	book, err := s.visibleBook(r, id)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			http.Error(w, "Book not found", http.StatusNotFound)
+			http.Error(w, i18n.T("Book not found"), http.StatusNotFound)
 			return
 		}
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		http.Error(w, i18n.T("Internal Server Error"), http.StatusInternalServerError)
 		return
 	}
 
 	bookPath, err := s.resolveBookPath(book)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to update EPUB metadata: %v", err), http.StatusUnprocessableEntity)
+		http.Error(w, i18n.T("Failed to update EPUB metadata: %v", err), http.StatusUnprocessableEntity)
 		return
 	}
 
 	var req metadataRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		http.Error(w, i18n.T("Invalid JSON body"), http.StatusBadRequest)
 		return
 	}
 
@@ -1304,14 +1788,15 @@ func (s *Server) HandleUpdateMetadata(w http.ResponseWriter, r *http.Request) {
 	req.SeriesIndex = strings.TrimSpace(req.SeriesIndex)
 
 	if req.Title == "" {
-		http.Error(w, "Title cannot be empty", http.StatusBadRequest)
+		http.Error(w, i18n.T("Title cannot be empty"), http.StatusBadRequest)
 		return
 	}
 	if req.Author == "" {
 		req.Author = "Unknown Author"
 	}
 
-	meta, err := scanner.UpdateEPUBMetadata(bookPath, scanner.MetadataUpdate{
+	before, _ := scanner.ExtractLiveMetadata(bookPath)
+	meta, err := s.applyMetadataUpdate(book, bookPath, scanner.MetadataUpdate{
 		Title:       req.Title,
 		Creator:     req.Author,
 		Language:    req.Language,
@@ -1324,28 +1809,45 @@ func (s *Server) HandleUpdateMetadata(w http.ResponseWriter, r *http.Request) {
 		SeriesIndex: req.SeriesIndex,
 	})
 	if err != nil {
-		if errors.Is(err, os.ErrPermission) {
-			http.Error(w, "Write permission denied for EPUB file", http.StatusForbidden)
-			return
-		}
-		if errors.Is(err, scanner.ErrMetadataTagNotFound()) {
-			http.Error(w, "Unable to locate metadata tags in EPUB", http.StatusUnprocessableEntity)
-			return
-		}
-		log.Printf("metadata update error for %s: %v", bookPath, err)
-		http.Error(w, "Failed to update EPUB metadata", http.StatusUnprocessableEntity)
+		writeMetadataUpdateError(w, r, bookPath, err)
 		return
 	}
+	s.recordMetadataChange(r, book.ID, before, meta, 0)
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(bookMetadataPayload{
+		BookID:       book.ID,
+		EPUBMetadata: meta,
+	})
+}
+
+var (
+	errModTimeUnavailable  = errors.New("metadata saved but failed to read file mod time")
+	errMetadataCacheUpdate = errors.New("failed to update metadata cache")
+)
+
+// applyMetadataUpdate writes metadata into the EPUB and refreshes the cached
+// row. The returned metadata is what was read back from the rewritten file.
+func (s *Server) applyMetadataUpdate(book *database.Book, bookPath string, update scanner.MetadataUpdate) (*scanner.EPUBMetadata, error) {
+	return ApplyMetadataUpdate(s.db, s.genres, book, bookPath, update)
+}
+
+// ApplyMetadataUpdate is applyMetadataUpdate for the meta command, which
+// has no server.
+func ApplyMetadataUpdate(db *database.DB, genreMap *genres.Mapper, book *database.Book, bookPath string, update scanner.MetadataUpdate) (*scanner.EPUBMetadata, error) {
+	meta, err := scanner.UpdateEPUBMetadata(bookPath, update)
+	if err != nil {
+		return nil, err
+	}
 
 	info, statErr := os.Stat(bookPath)
 	if statErr != nil {
-		http.Error(w, "Metadata saved but failed to read file mod time", http.StatusInternalServerError)
-		return
+		return nil, errModTimeUnavailable
 	}
 
-	title := req.Title
-	author := req.Author
-	description := req.Description
+	title := update.Title
+	author := update.Creator
+	description := update.Description
 	if meta != nil {
 		if strings.TrimSpace(meta.Title) != "" {
 			title = strings.TrimSpace(meta.Title)
@@ -1356,45 +1858,96 @@ func (s *Server) HandleUpdateMetadata(w http.ResponseWriter, r *http.Request) {
 		description = strings.TrimSpace(meta.Description)
 	}
 
-	if err := s.db.UpdateBookMetadata(book.ID, title, author, description, info.ModTime()); err != nil {
-		http.Error(w, "Failed to update metadata cache", http.StatusInternalServerError)
-		return
+	if err := db.UpdateBookMetadata(book.ID, title, author, description, info.ModTime()); err != nil {
+		return nil, errMetadataCacheUpdate
 	}
+	if meta != nil {
+		if err := db.UpdateBookSeries(book.ID, strings.TrimSpace(meta.Series), strings.TrimSpace(meta.SeriesIndex)); err != nil {
+			return nil, errMetadataCacheUpdate
+		}
+		if err := db.SetBookSubjects(book.ID, meta.Subjects, genreMap.Adult(meta.Subjects)); err != nil {
+			return nil, errMetadataCacheUpdate
+		}
+		if err := db.SetBookISBN(book.ID, scanner.ParseISBN(meta.Identifier)); err != nil {
+			return nil, errMetadataCacheUpdate
+		}
+	}
+	refreshBookHash(db, book.ID, bookPath)
 
-	w.Header().Set("Content-Type", "application/json")
 	if meta == nil {
 		meta = &scanner.EPUBMetadata{}
 	}
-	_ = json.NewEncoder(w).Encode(struct {
-		BookID int `json:"book_id"`
-		*scanner.EPUBMetadata
-	}{
-		BookID:       book.ID,
-		EPUBMetadata: meta,
-	})
+	return meta, nil
+}
+
+// refreshBookHash recomputes the stored content hashes after the EPUB has
+// been rewritten, so integrity checks don't flag our own edits and KOReader
+// progress for the new file maps back to the book.
+func (s *Server) refreshBookHash(bookID int, bookPath string) {
+	refreshBookHash(s.db, bookID, bookPath)
+}
+
+func refreshBookHash(db *database.DB, bookID int, bookPath string) {
+	hash, err := scanner.HashFile(bookPath)
+	if err != nil {
+		slog.Error("failed to hash book", "book_id", bookID, "path", bookPath, "err", err)
+		return
+	}
+	if err := db.UpdateBookFileHash(bookID, hash); err != nil {
+		slog.Error("failed to store file hash", "book_id", bookID, "err", err)
+	}
+	if partial, err := scanner.PartialMD5(bookPath); err == nil {
+		if err := db.SetBookPartialMD5(bookID, partial); err != nil {
+			slog.Error("failed to store partial md5", "book_id", bookID, "err", err)
+		}
+	}
+}
+
+func writeMetadataUpdateError(w http.ResponseWriter, r *http.Request, bookPath string, err error) {
+	switch {
+	case errors.Is(err, storage.ErrReadOnly):
+		http.Error(w, i18n.T("Books in remote libraries are read-only"), http.StatusConflict)
+	case errors.Is(err, os.ErrPermission):
+		http.Error(w, i18n.T("Write permission denied for EPUB file"), http.StatusForbidden)
+	case errors.Is(err, scanner.ErrMetadataTagNotFound()):
+		http.Error(w, i18n.T("Unable to locate metadata tags in EPUB"), http.StatusUnprocessableEntity)
+	case errors.Is(err, errModTimeUnavailable):
+		http.Error(w, i18n.T("Metadata saved but failed to read file mod time"), http.StatusInternalServerError)
+	case errors.Is(err, errMetadataCacheUpdate):
+		http.Error(w, i18n.T("Failed to update metadata cache"), http.StatusInternalServerError)
+	default:
+		slog.ErrorContext(r.Context(), "metadata update failed", "path", bookPath, "err", err)
+		http.Error(w, i18n.T("Failed to update EPUB metadata"), http.StatusUnprocessableEntity)
+	}
 }
 
 func (s *Server) HandleCoverCandidates(w http.ResponseWriter, r *http.Request) {
 	id := chi.URLParam(r, "id")
-	book, err := s.db.GetBookByID(id)
+	book, err := s.visibleBook(r, id)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			http.Error(w, "Book not found", http.StatusNotFound)
+			http.Error(w, i18n.T("Book not found"), http.StatusNotFound)
 			return
 		}
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		http.Error(w, i18n.T("Internal Server Error"), http.StatusInternalServerError)
 		return
 	}
 
 	bookPath, err := s.resolveBookPath(book)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to locate EPUB: %v", err), http.StatusUnprocessableEntity)
+		http.Error(w, i18n.T("Failed to locate EPUB: %v", err), http.StatusUnprocessableEntity)
 		return
 	}
 
-	options, err := scanner.ListCoverOptions(bookPath)
+	epub, err := scanner.OpenEPUB(bookPath)
+	if err != nil {
+		http.Error(w, i18n.T("Failed to list cover candidates: %v", err), http.StatusUnprocessableEntity)
+		return
+	}
+	defer epub.Close()
+	options, err := epub.CoverOptions()
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to list cover candidates: %v", err), http.StatusUnprocessableEntity)
+		http.Error(w, i18n.T("Failed to list cover candidates: %v", err), http.StatusUnprocessableEntity)
 		return
 	}
 
@@ -1413,12 +1966,11 @@ func (s *Server) HandleCoverCandidates(w http.ResponseWriter, r *http.Request) {
 			Remote:     false,
 		})
 	}
+	current, hasCurrent := currentCoverHash(book.ID)
+	out = dedupeCoverCandidates(out, current, hasCurrent, s.readCoverCandidate(epub))
 
 	w.Header().Set("Content-Type", "application/json")
-	_ = json.NewEncoder(w).Encode(struct {
-		BookID     int              `json:"book_id"`
-		Candidates []coverCandidate `json:"candidates"`
-	}{
+	_ = json.NewEncoder(w).Encode(coverCandidatesPayload{
 		BookID:     book.ID,
 		Candidates: out,
 	})
@@ -1426,19 +1978,19 @@ func (s *Server) HandleCoverCandidates(w http.ResponseWriter, r *http.Request) {
 
 func (s *Server) HandleOnlineCoverCandidates(w http.ResponseWriter, r *http.Request) {
 	id := chi.URLParam(r, "id")
-	book, err := s.db.GetBookByID(id)
+	book, err := s.visibleBook(r, id)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			http.Error(w, "Book not found", http.StatusNotFound)
+			http.Error(w, i18n.T("Book not found"), http.StatusNotFound)
 			return
 		}
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		http.Error(w, i18n.T("Internal Server Error"), http.StatusInternalServerError)
 		return
 	}
 
 	bookPath, err := s.resolveBookPath(book)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to locate EPUB: %v", err), http.StatusUnprocessableEntity)
+		http.Error(w, i18n.T("Failed to locate EPUB: %v", err), http.StatusUnprocessableEntity)
 		return
 	}
 
@@ -1456,99 +2008,57 @@ func (s *Server) HandleOnlineCoverCandidates(w http.ResponseWriter, r *http.Requ
 		isbn = normalizeISBN(meta.Identifier)
 	}
 
-	client := &http.Client{Timeout: 12 * time.Second}
-	candidates := make([]coverCandidate, 0, 12)
-	seen := map[string]struct{}{}
-	log.Printf("[covers.online] lookup start book_id=%d title=%q author=%q isbn=%q", book.ID, title, author, isbn)
-
-	// Open Library ISBN cover tends to be high quality when ISBN is available.
-	if isbn != "" {
-		ol := fmt.Sprintf("https://covers.openlibrary.org/b/isbn/%s-L.jpg?default=false", url.PathEscape(isbn))
-		if ok := remoteImageReachable(client, ol); ok {
-			candidates = append(candidates, makeRemoteCoverCandidate(
-				ol,
-				fmt.Sprintf("Open Library ISBN %s", isbn),
-				"openlibrary",
-			))
-			seen[ol] = struct{}{}
-			log.Printf("[covers.online] openlibrary isbn hit book_id=%d url=%s", book.ID, ol)
-		} else {
-			log.Printf("[covers.online] openlibrary isbn miss book_id=%d url=%s", book.ID, ol)
-		}
-	} else {
-		log.Printf("[covers.online] no isbn available for book_id=%d", book.ID)
-	}
-
-	query := strings.TrimSpace(strings.Join([]string{title, author, "book"}, " "))
-	if query != "" || isbn != "" {
-		gb, err := fetchGoogleBookCoverCandidates(client, query, isbn, 8)
-		if err == nil {
-			log.Printf("[covers.online] googlebooks candidates book_id=%d query=%q isbn=%q count=%d", book.ID, query, isbn, len(gb))
-			for _, c := range gb {
-				if _, ok := seen[c.ImageURL]; ok {
-					continue
-				}
-				seen[c.ImageURL] = struct{}{}
-				candidates = append(candidates, c)
+	ctx, cancel := context.WithTimeout(r.Context(), onlineCoverDeadline)
+	defer cancel()
+	slog.InfoContext(ctx, "covers.online: lookup start", "book_id", book.ID, "title", title, "author", author, "isbn", isbn)
+	sources := s.onlineCoverSources(title, author, isbn)
+	minW, minH := s.settings.Int(settings.OnlineCoverMinWidth), s.settings.Int(settings.OnlineCoverMinHeight)
+	current, hasCurrent := currentCoverHash(book.ID)
+
+	// NDJSON clients get each candidate as soon as it has been measured,
+	// instead of waiting for the slowest source.
+	if formatFromAccept(r.Header.Get("Accept")) == "ndjson" {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		flusher, _ := w.(http.Flusher)
+		enc := json.NewEncoder(w)
+		dedupe := coverDeduper{current: current, hasCurrent: hasCurrent}
+		n := 0
+		s.searchOnlineCovers(ctx, book.ID, sources, minW, minH, func(c onlineCover) {
+			if !dedupe.add(&c.candidate, c.body) {
+				return
 			}
-		} else {
-			log.Printf("[covers.online] googlebooks error book_id=%d query=%q isbn=%q err=%v", book.ID, query, isbn, err)
-		}
-	}
-
-	if query != "" {
-		olSearch, err := fetchOpenLibrarySearchCoverCandidates(client, query, 8)
-		if err == nil {
-			log.Printf("[covers.online] openlibrary search candidates book_id=%d query=%q count=%d", book.ID, query, len(olSearch))
-			for _, c := range olSearch {
-				if _, ok := seen[c.ImageURL]; ok {
-					continue
-				}
-				seen[c.ImageURL] = struct{}{}
-				candidates = append(candidates, c)
+			_ = enc.Encode(c.candidate)
+			if flusher != nil {
+				flusher.Flush()
 			}
-		} else {
-			log.Printf("[covers.online] openlibrary search error book_id=%d query=%q err=%v", book.ID, query, err)
-		}
+			n++
+		})
+		slog.InfoContext(ctx, "covers.online: lookup done", "book_id", book.ID, "candidates", n)
+		return
 	}
 
-	wikiQueries := make([]string, 0, 2)
-	if query != "" {
-		wikiQueries = append(wikiQueries, query)
-	}
-	if title != "" {
-		wikiQueries = append(wikiQueries, strings.TrimSpace(title+" book"))
-	}
-	for _, q := range wikiQueries {
-		wiki, err := fetchWikipediaCoverCandidates(client, q, 6)
-		if err == nil {
-			log.Printf("[covers.online] wikipedia candidates book_id=%d query=%q count=%d", book.ID, q, len(wiki))
-			for _, c := range wiki {
-				if _, ok := seen[c.ImageURL]; ok {
-					continue
-				}
-				seen[c.ImageURL] = struct{}{}
-				candidates = append(candidates, c)
-			}
-		} else {
-			log.Printf("[covers.online] wikipedia error book_id=%d query=%q err=%v", book.ID, q, err)
+	var candidates []coverCandidate
+	bodies := map[string][]byte{}
+	s.searchOnlineCovers(ctx, book.ID, sources, minW, minH, func(c onlineCover) {
+		candidates = append(candidates, c.candidate)
+		if c.body != nil {
+			bodies[c.candidate.ImageURL] = c.body
 		}
+	})
+	sortOnlineCovers(candidates)
+	candidates = dedupeCoverCandidates(candidates, current, hasCurrent, func(c coverCandidate) ([]byte, error) {
+		if body, ok := bodies[c.ImageURL]; ok {
+			return body, nil
+		}
+		return nil, errors.New("image not downloaded")
+	})
+	if candidates == nil {
+		candidates = []coverCandidate{}
 	}
-
-	if query == "" {
-		log.Printf("[covers.online] empty query for book_id=%d", book.ID)
-	} else {
-		log.Printf("[covers.online] query used for book_id=%d query=%q", book.ID, query)
-	}
-
-	candidates = rankAndFilterOnlineCovers(client, candidates)
-	log.Printf("[covers.online] lookup done book_id=%d total_candidates=%d", book.ID, len(candidates))
+	slog.InfoContext(ctx, "covers.online: lookup done", "book_id", book.ID, "candidates", len(candidates))
 
 	w.Header().Set("Content-Type", "application/json")
-	_ = json.NewEncoder(w).Encode(struct {
-		BookID     int              `json:"book_id"`
-		Candidates []coverCandidate `json:"candidates"`
-	}{
+	_ = json.NewEncoder(w).Encode(coverCandidatesPayload{
 		BookID:     book.ID,
 		Candidates: candidates,
 	})
@@ -1556,32 +2066,32 @@ func (s *Server) HandleOnlineCoverCandidates(w http.ResponseWriter, r *http.Requ
 
 func (s *Server) HandleCoverCandidateImage(w http.ResponseWriter, r *http.Request) {
 	id := chi.URLParam(r, "id")
-	book, err := s.db.GetBookByID(id)
+	book, err := s.visibleBook(r, id)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			http.Error(w, "Book not found", http.StatusNotFound)
+			http.Error(w, i18n.T("Book not found"), http.StatusNotFound)
 			return
 		}
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		http.Error(w, i18n.T("Internal Server Error"), http.StatusInternalServerError)
 		return
 	}
 
 	bookPath, err := s.resolveBookPath(book)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to locate EPUB: %v", err), http.StatusUnprocessableEntity)
+		http.Error(w, i18n.T("Failed to locate EPUB: %v", err), http.StatusUnprocessableEntity)
 		return
 	}
 
 	key := chi.URLParam(r, "key")
 	zipPath, err := decodeCoverKey(key)
 	if err != nil {
-		http.Error(w, "Invalid cover key", http.StatusBadRequest)
+		http.Error(w, i18n.T("Invalid cover key"), http.StatusBadRequest)
 		return
 	}
 
 	raw, _, err := scanner.ReadCoverOption(bookPath, zipPath)
 	if err != nil {
-		http.Error(w, "Cover candidate not found", http.StatusNotFound)
+		http.Error(w, i18n.T("Cover candidate not found"), http.StatusNotFound)
 		return
 	}
 
@@ -1596,182 +2106,181 @@ func (s *Server) HandleCoverCandidateImage(w http.ResponseWriter, r *http.Reques
 
 func (s *Server) HandleUpdateCover(w http.ResponseWriter, r *http.Request) {
 	id := chi.URLParam(r, "id")
-	book, err := s.db.GetBookByID(id)
+	book, err := s.visibleBook(r, id)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			http.Error(w, "Book not found", http.StatusNotFound)
+			http.Error(w, i18n.T("Book not found"), http.StatusNotFound)
 			return
 		}
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		http.Error(w, i18n.T("Internal Server Error"), http.StatusInternalServerError)
 		return
 	}
 
 	bookPath, err := s.resolveBookPath(book)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to locate EPUB: %v", err), http.StatusUnprocessableEntity)
+		http.Error(w, i18n.T("Failed to locate EPUB: %v", err), http.StatusUnprocessableEntity)
 		return
 	}
 
 	var req updateCoverRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		http.Error(w, i18n.T("Invalid JSON body"), http.StatusBadRequest)
 		return
 	}
 	req.Key = strings.TrimSpace(req.Key)
 	req.ImageURL = strings.TrimSpace(req.ImageURL)
 	if req.Key == "" && req.ImageURL == "" {
-		http.Error(w, "Cover key or image_url is required", http.StatusBadRequest)
+		http.Error(w, i18n.T("Cover key or image_url is required"), http.StatusBadRequest)
 		return
 	}
 
+	// Picking a cover from the EPUB and writing it back share one open
+	// archive.
+	if req.WriteToEPUB && storage.IsRemote(bookPath) {
+		http.Error(w, i18n.T("Books in remote libraries are read-only"), http.StatusConflict)
+		return
+	}
+	var epub *scanner.EPUB
+	if req.ImageURL == "" || req.WriteToEPUB {
+		epub, err = scanner.OpenEPUB(bookPath)
+		if err != nil {
+			http.Error(w, i18n.T("Failed to open EPUB: %v", err), http.StatusUnprocessableEntity)
+			return
+		}
+		defer epub.Close()
+	}
+
 	var raw []byte
 	var zipPath string
 	if req.ImageURL != "" {
-		raw, err = fetchAllowedRemoteImage(req.ImageURL)
+		if s.settings.Bool(settings.OfflineMode) {
+			http.Error(w, i18n.T(errExternalLookupsDisabled), http.StatusServiceUnavailable)
+			return
+		}
+		raw, _, err = s.remoteCoverImage(req.ImageURL)
 		if err != nil {
-			http.Error(w, fmt.Sprintf("Failed to fetch remote cover: %v", err), http.StatusUnprocessableEntity)
+			http.Error(w, i18n.T("Failed to fetch remote cover: %v", err), http.StatusUnprocessableEntity)
 			return
 		}
 	} else {
 		zipPath, err = decodeCoverKey(req.Key)
 		if err != nil {
-			http.Error(w, "Invalid cover key", http.StatusBadRequest)
+			http.Error(w, i18n.T("Invalid cover key"), http.StatusBadRequest)
 			return
 		}
 
-		raw, _, err = scanner.ReadCoverOption(bookPath, zipPath)
+		raw, _, err = epub.ReadCoverOption(zipPath)
 		if err != nil {
-			http.Error(w, "Cover candidate not found", http.StatusNotFound)
+			http.Error(w, i18n.T("Cover candidate not found"), http.StatusNotFound)
 			return
 		}
 	}
 
 	cacheJPG, err := scanner.ConvertImageToJPEG(raw)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Cover conversion failed: %v", err), http.StatusUnprocessableEntity)
+		http.Error(w, i18n.T("Cover conversion failed: %v", err), http.StatusUnprocessableEntity)
 		return
 	}
 
-	if err := os.MkdirAll("./data/covers", 0755); err != nil {
-		http.Error(w, fmt.Sprintf("Failed to prepare covers cache: %v", err), http.StatusInternalServerError)
-		return
-	}
-	if err := os.WriteFile(fmt.Sprintf("./data/covers/%d.jpg", book.ID), cacheJPG, 0644); err != nil {
-		http.Error(w, fmt.Sprintf("Failed to update cover cache: %v", err), http.StatusInternalServerError)
+	previousCover := snapshotCoverForHistory(book.ID)
+	previousHash, hadCover := currentCoverHash(book.ID)
+
+	if err := writeCover(r.Context(), book.ID, cacheJPG); err != nil {
+		http.Error(w, i18n.T("Failed to update cover cache: %v", err), http.StatusInternalServerError)
 		return
 	}
 
 	if req.WriteToEPUB {
 		if req.ImageURL != "" {
-			if err := scanner.WriteCoverBytesToEPUB(bookPath, cacheJPG); err != nil {
-				http.Error(w, fmt.Sprintf("Failed writing remote cover to EPUB: %v", err), http.StatusUnprocessableEntity)
+			if err := epub.WriteCoverBytes(cacheJPG); err != nil {
+				http.Error(w, i18n.T("Failed writing remote cover to EPUB: %v", err), http.StatusUnprocessableEntity)
 				return
 			}
 		} else {
-			if err := scanner.WriteCoverToEPUB(bookPath, zipPath); err != nil {
-				http.Error(w, fmt.Sprintf("Failed writing cover to EPUB: %v", err), http.StatusUnprocessableEntity)
+			if err := epub.WriteCover(zipPath); err != nil {
+				http.Error(w, i18n.T("Failed writing cover to EPUB: %v", err), http.StatusUnprocessableEntity)
 				return
 			}
 		}
 		localCoverPath := filepath.Join(filepath.Dir(bookPath), "cover.jpg")
 		if err := os.WriteFile(localCoverPath, cacheJPG, 0644); err != nil {
 			if errors.Is(err, os.ErrPermission) {
-				http.Error(w, "Write permission denied for sibling cover.jpg", http.StatusForbidden)
+				http.Error(w, i18n.T("Write permission denied for sibling cover.jpg"), http.StatusForbidden)
 				return
 			}
-			http.Error(w, fmt.Sprintf("Failed writing sibling cover.jpg: %v", err), http.StatusUnprocessableEntity)
+			http.Error(w, i18n.T("Failed writing sibling cover.jpg: %v", err), http.StatusUnprocessableEntity)
 			return
 		}
 		if info, err := os.Stat(bookPath); err == nil {
 			_ = s.db.UpdateBookMetadata(book.ID, book.Title, book.Author, book.Description, info.ModTime())
 		}
+		s.refreshBookHash(book.ID, bookPath)
+	}
+
+	source := "epub:" + zipPath
+	if req.ImageURL != "" {
+		source = "remote:" + req.ImageURL
 	}
+	s.recordCoverChange(r, book.ID, previousCover, cacheJPG, req.WriteToEPUB, source, 0)
+	// The cover's URL in cached feeds carries its old version.
+	s.libraryChanged()
 
 	w.Header().Set("Content-Type", "application/json")
-	_ = json.NewEncoder(w).Encode(struct {
-		OK          bool `json:"ok"`
-		BookID      int  `json:"book_id"`
-		WroteToEPUB bool `json:"wrote_to_epub"`
-	}{
-		OK:          true,
-		BookID:      book.ID,
-		WroteToEPUB: req.WriteToEPUB,
+	newHash, ok := coverHash(cacheJPG)
+	_ = json.NewEncoder(w).Encode(coverUpdatePayload{
+		OK:             true,
+		BookID:         book.ID,
+		WroteToEPUB:    req.WriteToEPUB,
+		SameAsPrevious: ok && hadCover && hashDistance(newHash, previousHash) <= nearDuplicateDistance,
 	})
 }
 
 func (s *Server) HandleCover(w http.ResponseWriter, r *http.Request) {
 	id := chi.URLParam(r, "id")
-	coverPath := fmt.Sprintf("data/covers/%s.jpg", id)
-	http.ServeFile(w, r, coverPath)
+	if f := s.bookFilter(r); f.Restricted() {
+		if _, err := s.visibleBook(r, id); err != nil {
+			http.Error(w, i18n.T("Cover not found"), http.StatusNotFound)
+			return
+		}
+	}
+	name := id + ".jpg"
+	version := coverVersion(r.Context(), name)
+	if version != "" {
+		metrics.CoverCache.Inc("hit")
+		s.setCoverCacheHeaders(w, r, version)
+	} else {
+		metrics.CoverCache.Inc("miss")
+	}
+	serveNegotiatedCover(w, r, name, version)
 }
 
 func (s *Server) HandleDownload(w http.ResponseWriter, r *http.Request) {
 	id := chi.URLParam(r, "id")
-	book, err := s.db.GetBookByID(id)
+	book, err := s.visibleBook(r, id)
 	if err != nil {
-		log.Printf("Download error (ID %s): %v", id, err)
-		http.Error(w, "Book not found", http.StatusNotFound)
+		slog.WarnContext(r.Context(), "download failed", "book_id", id, "err", err)
+		http.Error(w, i18n.T("Book not found"), http.StatusNotFound)
 		return
 	}
 
 	bookPath, err := s.resolveBookPath(book)
+	if errors.Is(err, errBookUnavailable) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(libraryCheckInterval.Seconds())))
+		http.Error(w, i18n.T("Book is temporarily unavailable"), http.StatusServiceUnavailable)
+		return
+	}
 	if err != nil {
-		log.Printf("Download error (ID %s): %v", id, err)
-		http.Error(w, "Book file not found", http.StatusNotFound)
+		slog.WarnContext(r.Context(), "download failed", "book_id", id, "err", err)
+		http.Error(w, i18n.T("Book file not found"), http.StatusNotFound)
 		return
 	}
 
-	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s.epub\"", book.Title))
-	w.Header().Set("Content-Type", "application/epub+zip")
-	http.ServeFile(w, r, bookPath)
-}
-
-func (s *Server) HandleRebuildLibrary(w http.ResponseWriter, r *http.Request) {
-	s.startScanJob(w, "rebuild")
-}
-
-func (s *Server) HandleRescanLibrary(w http.ResponseWriter, r *http.Request) {
-	s.startScanJob(w, "rescan")
-}
-
-func (s *Server) startScanJob(w http.ResponseWriter, operation string) {
-	s.rebuildMu.Lock()
-	if s.rebuildState.Running {
-		status := s.rebuildState
-		s.rebuildMu.Unlock()
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusConflict)
-		_ = json.NewEncoder(w).Encode(status)
+	if format := r.URL.Query().Get("format"); strings.TrimSpace(format) != "" {
+		s.serveBookFormat(w, r, book, bookPath, format)
 		return
 	}
-	startedAt := time.Now().UTC()
-	label := "Rebuild"
-	if operation == "rescan" {
-		label = "Rescan"
-	}
-	s.rebuildState = rebuildStatus{
-		Running:   true,
-		Operation: operation,
-		Phase:     "queued",
-		Message:   label + " queued.",
-		StartedAt: startedAt,
-	}
-	status := s.rebuildState
-	s.rebuildMu.Unlock()
-
-	go s.runScanJob(operation)
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusAccepted)
-	_ = json.NewEncoder(w).Encode(status)
-}
-
-func (s *Server) HandleRebuildStatus(w http.ResponseWriter, r *http.Request) {
-	s.rebuildMu.Lock()
-	status := s.rebuildState
-	s.rebuildMu.Unlock()
-
-	w.Header().Set("Content-Type", "application/json")
-	_ = json.NewEncoder(w).Encode(status)
+	epub, _ := lookupBookFormat("epub")
+	s.serveBookFile(w, r, book, bookPath, epub)
 }
 
 func encodeCoverKey(zipPath string) string {
@@ -1820,21 +2329,33 @@ func fetchWikipediaCoverCandidates(client *http.Client, query string, limit int)
 		return nil, nil
 	}
 
-	out := make([]coverCandidate, 0, len(titlesAny))
-	seen := map[string]struct{}{}
+	var titles []string
 	for _, v := range titlesAny {
-		title, ok := v.(string)
-		if !ok {
-			continue
-		}
-		title = strings.TrimSpace(title)
-		if title == "" {
-			continue
-		}
+		if title, ok := v.(string); ok && strings.TrimSpace(title) != "" {
+			titles = append(titles, strings.TrimSpace(title))
+		}
+	}
+
+	// Fetch the summaries together; each is a separate round trip.
+	summaries := make([]*wikiSummaryResponse, len(titles))
+	var wg sync.WaitGroup
+	for i, title := range titles {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			summaryURL := "https://en.wikipedia.org/api/rest_v1/page/summary/" + url.PathEscape(title)
+			var summary wikiSummaryResponse
+			if err := fetchJSON(client, summaryURL, &summary); err == nil {
+				summaries[i] = &summary
+			}
+		}()
+	}
+	wg.Wait()
 
-		summaryURL := "https://en.wikipedia.org/api/rest_v1/page/summary/" + url.PathEscape(title)
-		var summary wikiSummaryResponse
-		if err := fetchJSON(client, summaryURL, &summary); err != nil {
+	out := make([]coverCandidate, 0, len(titles))
+	seen := map[string]struct{}{}
+	for i, summary := range summaries {
+		if summary == nil {
 			continue
 		}
 
@@ -1855,7 +2376,7 @@ func fetchWikipediaCoverCandidates(client *http.Client, query string, limit int)
 			continue
 		}
 		seen[imageURL] = struct{}{}
-		out = append(out, makeRemoteCoverCandidate(imageURL, firstNonEmpty([]string{summary.Title, title}), "wikipedia"))
+		out = append(out, makeRemoteCoverCandidate(imageURL, firstNonEmpty([]string{summary.Title, titles[i]}), "wikipedia"))
 	}
 	return out, nil
 }
@@ -1868,7 +2389,7 @@ func makeRemoteCoverCandidate(imageURL, name, source string) coverCandidate {
 		Width:      0,
 		Height:     0,
 		IsCurrent:  false,
-		PreviewURL: imageURL,
+		PreviewURL: coverProxyURL(imageURL),
 		Source:     source,
 		Remote:     true,
 		ImageURL:   imageURL,
@@ -2016,6 +2537,7 @@ func isAllowedRemoteCoverURL(raw string) bool {
 		"upload.wikimedia.org",
 		"wikipedia.org",
 		"en.wikipedia.org",
+		"doubanio.com",
 	}
 	for _, a := range allowed {
 		if host == a || strings.HasSuffix(host, "."+a) {
@@ -2042,11 +2564,15 @@ func remoteImageReachable(client *http.Client, raw string) bool {
 	return res.StatusCode >= 200 && res.StatusCode < 300
 }
 
-func fetchAllowedRemoteImage(raw string) ([]byte, error) {
+// maxRemoteImage is the largest remote cover downloaded.
+const maxRemoteImage = 10 << 20 // 10MB
+
+// openAllowedRemoteImage starts downloading a remote cover from an allowed
+// host. The caller closes the body.
+func openAllowedRemoteImage(client *http.Client, raw string) (io.ReadCloser, error) {
 	if !isAllowedRemoteCoverURL(raw) {
 		return nil, fmt.Errorf("remote URL host is not allowed")
 	}
-	client := &http.Client{Timeout: 20 * time.Second}
 	req, err := http.NewRequest(http.MethodGet, raw, nil)
 	if err != nil {
 		return nil, err
@@ -2056,44 +2582,32 @@ func fetchAllowedRemoteImage(raw string) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
-	defer res.Body.Close()
 	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		res.Body.Close()
 		return nil, fmt.Errorf("unexpected status: %d", res.StatusCode)
 	}
-	const maxBytes = 10 << 20 // 10MB
-	limited := io.LimitReader(res.Body, maxBytes+1)
-	b, err := io.ReadAll(limited)
+	return res.Body, nil
+}
+
+func fetchAllowedRemoteImage(client *http.Client, raw string) ([]byte, error) {
+	body, err := openAllowedRemoteImage(client, raw)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	b, err := io.ReadAll(io.LimitReader(body, maxRemoteImage+1))
 	if err != nil {
 		return nil, err
 	}
-	if len(b) > maxBytes {
+	if len(b) > maxRemoteImage {
 		return nil, fmt.Errorf("remote image too large")
 	}
 	return b, nil
 }
 
-func rankAndFilterOnlineCovers(client *http.Client, in []coverCandidate) []coverCandidate {
-	minW := envIntDefault("ONLINE_COVER_MIN_WIDTH", 300)
-	minH := envIntDefault("ONLINE_COVER_MIN_HEIGHT", 420)
-
-	out := make([]coverCandidate, 0, len(in))
-	for _, c := range in {
-		if !c.Remote {
-			out = append(out, c)
-			continue
-		}
-
-		w, h, ok := probeRemoteImageDimensions(client, c.ImageURL)
-		if ok {
-			c.Width = w
-			c.Height = h
-		}
-		if c.Width > 0 && c.Height > 0 && (c.Width < minW || c.Height < minH) {
-			continue
-		}
-		out = append(out, c)
-	}
-
+// sortOnlineCovers orders remote candidates by preferred source, then
+// largest first.
+func sortOnlineCovers(out []coverCandidate) {
 	sort.SliceStable(out, func(i, j int) bool {
 		a := out[i]
 		b := out[j]
@@ -2111,8 +2625,6 @@ func rankAndFilterOnlineCovers(client *http.Client, in []coverCandidate) []cover
 		}
 		return strings.ToLower(a.Name) < strings.ToLower(b.Name)
 	})
-
-	return out
 }
 
 func sourcePriorityRank(source string) int {
@@ -2128,117 +2640,6 @@ func sourcePriorityRank(source string) int {
 	}
 }
 
-func probeRemoteImageDimensions(client *http.Client, raw string) (int, int, bool) {
-	if !isAllowedRemoteCoverURL(raw) {
-		return 0, 0, false
-	}
-	req, err := http.NewRequest(http.MethodGet, raw, nil)
-	if err != nil {
-		return 0, 0, false
-	}
-	applyOutboundHeaders(req)
-	res, err := client.Do(req)
-	if err != nil {
-		return 0, 0, false
-	}
-	defer res.Body.Close()
-	if res.StatusCode < 200 || res.StatusCode >= 300 {
-		return 0, 0, false
-	}
-
-	const sniffLimit = 5 << 20 // 5MB cap for probing dimensions
-	b, err := io.ReadAll(io.LimitReader(res.Body, sniffLimit))
-	if err != nil {
-		return 0, 0, false
-	}
-	cfg, _, err := image.DecodeConfig(bytes.NewReader(b))
-	if err != nil || cfg.Width <= 0 || cfg.Height <= 0 {
-		return 0, 0, false
-	}
-	return cfg.Width, cfg.Height, true
-}
-
-func envIntDefault(name string, fallback int) int {
-	raw := strings.TrimSpace(os.Getenv(name))
-	if raw == "" {
-		return fallback
-	}
-	v, err := strconv.Atoi(raw)
-	if err != nil || v <= 0 {
-		return fallback
-	}
-	return v
-}
-
-func (s *Server) runScanJob(operation string) {
-	label := "Rebuild"
-	if operation == "rescan" {
-		label = "Rescan"
-	}
-
-	if operation == "rebuild" {
-		s.setRebuildProgress("resetting_db", "Resetting database cache...")
-		if err := s.db.RebuildBooksTable(); err != nil {
-			s.finishRebuildWithError(fmt.Sprintf("Failed to reset database: %v", err), label)
-			return
-		}
-
-		s.setRebuildProgress("clearing_covers", "Clearing covers cache...")
-		if err := os.RemoveAll("./data/covers"); err != nil {
-			s.finishRebuildWithError(fmt.Sprintf("Failed to clear covers cache: %v", err), label)
-			return
-		}
-		if err := os.MkdirAll("./data/covers", 0755); err != nil {
-			s.finishRebuildWithError(fmt.Sprintf("Failed to recreate covers cache: %v", err), label)
-			return
-		}
-	}
-
-	bookPath := strings.TrimSpace(os.Getenv("BOOK_PATH"))
-	if bookPath == "" {
-		bookPath = "./books"
-	}
-
-	s.setRebuildProgress("scanning", "Scanning library...")
-	sc := scanner.New(s.db)
-	if err := sc.Start(bookPath); err != nil {
-		s.finishRebuildWithError(fmt.Sprintf("%s scan failed: %v", label, err), label)
-		return
-	}
-
-	books, err := s.db.GetAllBooks()
-	if err != nil {
-		s.finishRebuildWithError(fmt.Sprintf("%s finished but listing failed: %v", label, err), label)
-		return
-	}
-
-	s.rebuildMu.Lock()
-	s.rebuildState.Running = false
-	s.rebuildState.Phase = "complete"
-	s.rebuildState.Message = fmt.Sprintf("%s complete. %d books indexed.", label, len(books))
-	s.rebuildState.Error = ""
-	s.rebuildState.Count = len(books)
-	s.rebuildState.CompletedAt = time.Now().UTC()
-	s.rebuildMu.Unlock()
-}
-
-func (s *Server) setRebuildProgress(phase, message string) {
-	s.rebuildMu.Lock()
-	s.rebuildState.Phase = phase
-	s.rebuildState.Message = message
-	s.rebuildMu.Unlock()
-}
-
-func (s *Server) finishRebuildWithError(message string, label string) {
-	s.rebuildMu.Lock()
-	s.rebuildState.Running = false
-	s.rebuildState.Phase = "failed"
-	s.rebuildState.Message = label + " failed."
-	s.rebuildState.Error = message
-	s.rebuildState.CompletedAt = time.Now().UTC()
-	s.rebuildMu.Unlock()
-}
-
 func (s *Server) resolveBookPath(book *database.Book) (string, error) {
 	if book == nil {
 		return "", fmt.Errorf("book is nil")
@@ -2248,6 +2649,16 @@ func (s *Server) resolveBookPath(book *database.Book) (string, error) {
 	if current == "" {
 		return "", fmt.Errorf("book path is empty")
 	}
+	if !book.Available && !s.libraryStatus().Available {
+		// Searching a share that has gone away for the file would only
+		// hang or come up empty.
+		return "", errBookUnavailable
+	}
+	if storage.IsRemote(current) {
+		// Remote libraries are rescanned rather than searched, so their
+		// paths are only ever the stored ones.
+		return current, nil
+	}
 
 	if _, err := os.Stat(current); err == nil {
 		return current, nil
@@ -2279,10 +2690,10 @@ func (s *Server) resolveBookPath(book *database.Book) (string, error) {
 	}
 
 	if err := s.db.UpdateBookPath(book.ID, recovered); err != nil {
-		log.Printf("failed to update recovered book path for id=%d: %v", book.ID, err)
+		slog.Error("failed to update recovered book path", "book_id", book.ID, "err", err)
 	} else {
 		book.Path = recovered
-		log.Printf("recovered missing book path for id=%d: %s -> %s", book.ID, current, recovered)
+		slog.Info("recovered missing book path", "book_id", book.ID, "from", current, "to", recovered)
 	}
 
 	return recovered, nil
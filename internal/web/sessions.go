@@ -0,0 +1,151 @@
+package web
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ab0oo/gopds/internal/database"
+	"github.com/ab0oo/gopds/internal/i18n"
+	"github.com/go-chi/chi/v5"
+)
+
+type sessionsPayload struct {
+	Sessions []database.Session `json:"sessions"`
+}
+
+type revokedSessionsPayload struct {
+	Revoked int64 `json:"revoked"`
+}
+
+// sessionOwner returns the signed-in user whose sessions the session
+// endpoints manage. API tokens don't belong to a user, so they are refused.
+func (s *Server) sessionOwner(w http.ResponseWriter, r *http.Request) (string, bool) {
+	p, ok := s.principal(r)
+	if !ok {
+		http.Error(w, i18n.T("Unauthorized"), http.StatusUnauthorized)
+		return "", false
+	}
+	if p.TokenID != 0 {
+		http.Error(w, i18n.T("Sessions belong to users; API tokens have none"), http.StatusForbidden)
+		return "", false
+	}
+	return p.Name, true
+}
+
+// HandleListSessions lists the caller's active browser sessions, marking the
+// one the request came from.
+func (s *Server) HandleListSessions(w http.ResponseWriter, r *http.Request) {
+	username, ok := s.sessionOwner(w, r)
+	if !ok {
+		return
+	}
+	sessions, err := s.db.ListUserSessions(username, time.Now())
+	if err != nil {
+		http.Error(w, i18n.T("Failed to list sessions"), http.StatusInternalServerError)
+		return
+	}
+	var currentID int64
+	if cur, ok := s.currentSession(r); ok {
+		currentID = cur.ID
+	}
+	for i := range sessions {
+		sessions[i].Device = describeDevice(sessions[i].UserAgent)
+		sessions[i].Current = sessions[i].ID == currentID
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(sessionsPayload{Sessions: sessions})
+}
+
+// HandleRevokeSession signs out one of the caller's sessions, which may be
+// the current one.
+func (s *Server) HandleRevokeSession(w http.ResponseWriter, r *http.Request) {
+	username, ok := s.sessionOwner(w, r)
+	if !ok {
+		return
+	}
+	id, err := strconv.ParseInt(chi.URLParam(r, "sessionID"), 10, 64)
+	if err != nil {
+		http.Error(w, i18n.T("Invalid session ID"), http.StatusBadRequest)
+		return
+	}
+	deleted, err := s.db.DeleteUserSession(id, username)
+	if err != nil {
+		http.Error(w, i18n.T("Failed to revoke session"), http.StatusInternalServerError)
+		return
+	}
+	if !deleted {
+		http.Error(w, i18n.T("Session not found"), http.StatusNotFound)
+		return
+	}
+	slog.InfoContext(r.Context(), "session revoked", "session_id", id, "username", username)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleRevokeOtherSessions signs the caller out everywhere except the
+// session the request came from.
+func (s *Server) HandleRevokeOtherSessions(w http.ResponseWriter, r *http.Request) {
+	username, ok := s.sessionOwner(w, r)
+	if !ok {
+		return
+	}
+	var keepID int64
+	if cur, ok := s.currentSession(r); ok {
+		keepID = cur.ID
+	}
+	n, err := s.db.DeleteOtherUserSessions(username, keepID)
+	if err != nil {
+		http.Error(w, i18n.T("Failed to revoke sessions"), http.StatusInternalServerError)
+		return
+	}
+	s.basicCache.forget(username)
+	slog.InfoContext(r.Context(), "other sessions revoked", "username", username, "count", n)
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(revokedSessionsPayload{Revoked: n})
+}
+
+// describeDevice turns a User-Agent into something like "Firefox on Linux".
+// It only needs to be good enough for a user to recognise their devices.
+func describeDevice(userAgent string) string {
+	var browser, os string
+	for _, b := range []struct{ marker, name string }{
+		{"KOReader", "KOReader"},
+		{"Edg/", "Edge"},
+		{"OPR/", "Opera"},
+		{"Firefox/", "Firefox"},
+		{"Chrome/", "Chrome"},
+		{"Safari/", "Safari"},
+		{"curl/", "curl"},
+	} {
+		if strings.Contains(userAgent, b.marker) {
+			browser = b.name
+			break
+		}
+	}
+	for _, o := range []struct{ marker, name string }{
+		{"Windows", "Windows"},
+		{"Android", "Android"},
+		{"iPhone", "iOS"},
+		{"iPad", "iPadOS"},
+		{"CrOS", "ChromeOS"},
+		{"Mac OS X", "macOS"},
+		{"Linux", "Linux"},
+	} {
+		if strings.Contains(userAgent, o.marker) {
+			os = o.name
+			break
+		}
+	}
+	switch {
+	case browser != "" && os != "":
+		return browser + " on " + os
+	case browser != "":
+		return browser
+	case os != "":
+		return os
+	}
+	return "Unknown device"
+}
@@ -0,0 +1,111 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ab0oo/gopds/internal/i18n"
+	"github.com/ab0oo/gopds/internal/jobs"
+	"github.com/ab0oo/gopds/internal/settings"
+)
+
+type settingsPayload struct {
+	Settings []settings.Value `json:"settings"`
+}
+
+// updateSettingsRequest maps setting keys to new values. Values may be
+// strings, numbers, or booleans; null removes the override.
+type updateSettingsRequest map[string]json.RawMessage
+
+func (s *Server) HandleSettings(w http.ResponseWriter, r *http.Request) {
+	values, err := s.settings.List()
+	if err != nil {
+		http.Error(w, i18n.T("Internal Server Error"), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(settingsPayload{Settings: values})
+}
+
+// HandleUpdateSettings applies a partial update: keys that are left out are
+// unchanged. The whole update is rejected if any value is invalid.
+func (s *Server) HandleUpdateSettings(w http.ResponseWriter, r *http.Request) {
+	var req updateSettingsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, i18n.T("Invalid JSON body"), http.StatusBadRequest)
+		return
+	}
+	changes := make(map[string]*string, len(req))
+	for key, raw := range req {
+		trimmed := strings.TrimSpace(string(raw))
+		if trimmed == "null" {
+			changes[key] = nil
+			continue
+		}
+		var value string
+		if err := json.Unmarshal(raw, &value); err != nil {
+			// Numbers and booleans are taken as written.
+			value = trimmed
+		}
+		changes[key] = &value
+	}
+
+	actor := s.actorName(r)
+	if err := s.settings.Update(changes, actor); err != nil {
+		if errors.Is(err, settings.ErrInvalid) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		http.Error(w, i18n.T("Failed to save settings"), http.StatusInternalServerError)
+		return
+	}
+
+	keys := make([]string, 0, len(changes))
+	for key := range changes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	slog.InfoContext(r.Context(), "settings updated", "keys", strings.Join(keys, ","), "by", actor)
+
+	s.HandleSettings(w, r)
+}
+
+// RunScanSchedule queues an incremental rescan every scan_interval_minutes
+// until ctx is cancelled. The interval is re-read each minute, so changing
+// it takes effect without a restart; 0 pauses the schedule.
+func (s *Server) RunScanSchedule(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	last := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			interval := time.Duration(s.settings.Int(settings.ScanIntervalMinutes)) * time.Minute
+			if interval <= 0 || now.Sub(last) < interval {
+				continue
+			}
+			last = now
+			if !s.libraryStatus().Available {
+				slog.DebugContext(ctx, "scheduled rescan skipped; the library is unavailable")
+				continue
+			}
+			_, err := s.QueueScan(ctx, "rescan")
+			switch {
+			case errors.Is(err, jobs.ErrAlreadyActive):
+				slog.DebugContext(ctx, "scheduled rescan skipped; a scan is already active")
+			case err != nil:
+				slog.ErrorContext(ctx, "failed to queue scheduled scan", "err", err)
+			default:
+				slog.InfoContext(ctx, "scheduled rescan queued", "interval", interval)
+			}
+		}
+	}
+}
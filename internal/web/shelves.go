@@ -0,0 +1,301 @@
+package web
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ab0oo/gopds/internal/database"
+	"github.com/ab0oo/gopds/internal/i18n"
+	"github.com/go-chi/chi/v5"
+)
+
+const maxShelfNameLen = 200
+
+type shelfRequest struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+type reorderShelfRequest struct {
+	BookIDs []int `json:"book_ids"`
+}
+
+type shelvesPayload struct {
+	Shelves []database.Shelf `json:"shelves"`
+}
+
+type shelfPayload struct {
+	Shelf database.Shelf  `json:"shelf"`
+	Books []database.Book `json:"books"`
+}
+
+// shelfOwner is the name shelves are filed under for r: the session user,
+// or "token:<name>" for a bearer token.
+func (s *Server) shelfOwner(r *http.Request) string {
+	p, _ := s.principal(r)
+	return p.Name
+}
+
+// loadShelf resolves {shelfID} to one of the caller's shelves, writing 400
+// or 404 if it can't.
+func (s *Server) loadShelf(w http.ResponseWriter, r *http.Request) (*database.Shelf, bool) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "shelfID"), 10, 64)
+	if err != nil {
+		http.Error(w, i18n.T("Invalid shelf ID"), http.StatusBadRequest)
+		return nil, false
+	}
+	shelf, err := s.db.GetShelf(s.shelfOwner(r), id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, i18n.T("Shelf not found"), http.StatusNotFound)
+			return nil, false
+		}
+		http.Error(w, i18n.T("Internal Server Error"), http.StatusInternalServerError)
+		return nil, false
+	}
+	return shelf, true
+}
+
+func decodeShelfRequest(w http.ResponseWriter, r *http.Request) (shelfRequest, bool) {
+	var req shelfRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, i18n.T("Invalid JSON body"), http.StatusBadRequest)
+		return req, false
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	req.Description = strings.TrimSpace(req.Description)
+	if req.Name == "" || len(req.Name) > maxShelfNameLen {
+		http.Error(w, i18n.T("Shelf name is required and must be at most %d characters", maxShelfNameLen), http.StatusBadRequest)
+		return req, false
+	}
+	return req, true
+}
+
+func (s *Server) HandleListShelves(w http.ResponseWriter, r *http.Request) {
+	shelves, err := s.db.ListShelves(s.shelfOwner(r))
+	if err != nil {
+		http.Error(w, i18n.T("Internal Server Error"), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(shelvesPayload{Shelves: shelves})
+}
+
+func (s *Server) HandleCreateShelf(w http.ResponseWriter, r *http.Request) {
+	req, ok := decodeShelfRequest(w, r)
+	if !ok {
+		return
+	}
+	owner := s.shelfOwner(r)
+	shelf, err := s.db.CreateShelf(owner, req.Name, req.Description)
+	if err != nil {
+		if errors.Is(err, database.ErrShelfExists) {
+			http.Error(w, i18n.T("You already have a shelf with that name"), http.StatusConflict)
+			return
+		}
+		http.Error(w, i18n.T("Failed to create shelf"), http.StatusInternalServerError)
+		return
+	}
+	slog.InfoContext(r.Context(), "shelf created", "shelf_id", shelf.ID, "name", shelf.Name, "user", owner)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(shelf)
+}
+
+// HandleShelf returns a shelf with its books in shelf order.
+func (s *Server) HandleShelf(w http.ResponseWriter, r *http.Request) {
+	shelf, ok := s.loadShelf(w, r)
+	if !ok {
+		return
+	}
+	books, err := s.db.ShelfBooks(shelf.ID, s.bookFilter(r), -1, 0)
+	if err != nil {
+		http.Error(w, i18n.T("Internal Server Error"), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(shelfPayload{Shelf: *shelf, Books: books})
+}
+
+func (s *Server) HandleUpdateShelf(w http.ResponseWriter, r *http.Request) {
+	shelf, ok := s.loadShelf(w, r)
+	if !ok {
+		return
+	}
+	req, ok := decodeShelfRequest(w, r)
+	if !ok {
+		return
+	}
+	if _, err := s.db.UpdateShelf(shelf.Username, shelf.ID, req.Name, req.Description); err != nil {
+		if errors.Is(err, database.ErrShelfExists) {
+			http.Error(w, i18n.T("You already have a shelf with that name"), http.StatusConflict)
+			return
+		}
+		http.Error(w, i18n.T("Failed to update shelf"), http.StatusInternalServerError)
+		return
+	}
+	s.writeShelf(w, r, shelf)
+}
+
+func (s *Server) HandleDeleteShelf(w http.ResponseWriter, r *http.Request) {
+	shelf, ok := s.loadShelf(w, r)
+	if !ok {
+		return
+	}
+	if _, err := s.db.DeleteShelf(shelf.Username, shelf.ID); err != nil {
+		http.Error(w, i18n.T("Failed to delete shelf"), http.StatusInternalServerError)
+		return
+	}
+	slog.InfoContext(r.Context(), "shelf deleted", "shelf_id", shelf.ID, "name", shelf.Name, "user", shelf.Username)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleAddShelfBook appends a book to a shelf; adding a book that is
+// already on it is a no-op.
+func (s *Server) HandleAddShelfBook(w http.ResponseWriter, r *http.Request) {
+	shelf, ok := s.loadShelf(w, r)
+	if !ok {
+		return
+	}
+	book, err := s.visibleBook(r, chi.URLParam(r, "id"))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, i18n.T("Book not found"), http.StatusNotFound)
+			return
+		}
+		http.Error(w, i18n.T("Internal Server Error"), http.StatusInternalServerError)
+		return
+	}
+	if err := s.db.AddShelfBook(shelf.ID, *book); err != nil {
+		http.Error(w, i18n.T("Failed to add book to shelf"), http.StatusInternalServerError)
+		return
+	}
+	s.writeShelf(w, r, shelf)
+}
+
+func (s *Server) HandleRemoveShelfBook(w http.ResponseWriter, r *http.Request) {
+	shelf, ok := s.loadShelf(w, r)
+	if !ok {
+		return
+	}
+	bookID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, i18n.T("Invalid book ID"), http.StatusBadRequest)
+		return
+	}
+	found, err := s.db.RemoveShelfBook(shelf.ID, bookID)
+	if err != nil {
+		http.Error(w, i18n.T("Failed to remove book from shelf"), http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.Error(w, i18n.T("Book is not on this shelf"), http.StatusNotFound)
+		return
+	}
+	s.writeShelf(w, r, shelf)
+}
+
+// HandleReorderShelf moves the listed books to the front of the shelf in
+// the given order.
+func (s *Server) HandleReorderShelf(w http.ResponseWriter, r *http.Request) {
+	shelf, ok := s.loadShelf(w, r)
+	if !ok {
+		return
+	}
+	var req reorderShelfRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, i18n.T("Invalid JSON body"), http.StatusBadRequest)
+		return
+	}
+	if err := s.db.ReorderShelf(shelf.ID, req.BookIDs); err != nil {
+		http.Error(w, i18n.T("Failed to reorder shelf"), http.StatusInternalServerError)
+		return
+	}
+	s.writeShelf(w, r, shelf)
+}
+
+// writeShelf reloads a shelf after a change and writes it with its books.
+func (s *Server) writeShelf(w http.ResponseWriter, r *http.Request, shelf *database.Shelf) {
+	updated, err := s.db.GetShelf(shelf.Username, shelf.ID)
+	if err != nil {
+		http.Error(w, i18n.T("Internal Server Error"), http.StatusInternalServerError)
+		return
+	}
+	books, err := s.db.ShelfBooks(shelf.ID, s.bookFilter(r), -1, 0)
+	if err != nil {
+		http.Error(w, i18n.T("Internal Server Error"), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(shelfPayload{Shelf: *updated, Books: books})
+}
+
+// HandleShelvesCatalog is the OPDS navigation feed of the caller's shelves.
+func (s *Server) HandleShelvesCatalog(w http.ResponseWriter, r *http.Request) {
+	shelves, err := s.db.ListShelves(s.shelfOwner(r))
+	if err != nil {
+		http.Error(w, i18n.T("Internal Server Error"), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/atom+xml;profile=opds-catalog;kind=navigation;charset=utf-8")
+	fmt.Fprint(w, opdsFeedStart)
+	fmt.Fprintf(w, `<title>%s</title><id>gopds:shelves</id>`, html.EscapeString(feedTitle(i18n.T("My Shelves"))))
+	fmt.Fprintf(w, `<updated>%s</updated>`, time.Now().UTC().Format(time.RFC3339))
+	fmt.Fprint(w, `<link rel="self" href="/opds/shelves" type="application/atom+xml;profile=opds-catalog;kind=navigation"/>`)
+	fmt.Fprint(w, `<link rel="start" href="/opds" type="application/atom+xml;profile=opds-catalog;kind=navigation"/>`)
+	fmt.Fprint(w, fhComplete)
+	for _, shelf := range shelves {
+		fmt.Fprintf(w, `
+    <entry>
+        <title>%s (%d)</title>
+        <id>gopds:shelf:%d</id>
+        <updated>%s</updated>`,
+			html.EscapeString(shelf.Name), shelf.BookCount, shelf.ID, shelf.UpdatedAt.UTC().Format(time.RFC3339))
+		if shelf.Description != "" {
+			fmt.Fprintf(w, `<content type="text">%s</content>`, html.EscapeString(shelf.Description))
+		}
+		fmt.Fprintf(w, `
+        <link rel="subsection" href="/opds/shelves/%d" type="application/atom+xml;profile=opds-catalog;kind=acquisition"/>
+    </entry>`, shelf.ID)
+	}
+	fmt.Fprint(w, `</feed>`)
+}
+
+// HandleShelfCatalog is the OPDS acquisition feed for one shelf, paginated
+// like the category feeds.
+func (s *Server) HandleShelfCatalog(w http.ResponseWriter, r *http.Request) {
+	shelf, ok := s.loadShelf(w, r)
+	if !ok {
+		return
+	}
+	p := parseFeedPage(r, fmt.Sprintf("/opds/shelves/%d", shelf.ID), shelf.BookCount)
+
+	books, err := s.db.ShelfBooks(shelf.ID, s.bookFilter(r), p.limit, p.offset())
+	if err != nil {
+		http.Error(w, i18n.T("Internal Server Error"), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/atom+xml;profile=opds-catalog;kind=acquisition;charset=utf-8")
+	fmt.Fprint(w, opdsFeedStart)
+	fmt.Fprintf(w, `<title>%s</title>`, html.EscapeString(feedTitle(fmt.Sprintf("%s (%d)", shelf.Name, shelf.BookCount))))
+	fmt.Fprintf(w, `<id>gopds:shelf:%d</id>`, shelf.ID)
+	fmt.Fprintf(w, `<updated>%s</updated>`, shelf.UpdatedAt.UTC().Format(time.RFC3339))
+	fmt.Fprintf(w, `<link rel="self" href="%s" type="application/atom+xml;profile=opds-catalog;kind=acquisition"/>`, html.EscapeString(p.href(p.page)))
+	fmt.Fprint(w, `<link rel="up" href="/opds/shelves" type="application/atom+xml;profile=opds-catalog;kind=navigation"/>`)
+	p.writeLinks(w)
+	for _, b := range books {
+		writeOPDSEntry(w, b)
+	}
+	fmt.Fprint(w, `</feed>`)
+}
@@ -0,0 +1,292 @@
+package web
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/ab0oo/gopds/internal/database"
+	"github.com/ab0oo/gopds/internal/i18n"
+	"github.com/go-chi/chi/v5"
+)
+
+// Similarity weights. A shared series is the strongest signal, then a
+// shared author; subjects and description keywords break ties between
+// otherwise unrelated books.
+const (
+	similarSeriesWeight      = 5.0
+	similarAuthorWeight      = 3.0
+	similarSubjectWeight     = 1.5
+	similarMaxSubjectScore   = 4.5
+	similarKeywordWeight     = 3.0
+	similarMinSharedKeywords = 2
+	relatedBlockSize         = 5
+)
+
+type relatedBook struct {
+	ID          int      `json:"id"`
+	Title       string   `json:"title"`
+	Author      string   `json:"author"`
+	Series      string   `json:"series,omitempty"`
+	SeriesIndex string   `json:"series_index,omitempty"`
+	Score       float64  `json:"score"`
+	Reasons     []string `json:"reasons"`
+}
+
+type similarPayload struct {
+	BookID int           `json:"book_id"`
+	Books  []relatedBook `json:"books"`
+}
+
+type bookDetailPayload struct {
+	database.Book
+	Subjects []string      `json:"subjects"`
+	Genres   []string      `json:"genres"`
+	Related  []relatedBook `json:"related"`
+}
+
+// bookFeatures is what a book is compared on, normalized once.
+type bookFeatures struct {
+	authors  map[string]bool
+	series   string
+	subjects map[string]bool
+	keywords map[string]bool
+}
+
+var htmlTagPattern = regexp.MustCompile(`<[^>]*>`)
+
+var keywordStopwords = map[string]bool{
+	"about": true, "after": true, "again": true, "also": true, "among": true, "another": true,
+	"because": true, "been": true, "before": true, "being": true, "between": true, "book": true,
+	"both": true, "could": true, "does": true, "down": true, "each": true, "even": true,
+	"every": true, "first": true, "from": true, "have": true, "into": true, "just": true,
+	"like": true, "made": true, "make": true, "many": true, "more": true, "most": true,
+	"much": true, "must": true, "never": true, "novel": true, "only": true, "other": true,
+	"over": true, "said": true, "same": true, "should": true, "since": true, "some": true,
+	"story": true, "such": true, "than": true, "that": true, "their": true, "them": true,
+	"then": true, "there": true, "these": true, "they": true, "this": true, "those": true,
+	"through": true, "time": true, "under": true, "until": true, "upon": true, "very": true,
+	"were": true, "what": true, "when": true, "where": true, "which": true, "while": true,
+	"will": true, "with": true, "within": true, "without": true, "world": true, "would": true,
+	"year": true, "years": true, "your": true,
+}
+
+func featuresOf(b database.Book, subjects []string) bookFeatures {
+	f := bookFeatures{
+		authors:  map[string]bool{},
+		series:   strings.ToLower(strings.TrimSpace(b.Series)),
+		subjects: map[string]bool{},
+		keywords: map[string]bool{},
+	}
+	for _, a := range strings.FieldsFunc(b.Author, func(r rune) bool { return r == '&' || r == ';' }) {
+		if key := authorKey(a); key != "" && key != "author unknown" {
+			f.authors[key] = true
+		}
+	}
+	for _, s := range subjects {
+		if s = strings.ToLower(strings.TrimSpace(s)); s != "" {
+			f.subjects[s] = true
+		}
+	}
+	text := html.UnescapeString(htmlTagPattern.ReplaceAllString(b.Description, " "))
+	for _, word := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool { return !unicode.IsLetter(r) }) {
+		if len(word) >= 4 && !keywordStopwords[word] {
+			f.keywords[word] = true
+		}
+	}
+	return f
+}
+
+// authorKey normalizes a name so "J.R.R. Tolkien" and "Tolkien, J. R. R."
+// compare equal: lowercase letter runs, sorted.
+func authorKey(name string) string {
+	parts := strings.FieldsFunc(strings.ToLower(name), func(r rune) bool { return !unicode.IsLetter(r) })
+	sort.Strings(parts)
+	return strings.Join(parts, " ")
+}
+
+// similarity scores how related two books are and says why; zero means
+// unrelated.
+func similarity(a, b bookFeatures) (float64, []string) {
+	var score float64
+	var reasons []string
+	if a.series != "" && a.series == b.series {
+		score += similarSeriesWeight
+		reasons = append(reasons, "series")
+	}
+	for author := range a.authors {
+		if b.authors[author] {
+			score += similarAuthorWeight
+			reasons = append(reasons, "author")
+			break
+		}
+	}
+	var shared []string
+	for s := range a.subjects {
+		if b.subjects[s] {
+			shared = append(shared, s)
+		}
+	}
+	if len(shared) > 0 {
+		score += min(float64(len(shared))*similarSubjectWeight, similarMaxSubjectScore)
+		sort.Strings(shared)
+		reasons = append(reasons, "subjects: "+strings.Join(shared, ", "))
+	}
+	common := 0
+	for w := range a.keywords {
+		if b.keywords[w] {
+			common++
+		}
+	}
+	if common >= similarMinSharedKeywords {
+		union := len(a.keywords) + len(b.keywords) - common
+		score += similarKeywordWeight * float64(common) / float64(union)
+		reasons = append(reasons, "description")
+	}
+	return score, reasons
+}
+
+// similarBooks ranks every other book f allows against book, highest score
+// first, and returns up to limit of them.
+func (s *Server) similarBooks(book *database.Book, f database.BookFilter, limit int) ([]relatedBook, error) {
+	subjects, err := s.db.GetBookSubjects(book.ID)
+	if err != nil {
+		return nil, err
+	}
+	target := featuresOf(*book, subjects)
+
+	ranked := []relatedBook{}
+	err = s.db.ForEachBookWithSubjects(f, func(b database.Book, subjects []string) error {
+		if b.ID == book.ID {
+			return nil
+		}
+		score, reasons := similarity(target, featuresOf(b, subjects))
+		if score <= 0 {
+			return nil
+		}
+		ranked = append(ranked, relatedBook{
+			ID:          b.ID,
+			Title:       b.Title,
+			Author:      b.Author,
+			Series:      b.Series,
+			SeriesIndex: b.SeriesIndex,
+			Score:       float64(int(score*100+0.5)) / 100,
+			Reasons:     reasons,
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(ranked, func(i, j int) bool {
+		if ranked[i].Score != ranked[j].Score {
+			return ranked[i].Score > ranked[j].Score
+		}
+		return strings.ToLower(ranked[i].Title) < strings.ToLower(ranked[j].Title)
+	})
+	if len(ranked) > limit {
+		ranked = ranked[:limit]
+	}
+	return ranked, nil
+}
+
+// loadBook resolves {id} to a book, writing 404 or 500 if it can't.
+func (s *Server) loadBook(w http.ResponseWriter, r *http.Request) (*database.Book, bool) {
+	book, err := s.visibleBook(r, chi.URLParam(r, "id"))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, i18n.T("Book not found"), http.StatusNotFound)
+			return nil, false
+		}
+		http.Error(w, i18n.T("Internal Server Error"), http.StatusInternalServerError)
+		return nil, false
+	}
+	return book, true
+}
+
+// HandleBook returns one book's catalog record with its subjects and a short
+// list of related books.
+func (s *Server) HandleBook(w http.ResponseWriter, r *http.Request) {
+	book, ok := s.loadBook(w, r)
+	if !ok {
+		return
+	}
+	subjects, err := s.db.GetBookSubjects(book.ID)
+	if err != nil {
+		http.Error(w, i18n.T("Internal Server Error"), http.StatusInternalServerError)
+		return
+	}
+	related, err := s.similarBooks(book, s.bookFilter(r), relatedBlockSize)
+	if err != nil {
+		http.Error(w, i18n.T("Internal Server Error"), http.StatusInternalServerError)
+		return
+	}
+	if subjects == nil {
+		subjects = []string{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	genres := s.genres.Map(subjects)
+	if genres == nil {
+		genres = []string{}
+	}
+	_ = json.NewEncoder(w).Encode(bookDetailPayload{Book: *book, Subjects: subjects, Genres: genres, Related: related})
+}
+
+func (s *Server) HandleSimilarBooks(w http.ResponseWriter, r *http.Request) {
+	limit := parseIntDefault(r.URL.Query().Get("limit"), 10)
+	if limit < 1 || limit > 50 {
+		http.Error(w, i18n.T("limit must be between 1 and 50"), http.StatusBadRequest)
+		return
+	}
+	book, ok := s.loadBook(w, r)
+	if !ok {
+		return
+	}
+	related, err := s.similarBooks(book, s.bookFilter(r), limit)
+	if err != nil {
+		http.Error(w, i18n.T("Internal Server Error"), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(similarPayload{BookID: book.ID, Books: related})
+}
+
+// HandleSimilarCatalog is the OPDS acquisition feed behind each entry's
+// related link.
+func (s *Server) HandleSimilarCatalog(w http.ResponseWriter, r *http.Request) {
+	book, ok := s.loadBook(w, r)
+	if !ok {
+		return
+	}
+	related, err := s.similarBooks(book, s.bookFilter(r), 25)
+	if err != nil {
+		http.Error(w, i18n.T("Internal Server Error"), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/atom+xml;profile=opds-catalog;kind=acquisition;charset=utf-8")
+	fmt.Fprint(w, opdsFeedStart)
+	fmt.Fprintf(w, `<title>%s</title>`, html.EscapeString(feedTitle(i18n.T("Similar to %s", book.Title))))
+	fmt.Fprintf(w, `<id>gopds:similar:%d</id>`, book.ID)
+	fmt.Fprintf(w, `<updated>%s</updated>`, time.Now().UTC().Format(time.RFC3339))
+	fmt.Fprintf(w, `<link rel="self" href="/opds/books/%d/similar" type="application/atom+xml;profile=opds-catalog;kind=acquisition"/>`, book.ID)
+	fmt.Fprint(w, `<link rel="start" href="/opds" type="application/atom+xml;profile=opds-catalog;kind=navigation"/>`)
+	fmt.Fprint(w, fhComplete)
+	for _, rb := range related {
+		b, err := s.db.GetBookByID(strconv.Itoa(rb.ID))
+		if err != nil {
+			continue
+		}
+		writeOPDSEntry(w, *b)
+	}
+	fmt.Fprint(w, `</feed>`)
+}
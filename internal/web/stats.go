@@ -0,0 +1,86 @@
+package web
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ab0oo/gopds/internal/database"
+	"github.com/ab0oo/gopds/internal/i18n"
+)
+
+type statsPayload struct {
+	Books   int `json:"books"`
+	Authors int `json:"authors"`
+	Series  int `json:"series"`
+	// Downloads is the signed-in caller's usage and quota.
+	Downloads *downloadUsagePayload `json:"downloads,omitempty"`
+	// Users and Anonymous are only reported to admins.
+	Users     []downloadUsagePayload `json:"users,omitempty"`
+	Anonymous *anonymousDownloads    `json:"anonymous_downloads,omitempty"`
+}
+
+type anonymousDownloads struct {
+	Today database.DownloadUsage `json:"today"`
+	Month database.DownloadUsage `json:"month"`
+}
+
+// HandleStats reports library totals as the caller sees them, the caller's
+// download usage, and for admins everyone's usage.
+func (s *Server) HandleStats(w http.ResponseWriter, r *http.Request) {
+	p, signedIn := s.principal(r)
+	var payload statsPayload
+	var err error
+	payload.Books, payload.Authors, payload.Series, err = s.db.LibraryCounts(s.principalFilter(p))
+	if err != nil {
+		http.Error(w, i18n.T("Failed to count books"), http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now()
+	if signedIn && p.TokenID == 0 {
+		if user, err := s.db.GetUserByName(p.Name); err == nil {
+			usage, err := s.downloadUsage(user, now)
+			if err != nil {
+				http.Error(w, i18n.T("Failed to read download usage"), http.StatusInternalServerError)
+				return
+			}
+			payload.Downloads = &usage
+		}
+	}
+	if signedIn && p.has(scopeAdmin) {
+		if err := s.fillAdminStats(&payload, now); err != nil {
+			slog.ErrorContext(r.Context(), "failed to read download usage", "err", err)
+			http.Error(w, i18n.T("Failed to read download usage"), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(payload)
+}
+
+func (s *Server) fillAdminStats(payload *statsPayload, now time.Time) error {
+	dayStart, _, monthStart, _ := quotaPeriods(now)
+	today, err := s.db.DownloadUsageByUser(dayStart)
+	if err != nil {
+		return err
+	}
+	month, err := s.db.DownloadUsageByUser(monthStart)
+	if err != nil {
+		return err
+	}
+	users, err := s.db.ListUsers()
+	if err != nil {
+		return err
+	}
+	payload.Users = make([]downloadUsagePayload, 0, len(users))
+	for i := range users {
+		key := strings.ToLower(users[i].Username)
+		payload.Users = append(payload.Users, s.quotaUsage(&users[i], today[key], month[key], now))
+	}
+	payload.Anonymous = &anonymousDownloads{Today: today[""], Month: month[""]}
+	return nil
+}
@@ -0,0 +1,124 @@
+package web
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/ab0oo/gopds/internal/i18n"
+)
+
+const (
+	// defaultTimelineDays is how far back day buckets go without ?since=.
+	defaultTimelineDays = 90
+	// maxTimelinePoints keeps a far-back ?since= with day buckets from
+	// producing an unbounded series.
+	maxTimelinePoints = 3660
+)
+
+type timelinePayload struct {
+	Bucket string          `json:"bucket"`
+	Points []timelinePoint `json:"points"`
+}
+
+// timelinePoint is one day or month of library growth. Sources maps each
+// way books arrive (scan, watch, import) to how many it added.
+type timelinePoint struct {
+	Period  string         `json:"period"`
+	Added   int            `json:"added"`
+	Sources map[string]int `json:"sources"`
+	// Total is the size of the library at the end of the period.
+	Total int `json:"total"`
+}
+
+// HandleTimeline charts library growth: books added per day or month, by
+// how they arrived, with the running total. Only books still in the
+// library and visible to the caller are counted.
+func (s *Server) HandleTimeline(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	bucket := q.Get("bucket")
+	if bucket == "" {
+		bucket = "month"
+	}
+	if bucket != "day" && bucket != "month" {
+		http.Error(w, i18n.T("bucket must be day or month"), http.StatusBadRequest)
+		return
+	}
+	filter := s.bookFilter(r)
+	now := time.Now().UTC()
+
+	var since time.Time
+	if raw := q.Get("since"); raw != "" {
+		t, err := time.Parse("2006-01-02", raw)
+		if err != nil {
+			http.Error(w, i18n.T("since must be a date like 2006-01-02"), http.StatusBadRequest)
+			return
+		}
+		since = t
+	} else if bucket == "day" {
+		since = time.Date(now.Year(), now.Month(), now.Day()-defaultTimelineDays+1, 0, 0, 0, 0, time.UTC)
+	} else {
+		first, err := s.db.FirstBookAdded(filter)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "failed to read library timeline", "err", err)
+			http.Error(w, i18n.T("Internal Server Error"), http.StatusInternalServerError)
+			return
+		}
+		since = first
+		if since.IsZero() {
+			since = now
+		}
+	}
+	// Start on a period boundary, so the first point covers all of it.
+	since = time.Date(since.Year(), since.Month(), since.Day(), 0, 0, 0, 0, time.UTC)
+	step, layout := func(t time.Time) time.Time { return t.AddDate(0, 0, 1) }, "2006-01-02"
+	if bucket == "month" {
+		since = time.Date(since.Year(), since.Month(), 1, 0, 0, 0, 0, time.UTC)
+		step, layout = func(t time.Time) time.Time { return t.AddDate(0, 1, 0) }, "2006-01"
+	}
+
+	payload := timelinePayload{Bucket: bucket, Points: []timelinePoint{}}
+	index := map[string]int{}
+	for t := since; !t.After(now); t = step(t) {
+		if len(payload.Points) == maxTimelinePoints {
+			http.Error(w, i18n.T("Too many points; use a later since or month buckets"), http.StatusBadRequest)
+			return
+		}
+		period := t.Format(layout)
+		index[period] = len(payload.Points)
+		payload.Points = append(payload.Points, timelinePoint{Period: period, Sources: map[string]int{}})
+	}
+
+	total, err := s.db.CountBooksAddedBefore(filter, since)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to read library timeline", "err", err)
+		http.Error(w, i18n.T("Internal Server Error"), http.StatusInternalServerError)
+		return
+	}
+	additions, err := s.db.BookAdditionsSince(filter, since, bucket == "month")
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to read library timeline", "err", err)
+		http.Error(w, i18n.T("Internal Server Error"), http.StatusInternalServerError)
+		return
+	}
+	for _, a := range additions {
+		i, ok := index[a.Period]
+		if !ok {
+			// Recorded with a clock ahead of this one.
+			i = len(payload.Points) - 1
+		}
+		if i < 0 {
+			continue
+		}
+		payload.Points[i].Added += a.Books
+		payload.Points[i].Sources[a.Source] += a.Books
+	}
+	for i := range payload.Points {
+		total += payload.Points[i].Added
+		payload.Points[i].Total = total
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(payload)
+}
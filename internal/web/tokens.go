@@ -0,0 +1,258 @@
+package web
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ab0oo/gopds/internal/database"
+	"github.com/ab0oo/gopds/internal/i18n"
+	"github.com/go-chi/chi/v5"
+)
+
+// Token scopes. A session login holds the scopes of the user's role; a
+// bearer token holds the scopes it was created with. "admin" implies the
+// others.
+const (
+	scopeOPDS     = "opds"     // read the catalog and download books
+	scopeMetadata = "metadata" // edit metadata and covers, view/revert history
+	scopeAdmin    = "admin"    // everything else: scans, jobs, backups, tokens
+)
+
+var allScopes = []string{scopeOPDS, scopeMetadata, scopeAdmin}
+
+const apiTokenPrefix = "gopds_"
+
+// tokenTouchInterval limits how often last_used_at is written for a token
+// that is being used continuously.
+const tokenTouchInterval = time.Minute
+
+// principal is whoever a request is authenticated as.
+type principal struct {
+	Name    string
+	Role    string // empty for bearer tokens
+	Scopes  []string
+	TokenID int64 // zero for cookie sessions
+	Filter  database.BookFilter
+}
+
+func (p principal) has(scope string) bool {
+	return slices.Contains(p.Scopes, scopeAdmin) || slices.Contains(p.Scopes, scope)
+}
+
+type createTokenRequest struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+}
+
+type createTokenPayload struct {
+	// Token is the secret; it is only ever returned here.
+	Token    string            `json:"token"`
+	APIToken database.APIToken `json:"api_token"`
+}
+
+type tokensPayload struct {
+	Tokens []database.APIToken `json:"tokens"`
+}
+
+// principal authenticates r by bearer token if an Authorization header is
+// present, then by Basic credentials on the OPDS routes, falling back to the
+// session cookie otherwise. Bad credentials in the header fail outright
+// rather than falling through to the cookie.
+func (s *Server) principal(r *http.Request) (principal, bool) {
+	if raw, ok := bearerToken(r); ok {
+		return s.tokenPrincipal(r, raw)
+	}
+	if username, password, ok := r.BasicAuth(); ok && acceptsBasicAuth(r) {
+		name, ok := s.basicAuthUser(r, username, password)
+		if !ok {
+			return principal{}, false
+		}
+		return s.userPrincipal(r, name)
+	}
+	if p, ok, handled := s.proxyPrincipal(r); handled {
+		return p, ok
+	}
+	username, ok := s.sessionUser(r)
+	if !ok {
+		return principal{}, false
+	}
+	return s.userPrincipal(r, username)
+}
+
+// userPrincipal loads a signed-in account. The role is read on every request
+// so a change applies to sessions that are already signed in.
+func (s *Server) userPrincipal(r *http.Request, username string) (principal, bool) {
+	user, err := s.db.GetUserByName(username)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			slog.ErrorContext(r.Context(), "session user lookup failed", "username", username, "err", err)
+		}
+		return principal{}, false
+	}
+	return principal{Name: user.Username, Role: user.Role, Scopes: roleScopes[user.Role], Filter: user.Filter()}, true
+}
+
+func bearerToken(r *http.Request) (string, bool) {
+	header := strings.TrimSpace(r.Header.Get("Authorization"))
+	if header == "" {
+		return "", false
+	}
+	scheme, token, ok := strings.Cut(header, " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	return strings.TrimSpace(token), true
+}
+
+func (s *Server) tokenPrincipal(r *http.Request, raw string) (principal, bool) {
+	if !strings.HasPrefix(raw, apiTokenPrefix) {
+		return principal{}, false
+	}
+	tok, err := s.db.GetAPITokenByHash(hashAPIToken(raw))
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			slog.ErrorContext(r.Context(), "api token lookup failed", "err", err)
+		}
+		return principal{}, false
+	}
+	if tok.Revoked() {
+		return principal{}, false
+	}
+	if now := time.Now().UTC(); now.Sub(tok.LastUsedAt) > tokenTouchInterval {
+		if err := s.db.TouchAPIToken(tok.ID, now); err != nil {
+			slog.WarnContext(r.Context(), "failed to record api token use", "token_id", tok.ID, "err", err)
+		}
+	}
+	return principal{Name: "token:" + tok.Name, Scopes: tok.Scopes, TokenID: tok.ID}, true
+}
+
+// requireScope allows sessions whose role grants scope and bearer tokens
+// holding it. Every protected route goes through it.
+func (s *Server) requireScope(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p, ok := s.principal(r)
+		if !ok {
+			challengeBasic(w, r)
+			http.Error(w, i18n.T("Unauthorized"), http.StatusUnauthorized)
+			return
+		}
+		if !p.has(scope) {
+			if p.TokenID != 0 {
+				http.Error(w, i18n.T("Forbidden: token lacks the %s scope", scope), http.StatusForbidden)
+				return
+			}
+			http.Error(w, i18n.T("Forbidden: the %s role lacks the %s scope", p.Role, scope), http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// requirePublic lets anonymous requests through while the given public_*
+// setting is on; otherwise it needs any signed-in user or token with the
+// opds scope.
+func (s *Server) requirePublic(key string, next http.HandlerFunc) http.HandlerFunc {
+	signedIn := s.requireScope(scopeOPDS, next)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.settings.Bool(key) {
+			next(w, r)
+			return
+		}
+		signedIn(w, r)
+	}
+}
+
+func hashAPIToken(raw string) string {
+	sum := sha256.Sum256([]byte(raw))
+	return hex.EncodeToString(sum[:])
+}
+
+func generateAPIToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return apiTokenPrefix + hex.EncodeToString(buf), nil
+}
+
+func (s *Server) HandleListTokens(w http.ResponseWriter, r *http.Request) {
+	tokens, err := s.db.ListAPITokens()
+	if err != nil {
+		http.Error(w, i18n.T("Internal Server Error"), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(tokensPayload{Tokens: tokens})
+}
+
+func (s *Server) HandleCreateToken(w http.ResponseWriter, r *http.Request) {
+	var req createTokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, i18n.T("Invalid JSON body"), http.StatusBadRequest)
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		http.Error(w, i18n.T("Token name is required"), http.StatusBadRequest)
+		return
+	}
+	scopes := make([]string, 0, len(req.Scopes))
+	for _, scope := range req.Scopes {
+		scope = strings.ToLower(strings.TrimSpace(scope))
+		if !slices.Contains(allScopes, scope) {
+			http.Error(w, i18n.T("Unknown scope %q. Use %s", scope, strings.Join(allScopes, ", ")), http.StatusBadRequest)
+			return
+		}
+		if !slices.Contains(scopes, scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+	if len(scopes) == 0 {
+		scopes = []string{scopeOPDS}
+	}
+
+	raw, err := generateAPIToken()
+	if err != nil {
+		http.Error(w, i18n.T("Failed to generate token"), http.StatusInternalServerError)
+		return
+	}
+	tok, err := s.db.CreateAPIToken(req.Name, hashAPIToken(raw), raw[:len(apiTokenPrefix)+6], scopes)
+	if err != nil {
+		http.Error(w, i18n.T("Failed to store token"), http.StatusInternalServerError)
+		return
+	}
+	slog.InfoContext(r.Context(), "api token created", "token_id", tok.ID, "name", tok.Name, "scopes", strings.Join(scopes, ","), "by", s.actorName(r))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(createTokenPayload{Token: raw, APIToken: *tok})
+}
+
+func (s *Server) HandleRevokeToken(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "tokenID"), 10, 64)
+	if err != nil {
+		http.Error(w, i18n.T("Invalid token ID"), http.StatusBadRequest)
+		return
+	}
+	ok, err := s.db.RevokeAPIToken(id)
+	if err != nil {
+		http.Error(w, i18n.T("Internal Server Error"), http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.Error(w, i18n.T("Token not found"), http.StatusNotFound)
+		return
+	}
+	slog.InfoContext(r.Context(), "api token revoked", "token_id", id, "by", s.actorName(r))
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,285 @@
+package web
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"image/png"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ab0oo/gopds/internal/database"
+	"github.com/ab0oo/gopds/internal/i18n"
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+)
+
+// Two-factor authentication with time-based one-time passwords (RFC 6238),
+// for local accounts. Enrollment stores a pending secret that only takes
+// effect once the user proves their authenticator app has it.
+
+const (
+	totpIssuer        = "GoPDS"
+	totpPeriod        = 30
+	recoveryCodeCount = 10
+)
+
+// recoveryAlphabet leaves out characters that are easy to misread.
+const recoveryAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+type totpEnrollRequest struct {
+	Password string `json:"password"`
+}
+
+type totpEnrollPayload struct {
+	Secret string `json:"secret"`
+	// URI is the otpauth:// provisioning URI that QR is an image of.
+	URI string `json:"uri"`
+	// QR is a PNG data URL for authenticator apps to scan.
+	QR string `json:"qr"`
+}
+
+type totpCodeRequest struct {
+	Code string `json:"code"`
+}
+
+type totpDisableRequest struct {
+	Password string `json:"password"`
+	// Code is a current authenticator code or an unused recovery code.
+	Code string `json:"code"`
+}
+
+type recoveryCodesPayload struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+// totpAccount loads the signed-in local account for the two-factor
+// endpoints. Tokens and external accounts have nothing to protect with it.
+func (s *Server) totpAccount(w http.ResponseWriter, r *http.Request) (*database.User, bool) {
+	p, ok := s.principal(r)
+	if !ok {
+		http.Error(w, i18n.T("Unauthorized"), http.StatusUnauthorized)
+		return nil, false
+	}
+	if p.TokenID != 0 {
+		http.Error(w, i18n.T("Two-factor settings need a signed-in session"), http.StatusForbidden)
+		return nil, false
+	}
+	user, err := s.db.GetUserByName(p.Name)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, i18n.T("Unauthorized"), http.StatusUnauthorized)
+			return nil, false
+		}
+		http.Error(w, i18n.T("Internal Server Error"), http.StatusInternalServerError)
+		return nil, false
+	}
+	if user.Source != database.UserSourceLocal {
+		http.Error(w, i18n.T("Two-factor authentication is managed by your %s provider", user.Source), http.StatusConflict)
+		return nil, false
+	}
+	return user, true
+}
+
+// HandleTOTPEnroll starts two-factor enrollment for the signed-in user. The
+// secret isn't required at login until it is confirmed.
+func (s *Server) HandleTOTPEnroll(w http.ResponseWriter, r *http.Request) {
+	user, ok := s.totpAccount(w, r)
+	if !ok {
+		return
+	}
+	var req totpEnrollRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, i18n.T("Invalid JSON body"), http.StatusBadRequest)
+		return
+	}
+	if user.TOTPEnabled {
+		http.Error(w, i18n.T("Two-factor authentication is already enabled"), http.StatusConflict)
+		return
+	}
+	if _, ok := s.checkPassword(r, user.Username, req.Password); !ok {
+		http.Error(w, i18n.T("Invalid password"), http.StatusUnauthorized)
+		return
+	}
+
+	key, err := totp.Generate(totp.GenerateOpts{Issuer: totpIssuer, AccountName: user.Username, Period: totpPeriod})
+	if err != nil {
+		http.Error(w, i18n.T("Failed to generate secret"), http.StatusInternalServerError)
+		return
+	}
+	img, err := key.Image(256, 256)
+	if err != nil {
+		http.Error(w, i18n.T("Failed to render QR code"), http.StatusInternalServerError)
+		return
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		http.Error(w, i18n.T("Failed to render QR code"), http.StatusInternalServerError)
+		return
+	}
+	if _, err := s.db.SetUserTOTPSecret(user.ID, key.Secret()); err != nil {
+		http.Error(w, i18n.T("Failed to save secret"), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	_ = json.NewEncoder(w).Encode(totpEnrollPayload{
+		Secret: key.Secret(),
+		URI:    key.URL(),
+		QR:     "data:image/png;base64," + base64.StdEncoding.EncodeToString(buf.Bytes()),
+	})
+}
+
+// HandleTOTPConfirm enables two-factor once the user enters a code from the
+// enrolled secret, and returns one-time recovery codes.
+func (s *Server) HandleTOTPConfirm(w http.ResponseWriter, r *http.Request) {
+	user, ok := s.totpAccount(w, r)
+	if !ok {
+		return
+	}
+	var req totpCodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, i18n.T("Invalid JSON body"), http.StatusBadRequest)
+		return
+	}
+	if user.TOTPEnabled {
+		http.Error(w, i18n.T("Two-factor authentication is already enabled"), http.StatusConflict)
+		return
+	}
+	if user.TOTPSecret == "" {
+		http.Error(w, i18n.T("Start enrollment first"), http.StatusConflict)
+		return
+	}
+	if ok, err := s.checkTOTPCode(user, req.Code); err != nil {
+		http.Error(w, i18n.T("Internal Server Error"), http.StatusInternalServerError)
+		return
+	} else if !ok {
+		http.Error(w, i18n.T("Invalid code"), http.StatusBadRequest)
+		return
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		http.Error(w, i18n.T("Failed to generate recovery codes"), http.StatusInternalServerError)
+		return
+	}
+	if _, err := s.db.EnableUserTOTP(user.ID, hashes); err != nil {
+		http.Error(w, i18n.T("Failed to enable two-factor authentication"), http.StatusInternalServerError)
+		return
+	}
+	s.basicCache.forget(user.Username)
+	slog.InfoContext(r.Context(), "two-factor enabled", "user_id", user.ID, "username", user.Username)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	_ = json.NewEncoder(w).Encode(recoveryCodesPayload{RecoveryCodes: codes})
+}
+
+// HandleTOTPDisable turns two-factor off for the signed-in user, who must
+// give both their password and a code.
+func (s *Server) HandleTOTPDisable(w http.ResponseWriter, r *http.Request) {
+	user, ok := s.totpAccount(w, r)
+	if !ok {
+		return
+	}
+	var req totpDisableRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, i18n.T("Invalid JSON body"), http.StatusBadRequest)
+		return
+	}
+	if !user.TOTPEnabled {
+		http.Error(w, i18n.T("Two-factor authentication is not enabled"), http.StatusConflict)
+		return
+	}
+	if _, ok := s.checkPassword(r, user.Username, req.Password); !ok {
+		http.Error(w, i18n.T("Invalid password"), http.StatusUnauthorized)
+		return
+	}
+	if ok, err := s.checkSecondFactor(user, req.Code); err != nil {
+		http.Error(w, i18n.T("Internal Server Error"), http.StatusInternalServerError)
+		return
+	} else if !ok {
+		http.Error(w, i18n.T("Invalid code"), http.StatusUnauthorized)
+		return
+	}
+	if _, err := s.db.DisableUserTOTP(user.ID); err != nil {
+		http.Error(w, i18n.T("Failed to disable two-factor authentication"), http.StatusInternalServerError)
+		return
+	}
+	slog.InfoContext(r.Context(), "two-factor disabled", "user_id", user.ID, "username", user.Username, "by", user.Username)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// checkSecondFactor accepts a current authenticator code or an unused
+// recovery code, consuming whichever it was.
+func (s *Server) checkSecondFactor(user *database.User, code string) (bool, error) {
+	code = strings.TrimSpace(code)
+	if code == "" {
+		return false, nil
+	}
+	if ok, err := s.checkTOTPCode(user, code); ok || err != nil {
+		return ok, err
+	}
+	return s.db.UseRecoveryCode(user.ID, hashRecoveryCode(code))
+}
+
+// checkTOTPCode accepts a code from the current time step or either
+// neighbour, to allow for clock drift, as long as that step hasn't been used.
+func (s *Server) checkTOTPCode(user *database.User, code string) (bool, error) {
+	code = strings.ReplaceAll(strings.TrimSpace(code), " ", "")
+	if len(code) != 6 || user.TOTPSecret == "" {
+		return false, nil
+	}
+	now := time.Now().UTC()
+	for _, skew := range []int64{0, -1, 1} {
+		t := now.Add(time.Duration(skew*totpPeriod) * time.Second)
+		want, err := totp.GenerateCodeCustom(user.TOTPSecret, t, totp.ValidateOpts{Period: totpPeriod, Digits: otp.DigitsSix, Algorithm: otp.AlgorithmSHA1})
+		if err != nil {
+			return false, err
+		}
+		if want != code {
+			continue
+		}
+		return s.db.AdvanceUserTOTPStep(user.ID, t.Unix()/totpPeriod)
+	}
+	return false, nil
+}
+
+// newRecoveryCodes returns fresh codes formatted XXXXX-XXXXX, and their
+// hashes for storage.
+func newRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	buf := make([]byte, 10)
+	for i := range codes {
+		if _, err := rand.Read(buf); err != nil {
+			return nil, nil, err
+		}
+		var sb strings.Builder
+		for j, b := range buf {
+			if j == 5 {
+				sb.WriteByte('-')
+			}
+			sb.WriteByte(recoveryAlphabet[int(b)%len(recoveryAlphabet)])
+		}
+		codes[i] = sb.String()
+		hashes[i] = hashRecoveryCode(codes[i])
+	}
+	return codes, hashes, nil
+}
+
+// hashRecoveryCode ignores case, spaces, and dashes, so codes can be typed
+// loosely. The codes are random enough that a plain hash is safe to store.
+func hashRecoveryCode(code string) string {
+	code = strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(strings.TrimSpace(code)))
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
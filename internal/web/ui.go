@@ -0,0 +1,52 @@
+package web
+
+import (
+	"embed"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// UI_DIR names an on-disk directory laid over the embedded web UI. A file
+// there replaces the embedded file of the same name and anything missing
+// falls through to the embedded copy, so a theme can be a lone custom.css
+// and a rebranded UI a modified index.html, without rebuilding the binary.
+
+// overlayFS serves files from top when it has them and from base otherwise.
+type overlayFS struct {
+	top, base fs.FS
+}
+
+func (o overlayFS) Open(name string) (fs.File, error) {
+	f, err := o.top.Open(name)
+	if err == nil || !errors.Is(err, fs.ErrNotExist) {
+		return f, err
+	}
+	return o.base.Open(name)
+}
+
+// uiFromEnv returns the web UI's file system: the embedded web/ui directory,
+// overlaid with UI_DIR if it is set.
+func uiFromEnv(embedded embed.FS) (fs.FS, error) {
+	base, err := fs.Sub(embedded, "web/ui")
+	if err != nil {
+		return nil, err
+	}
+	dir := strings.TrimSpace(os.Getenv("UI_DIR"))
+	if dir == "" {
+		return base, nil
+	}
+	info, err := os.Stat(dir)
+	if err != nil {
+		slog.Warn("UI_DIR is not readable; serving the built-in UI", "dir", dir, "err", err)
+		return base, nil
+	}
+	if !info.IsDir() {
+		slog.Warn("UI_DIR is not a directory; serving the built-in UI", "dir", dir)
+		return base, nil
+	}
+	slog.Info("web ui overrides enabled", "dir", dir)
+	return overlayFS{top: os.DirFS(dir), base: base}, nil
+}
@@ -0,0 +1,478 @@
+package web
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ab0oo/gopds/internal/database"
+	"github.com/ab0oo/gopds/internal/i18n"
+	"github.com/ab0oo/gopds/internal/settings"
+	"github.com/go-chi/chi/v5"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const minPasswordLength = 8
+
+// Roles. Readers browse, download, and keep their own shelves and reading
+// progress; editors can also fix metadata and covers; admins can do
+// everything, including scans and user management.
+const (
+	roleAdmin  = "admin"
+	roleEditor = "editor"
+	roleReader = "reader"
+)
+
+var allRoles = []string{roleAdmin, roleEditor, roleReader}
+
+// roleScopes maps each role to the token scopes it grants, so sessions and
+// bearer tokens are checked by the same middleware.
+var roleScopes = map[string][]string{
+	roleAdmin:  {scopeAdmin},
+	roleEditor: {scopeOPDS, scopeMetadata},
+	roleReader: {scopeOPDS},
+}
+
+// rolesGranting lists the roles whose sessions hold scope.
+func rolesGranting(scope string) []string {
+	var roles []string
+	for _, role := range allRoles {
+		if (principal{Scopes: roleScopes[role]}).has(scope) {
+			roles = append(roles, role)
+		}
+	}
+	return roles
+}
+
+// parseRole validates a requested role; empty means fallback.
+func parseRole(raw, fallback string) (string, error) {
+	role := strings.ToLower(strings.TrimSpace(raw))
+	if role == "" {
+		return fallback, nil
+	}
+	if !slices.Contains(allRoles, role) {
+		return "", fmt.Errorf("Unknown role %q. Use %s", raw, strings.Join(allRoles, ", "))
+	}
+	return role, nil
+}
+
+// usernamePattern keeps names safe to use in Basic auth, KOReader headers,
+// and log lines.
+var usernamePattern = regexp.MustCompile(`^[A-Za-z0-9._@-]{1,64}$`)
+
+// dummyPasswordHash is compared against when a login names an unknown user,
+// so the response takes as long as a wrong password would.
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("gopds-dummy-password"), bcrypt.DefaultCost)
+
+type usersPayload struct {
+	Users []database.User `json:"users"`
+}
+
+type createUserRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	// Role defaults to reader.
+	Role string `json:"role,omitempty"`
+	// Email is optional; password reset links are sent to it.
+	Email string `json:"email,omitempty"`
+	// Categories limits the user to books in these categories; omit for
+	// the whole library.
+	Categories []string `json:"categories,omitempty"`
+	// HideAdult hides books flagged as adult content from the user.
+	HideAdult bool `json:"hide_adult,omitempty"`
+}
+
+type updateUserRequest struct {
+	Password *string `json:"password"`
+	Role     *string `json:"role"`
+	// Email replaces the address; "" clears it.
+	Email *string `json:"email"`
+	// Categories replaces the user's restrictions; [] lifts them.
+	Categories *[]string `json:"categories"`
+	HideAdult  *bool     `json:"hide_adult"`
+	// ResetTOTP turns off two-factor authentication, for a user who lost
+	// their authenticator and recovery codes.
+	ResetTOTP bool `json:"reset_totp,omitempty"`
+	// DownloadQuota replaces all of the user's quota overrides; omitted
+	// fields fall back to the server-wide settings.
+	DownloadQuota *database.DownloadQuota `json:"download_quota"`
+}
+
+// hashPassword returns the login hash and the KOReader sync key hash for
+// password.
+func hashPassword(password string) (string, string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", "", err
+	}
+	kosync, err := bcrypt.GenerateFromPassword([]byte(md5Hex(password)), bcrypt.DefaultCost)
+	if err != nil {
+		return "", "", err
+	}
+	return string(hash), string(kosync), nil
+}
+
+func validatePassword(password string) error {
+	if len(password) < minPasswordLength {
+		return fmt.Errorf("Password must be at least %d characters", minPasswordLength)
+	}
+	return nil
+}
+
+// seedAdminUser creates the first account from ADMIN_USERNAME and
+// ADMIN_PASSWORD when the users table is empty. Once any account exists the
+// variables are ignored.
+func seedAdminUser(db *database.DB) {
+	n, err := db.CountUsers()
+	if err != nil {
+		slog.Error("failed to count users", "err", err)
+		return
+	}
+	if n > 0 {
+		return
+	}
+	username := strings.TrimSpace(os.Getenv("ADMIN_USERNAME"))
+	if username == "" {
+		username = "admin"
+	}
+	password := os.Getenv("ADMIN_PASSWORD")
+	if strings.TrimSpace(password) == "" {
+		slog.Warn("no user accounts exist and ADMIN_PASSWORD is empty; authenticated features are disabled until it is set")
+		return
+	}
+	passwordHash, kosyncHash, err := hashPassword(password)
+	if err != nil {
+		slog.Error("failed to hash admin password", "err", err)
+		return
+	}
+	if _, err := db.CreateUser(username, roleAdmin, "", nil, passwordHash, kosyncHash); err != nil {
+		slog.Error("failed to create admin user", "username", username, "err", err)
+		return
+	}
+	slog.Info("created initial user from ADMIN_USERNAME/ADMIN_PASSWORD", "username", username)
+}
+
+// checkPassword returns the account if username and password match one,
+// provisioning LDAP users on their first login.
+func (s *Server) checkPassword(r *http.Request, username, password string) (*database.User, bool) {
+	user, err := s.db.GetUserByName(username)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		slog.ErrorContext(r.Context(), "user lookup failed", "username", username, "err", err)
+		return nil, false
+	}
+	// Directory accounts, and names not known locally, are checked against
+	// LDAP when it is configured.
+	if s.ldap != nil && (user == nil || user.Source == ldapSource) {
+		return s.checkLDAPPassword(r, username, password)
+	}
+	if user == nil {
+		_ = bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(password))
+		return nil, false
+	}
+	if bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)) != nil {
+		return nil, false
+	}
+	return user, true
+}
+
+// dropSessions ends every login session belonging to username and forgets
+// its cached Basic credentials.
+func (s *Server) dropSessions(username string) {
+	s.basicCache.forget(username)
+	if _, err := s.db.DeleteUserSessions(username); err != nil {
+		slog.Error("failed to delete sessions", "username", username, "err", err)
+	}
+}
+
+func (s *Server) HandleListUsers(w http.ResponseWriter, r *http.Request) {
+	users, err := s.db.ListUsers()
+	if err != nil {
+		http.Error(w, i18n.T("Internal Server Error"), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(usersPayload{Users: users})
+}
+
+func (s *Server) HandleCreateUser(w http.ResponseWriter, r *http.Request) {
+	var req createUserRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, i18n.T("Invalid JSON body"), http.StatusBadRequest)
+		return
+	}
+	req.Username = strings.TrimSpace(req.Username)
+	if !usernamePattern.MatchString(req.Username) {
+		http.Error(w, i18n.T("Username must be 1-64 letters, digits, or . _ @ -"), http.StatusBadRequest)
+		return
+	}
+	if err := validatePassword(req.Password); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	role, err := parseRole(req.Role, roleReader)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	email, err := normalizeEmail(req.Email)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	passwordHash, kosyncHash, err := hashPassword(req.Password)
+	if err != nil {
+		http.Error(w, i18n.T("Failed to hash password"), http.StatusInternalServerError)
+		return
+	}
+	user, err := s.db.CreateUser(req.Username, role, email, normalizeCategories(req.Categories), passwordHash, kosyncHash)
+	if err != nil {
+		if errors.Is(err, database.ErrUserExists) {
+			http.Error(w, i18n.T("Username already in use"), http.StatusConflict)
+			return
+		}
+		http.Error(w, i18n.T("Failed to create user"), http.StatusInternalServerError)
+		return
+	}
+	if req.HideAdult {
+		if _, err := s.db.SetUserHideAdult(user.ID, true); err != nil {
+			http.Error(w, i18n.T("Failed to create user"), http.StatusInternalServerError)
+			return
+		}
+		user.HideAdult = true
+	}
+	slog.InfoContext(r.Context(), "user created", "user_id", user.ID, "username", user.Username, "role", user.Role, "by", s.actorName(r))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(user)
+}
+
+// loadUser resolves {userID}, writing 400, 404, or 500 if it can't.
+func (s *Server) loadUser(w http.ResponseWriter, r *http.Request) (*database.User, bool) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "userID"), 10, 64)
+	if err != nil {
+		http.Error(w, i18n.T("Invalid user ID"), http.StatusBadRequest)
+		return nil, false
+	}
+	user, err := s.db.GetUser(id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, i18n.T("User not found"), http.StatusNotFound)
+			return nil, false
+		}
+		http.Error(w, i18n.T("Internal Server Error"), http.StatusInternalServerError)
+		return nil, false
+	}
+	return user, true
+}
+
+// isLastAdmin reports whether user is the only admin left, who must not be
+// demoted or deleted.
+func (s *Server) isLastAdmin(user *database.User) (bool, error) {
+	if user.Role != roleAdmin {
+		return false, nil
+	}
+	n, err := s.db.CountUsersWithRole(roleAdmin)
+	return n <= 1, err
+}
+
+// HandleUpdateUser changes an account's role, category and adult-content
+// restrictions, two-factor state, and/or password. A new password signs out all of that
+// user's sessions; role and category changes apply to them at once.
+func (s *Server) HandleUpdateUser(w http.ResponseWriter, r *http.Request) {
+	user, ok := s.loadUser(w, r)
+	if !ok {
+		return
+	}
+	var req updateUserRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, i18n.T("Invalid JSON body"), http.StatusBadRequest)
+		return
+	}
+	if req.Password != nil {
+		if err := validatePassword(*req.Password); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	var email string
+	if req.Email != nil {
+		var err error
+		if email, err = normalizeEmail(*req.Email); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if req.DownloadQuota != nil {
+		q := req.DownloadQuota
+		for _, v := range []*int{q.DailyDownloads, q.MonthlyDownloads, q.DailyMB, q.MonthlyMB} {
+			if v != nil && *v < 0 {
+				http.Error(w, i18n.T("Download quotas must be 0 (unlimited) or more"), http.StatusBadRequest)
+				return
+			}
+		}
+	}
+	if req.Role != nil {
+		role, err := parseRole(*req.Role, "")
+		if err != nil || role == "" {
+			http.Error(w, i18n.T("Role must be one of %s", strings.Join(allRoles, ", ")), http.StatusBadRequest)
+			return
+		}
+		if role != user.Role {
+			last, err := s.isLastAdmin(user)
+			if err != nil {
+				http.Error(w, i18n.T("Internal Server Error"), http.StatusInternalServerError)
+				return
+			}
+			if last {
+				http.Error(w, i18n.T("Cannot demote the last admin"), http.StatusConflict)
+				return
+			}
+			if _, err := s.db.SetUserRole(user.ID, role); err != nil {
+				http.Error(w, i18n.T("Failed to update user"), http.StatusInternalServerError)
+				return
+			}
+			slog.InfoContext(r.Context(), "user role changed", "user_id", user.ID, "username", user.Username, "from", user.Role, "to", role, "by", s.actorName(r))
+		}
+	}
+	if req.Email != nil {
+		if _, err := s.db.SetUserEmail(user.ID, email); err != nil {
+			http.Error(w, i18n.T("Failed to update user"), http.StatusInternalServerError)
+			return
+		}
+	}
+	if req.Categories != nil {
+		categories := normalizeCategories(*req.Categories)
+		if _, err := s.db.SetUserCategories(user.ID, categories); err != nil {
+			http.Error(w, i18n.T("Failed to update user"), http.StatusInternalServerError)
+			return
+		}
+		slog.InfoContext(r.Context(), "user categories changed", "user_id", user.ID, "username", user.Username, "categories", strings.Join(categories, ","), "by", s.actorName(r))
+	}
+	if req.HideAdult != nil {
+		if _, err := s.db.SetUserHideAdult(user.ID, *req.HideAdult); err != nil {
+			http.Error(w, i18n.T("Failed to update user"), http.StatusInternalServerError)
+			return
+		}
+		slog.InfoContext(r.Context(), "user adult-content filter changed", "user_id", user.ID, "username", user.Username, "hide_adult", *req.HideAdult, "by", s.actorName(r))
+	}
+	if req.DownloadQuota != nil {
+		if _, err := s.db.SetUserDownloadQuota(user.ID, *req.DownloadQuota); err != nil {
+			http.Error(w, i18n.T("Failed to update user"), http.StatusInternalServerError)
+			return
+		}
+		slog.InfoContext(r.Context(), "user download quota changed", "user_id", user.ID, "username", user.Username, "by", s.actorName(r))
+	}
+	if req.ResetTOTP && user.TOTPEnabled {
+		if _, err := s.db.DisableUserTOTP(user.ID); err != nil {
+			http.Error(w, i18n.T("Failed to update user"), http.StatusInternalServerError)
+			return
+		}
+		slog.InfoContext(r.Context(), "two-factor disabled", "user_id", user.ID, "username", user.Username, "by", s.actorName(r))
+	}
+	if req.Password != nil {
+		passwordHash, kosyncHash, err := hashPassword(*req.Password)
+		if err != nil {
+			http.Error(w, i18n.T("Failed to hash password"), http.StatusInternalServerError)
+			return
+		}
+		if _, err := s.db.SetUserPassword(user.ID, passwordHash, kosyncHash); err != nil {
+			http.Error(w, i18n.T("Failed to update user"), http.StatusInternalServerError)
+			return
+		}
+		s.dropSessions(user.Username)
+		s.loginGuard.succeed(user.Username)
+		slog.InfoContext(r.Context(), "user password changed", "user_id", user.ID, "username", user.Username, "by", s.actorName(r))
+	}
+
+	updated, err := s.db.GetUser(user.ID)
+	if err != nil {
+		http.Error(w, i18n.T("Internal Server Error"), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(updated)
+}
+
+// HandleDeleteUser removes an account and signs it out. The last admin
+// can't be deleted, so the server can't be locked out of its own API.
+func (s *Server) HandleDeleteUser(w http.ResponseWriter, r *http.Request) {
+	user, ok := s.loadUser(w, r)
+	if !ok {
+		return
+	}
+	last, err := s.isLastAdmin(user)
+	if err != nil {
+		http.Error(w, i18n.T("Internal Server Error"), http.StatusInternalServerError)
+		return
+	}
+	if last {
+		http.Error(w, i18n.T("Cannot delete the last admin"), http.StatusConflict)
+		return
+	}
+	if _, err := s.db.DeleteUser(user.ID); err != nil {
+		http.Error(w, i18n.T("Failed to delete user"), http.StatusInternalServerError)
+		return
+	}
+	s.dropSessions(user.Username)
+	slog.InfoContext(r.Context(), "user deleted", "user_id", user.ID, "username", user.Username, "by", s.actorName(r))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) recordLogin(r *http.Request, user *database.User) {
+	if err := s.db.TouchUserLogin(user.ID, time.Now().UTC()); err != nil {
+		slog.WarnContext(r.Context(), "failed to record login", "user_id", user.ID, "err", err)
+	}
+}
+
+// bookFilter returns the library restrictions of whoever r is signed in as.
+func (s *Server) bookFilter(r *http.Request) database.BookFilter {
+	p, _ := s.principal(r)
+	return s.principalFilter(p)
+}
+
+// principalFilter returns p's library restrictions. Anonymous requests and
+// bearer tokens see the whole library, except that the hide_adult setting
+// hides adult content from everyone without the admin scope.
+func (s *Server) principalFilter(p principal) database.BookFilter {
+	f := p.Filter
+	if !f.HideAdult && !p.has(scopeAdmin) && s.settings.Bool(settings.HideAdult) {
+		f.HideAdult = true
+	}
+	return f
+}
+
+// visibleBook loads a book by ID, reporting sql.ErrNoRows for books the
+// caller's restrictions hide so handlers answer 404 either way.
+func (s *Server) visibleBook(r *http.Request, id string) (*database.Book, error) {
+	book, err := s.db.GetBookByID(id)
+	if err != nil {
+		return nil, err
+	}
+	if !s.bookFilter(r).Allows(*book) {
+		return nil, sql.ErrNoRows
+	}
+	return book, nil
+}
+
+// normalizeCategories trims and de-duplicates a category list.
+func normalizeCategories(in []string) []string {
+	out := []string{}
+	for _, c := range in {
+		c = strings.TrimSpace(c)
+		if c == "" || slices.ContainsFunc(out, func(o string) bool { return strings.EqualFold(o, c) }) {
+			continue
+		}
+		out = append(out, c)
+	}
+	return out
+}
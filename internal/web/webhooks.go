@@ -0,0 +1,292 @@
+package web
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ab0oo/gopds/internal/database"
+	"github.com/ab0oo/gopds/internal/i18n"
+	"github.com/ab0oo/gopds/internal/webhooks"
+	"github.com/go-chi/chi/v5"
+)
+
+type createWebhookRequest struct {
+	URL     string   `json:"url"`
+	Events  []string `json:"events"`
+	Secret  string   `json:"secret,omitempty"`
+	Enabled *bool    `json:"enabled,omitempty"`
+}
+
+type updateWebhookRequest struct {
+	Enabled bool `json:"enabled"`
+}
+
+type createWebhookPayload struct {
+	// Secret signs deliveries; it is only ever returned here.
+	Secret  string           `json:"secret"`
+	Webhook database.Webhook `json:"webhook"`
+}
+
+type webhooksPayload struct {
+	Webhooks []database.Webhook `json:"webhooks"`
+	Events   []string           `json:"events"`
+}
+
+type webhookTestPayload struct {
+	OK     bool   `json:"ok"`
+	Status int    `json:"status,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// webhookBook is the book summary carried by book events.
+type webhookBook struct {
+	ID          int    `json:"id"`
+	Title       string `json:"title"`
+	Author      string `json:"author"`
+	Series      string `json:"series,omitempty"`
+	SeriesIndex string `json:"series_index,omitempty"`
+	Category    string `json:"category,omitempty"`
+	Subcategory string `json:"subcategory,omitempty"`
+}
+
+func webhookBookOf(b database.Book) webhookBook {
+	return webhookBook{
+		ID:          b.ID,
+		Title:       b.Title,
+		Author:      b.Author,
+		Series:      b.Series,
+		SeriesIndex: b.SeriesIndex,
+		Category:    b.Category,
+		Subcategory: b.Subcategory,
+	}
+}
+
+type bookAddedEvent struct {
+	Book webhookBook `json:"book"`
+}
+
+// bookRemovedEvent is sent when a full scan no longer finds a book's file.
+// The book stays in the catalog, marked unavailable.
+type bookRemovedEvent struct {
+	Book webhookBook `json:"book"`
+}
+
+type scanCompletedEvent struct {
+	JobID           int64   `json:"job_id"`
+	Operation       string  `json:"operation"`
+	Status          string  `json:"status"`
+	Books           int     `json:"books,omitempty"`
+	DurationSeconds float64 `json:"duration_seconds"`
+	Error           string  `json:"error,omitempty"`
+}
+
+type metadataChangedEvent struct {
+	Book    webhookBook `json:"book"`
+	Action  string      `json:"action"`
+	Actor   string      `json:"actor"`
+	AuditID int64       `json:"audit_id,omitempty"`
+}
+
+type bookDownloadedEvent struct {
+	Book     webhookBook `json:"book"`
+	Format   string      `json:"format"`
+	ClientIP string      `json:"client_ip"`
+}
+
+// emitMetadataChanged publishes metadata.changed for a book whose metadata
+// or cover was just changed and recorded in the audit log.
+func (s *Server) emitMetadataChanged(r *http.Request, bookID int, action string, auditID int64) {
+	s.emitMetadataChangedBy(r.Context(), s.actorName(r), bookID, action, auditID)
+}
+
+func (s *Server) emitMetadataChangedBy(ctx context.Context, actor string, bookID int, action string, auditID int64) {
+	book, err := s.db.GetBookByID(strconv.Itoa(bookID))
+	if err != nil {
+		slog.WarnContext(ctx, "webhooks: failed to load changed book", "book_id", bookID, "err", err)
+		return
+	}
+	s.publish(ctx, webhooks.EventMetadataChanged, bookID, metadataChangedEvent{
+		Book:    webhookBookOf(*book),
+		Action:  action,
+		Actor:   actor,
+		AuditID: auditID,
+	})
+}
+
+// emitDownload sends book.downloaded. Callers skip range requests that
+// resume a download already in progress.
+func (s *Server) emitDownload(r *http.Request, book *database.Book, format string) {
+	s.hooks.Emit(r.Context(), webhooks.EventBookDownloaded, bookDownloadedEvent{
+		Book:     webhookBookOf(*book),
+		Format:   format,
+		ClientIP: clientIP(r),
+	})
+}
+
+func generateWebhookSecret() (string, error) {
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+func validateWebhookURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return errors.New("Webhook URL must be an absolute http or https URL")
+	}
+	return nil
+}
+
+func (s *Server) HandleListWebhooks(w http.ResponseWriter, r *http.Request) {
+	hooks, err := s.db.ListWebhooks()
+	if err != nil {
+		http.Error(w, i18n.T("Internal Server Error"), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(webhooksPayload{Webhooks: hooks, Events: webhooks.Events})
+}
+
+func (s *Server) HandleCreateWebhook(w http.ResponseWriter, r *http.Request) {
+	var req createWebhookRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, i18n.T("Invalid JSON body"), http.StatusBadRequest)
+		return
+	}
+	req.URL = strings.TrimSpace(req.URL)
+	if err := validateWebhookURL(req.URL); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	events := make([]string, 0, len(req.Events))
+	for _, event := range req.Events {
+		event = strings.ToLower(strings.TrimSpace(event))
+		if event != "*" && !slices.Contains(webhooks.Events, event) {
+			http.Error(w, i18n.T("Unknown event %q. Use %s, or * for all", event, strings.Join(webhooks.Events, ", ")), http.StatusBadRequest)
+			return
+		}
+		if !slices.Contains(events, event) {
+			events = append(events, event)
+		}
+	}
+
+	secret := strings.TrimSpace(req.Secret)
+	if secret == "" {
+		var err error
+		if secret, err = generateWebhookSecret(); err != nil {
+			http.Error(w, i18n.T("Failed to generate secret"), http.StatusInternalServerError)
+			return
+		}
+	}
+	enabled := req.Enabled == nil || *req.Enabled
+
+	hook, err := s.db.CreateWebhook(req.URL, secret, events, enabled)
+	if err != nil {
+		http.Error(w, i18n.T("Failed to store webhook"), http.StatusInternalServerError)
+		return
+	}
+	slog.InfoContext(r.Context(), "webhook created", "webhook_id", hook.ID, "url", hook.URL, "events", strings.Join(events, ","), "by", s.actorName(r))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(createWebhookPayload{Secret: secret, Webhook: *hook})
+}
+
+func (s *Server) HandleUpdateWebhook(w http.ResponseWriter, r *http.Request) {
+	id, ok := webhookIDParam(w, r)
+	if !ok {
+		return
+	}
+	var req updateWebhookRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, i18n.T("Invalid JSON body"), http.StatusBadRequest)
+		return
+	}
+	found, err := s.db.SetWebhookEnabled(id, req.Enabled)
+	if err != nil {
+		http.Error(w, i18n.T("Internal Server Error"), http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.Error(w, i18n.T("Webhook not found"), http.StatusNotFound)
+		return
+	}
+	hook, err := s.db.GetWebhook(id)
+	if err != nil {
+		http.Error(w, i18n.T("Internal Server Error"), http.StatusInternalServerError)
+		return
+	}
+	slog.InfoContext(r.Context(), "webhook updated", "webhook_id", id, "enabled", req.Enabled, "by", s.actorName(r))
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(hook)
+}
+
+func (s *Server) HandleDeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	id, ok := webhookIDParam(w, r)
+	if !ok {
+		return
+	}
+	found, err := s.db.DeleteWebhook(id)
+	if err != nil {
+		http.Error(w, i18n.T("Internal Server Error"), http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.Error(w, i18n.T("Webhook not found"), http.StatusNotFound)
+		return
+	}
+	slog.InfoContext(r.Context(), "webhook deleted", "webhook_id", id, "by", s.actorName(r))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleTestWebhook sends a ping event to one webhook synchronously, whether
+// or not it is enabled, and reports the outcome. It does not retry.
+func (s *Server) HandleTestWebhook(w http.ResponseWriter, r *http.Request) {
+	id, ok := webhookIDParam(w, r)
+	if !ok {
+		return
+	}
+	hook, err := s.db.GetWebhook(id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, i18n.T("Webhook not found"), http.StatusNotFound)
+			return
+		}
+		http.Error(w, i18n.T("Internal Server Error"), http.StatusInternalServerError)
+		return
+	}
+
+	status, err := s.hooks.Send(r.Context(), hook, webhooks.EventPing, map[string]any{
+		"webhook_id": hook.ID,
+		"sent_at":    time.Now().UTC(),
+	})
+	payload := webhookTestPayload{OK: err == nil, Status: status}
+	if err != nil {
+		payload.Error = err.Error()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(payload)
+}
+
+func webhookIDParam(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "webhookID"), 10, 64)
+	if err != nil {
+		http.Error(w, i18n.T("Invalid webhook ID"), http.StatusBadRequest)
+		return 0, false
+	}
+	return id, true
+}
@@ -0,0 +1,196 @@
+package web
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/ab0oo/gopds/internal/database"
+)
+
+const wikidataSPARQLEndpoint = "https://query.wikidata.org/sparql"
+
+// wikidataEnrichLimit caps how many candidates one search enriches; each
+// costs a SPARQL query.
+const wikidataEnrichLimit = 3
+
+// wikidataWorkQuery finds works whose label matches the title and that
+// have an author, with their series, ordinal, and the author's birth date.
+// %s is the escaped title.
+const wikidataWorkQuery = `SELECT ?work ?series ?seriesLabel ?ordinal ?author ?authorLabel ?birth WHERE {
+  SERVICE wikibase:mwapi {
+    bd:serviceParam wikibase:endpoint "www.wikidata.org"; wikibase:api "EntitySearch";
+      mwapi:search "%s"; mwapi:language "en".
+    ?work wikibase:apiOutputItem mwapi:item.
+  }
+  ?work wdt:P50 ?author.
+  OPTIONAL { ?work p:P179 ?membership. ?membership ps:P179 ?series. OPTIONAL { ?membership pq:P1545 ?ordinal. } }
+  OPTIONAL { ?author wdt:P569 ?birth. }
+  SERVICE wikibase:label { bd:serviceParam wikibase:language "en". }
+} LIMIT 20`
+
+type wikidataSPARQLResponse struct {
+	Results struct {
+		Bindings []map[string]struct {
+			Value string `json:"value"`
+		} `json:"bindings"`
+	} `json:"results"`
+}
+
+// wikidataWork is one matching row of wikidataWorkQuery.
+type wikidataWork struct {
+	Series   database.SeriesInfo
+	Ordinal  string
+	Author   database.AuthorInfo
+	HasMatch bool
+}
+
+// enrichWithWikidata fills in series, series index, and author details on
+// the first few candidates from Wikidata, and remembers what it finds in
+// the authors and series tables. Lookup failures are logged and leave the
+// candidates as they were.
+func (s *Server) enrichWithWikidata(ctx context.Context, client *http.Client, candidates []metadataCandidate) {
+	done := map[string]wikidataWork{}
+	for i := range candidates {
+		if i >= wikidataEnrichLimit {
+			break
+		}
+		c := &candidates[i]
+		if strings.TrimSpace(c.Title) == "" {
+			continue
+		}
+		if known, ok, err := s.db.GetAuthorInfo(c.Author); err == nil && ok && strings.TrimSpace(c.Series) != "" {
+			c.AuthorInfo = &known
+			continue
+		}
+
+		key := strings.ToLower(c.Title + "|" + c.Author)
+		work, seen := done[key]
+		if !seen {
+			var err error
+			work, err = lookupWikidataWork(client, c.Title, c.Author)
+			if err != nil {
+				slog.WarnContext(ctx, "wikidata lookup failed", "title", c.Title, "err", err)
+				continue
+			}
+			done[key] = work
+		}
+		if !work.HasMatch {
+			continue
+		}
+
+		if strings.TrimSpace(c.Series) == "" && work.Series.Name != "" {
+			c.Series, c.SeriesIndex = work.Series.Name, work.Ordinal
+		}
+		if work.Series.Name != "" {
+			if err := s.db.SaveSeriesInfo(work.Series); err != nil {
+				slog.WarnContext(ctx, "failed to save series info", "series", work.Series.Name, "err", err)
+			}
+		}
+		info := work.Author
+		if strings.TrimSpace(c.Author) != "" {
+			info.Name = c.Author
+		}
+		if err := s.db.SaveAuthorInfo(info); err != nil {
+			slog.WarnContext(ctx, "failed to save author info", "author", info.Name, "err", err)
+		}
+		c.AuthorInfo = &info
+	}
+}
+
+// lookupWikidataWork returns the first work titled title whose author's
+// name matches author (any author, if author is empty).
+func lookupWikidataWork(client *http.Client, title, author string) (wikidataWork, error) {
+	query := strings.Replace(wikidataWorkQuery, "%s", sparqlEscape(title), 1)
+	endpoint := wikidataSPARQLEndpoint + "?format=json&query=" + url.QueryEscape(query)
+
+	var decoded wikidataSPARQLResponse
+	if err := fetchJSON(client, endpoint, &decoded); err != nil {
+		return wikidataWork{}, err
+	}
+
+	var best wikidataWork
+	for _, row := range decoded.Results.Bindings {
+		label := row["authorLabel"].Value
+		if !authorNamesMatch(author, label) {
+			continue
+		}
+		w := wikidataWork{
+			Series:  database.SeriesInfo{Name: row["seriesLabel"].Value, WikidataID: wikidataEntityID(row["series"].Value)},
+			Ordinal: strings.TrimSpace(row["ordinal"].Value),
+			Author: database.AuthorInfo{
+				Name:          label,
+				CanonicalName: label,
+				BirthYear:     yearOf(row["birth"].Value),
+				WikidataID:    wikidataEntityID(row["author"].Value),
+			},
+			HasMatch: true,
+		}
+		// An unlabelled series comes back as its bare Q-id; don't offer
+		// that as a name.
+		if w.Series.Name == w.Series.WikidataID {
+			w.Series = database.SeriesInfo{}
+			w.Ordinal = ""
+		}
+		// Prefer a row that places the work in a series.
+		if !best.HasMatch || (best.Series.Name == "" && w.Series.Name != "") {
+			best = w
+		}
+		if best.Series.Name != "" && best.Ordinal != "" {
+			break
+		}
+	}
+	return best, nil
+}
+
+func sparqlEscape(s string) string {
+	s = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", " ", "\r", " ").Replace(s)
+	return strings.TrimSpace(s)
+}
+
+// wikidataEntityID turns http://www.wikidata.org/entity/Q42 into Q42.
+func wikidataEntityID(uri string) string {
+	if i := strings.LastIndex(uri, "/"); i >= 0 {
+		return uri[i+1:]
+	}
+	return uri
+}
+
+// yearOf reads the year from an xsd:dateTime such as 1952-03-11T00:00:00Z.
+func yearOf(date string) int {
+	date = strings.TrimPrefix(date, "+")
+	if len(date) < 4 {
+		return 0
+	}
+	year, err := strconv.Atoi(date[:4])
+	if err != nil {
+		return 0
+	}
+	return year
+}
+
+// authorNamesMatch reports whether two spellings of a name plausibly mean
+// the same person: their surnames agree. "Last, First" is understood.
+func authorNamesMatch(a, b string) bool {
+	if strings.TrimSpace(a) == "" {
+		return true
+	}
+	return surname(a) != "" && surname(a) == surname(b)
+}
+
+func surname(name string) string {
+	if last, _, ok := strings.Cut(name, ","); ok {
+		name = last
+	}
+	words := strings.FieldsFunc(strings.ToLower(name), func(r rune) bool {
+		return !unicode.IsLetter(r) && r != '\''
+	})
+	if len(words) == 0 {
+		return ""
+	}
+	return words[len(words)-1]
+}
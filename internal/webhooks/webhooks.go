@@ -0,0 +1,267 @@
+// Package webhooks delivers library events to configured HTTP endpoints.
+// Each delivery is a signed JSON POST; failures are retried with exponential
+// backoff while the process is running. Pending retries do not survive a
+// restart.
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ab0oo/gopds/internal/database"
+	"github.com/ab0oo/gopds/internal/logging"
+	"github.com/ab0oo/gopds/internal/metrics"
+)
+
+// Events a webhook can subscribe to.
+const (
+	EventBookAdded       = "book.added"
+	EventBookRemoved     = "book.removed"
+	EventScanCompleted   = "scan.completed"
+	EventMetadataChanged = "metadata.changed"
+	EventBookDownloaded  = "book.downloaded"
+	// EventPing is only sent by the test endpoint.
+	EventPing = "ping"
+)
+
+var Events = []string{EventBookAdded, EventBookRemoved, EventScanCompleted, EventMetadataChanged, EventBookDownloaded}
+
+// Request headers set on every delivery.
+const (
+	HeaderEvent     = "X-GoPDS-Event"
+	HeaderDelivery  = "X-GoPDS-Delivery"
+	HeaderSignature = "X-GoPDS-Signature"
+)
+
+const (
+	queueSize      = 256
+	workers        = 2
+	requestTimeout = 10 * time.Second
+	retryBase      = 5 * time.Second
+)
+
+// Envelope is the JSON body of a delivery.
+type Envelope struct {
+	ID        string    `json:"id"`
+	Event     string    `json:"event"`
+	CreatedAt time.Time `json:"created_at"`
+	Data      any       `json:"data"`
+}
+
+type delivery struct {
+	hookID    int64
+	event     string
+	id        string
+	body      []byte
+	attempt   int
+	requestID string
+}
+
+// Dispatcher fans events out to the webhooks stored in the database. A nil
+// *Dispatcher is valid and drops every event.
+type Dispatcher struct {
+	db     *database.DB
+	client *http.Client
+	queue  chan delivery
+	wg     sync.WaitGroup
+}
+
+func New(db *database.DB) *Dispatcher {
+	return &Dispatcher{
+		db:     db,
+		client: &http.Client{Timeout: requestTimeout},
+		queue:  make(chan delivery, queueSize),
+	}
+}
+
+// Start launches the delivery workers. They exit when ctx is cancelled, and
+// retries scheduled after that are dropped.
+func (d *Dispatcher) Start(ctx context.Context) {
+	for i := 0; i < workers; i++ {
+		d.wg.Add(1)
+		go func() {
+			defer d.wg.Done()
+			d.worker(ctx)
+		}()
+	}
+}
+
+// Wait blocks until the workers have finished their current delivery and
+// exited after ctx was cancelled.
+func (d *Dispatcher) Wait() {
+	d.wg.Wait()
+}
+
+// maxAttempts is WEBHOOK_MAX_ATTEMPTS (default 5): the first try plus
+// retries after 5s, 10s, 20s, ... .
+func maxAttempts() int {
+	n, err := strconv.Atoi(strings.TrimSpace(os.Getenv("WEBHOOK_MAX_ATTEMPTS")))
+	if err != nil || n <= 0 {
+		return 5
+	}
+	return n
+}
+
+// Emit queues event for every enabled webhook subscribed to it. It never
+// blocks on delivery; if the queue is full the event is dropped and logged.
+func (d *Dispatcher) Emit(ctx context.Context, event string, data any) {
+	if d == nil {
+		return
+	}
+	hooks, err := d.db.ListWebhooks()
+	if err != nil {
+		slog.ErrorContext(ctx, "webhooks: failed to list webhooks", "event", event, "err", err)
+		return
+	}
+	var body []byte
+	var id string
+	for _, h := range hooks {
+		if !h.Enabled || !h.Wants(event) {
+			continue
+		}
+		if body == nil {
+			id = logging.NewRequestID()
+			body, err = json.Marshal(Envelope{ID: id, Event: event, CreatedAt: time.Now().UTC(), Data: data})
+			if err != nil {
+				slog.ErrorContext(ctx, "webhooks: failed to encode event", "event", event, "err", err)
+				return
+			}
+		}
+		d.enqueue(ctx, delivery{hookID: h.ID, event: event, id: id, body: body, attempt: 1, requestID: logging.RequestID(ctx)})
+	}
+}
+
+func (d *Dispatcher) enqueue(ctx context.Context, dl delivery) {
+	select {
+	case d.queue <- dl:
+	default:
+		metrics.WebhookDeliveries.Inc(dl.event, "dropped")
+		slog.WarnContext(ctx, "webhooks: queue full, dropping delivery", "webhook_id", dl.hookID, "event", dl.event, "delivery", dl.id)
+	}
+}
+
+func (d *Dispatcher) worker(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case dl := <-d.queue:
+			d.process(ctx, dl)
+		}
+	}
+}
+
+func (d *Dispatcher) process(ctx context.Context, dl delivery) {
+	if dl.requestID != "" {
+		ctx = logging.WithRequestID(ctx, dl.requestID)
+	}
+	ctx = logging.WithAttrs(ctx, slog.Int64("webhook_id", dl.hookID), slog.String("event", dl.event), slog.String("delivery", dl.id))
+
+	hook, err := d.db.GetWebhook(dl.hookID)
+	if err != nil || !hook.Enabled {
+		// Deleted or disabled since the event was queued.
+		return
+	}
+
+	status, err := d.post(ctx, hook, dl.event, dl.id, dl.body)
+	if recErr := d.db.RecordWebhookDelivery(hook.ID, time.Now().UTC(), status, errString(err)); recErr != nil {
+		slog.WarnContext(ctx, "webhooks: failed to record delivery", "err", recErr)
+	}
+	if err == nil {
+		metrics.WebhookDeliveries.Inc(dl.event, "ok")
+		slog.DebugContext(ctx, "webhooks: delivered", "status", status, "attempt", dl.attempt)
+		return
+	}
+
+	limit := maxAttempts()
+	if !retryable(status) || dl.attempt >= limit {
+		metrics.WebhookDeliveries.Inc(dl.event, "failed")
+		slog.WarnContext(ctx, "webhooks: delivery failed", "status", status, "attempt", dl.attempt, "err", err)
+		return
+	}
+
+	wait := retryBase << (dl.attempt - 1)
+	metrics.WebhookDeliveries.Inc(dl.event, "retry")
+	slog.InfoContext(ctx, "webhooks: delivery failed, will retry", "status", status, "attempt", dl.attempt, "of", limit, "retry_in", wait.String(), "err", err)
+	next := dl
+	next.attempt++
+	time.AfterFunc(wait, func() {
+		if ctx.Err() != nil {
+			return
+		}
+		d.enqueue(ctx, next)
+	})
+}
+
+// Send delivers event to hook once, synchronously, and returns the HTTP
+// status. It is used by the admin test endpoint.
+func (d *Dispatcher) Send(ctx context.Context, hook *database.Webhook, event string, data any) (int, error) {
+	id := logging.NewRequestID()
+	body, err := json.Marshal(Envelope{ID: id, Event: event, CreatedAt: time.Now().UTC(), Data: data})
+	if err != nil {
+		return 0, err
+	}
+	status, err := d.post(ctx, hook, event, id, body)
+	if recErr := d.db.RecordWebhookDelivery(hook.ID, time.Now().UTC(), status, errString(err)); recErr != nil {
+		slog.WarnContext(ctx, "webhooks: failed to record delivery", "webhook_id", hook.ID, "err", recErr)
+	}
+	return status, err
+}
+
+func (d *Dispatcher) post(ctx context.Context, hook *database.Webhook, event, id string, body []byte) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "GoPDS-Webhook/1.0 (+https://github.com/ab0oo/gopds)")
+	req.Header.Set(HeaderEvent, event)
+	req.Header.Set(HeaderDelivery, id)
+	req.Header.Set(HeaderSignature, Sign(hook.Secret, body))
+
+	res, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(res.Body, 64<<10))
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return res.StatusCode, fmt.Errorf("endpoint returned %s", res.Status)
+	}
+	return res.StatusCode, nil
+}
+
+// Sign returns the X-GoPDS-Signature value for body: "sha256=" followed by
+// the hex HMAC-SHA256 of the raw request body keyed with the secret.
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// retryable reports whether a failed attempt is worth repeating: network
+// errors, timeouts, rate limiting, and server errors are; other client
+// errors mean the request itself was rejected.
+func retryable(status int) bool {
+	return status == 0 || status == http.StatusRequestTimeout || status == http.StatusTooManyRequests || status >= 500
+}
+
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}